@@ -1,6 +1,11 @@
 // Package bittorrent implements all of the abstractions used to decouple the
 // protocol of a BitTorrent tracker from the logic of handling Announces and
 // Scrapes.
+//
+// This package is the public API shared by frontends, middleware and
+// storage, including those maintained outside of this repository. Its
+// exported types and functions are only changed incompatibly in a new major
+// version, as described in docs/compatibility.md.
 package bittorrent
 
 import (
@@ -9,6 +14,7 @@ import (
 	"time"
 
 	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/netutil"
 )
 
 // PeerID represents a peer ID.
@@ -89,11 +95,35 @@ func (i InfoHash) RawString() string {
 	return string(i[:])
 }
 
+// ReservedInfoHashPrefix is the prefix of the namespace of infohashes that is
+// reserved for internal and testing use.
+//
+// Swarms of reserved infohashes are never stored in or returned from the
+// configured storage, so that canaries, benchmarks and end-to-end tests can
+// run against a production tracker without polluting real data.
+const ReservedInfoHashPrefix = "chihaya-test"
+
+// Reserved reports whether the InfoHash is part of the namespace reserved for
+// internal and testing use.
+func (i InfoHash) Reserved() bool {
+	return string(i[:len(ReservedInfoHashPrefix)]) == ReservedInfoHashPrefix
+}
+
+// ReservedInfoHash creates an InfoHash in the reserved namespace, using as
+// much of suffix as fits after the ReservedInfoHashPrefix.
+func ReservedInfoHash(suffix []byte) InfoHash {
+	var i InfoHash
+	n := copy(i[:], ReservedInfoHashPrefix)
+	copy(i[n:], suffix)
+	return i
+}
+
 // AnnounceRequest represents the parsed parameters from an announce request.
 type AnnounceRequest struct {
 	Event           Event
 	InfoHash        InfoHash
 	Compact         bool
+	NoPeerID        bool
 	EventProvided   bool
 	NumWantProvided bool
 	IPProvided      bool
@@ -102,16 +132,33 @@ type AnnounceRequest struct {
 	Downloaded      uint64
 	Uploaded        uint64
 
+	// AlternatePeer is the endpoint of the announcing client in the address
+	// family other than the one of Peer, if the client is multi-homed as
+	// described in BEP 45.
+	// It shares the ID and the Port with Peer.
+	AlternatePeer *Peer
+
+	// ExcludedPeers are the endpoints of peers the client already knows,
+	// which are left out of the response. Their IDs are not known.
+	ExcludedPeers []Peer
+
 	Peer
 	Params
 }
 
+// MultiHomed reports whether the announcing client provided endpoints for both
+// address families.
+func (r AnnounceRequest) MultiHomed() bool {
+	return r.AlternatePeer != nil
+}
+
 // LogFields renders the current response as a set of log fields.
 func (r AnnounceRequest) LogFields() log.Fields {
 	return log.Fields{
 		"event":           r.Event,
 		"infoHash":        r.InfoHash,
 		"compact":         r.Compact,
+		"noPeerID":        r.NoPeerID,
 		"eventProvided":   r.EventProvided,
 		"numWantProvided": r.NumWantProvided,
 		"ipProvided":      r.IPProvided,
@@ -120,6 +167,8 @@ func (r AnnounceRequest) LogFields() log.Fields {
 		"downloaded":      r.Downloaded,
 		"uploaded":        r.Uploaded,
 		"peer":            r.Peer,
+		"alternatePeer":   r.AlternatePeer,
+		"excludedPeers":   len(r.ExcludedPeers),
 		"params":          r.Params,
 	}
 }
@@ -128,14 +177,34 @@ func (r AnnounceRequest) LogFields() log.Fields {
 // response.
 type AnnounceResponse struct {
 	Compact     bool
+	NoPeerID    bool
 	Complete    uint32
 	Incomplete  uint32
 	Interval    time.Duration
 	MinInterval time.Duration
 	IPv4Peers   []Peer
 	IPv6Peers   []Peer
+
+	// TrackerID is echoed by clients in subsequent announces, if not empty.
+	TrackerID string
+
+	// FailureReason, if not empty, makes the response a failure: the
+	// announce is refused with this reason instead of being answered with
+	// peers, and the peer is not added to the swarm. RetryIn tells clients
+	// when to try again, see RetryNever.
+	FailureReason string
+	RetryIn       time.Duration
+
+	// WarningMessage is shown to users by clients without failing the
+	// announce, if not empty.
+	WarningMessage string
 }
 
+// RetryNever is the AnnounceResponse.RetryIn of failures clients should not
+// retry, as defined by BEP 31. A RetryIn of zero leaves the decision to the
+// client.
+const RetryNever time.Duration = -1
+
 // LogFields renders the current response as a set of log fields.
 func (r AnnounceResponse) LogFields() log.Fields {
 	return log.Fields{
@@ -145,6 +214,9 @@ func (r AnnounceResponse) LogFields() log.Fields {
 		"minInterval": r.MinInterval,
 		"ipv4Peers":   r.IPv4Peers,
 		"ipv6Peers":   r.IPv6Peers,
+		"failure":     r.FailureReason,
+		"retryIn":     r.RetryIn,
+		"warning":     r.WarningMessage,
 	}
 }
 
@@ -170,21 +242,40 @@ func (r ScrapeRequest) LogFields() log.Fields {
 // ScrapeRequest.
 type ScrapeResponse struct {
 	Files []Scrape
+
+	// MinRequestInterval, if not zero, is the minimum time clients should
+	// wait between scrapes, which is sent as a flag defined by BEP 48 over
+	// HTTP.
+	MinRequestInterval time.Duration
 }
 
 // LogFields renders the current response as a set of Logrus fields.
 func (sr ScrapeResponse) LogFields() log.Fields {
 	return log.Fields{
-		"files": sr.Files,
+		"files":              sr.Files,
+		"minRequestInterval": sr.MinRequestInterval,
 	}
 }
 
 // Scrape represents the state of a swarm that is returned in a scrape response.
+//
+// Created and LastAnnounce are only set for scrapes whose context holds the
+// ScrapeActivityKey, if the storage tracks the activity of swarms.
+//
+// Name and Downloaders are optional keys defined by BEP 48, which are set by
+// middleware from external metadata sources and only sent over HTTP.
+// Downloaders is only sent if HasDownloaders is set.
 type Scrape struct {
-	InfoHash   InfoHash
-	Snatches   uint32
-	Complete   uint32
-	Incomplete uint32
+	InfoHash     InfoHash
+	Snatches     uint32
+	Complete     uint32
+	Incomplete   uint32
+	Created      time.Time
+	LastAnnounce time.Time
+
+	Name           string
+	Downloaders    uint32
+	HasDownloaders bool
 }
 
 // AddressFamily is the address family of an IP address.
@@ -213,6 +304,20 @@ type IP struct {
 	AddressFamily
 }
 
+// NewIP returns ip in its canonical form together with its address family.
+// IPv4 addresses mapped to IPv6 are IPv4 addresses.
+// It returns ErrInvalidIP if ip is neither an IPv4 nor an IPv6 address.
+func NewIP(ip net.IP) (IP, error) {
+	switch netutil.FamilyOf(ip) {
+	case netutil.IPv4:
+		return IP{IP: netutil.Unmap(ip), AddressFamily: IPv4}, nil
+	case netutil.IPv6:
+		return IP{IP: ip, AddressFamily: IPv6}, nil
+	default:
+		return IP{}, ErrInvalidIP
+	}
+}
+
 func (ip IP) String() string {
 	return ip.IP.String()
 }
@@ -51,3 +51,12 @@ func TestPeer_String(t *testing.T) {
 		require.Equal(t, c.expected, got)
 	}
 }
+
+func TestInfoHash_Reserved(t *testing.T) {
+	require.False(t, InfoHashFromBytes(b).Reserved())
+	require.True(t, ReservedInfoHash(nil).Reserved())
+
+	ih := ReservedInfoHash([]byte("12345678overflow"))
+	require.True(t, ih.Reserved())
+	require.Equal(t, "chihaya-test12345678", ih.RawString())
+}
@@ -0,0 +1,58 @@
+package bittorrent
+
+import (
+	"context"
+	"sync"
+)
+
+// Decision is a policy decision made while handling a request, such as where
+// the announce interval came from or how peers were selected.
+type Decision struct {
+	Name  string
+	Value string
+}
+
+// Decisions collects the Decisions made while handling a single request.
+//
+// It is safe for concurrent use.
+type Decisions struct {
+	mu        sync.Mutex
+	decisions []Decision
+}
+
+// Record records a Decision, replacing an earlier Decision of the same name.
+func (d *Decisions) Record(name, value string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for i := range d.decisions {
+		if d.decisions[i].Name == name {
+			d.decisions[i].Value = value
+			return
+		}
+	}
+	d.decisions = append(d.decisions, Decision{Name: name, Value: value})
+}
+
+// List returns the recorded Decisions in the order they were first made.
+func (d *Decisions) List() []Decision {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return append([]Decision(nil), d.decisions...)
+}
+
+type decisionsKey struct{}
+
+// DecisionsKey is a key for the context of an Announce or Scrape that
+// contains the *Decisions collected for the request.
+// It is only set by frontends that are asked to report the decisions, to
+// avoid the overhead for regular requests.
+var DecisionsKey = decisionsKey{}
+
+// RecordDecision records a Decision in the *Decisions of the context, if any.
+func RecordDecision(ctx context.Context, name, value string) {
+	if d, ok := ctx.Value(DecisionsKey).(*Decisions); ok {
+		d.Record(name, value)
+	}
+}
@@ -0,0 +1,50 @@
+package bittorrent
+
+import "net"
+
+// Sizes of peers in the compact format of BEP 23 and BEP 7.
+const (
+	compactPeerSize4 = net.IPv4len + 2
+	compactPeerSize6 = net.IPv6len + 2
+)
+
+// ErrInvalidExcludedPeers indicates excluded peers that are not in the
+// compact format.
+var ErrInvalidExcludedPeers = ClientError("invalid excluded peers")
+
+// ParseExcludedPeers parses the peers a client already knows and asks to be
+// left out of the response to its Announce.
+//
+// They are provided in the "exclude" and "exclude6" params in the compact
+// format of the "peers" and "peers6" keys of announce responses, i.e. 6 bytes
+// per IPv4 peer and 18 bytes per IPv6 peer.
+// At most max peers are returned; additional peers are ignored.
+func ParseExcludedPeers(p Params, max int) ([]Peer, error) {
+	var peers []Peer
+	for _, param := range []struct {
+		key  string
+		size int
+		af   AddressFamily
+	}{
+		{"exclude", compactPeerSize4, IPv4},
+		{"exclude6", compactPeerSize6, IPv6},
+	} {
+		s, ok := p.String(param.key)
+		if !ok {
+			continue
+		}
+		if len(s)%param.size != 0 {
+			return nil, ErrInvalidExcludedPeers
+		}
+
+		for ; len(s) > 0 && len(peers) < max; s = s[param.size:] {
+			ip := make(net.IP, param.size-2)
+			copy(ip, s)
+			peers = append(peers, Peer{
+				IP:   IP{IP: ip, AddressFamily: param.af},
+				Port: uint16(s[param.size-2])<<8 | uint16(s[param.size-1]),
+			})
+		}
+	}
+	return peers, nil
+}
@@ -0,0 +1,40 @@
+package bittorrent
+
+import (
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseExcludedPeers(t *testing.T) {
+	v4 := string([]byte{10, 0, 0, 1, 0x1a, 0xe1, 10, 0, 0, 2, 0, 1})
+	v6 := string(append(net.ParseIP("2001:db8::1"), 0, 2))
+
+	p, err := ParseURLData("/announce?exclude=" + url.QueryEscape(v4) + "&exclude6=" + url.QueryEscape(v6))
+	require.Nil(t, err)
+	peers, err := ParseExcludedPeers(p, 10)
+	require.Nil(t, err)
+	require.Equal(t, []Peer{
+		{IP: IP{IP: net.IP{10, 0, 0, 1}, AddressFamily: IPv4}, Port: 6881},
+		{IP: IP{IP: net.IP{10, 0, 0, 2}, AddressFamily: IPv4}, Port: 1},
+		{IP: IP{IP: net.ParseIP("2001:db8::1"), AddressFamily: IPv6}, Port: 2},
+	}, peers)
+
+	// Additional peers are ignored.
+	peers, err = ParseExcludedPeers(p, 1)
+	require.Nil(t, err)
+	require.Len(t, peers, 1)
+
+	p, err = ParseURLData("/announce?exclude=" + url.QueryEscape(v4[:7]))
+	require.Nil(t, err)
+	_, err = ParseExcludedPeers(p, 10)
+	require.Equal(t, ErrInvalidExcludedPeers, err)
+
+	p, err = ParseURLData("/announce")
+	require.Nil(t, err)
+	peers, err = ParseExcludedPeers(p, 10)
+	require.Nil(t, err)
+	require.Empty(t, peers)
+}
@@ -0,0 +1,23 @@
+// +build gofuzz
+
+package bittorrent
+
+// Fuzz is the entry point for fuzzing ParseURLData with go-fuzz.
+//
+// See https://github.com/dvyukov/go-fuzz for usage.
+func Fuzz(data []byte) int {
+	qp, err := ParseURLData(string(data))
+	if err != nil {
+		if qp != nil {
+			panic("query params returned with an error")
+		}
+		return 0
+	}
+
+	for _, ih := range qp.InfoHashes() {
+		if len(ih) != 20 {
+			panic("invalid info hash length")
+		}
+	}
+	return 1
+}
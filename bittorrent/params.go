@@ -2,11 +2,8 @@ package bittorrent
 
 import (
 	"errors"
-	"net/url"
 	"strconv"
 	"strings"
-
-	"github.com/chihaya/chihaya/pkg/log"
 )
 
 // Params is used to fetch (optional) request parameters from an Announce.
@@ -43,6 +40,8 @@ var ErrInvalidInfohash = ClientError("provided invalid infohash")
 
 // ErrInvalidQueryEscape is returned when a query string contains invalid
 // escapes.
+//
+// Deprecated: invalid escapes are taken literally by ParseURLData.
 var ErrInvalidQueryEscape = ClientError("invalid query escape")
 
 // QueryParams parses a URL Query and implements the Params interface with some
@@ -70,6 +69,33 @@ type RouteParam struct {
 // RouteParams is a collection of RouteParam instances.
 type RouteParams []RouteParam
 
+type clientSubnetKey struct{}
+
+// ClientSubnetKey is a key for the context of an Announce that contains the
+// client subnet asserted by a trusted proxy in front of the tracker.
+// The value is expected to be of type *net.IPNet.
+//
+// Middleware doing locality-aware peer matching should prefer this subnet over
+// the address of the announcing Peer, because the latter may belong to the
+// proxy rather than the client.
+var ClientSubnetKey = clientSubnetKey{}
+
+type unverifiedKey struct{}
+
+// UnverifiedKey is a key for the context of an Announce whose client could
+// not prove that it controls the address it announced from. Any non-nil value
+// marks the Announce as unverified.
+//
+// Unverified Announces are answered, but don't change any swarms.
+var UnverifiedKey = unverifiedKey{}
+
+type scrapeActivityKey struct{}
+
+// ScrapeActivityKey is a key for the context of a Scrape whose response
+// should include when the swarms were created and last announced to. Any
+// non-nil value requests them.
+var ScrapeActivityKey = scrapeActivityKey{}
+
 // ByName returns the value of the first RouteParam that matches the given
 // name. If no matching RouteParam is found, an empty string is returned.
 // In the event that a "catch-all" parameter is provided on the route and
@@ -98,8 +124,8 @@ func (rp RouteParams) ByName(name string) string {
 // the last value for that key is kept.
 // The only exception to this rule is the key "info_hash" which will attempt to
 // parse each value as an InfoHash and return an error if parsing fails. All
-// InfoHashes are collected and can later be retrieved by calling the InfoHashes
-// method.
+// distinct InfoHashes are collected and can later be retrieved by calling the
+// InfoHashes method.
 //
 // Also note that any error that is encountered during parsing is returned as a
 // ClientError, as this method is expected to be used to parse client-provided
@@ -123,8 +149,26 @@ func ParseURLData(urlData string) (*QueryParams, error) {
 	return q, nil
 }
 
+// Limits for queries, protecting against clients sending arbitrarily large
+// queries.
+const (
+	maxQueryParams      = 1024
+	maxQueryKeyLength   = 64
+	maxQueryValueLength = 8192
+)
+
+// ErrQueryTooLarge is returned when a query contains too many parameters or a
+// parameter that is too long.
+var ErrQueryTooLarge = ClientError("query too large")
+
 // parseQuery parses a URL query into QueryParams.
 // The query is expected to exclude the delimiting '?'.
+//
+// Unlike url.ParseQuery, parsing is lenient where real-world clients are
+// known to deviate from the spec: keys without a value have an empty value,
+// a '%' that does not start a valid escape sequence is taken literally (as
+// sent by clients that don't escape binary info hashes), keys are
+// case-insensitive and repeated identical info hashes are only returned once.
 func parseQuery(query string) (q *QueryParams, err error) {
 	// This is basically url.parseQuery, but with a map[string]string
 	// instead of map[string][]string for the values.
@@ -134,7 +178,11 @@ func parseQuery(query string) (q *QueryParams, err error) {
 		params:     make(map[string]string),
 	}
 
-	for query != "" {
+	for n := 0; query != ""; n++ {
+		if n == maxQueryParams {
+			return nil, ErrQueryTooLarge
+		}
+
 		key := query
 		if i := strings.IndexAny(key, "&;"); i >= 0 {
 			key, query = key[:i], key[i+1:]
@@ -148,38 +196,76 @@ func parseQuery(query string) (q *QueryParams, err error) {
 		if i := strings.Index(key, "="); i >= 0 {
 			key, value = key[:i], key[i+1:]
 		}
-		key, err = url.QueryUnescape(key)
-		if err != nil {
-			// QueryUnescape returns an error like "invalid escape: '%x'".
-			// But frontends record these errors to prometheus, which generates
-			// a lot of time series.
-			// We log it here for debugging instead.
-			log.Debug("failed to unescape query param key", log.Err(err))
-			return nil, ErrInvalidQueryEscape
-		}
-		value, err = url.QueryUnescape(value)
-		if err != nil {
-			// QueryUnescape returns an error like "invalid escape: '%x'".
-			// But frontends record these errors to prometheus, which generates
-			// a lot of time series.
-			// We log it here for debugging instead.
-			log.Debug("failed to unescape query param value", log.Err(err))
-			return nil, ErrInvalidQueryEscape
+		if len(key) > maxQueryKeyLength || len(value) > maxQueryValueLength {
+			return nil, ErrQueryTooLarge
 		}
 
+		key = strings.ToLower(unescapeQuery(key))
+		value = unescapeQuery(value)
+
 		if key == "info_hash" {
 			if len(value) != 20 {
 				return nil, ErrInvalidInfohash
 			}
-			q.infoHashes = append(q.infoHashes, InfoHashFromString(value))
+			q.addInfoHash(InfoHashFromString(value))
 		} else {
-			q.params[strings.ToLower(key)] = value
+			q.params[key] = value
 		}
 	}
 
 	return q, nil
 }
 
+// addInfoHash adds an InfoHash unless it was added before.
+func (qp *QueryParams) addInfoHash(ih InfoHash) {
+	for _, existing := range qp.infoHashes {
+		if existing == ih {
+			return
+		}
+	}
+	qp.infoHashes = append(qp.infoHashes, ih)
+}
+
+// unescapeQuery unescapes a key or value of a query.
+//
+// It behaves like url.QueryUnescape, but never fails: a '%' that is not
+// followed by two hexadecimal digits is kept as is.
+func unescapeQuery(s string) string {
+	if strings.IndexAny(s, "%+") == -1 {
+		return s
+	}
+
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '+':
+			b.WriteByte(' ')
+		case c == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]):
+			b.WriteByte(unhex(s[i+1])<<4 | unhex(s[i+2]))
+			i += 2
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
 // String returns a string parsed from a query. Every key can be returned as a
 // string because they are encoded in the URL as strings.
 func (qp *QueryParams) String(key string) (string, bool) {
@@ -1,7 +1,10 @@
 package bittorrent
 
 import (
+	"math/rand"
 	"net/url"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -96,6 +99,73 @@ func TestParseShouldNotPanicURLData(t *testing.T) {
 	}
 }
 
+func TestParseLenientURLData(t *testing.T) {
+	infoHash := "%00%01%02%03%04%05%06%07%08%09%0A%0B%0C%0D%0E%0F%10%11%12%13"
+	var table = []struct {
+		urlData    string
+		params     map[string]string
+		infoHashes int
+	}{
+		{"/announce?compact&port=1", map[string]string{"compact": "", "port": "1"}, 0},
+		{"/announce?PORT=1&Port=2", map[string]string{"port": "2"}, 0},
+		{"/announce?key=50%&peer_id=%zz%4", map[string]string{"key": "50%", "peer_id": "%zz%4"}, 0},
+		{"/announce?info_hash=" + infoHash + "&info_hash=" + infoHash, map[string]string{}, 1},
+		{"/announce?info_hash=%25abcdefghijklmnopqrs", map[string]string{}, 1},
+		{"/announce?info_hash=%zbcdefghijklmnopqrs", map[string]string{}, 1},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.urlData, func(t *testing.T) {
+			qp, err := ParseURLData(tt.urlData)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tt.params, qp.params) {
+				t.Fatalf("expected params %v, got %v", tt.params, qp.params)
+			}
+			if len(qp.InfoHashes()) != tt.infoHashes {
+				t.Fatalf("expected %d info hashes, got %d", tt.infoHashes, len(qp.InfoHashes()))
+			}
+		})
+	}
+}
+
+func TestParseLargeURLData(t *testing.T) {
+	var table = []string{
+		"/announce?" + strings.Repeat("a=b&", maxQueryParams+1),
+		"/announce?" + strings.Repeat("a", maxQueryKeyLength+1) + "=b",
+		"/announce?a=" + strings.Repeat("b", maxQueryValueLength+1),
+	}
+
+	for _, urlData := range table {
+		_, err := ParseURLData(urlData)
+		if err != ErrQueryTooLarge {
+			t.Fatalf("expected %v, got %v", ErrQueryTooLarge, err)
+		}
+	}
+}
+
+// TestUnescapeQueryRandom compares unescapeQuery to url.QueryUnescape for
+// random strings.
+func TestUnescapeQueryRandom(t *testing.T) {
+	const alphabet = "%+&=aF09\x00\xff"
+	r := rand.New(rand.NewSource(0))
+	for i := 0; i < 100000; i++ {
+		b := make([]byte, r.Intn(16))
+		for j := range b {
+			b[j] = alphabet[r.Intn(len(alphabet))]
+		}
+
+		got := unescapeQuery(string(b))
+		if want, err := url.QueryUnescape(string(b)); err == nil && got != want {
+			t.Fatalf("unescaping %q: expected %q, got %q", b, want, got)
+		}
+
+		// Parsing arbitrary input must not panic.
+		ParseURLData("/announce?" + string(b))
+	}
+}
+
 func BenchmarkParseQuery(b *testing.B) {
 	announceStrings := make([]string, 0)
 	for i := range ValidAnnounceArguments {
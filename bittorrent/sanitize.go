@@ -1,7 +1,7 @@
 package bittorrent
 
 import (
-	"net"
+	"math"
 
 	"github.com/chihaya/chihaya/pkg/log"
 )
@@ -12,26 +12,51 @@ var ErrInvalidIP = ClientError("invalid IP")
 // ErrInvalidPort indicates an invalid Port for an Announce.
 var ErrInvalidPort = ClientError("invalid port")
 
-// SanitizeAnnounce enforces a max and default NumWant and coerces the peer's
-// IP address into the proper format.
+// ErrTooManyInfoHashes indicates a Scrape for more infohashes than allowed.
+var ErrTooManyInfoHashes = ClientError("too many infohashes")
+
+// SanitizeAnnounce enforces a max and default NumWant, resets byte counters
+// that wrapped around and coerces the peer's IP address into the proper
+// format.
 func SanitizeAnnounce(r *AnnounceRequest, maxNumWant, defaultNumWant uint32) error {
 	if r.Port == 0 {
 		return ErrInvalidPort
 	}
 
+	// The byte counters are signed 64-bit integers on the wire. Negative
+	// values are sent by clients whose counters wrapped around, so the
+	// amounts are unknown.
+	// Left is kept, as a huge value correctly marks such a peer as a leecher.
+	if r.Downloaded > math.MaxInt64 {
+		r.Downloaded = 0
+	}
+	if r.Uploaded > math.MaxInt64 {
+		r.Uploaded = 0
+	}
+
 	if !r.NumWantProvided {
 		r.NumWant = defaultNumWant
 	} else if r.NumWant > maxNumWant {
 		r.NumWant = maxNumWant
 	}
 
-	if ip := r.Peer.IP.To4(); ip != nil {
-		r.Peer.IP.IP = ip
-		r.Peer.IP.AddressFamily = IPv4
-	} else if len(r.Peer.IP.IP) == net.IPv6len { // implies r.Peer.IP.To4() == nil
-		r.Peer.IP.AddressFamily = IPv6
-	} else {
-		return ErrInvalidIP
+	ip, err := NewIP(r.Peer.IP.IP)
+	if err != nil {
+		return err
+	}
+	r.Peer.IP = ip
+
+	if r.AlternatePeer != nil {
+		ip, err := NewIP(r.AlternatePeer.IP.IP)
+		if err != nil {
+			return err
+		}
+		r.AlternatePeer.IP = ip
+
+		// An alternate endpoint is only useful for the other address family.
+		if r.AlternatePeer.IP.AddressFamily == r.Peer.IP.AddressFamily {
+			r.AlternatePeer = nil
+		}
 	}
 
 	log.Debug("sanitized announce", r, log.Fields{
@@ -45,7 +70,7 @@ func SanitizeAnnounce(r *AnnounceRequest, maxNumWant, defaultNumWant uint32) err
 // request.
 func SanitizeScrape(r *ScrapeRequest, maxScrapeInfoHashes uint32) error {
 	if len(r.InfoHashes) > int(maxScrapeInfoHashes) {
-		r.InfoHashes = r.InfoHashes[:maxScrapeInfoHashes]
+		return ErrTooManyInfoHashes
 	}
 
 	log.Debug("sanitized scrape", r, log.Fields{
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// A format reads the infohashes of the torrents registered with another
+// tracker from a dump of its database.
+type format struct {
+	description string
+	read        func(io.Reader) ([]bittorrent.InfoHash, error)
+}
+
+// formats are the supported formats by name.
+var formats = map[string]format{
+	"opentracker": {
+		description: "an opentracker access list, one hex-encoded infohash per line",
+		read:        readAccessList,
+	},
+	"xbt": {
+		description: `the xbt_files table of XBT Tracker, as exported by mysql --batch -e "SELECT HEX(info_hash) AS info_hash, flags FROM xbt_files"`,
+		read: func(r io.Reader) ([]bittorrent.InfoHash, error) {
+			// XBT marks torrents it is about to delete with the first flag.
+			return readTable(r, func(row map[string]string) (bool, error) {
+				flags, ok := row["flags"]
+				if !ok || flags == "NULL" {
+					return false, nil
+				}
+				n, err := strconv.ParseUint(flags, 10, 64)
+				if err != nil {
+					return false, fmt.Errorf("invalid flags %q", flags)
+				}
+				return n&1 != 0, nil
+			})
+		},
+	},
+	"gazelle": {
+		description: `the torrents table of Gazelle, as exported by mysql --batch -e "SELECT HEX(info_hash) AS info_hash FROM torrents"`,
+		read: func(r io.Reader) ([]bittorrent.InfoHash, error) {
+			return readTable(r, nil)
+		},
+	},
+}
+
+// parseInfoHash parses a hex-encoded infohash.
+func parseInfoHash(s string) (bittorrent.InfoHash, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 20 {
+		return bittorrent.InfoHash{}, fmt.Errorf("invalid infohash %q", s)
+	}
+	return bittorrent.InfoHashFromBytes(b), nil
+}
+
+// readAccessList reads an opentracker access list. Like opentracker, only
+// the first 40 characters of a line are used, and empty lines and lines
+// starting with "#" are ignored.
+func readAccessList(r io.Reader) ([]bittorrent.InfoHash, error) {
+	var infoHashes []bittorrent.InfoHash
+
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if len(text) > 40 {
+			text = text[:40]
+		}
+
+		ih, err := parseInfoHash(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		infoHashes = append(infoHashes, ih)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return infoHashes, nil
+}
+
+// readTable reads the info_hash column of tab-separated rows with a header
+// line, as written by mysql --batch. Rows for which skip returns true are
+// left out.
+func readTable(r io.Reader, skip func(row map[string]string) (bool, error)) ([]bittorrent.InfoHash, error) {
+	s := bufio.NewScanner(r)
+	if !s.Scan() {
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("missing header line")
+	}
+	columns := strings.Split(s.Text(), "\t")
+	column := -1
+	for i, name := range columns {
+		if name == "info_hash" {
+			column = i
+		}
+	}
+	if column < 0 {
+		return nil, errors.New("missing info_hash column")
+	}
+
+	var infoHashes []bittorrent.InfoHash
+	for line := 2; s.Scan(); line++ {
+		if s.Text() == "" {
+			continue
+		}
+		fields := strings.Split(s.Text(), "\t")
+		if len(fields) != len(columns) {
+			return nil, fmt.Errorf("line %d: expected %d columns, got %d", line, len(columns), len(fields))
+		}
+
+		if skip != nil {
+			row := make(map[string]string, len(columns))
+			for i, name := range columns {
+				row[name] = fields[i]
+			}
+			skipped, err := skip(row)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", line, err)
+			}
+			if skipped {
+				continue
+			}
+		}
+
+		ih, err := parseInfoHash(fields[column])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s (export it with HEX(info_hash))", line, err)
+		}
+		infoHashes = append(infoHashes, ih)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return infoHashes, nil
+}
+
+// writeList writes infohashes as a list for the whitelist_source of the
+// torrent approval middleware: sorted, without duplicates and preceded by a
+// comment naming the source.
+func writeList(w io.Writer, source string, infoHashes []bittorrent.InfoHash) (int, error) {
+	sort.Slice(infoHashes, func(i, j int) bool {
+		return infoHashes[i].RawString() < infoHashes[j].RawString()
+	})
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# imported from %s by chihaya-import\n", source)
+	var n int
+	for i, ih := range infoHashes {
+		if i > 0 && ih == infoHashes[i-1] {
+			continue
+		}
+		fmt.Fprintln(bw, ih)
+		n++
+	}
+	return n, bw.Flush()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+const (
+	hashA = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	hashB = "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+)
+
+func infoHash(s string) bittorrent.InfoHash {
+	ih, err := parseInfoHash(s)
+	if err != nil {
+		panic(err)
+	}
+	return ih
+}
+
+func TestFormats(t *testing.T) {
+	var table = []struct {
+		format   string
+		input    string
+		expected []bittorrent.InfoHash
+	}{
+		{"opentracker", "# comment\n" + hashA + "\n\n" + hashB + " trailing\n", []bittorrent.InfoHash{infoHash(hashA), infoHash(hashB)}},
+		{"xbt", "info_hash\tflags\n" + strings.ToUpper(hashA) + "\t0\n" + hashB + "\t1\n", []bittorrent.InfoHash{infoHash(hashA)}},
+		{"gazelle", "info_hash\n" + hashA + "\n" + hashB + "\n", []bittorrent.InfoHash{infoHash(hashA), infoHash(hashB)}},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.format, func(t *testing.T) {
+			got, err := formats[tt.format].read(strings.NewReader(tt.input))
+			require.Nil(t, err)
+			require.Equal(t, tt.expected, got)
+		})
+	}
+}
+
+func TestFormatErrors(t *testing.T) {
+	for _, input := range []string{
+		"",
+		"id\n1\n",
+		"info_hash\n" + hashA + "\textra\n",
+		"info_hash\nnot hex\n",
+		"info_hash\tflags\n" + hashA + "\tx\n",
+	} {
+		_, err := formats["xbt"].read(strings.NewReader(input))
+		require.NotNil(t, err, input)
+	}
+
+	_, err := formats["opentracker"].read(strings.NewReader("abc\n"))
+	require.NotNil(t, err)
+}
+
+func TestWriteList(t *testing.T) {
+	var buf bytes.Buffer
+	n, err := writeList(&buf, "gazelle", []bittorrent.InfoHash{infoHash(hashB), infoHash(hashA), infoHash(hashB)})
+	require.Nil(t, err)
+	require.Equal(t, 2, n)
+	require.Equal(t, "# imported from gazelle by chihaya-import\n"+hashA+"\n"+hashB+"\n", buf.String())
+}
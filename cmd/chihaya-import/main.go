@@ -0,0 +1,103 @@
+// Command chihaya-import migrates the torrents registered with another
+// tracker to chihaya.
+//
+// It only imports infohash allowlists: it reads the infohashes from a dump of
+// the database of the other tracker and writes them as a list for the
+// whitelist_source of the torrent approval middleware, so that chihaya keeps
+// tracking the same torrents. Peers, statistics and users are not imported.
+// Peers announce to chihaya within one announce interval after the switch,
+// and users are served by the passkey middleware from the database of the
+// site.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+func run(cmd *cobra.Command, args []string) error {
+	flags := cmd.Flags()
+	name, err := flags.GetString("format")
+	if err != nil {
+		return err
+	}
+	output, err := flags.GetString("output")
+	if err != nil {
+		return err
+	}
+
+	f, ok := formats[name]
+	if !ok {
+		return fmt.Errorf("unknown format %q", name)
+	}
+
+	var in io.Reader = os.Stdin
+	if args[0] != "-" {
+		file, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+
+	infoHashes, err := f.read(in)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %s", args[0], err)
+	}
+
+	var n int
+	if output == "-" {
+		n, err = writeList(os.Stdout, name, infoHashes)
+	} else {
+		var file *os.File
+		if file, err = os.Create(output); err != nil {
+			return err
+		}
+		n, err = writeList(file, name, infoHashes)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	log.Info("imported torrents", log.Fields{"format": name, "torrents": n})
+	return nil
+}
+
+func main() {
+	names := make([]string, 0, len(formats))
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	long := []string{"Read the infohashes registered with another tracker and write them as a whitelist for the torrent approval middleware.", "", "Formats:"}
+	for _, name := range names {
+		long = append(long, "  "+name+": "+formats[name].description)
+	}
+
+	var rootCmd = &cobra.Command{
+		Use:          "chihaya-import <dump>",
+		Short:        "Migrate the torrents of another tracker to chihaya",
+		Long:         strings.Join(long, "\n"),
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE:         run,
+	}
+
+	rootCmd.Flags().String("format", "", "format of the dump: "+strings.Join(names, ", "))
+	rootCmd.Flags().StringP("output", "o", "-", "path of the whitelist to write, or - for stdout")
+
+	if err := rootCmd.Execute(); err != nil {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,92 @@
+// Command chihaya-relay relays connections between peers that received
+// relayed peers from chihaya, so that they don't learn each other's IP
+// addresses. See docs/middleware/relay.md.
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/relay"
+)
+
+// keyEnv is the environment variable the key is read from. It keeps the key
+// out of the process list.
+const keyEnv = "CHIHAYA_RELAY_KEY"
+
+func run(cmd *cobra.Command, args []string) error {
+	flags := cmd.Flags()
+	addr, err := flags.GetString("addr")
+	if err != nil {
+		return err
+	}
+	prefixStr, err := flags.GetString("prefix")
+	if err != nil {
+		return err
+	}
+	dialTimeout, err := flags.GetDuration("dial-timeout")
+	if err != nil {
+		return err
+	}
+	debugLog, err := flags.GetBool("debug")
+	if err != nil {
+		return err
+	}
+	if debugLog {
+		log.SetDebug(true)
+		log.Info("enabled debug logging")
+	}
+
+	_, prefix, err := net.ParseCIDR(prefixStr)
+	if err != nil {
+		return errors.New("invalid prefix: " + prefixStr)
+	}
+	tokens, err := relay.NewTokens([]byte(os.Getenv(keyEnv)), prefix)
+	if err != nil {
+		return err
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s := relay.NewServer(l, tokens, dialTimeout)
+	log.Info("relaying connections", log.Fields{"addr": s.Addr(), "prefix": prefix})
+
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
+	<-shutdown
+
+	log.Info("shutting down relay")
+	if errs := s.Stop().Wait(); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+func main() {
+	var rootCmd = &cobra.Command{
+		Use:          "chihaya-relay",
+		Short:        "Relay connections between BitTorrent peers",
+		Long:         "Relay the connections made to tokens returned by chihaya to the peers they encrypt, with the key read from $" + keyEnv,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE:         run,
+	}
+
+	rootCmd.Flags().String("addr", "[::]:6881", "address to accept connections on")
+	rootCmd.Flags().String("prefix", "", "IPv6 prefix of at most 64 bits routed to the relay, as configured for the relay middleware")
+	rootCmd.Flags().Duration("dial-timeout", 10*time.Second, "timeout of connections to peers")
+	rootCmd.Flags().Bool("debug", false, "enable debug logging")
+
+	if err := rootCmd.Execute(); err != nil {
+		os.Exit(1)
+	}
+}
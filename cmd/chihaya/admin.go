@@ -0,0 +1,29 @@
+package main
+
+import (
+	"github.com/chihaya/chihaya/pkg/admin"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/storage"
+)
+
+// startAdmin starts serving the admin API for store.
+//
+// Swarms are listed using lister, which is the underlying PeerStore, since
+// store may wrap it. It is nil if swarms can't be listed.
+func (r *Run) startAdmin(cfg admin.Config, store storage.PeerStore, lister storage.SwarmLister) error {
+	if r.bans == nil {
+		r.bans = admin.NewBans()
+	}
+
+	if lister == nil {
+		log.Warn("torrents can't be listed through the admin API with this storage configuration")
+	}
+
+	log.Info("starting admin API", cfg)
+	s, err := admin.NewServer(cfg, store, lister, r.bans, r.policies, r)
+	if err != nil {
+		return err
+	}
+	r.sg.Add(s)
+	return nil
+}
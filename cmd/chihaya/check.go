@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ConfigError is returned for a configuration with problems. It lists all of
+// them, so that they can be fixed at once.
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e.Problems, "\n  ")
+}
+
+// unknownFieldRE matches the errors yaml.UnmarshalStrict returns for keys
+// that don't exist.
+var unknownFieldRE = regexp.MustCompile(`field (\S+) not found in type \S+`)
+
+// yamlProblems returns the problems of a *yaml.TypeError, such as unknown
+// keys, prefixed by the source they were found in. It returns nil for any
+// other error.
+func yamlProblems(source string, err error) []string {
+	typeErr, ok := err.(*yaml.TypeError)
+	if !ok {
+		return nil
+	}
+
+	problems := make([]string, len(typeErr.Errors))
+	for i, e := range typeErr.Errors {
+		problems[i] = source + ": " + unknownFieldRE.ReplaceAllString(e, "unknown key $1")
+	}
+	return problems
+}
+
+// check returns all problems of cfg that would prevent the tracker from
+// starting or that make no sense, such as negative intervals.
+//
+// The configuration of the storage and the middleware is checked by their
+// drivers when they are created.
+func (cfg Config) check() (problems []string) {
+	add := func(errs []error) {
+		for _, err := range errs {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	httpEnabled := cfg.HTTPConfig.Addr != ""
+	udpEnabled := cfg.UDPConfig.Addr != "" || cfg.UDPConfig.Addr6 != ""
+	if !httpEnabled && !udpEnabled {
+		problems = append(problems, "http.addr or udp.addr must be set")
+	}
+	if httpEnabled {
+		add(cfg.HTTPConfig.Check())
+	}
+	if udpEnabled {
+		add(cfg.UDPConfig.Check())
+	}
+	add(cfg.ResponseConfig.Check())
+
+	if cfg.MaxResponsePeers < 0 {
+		problems = append(problems, "max_response_peers must not be negative")
+	}
+	if cfg.ShutdownTimeout < 0 {
+		problems = append(problems, "shutdown_timeout must not be negative")
+	}
+	if cfg.UpgradeTimeout < 0 {
+		problems = append(problems, "upgrade_timeout must not be negative")
+	}
+
+	if cfg.Storage.Name == "" {
+		problems = append(problems, "storage.name must be set")
+	}
+	for _, hooks := range []struct {
+		key   string
+		names []string
+	}{
+		{"prehooks", cfg.PreHookNames()},
+		{"responsehooks", cfg.ResponseHookNames()},
+		{"posthooks", cfg.PostHookNames()},
+	} {
+		for i, name := range hooks.names {
+			if name == "" {
+				problems = append(problems, fmt.Sprintf("%s[%d].name must be set", hooks.key, i))
+			}
+		}
+	}
+
+	return
+}
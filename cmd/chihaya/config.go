@@ -2,24 +2,45 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"time"
 
 	yaml "gopkg.in/yaml.v2"
 
 	"github.com/chihaya/chihaya/frontend/http"
 	"github.com/chihaya/chihaya/frontend/udp"
 	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/admin"
+	"github.com/chihaya/chihaya/pkg/etcd"
+	"github.com/chihaya/chihaya/pkg/policy"
+	"github.com/chihaya/chihaya/pkg/prometheus/push"
+	"github.com/chihaya/chihaya/storage/merge"
+	"github.com/chihaya/chihaya/storage/privacy"
+	"github.com/chihaya/chihaya/storage/redis"
+	"github.com/chihaya/chihaya/storage/replication"
+	"github.com/chihaya/chihaya/storage/scrapecache"
 
 	// Imports to register middleware drivers.
+	_ "github.com/chihaya/chihaya/middleware/cgnat"
 	_ "github.com/chihaya/chihaya/middleware/clientapproval"
+	_ "github.com/chihaya/chihaya/middleware/intervaljitter"
+	_ "github.com/chihaya/chihaya/middleware/ipblocklist"
 	_ "github.com/chihaya/chihaya/middleware/jwt"
+	_ "github.com/chihaya/chihaya/middleware/passkey"
+	_ "github.com/chihaya/chihaya/middleware/passkey/postgres"
+	_ "github.com/chihaya/chihaya/middleware/peergroups"
+	_ "github.com/chihaya/chihaya/middleware/peermetadata"
+	_ "github.com/chihaya/chihaya/middleware/ratioenforcement"
+	_ "github.com/chihaya/chihaya/middleware/relay"
+	_ "github.com/chihaya/chihaya/middleware/scrapemetadata"
 	_ "github.com/chihaya/chihaya/middleware/torrentapproval"
+	_ "github.com/chihaya/chihaya/middleware/torrentratelimit"
 	_ "github.com/chihaya/chihaya/middleware/varinterval"
 
 	// Imports to register storage drivers.
 	_ "github.com/chihaya/chihaya/storage/memory"
-	_ "github.com/chihaya/chihaya/storage/redis"
 )
 
 type storageConfig struct {
@@ -29,13 +50,54 @@ type storageConfig struct {
 
 // Config represents the configuration used for executing Chihaya.
 type Config struct {
+	Profile                   string `yaml:"profile"`
 	middleware.ResponseConfig `yaml:",inline"`
+	MaxScrapeInfoHashes       uint32                  `yaml:"max_scrape_infohashes"`
+	MaxResponsePeers          int                     `yaml:"max_response_peers"`
 	PrometheusAddr            string                  `yaml:"prometheus_addr"`
+	MetricsPush               *push.Config            `yaml:"metrics_push"`
 	HTTPConfig                http.Config             `yaml:"http"`
 	UDPConfig                 udp.Config              `yaml:"udp"`
 	Storage                   storageConfig           `yaml:"storage"`
 	PreHooks                  []middleware.HookConfig `yaml:"prehooks"`
+	ResponseHooks             []middleware.HookConfig `yaml:"responsehooks"`
 	PostHooks                 []middleware.HookConfig `yaml:"posthooks"`
+	User                      string                  `yaml:"user"`
+	Group                     string                  `yaml:"group"`
+	Chroot                    string                  `yaml:"chroot"`
+	RestartCoordination       *redis.LockConfig       `yaml:"restart_coordination"`
+	Replication               *replication.Config     `yaml:"replication"`
+	Admin                     *admin.Config           `yaml:"admin"`
+	InfoHashPrivacy           *privacy.Config         `yaml:"infohash_privacy"`
+	SwarmMerging              *merge.Config           `yaml:"swarm_merging"`
+	ScrapeCache               *scrapecache.Config     `yaml:"scrape_cache"`
+	TorrentPolicies           *policy.Config          `yaml:"torrent_policies"`
+	ShutdownTimeout           time.Duration           `yaml:"shutdown_timeout"`
+	UpgradeTimeout            time.Duration           `yaml:"upgrade_timeout"`
+}
+
+// defaultShutdownTimeout is the shutdown timeout used if none is configured.
+const defaultShutdownTimeout = 30 * time.Second
+
+// shutdownTimeout returns the time the services, the tracker logic and the
+// peer store each get to stop before they are abandoned.
+func (cfg Config) shutdownTimeout() time.Duration {
+	if cfg.ShutdownTimeout <= 0 {
+		return defaultShutdownTimeout
+	}
+	return cfg.ShutdownTimeout
+}
+
+// defaultUpgradeTimeout is the upgrade timeout used if none is configured.
+const defaultUpgradeTimeout = time.Minute
+
+// upgradeTimeout returns the time a new process started by an upgrade gets
+// to take over the sockets before it is killed.
+func (cfg Config) upgradeTimeout() time.Duration {
+	if cfg.UpgradeTimeout <= 0 {
+		return defaultUpgradeTimeout
+	}
+	return cfg.UpgradeTimeout
 }
 
 // PreHookNames returns only the names of the configured middleware.
@@ -47,6 +109,15 @@ func (cfg Config) PreHookNames() (names []string) {
 	return
 }
 
+// ResponseHookNames returns only the names of the configured middleware.
+func (cfg Config) ResponseHookNames() (names []string) {
+	for _, hook := range cfg.ResponseHooks {
+		names = append(names, hook.Name)
+	}
+
+	return
+}
+
 // PostHookNames returns only the names of the configured middleware.
 func (cfg Config) PostHookNames() (names []string) {
 	for _, hook := range cfg.PostHooks {
@@ -64,28 +135,154 @@ type ConfigFile struct {
 // ParseConfigFile returns a new ConfigFile given the path to a YAML
 // configuration file.
 //
-// It supports relative and absolute paths and environment variables.
-func ParseConfigFile(path string) (*ConfigFile, error) {
+// It supports relative and absolute paths and environment variables. A path
+// of the form etcd://host:port/key reads the configuration from that key of
+// an etcd cluster instead.
+//
+// If the configuration extends a profile, the profile is applied first and
+// overridden by the values in the file.
+//
+// The values in the file are overridden by environment variables, which are
+// overridden by sets of the form "key=value", as given with the --set flag.
+func ParseConfigFile(path string, sets ...string) (*ConfigFile, error) {
 	if path == "" {
 		return nil, errors.New("no config path specified")
 	}
 
-	f, err := os.Open(os.ExpandEnv(path))
+	flagOverrides, err := parseOverrides(sets)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
+	overrides := append(envOverrides(), flagOverrides...)
 
-	contents, err := ioutil.ReadAll(f)
+	contents, err := readConfigFile(path)
 	if err != nil {
 		return nil, err
 	}
 
+	// The profile is resolved before the file is parsed, so it is
+	// overridden beforehand.
+	var profile string
+	for _, o := range overrides {
+		if o.key == "profile" {
+			profile = o.value
+		}
+	}
+
 	var cfgFile ConfigFile
-	err = yaml.Unmarshal(contents, &cfgFile)
+	var problems []string
+	err = parseConfig(contents, profile, path, &cfgFile, make(map[string]bool), &problems)
 	if err != nil {
 		return nil, err
 	}
+	if err := applyOverrides(&cfgFile, overrides); err != nil {
+		return nil, err
+	}
+
+	// The tracker-wide limits apply to frontends that don't set their own.
+	cfg := &cfgFile.Chihaya
+	if cfg.MaxScrapeInfoHashes > 0 {
+		if cfg.HTTPConfig.MaxScrapeInfoHashes == 0 {
+			cfg.HTTPConfig.MaxScrapeInfoHashes = cfg.MaxScrapeInfoHashes
+		}
+		if cfg.UDPConfig.MaxScrapeInfoHashes == 0 {
+			cfg.UDPConfig.MaxScrapeInfoHashes = cfg.MaxScrapeInfoHashes
+		}
+	}
+	if cfg.MaxResponsePeers > 0 {
+		if cfg.HTTPConfig.MaxResponsePeers == 0 {
+			cfg.HTTPConfig.MaxResponsePeers = cfg.MaxResponsePeers
+		}
+		if cfg.UDPConfig.MaxResponsePeers == 0 {
+			cfg.UDPConfig.MaxResponsePeers = cfg.MaxResponsePeers
+		}
+	}
+
+	// In privacy mode, the access log must not reveal the original
+	// infohashes either.
+	cfg.HTTPConfig.RedactInfoHashes = cfg.InfoHashPrivacy != nil
+
+	// All problems are reported at once, including keys that don't exist.
+	problems = append(problems, cfg.check()...)
+	if len(problems) != 0 {
+		return nil, &ConfigError{Problems: problems}
+	}
 
 	return &cfgFile, nil
 }
+
+// readConfigFile reads a configuration file, or the value of an etcd key if
+// path is the URL of one.
+func readConfigFile(path string) ([]byte, error) {
+	if etcd.IsURL(path) {
+		return readEtcdConfig(path)
+	}
+
+	f, err := os.Open(os.ExpandEnv(path))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ioutil.ReadAll(f)
+}
+
+// parseConfig unmarshals contents read from source into cfgFile after
+// recursively applying the profile it extends, or profile if it is not empty.
+//
+// A profile is either the name of one of the built-in profiles or the path
+// to another configuration file.
+//
+// Keys that don't exist and values of the wrong type are appended to
+// problems, so that they are reported along with all other problems.
+func parseConfig(contents []byte, profile, source string, cfgFile *ConfigFile, seen map[string]bool, problems *[]string) error {
+	var header struct {
+		Chihaya struct {
+			Profile string      `yaml:"profile"`
+			Storage interface{} `yaml:"storage"`
+		} `yaml:"chihaya"`
+	}
+	err := yaml.Unmarshal(contents, &header)
+	if err != nil {
+		return err
+	}
+
+	if profile == "" {
+		profile = header.Chihaya.Profile
+	}
+	if profile != "" {
+		if seen[profile] {
+			return fmt.Errorf("config profile %q extends itself", profile)
+		}
+		seen[profile] = true
+
+		parent, ok := profiles[profile]
+		var parentContents []byte
+		if ok {
+			parentContents = []byte(parent)
+		} else {
+			parentContents, err = readConfigFile(profile)
+			if err != nil {
+				return fmt.Errorf("failed to read config profile %q: %s", profile, err)
+			}
+		}
+
+		err = parseConfig(parentContents, "", profile, cfgFile, seen, problems)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The storage block replaces that of the profile, rather than being
+	// merged into it, since its config is specific to the driver.
+	if header.Chihaya.Storage != nil {
+		cfgFile.Chihaya.Storage = storageConfig{}
+	}
+
+	err = yaml.UnmarshalStrict(contents, cfgFile)
+	if p := yamlProblems(source, err); p != nil {
+		*problems = append(*problems, p...)
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeConfigs writes files, mapping names to contents, into a temporary
+// directory, which must be removed by the caller. "$DIR" in the contents is
+// replaced by the directory.
+func writeConfigs(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "chihaya-config")
+	require.Nil(t, err)
+
+	for name, contents := range files {
+		contents = strings.Replace(contents, "$DIR", dir, -1)
+		require.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644))
+	}
+	return dir
+}
+
+func TestParseConfigFileProfiles(t *testing.T) {
+	var table = []struct {
+		name  string
+		files map[string]string
+		err   string
+		check func(t *testing.T, cfg Config)
+	}{
+		{
+			name: "built-in profile extended and overridden",
+			files: map[string]string{"chihaya.yaml": `
+chihaya:
+  profile: private
+  announce_interval: 1h
+  storage:
+    name: memory
+`},
+			check: func(t *testing.T, cfg Config) {
+				// Overridden by the file.
+				require.Equal(t, time.Hour, cfg.AnnounceInterval)
+				// Set by private.
+				require.Equal(t, 30*time.Minute, cfg.MinAnnounceInterval)
+				require.Equal(t, []string{"/:passkey/announce"}, cfg.HTTPConfig.AnnounceRoutes)
+				require.Equal(t, "", cfg.UDPConfig.Addr)
+				// Inherited from public, which private extends.
+				require.Equal(t, "0.0.0.0:6969", cfg.HTTPConfig.Addr)
+				require.Equal(t, 100, int(cfg.HTTPConfig.MaxNumWant))
+				// The storage block replaces that of the profile.
+				require.Nil(t, cfg.Storage.Config)
+			},
+		},
+		{
+			name: "file profile extending a built-in profile",
+			files: map[string]string{
+				"base.yaml": `
+chihaya:
+  profile: lan
+  max_response_peers: 20
+`,
+				"chihaya.yaml": `
+chihaya:
+  profile: $DIR/base.yaml
+  min_announce_interval: 30s
+`,
+			},
+			check: func(t *testing.T, cfg Config) {
+				require.Equal(t, 30*time.Second, cfg.MinAnnounceInterval)
+				require.Equal(t, 2*time.Minute, cfg.AnnounceInterval)
+				require.Equal(t, 20, cfg.MaxResponsePeers)
+				require.True(t, cfg.UDPConfig.IPSpoofing.AllowIPv4)
+				require.Equal(t, "memory", cfg.Storage.Name)
+			},
+		},
+		{
+			name:  "unknown profile",
+			files: map[string]string{"chihaya.yaml": "chihaya:\n  profile: nonexistent\n"},
+			err:   `failed to read config profile "nonexistent"`,
+		},
+		{
+			name: "extends cycle",
+			files: map[string]string{
+				"a.yaml":       "chihaya:\n  profile: $DIR/b.yaml\n",
+				"b.yaml":       "chihaya:\n  profile: $DIR/a.yaml\n",
+				"chihaya.yaml": "chihaya:\n  profile: $DIR/a.yaml\n",
+			},
+			err: "extends itself",
+		},
+		{
+			name:  "unknown keys",
+			files: map[string]string{"chihaya.yaml": "chihaya:\n  profile: public\n  announce_intervl: 1h\n  http:\n    adr: x\n"},
+			err:   "unknown key announce_intervl",
+		},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeConfigs(t, tt.files)
+			defer os.RemoveAll(dir)
+			cfgFile, err := ParseConfigFile(filepath.Join(dir, "chihaya.yaml"))
+			if tt.err != "" {
+				require.NotNil(t, err)
+				require.Contains(t, err.Error(), tt.err)
+				return
+			}
+			require.Nil(t, err)
+			tt.check(t, cfgFile.Chihaya)
+		})
+	}
+}
+
+func TestParseConfigFileOverrides(t *testing.T) {
+	dir := writeConfigs(t, map[string]string{
+		"chihaya.yaml": "chihaya:\n  profile: public\n  announce_interval: 1h\n",
+	})
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "chihaya.yaml")
+
+	os.Setenv(envName("announce_interval"), "2h")
+	os.Setenv(envName("udp.addr"), "127.0.0.1:6969")
+	defer os.Unsetenv(envName("announce_interval"))
+	defer os.Unsetenv(envName("udp.addr"))
+
+	cfgFile, err := ParseConfigFile(path, "announce_interval=3h", "profile=private", "http.announce_routes=[/a, /b]")
+	require.Nil(t, err)
+	cfg := cfgFile.Chihaya
+
+	// Sets take precedence over the environment, which takes precedence
+	// over the file.
+	require.Equal(t, 3*time.Hour, cfg.AnnounceInterval)
+	require.Equal(t, "127.0.0.1:6969", cfg.UDPConfig.Addr)
+	require.Equal(t, []string{"/a", "/b"}, cfg.HTTPConfig.AnnounceRoutes)
+	// The overridden profile is applied instead of the one in the file.
+	require.Equal(t, 30*time.Minute, cfg.MinAnnounceInterval)
+
+	for _, sets := range [][]string{{"announce_interval"}, {"nonexistent=1"}, {"announce_interval=never"}} {
+		_, err := ParseConfigFile(path, sets...)
+		require.NotNil(t, err, "%v", sets)
+	}
+}
+
+func TestParseConfigFileLimits(t *testing.T) {
+	dir := writeConfigs(t, map[string]string{"chihaya.yaml": `
+chihaya:
+  profile: public
+  max_scrape_infohashes: 10
+  max_response_peers: 25
+  udp:
+    max_scrape_infohashes: 5
+`})
+	defer os.RemoveAll(dir)
+	cfgFile, err := ParseConfigFile(filepath.Join(dir, "chihaya.yaml"))
+	require.Nil(t, err)
+
+	cfg := cfgFile.Chihaya
+	require.Equal(t, uint32(50), cfg.HTTPConfig.MaxScrapeInfoHashes)
+	require.Equal(t, uint32(5), cfg.UDPConfig.MaxScrapeInfoHashes)
+	require.Equal(t, 25, cfg.HTTPConfig.MaxResponsePeers)
+	require.Equal(t, 25, cfg.UDPConfig.MaxResponsePeers)
+}
+
+func TestParseConfigFileEtcd(t *testing.T) {
+	contents := "chihaya:\n  profile: public\n  announce_interval: 1h\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v3/kv/range", r.URL.Path)
+		fmt.Fprintf(w, `{"header":{"revision":"2"},"kvs":[{"value":%q,"mod_revision":"2"}],"count":"1"}`,
+			base64.StdEncoding.EncodeToString([]byte(contents)))
+	}))
+	defer srv.Close()
+
+	cfgFile, err := ParseConfigFile("etcd://" + strings.TrimPrefix(srv.URL, "http://") + "/chihaya")
+	require.Nil(t, err)
+	require.Equal(t, time.Hour, cfgFile.Chihaya.AnnounceInterval)
+}
+
+func TestCheck(t *testing.T) {
+	var table = []struct {
+		name     string
+		modify   func(cfg *Config)
+		problems []string
+	}{
+		{"valid", func(*Config) {}, nil},
+		{"no frontends", func(cfg *Config) {
+			cfg.HTTPConfig.Addr = ""
+			cfg.UDPConfig.Addr = ""
+		}, []string{"http.addr or udp.addr must be set"}},
+		{"negative values", func(cfg *Config) {
+			cfg.MaxResponsePeers = -1
+			cfg.ShutdownTimeout = -1
+			cfg.UpgradeTimeout = -1
+		}, []string{
+			"max_response_peers must not be negative",
+			"shutdown_timeout must not be negative",
+			"upgrade_timeout must not be negative",
+		}},
+		{"missing names", func(cfg *Config) {
+			cfg.Storage.Name = ""
+			cfg.PreHooks = append(cfg.PreHooks, cfg.PreHooks...)
+			cfg.PreHooks[1].Name = ""
+		}, []string{"storage.name must be set", "prehooks[1].name must be set"}},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfgFile ConfigFile
+			var problems []string
+			contents := []byte("chihaya:\n  prehooks:\n  - name: varinterval\n")
+			require.Nil(t, parseConfig(contents, "public", "test", &cfgFile, make(map[string]bool), &problems))
+			require.Empty(t, problems)
+
+			cfg := cfgFile.Chihaya
+			tt.modify(&cfg)
+			require.Equal(t, tt.problems, cfg.check())
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/storage"
+	"github.com/chihaya/chihaya/storage/redis"
+	"github.com/chihaya/chihaya/storage/replication"
+)
+
+// restartRetryInterval is the interval at which a node that is waiting for
+// its turn to restart retries to acquire the restart lock.
+const restartRetryInterval = time.Second
+
+// setupRestartLock creates the lock used to take turns restarting with the
+// other nodes of a cluster, if restart coordination is configured.
+//
+// The lock is owned by the host, so that the process started after a restart
+// can release the lock acquired by the process it replaced.
+func (r *Run) setupRestartLock(cfg *redis.LockConfig) error {
+	if cfg == nil || r.restartLock != nil {
+		return nil
+	}
+
+	owner, err := os.Hostname()
+	if err != nil {
+		return errors.New("failed to determine restart lock owner: " + err.Error())
+	}
+
+	log.Info("coordinating restarts", log.Fields{"owner": owner}, cfg)
+	r.restartLock, err = redis.NewLock(*cfg, owner)
+	return err
+}
+
+// finishRestartTurn releases the restart lock after this node is serving
+// again.
+func (r *Run) finishRestartTurn() {
+	if r.restartLock == nil {
+		return
+	}
+
+	if err := r.restartLock.Release(); err != nil {
+		log.Warn("failed to release restart lock", log.Err(err))
+	}
+}
+
+// awaitRestartTurn blocks until no other node of the cluster is restarting,
+// so that at most one node is draining at any time.
+//
+// Locks held by other nodes expire eventually, so this gives up waiting after
+// the TTL of the lock. Failures to reach the shared store never block a
+// restart.
+func (r *Run) awaitRestartTurn(watchdog <-chan time.Time) {
+	if r.restartLock == nil {
+		return
+	}
+
+	deadline := time.NewTimer(r.restartLock.TTL())
+	defer deadline.Stop()
+	retry := time.NewTicker(restartRetryInterval)
+	defer retry.Stop()
+
+	for waiting := false; ; waiting = true {
+		acquired, err := r.restartLock.TryAcquire()
+		if err != nil {
+			log.Warn("failed to acquire restart lock; restarting anyway", log.Err(err))
+			return
+		}
+		if acquired {
+			return
+		}
+		if !waiting {
+			log.Info("waiting for another node to finish restarting")
+		}
+
+	wait:
+		for {
+			select {
+			case <-watchdog:
+				notifySystemd("WATCHDOG=1")
+			case <-deadline.C:
+				log.Warn("timed out waiting for restart lock; restarting anyway")
+				return
+			case <-retry.C:
+				break wait
+			}
+		}
+	}
+}
+
+// startReplication starts replicating the PeerStore to followers or from a
+// primary, if replication is configured, and returns the PeerStore to be
+// used by the tracker logic.
+//
+// Replication is stopped with the frontends, so that a follower can be
+// promoted by changing its role and reloading.
+func (r *Run) startReplication(cfg *replication.Config) (storage.PeerStore, error) {
+	if cfg == nil {
+		return r.peerStore, nil
+	}
+
+	log.Info("starting replication", cfg)
+	if cfg.Role == replication.RolePrimary {
+		primary, err := replication.NewPrimary(r.peerStore, *cfg)
+		if err != nil {
+			return nil, err
+		}
+		r.sg.Add(primary)
+		return primary, nil
+	}
+
+	follower, err := replication.NewFollower(r.peerStore, *cfg)
+	if err != nil {
+		return nil, err
+	}
+	r.sg.Add(follower)
+	return r.peerStore, nil
+}
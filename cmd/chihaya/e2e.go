@@ -54,18 +54,20 @@ func EndToEndRunCmdFunc(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+// generateInfohash returns a random infohash in the reserved namespace, so
+// that end-to-end tests never pollute the swarms of a production tracker.
 func generateInfohash() [20]byte {
-	b := make([]byte, 20)
+	b := make([]byte, 20-len(bittorrent.ReservedInfoHashPrefix))
 
 	n, err := rand.Read(b)
 	if err != nil {
 		panic(err)
 	}
-	if n != 20 {
+	if n != len(b) {
 		panic(fmt.Errorf("not enough randomness? Got %d bytes", n))
 	}
 
-	return [20]byte(bittorrent.InfoHashFromBytes(b))
+	return [20]byte(bittorrent.ReservedInfoHash(b))
 }
 
 func test(addr string, delay time.Duration) error {
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/chihaya/chihaya/pkg/etcd"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+const (
+	// etcdTimeout bounds reading the configuration from etcd.
+	etcdTimeout = 10 * time.Second
+
+	// etcdRetryInterval is the time waited before watching the
+	// configuration again after the watch failed.
+	etcdRetryInterval = 5 * time.Second
+)
+
+// etcdClient is the HTTP client used to talk to etcd. It has no timeout, so
+// that watches can last indefinitely.
+var etcdClient = &http.Client{}
+
+// readEtcdConfig reads the configuration from the etcd key at url.
+func readEtcdConfig(url string) ([]byte, error) {
+	k, err := etcd.ParseURL(os.ExpandEnv(url), etcdClient)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	value, _, err := k.Get(ctx)
+	return value, err
+}
+
+// watchEtcdConfig sends to changes whenever the etcd key at url changes,
+// until ctx is done.
+//
+// Changes made while the watch was interrupted can't be told apart from
+// other changes to the cluster, so a reload is requested whenever the watch
+// is restarted after a failure.
+func watchEtcdConfig(ctx context.Context, url string, changes chan<- struct{}) {
+	k, err := etcd.ParseURL(os.ExpandEnv(url), etcdClient)
+	if err != nil {
+		log.Error("failed to watch the configuration in etcd", log.Err(err))
+		return
+	}
+
+	notify := func() {
+		select {
+		case changes <- struct{}{}:
+		default:
+			// A reload is pending already.
+		}
+	}
+
+	var missed bool
+	for {
+		getCtx, cancel := context.WithTimeout(ctx, etcdTimeout)
+		_, revision, err := k.Get(getCtx)
+		cancel()
+		if err == nil {
+			if missed {
+				notify()
+			}
+			log.Info("watching the configuration in etcd", log.Fields{"key": k.String(), "revision": revision})
+			err = k.Watch(ctx, revision, func(int64) { notify() })
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Warn("failed to watch the configuration in etcd", log.Fields{"key": k.String(), "error": err.Error()})
+		missed = true
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(etcdRetryInterval):
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !go1.17
+// +build !go1.17
+
+package main
+
+// Before Go 1.16, syscall.Setuid and syscall.Setgid fail with EOPNOTSUPP on
+// Linux, since they only changed the credentials of a single thread, so
+// chihaya couldn't drop its privileges. The gRPC admin service requires Go
+// 1.17. Building with an older release fails on purpose.
+var _ = chihaya_requires_go1_17
@@ -1,41 +1,120 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"os"
 	"os/signal"
 	"runtime"
 	"runtime/pprof"
 	"runtime/trace"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
+	"github.com/chihaya/chihaya/frontend"
 	"github.com/chihaya/chihaya/frontend/http"
 	"github.com/chihaya/chihaya/frontend/udp"
+	"github.com/chihaya/chihaya/internal/cpus"
+	"github.com/chihaya/chihaya/internal/handoff"
+	"github.com/chihaya/chihaya/internal/systemd"
 	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/accesslog"
+	"github.com/chihaya/chihaya/pkg/admin"
+	"github.com/chihaya/chihaya/pkg/etcd"
 	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/policy"
 	"github.com/chihaya/chihaya/pkg/prometheus"
+	"github.com/chihaya/chihaya/pkg/prometheus/push"
+	"github.com/chihaya/chihaya/pkg/server"
 	"github.com/chihaya/chihaya/pkg/stop"
 	"github.com/chihaya/chihaya/storage"
+	"github.com/chihaya/chihaya/storage/merge"
+	"github.com/chihaya/chihaya/storage/privacy"
+	"github.com/chihaya/chihaya/storage/redis"
+	"github.com/chihaya/chihaya/storage/scrapecache"
 )
 
 // Run represents the state of a running instance of Chihaya.
 type Run struct {
 	configFilePath string
-	peerStore      storage.PeerStore
-	logic          *middleware.Logic
-	sg             *stop.Group
+
+	// configOverrides override keys of the configuration file. They have
+	// the form "key=value".
+	configOverrides []string
+
+	peerStore storage.PeerStore
+	logic     *middleware.Logic
+
+	// cfg is the configuration currently applied.
+	cfg Config
+
+	// sg holds the services other than the frontends, which are restarted
+	// together when their configuration changes.
+	sg *stop.Group
+
+	// store is the PeerStore used by the tracker logic, which may wrap
+	// peerStore. lister lists its swarms and is nil if they can't be listed.
+	store  storage.PeerStore
+	lister storage.SwarmLister
+
+	// logicSwitch is used by the frontends, so that the tracker logic can be
+	// rebuilt without restarting them.
+	logicSwitch logicSwitch
+
+	// frontends holds the frontends that are enabled, named "http" and
+	// "udp".
+	frontends *server.Pool
+
+	// metrics serves the metrics and reports whether this instance is ready
+	// to serve requests.
+	metrics *prometheus.Server
+
+	// privilegesDropped is true once the configured user, group and root
+	// directory have been applied to the process.
+	privilegesDropped bool
+
+	// restartLock is used to take turns restarting with the other nodes of a
+	// cluster, if configured.
+	restartLock *redis.Lock
+
+	// bans holds the IP addresses banned through the admin API. It is kept
+	// when reloading.
+	bans *admin.Bans
+
+	// policies holds the policies of torrents. It is kept when reloading,
+	// unless they are read from a file.
+	policies *policy.Store
+
+	// reloadRequests receives requests to reload made through the admin API.
+	reloadRequests chan struct{}
+
+	// lastReload is the report of the last reload, or nil if the
+	// configuration has not been reloaded.
+	lastReload   *admin.ReloadReport
+	lastReloadMu sync.Mutex
 }
 
+var (
+	_ server.Failer = &http.Frontend{}
+	_ server.Failer = &udp.Frontend{}
+)
+
 // NewRun runs an instance of Chihaya.
-func NewRun(configFilePath string) (*Run, error) {
+func NewRun(configFilePath string, configOverrides []string) (*Run, error) {
 	r := &Run{
-		configFilePath: configFilePath,
+		configFilePath:  configFilePath,
+		configOverrides: configOverrides,
+		reloadRequests:  make(chan struct{}, 1),
+		policies:        policy.NewStore(),
+		frontends:       server.NewPool(),
 	}
+	r.logicSwitch.policies = r.policies
 
 	return r, r.Start(nil)
 }
@@ -44,17 +123,12 @@ func NewRun(configFilePath string) (*Run, error) {
 // It is optional to provide an instance of the peer store to avoid the
 // creation of a new one.
 func (r *Run) Start(ps storage.PeerStore) error {
-	configFile, err := ParseConfigFile(r.configFilePath)
+	configFile, err := ParseConfigFile(r.configFilePath, r.configOverrides...)
 	if err != nil {
 		return errors.New("failed to read config: " + err.Error())
 	}
 	cfg := configFile.Chihaya
 
-	r.sg = stop.NewGroup()
-
-	log.Info("starting Prometheus server", log.Fields{"addr": cfg.PrometheusAddr})
-	r.sg.Add(prometheus.NewServer(cfg.PrometheusAddr))
-
 	if ps == nil {
 		log.Info("starting storage", log.Fields{"name": cfg.Storage.Name})
 		ps, err = storage.NewPeerStore(cfg.Storage.Name, cfg.Storage.Config)
@@ -65,40 +139,182 @@ func (r *Run) Start(ps storage.PeerStore) error {
 	}
 	r.peerStore = ps
 
+	if err := r.startServices(cfg); err != nil {
+		return err
+	}
+	if err := r.startLogic(cfg); err != nil {
+		return err
+	}
+	if err := r.startHTTP(cfg.HTTPConfig); err != nil {
+		return err
+	}
+	if err := r.startUDP(cfg.UDPConfig); err != nil {
+		return err
+	}
+
+	// Privileges can only be dropped once, so after a reload, sockets are
+	// bound with the privileges that were dropped to.
+	if !r.privilegesDropped {
+		if err := dropPrivileges(cfg.User, cfg.Group, cfg.Chroot); err != nil {
+			return errors.New("failed to drop privileges: " + err.Error())
+		}
+		r.privilegesDropped = true
+	}
+
+	if err := r.setupRestartLock(cfg.RestartCoordination); err != nil {
+		return errors.New("failed to set up restart coordination: " + err.Error())
+	}
+	r.finishRestartTurn()
+	r.metrics.SetReady(true)
+	r.cfg = cfg
+
+	return nil
+}
+
+// startServices starts the metrics, replication and the admin API, and sets
+// up the PeerStore used by the tracker logic.
+func (r *Run) startServices(cfg Config) error {
+	r.sg = stop.NewGroup()
+
+	log.Info("starting Prometheus server", log.Fields{"addr": cfg.PrometheusAddr})
+	r.metrics = prometheus.NewServer(cfg.PrometheusAddr)
+	r.sg.Add(r.metrics)
+
+	if cfg.MetricsPush != nil {
+		log.Info("starting metrics push reporter", cfg.MetricsPush)
+		reporter, err := push.NewReporter(*cfg.MetricsPush)
+		if err != nil {
+			return errors.New("failed to start metrics push reporter: " + err.Error())
+		}
+		r.sg.Add(reporter)
+	}
+
+	// The tracker logic uses the replicating PeerStore of a primary, while
+	// the underlying PeerStore is kept when reloading.
+	store, err := r.startReplication(cfg.Replication)
+	if err != nil {
+		return errors.New("failed to start replication: " + err.Error())
+	}
+
+	// Infohashes are transformed before they are replicated, so that
+	// followers only store the transformed infohashes as well.
+	var lister storage.SwarmLister
+	if cfg.InfoHashPrivacy != nil {
+		log.Info("storing only keyed hashes of infohashes", cfg.InfoHashPrivacy)
+		if store, err = privacy.New(store, *cfg.InfoHashPrivacy); err != nil {
+			return errors.New("failed to set up infohash privacy: " + err.Error())
+		}
+	} else {
+		lister, _ = r.peerStore.(storage.SwarmLister)
+	}
+
+	// Equivalent infohashes are merged before they are transformed, so that
+	// a merged swarm is stored under the transform of its first infohash.
+	if cfg.SwarmMerging != nil {
+		log.Info("merging the swarms of equivalent infohashes", cfg.SwarmMerging)
+		if store, err = merge.New(store, *cfg.SwarmMerging); err != nil {
+			return errors.New("failed to set up swarm merging: " + err.Error())
+		}
+	}
+
+	// Scrapes are cached by the infohashes clients ask for.
+	if cfg.ScrapeCache != nil {
+		log.Info("caching scrapes", cfg.ScrapeCache)
+		cache, err := scrapecache.New(store, *cfg.ScrapeCache)
+		if err != nil {
+			return errors.New("failed to set up the scrape cache: " + err.Error())
+		}
+		r.sg.AddFunc(cache.StopCache)
+		store = cache
+	}
+	r.store, r.lister = store, lister
+	r.logicSwitch.setSwarms(store, lister)
+	if lister == nil && cfg.HTTPConfig.FullScrapeInterval > 0 {
+		log.Warn("full scrapes can't be served with this storage configuration")
+	}
+
+	if cfg.Admin != nil {
+		if err := r.startAdmin(*cfg.Admin, store, lister); err != nil {
+			return errors.New("failed to start admin API: " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+// startLogic builds the tracker logic and hands it to the frontends.
+//
+// The previous tracker logic is stopped afterwards. Requests that are in
+// flight while it is replaced may run their PostHooks in the new logic.
+func (r *Run) startLogic(cfg Config) error {
 	preHooks, err := middleware.HooksFromHookConfigs(cfg.PreHooks)
 	if err != nil {
 		return errors.New("failed to validate hook config: " + err.Error())
 	}
+	if cfg.TorrentPolicies != nil || cfg.Admin != nil {
+		// Policies are applied before the middleware that consume them.
+		var path string
+		if cfg.TorrentPolicies != nil {
+			path = cfg.TorrentPolicies.Path
+			log.Info("loading torrent policies", cfg.TorrentPolicies)
+		}
+		if err := r.policies.Open(path); err != nil {
+			return errors.New("failed to load torrent policies: " + err.Error())
+		}
+		preHooks = append([]middleware.Hook{middleware.NamedHook(policy.Name, r.policies)}, preHooks...)
+	}
+	if cfg.Admin != nil {
+		// Banned addresses are rejected before any other middleware runs.
+		preHooks = append([]middleware.Hook{middleware.NamedHook("bans", r.bans)}, preHooks...)
+	}
+	responseHooks, err := middleware.HooksFromHookConfigs(cfg.ResponseHooks)
+	if err != nil {
+		return errors.New("failed to validate hook config: " + err.Error())
+	}
 	postHooks, err := middleware.HooksFromHookConfigs(cfg.PostHooks)
 	if err != nil {
 		return errors.New("failed to validate hook config: " + err.Error())
 	}
 
 	log.Info("starting tracker logic", log.Fields{
-		"prehooks":  cfg.PreHookNames(),
-		"posthooks": cfg.PostHookNames(),
+		"prehooks":      cfg.PreHookNames(),
+		"responsehooks": cfg.ResponseHookNames(),
+		"posthooks":     cfg.PostHookNames(),
 	})
-	r.logic = middleware.NewLogic(cfg.ResponseConfig, r.peerStore, preHooks, postHooks)
+	old := r.logic
+	r.logic = middleware.NewLogicWithResponseHooks(cfg.ResponseConfig, r.store, preHooks, responseHooks, postHooks)
+	r.logicSwitch.set(r.logic)
 
-	if cfg.HTTPConfig.Addr != "" {
-		log.Info("starting HTTP frontend", cfg.HTTPConfig)
-		httpfe, err := http.NewFrontend(r.logic, cfg.HTTPConfig)
-		if err != nil {
-			return err
+	if old != nil {
+		if errs := old.StopWithin(r.cfg.shutdownTimeout()).Wait(); len(errs) != 0 {
+			return combineErrors("failed while shutting down middleware", errs)
 		}
-		r.sg.Add(httpfe)
 	}
+	return nil
+}
 
-	if cfg.UDPConfig.Addr != "" {
-		log.Info("starting UDP frontend", cfg.UDPConfig)
-		udpfe, err := udp.NewFrontend(r.logic, cfg.UDPConfig)
-		if err != nil {
-			return err
-		}
-		r.sg.Add(udpfe)
+// startHTTP starts the HTTP frontend, if it is enabled.
+func (r *Run) startHTTP(cfg http.Config) error {
+	if cfg.Addr == "" {
+		return nil
 	}
 
-	return nil
+	log.Info("starting HTTP frontend", cfg)
+	return r.frontends.Boot("http", func() (server.Server, error) {
+		return http.NewFrontend(&r.logicSwitch, cfg)
+	})
+}
+
+// startUDP starts the UDP frontend, if it is enabled.
+func (r *Run) startUDP(cfg udp.Config) error {
+	if cfg.Addr == "" && cfg.Addr6 == "" {
+		return nil
+	}
+
+	log.Info("starting UDP frontend", cfg)
+	return r.frontends.Boot("udp", func() (server.Server, error) {
+		return udp.NewFrontend(&r.logicSwitch, cfg)
+	})
 }
 
 func combineErrors(prefix string, errs []error) error {
@@ -110,26 +326,71 @@ func combineErrors(prefix string, errs []error) error {
 	return errors.New(prefix + ": " + strings.Join(errStrs, "; "))
 }
 
+// stopFrontends stops the frontends that are running, in the reverse order
+// they were started. Frontends that abandoned in-flight requests have been
+// stopped nonetheless, which is logged by the frontends.
+func (r *Run) stopFrontends(stopHTTP, stopUDP bool) error {
+	var result stop.Result
+	switch {
+	case stopHTTP && stopUDP:
+		result = r.frontends.Stop()
+	case stopHTTP:
+		result = r.frontends.StopServer("http")
+	case stopUDP:
+		result = r.frontends.StopServer("udp")
+	default:
+		return nil
+	}
+
+	var errs []error
+	for _, err := range result.Wait() {
+		if err != frontend.ErrDrainTimeout {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) != 0 {
+		return combineErrors("failed while shutting down frontends", errs)
+	}
+	return nil
+}
+
 // Stop shuts down an instance of Chihaya.
+//
+// The frontends, the services, the tracker logic and the peer store are
+// stopped in this order. Every stage after the frontends is abandoned if it
+// doesn't finish within the shutdown timeout, so that a hung component can't
+// keep the process from exiting. Later stages are stopped even if an earlier
+// one failed, and the errors of all stages are returned.
 func (r *Run) Stop(keepPeerStore bool) (storage.PeerStore, error) {
+	timeout := r.cfg.shutdownTimeout()
+	var errs []error
+
 	log.Debug("stopping frontends and prometheus endpoint")
-	if errs := r.sg.Stop().Wait(); len(errs) != 0 {
-		return nil, combineErrors("failed while shutting down frontends", errs)
+	r.metrics.SetReady(false)
+	if err := r.stopFrontends(true, true); err != nil {
+		errs = append(errs, err)
+	}
+	if stopErrs := stop.WithTimeout(r.sg.Stop(), "services", timeout).Wait(); len(stopErrs) != 0 {
+		errs = append(errs, combineErrors("failed while shutting down services", stopErrs))
 	}
 
 	log.Debug("stopping logic")
-	if errs := r.logic.Stop().Wait(); len(errs) != 0 {
-		return nil, combineErrors("failed while shutting down middleware", errs)
+	if stopErrs := r.logic.StopWithin(timeout).Wait(); len(stopErrs) != 0 {
+		errs = append(errs, combineErrors("failed while shutting down middleware", stopErrs))
 	}
+	r.logic = nil
 
 	if !keepPeerStore {
 		log.Debug("stopping peer store")
-		if errs := r.peerStore.Stop().Wait(); len(errs) != 0 {
-			return nil, combineErrors("failed while shutting down peer store", errs)
+		if stopErrs := stop.WithTimeout(r.peerStore.Stop(), "peer store", timeout).Wait(); len(stopErrs) != 0 {
+			errs = append(errs, combineErrors("failed while shutting down peer store", stopErrs))
 		}
 		r.peerStore = nil
 	}
 
+	if len(errs) != 0 {
+		return nil, combineErrors("failed to shut down cleanly", errs)
+	}
 	return r.peerStore, nil
 }
 
@@ -141,30 +402,110 @@ func RootRunCmdFunc(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	r, err := NewRun(configFilePath)
+	configOverrides, err := cmd.Flags().GetStringArray("set")
+	if err != nil {
+		return err
+	}
+
+	r, err := NewRun(configFilePath, configOverrides)
 	if err != nil {
 		return err
 	}
 
-	quit := make(chan os.Signal)
+	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 
 	reload := makeReloadChan()
+	reopen := makeReopenChan()
+	upgrade := makeUpgradeChan()
+
+	// A configuration kept in etcd is reloaded whenever it changes.
+	etcdChanges := make(chan struct{}, 1)
+	if etcd.IsURL(configFilePath) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go watchEtcdConfig(ctx, configFilePath, etcdChanges)
+	}
+
+	// All frontends have bound their sockets once NewRun returns. If this
+	// process was started to upgrade another one, that one stops now.
+	if handoff.Upgraded() {
+		log.Info("took over the sockets of the previous process")
+	}
+	if err := handoff.Ready(); err != nil {
+		log.Error("failed to report readiness to the previous process", log.Err(err))
+	}
+	notifySystemd("READY=1")
+
+	// The watchdog is fed by the main loop, so that systemd restarts the
+	// process if reloading or shutting down hangs.
+	var watchdog <-chan time.Time
+	if interval := systemd.WatchdogInterval(); interval > 0 {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		watchdog = ticker.C
+	}
 
 	for {
 		select {
+		case <-watchdog:
+			notifySystemd("WATCHDOG=1")
+		case <-reopen:
+			log.Info("reopening access logs; received SIGHUP")
+			if err := accesslog.ReopenAll(); err != nil {
+				log.Error("failed to reopen access logs", log.Err(err))
+			}
 		case <-reload:
 			log.Info("reloading; received SIGUSR1")
-			peerStore, err := r.Stop(true)
-			if err != nil {
+			if err := r.Reload(watchdog); err != nil {
+				return err
+			}
+		case <-r.reloadRequests:
+			log.Info("reloading; requested through the admin API")
+			if err := r.Reload(watchdog); err != nil {
+				return err
+			}
+		case <-etcdChanges:
+			log.Info("reloading; the configuration changed in etcd")
+			if err := r.Reload(watchdog); err != nil {
 				return err
 			}
+		case <-upgrade:
+			log.Info("upgrading; received SIGUSR2")
+			if r.cfg.User != "" || r.cfg.Group != "" || r.cfg.Chroot != "" {
+				// The new process would have to drop privileges again.
+				log.Error("failed to upgrade", log.Err(errors.New("upgrades are not supported when dropping privileges")))
+				continue
+			}
+			proc, err := handoff.Upgrade(r.cfg.upgradeTimeout())
+			if err != nil {
+				// This process keeps serving requests.
+				log.Error("failed to upgrade", log.Err(err))
+				continue
+			}
 
-			if err := r.Start(peerStore); err != nil {
+			// The new process serves requests on the same sockets, so
+			// this one drains and exits.
+			log.Info("shutting down; the new process is ready", log.Fields{"pid": proc.Pid})
+			notifySystemd("MAINPID=" + strconv.Itoa(proc.Pid))
+			if _, err := r.Stop(false); err != nil {
 				return err
 			}
+
+			return nil
+		case err := <-r.frontends.Failed():
+			log.Error("shutting down; a frontend failed", log.Err(err))
+			notifySystemd("STOPPING=1")
+			if _, stopErr := r.Stop(false); stopErr != nil {
+				log.Error("failed to shut down cleanly", log.Err(stopErr))
+			}
+			return err
 		case <-quit:
 			log.Info("shutting down; received SIGINT/SIGTERM")
+			// The lock is released by the process replacing this one or
+			// expires if this node doesn't come back.
+			r.awaitRestartTurn(watchdog)
+			notifySystemd("STOPPING=1")
 			if _, err := r.Stop(false); err != nil {
 				return err
 			}
@@ -174,6 +515,14 @@ func RootRunCmdFunc(cmd *cobra.Command, args []string) error {
 	}
 }
 
+// notifySystemd notifies systemd of a state change, if chihaya was started by
+// systemd.
+func notifySystemd(state string) {
+	if _, err := systemd.Notify(state); err != nil {
+		log.Warn("failed to notify systemd", log.Fields{"state": state, "error": err.Error()})
+	}
+}
+
 // RootPreRunCmdFunc handles command line flags for the Run command.
 func RootPreRunCmdFunc(cmd *cobra.Command, args []string) error {
 	noColors, err := cmd.Flags().GetBool("nocolors")
@@ -228,6 +577,12 @@ func RootPreRunCmdFunc(cmd *cobra.Command, args []string) error {
 		log.Info("enabled CPU profiling", log.Fields{"path": cpuProfilePath})
 	}
 
+	// Unless GOMAXPROCS is set explicitly, the Go runtime sizes it to the
+	// CPUs of the host rather than those of a container.
+	if previous, current := cpus.AdjustGOMAXPROCS(); current != previous {
+		log.Info("lowered GOMAXPROCS to the CPU limit of the cgroup", log.Fields{"previous": previous, "GOMAXPROCS": current})
+	}
+
 	return nil
 }
 
@@ -261,7 +616,8 @@ func main() {
 		rootCmd.PersistentFlags().Bool("nocolors", false, "disable log coloring")
 	}
 
-	rootCmd.Flags().String("config", "/etc/chihaya.yaml", "location of configuration file")
+	rootCmd.Flags().String("config", "/etc/chihaya.yaml", "location of configuration file, or etcd://host:port/key to read it from etcd")
+	rootCmd.Flags().StringArray("set", nil, "override a key of the configuration file, e.g. --set udp.addr=:6969 (repeatable)")
 
 	var e2eCmd = &cobra.Command{
 		Use:   "e2e",
@@ -276,6 +632,13 @@ func main() {
 
 	rootCmd.AddCommand(e2eCmd)
 
+	rootCmd.AddCommand(&cobra.Command{
+		Use:   "config-keys",
+		Short: "list configuration keys",
+		Long:  "List the configuration keys that can be overridden, with their environment variables",
+		Run:   ConfigKeysCmdFunc,
+	})
+
 	if err := rootCmd.Execute(); err != nil {
 		log.Fatal("failed when executing root cobra command: " + err.Error())
 	}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// envPrefix is the prefix of environment variables overriding the
+// configuration.
+const envPrefix = "CHIHAYA_"
+
+var unmarshalerType = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+
+// configKeys maps the keys of the configuration that can be overridden, such
+// as "udp.addr", to the types they are unmarshaled into.
+//
+// Keys are the leaves of the configuration structs. Values that are not
+// structs, such as lists and the configuration of storage and middleware, can
+// only be overridden as a whole.
+var configKeys = func() map[string]reflect.Type {
+	keys := make(map[string]reflect.Type)
+	collectConfigKeys(reflect.TypeOf(Config{}), "", keys)
+	return keys
+}()
+
+func collectConfigKeys(t reflect.Type, prefix string, keys map[string]reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		tag := strings.Split(field.Tag.Get("yaml"), ",")
+		name := tag[0]
+		if name == "-" {
+			continue
+		}
+		if len(tag) > 1 && tag[1] == "inline" {
+			collectConfigKeys(field.Type, prefix, keys)
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+
+		ft := field.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Struct && !reflect.PtrTo(ft).Implements(unmarshalerType) {
+			collectConfigKeys(ft, prefix+name+".", keys)
+			continue
+		}
+		keys[prefix+name] = ft
+	}
+}
+
+// envName returns the name of the environment variable overriding key.
+func envName(key string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(key, ".", "_", -1))
+}
+
+// configOverride replaces the value of a key of the configuration.
+type configOverride struct {
+	key   string
+	value string
+}
+
+// envOverrides returns the overrides set in the environment, ordered by key.
+func envOverrides() (overrides []configOverride) {
+	for key := range configKeys {
+		if value, ok := os.LookupEnv(envName(key)); ok {
+			overrides = append(overrides, configOverride{key, value})
+		}
+	}
+	sort.Slice(overrides, func(i, j int) bool { return overrides[i].key < overrides[j].key })
+	return
+}
+
+// parseOverrides parses overrides of the form "key=value", as given with the
+// --set flag.
+func parseOverrides(sets []string) (overrides []configOverride, err error) {
+	for _, set := range sets {
+		i := strings.IndexByte(set, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid override %q: must be key=value", set)
+		}
+		key := set[:i]
+		if _, ok := configKeys[key]; !ok {
+			return nil, fmt.Errorf("invalid override %q: unknown key %q", set, key)
+		}
+		overrides = append(overrides, configOverride{key, set[i+1:]})
+	}
+	return
+}
+
+// applyOverrides unmarshals overrides into cfgFile, replacing the values of
+// their keys. Later overrides of the same key take precedence.
+//
+// Values are parsed as YAML, except for strings, which are used verbatim.
+func applyOverrides(cfgFile *ConfigFile, overrides []configOverride) error {
+	if len(overrides) == 0 {
+		return nil
+	}
+
+	doc := make(map[string]interface{})
+	for _, o := range overrides {
+		var value interface{} = o.value
+		if configKeys[o.key].Kind() != reflect.String {
+			if err := yaml.Unmarshal([]byte(o.value), &value); err != nil {
+				return fmt.Errorf("invalid value of %s: %s", o.key, err)
+			}
+		}
+
+		path := strings.Split(o.key, ".")
+		node := doc
+		for _, name := range path[:len(path)-1] {
+			child, ok := node[name].(map[string]interface{})
+			if !ok {
+				child = make(map[string]interface{})
+				node[name] = child
+			}
+			node = child
+		}
+		node[path[len(path)-1]] = value
+	}
+
+	contents, err := yaml.Marshal(map[string]interface{}{"chihaya": doc})
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(contents, cfgFile)
+}
+
+// ConfigKeysCmdFunc implements a Cobra command that lists the keys of the
+// configuration that can be overridden, along with their environment
+// variables.
+func ConfigKeysCmdFunc(cmd *cobra.Command, args []string) {
+	keys := make([]string, 0, len(configKeys))
+	for key := range configKeys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Printf("%-48s %s\n", key, envName(key))
+	}
+}
@@ -0,0 +1,80 @@
+// +build darwin freebsd linux netbsd openbsd dragonfly solaris
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges changes the root directory of the process to chroot and
+// changes its user and group to those of the given names.
+// Empty arguments leave the respective property unchanged.
+//
+// This must be called after all privileged sockets were bound.
+//
+// Changing the user and group requires Go 1.16, which changes them for all
+// threads of the process.
+func dropPrivileges(username, groupname, chroot string) error {
+	if username == "" && groupname == "" && chroot == "" {
+		return nil
+	}
+	if os.Geteuid() != 0 {
+		return errors.New("must be started as root to drop privileges")
+	}
+
+	// Users and groups are looked up before changing the root directory,
+	// which usually doesn't contain the databases.
+	uid, gid := -1, -1
+	if username != "" {
+		u, err := user.Lookup(username)
+		if err != nil {
+			return err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(u.Gid); err != nil {
+			return err
+		}
+	}
+	if groupname != "" {
+		g, err := user.LookupGroup(groupname)
+		if err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return err
+		}
+	}
+
+	if chroot != "" {
+		if err := syscall.Chroot(chroot); err != nil {
+			return err
+		}
+		if err := os.Chdir("/"); err != nil {
+			return err
+		}
+	}
+
+	// The group must be changed first, as changing it requires the
+	// privileges of root.
+	if gid != -1 {
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return err
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return err
+		}
+	}
+	if uid != -1 {
+		if err := syscall.Setuid(uid); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,13 @@
+// +build windows
+
+package main
+
+import "errors"
+
+// dropPrivileges is not supported on Windows.
+func dropPrivileges(username, groupname, chroot string) error {
+	if username == "" && groupname == "" && chroot == "" {
+		return nil
+	}
+	return errors.New("dropping privileges is not supported on windows")
+}
@@ -0,0 +1,88 @@
+package main
+
+// profiles are named configurations bundling defaults for common setups.
+//
+// A config file extends a profile by setting "profile" in its chihaya block.
+// Values set in the file override those of the profile; lists, such as the
+// hooks, and the storage block replace those of the profile entirely.
+// Profiles can themselves extend other profiles.
+var profiles = map[string]string{
+	// public is an open tracker accepting announces for any torrent over
+	// both HTTP and UDP.
+	"public": `
+chihaya:
+  announce_interval: 30m
+  min_announce_interval: 15m
+  prometheus_addr: "0.0.0.0:6880"
+  http:
+    addr: "0.0.0.0:6969"
+    read_timeout: 5s
+    write_timeout: 5s
+    announce_routes: ["/announce"]
+    scrape_routes: ["/scrape"]
+    real_ip_header: "x-real-ip"
+    max_numwant: 100
+    default_numwant: 50
+    max_scrape_infohashes: 50
+  udp:
+    addr: "0.0.0.0:6969"
+    max_clock_skew: 10s
+    max_numwant: 100
+    default_numwant: 50
+    max_scrape_infohashes: 50
+  storage:
+    name: memory
+    config:
+      gc_interval: 3m
+      peer_lifetime: 31m
+      shard_count: 1024
+      prometheus_reporting_interval: 1s
+`,
+
+	// private is a tracker behind an authorizing site, such as Gazelle.
+	// Announces are only accepted over HTTP on routes containing a passkey.
+	// Checking the passkey is left to a prehook, such as passkey, which must
+	// be added by the config file.
+	"private": `
+chihaya:
+  profile: public
+  announce_interval: 45m
+  min_announce_interval: 30m
+  http:
+    announce_routes: ["/:passkey/announce"]
+    scrape_routes: ["/:passkey/scrape"]
+  udp:
+    addr: ""
+  storage:
+    name: memory
+    config:
+      gc_interval: 3m
+      peer_lifetime: 46m
+      shard_count: 1024
+      prometheus_reporting_interval: 1s
+`,
+
+	// lan is a tracker for a local network, where clients advertise their
+	// own addresses and announce frequently.
+	"lan": `
+chihaya:
+  profile: public
+  announce_interval: 2m
+  min_announce_interval: 1m
+  http:
+    ip_spoofing:
+      allow_ipv4: true
+      allow_ipv6: true
+  udp:
+    ip_spoofing:
+      allow_ipv4: true
+      allow_ipv6: true
+  storage:
+    name: memory
+    config:
+      gc_interval: 1m
+      peer_lifetime: 3m
+      shard_count: 16
+      prometheus_reporting_interval: 1s
+`,
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/frontend"
+	"github.com/chihaya/chihaya/pkg/admin"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/policy"
+	"github.com/chihaya/chihaya/pkg/stop"
+	"github.com/chihaya/chihaya/storage"
+)
+
+// logicSwitch is a frontend.TrackerLogic passing requests on to the current
+// tracker logic, so that it can be replaced without restarting the
+// frontends.
+type logicSwitch struct {
+	v atomic.Value
+
+	// swarms holds the swarmSource full scrapes are generated from.
+	swarms atomic.Value
+
+	// policies hides the swarms of torrents hidden from scrapes from full
+	// scrapes.
+	policies *policy.Store
+}
+
+// swarmSource is the PeerStore used by the tracker logic and the SwarmLister
+// listing its swarms, which is nil if they can't be listed.
+type swarmSource struct {
+	store  storage.PeerStore
+	lister storage.SwarmLister
+}
+
+var (
+	_ frontend.TrackerLogic = &logicSwitch{}
+	_ frontend.FullScraper  = &logicSwitch{}
+)
+
+func (s *logicSwitch) set(logic frontend.TrackerLogic) { s.v.Store(logic) }
+
+func (s *logicSwitch) setSwarms(store storage.PeerStore, lister storage.SwarmLister) {
+	s.swarms.Store(swarmSource{store, lister})
+}
+
+func (s *logicSwitch) current() frontend.TrackerLogic {
+	return s.v.Load().(frontend.TrackerLogic)
+}
+
+// HandleAnnounce implements frontend.TrackerLogic.
+func (s *logicSwitch) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest) (context.Context, *bittorrent.AnnounceResponse, error) {
+	return s.current().HandleAnnounce(ctx, req)
+}
+
+// AfterAnnounce implements frontend.TrackerLogic.
+func (s *logicSwitch) AfterAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) {
+	s.current().AfterAnnounce(ctx, req, resp)
+}
+
+// HandleScrape implements frontend.TrackerLogic.
+func (s *logicSwitch) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest) (context.Context, *bittorrent.ScrapeResponse, error) {
+	return s.current().HandleScrape(ctx, req)
+}
+
+// AfterScrape implements frontend.TrackerLogic.
+func (s *logicSwitch) AfterScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) {
+	s.current().AfterScrape(ctx, req, resp)
+}
+
+// FullScrape implements frontend.FullScraper.
+func (s *logicSwitch) FullScrape(ctx context.Context, af bittorrent.AddressFamily) ([]bittorrent.Scrape, error) {
+	src, _ := s.swarms.Load().(swarmSource)
+	if src.lister == nil {
+		return nil, errors.New("the storage does not support listing swarms")
+	}
+
+	infoHashes, err := src.lister.ListSwarms(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	scrapes := make([]bittorrent.Scrape, 0, len(infoHashes))
+	for _, ih := range infoHashes {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if s.policies.Hidden(ih) {
+			continue
+		}
+		scrapes = append(scrapes, src.store.ScrapeSwarm(ctx, ih, af))
+	}
+	return scrapes, nil
+}
+
+// configSection is a part of the configuration that is applied as a whole
+// when reloading.
+type configSection struct {
+	name string
+	get  func(Config) interface{}
+
+	// services is true if the section is applied by restarting the
+	// services, which also rebuilds the tracker logic.
+	services bool
+
+	// requiresRestart is true if the section can only be applied by
+	// restarting the process.
+	requiresRestart bool
+}
+
+// configSections are the sections compared when reloading, in the order they
+// are reported. The tracker-wide limits are part of the frontend sections,
+// since ParseConfigFile applies them to the frontends.
+var configSections = []configSection{
+	{name: "metrics", get: func(cfg Config) interface{} { return []interface{}{cfg.PrometheusAddr, cfg.MetricsPush} }, services: true},
+	{name: "replication", get: func(cfg Config) interface{} { return cfg.Replication }, services: true},
+	{name: "infohash_privacy", get: func(cfg Config) interface{} { return cfg.InfoHashPrivacy }, services: true},
+	{name: "swarm_merging", get: func(cfg Config) interface{} { return cfg.SwarmMerging }, services: true},
+	{name: "scrape_cache", get: func(cfg Config) interface{} { return cfg.ScrapeCache }, services: true},
+	{name: "admin", get: func(cfg Config) interface{} { return cfg.Admin }, services: true},
+	{name: "middleware", get: func(cfg Config) interface{} {
+		return []interface{}{cfg.ResponseConfig, cfg.PreHooks, cfg.ResponseHooks, cfg.PostHooks}
+	}},
+	{name: "torrent_policies", get: func(cfg Config) interface{} { return cfg.TorrentPolicies }},
+	{name: "http", get: func(cfg Config) interface{} { return cfg.HTTPConfig }},
+	{name: "udp", get: func(cfg Config) interface{} { return cfg.UDPConfig }},
+	{name: "storage", get: func(cfg Config) interface{} { return cfg.Storage }, requiresRestart: true},
+	{name: "privileges", get: func(cfg Config) interface{} { return []interface{}{cfg.User, cfg.Group, cfg.Chroot} }, requiresRestart: true},
+	{name: "restart_coordination", get: func(cfg Config) interface{} { return cfg.RestartCoordination }, requiresRestart: true},
+}
+
+// changedSections returns the sections that differ between old and new.
+func changedSections(old, new Config) (changed []configSection) {
+	for _, section := range configSections {
+		if !reflect.DeepEqual(section.get(old), section.get(new)) {
+			changed = append(changed, section)
+		}
+	}
+	return
+}
+
+// Reload applies the changes of the configuration file.
+//
+// Only the parts of the tracker whose configuration changed are restarted:
+// the services (metrics, replication and the admin API) together with the
+// tracker logic, the tracker logic alone if only the middleware changed, and
+// each frontend only if its own configuration changed. Changes to the
+// storage, the privileges and the restart coordination are not applied, but
+// reported as requiring a restart.
+//
+// A configuration that can't be read is reported without applying anything.
+// An error is returned if the tracker could not be restarted.
+func (r *Run) Reload(watchdog <-chan time.Time) error {
+	report := &admin.ReloadReport{
+		Time:            time.Now(),
+		Applied:         []string{},
+		Restarted:       []string{},
+		RequiresRestart: []string{},
+	}
+	defer func() {
+		r.lastReloadMu.Lock()
+		r.lastReload = report
+		r.lastReloadMu.Unlock()
+	}()
+
+	configFile, err := ParseConfigFile(r.configFilePath, r.configOverrides...)
+	if err != nil {
+		report.Error = "failed to read config: " + err.Error()
+		log.Error("not reloading", log.Fields{"error": report.Error})
+		return nil
+	}
+	cfg := configFile.Chihaya
+
+	var restartServices, rebuildLogic, restartHTTP, restartUDP bool
+	for _, section := range changedSections(r.cfg, cfg) {
+		if section.requiresRestart {
+			report.RequiresRestart = append(report.RequiresRestart, section.name)
+			continue
+		}
+		report.Applied = append(report.Applied, section.name)
+
+		switch {
+		case section.services:
+			restartServices = true
+		case section.name == "middleware", section.name == "torrent_policies":
+			rebuildLogic = true
+		case section.name == "http":
+			restartHTTP = true
+		case section.name == "udp":
+			restartUDP = true
+		}
+	}
+
+	// Sections that require a restart keep their current configuration, so
+	// that they are reported again by later reloads.
+	cfg.Storage = r.cfg.Storage
+	cfg.User, cfg.Group, cfg.Chroot = r.cfg.User, r.cfg.Group, r.cfg.Chroot
+	cfg.RestartCoordination = r.cfg.RestartCoordination
+
+	// Draining frontends take turns with the other nodes of a cluster.
+	if restartHTTP || restartUDP {
+		r.awaitRestartTurn(watchdog)
+	}
+	notifySystemd("RELOADING=1")
+
+	if restartServices {
+		r.metrics.SetReady(false)
+		if errs := stop.WithTimeout(r.sg.Stop(), "services", r.cfg.shutdownTimeout()).Wait(); len(errs) != 0 {
+			return combineErrors("failed while shutting down services", errs)
+		}
+		if err := r.startServices(cfg); err != nil {
+			return err
+		}
+		report.Restarted = append(report.Restarted, "services")
+	}
+	if restartServices || rebuildLogic {
+		if err := r.startLogic(cfg); err != nil {
+			return err
+		}
+		report.Restarted = append(report.Restarted, "middleware")
+	}
+
+	if restartHTTP || restartUDP {
+		r.metrics.SetReady(false)
+		if err := r.stopFrontends(restartHTTP, restartUDP); err != nil {
+			return err
+		}
+	}
+	if restartHTTP {
+		if err := r.startHTTP(cfg.HTTPConfig); err != nil {
+			return err
+		}
+		report.Restarted = append(report.Restarted, "http")
+	}
+	if restartUDP {
+		if err := r.startUDP(cfg.UDPConfig); err != nil {
+			return err
+		}
+		report.Restarted = append(report.Restarted, "udp")
+	}
+
+	if restartHTTP || restartUDP {
+		r.finishRestartTurn()
+	}
+	r.metrics.SetReady(true)
+	notifySystemd("READY=1")
+	r.cfg = cfg
+
+	log.Info("reloaded configuration", report)
+	return nil
+}
+
+// RequestReload implements admin.Reloader by requesting a reload from the
+// main loop.
+func (r *Run) RequestReload() {
+	select {
+	case r.reloadRequests <- struct{}{}:
+	default:
+		// A reload is pending already.
+	}
+}
+
+// LastReload implements admin.Reloader.
+func (r *Run) LastReload() *admin.ReloadReport {
+	r.lastReloadMu.Lock()
+	defer r.lastReloadMu.Unlock()
+	return r.lastReload
+}
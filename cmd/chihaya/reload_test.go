@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/admin"
+)
+
+func TestChangedSections(t *testing.T) {
+	var table = []struct {
+		name     string
+		modify   func(cfg *Config)
+		expected []string
+	}{
+		{"unchanged", func(*Config) {}, nil},
+		{"interval", func(cfg *Config) { cfg.AnnounceInterval = time.Hour }, []string{"middleware"}},
+		{"hooks", func(cfg *Config) {
+			cfg.PreHooks = []middleware.HookConfig{{Name: "varinterval"}}
+		}, []string{"middleware"}},
+		{"frontends", func(cfg *Config) {
+			cfg.HTTPConfig.Addr = "127.0.0.1:6969"
+			cfg.UDPConfig.MaxNumWant = 10
+		}, []string{"http", "udp"}},
+		{"services", func(cfg *Config) {
+			cfg.PrometheusAddr = "127.0.0.1:6880"
+			cfg.Admin = &admin.Config{}
+		}, []string{"metrics", "admin"}},
+		{"restart", func(cfg *Config) {
+			cfg.Storage.Name = "redis"
+			cfg.User = "nobody"
+		}, []string{"storage", "privileges"}},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.name, func(t *testing.T) {
+			var old ConfigFile
+			var problems []string
+			require.Nil(t, parseConfig(nil, "public", "test", &old, make(map[string]bool), &problems))
+
+			var cfgFile ConfigFile
+			require.Nil(t, parseConfig(nil, "public", "test", &cfgFile, make(map[string]bool), &problems))
+			tt.modify(&cfgFile.Chihaya)
+
+			var names []string
+			for _, section := range changedSections(old.Chihaya, cfgFile.Chihaya) {
+				names = append(names, section.name)
+			}
+			require.Equal(t, tt.expected, names)
+		})
+	}
+}
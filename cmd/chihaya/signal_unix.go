@@ -9,7 +9,23 @@ import (
 )
 
 func makeReloadChan() <-chan os.Signal {
-	reload := make(chan os.Signal)
+	reload := make(chan os.Signal, 1)
 	signal.Notify(reload, syscall.SIGUSR1)
 	return reload
 }
+
+// makeUpgradeChan returns a channel that receives SIGUSR2, which requests
+// upgrading to a new binary by handing the sockets off to a new process.
+func makeUpgradeChan() <-chan os.Signal {
+	upgrade := make(chan os.Signal, 1)
+	signal.Notify(upgrade, syscall.SIGUSR2)
+	return upgrade
+}
+
+// makeReopenChan returns a channel that receives SIGHUP, which is sent by log
+// rotation tools after moving the access logs.
+func makeReopenChan() <-chan os.Signal {
+	reopen := make(chan os.Signal, 1)
+	signal.Notify(reopen, syscall.SIGHUP)
+	return reopen
+}
@@ -9,7 +9,19 @@ import (
 )
 
 func makeReloadChan() <-chan os.Signal {
-	reload := make(chan os.Signal)
+	reload := make(chan os.Signal, 1)
 	signal.Notify(reload, syscall.SIGHUP)
 	return reload
 }
+
+// makeUpgradeChan returns nil, because sockets can't be handed off to a new
+// process on Windows.
+func makeUpgradeChan() <-chan os.Signal {
+	return nil
+}
+
+// makeReopenChan returns nil, because SIGHUP is used for reloading on Windows.
+// Access logs are reopened when reloading anyway.
+func makeReopenChan() <-chan os.Signal {
+	return nil
+}
@@ -0,0 +1,332 @@
+// Command chihayactl controls a running instance of chihaya through its admin
+// API.
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/admin"
+	"github.com/chihaya/chihaya/pkg/policy"
+)
+
+// tokenEnv is the environment variable the token is read from, if it is not
+// given as a flag. It keeps the token out of the process list.
+const tokenEnv = "CHIHAYACTL_TOKEN"
+
+// newClient creates a client of the admin API from the persistent flags.
+func newClient(cmd *cobra.Command) (*admin.Client, error) {
+	flags := cmd.Flags()
+	addr, err := flags.GetString("addr")
+	if err != nil {
+		return nil, err
+	}
+	token, err := flags.GetString("token")
+	if err != nil {
+		return nil, err
+	}
+	if token == "" {
+		token = os.Getenv(tokenEnv)
+	}
+	caPath, err := flags.GetString("cacert")
+	if err != nil {
+		return nil, err
+	}
+	certPath, err := flags.GetString("cert")
+	if err != nil {
+		return nil, err
+	}
+	keyPath, err := flags.GetString("key")
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := flags.GetDuration("timeout")
+	if err != nil {
+		return nil, err
+	}
+
+	tlsCfg := &tls.Config{}
+	if caPath != "" {
+		pem, err := ioutil.ReadFile(caPath)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.RootCAs = x509.NewCertPool()
+		if !tlsCfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + caPath)
+		}
+	}
+	if (certPath == "") != (keyPath == "") {
+		return nil, errors.New("--cert and --key must be given together")
+	}
+	if certPath != "" {
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+
+	client := &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{TLSClientConfig: tlsCfg},
+	}
+	return admin.NewClient(addr, token, client), nil
+}
+
+// parseInfoHash parses a hex-encoded infohash.
+func parseInfoHash(s string) (bittorrent.InfoHash, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 20 {
+		return bittorrent.InfoHash{}, fmt.Errorf("invalid infohash %q: must be 40 hexadecimal characters", s)
+	}
+	return bittorrent.InfoHashFromBytes(b), nil
+}
+
+// setPolicyCommand returns the command replacing the policy of a torrent,
+// which takes the policy as flags.
+func setPolicyCommand() *cobra.Command {
+	var p policy.Policy
+	var approval string
+	cmd := command("set-policy <infohash>", "replace the policy of a torrent", cobra.ExactArgs(1), func(c *admin.Client, args []string) error {
+		ih, err := parseInfoHash(args[0])
+		if err != nil {
+			return err
+		}
+		p.Approval = policy.Approval(approval)
+		if err := p.Validate(); err != nil {
+			return err
+		}
+		return c.SetPolicy(ih, p)
+	})
+	flags := cmd.Flags()
+	flags.DurationVar(&p.Interval, "interval", 0, "announce interval of the torrent, 0 for the default")
+	flags.BoolVar(&p.Freeleech, "freeleech", false, "don't count downloads of the torrent")
+	flags.StringVar(&approval, "approval", "", "approved or unapproved, empty to leave it to the torrent approval middleware")
+	flags.StringVar(&p.Category, "category", "", "category of the torrent")
+	flags.BoolVar(&p.HideFromScrapes, "hide-from-scrapes", false, "scrape the swarm of the torrent as empty")
+	return cmd
+}
+
+// printJSON writes v to stdout as indented JSON.
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// command returns a command calling fn with a client of the admin API.
+func command(use, short string, args cobra.PositionalArgs, fn func(c *admin.Client, args []string) error) *cobra.Command {
+	return &cobra.Command{
+		Use:          use,
+		Short:        short,
+		Args:         args,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := newClient(cmd)
+			if err != nil {
+				return err
+			}
+			return fn(c, args)
+		},
+	}
+}
+
+// rejectionsCommand returns the command showing the rejections of the
+// middleware, which takes the window as a flag.
+func rejectionsCommand() *cobra.Command {
+	var window time.Duration
+	cmd := command("rejections", "show why requests were rejected, and whose", cobra.NoArgs, func(c *admin.Client, args []string) error {
+		summary, err := c.Rejections(window)
+		if err != nil {
+			return err
+		}
+		return printJSON(summary)
+	})
+	cmd.Flags().DurationVar(&window, "window", time.Hour, "window to aggregate rejections over, up to 24h")
+	return cmd
+}
+
+// watchCommand returns the command recording the announces of a peer, which
+// takes the number of announces to keep as a flag.
+func watchCommand() *cobra.Command {
+	var size int
+	cmd := command("watch <peer id or ip>", "record the announces of a peer, given by hex-encoded peer ID or IP address", cobra.ExactArgs(1), func(c *admin.Client, args []string) error {
+		watch, err := c.Watch(args[0], size)
+		if err != nil {
+			return err
+		}
+		fmt.Println("recording the announces of", watch)
+		return nil
+	})
+	cmd.Flags().IntVar(&size, "size", 0, "number of announces to keep (default 50)")
+	return cmd
+}
+
+// torrentsCommand returns the command listing torrents, which lists the idle
+// torrents instead if the idle flag is set.
+func torrentsCommand() *cobra.Command {
+	var idle time.Duration
+	cmd := command("torrents", "list all torrents with peers", cobra.NoArgs, func(c *admin.Client, args []string) error {
+		var torrents []admin.Torrent
+		var err error
+		if idle > 0 {
+			torrents, err = c.IdleTorrents(idle)
+		} else {
+			torrents, err = c.Torrents()
+		}
+		if err != nil {
+			return err
+		}
+		return printJSON(torrents)
+	})
+	cmd.Flags().DurationVar(&idle, "idle", 0, "list the torrents not announced to within this duration instead, with or without peers")
+	return cmd
+}
+
+func main() {
+	var rootCmd = &cobra.Command{
+		Use:   "chihayactl",
+		Short: "Control a running BitTorrent Tracker",
+		Long:  "Inspect and control a running instance of chihaya through its admin API",
+	}
+
+	rootCmd.PersistentFlags().String("addr", "http://127.0.0.1:6882", "base URL of the admin API")
+	rootCmd.PersistentFlags().String("token", "", "token for the admin API (default $"+tokenEnv+")")
+	rootCmd.PersistentFlags().String("cacert", "", "location of the CA certificates verifying the admin API")
+	rootCmd.PersistentFlags().String("cert", "", "location of the client certificate")
+	rootCmd.PersistentFlags().String("key", "", "location of the key of the client certificate")
+	rootCmd.PersistentFlags().Duration("timeout", time.Minute, "timeout of requests")
+
+	rootCmd.AddCommand(
+		command("stats", "show the numbers of torrents, seeders and leechers", cobra.NoArgs, func(c *admin.Client, args []string) error {
+			stats, err := c.Stats()
+			if err != nil {
+				return err
+			}
+			return printJSON(stats)
+		}),
+		rejectionsCommand(),
+		command("merges", "list the classes of equivalent infohashes whose swarms are merged", cobra.NoArgs, func(c *admin.Client, args []string) error {
+			merges, err := c.Merges()
+			if err != nil {
+				return err
+			}
+			return printJSON(merges)
+		}),
+		torrentsCommand(),
+		command("swarm <infohash>", "show a torrent and its peers", cobra.ExactArgs(1), func(c *admin.Client, args []string) error {
+			ih, err := parseInfoHash(args[0])
+			if err != nil {
+				return err
+			}
+			swarm, err := c.Swarm(ih)
+			if err != nil {
+				return err
+			}
+			return printJSON(swarm)
+		}),
+		command("drop-swarm <infohash>", "remove all peers of a torrent", cobra.ExactArgs(1), func(c *admin.Client, args []string) error {
+			ih, err := parseInfoHash(args[0])
+			if err != nil {
+				return err
+			}
+			deleted, err := c.DropSwarm(ih)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("removed %d peers\n", deleted)
+			return nil
+		}),
+		command("bans", "list banned IP addresses and ranges", cobra.NoArgs, func(c *admin.Client, args []string) error {
+			bans, err := c.Bans()
+			if err != nil {
+				return err
+			}
+			for _, ban := range bans {
+				fmt.Println(ban)
+			}
+			return nil
+		}),
+		command("ban-ip <ip or cidr>", "ban an IP address or range", cobra.ExactArgs(1), func(c *admin.Client, args []string) error {
+			ban, err := c.Ban(args[0])
+			if err != nil {
+				return err
+			}
+			fmt.Println("banned", ban)
+			return nil
+		}),
+		command("unban-ip <ip or cidr>", "lift a ban", cobra.ExactArgs(1), func(c *admin.Client, args []string) error {
+			return c.Unban(args[0])
+		}),
+		command("watches", "list the peers whose announces are recorded", cobra.NoArgs, func(c *admin.Client, args []string) error {
+			watches, err := c.Watches()
+			if err != nil {
+				return err
+			}
+			return printJSON(watches)
+		}),
+		watchCommand(),
+		command("unwatch <peer id or ip>", "stop recording the announces of a peer", cobra.ExactArgs(1), func(c *admin.Client, args []string) error {
+			return c.Unwatch(args[0])
+		}),
+		command("history <peer id or ip>", "show the recorded announces of a peer", cobra.ExactArgs(1), func(c *admin.Client, args []string) error {
+			history, err := c.History(args[0])
+			if err != nil {
+				return err
+			}
+			return printJSON(history)
+		}),
+		command("policies", "list the policies of all torrents with one", cobra.NoArgs, func(c *admin.Client, args []string) error {
+			policies, err := c.Policies()
+			if err != nil {
+				return err
+			}
+			return printJSON(policies)
+		}),
+		command("policy <infohash>", "show the policy of a torrent", cobra.ExactArgs(1), func(c *admin.Client, args []string) error {
+			ih, err := parseInfoHash(args[0])
+			if err != nil {
+				return err
+			}
+			p, err := c.Policy(ih)
+			if err != nil {
+				return err
+			}
+			return printJSON(p)
+		}),
+		setPolicyCommand(),
+		command("delete-policy <infohash>", "remove the policy of a torrent", cobra.ExactArgs(1), func(c *admin.Client, args []string) error {
+			ih, err := parseInfoHash(args[0])
+			if err != nil {
+				return err
+			}
+			return c.DeletePolicy(ih)
+		}),
+		command("reload-config", "reload the configuration file", cobra.NoArgs, func(c *admin.Client, args []string) error {
+			return c.Reload()
+		}),
+		command("reload-status", "show what the last reload applied", cobra.NoArgs, func(c *admin.Client, args []string) error {
+			report, err := c.LastReload()
+			if err != nil {
+				return err
+			}
+			return printJSON(report)
+		}),
+	)
+
+	if err := rootCmd.Execute(); err != nil {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,26 @@
+package frontend
+
+import (
+	"context"
+	"time"
+)
+
+// Detach returns a context that carries the values of ctx, but is never
+// canceled and has no deadline.
+//
+// Frontends pass the context of a request to the TrackerLogic so that it is
+// canceled when the request times out or the client disconnects.
+// AfterAnnounce and AfterScrape run after the response has been delivered and
+// must not be aborted with the request, so they receive a detached context.
+func Detach(ctx context.Context) context.Context {
+	return detachedContext{ctx}
+}
+
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
@@ -0,0 +1,23 @@
+package frontend
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testKey struct{}
+
+func TestDetach(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), testKey{}, "value"))
+	detached := Detach(ctx)
+	cancel()
+
+	require.Equal(t, context.Canceled, ctx.Err())
+	require.Nil(t, detached.Err())
+	require.Nil(t, detached.Done())
+	_, ok := detached.Deadline()
+	require.False(t, ok)
+	require.Equal(t, "value", detached.Value(testKey{}))
+}
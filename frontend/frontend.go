@@ -2,13 +2,23 @@ package frontend
 
 import (
 	"context"
+	"errors"
 
 	"github.com/chihaya/chihaya/bittorrent"
 )
 
+// ErrDrainTimeout is returned by frontends that were stopped before all
+// in-flight requests were handled, because draining them took longer than
+// configured.
+var ErrDrainTimeout = errors.New("timed out draining in-flight requests")
+
 // TrackerLogic is the interface used by a frontend in order to: (1) generate a
 // response from a parsed request, and (2) asynchronously observe anything
 // after the response has been delivered to the client.
+//
+// The context passed to HandleAnnounce and HandleScrape is canceled when the
+// request is aborted, for example because it timed out or the client
+// disconnected, and should be passed on to any calls to remote services.
 type TrackerLogic interface {
 	// HandleAnnounce generates a response for an Announce.
 	//
@@ -18,6 +28,7 @@ type TrackerLogic interface {
 
 	// AfterAnnounce does something with the results of an Announce after it
 	// has been completed.
+	// The context is not canceled when the request is done, see Detach.
 	AfterAnnounce(context.Context, *bittorrent.AnnounceRequest, *bittorrent.AnnounceResponse)
 
 	// HandleScrape generates a response for a Scrape.
@@ -27,5 +38,13 @@ type TrackerLogic interface {
 	HandleScrape(context.Context, *bittorrent.ScrapeRequest) (context.Context, *bittorrent.ScrapeResponse, error)
 
 	// AfterScrape does something with the results of a Scrape after it has been completed.
+	// The context is not canceled when the request is done, see Detach.
 	AfterScrape(context.Context, *bittorrent.ScrapeRequest, *bittorrent.ScrapeResponse)
 }
+
+// FullScraper is implemented by TrackerLogics that can scrape all swarms at
+// once, which frontends use to serve full scrapes.
+type FullScraper interface {
+	// FullScrape returns the Scrapes of all swarms for the address family.
+	FullScrape(context.Context, bittorrent.AddressFamily) ([]bittorrent.Scrape, error)
+}
@@ -0,0 +1,102 @@
+package http
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/chihaya/chihaya/pkg/accesslog"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// accessLogHandler logs every request handled by h to l, or to the logger at
+// the info level if l is nil.
+//
+// If redact is set, the values of info_hash parameters are replaced, so that
+// the log doesn't reveal which torrents were tracked.
+func accessLogHandler(h http.Handler, l *accesslog.Log, redact bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &recordingWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r)
+
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		uri := r.RequestURI
+		if redact {
+			uri = redactInfoHashes(uri)
+		}
+		e := accesslog.Entry{
+			Remote:    host,
+			Time:      start,
+			Request:   r.Method + " " + uri + " " + r.Proto,
+			Status:    rec.status,
+			Bytes:     rec.bytes,
+			Referer:   r.Referer(),
+			UserAgent: r.UserAgent(),
+			Duration:  time.Since(start),
+		}
+		if l == nil {
+			logger.Info("handled request", e)
+			return
+		}
+		if err := l.Log(e); err != nil {
+			logger.Error("failed to write access log", log.Err(err))
+		}
+	})
+}
+
+// redactedInfoHash replaces the values of info_hash parameters in redacted
+// request URIs.
+const redactedInfoHash = "redacted"
+
+// redactInfoHashes replaces the values of all info_hash parameters in the
+// query of a request URI.
+func redactInfoHashes(uri string) string {
+	i := strings.IndexByte(uri, '?')
+	if i < 0 {
+		return uri
+	}
+
+	params := strings.Split(uri[i+1:], "&")
+	for j, param := range params {
+		key := param
+		if k := strings.IndexByte(param, '='); k >= 0 {
+			key = param[:k]
+		}
+		// The key may be escaped, which clients don't do but the parser
+		// accepts.
+		if unescaped, err := url.QueryUnescape(key); err == nil && unescaped == "info_hash" {
+			params[j] = key + "=" + redactedInfoHash
+		}
+	}
+	return uri[:i+1] + strings.Join(params, "&")
+}
+
+// recordingWriter is an http.ResponseWriter that records the status and the
+// size of the response.
+type recordingWriter struct {
+	http.ResponseWriter
+	status      int
+	bytes       int
+	wroteHeader bool
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
@@ -0,0 +1,60 @@
+package http
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/pkg/accesslog"
+)
+
+func TestAccessLogHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accesslog")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "access.log")
+	l, err := accesslog.Open(path, accesslog.FormatCombined)
+	require.Nil(t, err)
+
+	h := accessLogHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("not found"))
+	}), l, false)
+
+	r := httptest.NewRequest("GET", "/announce?info_hash=x", nil)
+	r.RemoteAddr = "10.0.0.1:6881"
+	r.Header.Set("User-Agent", "client/1.0")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	require.Nil(t, l.Close())
+
+	contents, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	require.Regexp(t, regexp.MustCompile(`^10\.0\.0\.1 - - \[[^]]+\] "GET /announce\?info_hash=x HTTP/1\.1" 404 9 "-" "client/1\.0" \d+\n$`), string(contents))
+}
+
+func TestRedactInfoHashes(t *testing.T) {
+	var table = []struct {
+		uri      string
+		expected string
+	}{
+		{"/announce", "/announce"},
+		{"/announce?port=6881", "/announce?port=6881"},
+		{"/announce?info_hash=%AA%BB&port=6881", "/announce?info_hash=redacted&port=6881"},
+		{"/scrape?info_hash=a&info_hash=b", "/scrape?info_hash=redacted&info_hash=redacted"},
+		{"/scrape?info%5Fhash=a", "/scrape?info%5Fhash=redacted"},
+		{"/scrape?info_hash", "/scrape?info_hash=redacted"},
+		{"/scrape?info_hashes=a", "/scrape?info_hashes=a"},
+	}
+	for _, tt := range table {
+		t.Run(tt.uri, func(t *testing.T) {
+			require.Equal(t, tt.expected, redactInfoHashes(tt.uri))
+		})
+	}
+}
@@ -1,41 +1,80 @@
-// Package bencode implements bencoding of data as defined in BEP 3 using
-// type assertion over reflection for performance.
+// Package bencode forwards to pkg/bencode, so that code importing the bencode
+// package from its location before it was moved keeps building.
+//
+// Deprecated: Use pkg/bencode instead. This package is removed in the next
+// major version.
 package bencode
 
-import "bytes"
+import (
+	"io"
 
-// Enforce that Dict implements the Marshaler interface.
-var _ Marshaler = Dict{}
+	"github.com/chihaya/chihaya/pkg/bencode"
+)
 
 // Dict represents a bencode dictionary.
-type Dict map[string]interface{}
+//
+// Deprecated: Use bencode.Dict of pkg/bencode instead.
+type Dict = bencode.Dict
+
+// List represents a bencode list.
+//
+// Deprecated: Use bencode.List of pkg/bencode instead.
+type List = bencode.List
+
+// A Decoder reads bencoded objects from an input stream.
+//
+// Deprecated: Use bencode.Decoder of pkg/bencode instead.
+type Decoder = bencode.Decoder
+
+// An Encoder writes bencoded objects to an output stream.
+//
+// Deprecated: Use bencode.Encoder of pkg/bencode instead.
+type Encoder = bencode.Encoder
+
+// Marshaler is the interface implemented by objects that can marshal
+// themselves.
+//
+// Deprecated: Use bencode.Marshaler of pkg/bencode instead.
+type Marshaler = bencode.Marshaler
 
 // NewDict allocates the memory for a Dict.
+//
+// Deprecated: Use bencode.NewDict of pkg/bencode instead.
 func NewDict() Dict {
-	return make(Dict)
+	return bencode.NewDict()
 }
 
-// MarshalBencode implements the Marshaler interface for Dict.
-func (d Dict) MarshalBencode() ([]byte, error) {
-	var buf bytes.Buffer
-	err := marshalMap(&buf, map[string]interface{}(d))
-	return buf.Bytes(), err
+// NewList allocates the memory for a List.
+//
+// Deprecated: Use bencode.NewList of pkg/bencode instead.
+func NewList() List {
+	return bencode.NewList()
 }
 
-// Enforce that List implements the Marshaler interface.
-var _ Marshaler = List{}
+// NewDecoder returns a new decoder that reads from r.
+//
+// Deprecated: Use bencode.NewDecoder of pkg/bencode instead.
+func NewDecoder(r io.Reader) *Decoder {
+	return bencode.NewDecoder(r)
+}
 
-// List represents a bencode list.
-type List []interface{}
+// Unmarshal deserializes and returns the bencoded value in buf.
+//
+// Deprecated: Use bencode.Unmarshal of pkg/bencode instead.
+func Unmarshal(buf []byte) (interface{}, error) {
+	return bencode.Unmarshal(buf)
+}
 
-// MarshalBencode implements the Marshaler interface for List.
-func (l List) MarshalBencode() ([]byte, error) {
-	var buf bytes.Buffer
-	err := marshalList(&buf, []interface{}(l))
-	return buf.Bytes(), err
+// NewEncoder returns a new encoder that writes to w.
+//
+// Deprecated: Use bencode.NewEncoder of pkg/bencode instead.
+func NewEncoder(w io.Writer) *Encoder {
+	return bencode.NewEncoder(w)
 }
 
-// NewList allocates the memory for a List.
-func NewList() List {
-	return make(List, 0)
+// Marshal returns the bencoding of v.
+//
+// Deprecated: Use bencode.Marshal of pkg/bencode instead.
+func Marshal(v interface{}) ([]byte, error) {
+	return bencode.Marshal(v)
 }
@@ -0,0 +1,70 @@
+package http
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// Challenge tokens are handed to clients as the "tracker id" of announce
+// responses, which clients echo as the trackerid parameter of subsequent
+// announces according to BEP 3.
+//
+// A token consists of the time it was issued in seconds since the epoch as a
+// big-endian uint32, followed by the first challengeMACSize bytes of the
+// HMAC-SHA256 of the time and the IP address of the client.
+const (
+	challengeMACSize = 12
+	challengeSize    = 4 + challengeMACSize
+
+	// challengeParam is the parameter clients echo tokens in.
+	challengeParam = "trackerid"
+
+	// minChallengeKeyLength is the minimum length of the key, in bytes.
+	minChallengeKeyLength = 16
+)
+
+// challenger issues and verifies tokens that are bound to the IP address
+// responses are delivered to, which clients can't choose.
+type challenger struct {
+	key []byte
+	ttl time.Duration
+}
+
+func (c challenger) mac(issued uint32, ip net.IP) []byte {
+	var b [4 + net.IPv6len]byte
+	binary.BigEndian.PutUint32(b[:4], issued)
+	copy(b[4:], ip.To16())
+
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write(b[:])
+	return mac.Sum(nil)[:challengeMACSize]
+}
+
+// issue returns a new token for ip.
+func (c challenger) issue(ip net.IP, now time.Time) string {
+	var b [challengeSize]byte
+	issued := uint32(now.Unix())
+	binary.BigEndian.PutUint32(b[:4], issued)
+	copy(b[4:], c.mac(issued, ip))
+	return base64.RawURLEncoding.EncodeToString(b[:])
+}
+
+// verify returns whether token was issued for ip no longer than the TTL ago.
+func (c challenger) verify(token string, ip net.IP, now time.Time) bool {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(b) != challengeSize {
+		return false
+	}
+
+	issued := binary.BigEndian.Uint32(b[:4])
+	age := now.Sub(time.Unix(int64(issued), 0))
+	if age < -time.Minute || age > c.ttl {
+		return false
+	}
+
+	return hmac.Equal(b[4:], c.mac(issued, ip))
+}
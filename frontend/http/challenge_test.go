@@ -0,0 +1,28 @@
+package http
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChallenger(t *testing.T) {
+	c := challenger{key: []byte("0123456789abcdef"), ttl: time.Hour}
+	other := challenger{key: []byte("fedcba9876543210"), ttl: time.Hour}
+	ip := net.ParseIP("10.0.0.1")
+	now := time.Unix(1500000000, 0)
+
+	token := c.issue(ip, now)
+	require.True(t, c.verify(token, ip, now))
+	require.True(t, c.verify(token, ip.To4(), now.Add(time.Hour)))
+
+	require.False(t, c.verify(token, net.ParseIP("10.0.0.2"), now))
+	require.False(t, c.verify(token, ip, now.Add(time.Hour+time.Second)))
+	require.False(t, c.verify(token, ip, now.Add(-2*time.Minute)))
+	require.False(t, other.verify(token, ip, now))
+	require.False(t, c.verify("", ip, now))
+	require.False(t, c.verify("not a token", ip, now))
+	require.False(t, c.verify(token[:len(token)-1], ip, now))
+}
@@ -0,0 +1,103 @@
+package http
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connStatsKey is the key of the *connStats of the connection of a request in
+// its context.
+type connStatsKey struct{}
+
+// connStats are the statistics of a connection.
+type connStats struct {
+	opened   time.Time
+	requests uint64
+}
+
+// connTracker records the reuse of the connections of a server and enforces
+// the keepalive limits of a Config.
+type connTracker struct {
+	scheme      string
+	maxRequests uint64
+	maxAge      time.Duration
+
+	// conns maps the open connections to their *connStats.
+	conns sync.Map
+}
+
+// newConnTracker returns a connTracker for a server of the given scheme.
+//
+// The keepalive limits are ignored if keepalive is disabled, since
+// connections are closed after every request then anyway.
+func newConnTracker(scheme string, cfg Config) *connTracker {
+	t := &connTracker{scheme: scheme}
+	if cfg.EnableKeepAlive {
+		t.maxRequests = uint64(cfg.MaxRequestsPerConn)
+		t.maxAge = cfg.MaxConnectionAge
+	}
+	return t
+}
+
+// install makes srv report its connections to t. It must be called after the
+// Handler of srv is set.
+func (t *connTracker) install(srv *http.Server) {
+	srv.ConnContext = t.connContext
+	srv.ConnState = t.connState
+	srv.Handler = t.handler(srv.Handler)
+}
+
+func (t *connTracker) connContext(ctx context.Context, c net.Conn) context.Context {
+	stats := &connStats{opened: time.Now()}
+	t.conns.Store(c, stats)
+	return context.WithValue(ctx, connStatsKey{}, stats)
+}
+
+func (t *connTracker) connState(c net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		recordConnectionOpened(t.scheme)
+	case http.StateClosed, http.StateHijacked:
+		v, ok := t.conns.Load(c)
+		if !ok {
+			return
+		}
+		t.conns.Delete(c)
+		recordConnectionClosed(t.scheme, atomic.LoadUint64(&v.(*connStats).requests))
+	}
+}
+
+// handler counts the requests of every connection and asks clients to close
+// connections that exceeded a keepalive limit.
+func (t *connTracker) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats, ok := r.Context().Value(connStatsKey{}).(*connStats)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		n := atomic.AddUint64(&stats.requests, 1)
+		recordConnectionRequest(t.scheme, n > 1)
+		if n == 1 && r.TLS != nil {
+			recordTLSHandshake(r.TLS.DidResume)
+		}
+
+		// The server closes the connection after writing a response with
+		// this header.
+		switch {
+		case t.maxRequests > 0 && n >= t.maxRequests:
+			w.Header().Set("Connection", "close")
+			recordKeepAliveLimit("requests")
+		case t.maxAge > 0 && time.Since(stats.opened) >= t.maxAge:
+			w.Header().Set("Connection", "close")
+			recordKeepAliveLimit("age")
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,52 @@
+package http
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnTrackerMaxRequests(t *testing.T) {
+	tracker := newConnTracker("http", Config{EnableKeepAlive: true, MaxRequestsPerConn: 2})
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tracker.install(ts.Config)
+	ts.Start()
+	defer ts.Close()
+
+	get := func() *http.Response {
+		resp, err := ts.Client().Get(ts.URL)
+		require.Nil(t, err)
+		_, err = ioutil.ReadAll(resp.Body)
+		require.Nil(t, err)
+		require.Nil(t, resp.Body.Close())
+		return resp
+	}
+
+	// The connection is reused once and closed after the second request.
+	require.False(t, get().Close)
+	require.True(t, get().Close)
+	require.False(t, get().Close)
+
+	// The first connection is forgotten once the server closed it.
+	requests := func() (counts []uint64) {
+		tracker.conns.Range(func(_, v interface{}) bool {
+			counts = append(counts, atomic.LoadUint64(&v.(*connStats).requests))
+			return true
+		})
+		return counts
+	}
+	for i := 0; i < 100 && len(requests()) > 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, []uint64{1}, requests())
+}
+
+func TestConnTrackerKeepAliveDisabled(t *testing.T) {
+	tracker := newConnTracker("http", Config{MaxRequestsPerConn: 2})
+	require.Equal(t, uint64(0), tracker.maxRequests)
+}
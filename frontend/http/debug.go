@@ -0,0 +1,51 @@
+package http
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+const (
+	// DebugTokenHeader is the request header used to present the configured
+	// debug token.
+	DebugTokenHeader = "X-Chihaya-Debug-Token"
+
+	// DebugHeader is the response header that describes a policy decision
+	// made while handling a request presenting the debug token.
+	// It is added once for every decision, formatted as "name=value".
+	DebugHeader = "X-Chihaya-Debug"
+)
+
+// debugContext returns a context that collects the policy decisions made
+// for the request if it presents the configured debug token.
+//
+// If the request doesn't present the token, the returned Decisions are nil.
+func (f *Frontend) debugContext(ctx context.Context, r *http.Request) (context.Context, *bittorrent.Decisions) {
+	if f.DebugToken == "" {
+		return ctx, nil
+	}
+
+	token := r.Header.Get(DebugTokenHeader)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(f.DebugToken)) != 1 {
+		return ctx, nil
+	}
+
+	d := &bittorrent.Decisions{}
+	return context.WithValue(ctx, bittorrent.DecisionsKey, d), d
+}
+
+// writeDecisions adds the collected decisions to the headers of the response.
+//
+// It must be called before the response is written.
+func writeDecisions(w http.ResponseWriter, d *bittorrent.Decisions) {
+	if d == nil {
+		return
+	}
+
+	for _, decision := range d.List() {
+		w.Header().Add(DebugHeader, decision.Name+"="+decision.Value)
+	}
+}
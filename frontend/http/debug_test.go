@@ -0,0 +1,62 @@
+package http
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/frontend"
+)
+
+// decidingLogic records a decision for every announce.
+type decidingLogic struct {
+	frontend.TrackerLogic
+}
+
+func (decidingLogic) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest) (context.Context, *bittorrent.AnnounceResponse, error) {
+	bittorrent.RecordDecision(ctx, "interval", "config")
+	return ctx, &bittorrent.AnnounceResponse{}, nil
+}
+
+func (decidingLogic) AfterAnnounce(context.Context, *bittorrent.AnnounceRequest, *bittorrent.AnnounceResponse) {
+}
+
+func TestDebugHeaders(t *testing.T) {
+	const query = "/announce?info_hash=aaaaaaaaaaaaaaaaaaaa&peer_id=bbbbbbbbbbbbbbbbbbbb&port=1&left=0&downloaded=0&uploaded=0"
+
+	var table = []struct {
+		configured, presented string
+		expected              []string
+	}{
+		{"", "", nil},
+		{"", "secret", nil},
+		{"secret", "", nil},
+		{"secret", "wrong", nil},
+		{"secret", "secret", []string{"interval=config"}},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.configured+"/"+tt.presented, func(t *testing.T) {
+			f := &Frontend{
+				logic: decidingLogic{},
+				Config: Config{
+					DebugToken:   tt.configured,
+					ParseOptions: ParseOptions{MaxNumWant: 50, DefaultNumWant: 50},
+				},
+			}
+
+			r := httptest.NewRequest("GET", query, nil)
+			if tt.presented != "" {
+				r.Header.Set(DebugTokenHeader, tt.presented)
+			}
+			w := httptest.NewRecorder()
+			f.announceRoute(w, r, nil)
+
+			require.Equal(t, 200, w.Code)
+			require.Equal(t, tt.expected, w.Header()[DebugHeader])
+		})
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"net"
 	"net/http"
 	"time"
@@ -14,10 +15,17 @@ import (
 
 	"github.com/chihaya/chihaya/bittorrent"
 	"github.com/chihaya/chihaya/frontend"
+	"github.com/chihaya/chihaya/internal/handoff"
+	"github.com/chihaya/chihaya/internal/systemd"
+	"github.com/chihaya/chihaya/pkg/accesslog"
 	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/netutil"
 	"github.com/chihaya/chihaya/pkg/stop"
 )
 
+// logger is used for all messages logged while serving requests.
+var logger = log.Component("http")
+
 // Config represents all of the configurable options for an HTTP BitTorrent
 // Frontend.
 type Config struct {
@@ -27,11 +35,30 @@ type Config struct {
 	WriteTimeout        time.Duration `yaml:"write_timeout"`
 	IdleTimeout         time.Duration `yaml:"idle_timeout"`
 	EnableKeepAlive     bool          `yaml:"enable_keepalive"`
+	MaxRequestsPerConn  int           `yaml:"max_requests_per_connection"`
+	MaxConnectionAge    time.Duration `yaml:"max_connection_age"`
 	TLSCertPath         string        `yaml:"tls_cert_path"`
 	TLSKeyPath          string        `yaml:"tls_key_path"`
 	AnnounceRoutes      []string      `yaml:"announce_routes"`
 	ScrapeRoutes        []string      `yaml:"scrape_routes"`
 	EnableRequestTiming bool          `yaml:"enable_request_timing"`
+	EnableAccessLog     bool          `yaml:"enable_access_log"`
+	AccessLogPath       string        `yaml:"access_log_path"`
+	AccessLogFormat     string        `yaml:"access_log_format"`
+
+	// RedactInfoHashes removes the infohashes from the request URIs in the
+	// access log. It is set when infohash privacy is enabled.
+	RedactInfoHashes bool `yaml:"-"`
+
+	DrainTimeout        time.Duration `yaml:"drain_timeout"`
+	DebugToken          string        `yaml:"debug_token"`
+	MaxResponsePeers    int           `yaml:"max_response_peers"`
+	ChallengeKey        string        `yaml:"challenge_key"`
+	ChallengeTTL        time.Duration `yaml:"challenge_ttl"`
+	ChallengeInterval   time.Duration `yaml:"challenge_interval"`
+	FullScrapeInterval  time.Duration `yaml:"full_scrape_interval"`
+	FullScrapeRateLimit float64       `yaml:"full_scrape_rate_limit"`
+	ScrapeActivity      bool          `yaml:"scrape_activity"`
 	ParseOptions        `yaml:",inline"`
 }
 
@@ -44,16 +71,35 @@ func (cfg Config) LogFields() log.Fields {
 		"writeTimeout":        cfg.WriteTimeout,
 		"idleTimeout":         cfg.IdleTimeout,
 		"enableKeepAlive":     cfg.EnableKeepAlive,
+		"maxRequestsPerConn":  cfg.MaxRequestsPerConn,
+		"maxConnectionAge":    cfg.MaxConnectionAge,
 		"tlsCertPath":         cfg.TLSCertPath,
 		"tlsKeyPath":          cfg.TLSKeyPath,
 		"announceRoutes":      cfg.AnnounceRoutes,
 		"scrapeRoutes":        cfg.ScrapeRoutes,
 		"enableRequestTiming": cfg.EnableRequestTiming,
-		"allowIPSpoofing":     cfg.AllowIPSpoofing,
+		"enableAccessLog":     cfg.EnableAccessLog,
+		"accessLogPath":       cfg.AccessLogPath,
+		"accessLogFormat":     cfg.AccessLogFormat,
+		"redactInfoHashes":    cfg.RedactInfoHashes,
+		"drainTimeout":        cfg.DrainTimeout,
+		"debugHeaders":        cfg.DebugToken != "",
+		"maxResponsePeers":    cfg.MaxResponsePeers,
+		"challenge":           cfg.ChallengeKey != "",
+		"challengeTTL":        cfg.ChallengeTTL,
+		"challengeInterval":   cfg.ChallengeInterval,
+		"fullScrapeInterval":  cfg.FullScrapeInterval,
+		"fullScrapeRateLimit": cfg.FullScrapeRateLimit,
+		"scrapeActivity":      cfg.ScrapeActivity,
+		"ipSpoofing":          cfg.IPSpoofing.LogFields(),
 		"realIPHeader":        cfg.RealIPHeader,
+		"allowClientSubnet":   cfg.AllowClientSubnet,
+		"allowMultiHomed":     cfg.AllowMultiHomed,
 		"maxNumWant":          cfg.MaxNumWant,
 		"defaultNumWant":      cfg.DefaultNumWant,
 		"maxScrapeInfoHashes": cfg.MaxScrapeInfoHashes,
+		"maxExcludedPeers":    cfg.MaxExcludedPeers,
+		"defaultCompact":      cfg.DefaultCompact,
 	}
 }
 
@@ -62,6 +108,10 @@ const (
 	defaultReadTimeout  = 2 * time.Second
 	defaultWriteTimeout = 2 * time.Second
 	defaultIdleTimeout  = 30 * time.Second
+	defaultDrainTimeout = 5 * time.Second
+
+	defaultChallengeTTL      = 2 * time.Hour
+	defaultChallengeInterval = time.Minute
 )
 
 // Validate sanity checks values set in a config and returns a new config with
@@ -102,6 +152,15 @@ func (cfg Config) Validate() Config {
 		}
 	}
 
+	if cfg.DrainTimeout <= 0 {
+		validcfg.DrainTimeout = defaultDrainTimeout
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "http.DrainTimeout",
+			"provided": cfg.DrainTimeout,
+			"default":  validcfg.DrainTimeout,
+		})
+	}
+
 	if cfg.MaxNumWant <= 0 {
 		validcfg.MaxNumWant = defaultMaxNumWant
 		log.Warn("falling back to default configuration", log.Fields{
@@ -129,15 +188,160 @@ func (cfg Config) Validate() Config {
 		})
 	}
 
+	if cfg.ChallengeKey != "" {
+		if cfg.ChallengeTTL <= 0 {
+			validcfg.ChallengeTTL = defaultChallengeTTL
+			log.Warn("falling back to default configuration", log.Fields{
+				"name":     "http.ChallengeTTL",
+				"provided": cfg.ChallengeTTL,
+				"default":  validcfg.ChallengeTTL,
+			})
+		}
+
+		if cfg.ChallengeInterval <= 0 {
+			validcfg.ChallengeInterval = defaultChallengeInterval
+			log.Warn("falling back to default configuration", log.Fields{
+				"name":     "http.ChallengeInterval",
+				"provided": cfg.ChallengeInterval,
+				"default":  validcfg.ChallengeInterval,
+			})
+		}
+	}
+
+	// Clients gain nothing from scraping more often than snapshots are
+	// generated.
+	if cfg.FullScrapeInterval > 0 && cfg.FullScrapeRateLimit <= 0 {
+		validcfg.FullScrapeRateLimit = 1 / cfg.FullScrapeInterval.Seconds()
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "http.FullScrapeRateLimit",
+			"provided": cfg.FullScrapeRateLimit,
+			"default":  validcfg.FullScrapeRateLimit,
+		})
+	}
+
+	if cfg.AllowIPSpoofing && !cfg.IPSpoofing.Enabled() {
+		validcfg.IPSpoofing.AllowIPv4 = true
+		validcfg.IPSpoofing.AllowIPv6 = true
+		log.Warn("deprecated configuration, use http.ip_spoofing instead", log.Fields{
+			"name":     "http.AllowIPSpoofing",
+			"provided": cfg.AllowIPSpoofing,
+		})
+	}
+
+	// Anyone reaching the tracker directly can send the header.
+	if cfg.RealIPHeader != "" && len(cfg.IPSpoofing.TrustedProxyCIDRs) == 0 {
+		log.Warn("real IP header is trusted from any address, set http.ip_spoofing.trusted_proxy_cidrs", log.Fields{
+			"name":     "http.RealIPHeader",
+			"provided": cfg.RealIPHeader,
+		})
+	}
+
+	// The client subnet is only accepted from trusted proxies, which
+	// anyone would be without trusted networks.
+	if cfg.AllowClientSubnet && len(cfg.IPSpoofing.TrustedProxyCIDRs) == 0 {
+		validcfg.AllowClientSubnet = false
+		log.Warn("client subnets require trusted proxies, set http.ip_spoofing.trusted_proxy_cidrs", log.Fields{
+			"name":     "http.AllowClientSubnet",
+			"provided": cfg.AllowClientSubnet,
+			"default":  validcfg.AllowClientSubnet,
+		})
+	}
 	return validcfg
 }
 
+// Check returns all problems of a config that NewFrontend refuses or that
+// make no sense, such as negative timeouts.
+//
+// Unset values are not problems, since Validate replaces them with defaults.
+func (cfg Config) Check() (problems []error) {
+	negative := func(key string) {
+		problems = append(problems, fmt.Errorf("http.%s must not be negative", key))
+	}
+
+	if cfg.Addr == "" && cfg.HTTPSAddr == "" {
+		problems = append(problems, errors.New("http.addr or http.https_addr must be set"))
+	}
+	if len(cfg.AnnounceRoutes) < 1 || len(cfg.ScrapeRoutes) < 1 {
+		problems = append(problems, errors.New("http.announce_routes and http.scrape_routes must be set"))
+	}
+
+	keyPair := cfg.TLSCertPath != "" && cfg.TLSKeyPath != ""
+	switch {
+	case (cfg.TLSCertPath == "") != (cfg.TLSKeyPath == ""):
+		problems = append(problems, errors.New("http.tls_cert_path and http.tls_key_path must be set together"))
+	case cfg.HTTPSAddr != "" && !keyPair:
+		problems = append(problems, errors.New("http.tls_cert_path and http.tls_key_path must be set when using http.https_addr"))
+	case cfg.HTTPSAddr == "" && keyPair:
+		problems = append(problems, errors.New("http.https_addr must be set when using http.tls_cert_path and http.tls_key_path"))
+	}
+
+	if cfg.AccessLogPath != "" && !cfg.EnableAccessLog {
+		problems = append(problems, errors.New("http.enable_access_log must be set when using http.access_log_path"))
+	}
+
+	if cfg.ChallengeKey != "" && len(cfg.ChallengeKey) < minChallengeKeyLength {
+		problems = append(problems, fmt.Errorf("http.challenge_key must be at least %d bytes long", minChallengeKeyLength))
+	}
+
+	if cfg.ReadTimeout < 0 {
+		negative("read_timeout")
+	}
+	if cfg.WriteTimeout < 0 {
+		negative("write_timeout")
+	}
+	if cfg.IdleTimeout < 0 {
+		negative("idle_timeout")
+	}
+	if cfg.DrainTimeout < 0 {
+		negative("drain_timeout")
+	}
+	if cfg.MaxRequestsPerConn < 0 {
+		negative("max_requests_per_connection")
+	}
+	if cfg.MaxConnectionAge < 0 {
+		negative("max_connection_age")
+	}
+	if cfg.ChallengeTTL < 0 {
+		negative("challenge_ttl")
+	}
+	if cfg.ChallengeInterval < 0 {
+		negative("challenge_interval")
+	}
+	if cfg.MaxResponsePeers < 0 {
+		negative("max_response_peers")
+	}
+	if cfg.FullScrapeInterval < 0 {
+		negative("full_scrape_interval")
+	}
+	if cfg.FullScrapeRateLimit < 0 {
+		negative("full_scrape_rate_limit")
+	}
+
+	if cfg.MaxNumWant > 0 && cfg.DefaultNumWant > cfg.MaxNumWant {
+		problems = append(problems, errors.New("http.default_numwant must not exceed http.max_numwant"))
+	}
+	return
+}
+
 // Frontend represents the state of an HTTP BitTorrent Frontend.
 type Frontend struct {
 	srv    *http.Server
 	tlsSrv *http.Server
 	tlsCfg *tls.Config
 
+	// challenger issues and verifies challenge tokens. It is nil if
+	// announces are not challenged.
+	challenger *challenger
+
+	// accessLog is nil if access logs are disabled or written to the logger.
+	accessLog *accesslog.Log
+
+	// fullScrapes is nil if full scrapes are disabled.
+	fullScrapes *fullScrapes
+
+	// failed receives the first error serving fails with.
+	failed chan error
+
 	logic frontend.TrackerLogic
 	Config
 }
@@ -145,21 +349,17 @@ type Frontend struct {
 // NewFrontend creates a new instance of an HTTP Frontend that asynchronously
 // serves requests.
 func NewFrontend(logic frontend.TrackerLogic, provided Config) (*Frontend, error) {
+	if problems := provided.Check(); len(problems) != 0 {
+		return nil, problems[0]
+	}
 	cfg := provided.Validate()
 
 	f := &Frontend{
+		failed: make(chan error, 1),
 		logic:  logic,
 		Config: cfg,
 	}
 
-	if cfg.Addr == "" && cfg.HTTPSAddr == "" {
-		return nil, errors.New("must specify addr or https_addr or both")
-	}
-
-	if len(cfg.AnnounceRoutes) < 1 || len(cfg.ScrapeRoutes) < 1 {
-		return nil, errors.New("must specify routes")
-	}
-
 	// If TLS is enabled, create a key pair.
 	if cfg.TLSCertPath != "" && cfg.TLSKeyPath != "" {
 		var err error
@@ -172,35 +372,58 @@ func NewFrontend(logic frontend.TrackerLogic, provided Config) (*Frontend, error
 		}
 	}
 
-	if cfg.HTTPSAddr != "" && f.tlsCfg == nil {
-		return nil, errors.New("must specify tls_cert_path and tls_key_path when using https_addr")
+	if cfg.ChallengeKey != "" {
+		f.challenger = &challenger{key: []byte(cfg.ChallengeKey), ttl: cfg.ChallengeTTL}
 	}
-	if cfg.HTTPSAddr == "" && f.tlsCfg != nil {
-		return nil, errors.New("must specify https_addr when using tls_cert_path and tls_key_path")
+
+	var fullScraper frontend.FullScraper
+	if cfg.FullScrapeInterval > 0 {
+		var ok bool
+		if fullScraper, ok = logic.(frontend.FullScraper); !ok {
+			return nil, errors.New("the tracker logic does not support full scrapes")
+		}
 	}
 
 	var listenerHTTP, listenerHTTPS net.Listener
 	var err error
 	if cfg.Addr != "" {
-		listenerHTTP, err = net.Listen("tcp", f.Addr)
+		listenerHTTP, err = listen(f.Addr)
 		if err != nil {
 			return nil, err
 		}
 	}
 	if cfg.HTTPSAddr != "" {
-		listenerHTTPS, err = net.Listen("tcp", f.HTTPSAddr)
+		listenerHTTPS, err = listen(f.HTTPSAddr)
+		if err != nil {
+			if listenerHTTP != nil {
+				listenerHTTP.Close()
+			}
+			return nil, err
+		}
+	}
+
+	if cfg.EnableAccessLog && cfg.AccessLogPath != "" {
+		f.accessLog, err = accesslog.Open(cfg.AccessLogPath, cfg.AccessLogFormat)
 		if err != nil {
 			if listenerHTTP != nil {
 				listenerHTTP.Close()
 			}
+			if listenerHTTPS != nil {
+				listenerHTTPS.Close()
+			}
 			return nil, err
 		}
 	}
 
+	if fullScraper != nil {
+		f.fullScrapes = newFullScrapes(fullScraper, cfg.FullScrapeInterval, cfg.FullScrapeRateLimit)
+	}
+
 	if cfg.Addr != "" {
 		go func() {
 			if err := f.serveHTTP(listenerHTTP); err != nil {
-				log.Fatal("failed while serving http", log.Err(err))
+				logger.Error("failed while serving http", log.Err(err))
+				f.fail(err)
 			}
 		}()
 	}
@@ -208,7 +431,8 @@ func NewFrontend(logic frontend.TrackerLogic, provided Config) (*Frontend, error
 	if cfg.HTTPSAddr != "" {
 		go func() {
 			if err := f.serveHTTPS(listenerHTTPS); err != nil {
-				log.Fatal("failed while serving https", log.Err(err))
+				logger.Error("failed while serving https", log.Err(err))
+				f.fail(err)
 			}
 		}()
 	}
@@ -216,6 +440,55 @@ func NewFrontend(logic frontend.TrackerLogic, provided Config) (*Frontend, error
 	return f, nil
 }
 
+// listen returns a listener for a socket bound to addr. If systemd passed
+// such a socket, it is used instead of binding a new one, and if this process
+// was started to upgrade another one, the socket of that process is taken
+// over.
+//
+// Addresses of the form fd://0 or fd://name name a socket passed by systemd
+// explicitly.
+func listen(addr string) (net.Listener, error) {
+	return handoff.Listen("tcp", addr, func() (net.Listener, error) {
+		return bind(addr)
+	})
+}
+
+// bind returns a listener for a socket passed by systemd or a new socket
+// bound to addr.
+func bind(addr string) (net.Listener, error) {
+	if systemd.IsAddr(addr) {
+		return systemd.Listener(addr)
+	}
+
+	activated, err := systemd.Listeners("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if len(activated) > 0 {
+		for _, l := range activated[1:] {
+			l.Close()
+		}
+		return activated[0], nil
+	}
+
+	return net.Listen("tcp", addr)
+}
+
+// Failed implements server.Failer. The returned channel receives the first
+// error serving requests failed with.
+func (f *Frontend) Failed() <-chan error {
+	return f.failed
+}
+
+// fail reports that serving requests failed with err, unless serving failed
+// before.
+func (f *Frontend) fail(err error) {
+	select {
+	case f.failed <- err:
+	default:
+	}
+}
+
 // Stop provides a thread-safe way to shutdown a currently running Frontend.
 func (f *Frontend) Stop() stop.Result {
 	stopGroup := stop.NewGroup()
@@ -227,14 +500,43 @@ func (f *Frontend) Stop() stop.Result {
 		stopGroup.AddFunc(f.makeStopFunc(f.tlsSrv))
 	}
 
-	return stopGroup.Stop()
+	if f.accessLog == nil && f.fullScrapes == nil {
+		return stopGroup.Stop()
+	}
+
+	// The access log is closed and full scrapes are no longer generated
+	// once no more requests are handled.
+	c := make(stop.Channel)
+	go func() {
+		errs := stopGroup.Stop().Wait()
+		if f.fullScrapes != nil {
+			f.fullScrapes.stop()
+		}
+		if f.accessLog != nil {
+			if err := f.accessLog.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		c.Done(errs...)
+	}()
+	return c.Result()
 }
 
 func (f *Frontend) makeStopFunc(stopSrv *http.Server) stop.Func {
 	return func() stop.Result {
 		c := make(stop.Channel)
 		go func() {
-			c.Done(stopSrv.Shutdown(context.Background()))
+			ctx, cancel := context.WithTimeout(context.Background(), f.DrainTimeout)
+			defer cancel()
+
+			err := stopSrv.Shutdown(ctx)
+			if err == context.DeadlineExceeded {
+				// Abandon the requests still being handled.
+				logger.Warn("timed out draining in-flight requests", log.Fields{"drainTimeout": f.DrainTimeout})
+				stopSrv.Close()
+				err = frontend.ErrDrainTimeout
+			}
+			c.Done(err)
 		}()
 		return c.Result()
 	}
@@ -248,6 +550,10 @@ func (f *Frontend) handler() http.Handler {
 	for _, route := range f.ScrapeRoutes {
 		router.GET(route, f.scrapeRoute)
 	}
+
+	if f.EnableAccessLog {
+		return accessLogHandler(router, f.accessLog, f.RedactInfoHashes)
+	}
 	return router
 }
 
@@ -263,6 +569,7 @@ func (f *Frontend) serveHTTP(l net.Listener) error {
 	}
 
 	f.srv.SetKeepAlivesEnabled(f.EnableKeepAlive)
+	newConnTracker("http", f.Config).install(f.srv)
 
 	// Start the HTTP server.
 	if err := f.srv.Serve(l); err != http.ErrServerClosed {
@@ -280,9 +587,11 @@ func (f *Frontend) serveHTTPS(l net.Listener) error {
 		Handler:      f.handler(),
 		ReadTimeout:  f.ReadTimeout,
 		WriteTimeout: f.WriteTimeout,
+		IdleTimeout:  f.IdleTimeout,
 	}
 
 	f.tlsSrv.SetKeepAlivesEnabled(f.EnableKeepAlive)
+	newConnTracker("https", f.Config).install(f.tlsSrv)
 
 	// Start the HTTP server.
 	if err := f.tlsSrv.ServeTLS(l, "", ""); err != http.ErrServerClosed {
@@ -322,22 +631,67 @@ func (f *Frontend) announceRoute(w http.ResponseWriter, r *http.Request, ps http
 	}
 	af = new(bittorrent.AddressFamily)
 	*af = req.IP.AddressFamily
+	if req.MultiHomed() {
+		recordMultiHomedAnnounce(*af)
+	}
+
+	ctx := injectRouteParamsToContext(r.Context(), ps)
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if f.AllowClientSubnet && f.IPSpoofing.Trusts(netutil.ParseIP(host)) {
+		var subnet *net.IPNet
+		subnet, err = ParseClientSubnet(req.Params)
+		if err != nil {
+			WriteError(w, err)
+			return
+		}
+		if subnet != nil {
+			ctx = context.WithValue(ctx, bittorrent.ClientSubnetKey, subnet)
+		}
+	}
+
+	// Announces without a valid challenge token are answered, but don't
+	// change any swarms, and are asked to announce again soon with the
+	// token they are issued. Tokens are bound to the address responses are
+	// delivered to, so announces asserting any other address are never
+	// verified.
+	var challenged bool
+	var source net.IP
+	if f.challenger != nil {
+		source = transportIP(r, f.ParseOptions)
+		token, _ := req.Params.String(challengeParam)
+		if !req.IP.IP.Equal(source) || !f.challenger.verify(token, source, time.Now()) {
+			challenged = true
+			recordChallengedAnnounce()
+			ctx = context.WithValue(ctx, bittorrent.UnverifiedKey, true)
+		}
+	}
 
-	ctx := injectRouteParamsToContext(context.Background(), ps)
+	ctx, decisions := f.debugContext(ctx, r)
 	ctx, resp, err := f.logic.HandleAnnounce(ctx, req)
+	writeDecisions(w, decisions)
 	if err != nil {
 		WriteError(w, err)
 		return
 	}
 
+	if f.challenger != nil {
+		resp.TrackerID = f.challenger.issue(source, time.Now())
+		if challenged && resp.Interval > f.ChallengeInterval {
+			resp.Interval = f.ChallengeInterval
+			if resp.MinInterval > f.ChallengeInterval {
+				resp.MinInterval = f.ChallengeInterval
+			}
+		}
+	}
+
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	err = WriteAnnounceResponse(w, resp)
+	err = WriteAnnounceResponse(w, truncatePeers(resp, f.MaxResponsePeers))
 	if err != nil {
 		WriteError(w, err)
 		return
 	}
 
-	go f.logic.AfterAnnounce(ctx, req, resp)
+	go f.logic.AfterAnnounce(frontend.Detach(ctx), req, resp)
 }
 
 // scrapeRoute parses and responds to a Scrape.
@@ -357,6 +711,18 @@ func (f *Frontend) scrapeRoute(w http.ResponseWriter, r *http.Request, ps httpro
 	}()
 
 	req, err := ParseScrape(r, f.ParseOptions)
+	if err == ErrNoInfoHash && f.fullScrapes != nil {
+		var ip bittorrent.IP
+		if ip, err = remoteIP(r); err == nil {
+			af = new(bittorrent.AddressFamily)
+			*af = ip.AddressFamily
+			err = f.fullScrapes.serve(w, ip, time.Now())
+		}
+		if err != nil {
+			WriteError(w, err)
+		}
+		return
+	}
 	if err != nil {
 		WriteError(w, err)
 		return
@@ -364,26 +730,28 @@ func (f *Frontend) scrapeRoute(w http.ResponseWriter, r *http.Request, ps httpro
 
 	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		log.Error("http: unable to determine remote address for scrape", log.Err(err))
+		logger.Error("unable to determine remote address for scrape", log.Err(err))
 		WriteError(w, err)
 		return
 	}
 
-	reqIP := net.ParseIP(host)
-	if reqIP.To4() != nil {
-		req.AddressFamily = bittorrent.IPv4
-	} else if len(reqIP) == net.IPv6len { // implies reqIP.To4() == nil
-		req.AddressFamily = bittorrent.IPv6
-	} else {
-		log.Error("http: invalid IP: neither v4 nor v6", log.Fields{"RemoteAddr": r.RemoteAddr})
-		WriteError(w, bittorrent.ErrInvalidIP)
+	reqIP, err := bittorrent.NewIP(net.ParseIP(host))
+	if err != nil {
+		logger.Error("invalid IP: neither v4 nor v6", log.Fields{"RemoteAddr": r.RemoteAddr})
+		WriteError(w, err)
 		return
 	}
+	req.AddressFamily = reqIP.AddressFamily
 	af = new(bittorrent.AddressFamily)
 	*af = req.AddressFamily
 
-	ctx := injectRouteParamsToContext(context.Background(), ps)
+	ctx := injectRouteParamsToContext(r.Context(), ps)
+	if f.ScrapeActivity {
+		ctx = context.WithValue(ctx, bittorrent.ScrapeActivityKey, true)
+	}
+	ctx, decisions := f.debugContext(ctx, r)
 	ctx, resp, err := f.logic.HandleScrape(ctx, req)
+	writeDecisions(w, decisions)
 	if err != nil {
 		WriteError(w, err)
 		return
@@ -396,5 +764,5 @@ func (f *Frontend) scrapeRoute(w http.ResponseWriter, r *http.Request, ps httpro
 		return
 	}
 
-	go f.logic.AfterScrape(ctx, req, resp)
+	go f.logic.AfterScrape(frontend.Detach(ctx), req, resp)
 }
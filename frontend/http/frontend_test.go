@@ -0,0 +1,174 @@
+package http
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/frontend"
+)
+
+func TestCheck(t *testing.T) {
+	valid := Config{
+		Addr:           "127.0.0.1:0",
+		AnnounceRoutes: []string{"/announce"},
+		ScrapeRoutes:   []string{"/scrape"},
+	}
+	require.Empty(t, valid.Check())
+
+	var table = []struct {
+		name   string
+		modify func(cfg *Config)
+	}{
+		{"no addr", func(cfg *Config) { cfg.Addr = "" }},
+		{"no routes", func(cfg *Config) { cfg.ScrapeRoutes = nil }},
+		{"cert without key", func(cfg *Config) { cfg.TLSCertPath = "cert.pem" }},
+		{"https without key pair", func(cfg *Config) { cfg.HTTPSAddr = "127.0.0.1:0" }},
+		{"key pair without https", func(cfg *Config) { cfg.TLSCertPath, cfg.TLSKeyPath = "cert.pem", "key.pem" }},
+		{"access log path without access log", func(cfg *Config) { cfg.AccessLogPath = "access.log" }},
+		{"short challenge key", func(cfg *Config) { cfg.ChallengeKey = "short" }},
+		{"negative timeout", func(cfg *Config) { cfg.ReadTimeout = -time.Second }},
+		{"default numwant above max", func(cfg *Config) { cfg.MaxNumWant, cfg.DefaultNumWant = 10, 20 }},
+	}
+	for _, tt := range table {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid
+			tt.modify(&cfg)
+			require.Len(t, cfg.Check(), 1)
+		})
+	}
+}
+
+// subnetLogic records the client subnet of the last announce.
+type subnetLogic struct {
+	frontend.TrackerLogic
+	subnet *net.IPNet
+}
+
+func (l *subnetLogic) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest) (context.Context, *bittorrent.AnnounceResponse, error) {
+	l.subnet, _ = ctx.Value(bittorrent.ClientSubnetKey).(*net.IPNet)
+	return ctx, &bittorrent.AnnounceResponse{}, nil
+}
+
+func (l *subnetLogic) AfterAnnounce(context.Context, *bittorrent.AnnounceRequest, *bittorrent.AnnounceResponse) {
+}
+
+func TestClientSubnetFromTrustedProxies(t *testing.T) {
+	const query = "/announce?info_hash=aaaaaaaaaaaaaaaaaaaa&peer_id=bbbbbbbbbbbbbbbbbbbb&port=1&left=0&downloaded=0&uploaded=0&cs=203.0.113.0/24"
+	proxies := frontend.CIDRs{{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)}}
+
+	var table = []struct {
+		remote   string
+		expected string
+	}{
+		{"10.0.0.1:1234", "203.0.113.0/24"},
+		{"192.0.2.1:1234", ""},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.remote, func(t *testing.T) {
+			logic := &subnetLogic{}
+			f := &Frontend{
+				logic: logic,
+				Config: Config{
+					ParseOptions: ParseOptions{
+						AllowClientSubnet: true,
+						IPSpoofing:        frontend.IPSpoofingPolicy{TrustedProxyCIDRs: proxies},
+						MaxNumWant:        50,
+						DefaultNumWant:    50,
+					},
+				},
+			}
+
+			r := httptest.NewRequest("GET", query, nil)
+			r.RemoteAddr = tt.remote
+			w := httptest.NewRecorder()
+			f.announceRoute(w, r, nil)
+
+			require.Equal(t, 200, w.Code)
+			if tt.expected == "" {
+				require.Nil(t, logic.subnet)
+			} else {
+				require.Equal(t, tt.expected, logic.subnet.String())
+			}
+		})
+	}
+}
+
+// challengeLogic records whether the last announce was verified and the
+// response to it.
+type challengeLogic struct {
+	frontend.TrackerLogic
+	unverified bool
+	resp       *bittorrent.AnnounceResponse
+}
+
+func (l *challengeLogic) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest) (context.Context, *bittorrent.AnnounceResponse, error) {
+	l.unverified = ctx.Value(bittorrent.UnverifiedKey) != nil
+	l.resp = &bittorrent.AnnounceResponse{Interval: time.Hour}
+	return ctx, l.resp, nil
+}
+
+func (l *challengeLogic) AfterAnnounce(context.Context, *bittorrent.AnnounceRequest, *bittorrent.AnnounceResponse) {
+}
+
+func TestAnnounceChallenge(t *testing.T) {
+	const query = "/announce?info_hash=aaaaaaaaaaaaaaaaaaaa&peer_id=bbbbbbbbbbbbbbbbbbbb&port=1&left=0&downloaded=0&uploaded=0"
+	const attacker, victim = "192.0.2.1", "203.0.113.7"
+
+	logic := &challengeLogic{}
+	f := &Frontend{
+		logic:      logic,
+		challenger: &challenger{key: []byte("0123456789abcdef"), ttl: time.Hour},
+		Config: Config{
+			ChallengeInterval: time.Minute,
+			ParseOptions: ParseOptions{
+				IPSpoofing:     frontend.IPSpoofingPolicy{AllowIPv4: true},
+				MaxNumWant:     50,
+				DefaultNumWant: 50,
+			},
+		},
+	}
+
+	// announce sends an announce from source with the additional parameters
+	// and returns whether it was verified and the token it was issued.
+	announce := func(source, params string) (bool, string) {
+		r := httptest.NewRequest("GET", query+params, nil)
+		r.RemoteAddr = source + ":1234"
+		w := httptest.NewRecorder()
+		f.announceRoute(w, r, nil)
+		require.Equal(t, 200, w.Code)
+		return !logic.unverified, logic.resp.TrackerID
+	}
+
+	verified, token := announce(attacker, "")
+	require.False(t, verified)
+	require.Equal(t, time.Minute, logic.resp.Interval)
+	verified, _ = announce(attacker, "&trackerid="+token)
+	require.True(t, verified)
+
+	// A token issued to an announce spoofing the victim's address doesn't
+	// verify announces spoofing the victim, nor those of the victim.
+	verified, token = announce(attacker, "&ip="+victim)
+	require.False(t, verified)
+	verified, _ = announce(attacker, "&ip="+victim+"&trackerid="+token)
+	require.False(t, verified)
+	verified, _ = announce(victim, "&trackerid="+token)
+	require.False(t, verified)
+
+	// Neither does a valid token of the attacker.
+	verified, token = announce(attacker, "")
+	require.False(t, verified)
+	verified, _ = announce(attacker, "&ip="+victim+"&trackerid="+token)
+	require.False(t, verified)
+}
+
+func TestValidateClientSubnetWithoutProxies(t *testing.T) {
+	cfg := Config{ParseOptions: ParseOptions{AllowClientSubnet: true}}
+	require.False(t, cfg.Validate().AllowClientSubnet)
+}
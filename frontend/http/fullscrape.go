@@ -0,0 +1,133 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/frontend"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/ratelimit"
+)
+
+// ErrFullScrapeRateLimited is returned for full scrapes of clients that
+// exceeded the rate limit.
+var ErrFullScrapeRateLimited = bittorrent.ClientError("full scrape rate limit exceeded")
+
+// ErrFullScrapeUnavailable is returned for full scrapes before the first
+// snapshot of all swarms has been generated.
+var ErrFullScrapeUnavailable = bittorrent.ClientError("full scrape not available yet")
+
+// fullScrapeCacheSize is the number of IP addresses whose rate of full
+// scrapes is limited at once.
+const fullScrapeCacheSize = 65536
+
+// fullScrapes serves full scrapes, which are scrapes without infohashes that
+// report all swarms.
+//
+// Scraping all swarms is expensive, so the response is generated on an
+// interval and served from an encoded snapshot, one for each address family.
+type fullScrapes struct {
+	scraper  frontend.FullScraper
+	interval time.Duration
+	limiter  *ratelimit.Limiter
+
+	// snapshots hold the encoded responses for IPv4 and IPv6 clients as
+	// []byte, once they have been generated.
+	snapshots [2]atomic.Value
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// newFullScrapes starts generating snapshots using scraper every interval.
+// Every IP address may receive rate full scrapes per second.
+func newFullScrapes(scraper frontend.FullScraper, interval time.Duration, rate float64) *fullScrapes {
+	s := &fullScrapes{
+		scraper:  scraper,
+		interval: interval,
+		limiter:  ratelimit.New(rate, 1, fullScrapeCacheSize),
+		done:     make(chan struct{}),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	go s.run()
+	return s
+}
+
+func (s *fullScrapes) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		s.generate()
+
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// generate replaces the snapshots. A snapshot that can't be generated is
+// kept, so that clients receive slightly outdated responses instead of
+// errors.
+func (s *fullScrapes) generate() {
+	start := time.Now()
+	for _, af := range []bittorrent.AddressFamily{bittorrent.IPv4, bittorrent.IPv6} {
+		scrapes, err := s.scraper.FullScrape(s.ctx, af)
+		if err != nil {
+			if s.ctx.Err() == nil {
+				logger.Error("failed to generate full scrape", log.Fields{"addressFamily": af, "error": err.Error()})
+			}
+			continue
+		}
+
+		var buf bytes.Buffer
+		if err := WriteScrapeResponse(&buf, &bittorrent.ScrapeResponse{Files: scrapes}); err != nil {
+			logger.Error("failed to encode full scrape", log.Err(err))
+			continue
+		}
+		s.snapshots[af].Store(buf.Bytes())
+	}
+	logger.Debug("generated full scrape", log.Fields{"duration": time.Since(start)})
+}
+
+// serve writes the snapshot for the address family of ip.
+func (s *fullScrapes) serve(w http.ResponseWriter, ip bittorrent.IP, now time.Time) error {
+	if !s.limiter.Allow(string(ip.IP), now) {
+		return ErrFullScrapeRateLimited
+	}
+
+	snapshot, _ := s.snapshots[ip.AddressFamily].Load().([]byte)
+	if snapshot == nil {
+		return ErrFullScrapeUnavailable
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, err := w.Write(snapshot)
+	return err
+}
+
+// stop stops generating snapshots and waits for a generation in progress.
+func (s *fullScrapes) stop() {
+	s.cancel()
+	<-s.done
+}
+
+// remoteIP returns the IP address of the client of r, as seen by the server.
+func remoteIP(r *http.Request) (bittorrent.IP, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return bittorrent.IP{}, err
+	}
+	return bittorrent.NewIP(net.ParseIP(host))
+}
@@ -0,0 +1,59 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// fakeFullScraper returns one swarm whose counts depend on the address
+// family, or fails if err is set.
+type fakeFullScraper struct {
+	err error
+}
+
+func (s fakeFullScraper) FullScrape(ctx context.Context, af bittorrent.AddressFamily) ([]bittorrent.Scrape, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return []bittorrent.Scrape{{
+		InfoHash: bittorrent.InfoHashFromString("aaaaaaaaaaaaaaaaaaaa"),
+		Complete: uint32(af) + 1,
+	}}, nil
+}
+
+func TestFullScrapes(t *testing.T) {
+	s := newFullScrapes(fakeFullScraper{}, time.Hour, 1)
+	s.stop()
+
+	ipv4 := bittorrent.IP{IP: net.IP{192, 0, 2, 1}, AddressFamily: bittorrent.IPv4}
+	ipv6 := bittorrent.IP{IP: net.ParseIP("2001:db8::1"), AddressFamily: bittorrent.IPv6}
+	now := time.Now()
+
+	r := httptest.NewRecorder()
+	require.Nil(t, s.serve(r, ipv4, now))
+	require.Equal(t, "d5:filesd20:aaaaaaaaaaaaaaaaaaaad8:completei1e10:downloadedi0e10:incompletei0eeee", r.Body.String())
+
+	r = httptest.NewRecorder()
+	require.Nil(t, s.serve(r, ipv6, now))
+	require.Equal(t, "d5:filesd20:aaaaaaaaaaaaaaaaaaaad8:completei2e10:downloadedi0e10:incompletei0eeee", r.Body.String())
+
+	// Every IP address may scrape once per second.
+	require.Equal(t, ErrFullScrapeRateLimited, s.serve(httptest.NewRecorder(), ipv4, now))
+	require.Nil(t, s.serve(httptest.NewRecorder(), ipv4, now.Add(time.Second)))
+}
+
+func TestFullScrapesUnavailable(t *testing.T) {
+	s := newFullScrapes(fakeFullScraper{err: errors.New("failed")}, time.Hour, 1)
+	s.stop()
+
+	ip := bittorrent.IP{IP: net.IP{192, 0, 2, 1}, AddressFamily: bittorrent.IPv4}
+	require.Equal(t, ErrFullScrapeUnavailable, s.serve(httptest.NewRecorder(), ip, time.Now()))
+}
@@ -1,23 +1,49 @@
 package http
 
 import (
+	"math"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/frontend"
+	"github.com/chihaya/chihaya/pkg/netutil"
 )
 
+// ErrNoInfoHash is returned for announces and scrapes without an infohash.
+var ErrNoInfoHash = bittorrent.ClientError("no info_hash parameter supplied")
+
 // ParseOptions is the configuration used to parse an Announce Request.
 //
-// If AllowIPSpoofing is true, IPs provided via BitTorrent params will be used.
-// If RealIPHeader is not empty string, the value of the first HTTP Header with
-// that name will be used.
+// IPs provided via BitTorrent params will be used if IPSpoofing allows it.
+// AllowIPSpoofing is deprecated and allows spoofing of all IPs if IPSpoofing
+// allows none.
+// If RealIPHeader is not empty string, the first HTTP Header with that name
+// will be used if the request comes from a proxy trusted by IPSpoofing. It may
+// list the addresses of a chain of proxies like X-Forwarded-For, of which the
+// one appended by the first untrusted proxy is used.
+// If AllowClientSubnet is true, a client subnet provided via the "cs" param by
+// a proxy trusted by IPSpoofing will be made available to middleware, which
+// prefers peers in it.
+// If AllowMultiHomed is true, an endpoint for the other address family
+// provided via the "ipv4" or "ipv6" params will be used as described in BEP 45.
+// If MaxExcludedPeers is not zero, up to that many peers provided via the
+// "exclude" and "exclude6" params are left out of the response.
+// If DefaultCompact is true, clients that don't provide the "compact" param
+// receive compact responses.
 type ParseOptions struct {
-	AllowIPSpoofing     bool   `yaml:"allow_ip_spoofing"`
-	RealIPHeader        string `yaml:"real_ip_header"`
-	MaxNumWant          uint32 `yaml:"max_numwant"`
-	DefaultNumWant      uint32 `yaml:"default_numwant"`
-	MaxScrapeInfoHashes uint32 `yaml:"max_scrape_infohashes"`
+	AllowIPSpoofing     bool                      `yaml:"allow_ip_spoofing"`
+	IPSpoofing          frontend.IPSpoofingPolicy `yaml:"ip_spoofing"`
+	RealIPHeader        string                    `yaml:"real_ip_header"`
+	AllowClientSubnet   bool                      `yaml:"allow_client_subnet"`
+	AllowMultiHomed     bool                      `yaml:"allow_multihomed"`
+	MaxNumWant          uint32                    `yaml:"max_numwant"`
+	DefaultNumWant      uint32                    `yaml:"default_numwant"`
+	MaxScrapeInfoHashes uint32                    `yaml:"max_scrape_infohashes"`
+	MaxExcludedPeers    uint32                    `yaml:"max_excluded_peers"`
+	DefaultCompact      bool                      `yaml:"default_compact"`
 }
 
 // Default parser config constants.
@@ -27,6 +53,25 @@ const (
 	defaultMaxScrapeInfoHashes = 50
 )
 
+// parseCounter parses a byte counter of an announce.
+//
+// Negative values, sent by clients whose signed counters overflowed, are
+// wrapped around like the signed 64-bit counters of UDP announces, so that
+// they are handled the same way by bittorrent.SanitizeAnnounce.
+func parseCounter(qp *bittorrent.QueryParams, key string) (uint64, error) {
+	v, err := qp.Uint64(key)
+	if err == nil || err == bittorrent.ErrKeyNotFound {
+		return v, err
+	}
+
+	str, _ := qp.String(key)
+	i, ierr := strconv.ParseInt(str, 10, 64)
+	if ierr != nil || i >= 0 {
+		return 0, err
+	}
+	return uint64(i), nil
+}
+
 // ParseAnnounce parses an bittorrent.AnnounceRequest from an http.Request.
 func ParseAnnounce(r *http.Request, opts ParseOptions) (*bittorrent.AnnounceRequest, error) {
 	qp, err := bittorrent.ParseURLData(r.RequestURI)
@@ -48,14 +93,19 @@ func ParseAnnounce(r *http.Request, opts ParseOptions) (*bittorrent.AnnounceRequ
 		request.Event = bittorrent.None
 	}
 
-	// Determine if the client expects a compact response.
-	compactStr, _ := qp.String("compact")
-	request.Compact = compactStr != "" && compactStr != "0"
+	// Determine if the client expects a compact response, or the dictionary
+	// model of BEP 3 without peer IDs.
+	request.Compact = opts.DefaultCompact
+	if compactStr, ok := qp.String("compact"); ok {
+		request.Compact = compactStr != "" && compactStr != "0"
+	}
+	noPeerIDStr, _ := qp.String("no_peer_id")
+	request.NoPeerID = noPeerIDStr != "" && noPeerIDStr != "0"
 
 	// Parse the infohash from the request.
 	infoHashes := qp.InfoHashes()
 	if len(infoHashes) < 1 {
-		return nil, bittorrent.ClientError("no info_hash parameter supplied")
+		return nil, ErrNoInfoHash
 	}
 	if len(infoHashes) > 1 {
 		return nil, bittorrent.ClientError("multiple info_hash parameters supplied")
@@ -73,19 +123,19 @@ func ParseAnnounce(r *http.Request, opts ParseOptions) (*bittorrent.AnnounceRequ
 	request.Peer.ID = bittorrent.PeerIDFromString(peerID)
 
 	// Determine the number of remaining bytes for the client.
-	request.Left, err = qp.Uint64("left")
+	request.Left, err = parseCounter(qp, "left")
 	if err != nil {
 		return nil, bittorrent.ClientError("failed to parse parameter: left")
 	}
 
 	// Determine the number of bytes downloaded by the client.
-	request.Downloaded, err = qp.Uint64("downloaded")
+	request.Downloaded, err = parseCounter(qp, "downloaded")
 	if err != nil {
 		return nil, bittorrent.ClientError("failed to parse parameter: downloaded")
 	}
 
 	// Determine the number of bytes shared by the client.
-	request.Uploaded, err = qp.Uint64("uploaded")
+	request.Uploaded, err = parseCounter(qp, "uploaded")
 	if err != nil {
 		return nil, bittorrent.ClientError("failed to parse parameter: uploaded")
 	}
@@ -97,13 +147,24 @@ func ParseAnnounce(r *http.Request, opts ParseOptions) (*bittorrent.AnnounceRequ
 	}
 	// If there were no errors, the user actually provided the numwant.
 	request.NumWantProvided = err == nil
+	if numwant > math.MaxUint32 {
+		numwant = math.MaxUint32
+	}
 	request.NumWant = uint32(numwant)
 
 	// Parse the port where the client is listening.
 	port, err := qp.Uint64("port")
-	if err != nil {
+	if err != nil || port > math.MaxUint16 {
 		return nil, bittorrent.ClientError("failed to parse parameter: port")
 	}
+	// Clients only accepting encrypted connections announce port 0 and the
+	// port they accept them on in "cryptoport", as in the tracker extension
+	// of Message Stream Encryption.
+	if port == 0 {
+		if cryptoPort, err := qp.Uint64("cryptoport"); err == nil && cryptoPort <= math.MaxUint16 {
+			port = cryptoPort
+		}
+	}
 	request.Peer.Port = uint16(port)
 
 	// Parse the IP address where the client is listening.
@@ -112,6 +173,23 @@ func ParseAnnounce(r *http.Request, opts ParseOptions) (*bittorrent.AnnounceRequ
 		return nil, bittorrent.ClientError("failed to parse peer IP address")
 	}
 
+	// Parse the endpoint of a multi-homed client in the other address family.
+	if opts.AllowMultiHomed {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		request.AlternatePeer, err = alternatePeer(qp, request.Peer, netutil.ParseIP(host), opts.IPSpoofing)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Parse the peers the client already knows.
+	if opts.MaxExcludedPeers > 0 {
+		request.ExcludedPeers, err = bittorrent.ParseExcludedPeers(qp, int(opts.MaxExcludedPeers))
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	if err := bittorrent.SanitizeAnnounce(request, opts.MaxNumWant, opts.DefaultNumWant); err != nil {
 		return nil, err
 	}
@@ -128,7 +206,7 @@ func ParseScrape(r *http.Request, opts ParseOptions) (*bittorrent.ScrapeRequest,
 
 	infoHashes := qp.InfoHashes()
 	if len(infoHashes) < 1 {
-		return nil, bittorrent.ClientError("no info_hash parameter supplied")
+		return nil, ErrNoInfoHash
 	}
 
 	request := &bittorrent.ScrapeRequest{
@@ -143,28 +221,116 @@ func ParseScrape(r *http.Request, opts ParseOptions) (*bittorrent.ScrapeRequest,
 	return request, nil
 }
 
-// requestedIP determines the IP address for a BitTorrent client request.
-func requestedIP(r *http.Request, p bittorrent.Params, opts ParseOptions) (ip net.IP, provided bool) {
-	if opts.AllowIPSpoofing {
-		if ipstr, ok := p.String("ip"); ok {
-			return net.ParseIP(ipstr), true
-		}
+// ParseClientSubnet parses the client subnet asserted via the "cs" param,
+// similar to the EDNS Client Subnet option in DNS.
+//
+// The value is expected in CIDR notation, e.g. "203.0.113.0/24". A single IP
+// address is treated as a subnet containing only that address.
+// If the param is not present, nil and no error are returned.
+func ParseClientSubnet(p bittorrent.Params) (*net.IPNet, error) {
+	csStr, ok := p.String("cs")
+	if !ok {
+		return nil, nil
+	}
 
-		if ipstr, ok := p.String("ipv4"); ok {
-			return net.ParseIP(ipstr), true
+	if !strings.Contains(csStr, "/") {
+		ip := netutil.ParseIP(csStr)
+		if ip == nil {
+			return nil, bittorrent.ClientError("failed to parse parameter: cs")
 		}
+		bits := 8 * len(ip)
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, subnet, err := net.ParseCIDR(csStr)
+	if err != nil {
+		return nil, bittorrent.ClientError("failed to parse parameter: cs")
+	}
+
+	return subnet, nil
+}
+
+// alternatePeer determines the endpoint of a multi-homed client in the address
+// family other than the one of the provided Peer.
+//
+// As described in BEP 7, the "ipv4" and "ipv6" params may contain either a
+// bare address or an address and a port.
+// If no such endpoint was provided, nil and no error are returned.
+//
+// Since the endpoint is added to swarms like the address of the client, it is
+// only used if the request, received from source, may assert it according to
+// policy, and ignored otherwise. Endpoints that are not of the family named by
+// the param, not publicly routable or have port 0 are rejected.
+func alternatePeer(p bittorrent.Params, peer bittorrent.Peer, source net.IP, policy frontend.IPSpoofingPolicy) (*bittorrent.Peer, error) {
+	key, family := "ipv6", netutil.IPv6
+	if netutil.FamilyOf(peer.IP.IP) == netutil.IPv6 {
+		key, family = "ipv4", netutil.IPv4
+	}
 
-		if ipstr, ok := p.String("ipv6"); ok {
-			return net.ParseIP(ipstr), true
+	value, ok := p.String(key)
+	if !ok || value == "" {
+		return nil, nil
+	}
+
+	alternate := &bittorrent.Peer{ID: peer.ID, Port: peer.Port}
+	if ip := netutil.ParseIP(value); ip != nil {
+		alternate.IP.IP = ip
+	} else {
+		host, portStr, err := net.SplitHostPort(value)
+		if err != nil {
+			return nil, bittorrent.ClientError("failed to parse parameter: " + key)
+		}
+		alternate.IP.IP = netutil.ParseIP(host)
+		if alternate.IP.IP == nil {
+			return nil, bittorrent.ClientError("failed to parse parameter: " + key)
 		}
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			return nil, bittorrent.ClientError("failed to parse parameter: " + key)
+		}
+		alternate.Port = uint16(port)
 	}
 
-	if opts.RealIPHeader != "" {
-		if ip := r.Header.Get(opts.RealIPHeader); ip != "" {
-			return net.ParseIP(ip), false
+	if netutil.FamilyOf(alternate.IP.IP) != family || frontend.IsBogon(alternate.IP.IP) || alternate.Port == 0 {
+		return nil, bittorrent.ClientError("invalid endpoint in parameter: " + key)
+	}
+	if !policy.Allows(source, alternate.IP.IP) {
+		return nil, nil
+	}
+
+	return alternate, nil
+}
+
+// requestedIP determines the IP address for a BitTorrent client request.
+func requestedIP(r *http.Request, p bittorrent.Params, opts ParseOptions) (ip net.IP, provided bool) {
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	source := netutil.ParseIP(host)
+
+	if opts.IPSpoofing.Enabled() {
+		for _, key := range []string{"ip", "ipv4", "ipv6"} {
+			if ipstr, ok := p.String(key); ok {
+				if asserted := netutil.ParseIP(ipstr); opts.IPSpoofing.Allows(source, asserted) {
+					return asserted, true
+				}
+			}
 		}
 	}
 
+	return transportIP(r, opts), false
+}
+
+// transportIP returns the IP address responses to r are delivered to: the
+// source of the connection, or the address a trusted proxy forwarded it for.
+// Unlike requestedIP, it ignores the addresses asserted in the parameters.
+func transportIP(r *http.Request, opts ParseOptions) net.IP {
 	host, _, _ := net.SplitHostPort(r.RemoteAddr)
-	return net.ParseIP(host), false
+	source := netutil.ParseIP(host)
+
+	if opts.RealIPHeader != "" && opts.IPSpoofing.Trusts(source) {
+		if header := r.Header.Get(opts.RealIPHeader); header != "" {
+			return opts.IPSpoofing.ForwardedIP(source, header)
+		}
+	}
+
+	return source
 }
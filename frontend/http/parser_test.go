@@ -0,0 +1,216 @@
+package http
+
+import (
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/frontend"
+)
+
+func TestParseClientSubnet(t *testing.T) {
+	var table = []struct {
+		urlData  string
+		expected string
+		err      error
+	}{
+		{"/announce", "", nil},
+		{"/announce?cs=203.0.113.0/24", "203.0.113.0/24", nil},
+		{"/announce?cs=203.0.113.7/24", "203.0.113.0/24", nil},
+		{"/announce?cs=203.0.113.7", "203.0.113.7/32", nil},
+		{"/announce?cs=2001:db8::/48", "2001:db8::/48", nil},
+		{"/announce?cs=2001:db8::1", "2001:db8::1/128", nil},
+		{"/announce?cs=", "", bittorrent.ClientError("failed to parse parameter: cs")},
+		{"/announce?cs=203.0.113.0/33", "", bittorrent.ClientError("failed to parse parameter: cs")},
+		{"/announce?cs=example.com", "", bittorrent.ClientError("failed to parse parameter: cs")},
+	}
+
+	for _, tt := range table {
+		t.Run(fmt.Sprintf("%s expecting %s", tt.urlData, tt.expected), func(t *testing.T) {
+			qp, err := bittorrent.ParseURLData(tt.urlData)
+			require.Nil(t, err)
+
+			subnet, err := ParseClientSubnet(qp)
+			require.Equal(t, tt.err, err)
+			if tt.expected == "" {
+				require.Nil(t, subnet)
+			} else {
+				require.Equal(t, tt.expected, subnet.String())
+			}
+		})
+	}
+}
+
+func TestAlternatePeer(t *testing.T) {
+	v4Peer := bittorrent.Peer{IP: bittorrent.IP{IP: net.ParseIP("93.184.216.34").To4()}, Port: 1234}
+	v6Peer := bittorrent.Peer{IP: bittorrent.IP{IP: net.ParseIP("2a00:1450::1")}, Port: 1234}
+	source := net.ParseIP("198.51.100.7")
+	allowAll := frontend.IPSpoofingPolicy{AllowIPv4: true, AllowIPv6: true}
+
+	var table = []struct {
+		urlData  string
+		peer     bittorrent.Peer
+		policy   frontend.IPSpoofingPolicy
+		expected string
+		err      bool
+	}{
+		{"/announce", v4Peer, allowAll, "", false},
+		{"/announce?ipv4=93.184.216.35", v4Peer, allowAll, "", false},
+		{"/announce?ipv6=2a00:1450::2", v4Peer, allowAll, "[2a00:1450::2]:1234", false},
+		{"/announce?ipv6=[2a00:1450::2]:4321", v4Peer, allowAll, "[2a00:1450::2]:4321", false},
+		{"/announce?ipv4=93.184.216.35", v6Peer, allowAll, "[93.184.216.35]:1234", false},
+		{"/announce?ipv4=93.184.216.35:4321", v6Peer, allowAll, "[93.184.216.35]:4321", false},
+		{"/announce?ipv6=2a00:1450::zz", v4Peer, allowAll, "", true},
+		{"/announce?ipv4=93.184.216.35:99999", v6Peer, allowAll, "", true},
+
+		// The endpoint must be of the family named by the param.
+		{"/announce?ipv6=93.184.216.35", v4Peer, allowAll, "", true},
+		{"/announce?ipv4=2a00:1450::2", v6Peer, allowAll, "", true},
+
+		// The endpoint must be publicly routable and have a port.
+		{"/announce?ipv6=::", v4Peer, allowAll, "", true},
+		{"/announce?ipv6=::1", v4Peer, allowAll, "", true},
+		{"/announce?ipv6=2001:db8::2", v4Peer, allowAll, "", true},
+		{"/announce?ipv4=127.0.0.1", v6Peer, allowAll, "", true},
+		{"/announce?ipv4=10.0.0.1", v6Peer, allowAll, "", true},
+		{"/announce?ipv4=93.184.216.35:0", v6Peer, allowAll, "", true},
+
+		// The endpoint is ignored unless the policy allows asserting it.
+		{"/announce?ipv6=2a00:1450::2", v4Peer, frontend.IPSpoofingPolicy{}, "", false},
+		{"/announce?ipv6=2a00:1450::2", v4Peer, frontend.IPSpoofingPolicy{AllowIPv4: true}, "", false},
+		{"/announce?ipv4=93.184.216.35", v6Peer, frontend.IPSpoofingPolicy{AllowIPv4: true}, "[93.184.216.35]:1234", false},
+		{"/announce?ipv6=2a00:1450::2", v4Peer, frontend.IPSpoofingPolicy{AllowIPv6: true, TrustedProxyCIDRs: frontend.CIDRs{{IP: net.IPv4(192, 0, 2, 0), Mask: net.CIDRMask(24, 32)}}}, "", false},
+		{"/announce?ipv6=2a00:1450::2", v4Peer, frontend.IPSpoofingPolicy{AllowIPv6: true, TrustedProxyCIDRs: frontend.CIDRs{{IP: net.IPv4(198, 51, 100, 0), Mask: net.CIDRMask(24, 32)}}}, "[2a00:1450::2]:1234", false},
+	}
+
+	for _, tt := range table {
+		t.Run(fmt.Sprintf("%s from %s", tt.urlData, tt.peer.IP), func(t *testing.T) {
+			qp, err := bittorrent.ParseURLData(tt.urlData)
+			require.Nil(t, err)
+
+			alternate, err := alternatePeer(qp, tt.peer, source, tt.policy)
+			if tt.err {
+				require.NotNil(t, err)
+				return
+			}
+			require.Nil(t, err)
+			if tt.expected == "" {
+				require.Nil(t, alternate)
+			} else {
+				require.Equal(t, tt.expected, fmt.Sprintf("[%s]:%d", alternate.IP, alternate.Port))
+			}
+		})
+	}
+}
+
+func TestParseAnnounceCounters(t *testing.T) {
+	const query = "/announce?info_hash=aaaaaaaaaaaaaaaaaaaa&peer_id=bbbbbbbbbbbbbbbbbbbb"
+	opts := ParseOptions{MaxNumWant: 100, DefaultNumWant: 50}
+
+	var table = []struct {
+		params     string
+		left       uint64
+		downloaded uint64
+		uploaded   uint64
+		numWant    uint32
+		err        bool
+	}{
+		{"&port=1&left=1&downloaded=2&uploaded=3&numwant=10", 1, 2, 3, 10, false},
+		{"&port=1&left=-1&downloaded=-2&uploaded=-3", 1<<64 - 1, 0, 0, 50, false},
+		{"&port=1&left=0&downloaded=0&uploaded=0&numwant=4294967296", 0, 0, 0, 100, false},
+		{"&port=65537&left=0&downloaded=0&uploaded=0", 0, 0, 0, 0, true},
+		{"&port=1&left=x&downloaded=0&uploaded=0", 0, 0, 0, 0, true},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.params, func(t *testing.T) {
+			req, err := ParseAnnounce(httptest.NewRequest("GET", query+tt.params, nil), opts)
+			if tt.err {
+				require.NotNil(t, err)
+				return
+			}
+			require.Nil(t, err)
+			require.Equal(t, tt.left, req.Left)
+			require.Equal(t, tt.downloaded, req.Downloaded)
+			require.Equal(t, tt.uploaded, req.Uploaded)
+			require.Equal(t, tt.numWant, req.NumWant)
+		})
+	}
+}
+
+func TestRequestedIP(t *testing.T) {
+	allowAll := frontend.IPSpoofingPolicy{AllowIPv4: true, AllowIPv6: true}
+	trustedProxy := allowAll
+	trustedProxy.TrustedProxyCIDRs = frontend.CIDRs{{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)}}
+
+	var table = []struct {
+		remoteAddr string
+		urlData    string
+		policy     frontend.IPSpoofingPolicy
+		expected   string
+		provided   bool
+	}{
+		{"203.0.113.1:1234", "/announce?ip=198.51.100.1", frontend.IPSpoofingPolicy{}, "198.51.100.2", false},
+		{"203.0.113.1:1234", "/announce?ip=198.51.100.1", allowAll, "198.51.100.1", true},
+		{"203.0.113.1:1234", "/announce?ip=198.51.100.1", trustedProxy, "203.0.113.1", false},
+		{"10.0.0.1:1234", "/announce?ip=198.51.100.1", trustedProxy, "198.51.100.1", true},
+		{"203.0.113.1:1234", "/announce?ip=bogus", allowAll, "198.51.100.2", false},
+		{"203.0.113.1:1234", "/announce", trustedProxy, "203.0.113.1", false},
+		{"10.0.0.1:1234", "/announce", trustedProxy, "198.51.100.2", false},
+		{"10.0.0.1:1234", "/announce?ip=bogus", trustedProxy, "198.51.100.2", false},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.remoteAddr+tt.urlData, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.urlData, nil)
+			r.RemoteAddr = tt.remoteAddr
+			r.Header.Set("X-Real-IP", "198.51.100.2")
+			qp, err := bittorrent.ParseURLData(tt.urlData)
+			require.Nil(t, err)
+
+			ip, provided := requestedIP(r, qp, ParseOptions{IPSpoofing: tt.policy, RealIPHeader: "X-Real-IP"})
+			require.Equal(t, tt.expected, ip.String())
+			require.Equal(t, tt.provided, provided)
+		})
+	}
+}
+
+func TestParseAnnounceResponseFormat(t *testing.T) {
+	const query = "/announce?info_hash=aaaaaaaaaaaaaaaaaaaa&peer_id=bbbbbbbbbbbbbbbbbbbb&left=0&downloaded=0&uploaded=0"
+
+	var table = []struct {
+		params         string
+		defaultCompact bool
+		compact        bool
+		noPeerID       bool
+		port           uint16
+	}{
+		{"&port=1", false, false, false, 1},
+		{"&port=1", true, true, false, 1},
+		{"&port=1&compact=1", false, true, false, 1},
+		{"&port=1&compact=0", true, false, false, 1},
+		{"&port=1&compact=0&no_peer_id=1", true, false, true, 1},
+		// Clients only accepting encrypted connections announce their port
+		// as cryptoport.
+		{"&port=0&cryptoport=2", false, false, false, 2},
+		{"&port=1&cryptoport=2", false, false, false, 1},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.params, func(t *testing.T) {
+			opts := ParseOptions{MaxNumWant: 100, DefaultNumWant: 50, DefaultCompact: tt.defaultCompact}
+			req, err := ParseAnnounce(httptest.NewRequest("GET", query+tt.params, nil), opts)
+			require.Nil(t, err)
+			require.Equal(t, tt.compact, req.Compact)
+			require.Equal(t, tt.noPeerID, req.NoPeerID)
+			require.Equal(t, tt.port, req.Port)
+		})
+	}
+
+	_, err := ParseAnnounce(httptest.NewRequest("GET", query+"&port=0", nil), ParseOptions{})
+	require.Equal(t, bittorrent.ErrInvalidPort, err)
+}
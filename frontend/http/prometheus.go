@@ -1,6 +1,7 @@
 package http
 
 import (
+	"strconv"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -9,7 +10,18 @@ import (
 )
 
 func init() {
-	prometheus.MustRegister(promResponseDurationMilliseconds)
+	prometheus.MustRegister(
+		promResponseDurationMilliseconds,
+		promMultiHomedAnnouncesTotal,
+		promTruncatedResponsesTotal,
+		promChallengedAnnouncesTotal,
+		promOpenConnections,
+		promConnectionsTotal,
+		promConnectionRequestsTotal,
+		promRequestsPerConnection,
+		promTLSHandshakesTotal,
+		promKeepAliveLimitsTotal,
+	)
 }
 
 var promResponseDurationMilliseconds = prometheus.NewHistogramVec(
@@ -21,6 +33,121 @@ var promResponseDurationMilliseconds = prometheus.NewHistogramVec(
 	[]string{"action", "address_family", "error"},
 )
 
+var promMultiHomedAnnouncesTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "chihaya_http_multihomed_announces_total",
+		Help: "The number of announces providing endpoints for both address families",
+	},
+	[]string{"address_family"},
+)
+
+var promTruncatedResponsesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "chihaya_http_truncated_responses_total",
+	Help: "The number of announce responses whose peers were truncated to max_response_peers",
+})
+
+var promChallengedAnnouncesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "chihaya_http_challenged_announces_total",
+	Help: "The number of announces without a valid challenge token, which didn't change any swarms",
+})
+
+var promOpenConnections = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "chihaya_http_open_connections",
+		Help: "The number of open client connections",
+	},
+	[]string{"scheme"},
+)
+
+var promConnectionsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "chihaya_http_connections_total",
+		Help: "The number of accepted client connections",
+	},
+	[]string{"scheme"},
+)
+
+var promConnectionRequestsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "chihaya_http_connection_requests_total",
+		Help: "The number of requests, by whether they reused a connection of an earlier request",
+	},
+	[]string{"scheme", "reused"},
+)
+
+var promRequestsPerConnection = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "chihaya_http_requests_per_connection",
+		Help:    "The number of requests served on client connections, observed when they are closed",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+	},
+	[]string{"scheme"},
+)
+
+var promTLSHandshakesTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "chihaya_http_tls_handshakes_total",
+		Help: "The number of completed TLS handshakes, by whether they resumed a session",
+	},
+	[]string{"resumed"},
+)
+
+var promKeepAliveLimitsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "chihaya_http_keepalive_limits_total",
+		Help: "The number of connections closed because they reached a keepalive limit",
+	},
+	[]string{"limit"},
+)
+
+// recordConnectionOpened records an accepted connection.
+func recordConnectionOpened(scheme string) {
+	promConnectionsTotal.WithLabelValues(scheme).Inc()
+	promOpenConnections.WithLabelValues(scheme).Inc()
+}
+
+// recordConnectionClosed records a closed connection that served the given
+// number of requests.
+func recordConnectionClosed(scheme string, requests uint64) {
+	promOpenConnections.WithLabelValues(scheme).Dec()
+	promRequestsPerConnection.WithLabelValues(scheme).Observe(float64(requests))
+}
+
+// recordConnectionRequest records a request and whether its connection
+// served an earlier request.
+func recordConnectionRequest(scheme string, reused bool) {
+	promConnectionRequestsTotal.WithLabelValues(scheme, strconv.FormatBool(reused)).Inc()
+}
+
+// recordTLSHandshake records a completed TLS handshake.
+func recordTLSHandshake(resumed bool) {
+	promTLSHandshakesTotal.WithLabelValues(strconv.FormatBool(resumed)).Inc()
+}
+
+// recordKeepAliveLimit records a connection that is closed because it
+// reached the given keepalive limit.
+func recordKeepAliveLimit(limit string) {
+	promKeepAliveLimitsTotal.WithLabelValues(limit).Inc()
+}
+
+// recordChallengedAnnounce records an announce without a valid challenge
+// token.
+func recordChallengedAnnounce() {
+	promChallengedAnnouncesTotal.Inc()
+}
+
+// recordMultiHomedAnnounce records an announce of a multi-homed client that
+// was received via the given address family.
+func recordMultiHomedAnnounce(af bittorrent.AddressFamily) {
+	promMultiHomedAnnouncesTotal.WithLabelValues(af.String()).Inc()
+}
+
+// recordTruncatedResponse records an announce response whose peers were
+// truncated.
+func recordTruncatedResponse() {
+	promTruncatedResponsesTotal.Inc()
+}
+
 // recordResponseDuration records the duration of time to respond to a Request
 // in milliseconds.
 func recordResponseDuration(action string, af *bittorrent.AddressFamily, err error, duration time.Duration) {
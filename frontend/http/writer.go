@@ -1,10 +1,14 @@
 package http
 
 import (
+	"bytes"
+	"io"
 	"net/http"
+	"sort"
+	"time"
 
 	"github.com/chihaya/chihaya/bittorrent"
-	"github.com/chihaya/chihaya/frontend/http/bencode"
+	"github.com/chihaya/chihaya/pkg/bencode"
 	"github.com/chihaya/chihaya/pkg/log"
 )
 
@@ -14,103 +18,206 @@ func WriteError(w http.ResponseWriter, err error) error {
 	if _, clientErr := err.(bittorrent.ClientError); clientErr {
 		message = err.Error()
 	} else {
-		log.Error("http: internal error", log.Err(err))
+		logger.Error("internal error", log.Err(err))
 	}
 
 	w.WriteHeader(http.StatusOK)
-	return bencode.NewEncoder(w).Encode(bencode.Dict{
-		"failure reason": message,
-	})
+	return writeFailure(w, message, 0)
+}
+
+// writeFailure writes a failure with the given reason. A retryIn other than
+// zero is written as the "retry in" key of BEP 31, in whole minutes rounded
+// up, or as "never" if it is bittorrent.RetryNever.
+func writeFailure(w io.Writer, reason string, retryIn time.Duration) error {
+	bw := bencode.NewWriter(w)
+	bw.Dict()
+	bw.Key("failure reason")
+	bw.String(reason)
+	switch {
+	case retryIn == bittorrent.RetryNever:
+		bw.Key("retry in")
+		bw.String("never")
+	case retryIn > 0:
+		bw.Key("retry in")
+		bw.Int(int64((retryIn + time.Minute - 1) / time.Minute))
+	}
+	bw.End()
+	return bw.Flush()
 }
 
 // WriteAnnounceResponse communicates the results of an Announce to a
 // BitTorrent client over HTTP.
+//
+// The keys of the response are written in sorted order. A response with a
+// FailureReason is written as a failure, without peers.
 func WriteAnnounceResponse(w http.ResponseWriter, resp *bittorrent.AnnounceResponse) error {
-	bdict := bencode.Dict{
-		"complete":     resp.Complete,
-		"incomplete":   resp.Incomplete,
-		"interval":     resp.Interval,
-		"min interval": resp.MinInterval,
+	if resp.FailureReason != "" {
+		return writeFailure(w, resp.FailureReason, resp.RetryIn)
 	}
 
-	// Add the peers to the dictionary in the compact format.
+	bw := bencode.NewWriter(w)
+	bw.Dict()
+	bw.Key("complete")
+	bw.Uint(uint64(resp.Complete))
+	bw.Key("incomplete")
+	bw.Uint(uint64(resp.Incomplete))
+	bw.Key("interval")
+	bw.Int(int64(resp.Interval / time.Second))
+	bw.Key("min interval")
+	bw.Int(int64(resp.MinInterval / time.Second))
+
+	bw.Key("peers")
 	if resp.Compact {
-		var IPv4CompactDict, IPv6CompactDict []byte
+		// The key is always present, as clients expect it even if there
+		// are no peers, for example because they asked for none.
+		buf := bw.ByteString(6 * len(resp.IPv4Peers))
+		for i, peer := range resp.IPv4Peers {
+			compact4(buf[6*i:], peer)
+		}
 
-		// Add the IPv4 peers to the dictionary.
-		for _, peer := range resp.IPv4Peers {
-			IPv4CompactDict = append(IPv4CompactDict, compact4(peer)...)
+		if len(resp.IPv6Peers) > 0 {
+			bw.Key("peers6")
+			buf := bw.ByteString(18 * len(resp.IPv6Peers))
+			for i, peer := range resp.IPv6Peers {
+				compact6(buf[18*i:], peer)
+			}
 		}
-		if len(IPv4CompactDict) > 0 {
-			bdict["peers"] = IPv4CompactDict
+	} else {
+		bw.List()
+		for _, peer := range resp.IPv4Peers {
+			writePeer(bw, peer, resp.NoPeerID)
 		}
-
-		// Add the IPv6 peers to the dictionary.
 		for _, peer := range resp.IPv6Peers {
-			IPv6CompactDict = append(IPv6CompactDict, compact6(peer)...)
-		}
-		if len(IPv6CompactDict) > 0 {
-			bdict["peers6"] = IPv6CompactDict
+			writePeer(bw, peer, resp.NoPeerID)
 		}
-
-		return bencode.NewEncoder(w).Encode(bdict)
+		bw.End()
 	}
 
-	// Add the peers to the dictionary.
-	var peers []bencode.Dict
-	for _, peer := range resp.IPv4Peers {
-		peers = append(peers, dict(peer))
+	if resp.TrackerID != "" {
+		bw.Key("tracker id")
+		bw.String(resp.TrackerID)
 	}
-	for _, peer := range resp.IPv6Peers {
-		peers = append(peers, dict(peer))
+	if resp.WarningMessage != "" {
+		bw.Key("warning message")
+		bw.String(resp.WarningMessage)
+	}
+	bw.End()
+	return bw.Flush()
+}
+
+// truncatePeers returns a copy of resp with at most max peers of each address
+// family, or resp itself if it has no more peers than that or max is zero.
+func truncatePeers(resp *bittorrent.AnnounceResponse, max int) *bittorrent.AnnounceResponse {
+	if max <= 0 || (len(resp.IPv4Peers) <= max && len(resp.IPv6Peers) <= max) {
+		return resp
 	}
-	bdict["peers"] = peers
 
-	return bencode.NewEncoder(w).Encode(bdict)
+	truncated := *resp
+	if len(truncated.IPv4Peers) > max {
+		truncated.IPv4Peers = truncated.IPv4Peers[:max]
+	}
+	if len(truncated.IPv6Peers) > max {
+		truncated.IPv6Peers = truncated.IPv6Peers[:max]
+	}
+	recordTruncatedResponse()
+	return &truncated
 }
 
 // WriteScrapeResponse communicates the results of a Scrape to a BitTorrent
 // client over HTTP.
-func WriteScrapeResponse(w http.ResponseWriter, resp *bittorrent.ScrapeResponse) error {
-	filesDict := bencode.NewDict()
-	for _, scrape := range resp.Files {
-		filesDict[string(scrape.InfoHash[:])] = bencode.Dict{
-			"complete":   scrape.Complete,
-			"incomplete": scrape.Incomplete,
-		}
+//
+// The files are keyed by their infohashes, which are written in sorted order
+// and only once.
+func WriteScrapeResponse(w io.Writer, resp *bittorrent.ScrapeResponse) error {
+	files := resp.Files
+	less := func(i, j int) bool { return bytes.Compare(files[i].InfoHash[:], files[j].InfoHash[:]) < 0 }
+	if !sort.SliceIsSorted(files, less) {
+		// The response is not reordered, as it is passed on to the
+		// middleware afterwards.
+		files = append([]bittorrent.Scrape(nil), files...)
+		sort.Slice(files, less)
 	}
 
-	return bencode.NewEncoder(w).Encode(bencode.Dict{
-		"files": filesDict,
-	})
+	bw := bencode.NewWriter(w)
+	bw.Dict()
+	bw.Key("files")
+	bw.Dict()
+	for i, scrape := range files {
+		if i > 0 && scrape.InfoHash == files[i-1].InfoHash {
+			continue
+		}
+		bw.Key(string(scrape.InfoHash[:]))
+		bw.Dict()
+		bw.Key("complete")
+		bw.Uint(uint64(scrape.Complete))
+		if !scrape.Created.IsZero() {
+			bw.Key("created")
+			bw.Uint(uint64(scrape.Created.Unix()))
+		}
+		bw.Key("downloaded")
+		bw.Uint(uint64(scrape.Snatches))
+		if scrape.HasDownloaders {
+			bw.Key("downloaders")
+			bw.Uint(uint64(scrape.Downloaders))
+		}
+		bw.Key("incomplete")
+		bw.Uint(uint64(scrape.Incomplete))
+		if !scrape.LastAnnounce.IsZero() {
+			bw.Key("last_announce")
+			bw.Uint(uint64(scrape.LastAnnounce.Unix()))
+		}
+		if scrape.Name != "" {
+			bw.Key("name")
+			bw.String(scrape.Name)
+		}
+		bw.End()
+	}
+	bw.End()
+	if resp.MinRequestInterval > 0 {
+		bw.Key("flags")
+		bw.Dict()
+		bw.Key("min_request_interval")
+		bw.Uint(uint64(resp.MinRequestInterval / time.Second))
+		bw.End()
+	}
+	bw.End()
+	return bw.Flush()
 }
 
-func compact4(peer bittorrent.Peer) (buf []byte) {
-	if ip := peer.IP.To4(); ip == nil {
+// compact4 writes the compact form of an IPv4 peer into the first 6 bytes of
+// buf.
+func compact4(buf []byte, peer bittorrent.Peer) {
+	ip := peer.IP.To4()
+	if ip == nil {
 		panic("non-IPv4 IP for Peer in IPv4Peers")
-	} else {
-		buf = []byte(ip)
 	}
-	buf = append(buf, byte(peer.Port>>8))
-	buf = append(buf, byte(peer.Port&0xff))
-	return
+	copy(buf, ip)
+	buf[4] = byte(peer.Port >> 8)
+	buf[5] = byte(peer.Port & 0xff)
 }
 
-func compact6(peer bittorrent.Peer) (buf []byte) {
-	if ip := peer.IP.To16(); ip == nil {
+// compact6 writes the compact form of an IPv6 peer into the first 18 bytes
+// of buf.
+func compact6(buf []byte, peer bittorrent.Peer) {
+	ip := peer.IP.To16()
+	if ip == nil {
 		panic("non-IPv6 IP for Peer in IPv6Peers")
-	} else {
-		buf = []byte(ip)
 	}
-	buf = append(buf, byte(peer.Port>>8))
-	buf = append(buf, byte(peer.Port&0xff))
-	return
+	copy(buf, ip)
+	buf[16] = byte(peer.Port >> 8)
+	buf[17] = byte(peer.Port & 0xff)
 }
 
-func dict(peer bittorrent.Peer) bencode.Dict {
-	return bencode.Dict{
-		"peer id": string(peer.ID[:]),
-		"ip":      peer.IP.String(),
-		"port":    peer.Port,
+// writePeer writes the dictionary of a peer of a non-compact response.
+func writePeer(bw *bencode.Writer, peer bittorrent.Peer, noPeerID bool) {
+	bw.Dict()
+	bw.Key("ip")
+	bw.String(peer.IP.String())
+	if !noPeerID {
+		bw.Key("peer id")
+		bw.Bytes(peer.ID[:])
 	}
+	bw.Key("port")
+	bw.Uint(uint64(peer.Port))
+	bw.End()
 }
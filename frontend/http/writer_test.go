@@ -2,8 +2,10 @@ package http
 
 import (
 	"fmt"
+	"net"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
@@ -44,3 +46,158 @@ func TestWriteStatus(t *testing.T) {
 		})
 	}
 }
+
+func TestWriteAnnounceResponseWithoutPeers(t *testing.T) {
+	var table = []struct {
+		compact  bool
+		expected string
+	}{
+		{true, "d8:completei1e10:incompletei2e8:intervali0e12:min intervali0e5:peers0:e"},
+		{false, "d8:completei1e10:incompletei2e8:intervali0e12:min intervali0e5:peerslee"},
+	}
+
+	for _, tt := range table {
+		t.Run(fmt.Sprintf("compact=%t", tt.compact), func(t *testing.T) {
+			r := httptest.NewRecorder()
+			err := WriteAnnounceResponse(r, &bittorrent.AnnounceResponse{Compact: tt.compact, Complete: 1, Incomplete: 2})
+			require.Nil(t, err)
+			require.Equal(t, tt.expected, r.Body.String())
+		})
+	}
+}
+
+func TestTruncatePeers(t *testing.T) {
+	peers := func(n int) []bittorrent.Peer {
+		return make([]bittorrent.Peer, n)
+	}
+
+	var table = []struct {
+		ipv4, ipv6   int
+		max          int
+		expectedIPv4 int
+		expectedIPv6 int
+	}{
+		{50, 50, 0, 50, 50},
+		{50, 10, 30, 30, 10},
+		{10, 50, 30, 10, 30},
+		{10, 10, 30, 10, 10},
+	}
+
+	for _, tt := range table {
+		resp := &bittorrent.AnnounceResponse{IPv4Peers: peers(tt.ipv4), IPv6Peers: peers(tt.ipv6)}
+		truncated := truncatePeers(resp, tt.max)
+		require.Len(t, truncated.IPv4Peers, tt.expectedIPv4)
+		require.Len(t, truncated.IPv6Peers, tt.expectedIPv6)
+
+		// The original response is not modified.
+		require.Len(t, resp.IPv4Peers, tt.ipv4)
+		require.Len(t, resp.IPv6Peers, tt.ipv6)
+	}
+}
+
+func TestWriteAnnounceResponseTrackerID(t *testing.T) {
+	r := httptest.NewRecorder()
+	err := WriteAnnounceResponse(r, &bittorrent.AnnounceResponse{Compact: true, TrackerID: "token"})
+	require.Nil(t, err)
+	require.Equal(t, "d8:completei0e10:incompletei0e8:intervali0e12:min intervali0e5:peers0:10:tracker id5:tokene", r.Body.String())
+}
+
+func TestWriteAnnounceResponseWarning(t *testing.T) {
+	r := httptest.NewRecorder()
+	err := WriteAnnounceResponse(r, &bittorrent.AnnounceResponse{Compact: true, WarningMessage: "update your client"})
+	require.Nil(t, err)
+	require.Equal(t, "d8:completei0e10:incompletei0e8:intervali0e12:min intervali0e5:peers0:15:warning message18:update your cliente", r.Body.String())
+}
+
+func TestWriteAnnounceResponseFailure(t *testing.T) {
+	var table = []struct {
+		retryIn  time.Duration
+		expected string
+	}{
+		{0, "d14:failure reason4:busye"},
+		{90 * time.Second, "d14:failure reason4:busy8:retry ini2ee"},
+		{bittorrent.RetryNever, "d14:failure reason4:busy8:retry in5:nevere"},
+	}
+
+	for _, tt := range table {
+		t.Run(fmt.Sprintf("retryIn=%s", tt.retryIn), func(t *testing.T) {
+			r := httptest.NewRecorder()
+			err := WriteAnnounceResponse(r, &bittorrent.AnnounceResponse{
+				Compact:       true,
+				FailureReason: "busy",
+				RetryIn:       tt.retryIn,
+				IPv4Peers:     make([]bittorrent.Peer, 1),
+			})
+			require.Nil(t, err)
+			require.Equal(t, tt.expected, r.Body.String())
+		})
+	}
+}
+
+func TestWriteAnnounceResponsePeerIDs(t *testing.T) {
+	resp := &bittorrent.AnnounceResponse{
+		IPv4Peers: []bittorrent.Peer{{
+			ID:   bittorrent.PeerIDFromString("aaaaaaaaaaaaaaaaaaaa"),
+			IP:   bittorrent.IP{IP: net.IP{10, 0, 0, 1}, AddressFamily: bittorrent.IPv4},
+			Port: 1,
+		}},
+	}
+
+	r := httptest.NewRecorder()
+	require.Nil(t, WriteAnnounceResponse(r, resp))
+	require.Equal(t, "d8:completei0e10:incompletei0e8:intervali0e12:min intervali0e5:peersld2:ip8:10.0.0.17:peer id20:aaaaaaaaaaaaaaaaaaaa4:porti1eeee", r.Body.String())
+
+	resp.NoPeerID = true
+	r = httptest.NewRecorder()
+	require.Nil(t, WriteAnnounceResponse(r, resp))
+	require.Equal(t, "d8:completei0e10:incompletei0e8:intervali0e12:min intervali0e5:peersld2:ip8:10.0.0.14:porti1eeee", r.Body.String())
+}
+
+func TestWriteScrapeResponse(t *testing.T) {
+	a := bittorrent.InfoHashFromString("aaaaaaaaaaaaaaaaaaaa")
+	b := bittorrent.InfoHashFromString("bbbbbbbbbbbbbbbbbbbb")
+	resp := &bittorrent.ScrapeResponse{Files: []bittorrent.Scrape{
+		{InfoHash: b, Complete: 1},
+		{InfoHash: a, Incomplete: 2, Snatches: 3},
+		{InfoHash: b, Complete: 1},
+	}}
+
+	r := httptest.NewRecorder()
+	require.Nil(t, WriteScrapeResponse(r, resp))
+	require.Equal(t, "d5:filesd"+
+		"20:aaaaaaaaaaaaaaaaaaaad8:completei0e10:downloadedi3e10:incompletei2ee"+
+		"20:bbbbbbbbbbbbbbbbbbbbd8:completei1e10:downloadedi0e10:incompletei0ee"+
+		"ee", r.Body.String())
+
+	// The response itself is not reordered.
+	require.Equal(t, b, resp.Files[0].InfoHash)
+}
+
+func TestWriteScrapeResponseActivity(t *testing.T) {
+	a := bittorrent.InfoHashFromString("aaaaaaaaaaaaaaaaaaaa")
+	resp := &bittorrent.ScrapeResponse{Files: []bittorrent.Scrape{
+		{InfoHash: a, Complete: 1, Created: time.Unix(1000, 0), LastAnnounce: time.Unix(2000, 0)},
+	}}
+
+	r := httptest.NewRecorder()
+	require.Nil(t, WriteScrapeResponse(r, resp))
+	require.Equal(t, "d5:filesd"+
+		"20:aaaaaaaaaaaaaaaaaaaad8:completei1e7:createdi1000e10:downloadedi0e10:incompletei0e13:last_announcei2000ee"+
+		"ee", r.Body.String())
+}
+
+func TestWriteScrapeResponseMetadata(t *testing.T) {
+	a := bittorrent.InfoHashFromString("aaaaaaaaaaaaaaaaaaaa")
+	resp := &bittorrent.ScrapeResponse{
+		Files: []bittorrent.Scrape{
+			{InfoHash: a, Complete: 1, Incomplete: 2, Name: "ubuntu.iso", Downloaders: 1, HasDownloaders: true},
+		},
+		MinRequestInterval: 15 * time.Minute,
+	}
+
+	r := httptest.NewRecorder()
+	require.Nil(t, WriteScrapeResponse(r, resp))
+	require.Equal(t, "d5:filesd"+
+		"20:aaaaaaaaaaaaaaaaaaaad8:completei1e10:downloadedi0e11:downloadersi1e10:incompletei2e4:name10:ubuntu.isoe"+
+		"e5:flagsd20:min_request_intervali900eee", r.Body.String())
+}
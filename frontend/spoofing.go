@@ -0,0 +1,204 @@
+package frontend
+
+import (
+	"net"
+	"strings"
+
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/netutil"
+)
+
+// CIDRs is a list of IP networks that is configured as a list of strings in
+// CIDR notation.
+type CIDRs []*net.IPNet
+
+// UnmarshalYAML implements yaml.Unmarshaler, parsing the networks.
+func (c *CIDRs) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var strs []string
+	if err := unmarshal(&strs); err != nil {
+		return err
+	}
+
+	nets := make(CIDRs, 0, len(strs))
+	for _, s := range strs {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return err
+		}
+		nets = append(nets, n)
+	}
+	*c = nets
+	return nil
+}
+
+// MarshalYAML implements yaml.Marshaler.
+func (c CIDRs) MarshalYAML() (interface{}, error) {
+	strs := make([]string, 0, len(c))
+	for _, n := range c {
+		strs = append(strs, n.String())
+	}
+	return strs, nil
+}
+
+// Contains reports whether ip is part of any of the networks.
+func (c CIDRs) Contains(ip net.IP) bool {
+	for _, n := range c {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IPSpoofingPolicy determines whether the IP address a request asserts for a
+// client is used instead of the address the request was received from.
+//
+// It is shared by all frontends, so that a client can't pick a frontend with
+// a more permissive policy.
+type IPSpoofingPolicy struct {
+	// TrustedProxyCIDRs are the networks requests may assert client IPs
+	// from, usually the addresses of proxies in front of the tracker.
+	// If empty, requests from any address may assert client IPs.
+	TrustedProxyCIDRs CIDRs `yaml:"trusted_proxy_cidrs"`
+
+	// AllowIPv4 and AllowIPv6 allow asserting IPv4 and IPv6 addresses.
+	AllowIPv4 bool `yaml:"allow_ipv4"`
+	AllowIPv6 bool `yaml:"allow_ipv6"`
+
+	// RejectBogons rejects asserted addresses that are not publicly
+	// routable, such as private, loopback or documentation addresses.
+	RejectBogons bool `yaml:"reject_bogons"`
+}
+
+// LogFields renders the current policy as a set of Logrus fields.
+func (p IPSpoofingPolicy) LogFields() log.Fields {
+	return log.Fields{
+		"trustedProxyCIDRs": p.TrustedProxyCIDRs,
+		"allowIPv4":         p.AllowIPv4,
+		"allowIPv6":         p.AllowIPv6,
+		"rejectBogons":      p.RejectBogons,
+	}
+}
+
+// Enabled reports whether any client IPs may be asserted at all.
+func (p IPSpoofingPolicy) Enabled() bool {
+	return p.AllowIPv4 || p.AllowIPv6
+}
+
+// Trusts reports whether requests received from source may assert client
+// IPs.
+func (p IPSpoofingPolicy) Trusts(source net.IP) bool {
+	return len(p.TrustedProxyCIDRs) == 0 || p.TrustedProxyCIDRs.Contains(source)
+}
+
+// Allows reports whether a request received from source may assert the
+// client IP asserted.
+func (p IPSpoofingPolicy) Allows(source, asserted net.IP) bool {
+	if !p.Trusts(source) {
+		return false
+	}
+
+	switch netutil.FamilyOf(asserted) {
+	case netutil.IPv4:
+		if !p.AllowIPv4 {
+			return false
+		}
+	case netutil.IPv6:
+		if !p.AllowIPv6 {
+			return false
+		}
+	default:
+		return false
+	}
+
+	return !p.RejectBogons || !IsBogon(asserted)
+}
+
+// ForwardedIP returns the address of the client that a request received from
+// source was forwarded for, given the value of a header such as X-Real-IP or
+// X-Forwarded-For.
+//
+// The header lists the addresses the request was forwarded for, separated by
+// commas, where every proxy appends the address it received the request
+// from. The list is followed from the end for as long as the request was
+// received from a trusted proxy, so that clients can't pose as other clients
+// by sending the header themselves. The address the first proxy that is not
+// trusted was forwarded for is returned, or source, if it is not trusted.
+// It returns nil if the address reached is not a valid IP.
+func (p IPSpoofingPolicy) ForwardedIP(source net.IP, header string) net.IP {
+	hops := strings.Split(header, ",")
+	ip := source
+	for i := len(hops) - 1; i >= 0 && p.Trusts(ip); i-- {
+		ip = parseHop(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			return nil
+		}
+	}
+	return ip
+}
+
+// parseHop parses an address of a forwarding header, which some proxies
+// append with a port.
+func parseHop(s string) net.IP {
+	if ip := netutil.ParseIP(s); ip != nil {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil
+	}
+	return netutil.ParseIP(host)
+}
+
+// bogons are the networks that are not publicly routable, in addition to the
+// ones detected by the methods of net.IP.
+var bogons = mustParseCIDRs(
+	"0.0.0.0/8",
+	"100.64.0.0/10",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"240.0.0.0/4",
+	"64:ff9b:1::/48",
+	"100::/64",
+	"2001:db8::/32",
+	"fc00::/7",
+)
+
+// IsBogon reports whether ip is not a publicly routable address.
+func IsBogon(ip net.IP) bool {
+	return ip.IsUnspecified() ||
+		ip.IsLoopback() ||
+		ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.Equal(net.IPv4bcast) ||
+		isPrivate(ip) ||
+		bogons.Contains(ip)
+}
+
+// isPrivate reports whether ip is a private address as defined by RFC 1918.
+// The addresses of RFC 4193 are part of the bogons.
+func isPrivate(ip net.IP) bool {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return false
+	}
+	return ip4[0] == 10 ||
+		(ip4[0] == 172 && ip4[1]&0xf0 == 16) ||
+		(ip4[0] == 192 && ip4[1] == 168)
+}
+
+func mustParseCIDRs(strs ...string) CIDRs {
+	nets := make(CIDRs, 0, len(strs))
+	for _, s := range strs {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
@@ -0,0 +1,72 @@
+package frontend
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestIPSpoofingPolicy(t *testing.T) {
+	var p IPSpoofingPolicy
+	err := yaml.Unmarshal([]byte(`
+trusted_proxy_cidrs: ["10.0.0.0/8", "2001:db8::/32"]
+allow_ipv4: true
+reject_bogons: true
+`), &p)
+	require.Nil(t, err)
+
+	var table = []struct {
+		source, asserted string
+		expected         bool
+	}{
+		{"10.0.0.1", "198.51.99.1", true},
+		{"2001:db8::1", "198.51.99.1", true},
+		{"192.0.2.1", "198.51.99.1", false},
+		{"10.0.0.1", "2001:4860::1", false},
+		{"10.0.0.1", "192.168.0.1", false},
+		{"10.0.0.1", "100.64.0.1", false},
+		{"10.0.0.1", "127.0.0.1", false},
+		{"10.0.0.1", "0.0.0.0", false},
+		{"10.0.0.1", "not an ip", false},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.source+" asserting "+tt.asserted, func(t *testing.T) {
+			require.Equal(t, tt.expected, p.Allows(net.ParseIP(tt.source), net.ParseIP(tt.asserted)))
+		})
+	}
+
+	require.NotNil(t, yaml.Unmarshal([]byte(`trusted_proxy_cidrs: ["10.0.0.0/33"]`), &p))
+}
+
+func TestForwardedIP(t *testing.T) {
+	var p IPSpoofingPolicy
+	err := yaml.Unmarshal([]byte(`trusted_proxy_cidrs: ["10.0.0.0/8"]`), &p)
+	require.Nil(t, err)
+
+	var table = []struct {
+		source, header string
+		expected       string
+	}{
+		{"10.0.0.1", "198.51.100.1", "198.51.100.1"},
+		{"10.0.0.1", "198.51.100.1, 10.0.0.2", "198.51.100.1"},
+		// Addresses prepended by the client are ignored.
+		{"10.0.0.1", "192.0.2.1, 198.51.100.1, 10.0.0.2", "198.51.100.1"},
+		{"10.0.0.1", "198.51.100.1:1234", "198.51.100.1"},
+		{"10.0.0.1", "[2001:db8::1]:1234", "2001:db8::1"},
+		{"192.0.2.1", "198.51.100.1", "192.0.2.1"},
+		{"10.0.0.1", "10.0.0.2, 10.0.0.3", "10.0.0.2"},
+		{"10.0.0.1", "bogus", "<nil>"},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.source+" forwarding "+tt.header, func(t *testing.T) {
+			require.Equal(t, tt.expected, p.ForwardedIP(net.ParseIP(tt.source), tt.header).String())
+		})
+	}
+
+	// Without trusted proxies, the first address is used.
+	require.Equal(t, "192.0.2.1", IPSpoofingPolicy{}.ForwardedIP(net.ParseIP("10.0.0.1"), "192.0.2.1, 198.51.100.1").String())
+}
@@ -0,0 +1,90 @@
+package udp
+
+import (
+	"net"
+	"time"
+
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// The bounds of the delay between reads after temporary errors.
+const (
+	minReadBackoff = 5 * time.Millisecond
+	maxReadBackoff = time.Second
+)
+
+// readBackoff delays the reads of a socket after repeated temporary errors,
+// so that errors that persist, like running out of file descriptors, don't
+// make the read loop spin.
+//
+// The delay starts at minReadBackoff and doubles with every consecutive
+// error up to maxReadBackoff. The socket is considered degraded until a read
+// succeeds again.
+type readBackoff struct {
+	socket *net.UDPConn
+	delay  time.Duration
+	errors int
+}
+
+// next returns the delay before the next read after another temporary error.
+func (b *readBackoff) next() time.Duration {
+	b.errors++
+	switch {
+	case b.delay == 0:
+		b.delay = minReadBackoff
+	case b.delay < maxReadBackoff/2:
+		b.delay *= 2
+	default:
+		b.delay = maxReadBackoff
+	}
+	return b.delay
+}
+
+// waitAfterReadError waits before the next read after the temporary error err. It returns
+// false if the Frontend was stopped while waiting.
+func (t *Frontend) waitAfterReadError(b *readBackoff, err error) bool {
+	// Stopping the Frontend interrupts reads with a timeout, which is not
+	// an error worth backing off for.
+	select {
+	case <-t.closing:
+		if b.delay != 0 {
+			recordDegradedSocket(false)
+		}
+		return false
+	default:
+	}
+
+	if b.delay == 0 {
+		recordDegradedSocket(true)
+	}
+	delay := b.next()
+	recordTemporaryReadError()
+	logger.Warn("reading from udp socket failed temporarily, backing off", log.Fields{
+		"addr":   b.socket.LocalAddr(),
+		"error":  err,
+		"errors": b.errors,
+		"delay":  delay,
+	})
+
+	select {
+	case <-t.closing:
+		recordDegradedSocket(false)
+		return false
+	case <-time.After(delay):
+		return true
+	}
+}
+
+// recovered records a successful read, which ends a series of temporary
+// errors.
+func (b *readBackoff) recovered() {
+	if b.delay == 0 {
+		return
+	}
+	recordDegradedSocket(false)
+	logger.Info("reading from udp socket recovered", log.Fields{
+		"addr":   b.socket.LocalAddr(),
+		"errors": b.errors,
+	})
+	b.delay, b.errors = 0, 0
+}
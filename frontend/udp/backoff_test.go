@@ -0,0 +1,37 @@
+package udp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadBackoff(t *testing.T) {
+	var b readBackoff
+	require.Equal(t, minReadBackoff, b.next())
+	require.Equal(t, 2*minReadBackoff, b.next())
+	require.Equal(t, 4*minReadBackoff, b.next())
+
+	for i := 0; i < 20; i++ {
+		b.next()
+	}
+	require.Equal(t, maxReadBackoff, b.delay)
+	require.Equal(t, 23, b.errors)
+}
+
+func TestReadBackoffStops(t *testing.T) {
+	socket, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.Nil(t, err)
+	defer socket.Close()
+
+	f := &Frontend{closing: make(chan struct{})}
+	b := readBackoff{socket: socket}
+
+	close(f.closing)
+	start := time.Now()
+	require.False(t, f.waitAfterReadError(&b, errBadConnectionID))
+	require.True(t, time.Since(start) < minReadBackoff)
+	require.Equal(t, 0, b.errors)
+}
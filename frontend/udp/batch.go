@@ -0,0 +1,169 @@
+package udp
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+// outgoing is a response waiting to be written in a batch or by a sender.
+type outgoing struct {
+	buffer *[]byte
+	addr   *net.UDPAddr
+
+	// queued is the time the response was queued. It is only set if request
+	// timing is enabled.
+	queued time.Time
+}
+
+// serveBatches is like serve, but reads up to BatchSize packets with a single
+// system call.
+//
+// Responses to the packets read are sent to out.
+func (t *Frontend) serveBatches(socket *net.UDPConn, out chan<- outgoing) error {
+	pc := ipv4.NewPacketConn(socket)
+	msgs := make([]ipv4.Message, t.BatchSize)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{make([]byte, maxPacketSize)}
+	}
+	backoff := readBackoff{socket: socket}
+
+	for {
+		// Check to see if we need to shutdown.
+		select {
+		case <-t.closing:
+			logger.Debug("serveBatches() received shutdown signal")
+			return nil
+		default:
+		}
+
+		n, err := pc.ReadBatch(msgs, 0)
+		if err != nil {
+			if t.RecvErr && isICMPError(err) {
+				recordICMPError(writeErrorType(err))
+				continue
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				// A temporary failure is not fatal, but it is retried
+				// after a delay in case it persists.
+				if !t.waitAfterReadError(&backoff, err) {
+					return nil
+				}
+				continue
+			}
+			return err
+		}
+		backoff.recovered()
+
+		for i := 0; i < n; i++ {
+			// We got nothin'
+			if msgs[i].N == 0 {
+				continue
+			}
+
+			addr, ok := msgs[i].Addr.(*net.UDPAddr)
+			if !ok {
+				continue
+			}
+
+			t.enqueue(msgs[i].Buffers[0][:msgs[i].N], addr, socket, out)
+		}
+	}
+}
+
+// writeBatches writes the responses sent to out until out is closed or the
+// Frontend abandons in-flight requests.
+//
+// All responses that are pending when a batch is written, up to BatchSize, are
+// written with a single system call.
+func (t *Frontend) writeBatches(socket *net.UDPConn, out <-chan outgoing) {
+	defer t.sendWG.Done()
+
+	pc := ipv4.NewPacketConn(socket)
+	msgs := make([]ipv4.Message, t.BatchSize)
+	for i := range msgs {
+		msgs[i].Buffers = make([][]byte, 1)
+	}
+
+	// pending holds the buffers of msgs, which are returned to the pool once
+	// they have been written.
+	pending := make([]*[]byte, t.BatchSize)
+
+	for {
+		var o outgoing
+		var ok bool
+		select {
+		case o, ok = <-out:
+			if !ok {
+				return
+			}
+		case <-t.ctx.Done():
+			// Responses of abandoned requests are discarded.
+			return
+		}
+		msgs[0].Buffers[0], msgs[0].Addr = *o.buffer, o.addr
+		pending[0] = o.buffer
+		recordQueued(o)
+		n := 1
+
+	collect:
+		for n < len(msgs) {
+			select {
+			case o, ok := <-out:
+				if !ok {
+					break collect
+				}
+				msgs[n].Buffers[0], msgs[n].Addr = *o.buffer, o.addr
+				pending[n] = o.buffer
+				recordQueued(o)
+				n++
+			default:
+				break collect
+			}
+		}
+
+		var start time.Time
+		if t.EnableRequestTiming {
+			start = time.Now()
+		}
+		retried := false
+		for written := 0; written < n; {
+			w, err := pc.WriteBatch(msgs[written:n], 0)
+			if err != nil {
+				// The first message could not be written. If there was
+				// no buffer space, it is retried once if enabled.
+				if t.RetryWrites && !retried && isRetriable(err) {
+					retried = true
+					continue
+				}
+				if retried {
+					recordWriteRetry(false)
+					retried = false
+				}
+
+				// If it was too large for the path MTU, the rest is
+				// written anyway.
+				writeFailed(err, msgs[written].Addr.(*net.UDPAddr), t.pathMTUs)
+				if t.pathMTUs != nil && isMessageTooLong(err) {
+					written++
+					continue
+				}
+				break
+			}
+			if retried {
+				recordWriteRetry(true)
+				retried = false
+			}
+			written += w
+		}
+		if !start.IsZero() {
+			recordStageDuration(stageWrite, time.Since(start))
+		}
+
+		for i := 0; i < n; i++ {
+			buffers.Put(pending[i])
+			msgs[i].Buffers[0], msgs[i].Addr, pending[i] = nil, nil, nil
+		}
+	}
+}
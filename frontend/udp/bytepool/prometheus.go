@@ -0,0 +1,30 @@
+package bytepool
+
+import "github.com/prometheus/client_golang/prometheus"
+
+func init() {
+	prometheus.MustRegister(
+		promGetsTotal,
+		promAllocationsTotal,
+	)
+}
+
+// sizeClassOversized is the size class label of byte slices exceeding the
+// largest size class of a SizedPool.
+const sizeClassOversized = "oversized"
+
+var promGetsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "chihaya_bytepool_gets_total",
+		Help: "The number of byte slices taken from a pool, by size class",
+	},
+	[]string{"pool", "size_class"},
+)
+
+var promAllocationsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "chihaya_bytepool_allocations_total",
+		Help: "The number of byte slices allocated because a pool was empty, by size class",
+	},
+	[]string{"pool", "size_class"},
+)
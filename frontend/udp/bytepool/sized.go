@@ -0,0 +1,95 @@
+package bytepool
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SizedPool is a cached pool of reusable byte slices of several size classes.
+//
+// Byte slices are taken from the smallest size class that fits the requested
+// size, so that buffers of very different sizes can be pooled without
+// wasting memory on small ones.
+//
+// Pointers to byte slices are pooled, so that returning them doesn't
+// allocate.
+type SizedPool struct {
+	sizes []int
+	pools []*sync.Pool
+
+	gets      []prometheus.Counter
+	oversized prometheus.Counter
+}
+
+// NewSized allocates a new SizedPool with the given size classes.
+// The name identifies the pool in metrics.
+func NewSized(name string, sizes ...int) *SizedPool {
+	if len(sizes) == 0 {
+		panic("bytepool: no size classes")
+	}
+
+	sizes = append([]int{}, sizes...)
+	sort.Ints(sizes)
+
+	sp := &SizedPool{
+		sizes:     sizes,
+		oversized: promGetsTotal.WithLabelValues(name, sizeClassOversized),
+	}
+	for _, size := range sizes {
+		size := size
+		class := strconv.Itoa(size)
+		allocations := promAllocationsTotal.WithLabelValues(name, class)
+
+		sp.pools = append(sp.pools, &sync.Pool{
+			New: func() interface{} {
+				allocations.Inc()
+				b := make([]byte, size)
+				return &b
+			},
+		})
+		sp.gets = append(sp.gets, promGetsTotal.WithLabelValues(name, class))
+	}
+
+	return sp
+}
+
+// Get returns a byte slice of the given length from the smallest size class
+// that fits it.
+// If the length exceeds the largest size class, a new byte slice is
+// allocated.
+func (sp *SizedPool) Get(length int) *[]byte {
+	i := sort.SearchInts(sp.sizes, length)
+	if i == len(sp.sizes) {
+		sp.oversized.Inc()
+		b := make([]byte, length)
+		return &b
+	}
+
+	sp.gets[i].Inc()
+	bp := sp.pools[i].Get().(*[]byte)
+	*bp = (*bp)[:length]
+	return bp
+}
+
+// Put returns a byte slice to the largest size class not exceeding its
+// capacity. Byte slices smaller than the smallest size class are discarded.
+//
+// The byte slice may have been replaced by a grown one since it was taken
+// from the pool.
+func (sp *SizedPool) Put(bp *[]byte) {
+	i := sort.SearchInts(sp.sizes, cap(*bp)+1) - 1
+	if i < 0 {
+		return
+	}
+
+	b := (*bp)[:cap(*bp)]
+	// Zero out the bytes.
+	for j := range b {
+		b[j] = 0
+	}
+	*bp = b
+	sp.pools[i].Put(bp)
+}
@@ -0,0 +1,57 @@
+package bytepool
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSizedPool(t *testing.T) {
+	sp := NewSized("test", 2048, 512, 8192)
+
+	var table = []struct {
+		length   int
+		capacity int
+	}{
+		{0, 512},
+		{100, 512},
+		{512, 512},
+		{513, 2048},
+		{8192, 8192},
+		{8193, 8193},
+	}
+
+	for _, tt := range table {
+		bp := sp.Get(tt.length)
+		require.Len(t, *bp, tt.length)
+		require.Equal(t, tt.capacity, cap(*bp))
+		sp.Put(bp)
+	}
+}
+
+func TestSizedPoolPut(t *testing.T) {
+	sp := NewSized("test", 512, 2048)
+
+	// Byte slices are zeroed and returned to the largest class they fit.
+	bp := sp.Get(10)
+	copy(*bp, "0123456789")
+	*bp = append(*bp, make([]byte, 1000)...)
+	require.True(t, cap(*bp) >= 512 && cap(*bp) < 2048)
+	sp.Put(bp)
+
+	bp = sp.Get(10)
+	require.Equal(t, make([]byte, 10), *bp)
+
+	// Byte slices smaller than all classes are discarded.
+	b := make([]byte, 100)
+	sp.Put(&b)
+}
+
+func BenchmarkSizedPool(b *testing.B) {
+	sp := NewSized("test", 512, 2048, 8192)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		sp.Put(sp.Get(100))
+	}
+}
@@ -3,11 +3,14 @@ package udp
 import (
 	"crypto/hmac"
 	"encoding/binary"
+	"errors"
 	"hash"
 	"net"
 	"time"
 
+	"github.com/dchest/siphash"
 	sha256 "github.com/minio/sha256-simd"
+	"lukechampine.com/blake3"
 
 	"github.com/chihaya/chihaya/pkg/log"
 )
@@ -30,15 +33,74 @@ func ValidConnectionID(connectionID []byte, ip net.IP, now time.Time, maxClockSk
 	return NewConnectionIDGenerator(key).Validate(connectionID, ip, now, maxClockSkew)
 }
 
+// The algorithms connection IDs can be generated with.
+const (
+	// ConnectionIDAlgorithmSHA256 is HMAC-SHA-256 with the key. It is the
+	// default, since it is the algorithm used before others were added.
+	ConnectionIDAlgorithmSHA256 = "sha256"
+
+	// ConnectionIDAlgorithmSipHash is SipHash-2-4 keyed with the first 16
+	// bytes of the SHA-256 hash of the key.
+	ConnectionIDAlgorithmSipHash = "siphash"
+
+	// ConnectionIDAlgorithmBLAKE3 is BLAKE3 keyed with the SHA-256 hash of
+	// the key.
+	ConnectionIDAlgorithmBLAKE3 = "blake3"
+)
+
+// ErrUnknownConnectionIDAlgorithm is returned by
+// NewConnectionIDGeneratorWithAlgorithm for algorithms that don't exist.
+var ErrUnknownConnectionIDAlgorithm = errors.New("unknown connection ID algorithm")
+
 // A ConnectionIDGenerator is a reusable generator and validator for connection
 // IDs as described in BEP 15.
 // It is not thread safe, but is safe to be pooled and reused by other
 // goroutines. It manages its state itself, so it can be taken from and returned
 // to a pool without any cleanup.
+type ConnectionIDGenerator interface {
+	// Generate generates an 8-byte connection ID for the given IP and the
+	// current time.
+	//
+	// The returned slice is owned by the generator. It must not be
+	// referenced after returning the generator to a pool and is
+	// overwritten by subsequent calls to Generate.
+	Generate(ip net.IP, now time.Time) []byte
+
+	// Validate validates the given connection ID for an IP and the current
+	// time.
+	Validate(connectionID []byte, ip net.IP, now time.Time, maxClockSkew time.Duration) bool
+}
+
+// NewConnectionIDGenerator creates a new connection ID generator using
+// ConnectionIDAlgorithmSHA256.
+func NewConnectionIDGenerator(key string) ConnectionIDGenerator {
+	return newMACGenerator(hmac.New(sha256.New, []byte(key)))
+}
+
+// NewConnectionIDGeneratorWithAlgorithm creates a new connection ID generator
+// using the given algorithm, one of the ConnectionIDAlgorithm constants.
+func NewConnectionIDGeneratorWithAlgorithm(algorithm, key string) (ConnectionIDGenerator, error) {
+	if algorithm == ConnectionIDAlgorithmSHA256 {
+		return NewConnectionIDGenerator(key), nil
+	}
+
+	// The other hashes take keys of a fixed size.
+	derived := sha256.Sum256([]byte(key))
+	switch algorithm {
+	case ConnectionIDAlgorithmSipHash:
+		return newMACGenerator(siphash.New(derived[:16])), nil
+	case ConnectionIDAlgorithmBLAKE3:
+		return newMACGenerator(blake3.New(8, derived[:])), nil
+	default:
+		return nil, ErrUnknownConnectionIDAlgorithm
+	}
+}
+
+// macGenerator is a ConnectionIDGenerator using a keyed hash.
 // After initial creation, it can generate connection IDs without allocating.
 // See Generate and Validate for usage notes and guarantees.
-type ConnectionIDGenerator struct {
-	// mac is a keyed HMAC that can be reused for subsequent connection ID
+type macGenerator struct {
+	// mac is a keyed hash that can be reused for subsequent connection ID
 	// generations.
 	mac hash.Hash
 
@@ -49,14 +111,13 @@ type ConnectionIDGenerator struct {
 	connID []byte
 
 	// scratch is a 32-byte slice that is used as a scratchpad for the generated
-	// HMACs.
+	// hashes.
 	scratch []byte
 }
 
-// NewConnectionIDGenerator creates a new connection ID generator.
-func NewConnectionIDGenerator(key string) *ConnectionIDGenerator {
-	return &ConnectionIDGenerator{
-		mac:     hmac.New(sha256.New, []byte(key)),
+func newMACGenerator(mac hash.Hash) *macGenerator {
+	return &macGenerator{
+		mac:     mac,
 		connID:  make([]byte, 8),
 		scratch: make([]byte, 32),
 	}
@@ -65,7 +126,7 @@ func NewConnectionIDGenerator(key string) *ConnectionIDGenerator {
 // reset resets the generator.
 // This is called by other methods of the generator, it's not necessary to call
 // it after getting a generator from a pool.
-func (g *ConnectionIDGenerator) reset() {
+func (g *macGenerator) reset() {
 	g.mac.Reset()
 	g.connID = g.connID[:8]
 	g.scratch = g.scratch[:0]
@@ -75,17 +136,17 @@ func (g *ConnectionIDGenerator) reset() {
 // given IP and the current time.
 //
 // The first 4 bytes of the connection identifier is a unix timestamp and the
-// last 4 bytes are a truncated HMAC token created from the aforementioned
+// last 4 bytes are a truncated keyed hash created from the aforementioned
 // unix timestamp and the source IP address of the UDP packet.
 //
-// Truncated HMAC is known to be safe for 2^(-n) where n is the size in bits
-// of the truncated HMAC token. In this use case we have 32 bits, thus a
+// A truncated MAC is known to be safe for 2^(-n) where n is the size in bits
+// of the truncated token. In this use case we have 32 bits, thus a
 // forgery probability of approximately 1 in 4 billion.
 //
 // The generated ID is written to g.connID, which is also returned. g.connID
 // will be reused, so it must not be referenced after returning the generator
 // to a pool and will be overwritten be subsequent calls to Generate!
-func (g *ConnectionIDGenerator) Generate(ip net.IP, now time.Time) []byte {
+func (g *macGenerator) Generate(ip net.IP, now time.Time) []byte {
 	g.reset()
 
 	binary.BigEndian.PutUint32(g.connID, uint32(now.Unix()))
@@ -95,15 +156,14 @@ func (g *ConnectionIDGenerator) Generate(ip net.IP, now time.Time) []byte {
 	g.scratch = g.mac.Sum(g.scratch)
 	copy(g.connID[4:8], g.scratch[:4])
 
-	log.Debug("generated connection ID", log.Fields{"ip": ip, "now": now, "connID": g.connID})
+	logger.Debug("generated connection ID", log.Fields{"ip": ip, "now": now, "connID": g.connID})
 	return g.connID
 }
 
 // Validate validates the given connection ID for an IP and the current time.
-func (g *ConnectionIDGenerator) Validate(connectionID []byte, ip net.IP, now time.Time, maxClockSkew time.Duration) bool {
-	ts := time.Unix(int64(binary.BigEndian.Uint32(connectionID[:4])), 0)
-	log.Debug("validating connection ID", log.Fields{"connID": connectionID, "ip": ip, "ts": ts, "now": now})
-	if now.After(ts.Add(ttl)) || ts.After(now.Add(maxClockSkew)) {
+func (g *macGenerator) Validate(connectionID []byte, ip net.IP, now time.Time, maxClockSkew time.Duration) bool {
+	logger.Debug("validating connection ID", log.Fields{"connID": connectionID, "ip": ip, "now": now})
+	if connectionIDExpired(connectionID, now, maxClockSkew) {
 		return false
 	}
 
@@ -114,3 +174,10 @@ func (g *ConnectionIDGenerator) Validate(connectionID []byte, ip net.IP, now tim
 	g.scratch = g.mac.Sum(g.scratch)
 	return hmac.Equal(g.scratch[:4], connectionID[4:])
 }
+
+// connectionIDExpired determines whether the timestamp of a connection ID is
+// older than its lifetime or further in the future than maxClockSkew.
+func connectionIDExpired(connectionID []byte, now time.Time, maxClockSkew time.Duration) bool {
+	ts := time.Unix(int64(binary.BigEndian.Uint32(connectionID[:4])), 0)
+	return now.After(ts.Add(ttl)) || ts.After(now.Add(maxClockSkew))
+}
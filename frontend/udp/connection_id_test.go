@@ -98,6 +98,46 @@ func TestReuseGeneratorValidate(t *testing.T) {
 	}
 }
 
+var algorithms = []string{
+	ConnectionIDAlgorithmSHA256,
+	ConnectionIDAlgorithmSipHash,
+	ConnectionIDAlgorithmBLAKE3,
+}
+
+func TestConnectionIDAlgorithms(t *testing.T) {
+	ip := net.ParseIP("127.0.0.1")
+	now := time.Unix(1234, 0)
+	key := "some random string that is hopefully at least this long"
+
+	connIDs := make(map[string]string)
+	for _, algorithm := range algorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			gen, err := NewConnectionIDGeneratorWithAlgorithm(algorithm, key)
+			require.Nil(t, err)
+			cid := append([]byte{}, gen.Generate(ip, now)...)
+			require.Len(t, cid, 8)
+			connIDs[algorithm] = string(cid)
+
+			require.True(t, gen.Validate(cid, ip, now, time.Minute))
+			require.False(t, gen.Validate(cid, net.ParseIP("127.0.0.2"), now, time.Minute))
+			require.False(t, gen.Validate(cid, ip, now.Add(ttl+time.Second), time.Minute))
+
+			other, err := NewConnectionIDGeneratorWithAlgorithm(algorithm, key+"!")
+			require.Nil(t, err)
+			require.False(t, other.Validate(cid, ip, now, time.Minute))
+		})
+	}
+
+	// The default algorithm is compatible with connection IDs generated
+	// before algorithms could be chosen.
+	require.Equal(t, string(simpleNewConnectionID(ip, now, key)), connIDs[ConnectionIDAlgorithmSHA256])
+	require.NotEqual(t, connIDs[ConnectionIDAlgorithmSHA256], connIDs[ConnectionIDAlgorithmSipHash])
+	require.NotEqual(t, connIDs[ConnectionIDAlgorithmSHA256], connIDs[ConnectionIDAlgorithmBLAKE3])
+
+	_, err := NewConnectionIDGeneratorWithAlgorithm("md5", key)
+	require.Equal(t, ErrUnknownConnectionIDAlgorithm, err)
+}
+
 func BenchmarkSimpleNewConnectionID(b *testing.B) {
 	ip := net.ParseIP("127.0.0.1")
 	key := "some random string that is hopefully at least this long"
@@ -146,7 +186,7 @@ func BenchmarkConnectionIDGenerator_Generate(b *testing.B) {
 	b.RunParallel(func(pb *testing.PB) {
 		sum := int64(0)
 		for pb.Next() {
-			gen := pool.Get().(*ConnectionIDGenerator)
+			gen := pool.Get().(ConnectionIDGenerator)
 			cid := gen.Generate(ip, createdAt)
 			sum += int64(cid[7])
 			pool.Put(gen)
@@ -183,7 +223,7 @@ func BenchmarkConnectionIDGenerator_Validate(b *testing.B) {
 
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
-			gen := pool.Get().(*ConnectionIDGenerator)
+			gen := pool.Get().(ConnectionIDGenerator)
 			if !gen.Validate(cid, ip, createdAt, 10*time.Second) {
 				b.FailNow()
 			}
@@ -191,3 +231,39 @@ func BenchmarkConnectionIDGenerator_Validate(b *testing.B) {
 		}
 	})
 }
+
+func BenchmarkConnectionIDAlgorithms(b *testing.B) {
+	ip := net.ParseIP("127.0.0.1")
+	key := "some random string that is hopefully at least this long"
+	createdAt := time.Now()
+
+	for _, algorithm := range algorithms {
+		pool := newGeneratorPool(algorithm, key)
+		gen := pool.Get().(ConnectionIDGenerator)
+		cid := append([]byte{}, gen.Generate(ip, createdAt)...)
+		pool.Put(gen)
+
+		b.Run(algorithm+"/generate", func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				sum := int64(0)
+				for pb.Next() {
+					gen := pool.Get().(ConnectionIDGenerator)
+					sum += int64(gen.Generate(ip, createdAt)[7])
+					pool.Put(gen)
+				}
+				_ = sum
+			})
+		})
+		b.Run(algorithm+"/validate", func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					gen := pool.Get().(ConnectionIDGenerator)
+					if !gen.Validate(cid, ip, createdAt, 10*time.Second) {
+						b.FailNow()
+					}
+					pool.Put(gen)
+				}
+			})
+		})
+	}
+}
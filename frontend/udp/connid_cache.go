@@ -0,0 +1,142 @@
+package udp
+
+import (
+	"container/list"
+	"encoding/binary"
+	"net"
+	"sync"
+)
+
+// connIDCache holds the connection IDs recently issued to or validated for
+// clients, so that repeated announces don't have to compute the HMACs of
+// their connection IDs again.
+//
+// Only the most recently used connection IDs are kept. Each one remembers the
+// pool of the key it was generated with, so that it stops being accepted once
+// that key is retired, just like an uncached connection ID.
+//
+// The cache is split into stripes, each with its own lock and LRU list, so
+// that the workers handling announces don't all contend for one lock. A
+// connection ID is evicted when it is the least recently used one of its
+// stripe.
+type connIDCache struct {
+	stripes []connIDCacheStripe
+}
+
+// connIDCacheStripes is the maximum number of stripes of a connIDCache.
+const connIDCacheStripes = 64
+
+// connIDCacheStripe is a part of a connIDCache.
+type connIDCacheStripe struct {
+	size int
+
+	mu  sync.Mutex
+	ids map[connIDCacheKey]*list.Element
+	lru *list.List
+
+	// Pad the stripes to separate cache lines, so that locking one doesn't
+	// slow down the others.
+	_ [64]byte
+}
+
+// connIDCacheKey identifies a connection ID issued to an IP address. It is a
+// fixed-size array, so that looking it up doesn't allocate.
+type connIDCacheKey [8 + net.IPv6len]byte
+
+// cachedConnID is a connection ID in a connIDCache.
+type cachedConnID struct {
+	key  connIDCacheKey
+	pool *sync.Pool
+}
+
+// newConnIDCache creates a connIDCache for up to size connection IDs.
+func newConnIDCache(size int) *connIDCache {
+	n := connIDCacheStripes
+	if size < n {
+		n = size
+	}
+
+	c := &connIDCache{stripes: make([]connIDCacheStripe, n)}
+	for i := range c.stripes {
+		// The first stripes hold the remainder of the size.
+		stripeSize := size / n
+		if i < size%n {
+			stripeSize++
+		}
+		c.stripes[i] = connIDCacheStripe{
+			size: stripeSize,
+			ids:  make(map[connIDCacheKey]*list.Element, stripeSize),
+			lru:  list.New(),
+		}
+	}
+	return c
+}
+
+// stripe returns the stripe holding key. Stripes are chosen by the token of
+// the connection ID, which is distributed uniformly.
+func (c *connIDCache) stripe(key *connIDCacheKey) *connIDCacheStripe {
+	return &c.stripes[binary.BigEndian.Uint32(key[4:8])%uint32(len(c.stripes))]
+}
+
+// len returns the number of connection IDs in the cache.
+func (c *connIDCache) len() (n int) {
+	for i := range c.stripes {
+		s := &c.stripes[i]
+		s.mu.Lock()
+		n += len(s.ids)
+		s.mu.Unlock()
+	}
+	return
+}
+
+func makeConnIDCacheKey(connID []byte, ip net.IP) (key connIDCacheKey) {
+	copy(key[:8], connID)
+	copy(key[8:], ip.To16())
+	return
+}
+
+// contains determines whether connID was issued to ip with one of the keys of
+// kr. It doesn't check whether the connection ID expired.
+func (c *connIDCache) contains(connID []byte, ip net.IP, kr *keyring) bool {
+	key := makeConnIDCacheKey(connID, ip)
+	s := c.stripe(&key)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.ids[key]
+	if !ok {
+		return false
+	}
+	if pool := e.Value.(*cachedConnID).pool; pool != kr.current && pool != kr.previous {
+		// The key was retired, so the connection ID will never be valid
+		// again.
+		s.lru.Remove(e)
+		delete(s.ids, key)
+		return false
+	}
+	s.lru.MoveToFront(e)
+	return true
+}
+
+// add records that connID was issued to ip with the key of pool.
+func (c *connIDCache) add(connID []byte, ip net.IP, pool *sync.Pool) {
+	key := makeConnIDCacheKey(connID, ip)
+	s := c.stripe(&key)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.ids[key]; ok {
+		s.lru.MoveToFront(e)
+		e.Value.(*cachedConnID).pool = pool
+		return
+	}
+
+	if s.lru.Len() >= s.size {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.ids, oldest.Value.(*cachedConnID).key)
+	}
+	s.ids[key] = s.lru.PushFront(&cachedConnID{key: key, pool: pool})
+}
@@ -6,46 +6,156 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"math"
 	"math/rand"
 	"net"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/chihaya/chihaya/bittorrent"
 	"github.com/chihaya/chihaya/frontend"
 	"github.com/chihaya/chihaya/frontend/udp/bytepool"
+	"github.com/chihaya/chihaya/internal/cpus"
+	"github.com/chihaya/chihaya/internal/handoff"
+	"github.com/chihaya/chihaya/internal/systemd"
+	"github.com/chihaya/chihaya/pkg/accesslog"
+	"github.com/chihaya/chihaya/pkg/clock"
 	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/netutil"
+	"github.com/chihaya/chihaya/pkg/ratelimit"
 	"github.com/chihaya/chihaya/pkg/stop"
-	"github.com/chihaya/chihaya/pkg/timecache"
 )
 
+// logger is used for all messages logged while serving requests.
+var logger = log.Component("udp")
+
 var allowedGeneratedPrivateKeyRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890")
 
 // Config represents all of the configurable options for a UDP BitTorrent
 // Tracker.
 type Config struct {
-	Addr                string        `yaml:"addr"`
-	PrivateKey          string        `yaml:"private_key"`
-	MaxClockSkew        time.Duration `yaml:"max_clock_skew"`
-	EnableRequestTiming bool          `yaml:"enable_request_timing"`
-	ParseOptions        `yaml:",inline"`
+	Addr                  string        `yaml:"addr"`
+	Addr6                 string        `yaml:"addr6"`
+	PrivateKey            string        `yaml:"private_key"`
+	MaxClockSkew          time.Duration `yaml:"max_clock_skew"`
+	KeyRotationInterval   time.Duration `yaml:"key_rotation_interval"`
+	ConnectionIDAlgorithm string        `yaml:"connection_id_algorithm"`
+	ConnectionIDCacheSize int           `yaml:"connection_id_cache_size"`
+	EnableRequestTiming   bool          `yaml:"enable_request_timing"`
+	NumListeners          int           `yaml:"num_listeners"`
+	BatchSize             int           `yaml:"batch_size"`
+	Workers               int           `yaml:"workers"`
+	WorkersPerCPU         int           `yaml:"workers_per_cpu"`
+	LockListenerThreads   bool          `yaml:"lock_listener_threads"`
+	QueueSize             int           `yaml:"queue_size"`
+	Senders               int           `yaml:"senders"`
+	SendQueueSize         int           `yaml:"send_queue_size"`
+	RetryWrites           bool          `yaml:"retry_writes"`
+	SocketStatsInterval   time.Duration `yaml:"socket_stats_interval"`
+	ReadBufferSize        int           `yaml:"read_buffer_size"`
+	MaxReadBufferSize     int           `yaml:"max_read_buffer_size"`
+	WriteBufferSize       int           `yaml:"write_buffer_size"`
+	TOS                   int           `yaml:"tos"`
+	RecvErr               bool          `yaml:"recv_err"`
+	RateLimit             float64       `yaml:"rate_limit"`
+	RateLimitBurst        int           `yaml:"rate_limit_burst"`
+	RateLimitCacheSize    int           `yaml:"rate_limit_cache_size"`
+	MaxResponseSize       int           `yaml:"max_response_size"`
+	MaxResponseSizeIPv6   int           `yaml:"max_response_size_ipv6"`
+	MaxResponseFactor     float64       `yaml:"max_response_factor"`
+	MTU                   int           `yaml:"mtu"`
+	PathMTUDiscovery      bool          `yaml:"path_mtu_discovery"`
+	PathMTUCacheSize      int           `yaml:"path_mtu_cache_size"`
+	EnableAccessLog       bool          `yaml:"enable_access_log"`
+	AccessLogPath         string        `yaml:"access_log_path"`
+	AccessLogFormat       string        `yaml:"access_log_format"`
+	DrainTimeout          time.Duration `yaml:"drain_timeout"`
+	RequestTimeout        time.Duration `yaml:"request_timeout"`
+	MaxResponsePeers      int           `yaml:"max_response_peers"`
+	ParseOptions          `yaml:",inline"`
+
+	// Clock is used to generate and validate connection IDs, to rate limit
+	// and to schedule key rotations. It defaults to clock.Cached and is
+	// replaced in tests.
+	Clock clock.Clock `yaml:"-"`
 }
 
 // LogFields renders the current config as a set of Logrus fields.
 func (cfg Config) LogFields() log.Fields {
 	return log.Fields{
-		"addr":                cfg.Addr,
-		"privateKey":          cfg.PrivateKey,
-		"maxClockSkew":        cfg.MaxClockSkew,
-		"enableRequestTiming": cfg.EnableRequestTiming,
-		"allowIPSpoofing":     cfg.AllowIPSpoofing,
-		"maxNumWant":          cfg.MaxNumWant,
-		"defaultNumWant":      cfg.DefaultNumWant,
-		"maxScrapeInfoHashes": cfg.MaxScrapeInfoHashes,
+		"addr":                  cfg.Addr,
+		"addr6":                 cfg.Addr6,
+		"privateKey":            cfg.PrivateKey,
+		"maxClockSkew":          cfg.MaxClockSkew,
+		"keyRotationInterval":   cfg.KeyRotationInterval,
+		"connectionIDAlgorithm": cfg.ConnectionIDAlgorithm,
+		"connectionIDCacheSize": cfg.ConnectionIDCacheSize,
+		"enableRequestTiming":   cfg.EnableRequestTiming,
+		"numListeners":          cfg.NumListeners,
+		"batchSize":             cfg.BatchSize,
+		"workers":               cfg.Workers,
+		"workersPerCPU":         cfg.WorkersPerCPU,
+		"lockListenerThreads":   cfg.LockListenerThreads,
+		"queueSize":             cfg.QueueSize,
+		"senders":               cfg.Senders,
+		"sendQueueSize":         cfg.SendQueueSize,
+		"retryWrites":           cfg.RetryWrites,
+		"socketStatsInterval":   cfg.SocketStatsInterval,
+		"readBufferSize":        cfg.ReadBufferSize,
+		"maxReadBufferSize":     cfg.MaxReadBufferSize,
+		"writeBufferSize":       cfg.WriteBufferSize,
+		"tos":                   cfg.TOS,
+		"recvErr":               cfg.RecvErr,
+		"rateLimit":             cfg.RateLimit,
+		"rateLimitBurst":        cfg.RateLimitBurst,
+		"rateLimitCacheSize":    cfg.RateLimitCacheSize,
+		"maxResponseSize":       cfg.MaxResponseSize,
+		"maxResponseSizeIPv6":   cfg.MaxResponseSizeIPv6,
+		"maxResponseFactor":     cfg.MaxResponseFactor,
+		"mtu":                   cfg.MTU,
+		"pathMTUDiscovery":      cfg.PathMTUDiscovery,
+		"pathMTUCacheSize":      cfg.PathMTUCacheSize,
+		"enableAccessLog":       cfg.EnableAccessLog,
+		"accessLogPath":         cfg.AccessLogPath,
+		"accessLogFormat":       cfg.AccessLogFormat,
+		"drainTimeout":          cfg.DrainTimeout,
+		"requestTimeout":        cfg.RequestTimeout,
+		"maxResponsePeers":      cfg.MaxResponsePeers,
+		"ipSpoofing":            cfg.IPSpoofing.LogFields(),
+		"maxNumWant":            cfg.MaxNumWant,
+		"defaultNumWant":        cfg.DefaultNumWant,
+		"maxScrapeInfoHashes":   cfg.MaxScrapeInfoHashes,
+		"maxExcludedPeers":      cfg.MaxExcludedPeers,
 	}
 }
 
+// Default config constants.
+const (
+	defaultNumListeners = 1
+	defaultBatchSize    = 1
+	defaultWorkers      = 256
+	defaultQueueSize    = 4096
+
+	defaultSocketStatsInterval = 10 * time.Second
+	defaultRateLimitCacheSize  = 65536
+
+	// defaultMaxResponseSize is the largest UDP payload that fits into a
+	// packet on an Ethernet link (1500 bytes) with IPv6 and UDP headers.
+	defaultMaxResponseSize = 1452
+
+	// defaultMaxResponseSizeIPv6 is the largest UDP payload that fits into
+	// a packet on any IPv6 link, whose MTU is at least 1280 bytes.
+	defaultMaxResponseSizeIPv6 = minIPv6MTU - 40 - 8
+
+	defaultPathMTUCacheSize = 65536
+
+	defaultDrainTimeout = 5 * time.Second
+)
+
 // Validate sanity checks values set in a config and returns a new config with
 // default values replacing anything that is invalid.
 //
@@ -53,8 +163,28 @@ func (cfg Config) LogFields() log.Fields {
 func (cfg Config) Validate() Config {
 	validcfg := cfg
 
-	// Generate a private key if one isn't provided by the user.
-	if cfg.PrivateKey == "" {
+	if cfg.KeyRotationInterval > 0 {
+		// Keys are generated and rotated automatically.
+		if cfg.PrivateKey != "" {
+			validcfg.PrivateKey = ""
+			log.Warn("UDP private key is ignored because keys are rotated", log.Fields{
+				"name":                "udp.PrivateKey",
+				"keyRotationInterval": cfg.KeyRotationInterval,
+			})
+		}
+
+		// Connection IDs must stay valid until the key they were generated
+		// with has been rotated out.
+		if cfg.KeyRotationInterval < ttl {
+			validcfg.KeyRotationInterval = ttl
+			log.Warn("falling back to minimum configuration", log.Fields{
+				"name":     "udp.KeyRotationInterval",
+				"provided": cfg.KeyRotationInterval,
+				"minimum":  validcfg.KeyRotationInterval,
+			})
+		}
+	} else if cfg.PrivateKey == "" {
+		// Generate a private key if one isn't provided by the user.
 		rand.Seed(time.Now().UnixNano())
 		pkeyRunes := make([]rune, 64)
 		for i := range pkeyRunes {
@@ -65,6 +195,213 @@ func (cfg Config) Validate() Config {
 		log.Warn("UDP private key was not provided, using generated key", log.Fields{"key": validcfg.PrivateKey})
 	}
 
+	if cfg.ConnectionIDAlgorithm == "" {
+		validcfg.ConnectionIDAlgorithm = ConnectionIDAlgorithmSHA256
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "udp.ConnectionIDAlgorithm",
+			"provided": cfg.ConnectionIDAlgorithm,
+			"default":  validcfg.ConnectionIDAlgorithm,
+		})
+	}
+
+	if cfg.NumListeners <= 0 {
+		validcfg.NumListeners = defaultNumListeners
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "udp.NumListeners",
+			"provided": cfg.NumListeners,
+			"default":  validcfg.NumListeners,
+		})
+	}
+
+	if cfg.BatchSize <= 0 {
+		validcfg.BatchSize = defaultBatchSize
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "udp.BatchSize",
+			"provided": cfg.BatchSize,
+			"default":  validcfg.BatchSize,
+		})
+	} else if cfg.BatchSize > 1 && runtime.GOOS != "linux" {
+		validcfg.BatchSize = 1
+		log.Warn("batched I/O is not supported on this platform, falling back to single-packet I/O", log.Fields{
+			"name":     "udp.BatchSize",
+			"provided": cfg.BatchSize,
+			"os":       runtime.GOOS,
+		})
+	}
+
+	if cfg.Workers <= 0 && cfg.WorkersPerCPU > 0 {
+		// Workers beyond the CPUs the process may use only contend for
+		// them, which cgroup CPU limits make worse.
+		n := cpus.Available()
+		validcfg.Workers = cfg.WorkersPerCPU * n
+		log.Debug("sized UDP workers to the available CPUs", log.Fields{
+			"name":          "udp.Workers",
+			"workersPerCPU": cfg.WorkersPerCPU,
+			"cpus":          n,
+			"workers":       validcfg.Workers,
+		})
+	} else if cfg.Workers <= 0 {
+		validcfg.Workers = defaultWorkers
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "udp.Workers",
+			"provided": cfg.Workers,
+			"default":  validcfg.Workers,
+		})
+	}
+
+	if cfg.QueueSize <= 0 {
+		validcfg.QueueSize = defaultQueueSize
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "udp.QueueSize",
+			"provided": cfg.QueueSize,
+			"default":  validcfg.QueueSize,
+		})
+	}
+
+	if cfg.Senders < 0 {
+		validcfg.Senders = 0
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "udp.Senders",
+			"provided": cfg.Senders,
+			"default":  validcfg.Senders,
+		})
+	}
+
+	if (validcfg.Senders > 0 || validcfg.BatchSize > 1) && cfg.SendQueueSize <= 0 {
+		validcfg.SendQueueSize = validcfg.QueueSize
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "udp.SendQueueSize",
+			"provided": cfg.SendQueueSize,
+			"default":  validcfg.SendQueueSize,
+		})
+	}
+
+	if cfg.SocketStatsInterval <= 0 {
+		validcfg.SocketStatsInterval = defaultSocketStatsInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "udp.SocketStatsInterval",
+			"provided": cfg.SocketStatsInterval,
+			"default":  validcfg.SocketStatsInterval,
+		})
+	}
+
+	if cfg.RecvErr && !recvErrSupported {
+		validcfg.RecvErr = false
+		log.Warn("reporting ICMP errors is not supported on this platform, disabling it", log.Fields{
+			"name": "udp.RecvErr",
+			"os":   runtime.GOOS,
+		})
+	}
+
+	if cfg.MaxReadBufferSize > 0 && !socketStatsSupported {
+		validcfg.MaxReadBufferSize = 0
+		log.Warn("UDP receive buffers are not tuned, because socket statistics are not supported on this platform", log.Fields{
+			"name":     "udp.MaxReadBufferSize",
+			"provided": cfg.MaxReadBufferSize,
+		})
+	}
+
+	if cfg.RateLimit > 0 {
+		if cfg.RateLimitBurst <= 0 {
+			// Allow at least one second worth of packets at once.
+			validcfg.RateLimitBurst = int(math.Ceil(cfg.RateLimit))
+			log.Warn("falling back to default configuration", log.Fields{
+				"name":     "udp.RateLimitBurst",
+				"provided": cfg.RateLimitBurst,
+				"default":  validcfg.RateLimitBurst,
+			})
+		}
+
+		if cfg.RateLimitCacheSize <= 0 {
+			validcfg.RateLimitCacheSize = defaultRateLimitCacheSize
+			log.Warn("falling back to default configuration", log.Fields{
+				"name":     "udp.RateLimitCacheSize",
+				"provided": cfg.RateLimitCacheSize,
+				"default":  validcfg.RateLimitCacheSize,
+			})
+		}
+	}
+
+	// The MTU is validated first, since the response sizes are derived from
+	// it.
+	if cfg.MTU < 0 || (cfg.MTU > 0 && cfg.MTU < minIPv4MTU) {
+		validcfg.MTU = 0
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "udp.MTU",
+			"provided": cfg.MTU,
+			"default":  validcfg.MTU,
+		})
+	}
+
+	if cfg.MaxResponseSize <= 0 {
+		validcfg.MaxResponseSize = defaultMaxResponseSize
+		if validcfg.MTU > 0 {
+			// The MTU limits responses depending on the address family.
+			validcfg.MaxResponseSize = validcfg.MTU - headerSize(net.IPv4zero)
+		}
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "udp.MaxResponseSize",
+			"provided": cfg.MaxResponseSize,
+			"default":  validcfg.MaxResponseSize,
+		})
+	}
+
+	if cfg.MaxResponseSizeIPv6 <= 0 {
+		validcfg.MaxResponseSizeIPv6 = defaultMaxResponseSizeIPv6
+		if validcfg.MTU >= minIPv6MTU {
+			// The MTU is known to be larger than the minimum.
+			validcfg.MaxResponseSizeIPv6 = validcfg.MTU - headerSize(net.IPv6zero)
+		}
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "udp.MaxResponseSizeIPv6",
+			"provided": cfg.MaxResponseSizeIPv6,
+			"default":  validcfg.MaxResponseSizeIPv6,
+		})
+	}
+
+	if cfg.PathMTUDiscovery {
+		if !pathMTUDiscoverySupported {
+			validcfg.PathMTUDiscovery = false
+			log.Warn("path MTU discovery is not supported on this platform, disabling it", log.Fields{
+				"name": "udp.PathMTUDiscovery",
+				"os":   runtime.GOOS,
+			})
+		} else if cfg.PathMTUCacheSize <= 0 {
+			validcfg.PathMTUCacheSize = defaultPathMTUCacheSize
+			log.Warn("falling back to default configuration", log.Fields{
+				"name":     "udp.PathMTUCacheSize",
+				"provided": cfg.PathMTUCacheSize,
+				"default":  validcfg.PathMTUCacheSize,
+			})
+		}
+	}
+
+	if cfg.DrainTimeout <= 0 {
+		validcfg.DrainTimeout = defaultDrainTimeout
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "udp.DrainTimeout",
+			"provided": cfg.DrainTimeout,
+			"default":  validcfg.DrainTimeout,
+		})
+	}
+
+	if cfg.MaxResponseFactor < 0 {
+		validcfg.MaxResponseFactor = 0
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "udp.MaxResponseFactor",
+			"provided": cfg.MaxResponseFactor,
+			"default":  validcfg.MaxResponseFactor,
+		})
+	} else if cfg.MaxResponseFactor > 0 && cfg.MaxResponseFactor < 1 {
+		// Responses to announces must at least be able to contain one peer.
+		validcfg.MaxResponseFactor = 1
+		log.Warn("falling back to minimum configuration", log.Fields{
+			"name":     "udp.MaxResponseFactor",
+			"provided": cfg.MaxResponseFactor,
+			"minimum":  validcfg.MaxResponseFactor,
+		})
+	}
+
 	if cfg.MaxNumWant <= 0 {
 		validcfg.MaxNumWant = defaultMaxNumWant
 		log.Warn("falling back to default configuration", log.Fields{
@@ -92,16 +429,177 @@ func (cfg Config) Validate() Config {
 		})
 	}
 
+	if cfg.AllowIPSpoofing && !cfg.IPSpoofing.Enabled() {
+		validcfg.IPSpoofing.AllowIPv4 = true
+		validcfg.IPSpoofing.AllowIPv6 = true
+		log.Warn("deprecated configuration, use udp.ip_spoofing instead", log.Fields{
+			"name":     "udp.AllowIPSpoofing",
+			"provided": cfg.AllowIPSpoofing,
+		})
+	}
+
+	if cfg.Clock == nil {
+		validcfg.Clock = clock.Cached
+	}
+
 	return validcfg
 }
 
+// Check returns all problems of a config that make no sense, such as
+// negative intervals or buffer sizes.
+//
+// Unset values are not problems, since Validate replaces them with defaults.
+// This includes the private key, which is generated if it is not set.
+func (cfg Config) Check() (problems []error) {
+	negative := func(key string) {
+		problems = append(problems, fmt.Errorf("udp.%s must not be negative", key))
+	}
+
+	if cfg.AccessLogPath != "" && !cfg.EnableAccessLog {
+		problems = append(problems, errors.New("udp.enable_access_log must be set when using udp.access_log_path"))
+	}
+
+	if cfg.MaxClockSkew < 0 {
+		negative("max_clock_skew")
+	}
+	if cfg.KeyRotationInterval < 0 {
+		negative("key_rotation_interval")
+	}
+	if cfg.NumListeners < 0 {
+		negative("num_listeners")
+	}
+	if cfg.BatchSize < 0 {
+		negative("batch_size")
+	}
+	if cfg.Workers < 0 {
+		negative("workers")
+	}
+	if cfg.WorkersPerCPU < 0 {
+		negative("workers_per_cpu")
+	}
+	if cfg.QueueSize < 0 {
+		negative("queue_size")
+	}
+	if cfg.Senders < 0 {
+		negative("senders")
+	}
+	if cfg.SendQueueSize < 0 {
+		negative("send_queue_size")
+	}
+	if cfg.SocketStatsInterval < 0 {
+		negative("socket_stats_interval")
+	}
+	if cfg.ReadBufferSize < 0 {
+		negative("read_buffer_size")
+	}
+	if cfg.MaxReadBufferSize < 0 {
+		negative("max_read_buffer_size")
+	}
+	if cfg.WriteBufferSize < 0 {
+		negative("write_buffer_size")
+	}
+	if cfg.TOS < 0 || cfg.TOS > 255 {
+		problems = append(problems, fmt.Errorf("udp.tos must be between 0 and 255, not %d", cfg.TOS))
+	}
+	if cfg.RateLimit < 0 {
+		negative("rate_limit")
+	}
+	if cfg.RateLimitBurst < 0 {
+		negative("rate_limit_burst")
+	}
+	if cfg.RateLimitCacheSize < 0 {
+		negative("rate_limit_cache_size")
+	}
+	if cfg.MaxResponseSize < 0 {
+		negative("max_response_size")
+	}
+	if cfg.MaxResponseSizeIPv6 < 0 {
+		negative("max_response_size_ipv6")
+	}
+	if cfg.MaxResponseFactor < 0 {
+		negative("max_response_factor")
+	}
+	if cfg.MTU < 0 {
+		negative("mtu")
+	}
+	if cfg.PathMTUCacheSize < 0 {
+		negative("path_mtu_cache_size")
+	}
+	if cfg.ConnectionIDCacheSize < 0 {
+		negative("connection_id_cache_size")
+	}
+	if cfg.DrainTimeout < 0 {
+		negative("drain_timeout")
+	}
+	if cfg.RequestTimeout < 0 {
+		negative("request_timeout")
+	}
+	if cfg.MaxResponsePeers < 0 {
+		negative("max_response_peers")
+	}
+
+	switch cfg.ConnectionIDAlgorithm {
+	case "", ConnectionIDAlgorithmSHA256, ConnectionIDAlgorithmSipHash, ConnectionIDAlgorithmBLAKE3:
+	default:
+		problems = append(problems, fmt.Errorf("udp.connection_id_algorithm must be %s, %s or %s, not %q",
+			ConnectionIDAlgorithmSHA256, ConnectionIDAlgorithmSipHash, ConnectionIDAlgorithmBLAKE3, cfg.ConnectionIDAlgorithm))
+	}
+	if cfg.MaxReadBufferSize > 0 && cfg.MaxReadBufferSize < cfg.ReadBufferSize {
+		problems = append(problems, errors.New("udp.max_read_buffer_size must not be smaller than udp.read_buffer_size"))
+	}
+	if cfg.MaxNumWant > 0 && cfg.DefaultNumWant > cfg.MaxNumWant {
+		problems = append(problems, errors.New("udp.default_numwant must not exceed udp.max_numwant"))
+	}
+	return
+}
+
 // Frontend holds the state of a UDP BitTorrent Frontend.
 type Frontend struct {
-	socket  *net.UDPConn
+	// sockets are the bound server sockets, each served by its own read
+	// loop.
+	sockets []*net.UDPConn
 	closing chan struct{}
 	wg      sync.WaitGroup
 
-	genPool *sync.Pool
+	// failed receives the first error a read loop fails with.
+	failed chan error
+
+	// ctx is passed to the TrackerLogic. It is canceled when the Frontend is
+	// stopped, after in-flight requests were drained or abandoned.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// outs hold the responses waiting to be written in batches or by
+	// senders, one for each socket. They are only used if batching or
+	// senders are enabled.
+	outs   []chan outgoing
+	sendWG sync.WaitGroup
+
+	// queue holds packets that have been read from the socket but not yet
+	// handled by a worker.
+	queue chan packet
+
+	// limiter limits the rate of packets per IP. It is nil if rate limiting
+	// is disabled.
+	limiter *ratelimit.Limiter
+
+	// pathMTUs holds the discovered path MTUs of destinations. It is nil if
+	// path MTU discovery is disabled.
+	pathMTUs *pathMTUCache
+
+	// accessLog is nil if access logs are disabled or written to the logger.
+	accessLog *accesslog.Log
+
+	// readBuffers grows the receive buffers of the sockets. It is nil if
+	// they are not tuned.
+	readBuffers *readBufferTuner
+
+	// keys holds the *keyring used to generate and validate connection IDs.
+	keys atomic.Value
+
+	// connIDs holds the connection IDs recently issued to or validated for
+	// clients. It is nil if connection IDs are not cached.
+	connIDs *connIDCache
 
 	logic frontend.TrackerLogic
 	Config
@@ -110,33 +608,166 @@ type Frontend struct {
 // NewFrontend creates a new instance of an UDP Frontend that asynchronously
 // serves requests.
 func NewFrontend(logic frontend.TrackerLogic, provided Config) (*Frontend, error) {
+	if problems := provided.Check(); len(problems) != 0 {
+		return nil, problems[0]
+	}
 	cfg := provided.Validate()
 
 	f := &Frontend{
 		closing: make(chan struct{}),
+		failed:  make(chan error, 1),
+		queue:   make(chan packet, cfg.QueueSize),
 		logic:   logic,
 		Config:  cfg,
-		genPool: &sync.Pool{
-			New: func() interface{} {
-				return NewConnectionIDGenerator(cfg.PrivateKey)
-			},
-		},
+	}
+
+	if cfg.RateLimit > 0 {
+		f.limiter = ratelimit.New(cfg.RateLimit, cfg.RateLimitBurst, cfg.RateLimitCacheSize)
+	}
+
+	if cfg.KeyRotationInterval > 0 {
+		f.keys.Store(&keyring{current: newGeneratorPool(cfg.ConnectionIDAlgorithm, generateKey())})
+	} else {
+		f.keys.Store(&keyring{current: newGeneratorPool(cfg.ConnectionIDAlgorithm, cfg.PrivateKey)})
+	}
+
+	if cfg.ConnectionIDCacheSize > 0 {
+		f.connIDs = newConnIDCache(cfg.ConnectionIDCacheSize)
+	}
+
+	if cfg.EnableAccessLog && cfg.AccessLogPath != "" {
+		var err error
+		if f.accessLog, err = accesslog.Open(cfg.AccessLogPath, cfg.AccessLogFormat); err != nil {
+			return nil, err
+		}
 	}
 
 	err := f.listen()
 	if err != nil {
+		if f.accessLog != nil {
+			f.accessLog.Close()
+		}
 		return nil, err
 	}
 
-	go func() {
-		if err := f.serve(); err != nil {
-			log.Fatal("failed while serving udp", log.Err(err))
+	if cfg.ReadBufferSize > 0 {
+		for _, socket := range f.sockets {
+			if err := socket.SetReadBuffer(cfg.ReadBufferSize); err != nil {
+				f.closeSockets()
+				return nil, err
+			}
 		}
+	}
+	if cfg.MaxReadBufferSize > 0 {
+		f.readBuffers = newReadBufferTuner(f.sockets, cfg.MaxReadBufferSize)
+	}
+
+	for _, socket := range f.sockets {
+		if err := f.setSocketOptions(socket); err != nil {
+			f.closeSockets()
+			return nil, err
+		}
+	}
+
+	if cfg.PathMTUDiscovery {
+		f.pathMTUs = newPathMTUCache(cfg.PathMTUCacheSize)
+		for _, socket := range f.sockets {
+			if err := enablePathMTUDiscovery(socket); err != nil {
+				f.closeSockets()
+				return nil, err
+			}
+		}
+	}
+	f.ctx, f.cancel = context.WithCancel(context.Background())
+
+	if cfg.KeyRotationInterval > 0 {
+		f.wg.Add(1)
+		go f.rotateKeys()
+	}
+
+	for i := 0; i < cfg.Workers; i++ {
+		f.wg.Add(1)
+		go f.work()
+	}
+
+	if cfg.BatchSize > 1 {
+		for _, socket := range f.sockets {
+			out := make(chan outgoing, cfg.SendQueueSize)
+			f.outs = append(f.outs, out)
+			f.sendWG.Add(1)
+			go f.writeBatches(socket, out)
+		}
+	} else if cfg.Senders > 0 {
+		for _, socket := range f.sockets {
+			out := make(chan outgoing, cfg.SendQueueSize)
+			f.outs = append(f.outs, out)
+			for i := 0; i < cfg.Senders; i++ {
+				f.sendWG.Add(1)
+				go f.writeResponses(socket, out)
+			}
+		}
+	}
+
+	// The queue is closed once all read loops have exited.
+	var serving sync.WaitGroup
+	for i, socket := range f.sockets {
+		serving.Add(1)
+		go func(i int, socket *net.UDPConn) {
+			defer serving.Done()
+
+			if cfg.LockListenerThreads {
+				// Each read loop keeps a thread of its own, so that
+				// it is not moved between threads by the scheduler.
+				runtime.LockOSThread()
+				defer runtime.UnlockOSThread()
+			}
+
+			var err error
+			switch {
+			case cfg.BatchSize > 1:
+				err = f.serveBatches(socket, f.outs[i])
+			case cfg.Senders > 0:
+				err = f.serve(socket, f.outs[i])
+			default:
+				err = f.serve(socket, nil)
+			}
+			if err != nil {
+				logger.Error("failed while serving udp", log.Err(err))
+				f.fail(err)
+			}
+		}(i, socket)
+	}
+
+	if socketStatsSupported {
+		f.wg.Add(1)
+		go f.reportSocketStats()
+	}
+
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		serving.Wait()
+		close(f.queue)
 	}()
 
 	return f, nil
 }
 
+// Failed implements server.Failer. The returned channel receives the first
+// error reading from a socket failed with.
+func (t *Frontend) Failed() <-chan error {
+	return t.failed
+}
+
+// fail reports that reading from a socket failed with err, unless reading
+// from a socket failed before.
+func (t *Frontend) fail(err error) {
+	select {
+	case t.failed <- err:
+	default:
+	}
+}
+
 // Stop provides a thread-safe way to shutdown a currently running Frontend.
 func (t *Frontend) Stop() stop.Result {
 	select {
@@ -148,84 +779,364 @@ func (t *Frontend) Stop() stop.Result {
 	c := make(stop.Channel)
 	go func() {
 		close(t.closing)
-		t.socket.SetReadDeadline(time.Now())
-		t.wg.Wait()
-		c.Done(t.socket.Close())
+		for _, socket := range t.sockets {
+			socket.SetReadDeadline(time.Now())
+		}
+
+		drained := make(chan struct{})
+		go func() {
+			t.wg.Wait()
+			close(drained)
+		}()
+
+		var errs []error
+		timer := time.NewTimer(t.DrainTimeout)
+		select {
+		case <-drained:
+			timer.Stop()
+
+			// Now that no more responses are generated, flush pending
+			// batches.
+			for _, out := range t.outs {
+				close(out)
+			}
+			t.sendWG.Wait()
+		case <-timer.C:
+			// Abandon the requests still being handled. Responses they
+			// generate are discarded.
+			logger.Warn("timed out draining in-flight requests", log.Fields{"drainTimeout": t.DrainTimeout})
+			errs = append(errs, frontend.ErrDrainTimeout)
+		}
+		t.cancel()
+
+		errs = append(errs, t.closeSockets()...)
+		t.sendWG.Wait()
+
+		if t.accessLog != nil {
+			if err := t.accessLog.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		c.Done(errs...)
 	}()
 
 	return c.Result()
 }
 
-// listen resolves the address and binds the server socket.
+// Addrs returns the local addresses of the sockets of the Frontend.
+func (t *Frontend) Addrs() []net.Addr {
+	addrs := make([]net.Addr, 0, len(t.sockets))
+	for _, socket := range t.sockets {
+		addrs = append(addrs, socket.LocalAddr())
+	}
+	return addrs
+}
+
+// closeSockets closes the server sockets, after removing them from the
+// sockets passed to new processes on upgrades.
+func (t *Frontend) closeSockets() (errs []error) {
+	for _, socket := range t.sockets {
+		handoff.Remove(socket)
+		if err := socket.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// listen binds the server sockets.
+//
+// If Addr6 is set, Addr only accepts IPv4 and Addr6 only accepts IPv6.
+// Otherwise, Addr accepts both address families.
 func (t *Frontend) listen() error {
-	udpAddr, err := net.ResolveUDPAddr("udp", t.Addr)
+	network := "udp"
+	if t.Addr6 != "" {
+		network = "udp4"
+	}
+
+	if t.Addr != "" {
+		if err := t.bind(network, t.Addr); err != nil {
+			return err
+		}
+	}
+
+	if t.Addr6 != "" {
+		if err := t.bind("udp6", t.Addr6); err != nil {
+			t.closeSockets()
+			t.sockets = nil
+			return err
+		}
+	}
+
+	return nil
+}
+
+// bind binds the server sockets for an address, or takes them over from the
+// previous process if this process was started to upgrade it. See
+// bindSockets for how they are bound.
+func (t *Frontend) bind(network, address string) error {
+	sockets, err := handoff.ListenPacket(network, address, func() ([]*net.UDPConn, error) {
+		return t.bindSockets(network, address)
+	})
 	if err != nil {
 		return err
 	}
-	t.socket, err = net.ListenUDP("udp", udpAddr)
-	return err
+	t.sockets = append(t.sockets, sockets...)
+	return nil
 }
 
-// serve blocks while listening and serving UDP BitTorrent requests
-// until Stop() is called or an error is returned.
-func (t *Frontend) serve() error {
-	pool := bytepool.New(2048)
+// bindSockets resolves the address and binds NumListeners server sockets to it.
+//
+// If more than one listener is configured, all sockets are bound to the same
+// address using SO_REUSEPORT, so that the kernel balances packets across them.
+//
+// If systemd passed sockets bound to the address, those are used instead.
+// Addresses of the form fd://0 or fd://name name a socket passed by systemd
+// explicitly, which is used as the only socket for the address.
+func (t *Frontend) bindSockets(network, address string) ([]*net.UDPConn, error) {
+	if systemd.IsAddr(address) {
+		pc, err := systemd.PacketConn(address)
+		if err != nil {
+			return nil, err
+		}
+		socket, ok := pc.(*net.UDPConn)
+		if !ok {
+			pc.Close()
+			return nil, fmt.Errorf("udp: %s is not a UDP socket", address)
+		}
+		return []*net.UDPConn{socket}, nil
+	}
 
-	t.wg.Add(1)
-	defer t.wg.Done()
+	udpAddr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	activated, err := systemd.PacketConns(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if len(activated) > 0 {
+		sockets := make([]*net.UDPConn, 0, len(activated))
+		for _, pc := range activated {
+			sockets = append(sockets, pc.(*net.UDPConn))
+		}
+		return sockets, nil
+	}
+
+	if t.NumListeners == 1 {
+		socket, err := net.ListenUDP(network, udpAddr)
+		if err != nil {
+			return nil, err
+		}
+		return []*net.UDPConn{socket}, nil
+	}
+
+	lc := net.ListenConfig{Control: reusePortControl}
+	addr := udpAddr.String()
+	sockets := make([]*net.UDPConn, 0, t.NumListeners)
+	for i := 0; i < t.NumListeners; i++ {
+		pc, err := lc.ListenPacket(context.Background(), network, addr)
+		if err != nil {
+			for _, socket := range sockets {
+				socket.Close()
+			}
+			return nil, err
+		}
+		socket := pc.(*net.UDPConn)
+		sockets = append(sockets, socket)
+
+		// If the port was chosen by the kernel, the other sockets must bind
+		// to the same one.
+		addr = socket.LocalAddr().String()
+	}
+
+	return sockets, nil
+}
+
+// maxPacketSize is the size of the buffers packets are read into. Larger
+// packets are truncated.
+const maxPacketSize = 2048
+
+// buffers holds the buffers of requests and responses, which have very
+// different sizes.
+var buffers = bytepool.NewSized("udp", 512, 2048, 8192)
+
+// packet is a UDP payload waiting to be handled by a worker.
+type packet struct {
+	buffer *[]byte
+	addr   *net.UDPAddr
+	socket *net.UDPConn
+
+	// out is where responses are sent to be written in batches or by
+	// senders. If nil, responses are written directly to the socket.
+	out chan<- outgoing
+
+	// received is the time the packet was queued. It is only set if
+	// request timing is enabled.
+	received time.Time
+}
 
+// serve blocks while listening and serving UDP BitTorrent requests
+// until Stop() is called or an error is returned.
+//
+// Packets are handed to a fixed number of workers through a bounded queue.
+// If the queue is full, packets are dropped.
+//
+// Responses are sent to out, if not nil.
+func (t *Frontend) serve(socket *net.UDPConn, out chan<- outgoing) error {
+	buffer := make([]byte, maxPacketSize)
+	backoff := readBackoff{socket: socket}
 	for {
 		// Check to see if we need to shutdown.
 		select {
 		case <-t.closing:
-			log.Debug("udp serve() received shutdown signal")
+			logger.Debug("serve() received shutdown signal")
 			return nil
 		default:
 		}
 
-		// Read a UDP packet into a reusable buffer.
-		buffer := pool.Get()
-		n, addr, err := t.socket.ReadFromUDP(buffer)
+		n, addr, err := socket.ReadFromUDP(buffer)
 		if err != nil {
-			pool.Put(buffer)
+			if t.RecvErr && isICMPError(err) {
+				recordICMPError(writeErrorType(err))
+				continue
+			}
 			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
-				// A temporary failure is not fatal; just pretend it never happened.
+				// A temporary failure is not fatal, but it is retried
+				// after a delay in case it persists.
+				if !t.waitAfterReadError(&backoff, err) {
+					return nil
+				}
 				continue
 			}
 			return err
 		}
+		backoff.recovered()
 
 		// We got nothin'
 		if n == 0 {
-			pool.Put(buffer)
 			continue
 		}
 
-		t.wg.Add(1)
-		go func() {
-			defer t.wg.Done()
-			defer pool.Put(buffer)
+		t.enqueue(buffer[:n], addr, socket, out)
+	}
+}
 
-			if ip := addr.IP.To4(); ip != nil {
-				addr.IP = ip
-			}
+// work handles packets from the queue until it is closed.
+func (t *Frontend) work() {
+	defer t.wg.Done()
 
-			// Handle the request.
-			var start time.Time
-			if t.EnableRequestTiming {
-				start = time.Now()
-			}
-			action, af, err := t.handleRequest(
-				// Make sure the IP is copied, not referenced.
-				Request{buffer[:n], append([]byte{}, addr.IP...)},
-				ResponseWriter{t.socket, addr},
-			)
-			if t.EnableRequestTiming {
-				recordResponseDuration(action, af, err, time.Since(start))
-			} else {
-				recordResponseDuration(action, af, err, time.Duration(0))
-			}
-		}()
+	for p := range t.queue {
+		if !p.received.IsZero() {
+			recordStageDuration(stageReceiveQueue, time.Since(p.received))
+		}
+		t.handlePacket(p)
+		buffers.Put(p.buffer)
+	}
+}
+
+// enqueue hands a packet read into a reusable buffer to the workers.
+//
+// The packet is copied into a buffer of the best-fitting size, so that
+// bursts of queued packets don't hold on to buffers sized for the largest
+// packets.
+func (t *Frontend) enqueue(b []byte, addr *net.UDPAddr, socket *net.UDPConn, out chan<- outgoing) {
+	buffer := buffers.Get(len(b))
+	copy(*buffer, b)
+
+	var received time.Time
+	if t.EnableRequestTiming {
+		received = time.Now()
+	}
+
+	select {
+	case t.queue <- packet{buffer, addr, socket, out, received}:
+		recordQueueDepth(len(t.queue))
+	default:
+		buffers.Put(buffer)
+		recordDroppedPacket(dropReasonQueueFull)
+	}
+}
+
+// handlePacket handles a single packet read from the socket.
+func (t *Frontend) handlePacket(p packet) {
+	addr := p.addr
+	addr.IP = netutil.Unmap(addr.IP)
+
+	// Silently drop packets above the rate limit, so that the tracker can't
+	// be used to amplify floods.
+	if t.limiter != nil && !t.limiter.Allow(string(addr.IP), t.Clock.Now()) {
+		recordDroppedPacket(dropReasonRateLimited)
+		return
+	}
+
+	// Handle the request.
+	var start time.Time
+	if t.EnableRequestTiming || t.EnableAccessLog {
+		start = time.Now()
+	}
+	action, af, err := t.handleRequest(
+		// Make sure the IP is copied, not referenced.
+		Request{*p.buffer, append([]byte{}, addr.IP...)},
+		ResponseWriter{p.socket, addr, p.out, t.ctx.Done(), t.maxResponseSize(len(*p.buffer), addr.IP), t.pathMTUs, t.EnableRequestTiming, t.RetryWrites},
+	)
+	var duration time.Duration
+	if !start.IsZero() {
+		duration = time.Since(start)
+	}
+	if t.EnableRequestTiming {
+		recordResponseDuration(action, af, err, duration)
+	} else {
+		recordResponseDuration(action, af, err, time.Duration(0))
+	}
+	if t.EnableAccessLog {
+		logAccess(t.accessLog, action, addr, af, err, start, duration)
+	}
+}
+
+// logAccess writes a handled request to l, or to the logger at the info level
+// if l is nil.
+//
+// The request is logged as "<action> <address family> UDP", e.g.
+// "announce IPv4 UDP", and its status is 200 if it succeeded, 400 if it failed
+// because of the client and 500 otherwise. The size of the response is not
+// logged.
+func logAccess(l *accesslog.Log, action string, addr *net.UDPAddr, af *bittorrent.AddressFamily, err error, start time.Time, duration time.Duration) {
+	if action == "" {
+		action = "-"
+	}
+	afString := "-"
+	if af != nil {
+		afString = af.String()
+	}
+
+	status := 200
+	if err != nil {
+		status = 500
+		if _, ok := err.(bittorrent.ClientError); ok {
+			status = 400
+		}
+	}
+
+	e := accesslog.Entry{
+		Remote:   addr.IP.String(),
+		Time:     start,
+		Request:  action + " " + afString + " UDP",
+		Status:   status,
+		Bytes:    -1,
+		Duration: duration,
+	}
+	if l == nil {
+		if err != nil {
+			logger.Info("handled request", e, log.Err(err))
+		} else {
+			logger.Info("handled request", e)
+		}
+		return
+	}
+	if err := l.Log(e); err != nil {
+		logger.Error("failed to write access log", log.Err(err))
 	}
 }
 
@@ -240,14 +1151,72 @@ type Request struct {
 type ResponseWriter struct {
 	socket *net.UDPConn
 	addr   *net.UDPAddr
+	out    chan<- outgoing
+
+	// done is closed once responses are no longer written, because the
+	// Frontend was stopped.
+	done <-chan struct{}
+
+	// limit is the maximum size of a response. Larger responses are dropped.
+	limit int
+
+	// pathMTUs records destinations that responses were too large for. It is
+	// nil if path MTU discovery is disabled.
+	pathMTUs *pathMTUCache
+
+	// timed is set if the time responses wait to be written is recorded.
+	timed bool
+
+	// retry is set if responses that could not be written for lack of
+	// buffer space are written once more.
+	retry bool
 }
 
 // Write implements the io.Writer interface for a ResponseWriter.
 func (w ResponseWriter) Write(b []byte) (int, error) {
-	w.socket.WriteToUDP(b, w.addr)
+	if w.limit > 0 && len(b) > w.limit {
+		recordDroppedPacket(dropReasonResponseTooLarge)
+		return len(b), nil
+	}
+
+	if w.out != nil {
+		// The response is written asynchronously, so it must be copied.
+		buffer := buffers.Get(len(b))
+		copy(*buffer, b)
+
+		o := outgoing{buffer: buffer, addr: w.addr}
+		if w.timed {
+			o.queued = time.Now()
+		}
+
+		// Workers never wait for the socket. If responses can't be
+		// written as fast as they are generated, they are dropped.
+		select {
+		case <-w.done:
+			buffers.Put(buffer)
+		case w.out <- o:
+		default:
+			buffers.Put(buffer)
+			recordDroppedPacket(dropReasonSendQueueFull)
+		}
+		return len(b), nil
+	}
+
+	if err := writeResponseTo(w.socket, b, w.addr, w.retry); err != nil {
+		writeFailed(err, w.addr, w.pathMTUs)
+	}
 	return len(b), nil
 }
 
+// requestContext returns the context for handling a single request, which is
+// canceled when the Frontend is stopped or the request timed out.
+func (t *Frontend) requestContext() (context.Context, context.CancelFunc) {
+	if t.RequestTimeout > 0 {
+		return context.WithTimeout(t.ctx, t.RequestTimeout)
+	}
+	return context.WithCancel(t.ctx)
+}
+
 // handleRequest parses and responds to a UDP Request.
 func (t *Frontend) handleRequest(r Request, w ResponseWriter) (actionName string, af *bittorrent.AddressFamily, err error) {
 	if len(r.Packet) < 16 {
@@ -257,18 +1226,18 @@ func (t *Frontend) handleRequest(r Request, w ResponseWriter) (actionName string
 		return
 	}
 
+	// The address family of the transport decides how responses are encoded,
+	// regardless of the addresses clients advertise.
+	transport := addressFamily(r.IP)
+
 	// Parse the headers of the UDP packet.
 	connID := r.Packet[0:8]
 	actionID := binary.BigEndian.Uint32(r.Packet[8:12])
 	txID := r.Packet[12:16]
 
-	// get a connection ID generator/validator from the pool.
-	gen := t.genPool.Get().(*ConnectionIDGenerator)
-	defer t.genPool.Put(gen)
-
 	// If this isn't requesting a new connection ID and the connection ID is
 	// invalid, then fail.
-	if actionID != connectActionID && !gen.Validate(connID, r.IP, timecache.Now(), t.MaxClockSkew) {
+	if actionID != connectActionID && !t.validConnectionID(connID, r.IP, t.Clock.Now()) {
 		err = errBadConnectionID
 		WriteError(w, txID, err)
 		return
@@ -285,16 +1254,9 @@ func (t *Frontend) handleRequest(r Request, w ResponseWriter) (actionName string
 		}
 
 		af = new(bittorrent.AddressFamily)
-		if r.IP.To4() != nil {
-			*af = bittorrent.IPv4
-		} else if len(r.IP) == net.IPv6len { // implies r.IP.To4() == nil
-			*af = bittorrent.IPv6
-		} else {
-			// Should never happen - we got the IP straight from the UDP packet.
-			panic(fmt.Sprintf("udp: invalid IP: neither v4 nor v6, IP: %#v", r.IP))
-		}
+		*af = transport
 
-		WriteConnectionID(w, txID, gen.Generate(r.IP, timecache.Now()))
+		t.generateConnectionID(w, txID, r.IP, t.Clock.Now())
 
 	case announceActionID, announceV6ActionID:
 		actionName = "announce"
@@ -308,17 +1270,20 @@ func (t *Frontend) handleRequest(r Request, w ResponseWriter) (actionName string
 		af = new(bittorrent.AddressFamily)
 		*af = req.IP.AddressFamily
 
-		var ctx context.Context
+		ctx, cancel := t.requestContext()
+		defer cancel()
+
 		var resp *bittorrent.AnnounceResponse
-		ctx, resp, err = t.logic.HandleAnnounce(context.Background(), req)
+		ctx, resp, err = t.logic.HandleAnnounce(ctx, req)
 		if err != nil {
 			WriteError(w, txID, err)
 			return
 		}
 
-		WriteAnnounce(w, txID, resp, actionID == announceV6ActionID, req.IP.AddressFamily == bittorrent.IPv6)
+		resp = truncatePeers(resp, transport, w.limit, t.MaxResponsePeers, req.NumWant)
+		WriteAnnounce(w, txID, resp, actionID == announceV6ActionID, transport == bittorrent.IPv6)
 
-		go t.logic.AfterAnnounce(ctx, req, resp)
+		go t.logic.AfterAnnounce(frontend.Detach(ctx), req, resp)
 
 	case scrapeActionID:
 		actionName = "scrape"
@@ -330,20 +1295,15 @@ func (t *Frontend) handleRequest(r Request, w ResponseWriter) (actionName string
 			return
 		}
 
-		if r.IP.To4() != nil {
-			req.AddressFamily = bittorrent.IPv4
-		} else if len(r.IP) == net.IPv6len { // implies r.IP.To4() == nil
-			req.AddressFamily = bittorrent.IPv6
-		} else {
-			// Should never happen - we got the IP straight from the UDP packet.
-			panic(fmt.Sprintf("udp: invalid IP: neither v4 nor v6, IP: %#v", r.IP))
-		}
+		req.AddressFamily = transport
 		af = new(bittorrent.AddressFamily)
 		*af = req.AddressFamily
 
-		var ctx context.Context
+		ctx, cancel := t.requestContext()
+		defer cancel()
+
 		var resp *bittorrent.ScrapeResponse
-		ctx, resp, err = t.logic.HandleScrape(context.Background(), req)
+		ctx, resp, err = t.logic.HandleScrape(ctx, req)
 		if err != nil {
 			WriteError(w, txID, err)
 			return
@@ -351,7 +1311,7 @@ func (t *Frontend) handleRequest(r Request, w ResponseWriter) (actionName string
 
 		WriteScrape(w, txID, resp)
 
-		go t.logic.AfterScrape(ctx, req, resp)
+		go t.logic.AfterScrape(frontend.Detach(ctx), req, resp)
 
 	default:
 		err = errUnknownAction
@@ -360,3 +1320,49 @@ func (t *Frontend) handleRequest(r Request, w ResponseWriter) (actionName string
 
 	return
 }
+
+// maxResponseSize returns the maximum size of the response to a request of
+// the given size from ip.
+//
+// Responses are never larger than MaxResponseSize and, if MaxResponseFactor
+// is set, never larger than that multiple of the request. This keeps the
+// tracker from being used to amplify reflection attacks.
+//
+// Responses also fit into a single datagram on a link of the configured MTU
+// or the path MTU discovered for ip, so that they aren't fragmented. Unless
+// configured otherwise, responses to IPv6 clients fit into the minimum IPv6
+// MTU.
+func (t *Frontend) maxResponseSize(requestSize int, ip net.IP) int {
+	limit := t.MaxResponseSize
+	if netutil.FamilyOf(ip) == netutil.IPv6 && t.MaxResponseSizeIPv6 > 0 && t.MaxResponseSizeIPv6 < limit {
+		limit = t.MaxResponseSizeIPv6
+	}
+	if t.MTU > 0 {
+		if l := t.MTU - headerSize(ip); l < limit {
+			limit = l
+		}
+	}
+	if t.pathMTUs != nil {
+		if mtu, ok := t.pathMTUs.get(ip); ok {
+			if l := mtu - headerSize(ip); l < limit {
+				limit = l
+			}
+		}
+	}
+	if t.MaxResponseFactor > 0 {
+		if l := int(t.MaxResponseFactor * float64(requestSize)); l < limit {
+			limit = l
+		}
+	}
+	return limit
+}
+
+// addressFamily returns the address family of an IP read from a UDP packet.
+func addressFamily(ip net.IP) bittorrent.AddressFamily {
+	reqIP, err := bittorrent.NewIP(ip)
+	if err != nil {
+		// Should never happen - we got the IP straight from the UDP packet.
+		panic(fmt.Sprintf("udp: invalid IP: neither v4 nor v6, IP: %#v", ip))
+	}
+	return reqIP.AddressFamily
+}
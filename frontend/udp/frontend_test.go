@@ -1,28 +1,269 @@
 package udp_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
 	"testing"
+	"time"
 
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/frontend"
 	"github.com/chihaya/chihaya/frontend/udp"
+	"github.com/chihaya/chihaya/internal/cpus"
 	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/clock"
 	"github.com/chihaya/chihaya/storage"
 	_ "github.com/chihaya/chihaya/storage/memory"
 )
 
-func TestStartStopRaceIssue437(t *testing.T) {
+func newFrontend(t *testing.T, cfg udp.Config) *udp.Frontend {
 	ps, err := storage.NewPeerStore("memory", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 	var responseConfig middleware.ResponseConfig
 	lgc := middleware.NewLogic(responseConfig, ps, nil, nil)
-	fe, err := udp.NewFrontend(lgc, udp.Config{Addr: "127.0.0.1:0"})
+	fe, err := udp.NewFrontend(lgc, cfg)
 	if err != nil {
 		t.Fatal(err)
 	}
+	return fe
+}
+
+func stopFrontend(t *testing.T, fe *udp.Frontend) {
 	errC := fe.Stop()
 	errs := <-errC
 	if len(errs) != 0 {
 		t.Fatal(errs[0])
 	}
 }
+
+// connect sends a connect request to the frontend and returns the
+// connection ID from the response.
+func connect(t *testing.T, addr net.Addr) []byte {
+	conn, err := net.Dial("udp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	txID := []byte{1, 2, 3, 4}
+	req := []byte{0, 0, 0x04, 0x17, 0x27, 0x10, 0x19, 0x80, 0, 0, 0, 0}
+	req = append(req, txID...)
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp := make([]byte, 64)
+	n, err := conn.Read(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 16 {
+		t.Fatalf("expected response of 16 bytes, got %d", n)
+	}
+	if action := binary.BigEndian.Uint32(resp[:4]); action != 0 {
+		t.Fatalf("expected connect action, got %d", action)
+	}
+	if !bytes.Equal(resp[4:8], txID) {
+		t.Fatalf("expected transaction ID %x, got %x", txID, resp[4:8])
+	}
+	return resp[8:16]
+}
+
+func TestStartStopRaceIssue437(t *testing.T) {
+	fe := newFrontend(t, udp.Config{Addr: "127.0.0.1:0"})
+	stopFrontend(t, fe)
+}
+
+func TestMultipleListeners(t *testing.T) {
+	fe := newFrontend(t, udp.Config{Addr: "127.0.0.1:0", NumListeners: 4})
+	defer stopFrontend(t, fe)
+
+	addrs := fe.Addrs()
+	if len(addrs) != 4 {
+		t.Fatalf("expected 4 sockets, got %d", len(addrs))
+	}
+	// The sockets share one port, which the kernel balances clients
+	// across by their addresses.
+	for _, addr := range addrs[1:] {
+		if addr.String() != addrs[0].String() {
+			t.Fatalf("expected all sockets to be bound to %s, got %s", addrs[0], addr)
+		}
+	}
+	for _, addr := range addrs {
+		connect(t, addr)
+	}
+}
+
+func TestConnect(t *testing.T) {
+	for _, batchSize := range []int{1, 8} {
+		fe := newFrontend(t, udp.Config{Addr: "127.0.0.1:0", BatchSize: batchSize})
+		connect(t, fe.Addrs()[0])
+		stopFrontend(t, fe)
+	}
+}
+
+func TestConnectSenders(t *testing.T) {
+	fe := newFrontend(t, udp.Config{Addr: "127.0.0.1:0", Senders: 2, SendQueueSize: 16, EnableRequestTiming: true})
+	for i := 0; i < 4; i++ {
+		connect(t, fe.Addrs()[0])
+	}
+	stopFrontend(t, fe)
+}
+
+func TestSeparateListeners(t *testing.T) {
+	fe := newFrontend(t, udp.Config{Addr: "127.0.0.1:0", Addr6: "[::1]:0"})
+	defer stopFrontend(t, fe)
+
+	addrs := fe.Addrs()
+	if len(addrs) != 2 {
+		t.Fatalf("expected 2 sockets, got %d", len(addrs))
+	}
+	for _, addr := range addrs {
+		connect(t, addr)
+	}
+}
+
+// scrape sends a scrape request with the given connection ID to the frontend
+// and returns the action of the response.
+func scrape(t *testing.T, addr net.Addr, connID []byte) uint32 {
+	conn, err := net.Dial("udp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req := append(append([]byte{}, connID...), 0, 0, 0, 2, 1, 2, 3, 4)
+	req = append(req, make([]byte, 20)...)
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp := make([]byte, 64)
+	n, err := conn.Read(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n < 8 {
+		t.Fatalf("expected response of at least 8 bytes, got %d", n)
+	}
+	return binary.BigEndian.Uint32(resp[:4])
+}
+
+func TestConnectionIDExpiry(t *testing.T) {
+	c := clock.NewMock(time.Unix(1e9, 0))
+	fe := newFrontend(t, udp.Config{Addr: "127.0.0.1:0", MaxClockSkew: 10 * time.Second, Clock: c})
+	defer stopFrontend(t, fe)
+	addr := fe.Addrs()[0]
+
+	connID := connect(t, addr)
+	if action := scrape(t, addr, connID); action != 2 {
+		t.Fatalf("expected scrape action, got %d", action)
+	}
+
+	// Connection IDs are valid for two minutes.
+	c.Add(2 * time.Minute)
+	if action := scrape(t, addr, connID); action != 2 {
+		t.Fatalf("expected scrape action, got %d", action)
+	}
+
+	c.Add(time.Second)
+	if action := scrape(t, addr, connID); action != 3 {
+		t.Fatalf("expected error action, got %d", action)
+	}
+}
+
+// blockingLogic blocks scrapes until their context is canceled.
+type blockingLogic struct {
+	frontend.TrackerLogic
+	started  chan struct{}
+	canceled chan struct{}
+}
+
+func (l blockingLogic) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest) (context.Context, *bittorrent.ScrapeResponse, error) {
+	close(l.started)
+	<-ctx.Done()
+	close(l.canceled)
+	return ctx, nil, ctx.Err()
+}
+
+func TestStopDrainTimeout(t *testing.T) {
+	lgc := blockingLogic{started: make(chan struct{}), canceled: make(chan struct{})}
+	fe, err := udp.NewFrontend(lgc, udp.Config{
+		Addr:         "127.0.0.1:0",
+		DrainTimeout: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connID := connect(t, fe.Addrs()[0])
+	req := append(append([]byte{}, connID...), 0, 0, 0, 2, 1, 2, 3, 4)
+	req = append(req, make([]byte, 20)...)
+
+	conn, err := net.Dial("udp", fe.Addrs()[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-lgc.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("scrape was not handled")
+	}
+
+	errs := fe.Stop().Wait()
+	if len(errs) != 1 || errs[0] != frontend.ErrDrainTimeout {
+		t.Fatalf("expected %v, got %v", frontend.ErrDrainTimeout, errs)
+	}
+
+	select {
+	case <-lgc.canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("context of abandoned scrape was not canceled")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	if problems := (udp.Config{Addr: "127.0.0.1:0"}).Check(); len(problems) != 0 {
+		t.Fatal("unset values are problems:", problems)
+	}
+
+	problems := udp.Config{
+		Addr:           "127.0.0.1:0",
+		QueueSize:      -1,
+		DrainTimeout:   -time.Second,
+		ParseOptions:   udp.ParseOptions{MaxNumWant: 10, DefaultNumWant: 20},
+		RateLimitBurst: 5,
+		AccessLogPath:  "access.log",
+	}.Check()
+	if len(problems) != 4 {
+		t.Fatal("expected 4 problems, got", problems)
+	}
+
+	if _, err := udp.NewFrontend(nil, udp.Config{Addr: "127.0.0.1:0", Workers: -1}); err == nil {
+		t.Fatal("NewFrontend accepted a negative number of workers")
+	}
+}
+
+func TestWorkersPerCPU(t *testing.T) {
+	cfg := udp.Config{Addr: "127.0.0.1:0", WorkersPerCPU: 4}.Validate()
+	if cfg.Workers != 4*cpus.Available() {
+		t.Fatal("expected 4 workers per CPU, got", cfg.Workers)
+	}
+
+	// An explicit number of workers takes precedence.
+	cfg = udp.Config{Addr: "127.0.0.1:0", Workers: 3, WorkersPerCPU: 4}.Validate()
+	if cfg.Workers != 3 {
+		t.Fatal("expected 3 workers, got", cfg.Workers)
+	}
+}
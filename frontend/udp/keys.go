@@ -0,0 +1,125 @@
+package udp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// keyring holds pools of connection ID generators for the current key and,
+// if keys are rotated, the previous key.
+type keyring struct {
+	current  *sync.Pool
+	previous *sync.Pool
+}
+
+// newGeneratorPool returns a pool of connection ID generators using algorithm
+// and key. The algorithm must exist.
+func newGeneratorPool(algorithm, key string) *sync.Pool {
+	return &sync.Pool{
+		New: func() interface{} {
+			gen, err := NewConnectionIDGeneratorWithAlgorithm(algorithm, key)
+			if err != nil {
+				panic("udp: " + err.Error())
+			}
+			return gen
+		},
+	}
+}
+
+// generateKey returns a random key for connection IDs.
+func generateKey() string {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic("udp: failed to generate connection ID key: " + err.Error())
+	}
+	return hex.EncodeToString(key)
+}
+
+// keyring returns the keyring currently in use.
+func (t *Frontend) keyring() *keyring {
+	return t.keys.Load().(*keyring)
+}
+
+// validConnectionID determines whether a connection ID was generated for ip
+// with the current key or, during the grace period after a rotation, the
+// previous key.
+//
+// If connection IDs are cached, the HMACs of cached connection IDs aren't
+// computed again.
+func (t *Frontend) validConnectionID(connID []byte, ip net.IP, now time.Time) bool {
+	kr := t.keyring()
+	if t.connIDs != nil {
+		if connectionIDExpired(connID, now, t.MaxClockSkew) {
+			return false
+		}
+		if t.connIDs.contains(connID, ip, kr) {
+			recordConnectionIDCacheLookup(true)
+			return true
+		}
+		recordConnectionIDCacheLookup(false)
+	}
+
+	for _, pool := range []*sync.Pool{kr.current, kr.previous} {
+		if pool == nil {
+			continue
+		}
+
+		gen := pool.Get().(ConnectionIDGenerator)
+		valid := gen.Validate(connID, ip, now, t.MaxClockSkew)
+		pool.Put(gen)
+		if valid {
+			if t.connIDs != nil {
+				t.connIDs.add(connID, ip, pool)
+			}
+			return true
+		}
+	}
+
+	return false
+}
+
+// generateConnectionID writes a new connection ID for ip generated with the
+// current key to w.
+func (t *Frontend) generateConnectionID(w io.Writer, txID []byte, ip net.IP, now time.Time) {
+	pool := t.keyring().current
+	gen := pool.Get().(ConnectionIDGenerator)
+	connID := gen.Generate(ip, now)
+	if t.connIDs != nil {
+		t.connIDs.add(connID, ip, pool)
+	}
+	WriteConnectionID(w, txID, connID)
+	pool.Put(gen)
+}
+
+// rotateKeys replaces the key used to generate connection IDs every
+// KeyRotationInterval until Stop() is called.
+//
+// The previous key is still accepted until the next rotation, so that
+// connection IDs issued shortly before a rotation stay valid for their
+// lifetime.
+func (t *Frontend) rotateKeys() {
+	defer t.wg.Done()
+
+	for {
+		select {
+		case <-t.closing:
+			return
+		case <-t.Clock.After(t.KeyRotationInterval):
+			t.rotateKey()
+			logger.Debug("rotated connection ID key")
+		}
+	}
+}
+
+// rotateKey replaces the current key with a new one and retires the previous
+// key.
+func (t *Frontend) rotateKey() {
+	t.keys.Store(&keyring{
+		current:  newGeneratorPool(t.ConnectionIDAlgorithm, generateKey()),
+		previous: t.keyring().current,
+	})
+}
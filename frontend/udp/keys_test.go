@@ -0,0 +1,154 @@
+package udp
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyRotation(t *testing.T) {
+	f := &Frontend{Config: Config{MaxClockSkew: time.Minute, ConnectionIDAlgorithm: ConnectionIDAlgorithmSHA256}}
+	f.keys.Store(&keyring{current: newGeneratorPool(ConnectionIDAlgorithmSHA256, generateKey())})
+
+	ip := net.ParseIP("127.0.0.1").To4()
+	now := time.Now()
+	gen := f.keyring().current.Get().(ConnectionIDGenerator)
+	connID := append([]byte{}, gen.Generate(ip, now)...)
+	require.True(t, f.validConnectionID(connID, ip, now))
+
+	// The previous key is still accepted after a rotation.
+	f.rotateKey()
+	require.True(t, f.validConnectionID(connID, ip, now))
+
+	f.rotateKey()
+	require.False(t, f.validConnectionID(connID, ip, now))
+}
+
+func TestCachedConnectionIDs(t *testing.T) {
+	f := &Frontend{Config: Config{MaxClockSkew: time.Minute, ConnectionIDAlgorithm: ConnectionIDAlgorithmSHA256}, connIDs: newConnIDCache(1)}
+	f.keys.Store(&keyring{current: newGeneratorPool(ConnectionIDAlgorithmSHA256, generateKey())})
+
+	ip := net.ParseIP("127.0.0.1").To4()
+	now := time.Now()
+	var buf bytes.Buffer
+	f.generateConnectionID(&buf, []byte{0, 0, 0, 0}, ip, now)
+	connID := buf.Bytes()[8:16]
+	require.True(t, f.connIDs.contains(connID, ip, f.keyring()))
+	require.True(t, f.validConnectionID(connID, ip, now))
+
+	// Cached connection IDs still expire and are bound to their IP.
+	require.False(t, f.validConnectionID(connID, ip, now.Add(ttl+time.Second)))
+	require.False(t, f.validConnectionID(connID, net.ParseIP("127.0.0.2").To4(), now))
+
+	// Cached connection IDs are accepted as long as their key is.
+	f.rotateKey()
+	require.True(t, f.connIDs.contains(connID, ip, f.keyring()))
+	require.True(t, f.validConnectionID(connID, ip, now))
+	f.rotateKey()
+	require.False(t, f.validConnectionID(connID, ip, now))
+	require.Zero(t, f.connIDs.len())
+}
+
+func TestConnIDCacheEviction(t *testing.T) {
+	pool := newGeneratorPool(ConnectionIDAlgorithmSHA256, generateKey())
+	kr := &keyring{current: pool}
+	c := newConnIDCache(2 * connIDCacheStripes)
+	require.Len(t, c.stripes, connIDCacheStripes)
+	ip := net.ParseIP("10.0.0.1")
+
+	// The tokens of these connection IDs all select the first stripe, which
+	// holds two of them.
+	connID := func(i byte) []byte { return []byte{0, 0, 0, 0, 0, 0, 0, i * connIDCacheStripes} }
+	c.add(connID(1), ip, pool)
+	c.add(connID(2), ip, pool)
+	require.True(t, c.contains(connID(1), ip, kr))
+	c.add(connID(3), ip, pool)
+
+	require.True(t, c.contains(connID(1), ip, kr))
+	require.False(t, c.contains(connID(2), ip, kr))
+	require.True(t, c.contains(connID(3), ip, kr))
+
+	// Other stripes are unaffected.
+	c.add([]byte{0, 0, 0, 0, 0, 0, 0, 1}, ip, pool)
+	require.True(t, c.contains(connID(1), ip, kr))
+	require.True(t, c.contains(connID(3), ip, kr))
+	require.Equal(t, 3, c.len())
+}
+
+func TestConnIDCacheSize(t *testing.T) {
+	for _, size := range []int{1, 10, connIDCacheStripes, 1000} {
+		c := newConnIDCache(size)
+		total := 0
+		for i := range c.stripes {
+			total += c.stripes[i].size
+		}
+		require.Equal(t, size, total)
+	}
+}
+
+func BenchmarkFrontend_ValidConnectionID(b *testing.B) {
+	for _, bm := range []struct {
+		name      string
+		cacheSize int
+	}{
+		{"hmac", 0},
+		{"cached", 1024},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			f := &Frontend{Config: Config{MaxClockSkew: time.Minute, ConnectionIDAlgorithm: ConnectionIDAlgorithmSHA256}}
+			if bm.cacheSize > 0 {
+				f.connIDs = newConnIDCache(bm.cacheSize)
+			}
+			// Connection IDs of the previous key are the worst case, since
+			// they take two HMACs to validate without the cache.
+			f.keys.Store(&keyring{current: newGeneratorPool(ConnectionIDAlgorithmSHA256, generateKey())})
+			ip := net.ParseIP("127.0.0.1").To4()
+			now := time.Now()
+			var buf bytes.Buffer
+			f.generateConnectionID(&buf, []byte{0, 0, 0, 0}, ip, now)
+			connID := buf.Bytes()[8:16]
+			f.rotateKey()
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if !f.validConnectionID(connID, ip, now) {
+						b.FailNow()
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkConnIDCache_Parallel(b *testing.B) {
+	pool := newGeneratorPool(ConnectionIDAlgorithmSHA256, generateKey())
+	kr := &keyring{current: pool}
+	c := newConnIDCache(1 << 16)
+
+	// Every goroutine announces for its own clients, like the workers of a
+	// busy frontend.
+	var next uint32
+	b.RunParallel(func(pb *testing.PB) {
+		gen := pool.Get().(ConnectionIDGenerator)
+		worker := atomic.AddUint32(&next, 1)
+		connIDs := make([][]byte, 256)
+		ips := make([]net.IP, len(connIDs))
+		for i := range connIDs {
+			ips[i] = net.IPv4(10, byte(worker), byte(i), 1).To4()
+			connIDs[i] = append([]byte{}, gen.Generate(ips[i], time.Now())...)
+			c.add(connIDs[i], ips[i], pool)
+		}
+
+		for i := 0; pb.Next(); i++ {
+			j := i % len(connIDs)
+			if !c.contains(connIDs[j], ips[j], kr) {
+				b.FailNow()
+			}
+		}
+	})
+}
@@ -8,6 +8,8 @@ import (
 	"sync"
 
 	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/frontend"
+	"github.com/chihaya/chihaya/pkg/netutil"
 )
 
 const (
@@ -50,12 +52,19 @@ var (
 
 // ParseOptions is the configuration used to parse an Announce Request.
 //
-// If AllowIPSpoofing is true, IPs provided via params will be used.
+// IPs provided via params will be used if IPSpoofing allows it.
+// AllowIPSpoofing is deprecated and allows spoofing of all IPs if IPSpoofing
+// allows none.
+// If MaxExcludedPeers is not zero, up to that many peers provided via the
+// "exclude" and "exclude6" params of the URL data option are left out of the
+// response.
 type ParseOptions struct {
-	AllowIPSpoofing     bool   `yaml:"allow_ip_spoofing"`
-	MaxNumWant          uint32 `yaml:"max_numwant"`
-	DefaultNumWant      uint32 `yaml:"default_numwant"`
-	MaxScrapeInfoHashes uint32 `yaml:"max_scrape_infohashes"`
+	AllowIPSpoofing     bool                      `yaml:"allow_ip_spoofing"`
+	IPSpoofing          frontend.IPSpoofingPolicy `yaml:"ip_spoofing"`
+	MaxNumWant          uint32                    `yaml:"max_numwant"`
+	DefaultNumWant      uint32                    `yaml:"default_numwant"`
+	MaxScrapeInfoHashes uint32                    `yaml:"max_scrape_infohashes"`
+	MaxExcludedPeers    uint32                    `yaml:"max_excluded_peers"`
 }
 
 // Default parser config constants.
@@ -93,13 +102,18 @@ func ParseAnnounce(r Request, v6Action bool, opts ParseOptions) (*bittorrent.Ann
 
 	ip := r.IP
 	ipProvided := false
-	ipbytes := r.Packet[84:ipEnd]
-	if opts.AllowIPSpoofing {
-		// Make sure the bytes are copied to a new slice.
-		copy(ip, net.IP(ipbytes))
-		ipProvided = true
+	if opts.IPSpoofing.Enabled() {
+		// The asserted IP is a field of its own, which is only used instead
+		// of the address the packet was sent from if the policy allows it.
+		asserted, _ := netutil.ByteIP(r.Packet[84:ipEnd])
+
+		// Clients send 0 to use the address the packet was sent from.
+		if !asserted.IsUnspecified() && opts.IPSpoofing.Allows(r.IP, asserted) {
+			ip = asserted
+			ipProvided = true
+		}
 	}
-	if !opts.AllowIPSpoofing && r.IP == nil {
+	if ip == nil {
 		// We have no IP address to fallback on.
 		return nil, errMalformedIP
 	}
@@ -130,6 +144,13 @@ func ParseAnnounce(r Request, v6Action bool, opts ParseOptions) (*bittorrent.Ann
 		Params: params,
 	}
 
+	if opts.MaxExcludedPeers > 0 {
+		request.ExcludedPeers, err = bittorrent.ParseExcludedPeers(params, int(opts.MaxExcludedPeers))
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	if err := bittorrent.SanitizeAnnounce(request, opts.MaxNumWant, opts.DefaultNumWant); err != nil {
 		return nil, err
 	}
@@ -212,8 +233,14 @@ func ParseScrape(r Request, opts ParseOptions) (*bittorrent.ScrapeRequest, error
 		return nil, errMalformedPacket
 	}
 
+	// Check the number of infohashes before allocating a list for them.
+	n := len(r.Packet) / 20
+	if n > int(opts.MaxScrapeInfoHashes) {
+		return nil, bittorrent.ErrTooManyInfoHashes
+	}
+
 	// Allocate a list of infohashes and append it to the list until we're out.
-	var infohashes []bittorrent.InfoHash
+	infohashes := make([]bittorrent.InfoHash, 0, n)
 	for len(r.Packet) >= 20 {
 		infohashes = append(infohashes, bittorrent.InfoHashFromBytes(r.Packet[:20]))
 		r.Packet = r.Packet[20:]
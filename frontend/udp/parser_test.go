@@ -2,7 +2,13 @@ package udp
 
 import (
 	"fmt"
+	"net"
 	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/frontend"
 )
 
 var table = []struct {
@@ -74,3 +80,58 @@ func TestHandleOptionalParameters(t *testing.T) {
 		})
 	}
 }
+
+func TestParseScrapeMaxInfoHashes(t *testing.T) {
+	opts := ParseOptions{MaxScrapeInfoHashes: 2}
+	for n, expected := range []error{errMalformedPacket, nil, nil, bittorrent.ErrTooManyInfoHashes} {
+		packet := make([]byte, 16+20*n)
+		req, err := ParseScrape(Request{Packet: packet}, opts)
+		if err != expected {
+			t.Fatalf("expected %v for %d infohashes, got %v", expected, n, err)
+		}
+		if err == nil && len(req.InfoHashes) != n {
+			t.Fatalf("expected %d infohashes, got %d", n, len(req.InfoHashes))
+		}
+	}
+}
+
+func TestParseAnnounceIP(t *testing.T) {
+	allowAll := ParseOptions{
+		IPSpoofing:     frontend.IPSpoofingPolicy{AllowIPv4: true, AllowIPv6: true},
+		MaxNumWant:     50,
+		DefaultNumWant: 50,
+	}
+
+	var table = []struct {
+		source   net.IP
+		asserted net.IP
+		v6Action bool
+		opts     ParseOptions
+		expected net.IP
+		af       bittorrent.AddressFamily
+		provided bool
+	}{
+		// The asserted IP is ignored unless spoofing is allowed.
+		{net.IP{203, 0, 113, 1}, net.IP{198, 51, 100, 1}, false, ParseOptions{MaxNumWant: 50}, net.IP{203, 0, 113, 1}, bittorrent.IPv4, false},
+		{net.IP{203, 0, 113, 1}, net.IP{198, 51, 100, 1}, false, allowAll, net.IP{198, 51, 100, 1}, bittorrent.IPv4, true},
+		{net.IP{203, 0, 113, 1}, net.IPv4zero.To4(), false, allowAll, net.IP{203, 0, 113, 1}, bittorrent.IPv4, false},
+		{net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), true, allowAll, net.ParseIP("2001:db8::2"), bittorrent.IPv6, true},
+		{net.ParseIP("2001:db8::1"), net.IPv6zero, true, allowAll, net.ParseIP("2001:db8::1"), bittorrent.IPv6, false},
+		// IPv4 addresses mapped to IPv6 are IPv4 addresses.
+		{net.ParseIP("2001:db8::1"), net.ParseIP("::ffff:198.51.100.1"), true, allowAll, net.IP{198, 51, 100, 1}, bittorrent.IPv4, true},
+	}
+
+	for _, tt := range table {
+		t.Run(fmt.Sprintf("%s asserting %s", tt.source, tt.asserted), func(t *testing.T) {
+			packet := make([]byte, 84, 84+len(tt.asserted)+10)
+			packet = append(packet, tt.asserted...)
+			packet = append(packet, 0, 0, 0, 0, 0, 0, 0, 1, 0x1a, 0xe1)
+
+			req, err := ParseAnnounce(Request{Packet: packet, IP: tt.source}, tt.v6Action, tt.opts)
+			require.Nil(t, err)
+			require.Equal(t, tt.expected, req.Peer.IP.IP)
+			require.Equal(t, tt.af, req.Peer.IP.AddressFamily)
+			require.Equal(t, tt.provided, req.IPProvided)
+		})
+	}
+}
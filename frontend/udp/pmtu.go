@@ -0,0 +1,96 @@
+package udp
+
+import (
+	"container/list"
+	"net"
+	"sync"
+
+	"github.com/chihaya/chihaya/pkg/netutil"
+)
+
+// The minimum MTUs every link must support, which responses to destinations
+// with a path MTU smaller than assumed are trimmed to.
+const (
+	minIPv4MTU = 576
+	minIPv6MTU = 1280
+)
+
+// headerSize returns the size of the IP and UDP headers of a datagram sent to
+// ip.
+func headerSize(ip net.IP) int {
+	if netutil.FamilyOf(ip) == netutil.IPv4 {
+		return 20 + 8
+	}
+	return 40 + 8
+}
+
+// pathMTUCache holds the path MTUs of the destinations that responses were
+// too large for.
+//
+// Only the most recently seen destinations are kept. If a destination is
+// evicted from the cache, its path MTU is discovered again.
+type pathMTUCache struct {
+	size int
+
+	mu   sync.Mutex
+	mtus map[string]*list.Element
+	lru  *list.List
+}
+
+// pathMTU is the path MTU of a destination.
+type pathMTU struct {
+	ip  string
+	mtu int
+}
+
+// newPathMTUCache creates a pathMTUCache for up to size destinations.
+func newPathMTUCache(size int) *pathMTUCache {
+	return &pathMTUCache{
+		size: size,
+		mtus: make(map[string]*list.Element, size),
+		lru:  list.New(),
+	}
+}
+
+// get returns the path MTU of ip, if it was discovered.
+func (c *pathMTUCache) get(ip net.IP) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.mtus[string(ip)]
+	if !ok {
+		return 0, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*pathMTU).mtu, true
+}
+
+// shrink records that the path MTU of ip is smaller than the size of the
+// responses sent to it so far.
+//
+// The kernel doesn't tell which size would have fit, so the minimum MTU of
+// the address family is assumed.
+func (c *pathMTUCache) shrink(ip net.IP) {
+	mtu := minIPv6MTU
+	if netutil.FamilyOf(ip) == netutil.IPv4 {
+		mtu = minIPv4MTU
+	}
+	key := string(ip)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.mtus[key]; ok {
+		c.lru.MoveToFront(e)
+		e.Value.(*pathMTU).mtu = mtu
+		return
+	}
+
+	if c.lru.Len() >= c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.mtus, oldest.Value.(*pathMTU).ip)
+	}
+	c.mtus[key] = c.lru.PushFront(&pathMTU{ip: key, mtu: mtu})
+	recordPathMTUShrunk()
+}
@@ -0,0 +1,43 @@
+package udp
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const pathMTUDiscoverySupported = true
+
+// enablePathMTUDiscovery sets the Don't Fragment flag on the datagrams sent
+// from socket, so that the kernel rejects datagrams larger than the path MTU
+// it learned for their destination instead of fragmenting them.
+func enablePathMTUDiscovery(socket *net.UDPConn) error {
+	rc, err := socket.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_DO)
+		if sockErr != nil {
+			return
+		}
+
+		if ip, ok := socket.LocalAddr().(*net.UDPAddr); ok && ip.IP.To4() == nil {
+			sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_DO)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// isMessageTooLong reports whether err was caused by a datagram that is
+// larger than the path MTU to its destination.
+func isMessageTooLong(err error) bool {
+	return errors.Is(err, syscall.EMSGSIZE)
+}
@@ -0,0 +1,28 @@
+package udp
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestEnablePathMTUDiscovery(t *testing.T) {
+	for _, network := range []string{"udp", "udp4"} {
+		socket, err := net.ListenUDP(network, nil)
+		require.Nil(t, err)
+		defer socket.Close()
+
+		require.Nil(t, enablePathMTUDiscovery(socket))
+
+		rc, err := socket.SyscallConn()
+		require.Nil(t, err)
+		var value int
+		require.Nil(t, rc.Control(func(fd uintptr) {
+			value, err = unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER)
+		}))
+		require.Nil(t, err)
+		require.Equal(t, unix.IP_PMTUDISC_DO, value)
+	}
+}
@@ -0,0 +1,22 @@
+// +build !linux
+
+package udp
+
+import (
+	"errors"
+	"net"
+)
+
+const pathMTUDiscoverySupported = false
+
+// enablePathMTUDiscovery fails, because path MTU discovery is only supported
+// on Linux.
+func enablePathMTUDiscovery(socket *net.UDPConn) error {
+	return errors.New("udp: path MTU discovery is not supported on this platform")
+}
+
+// isMessageTooLong always returns false, because path MTU discovery is only
+// supported on Linux.
+func isMessageTooLong(err error) bool {
+	return false
+}
@@ -9,9 +9,48 @@ import (
 )
 
 func init() {
-	prometheus.MustRegister(promResponseDurationMilliseconds)
+	prometheus.MustRegister(
+		promResponseDurationMilliseconds,
+		promStageDurationMilliseconds,
+		promQueueDepth,
+		promDroppedPacketsTotal,
+		promSocketReceiveQueueBytes,
+		promSocketDropsTotal,
+		promSocketReceiveBufferBytes,
+		promClampedValuesTotal,
+		promTruncatedResponsesTotal,
+		promPathMTUsShrunkTotal,
+		promConnectionIDCacheLookupsTotal,
+		promTemporaryReadErrorsTotal,
+		promDegradedSockets,
+		promWriteErrorsTotal,
+		promWriteRetriesTotal,
+		promICMPErrorsTotal,
+	)
 }
 
+// Reasons for dropping a packet without responding to it.
+const (
+	dropReasonQueueFull        = "queue_full"
+	dropReasonRateLimited      = "rate_limited"
+	dropReasonResponseTooLarge = "response_too_large"
+	dropReasonSendQueueFull    = "send_queue_full"
+)
+
+// Stages of handling a packet, besides handling the request itself.
+const (
+	stageReceiveQueue = "receive_queue"
+	stageSendQueue    = "send_queue"
+	stageWrite        = "write"
+)
+
+// Reasons for truncating the peers of an announce response.
+const (
+	truncateReasonResponseSize = "response_size"
+	truncateReasonMaxPeers     = "max_peers"
+	truncateReasonNumWant      = "numwant"
+)
+
 var promResponseDurationMilliseconds = prometheus.NewHistogramVec(
 	prometheus.HistogramOpts{
 		Name:    "chihaya_udp_response_duration_milliseconds",
@@ -21,6 +60,109 @@ var promResponseDurationMilliseconds = prometheus.NewHistogramVec(
 	[]string{"action", "address_family", "error"},
 )
 
+var promStageDurationMilliseconds = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "chihaya_udp_stage_duration_milliseconds",
+		Help:    "The duration of time packets spend waiting in queues and responses spend being written",
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 10),
+	},
+	[]string{"stage"},
+)
+
+var promQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "chihaya_udp_queue_depth",
+	Help: "The number of packets waiting to be handled by a worker",
+})
+
+var promDroppedPacketsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "chihaya_udp_dropped_packets_total",
+		Help: "The number of packets dropped without a response",
+	},
+	[]string{"reason"},
+)
+
+var promSocketReceiveQueueBytes = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "chihaya_udp_socket_receive_queue_bytes",
+		Help: "The number of bytes waiting in the kernel receive buffer of a socket",
+	},
+	[]string{"socket"},
+)
+
+var promSocketDropsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "chihaya_udp_socket_drops_total",
+		Help: "The number of packets dropped by the kernel before they could be read from a socket",
+	},
+	[]string{"socket"},
+)
+
+var promSocketReceiveBufferBytes = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "chihaya_udp_socket_receive_buffer_bytes",
+		Help: "The size of the kernel receive buffer of a socket, if it is tuned",
+	},
+	[]string{"socket"},
+)
+
+var promClampedValuesTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "chihaya_udp_clamped_values_total",
+		Help: "The number of values clamped to fit into the fields of a response",
+	},
+	[]string{"field"},
+)
+
+var promTruncatedResponsesTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "chihaya_udp_truncated_responses_total",
+		Help: "The number of announce responses whose peers were truncated",
+	},
+	[]string{"reason"},
+)
+
+var promPathMTUsShrunkTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "chihaya_udp_path_mtus_shrunk_total",
+	Help: "The number of destinations whose path MTU was discovered to be smaller than assumed",
+})
+
+// recordPathMTUShrunk records a destination whose path MTU was discovered to
+// be smaller than assumed.
+func recordPathMTUShrunk() {
+	promPathMTUsShrunkTotal.Inc()
+}
+
+// recordTruncatedResponse records an announce response whose peers were
+// truncated for the given reason.
+func recordTruncatedResponse(reason string) {
+	promTruncatedResponsesTotal.WithLabelValues(reason).Inc()
+}
+
+// recordSocketStats records the kernel statistics of the socket with the
+// given index, of which newDrops packets were dropped since they were last
+// recorded.
+func recordSocketStats(socket string, stats socketStats, newDrops uint64) {
+	promSocketReceiveQueueBytes.WithLabelValues(socket).Set(float64(stats.rxQueue))
+	promSocketDropsTotal.WithLabelValues(socket).Add(float64(newDrops))
+}
+
+// recordReadBufferSize records the receive buffer size of the socket with
+// the given index.
+func recordReadBufferSize(socket string, size int) {
+	promSocketReceiveBufferBytes.WithLabelValues(socket).Set(float64(size))
+}
+
+// recordQueueDepth records the number of packets waiting in the queue.
+func recordQueueDepth(depth int) {
+	promQueueDepth.Set(float64(depth))
+}
+
+// recordDroppedPacket records a packet that was dropped for the given reason.
+func recordDroppedPacket(reason string) {
+	promDroppedPacketsTotal.WithLabelValues(reason).Inc()
+}
+
 // recordResponseDuration records the duration of time to respond to a UDP
 // Request in milliseconds.
 func recordResponseDuration(action string, af *bittorrent.AddressFamily, err error, duration time.Duration) {
@@ -46,3 +188,111 @@ func recordResponseDuration(action string, af *bittorrent.AddressFamily, err err
 		WithLabelValues(action, afString, errString).
 		Observe(float64(duration.Nanoseconds()) / float64(time.Millisecond))
 }
+
+// recordStageDuration records the duration of a stage of handling a packet.
+func recordStageDuration(stage string, duration time.Duration) {
+	promStageDurationMilliseconds.
+		WithLabelValues(stage).
+		Observe(float64(duration.Nanoseconds()) / float64(time.Millisecond))
+}
+
+// recordQueued records the time a response waited to be written, if it was
+// recorded.
+func recordQueued(o outgoing) {
+	if !o.queued.IsZero() {
+		recordStageDuration(stageSendQueue, time.Since(o.queued))
+	}
+}
+
+// recordClampedValue records a value of the given field of a response that
+// was clamped to fit into the field.
+func recordClampedValue(field string) {
+	promClampedValuesTotal.WithLabelValues(field).Inc()
+}
+
+var promConnectionIDCacheLookupsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "chihaya_udp_connection_id_cache_lookups_total",
+		Help: "The number of connection IDs looked up in the cache of recently issued connection IDs",
+	},
+	[]string{"result"},
+)
+
+// recordConnectionIDCacheLookup records a lookup of a connection ID in the
+// cache of recently issued connection IDs.
+func recordConnectionIDCacheLookup(hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	promConnectionIDCacheLookupsTotal.WithLabelValues(result).Inc()
+}
+
+var promTemporaryReadErrorsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "chihaya_udp_temporary_read_errors_total",
+	Help: "The number of temporary errors reading from a socket, each followed by a backoff",
+})
+
+var promDegradedSockets = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "chihaya_udp_degraded_sockets",
+	Help: "The number of sockets whose reads are backing off after temporary errors",
+})
+
+// recordTemporaryReadError records a temporary error reading from a socket.
+func recordTemporaryReadError() {
+	promTemporaryReadErrorsTotal.Inc()
+}
+
+// recordDegradedSocket records a socket entering or leaving the degraded
+// state after temporary errors.
+func recordDegradedSocket(degraded bool) {
+	if degraded {
+		promDegradedSockets.Inc()
+	} else {
+		promDegradedSockets.Dec()
+	}
+}
+
+var promWriteErrorsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "chihaya_udp_write_errors_total",
+		Help: "The number of responses that could not be written, by the type of error",
+	},
+	[]string{"error"},
+)
+
+var promWriteRetriesTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "chihaya_udp_write_retries_total",
+		Help: "The number of responses written once more after a lack of buffer space",
+	},
+	[]string{"result"},
+)
+
+// recordWriteError records a response that could not be written.
+func recordWriteError(typ string) {
+	promWriteErrorsTotal.WithLabelValues(typ).Inc()
+}
+
+// recordWriteRetry records a response written once more after a lack of
+// buffer space.
+func recordWriteRetry(succeeded bool) {
+	result := "failure"
+	if succeeded {
+		result = "success"
+	}
+	promWriteRetriesTotal.WithLabelValues(result).Inc()
+}
+
+var promICMPErrorsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "chihaya_udp_icmp_errors_total",
+		Help: "The number of ICMP errors reported for sent responses, if enabled",
+	},
+	[]string{"error"},
+)
+
+// recordICMPError records an ICMP error reported for a sent response.
+func recordICMPError(typ string) {
+	promICMPErrorsTotal.WithLabelValues(typ).Inc()
+}
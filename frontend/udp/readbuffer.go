@@ -0,0 +1,99 @@
+package udp
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// readBufferTuner grows the receive buffers of sockets whose kernel dropped
+// packets because the buffer was full, up to a maximum.
+//
+// It is driven by reportSocketStats, so buffers grow at most once per
+// SocketStatsInterval.
+type readBufferTuner struct {
+	max int
+
+	// sizes are the current buffer sizes of the sockets and drops the drop
+	// counters of their last statistics. A socket whose size is max is not
+	// tuned anymore.
+	sizes []int
+	drops []uint64
+	seen  []bool
+
+	// set sets the buffer size of a socket and returns the size the kernel
+	// actually used, which may be capped by the system.
+	set func(socket *net.UDPConn, size int) (int, error)
+}
+
+// newReadBufferTuner returns a readBufferTuner for sockets, or nil if the
+// buffer sizes can't be read, which is logged.
+func newReadBufferTuner(sockets []*net.UDPConn, max int) *readBufferTuner {
+	t := &readBufferTuner{
+		max:   max,
+		sizes: make([]int, len(sockets)),
+		drops: make([]uint64, len(sockets)),
+		seen:  make([]bool, len(sockets)),
+		set:   setReadBufferSize,
+	}
+	for i, socket := range sockets {
+		size, err := readBufferSize(socket)
+		if err != nil {
+			logger.Error("failed to read socket receive buffer size; not tuning it", log.Err(err))
+			return nil
+		}
+		t.sizes[i] = size
+		recordReadBufferSize(strconv.Itoa(i), size)
+	}
+	return t
+}
+
+// observe grows the buffer of the socket with the given index if the kernel
+// dropped packets since it was last observed.
+//
+// Drops counted before the first observation are ignored, since they may be
+// older than the current buffer size.
+func (t *readBufferTuner) observe(i int, socket *net.UDPConn, stats socketStats) {
+	drops, seen := t.drops[i], t.seen[i]
+	t.drops[i], t.seen[i] = stats.drops, true
+	if !seen || stats.drops <= drops || t.sizes[i] >= t.max {
+		return
+	}
+
+	size := 2 * t.sizes[i]
+	if size > t.max {
+		size = t.max
+	}
+	actual, err := t.set(socket, size)
+	if err != nil {
+		logger.Error("failed to grow socket receive buffer", log.Err(err))
+		return
+	}
+
+	fields := log.Fields{
+		"socket":   i,
+		"previous": t.sizes[i],
+		"size":     actual,
+		"drops":    stats.drops - drops,
+	}
+	if actual <= t.sizes[i] {
+		// Growing is pointless until the system limit is raised.
+		t.sizes[i] = t.max
+		logger.Warn("socket receive buffer is limited by the system (net.core.rmem_max on Linux); not growing it anymore", fields)
+		return
+	}
+
+	t.sizes[i] = actual
+	recordReadBufferSize(strconv.Itoa(i), actual)
+	logger.Info("grew socket receive buffer after the kernel dropped packets", fields)
+}
+
+// setReadBufferSize sets the receive buffer size of socket and returns the
+// size the kernel uses.
+func setReadBufferSize(socket *net.UDPConn, size int) (int, error) {
+	if err := socket.SetReadBuffer(size); err != nil {
+		return 0, err
+	}
+	return readBufferSize(socket)
+}
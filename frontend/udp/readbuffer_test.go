@@ -0,0 +1,51 @@
+package udp
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadBufferTuner(t *testing.T) {
+	var set []int
+	limit := 1 << 20
+	tuner := &readBufferTuner{
+		max:   3000,
+		sizes: []int{1000},
+		drops: make([]uint64, 1),
+		seen:  make([]bool, 1),
+		set: func(socket *net.UDPConn, size int) (int, error) {
+			set = append(set, size)
+			if size > limit {
+				size = limit
+			}
+			return size, nil
+		},
+	}
+
+	// Drops before the first observation are ignored.
+	tuner.observe(0, nil, socketStats{drops: 10})
+	require.Nil(t, set)
+
+	// The buffer is only grown if packets were dropped since.
+	tuner.observe(0, nil, socketStats{drops: 10})
+	require.Nil(t, set)
+	tuner.observe(0, nil, socketStats{drops: 11})
+	require.Equal(t, []int{2000}, set)
+
+	// The buffer doesn't grow beyond the maximum.
+	tuner.observe(0, nil, socketStats{drops: 12})
+	tuner.observe(0, nil, socketStats{drops: 13})
+	require.Equal(t, []int{2000, 3000}, set)
+	require.Equal(t, 3000, tuner.sizes[0])
+
+	// Tuning stops once the system doesn't grow the buffer anymore.
+	limit = 4000
+	tuner.max = 16000
+	tuner.observe(0, nil, socketStats{drops: 14})
+	tuner.observe(0, nil, socketStats{drops: 15})
+	tuner.observe(0, nil, socketStats{drops: 16})
+	require.Equal(t, []int{2000, 3000, 6000, 8000}, set)
+	require.Equal(t, 16000, tuner.sizes[0])
+}
@@ -0,0 +1,47 @@
+package udp
+
+import (
+	"net"
+	"time"
+)
+
+// writeResponses writes the responses sent to out one at a time until out is
+// closed or the Frontend abandons in-flight requests.
+//
+// Several senders write the responses of a socket, so that a full send
+// buffer delays only the senders, not the workers.
+func (t *Frontend) writeResponses(socket *net.UDPConn, out <-chan outgoing) {
+	defer t.sendWG.Done()
+
+	for {
+		select {
+		case o, ok := <-out:
+			if !ok {
+				return
+			}
+			t.writeResponse(socket, o)
+		case <-t.ctx.Done():
+			// Responses of abandoned requests are discarded.
+			return
+		}
+	}
+}
+
+// writeResponse writes a single queued response.
+func (t *Frontend) writeResponse(socket *net.UDPConn, o outgoing) {
+	defer buffers.Put(o.buffer)
+	recordQueued(o)
+
+	var start time.Time
+	if t.EnableRequestTiming {
+		start = time.Now()
+	}
+	err := writeResponseTo(socket, *o.buffer, o.addr, t.RetryWrites)
+	if !start.IsZero() {
+		recordStageDuration(stageWrite, time.Since(start))
+	}
+
+	if err != nil {
+		writeFailed(err, o.addr, t.pathMTUs)
+	}
+}
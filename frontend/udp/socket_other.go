@@ -0,0 +1,14 @@
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package udp
+
+import (
+	"errors"
+	"syscall"
+)
+
+// reusePortControl fails, because SO_REUSEPORT is not supported on this
+// platform.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errors.New("udp: multiple listeners are not supported on this platform")
+}
@@ -0,0 +1,47 @@
+package udp
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// setSocketOptions applies the configured write buffer size, type of service
+// and error reporting to socket.
+func (t *Frontend) setSocketOptions(socket *net.UDPConn) error {
+	if t.WriteBufferSize > 0 {
+		if err := socket.SetWriteBuffer(t.WriteBufferSize); err != nil {
+			return err
+		}
+	}
+
+	if t.TOS > 0 {
+		if err := setTOS(socket, t.TOS); err != nil {
+			return err
+		}
+	}
+
+	if t.RecvErr {
+		if err := enableRecvErr(socket); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setTOS sets the type of service of the IPv4 datagrams and the traffic class
+// of the IPv6 datagrams sent from socket.
+func setTOS(socket *net.UDPConn, tos int) error {
+	if addr, ok := socket.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+		return ipv4.NewConn(socket).SetTOS(tos)
+	}
+
+	if err := ipv6.NewConn(socket).SetTrafficClass(tos); err != nil {
+		return err
+	}
+	// A dual-stack socket also sends IPv4 datagrams. Sockets bound to IPv6
+	// only may not accept the IPv4 option.
+	_ = ipv4.NewConn(socket).SetTOS(tos)
+	return nil
+}
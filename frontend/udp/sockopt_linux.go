@@ -0,0 +1,60 @@
+package udp
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const recvErrSupported = true
+
+// enableRecvErr makes the kernel report the ICMP errors caused by datagrams
+// sent from socket, which are returned by the next read from it.
+func enableRecvErr(socket *net.UDPConn) error {
+	rc, err := socket.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	addr, _ := socket.LocalAddr().(*net.UDPAddr)
+	ipv4Only := addr != nil && addr.IP.To4() != nil
+
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		if !ipv4Only {
+			sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_RECVERR, 1)
+			if sockErr != nil {
+				return
+			}
+		}
+
+		// Dual-stack sockets need the IPv4 option as well, which sockets
+		// bound to IPv6 only may reject.
+		if err := unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_RECVERR, 1); err != nil && ipv4Only {
+			sockErr = err
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// isICMPError reports whether err is an ICMP error reported for a datagram
+// sent earlier instead of an error reading from the socket.
+func isICMPError(err error) bool {
+	for _, errno := range []syscall.Errno{
+		syscall.ECONNREFUSED,
+		syscall.EHOSTUNREACH,
+		syscall.ENETUNREACH,
+		syscall.EMSGSIZE,
+		syscall.EPROTO,
+	} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
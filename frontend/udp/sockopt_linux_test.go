@@ -0,0 +1,64 @@
+package udp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestSetSocketOptions(t *testing.T) {
+	f := &Frontend{Config: Config{WriteBufferSize: 65536, TOS: 0x10, RecvErr: true}}
+	for _, network := range []string{"udp", "udp4"} {
+		socket, err := net.ListenUDP(network, nil)
+		require.Nil(t, err)
+		defer socket.Close()
+
+		require.Nil(t, f.setSocketOptions(socket))
+
+		rc, err := socket.SyscallConn()
+		require.Nil(t, err)
+		var tos, recvErr, sndbuf int
+		require.Nil(t, rc.Control(func(fd uintptr) {
+			tos, _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS)
+			recvErr, _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_RECVERR)
+			sndbuf, _ = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF)
+		}))
+		require.Equal(t, 0x10, tos)
+		require.Equal(t, 1, recvErr)
+		// The kernel doubles the requested size for its own bookkeeping,
+		// but caps it at net.core.wmem_max.
+		require.True(t, sndbuf > 0)
+
+		if network == "udp" {
+			var tclass int
+			require.Nil(t, rc.Control(func(fd uintptr) {
+				tclass, _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_TCLASS)
+			}))
+			require.Equal(t, 0x10, tclass)
+		}
+	}
+}
+
+func TestICMPErrorsAreReported(t *testing.T) {
+	socket, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.Nil(t, err)
+	defer socket.Close()
+	require.Nil(t, enableRecvErr(socket))
+
+	// Nothing listens on the port of a closed socket, so the kernel answers
+	// with an ICMP port unreachable error.
+	closed, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.Nil(t, err)
+	addr := closed.LocalAddr().(*net.UDPAddr)
+	closed.Close()
+
+	_, err = socket.WriteToUDP([]byte("ping"), addr)
+	require.Nil(t, err)
+	require.Nil(t, socket.SetReadDeadline(time.Now().Add(time.Second)))
+	_, _, err = socket.ReadFromUDP(make([]byte, 16))
+	require.True(t, isICMPError(err), "%v", err)
+	require.Equal(t, writeErrorRefused, writeErrorType(err))
+}
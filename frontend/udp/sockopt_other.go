@@ -0,0 +1,22 @@
+// +build !linux
+
+package udp
+
+import (
+	"errors"
+	"net"
+)
+
+const recvErrSupported = false
+
+// enableRecvErr fails, because reporting ICMP errors is only supported on
+// Linux.
+func enableRecvErr(socket *net.UDPConn) error {
+	return errors.New("udp: reporting ICMP errors is not supported on this platform")
+}
+
+// isICMPError always returns false, because reporting ICMP errors is only
+// supported on Linux.
+func isICMPError(err error) bool {
+	return false
+}
@@ -0,0 +1,68 @@
+package udp
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// socketStats are the statistics the kernel keeps for a socket.
+type socketStats struct {
+	// rxQueue is the number of bytes waiting in the receive buffer.
+	rxQueue uint64
+
+	// drops is the number of packets dropped by the kernel since the socket
+	// was created, usually because the receive buffer was full.
+	drops uint64
+}
+
+// reportSocketStats periodically exports the kernel statistics of the
+// sockets of the Frontend until Stop() is called.
+//
+// Unlike the dropped packets counted by the Frontend itself, these are
+// packets that never made it out of the kernel.
+func (t *Frontend) reportSocketStats() {
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(t.SocketStatsInterval)
+	defer ticker.Stop()
+
+	// The kernel counts the drops of a socket since it was created, while
+	// they are exported as a counter of the process. Sockets inherited on an
+	// upgrade may have dropped packets before, which are counted as well.
+	var drops []uint64
+
+	for {
+		select {
+		case <-t.closing:
+			return
+		case <-ticker.C:
+			stats, err := readSocketStats(t.sockets)
+			if err != nil {
+				logger.Error("failed to read socket statistics", log.Err(err))
+				continue
+			}
+			if drops == nil {
+				drops = make([]uint64, len(stats))
+			}
+			for i, s := range stats {
+				recordSocketStats(strconv.Itoa(i), s, newDrops(drops[i], s.drops))
+				drops[i] = s.drops
+				if t.readBuffers != nil {
+					t.readBuffers.observe(i, t.sockets[i], s)
+				}
+			}
+		}
+	}
+}
+
+// newDrops returns the number of packets dropped since the drops of a socket
+// were last counted, given the last and the current count. A count that went backwards belongs to a new
+// socket, so all of its drops are new.
+func newDrops(last, current uint64) uint64 {
+	if current < last {
+		return current
+	}
+	return current - last
+}
@@ -0,0 +1,137 @@
+package udp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const socketStatsSupported = true
+
+// procNetUDPFiles are the files the kernel uses to expose the state of UDP
+// sockets in the current network namespace.
+var procNetUDPFiles = []string{"/proc/net/udp", "/proc/net/udp6"}
+
+// readSocketStats reads the kernel statistics of the given sockets.
+func readSocketStats(sockets []*net.UDPConn) ([]socketStats, error) {
+	inodes := make(map[uint64]int, len(sockets))
+	for i, socket := range sockets {
+		inode, err := socketInode(socket)
+		if err != nil {
+			return nil, err
+		}
+		inodes[inode] = i
+	}
+
+	stats := make([]socketStats, len(sockets))
+	for _, name := range procNetUDPFiles {
+		f, err := os.Open(name)
+		if os.IsNotExist(err) {
+			// IPv6 may be disabled.
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		err = parseSocketStats(f, inodes, stats)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return stats, nil
+}
+
+// socketInode returns the inode number identifying a socket in
+// /proc/net/udp.
+func socketInode(socket *net.UDPConn) (uint64, error) {
+	rc, err := socket.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var st unix.Stat_t
+	var statErr error
+	err = rc.Control(func(fd uintptr) {
+		statErr = unix.Fstat(int(fd), &st)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return st.Ino, statErr
+}
+
+// parseSocketStats parses the contents of /proc/net/udp or /proc/net/udp6
+// and fills stats for every socket whose inode is in inodes.
+//
+// Each line after the header looks like this:
+//
+//	sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+//	12: 00000000:1B39 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 24587 2 0000000000000000 0
+func parseSocketStats(r io.Reader, inodes map[uint64]int, stats []socketStats) error {
+	scanner := bufio.NewScanner(r)
+
+	// Skip the header.
+	scanner.Scan()
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 13 {
+			return fmt.Errorf("udp: malformed socket statistics line: %q", scanner.Text())
+		}
+
+		inode, err := strconv.ParseUint(fields[9], 10, 64)
+		if err != nil {
+			return err
+		}
+		i, ok := inodes[inode]
+		if !ok {
+			continue
+		}
+
+		queues := strings.SplitN(fields[4], ":", 2)
+		if len(queues) != 2 {
+			return fmt.Errorf("udp: malformed socket queue sizes: %q", fields[4])
+		}
+		rxQueue, err := strconv.ParseUint(queues[1], 16, 64)
+		if err != nil {
+			return err
+		}
+
+		drops, err := strconv.ParseUint(fields[12], 10, 64)
+		if err != nil {
+			return err
+		}
+
+		stats[i] = socketStats{rxQueue: rxQueue, drops: drops}
+	}
+
+	return scanner.Err()
+}
+
+// readBufferSize returns the receive buffer size of socket.
+//
+// The kernel reports twice the size that was set, since it accounts for its
+// own overhead, so the size is halved to match SetReadBuffer.
+func readBufferSize(socket *net.UDPConn) (int, error) {
+	rc, err := socket.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var size int
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		size, sockErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return size / 2, sockErr
+}
@@ -0,0 +1,47 @@
+package udp
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const procNetUDP = `   sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops             
+   12: 00000000:1B39 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 24587 2 0000000000000000 0          
+   13: 0100007F:1B39 00000000:0000 07 00000000:00001A00 00:00000000 00000000     0        0 24588 2 0000000000000000 42         
+   14: 0100007F:0035 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 11111 2 0000000000000000 7          
+`
+
+func TestParseSocketStats(t *testing.T) {
+	stats := make([]socketStats, 2)
+	err := parseSocketStats(strings.NewReader(procNetUDP), map[uint64]int{24587: 0, 24588: 1}, stats)
+	require.Nil(t, err)
+	require.Equal(t, []socketStats{{0, 0}, {0x1A00, 42}}, stats)
+}
+
+func TestReadSocketStats(t *testing.T) {
+	socket, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.Nil(t, err)
+	defer socket.Close()
+
+	// Leave a packet in the receive buffer.
+	_, err = socket.WriteToUDP([]byte("ping"), socket.LocalAddr().(*net.UDPAddr))
+	require.Nil(t, err)
+
+	stats, err := readSocketStats([]*net.UDPConn{socket})
+	require.Nil(t, err)
+	require.Len(t, stats, 1)
+	require.NotZero(t, stats[0].rxQueue)
+}
+
+func TestReadBufferSize(t *testing.T) {
+	socket, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.Nil(t, err)
+	defer socket.Close()
+
+	size, err := setReadBufferSize(socket, 65536)
+	require.Nil(t, err)
+	require.Equal(t, 65536, size)
+}
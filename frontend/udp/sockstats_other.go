@@ -0,0 +1,21 @@
+// +build !linux
+
+package udp
+
+import (
+	"errors"
+	"net"
+)
+
+const socketStatsSupported = false
+
+// readSocketStats fails, because socket statistics are only available on
+// Linux.
+func readSocketStats(sockets []*net.UDPConn) ([]socketStats, error) {
+	return nil, errors.New("udp: socket statistics are not supported on this platform")
+}
+
+// readBufferSize fails, because receive buffers are only tuned on Linux.
+func readBufferSize(socket *net.UDPConn) (int, error) {
+	return 0, errors.New("udp: reading socket buffer sizes is not supported on this platform")
+}
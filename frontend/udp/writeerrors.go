@@ -0,0 +1,111 @@
+package udp
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// writeErrorLogInterval is the minimum time between two logged errors writing
+// responses. The errors in between are only counted.
+const writeErrorLogInterval = 10 * time.Second
+
+// The types of errors writing responses.
+const (
+	writeErrorSendBufferFull = "send_buffer_full"
+	writeErrorNoBufferSpace  = "no_buffer_space"
+	writeErrorMessageTooLong = "message_too_long"
+	writeErrorRefused        = "refused"
+	writeErrorUnreachable    = "unreachable"
+	writeErrorNotPermitted   = "not_permitted"
+	writeErrorOther          = "other"
+)
+
+// writeErrorType classifies an error writing a response.
+func writeErrorType(err error) string {
+	switch {
+	case errors.Is(err, syscall.EAGAIN):
+		return writeErrorSendBufferFull
+	case errors.Is(err, syscall.ENOBUFS):
+		return writeErrorNoBufferSpace
+	case errors.Is(err, syscall.EMSGSIZE):
+		return writeErrorMessageTooLong
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return writeErrorRefused
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return writeErrorUnreachable
+	case errors.Is(err, syscall.EPERM), errors.Is(err, syscall.EACCES):
+		return writeErrorNotPermitted
+	default:
+		return writeErrorOther
+	}
+}
+
+// isRetriable reports whether a write failed because the kernel ran out of
+// buffer space, which is likely to be available again right away.
+func isRetriable(err error) bool {
+	return errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.ENOBUFS)
+}
+
+// writeResponseTo writes a single response to addr. If retry is set, a
+// response that could not be written for lack of buffer space is written
+// once more.
+func writeResponseTo(socket *net.UDPConn, b []byte, addr *net.UDPAddr, retry bool) error {
+	_, err := socket.WriteToUDP(b, addr)
+	if err != nil && retry && isRetriable(err) {
+		_, err = socket.WriteToUDP(b, addr)
+		recordWriteRetry(err == nil)
+	}
+	return err
+}
+
+// writeFailed accounts for a response that could not be written to addr.
+//
+// Destinations the response was too large for are recorded in pathMTUs, if
+// path MTU discovery is enabled. All other errors are counted by type and
+// logged, at most once per writeErrorLogInterval.
+func writeFailed(err error, addr *net.UDPAddr, pathMTUs *pathMTUCache) {
+	if pathMTUs != nil && isMessageTooLong(err) {
+		pathMTUs.shrink(addr.IP)
+		return
+	}
+
+	typ := writeErrorType(err)
+	recordWriteError(typ)
+	writeErrors.log(err, typ, addr)
+}
+
+// writeErrors samples the errors writing responses that are logged.
+var writeErrors sampledLog
+
+// sampledLog logs errors at most once per writeErrorLogInterval, along with
+// the number of errors that were not logged since.
+type sampledLog struct {
+	mu         sync.Mutex
+	last       time.Time
+	suppressed int
+}
+
+func (l *sampledLog) log(err error, typ string, addr *net.UDPAddr) {
+	l.mu.Lock()
+	now := time.Now()
+	if now.Sub(l.last) < writeErrorLogInterval {
+		l.suppressed++
+		l.mu.Unlock()
+		return
+	}
+	suppressed := l.suppressed
+	l.last, l.suppressed = now, 0
+	l.mu.Unlock()
+
+	logger.Warn("failed to write response", log.Fields{
+		"addr":       addr,
+		"type":       typ,
+		"error":      err,
+		"suppressed": suppressed,
+	})
+}
@@ -0,0 +1,49 @@
+package udp
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeError(errno syscall.Errno) error {
+	return &net.OpError{Op: "write", Net: "udp", Err: os.NewSyscallError("sendto", errno)}
+}
+
+func TestWriteErrorType(t *testing.T) {
+	require.Equal(t, writeErrorSendBufferFull, writeErrorType(writeError(syscall.EAGAIN)))
+	require.Equal(t, writeErrorNoBufferSpace, writeErrorType(writeError(syscall.ENOBUFS)))
+	require.Equal(t, writeErrorMessageTooLong, writeErrorType(writeError(syscall.EMSGSIZE)))
+	require.Equal(t, writeErrorRefused, writeErrorType(writeError(syscall.ECONNREFUSED)))
+	require.Equal(t, writeErrorUnreachable, writeErrorType(writeError(syscall.EHOSTUNREACH)))
+	require.Equal(t, writeErrorNotPermitted, writeErrorType(writeError(syscall.EPERM)))
+	require.Equal(t, writeErrorOther, writeErrorType(errors.New("something else")))
+
+	require.True(t, isRetriable(writeError(syscall.EAGAIN)))
+	require.True(t, isRetriable(writeError(syscall.ENOBUFS)))
+	require.False(t, isRetriable(writeError(syscall.ECONNREFUSED)))
+}
+
+func TestSampledLog(t *testing.T) {
+	var l sampledLog
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6881}
+	err := writeError(syscall.ENOBUFS)
+
+	l.log(err, writeErrorNoBufferSpace, addr)
+	require.Equal(t, 0, l.suppressed)
+	last := l.last
+
+	// Errors within the interval are only counted.
+	l.log(err, writeErrorNoBufferSpace, addr)
+	l.log(err, writeErrorNoBufferSpace, addr)
+	require.Equal(t, 2, l.suppressed)
+	require.Equal(t, last, l.last)
+
+	l.last = last.Add(-writeErrorLogInterval)
+	l.log(err, writeErrorNoBufferSpace, addr)
+	require.Equal(t, 0, l.suppressed)
+}
@@ -1,9 +1,9 @@
 package udp
 
 import (
-	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
 	"time"
 
 	"github.com/chihaya/chihaya/bittorrent"
@@ -16,75 +16,159 @@ func WriteError(w io.Writer, txID []byte, err error) {
 		err = fmt.Errorf("internal error occurred: %s", err.Error())
 	}
 
-	buf := newBuffer()
-	writeHeader(buf, txID, errorActionID)
-	buf.WriteString(err.Error())
-	buf.WriteRune('\000')
-	w.Write(buf.Bytes())
-	buf.free()
+	msg := err.Error()
+	bp := buffers.Get(8 + len(msg) + 1)
+	b := appendHeader((*bp)[:0], txID, errorActionID)
+	b = append(b, msg...)
+	b = append(b, 0)
+	w.Write(b)
+	putBuffer(bp, b)
 }
 
+// announceHeaderSize is the size of an announce response without peers.
+const announceHeaderSize = 20
+
 // WriteAnnounce encodes an announce response according to BEP 15.
 // The peers returned will be resp.IPv6Peers or resp.IPv4Peers, depending on
 // whether v6Peers is set.
 // If v6Action is set, the action will be 4, according to
 // https://web.archive.org/web/20170503181830/http://opentracker.blog.h3q.com/2007/12/28/the-ipv6-situation/
+//
+// A response with a FailureReason is written as an error. BEP 15 has no way
+// to send the RetryIn or WarningMessage of a response, so they are dropped.
 func WriteAnnounce(w io.Writer, txID []byte, resp *bittorrent.AnnounceResponse, v6Action, v6Peers bool) {
-	buf := newBuffer()
+	if resp.FailureReason != "" {
+		WriteError(w, txID, bittorrent.ClientError(resp.FailureReason))
+		return
+	}
+
+	peers, peerSize := resp.IPv4Peers, 6
+	if v6Peers {
+		peers, peerSize = resp.IPv6Peers, 18
+	}
+	bp := buffers.Get(announceHeaderSize + len(peers)*peerSize)
+	b := (*bp)[:0]
 
 	if v6Action {
-		writeHeader(buf, txID, announceV6ActionID)
+		b = appendHeader(b, txID, announceV6ActionID)
 	} else {
-		writeHeader(buf, txID, announceActionID)
+		b = appendHeader(b, txID, announceActionID)
 	}
-	binary.Write(buf, binary.BigEndian, uint32(resp.Interval/time.Second))
-	binary.Write(buf, binary.BigEndian, resp.Incomplete)
-	binary.Write(buf, binary.BigEndian, resp.Complete)
+	b = appendUint32(b, durationSeconds(resp.Interval))
+	b = appendUint32(b, resp.Incomplete)
+	b = appendUint32(b, resp.Complete)
 
+	for _, peer := range peers {
+		b = append(b, peer.IP.IP...)
+		b = appendUint16(b, peer.Port)
+	}
+
+	w.Write(b)
+	putBuffer(bp, b)
+}
+
+// truncatePeers returns a copy of resp with as many of the peers of the given
+// address family as fit into a response of at most limit bytes, but no more
+// than maxPeers, if greater than zero, and no more than the client asked for
+// with numWant.
+//
+// The middleware selects no more than numWant peers, but ResponseHooks may
+// add peers afterwards.
+func truncatePeers(resp *bittorrent.AnnounceResponse, af bittorrent.AddressFamily, limit, maxPeers int, numWant uint32) *bittorrent.AnnounceResponse {
+	peerSize := 6
 	peers := resp.IPv4Peers
-	if v6Peers {
+	if af == bittorrent.IPv6 {
+		peerSize = 18
 		peers = resp.IPv6Peers
 	}
 
-	for _, peer := range peers {
-		buf.Write(peer.IP.IP)
-		binary.Write(buf, binary.BigEndian, peer.Port)
+	max := (limit - announceHeaderSize) / peerSize
+	if max < 0 {
+		max = 0
+	}
+	reason := truncateReasonResponseSize
+	if maxPeers > 0 && maxPeers < max {
+		max = maxPeers
+		reason = truncateReasonMaxPeers
+	}
+	if uint64(numWant) < uint64(max) {
+		max = int(numWant)
+		reason = truncateReasonNumWant
+	}
+	if len(peers) <= max {
+		return resp
 	}
 
-	w.Write(buf.Bytes())
-	buf.free()
+	truncated := *resp
+	if af == bittorrent.IPv6 {
+		truncated.IPv6Peers = peers[:max]
+	} else {
+		truncated.IPv4Peers = peers[:max]
+	}
+	recordTruncatedResponse(reason)
+	return &truncated
+}
+
+// durationSeconds returns d in whole seconds, clamped to the range of a
+// uint32.
+func durationSeconds(d time.Duration) uint32 {
+	s := d / time.Second
+	switch {
+	case s < 0:
+		recordClampedValue("interval")
+		return 0
+	case s > math.MaxUint32:
+		recordClampedValue("interval")
+		return math.MaxUint32
+	}
+	return uint32(s)
 }
 
 // WriteScrape encodes a scrape response according to BEP 15.
 func WriteScrape(w io.Writer, txID []byte, resp *bittorrent.ScrapeResponse) {
-	buf := newBuffer()
-
-	writeHeader(buf, txID, scrapeActionID)
+	bp := buffers.Get(8 + 12*len(resp.Files))
+	b := appendHeader((*bp)[:0], txID, scrapeActionID)
 
 	for _, scrape := range resp.Files {
-		binary.Write(buf, binary.BigEndian, scrape.Complete)
-		binary.Write(buf, binary.BigEndian, scrape.Snatches)
-		binary.Write(buf, binary.BigEndian, scrape.Incomplete)
+		b = appendUint32(b, scrape.Complete)
+		b = appendUint32(b, scrape.Snatches)
+		b = appendUint32(b, scrape.Incomplete)
 	}
 
-	w.Write(buf.Bytes())
-	buf.free()
+	w.Write(b)
+	putBuffer(bp, b)
 }
 
 // WriteConnectionID encodes a new connection response according to BEP 15.
 func WriteConnectionID(w io.Writer, txID, connID []byte) {
-	buf := newBuffer()
+	bp := buffers.Get(16)
+	b := appendHeader((*bp)[:0], txID, connectActionID)
+	b = append(b, connID...)
 
-	writeHeader(buf, txID, connectActionID)
-	buf.Write(connID)
+	w.Write(b)
+	putBuffer(bp, b)
+}
 
-	w.Write(buf.Bytes())
-	buf.free()
+// putBuffer returns a buffer to buffers.
+// b is the buffer after encoding a response, which may have been grown.
+func putBuffer(bp *[]byte, b []byte) {
+	*bp = b
+	buffers.Put(bp)
 }
 
-// writeHeader writes the action and transaction ID to the provided response
+// appendHeader appends the action and transaction ID to the provided response
 // buffer.
-func writeHeader(w io.Writer, txID []byte, action uint32) {
-	binary.Write(w, binary.BigEndian, action)
-	w.Write(txID)
+func appendHeader(b []byte, txID []byte, action uint32) []byte {
+	b = appendUint32(b, action)
+	return append(b, txID...)
+}
+
+// appendUint32 appends v to b in big-endian byte order.
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// appendUint16 appends v to b in big-endian byte order.
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
 }
@@ -0,0 +1,199 @@
+package udp
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+func TestTruncatePeers(t *testing.T) {
+	peers := func(n int, af bittorrent.AddressFamily) []bittorrent.Peer {
+		ip := net.IPv4(10, 0, 0, 1).To4()
+		if af == bittorrent.IPv6 {
+			ip = net.ParseIP("fc00::1")
+		}
+		ps := make([]bittorrent.Peer, n)
+		for i := range ps {
+			ps[i] = bittorrent.Peer{IP: bittorrent.IP{IP: ip, AddressFamily: af}, Port: uint16(i)}
+		}
+		return ps
+	}
+
+	var table = []struct {
+		af       bittorrent.AddressFamily
+		peers    int
+		limit    int
+		maxPeers int
+		numWant  uint32
+		expected int
+	}{
+		{bittorrent.IPv4, 50, 1452, 0, 50, 50},
+		{bittorrent.IPv4, 50, 98, 0, 50, 13},
+		{bittorrent.IPv6, 50, 98, 0, 50, 4},
+		{bittorrent.IPv6, 50, 16, 0, 50, 0},
+		{bittorrent.IPv4, 50, 1452, 30, 50, 30},
+		{bittorrent.IPv4, 50, 98, 30, 50, 13},
+		{bittorrent.IPv6, 50, 1452, 60, 100, 50},
+		{bittorrent.IPv4, 50, 1452, 0, 20, 20},
+		{bittorrent.IPv4, 50, 1452, 30, 20, 20},
+		{bittorrent.IPv4, 50, 98, 0, 20, 13},
+		{bittorrent.IPv6, 50, 1452, 0, 0, 0},
+		{bittorrent.IPv6, 100, 1232, 0, 100, 67},
+	}
+
+	for _, tt := range table {
+		resp := &bittorrent.AnnounceResponse{IPv4Peers: peers(tt.peers, bittorrent.IPv4), IPv6Peers: peers(tt.peers, bittorrent.IPv6)}
+		truncated := truncatePeers(resp, tt.af, tt.limit, tt.maxPeers, tt.numWant)
+
+		var buf bytes.Buffer
+		WriteAnnounce(&buf, []byte{0, 0, 0, 0}, truncated, false, tt.af == bittorrent.IPv6)
+		if tt.expected > 0 {
+			require.True(t, buf.Len() <= tt.limit)
+		}
+
+		if tt.af == bittorrent.IPv6 {
+			require.Len(t, truncated.IPv6Peers, tt.expected)
+		} else {
+			require.Len(t, truncated.IPv4Peers, tt.expected)
+		}
+
+		// The original response is not modified.
+		require.Len(t, resp.IPv4Peers, tt.peers)
+		require.Len(t, resp.IPv6Peers, tt.peers)
+	}
+}
+
+func TestMaxResponseSize(t *testing.T) {
+	v4, v6 := net.IPv4(10, 0, 0, 1).To4(), net.ParseIP("fc00::1")
+
+	f := &Frontend{Config: Config{MaxResponseSize: 1452}}
+	require.Equal(t, 1452, f.maxResponseSize(98, v4))
+
+	f.MaxResponseFactor = 2
+	require.Equal(t, 196, f.maxResponseSize(98, v4))
+	require.Equal(t, 1452, f.maxResponseSize(1000, v4))
+
+	// Responses to IPv6 clients fit into the minimum IPv6 MTU by default.
+	f = &Frontend{Config: Config{MaxResponseSize: 1452}.Validate()}
+	require.Equal(t, 1452, f.maxResponseSize(98, v4))
+	require.Equal(t, 1232, f.maxResponseSize(98, v6))
+	require.Equal(t, 1452, f.maxResponseSize(98, net.IPv4(10, 0, 0, 1)))
+	require.Equal(t, 8952, Config{MTU: 9000}.Validate().MaxResponseSizeIPv6)
+
+	// Invalid MTUs are replaced before the response sizes are derived.
+	cfg := Config{MTU: 100}.Validate()
+	require.Equal(t, 0, cfg.MTU)
+	require.Equal(t, 1452, cfg.MaxResponseSize)
+	require.Equal(t, 1232, cfg.MaxResponseSizeIPv6)
+
+	f = &Frontend{Config: Config{MaxResponseSize: 8972, MTU: 9000}}
+	require.Equal(t, 8972, f.maxResponseSize(98, v4))
+	require.Equal(t, 8952, f.maxResponseSize(98, v6))
+
+	f.pathMTUs = newPathMTUCache(1)
+	f.pathMTUs.shrink(v4)
+	require.Equal(t, minIPv4MTU-28, f.maxResponseSize(98, v4))
+	require.Equal(t, 8952, f.maxResponseSize(98, v6))
+
+	// The least recently seen destination is evicted.
+	f.pathMTUs.shrink(v6)
+	require.Equal(t, 8972, f.maxResponseSize(98, v4))
+	require.Equal(t, minIPv6MTU-48, f.maxResponseSize(98, v6))
+}
+
+func TestWriteResponses(t *testing.T) {
+	txID := []byte{1, 2, 3, 4}
+	resp := &bittorrent.AnnounceResponse{
+		Interval:   30 * time.Minute,
+		Complete:   1,
+		Incomplete: 2,
+		IPv4Peers: []bittorrent.Peer{
+			{IP: bittorrent.IP{IP: net.IPv4(10, 0, 0, 1).To4(), AddressFamily: bittorrent.IPv4}, Port: 6881},
+		},
+		IPv6Peers: []bittorrent.Peer{
+			{IP: bittorrent.IP{IP: net.ParseIP("fc00::1"), AddressFamily: bittorrent.IPv6}, Port: 6882},
+		},
+	}
+
+	var table = []struct {
+		write    func(*bytes.Buffer)
+		expected []byte
+	}{
+		{
+			func(buf *bytes.Buffer) { WriteConnectionID(buf, txID, []byte{8, 7, 6, 5, 4, 3, 2, 1}) },
+			[]byte{0, 0, 0, 0, 1, 2, 3, 4, 8, 7, 6, 5, 4, 3, 2, 1},
+		},
+		{
+			func(buf *bytes.Buffer) { WriteAnnounce(buf, txID, resp, false, false) },
+			[]byte{0, 0, 0, 1, 1, 2, 3, 4, 0, 0, 0x07, 0x08, 0, 0, 0, 2, 0, 0, 0, 1, 10, 0, 0, 1, 0x1a, 0xe1},
+		},
+		{
+			func(buf *bytes.Buffer) { WriteAnnounce(buf, txID, resp, true, true) },
+			[]byte{0, 0, 0, 4, 1, 2, 3, 4, 0, 0, 0x07, 0x08, 0, 0, 0, 2, 0, 0, 0, 1, 0xfc, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1a, 0xe2},
+		},
+		{
+			func(buf *bytes.Buffer) {
+				WriteScrape(buf, txID, &bittorrent.ScrapeResponse{Files: []bittorrent.Scrape{{Complete: 1, Snatches: 2, Incomplete: 3}}})
+			},
+			[]byte{0, 0, 0, 2, 1, 2, 3, 4, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3},
+		},
+		{
+			func(buf *bytes.Buffer) { WriteError(buf, txID, bittorrent.ClientError("oops")) },
+			[]byte{0, 0, 0, 3, 1, 2, 3, 4, 'o', 'o', 'p', 's', 0},
+		},
+		{
+			func(buf *bytes.Buffer) {
+				WriteAnnounce(buf, txID, &bittorrent.AnnounceResponse{FailureReason: "busy", RetryIn: time.Minute}, false, false)
+			},
+			[]byte{0, 0, 0, 3, 1, 2, 3, 4, 'b', 'u', 's', 'y', 0},
+		},
+		{
+			func(buf *bytes.Buffer) { WriteError(buf, txID, errors.New("oops")) },
+			append([]byte{0, 0, 0, 3, 1, 2, 3, 4}, "internal error occurred: oops\x00"...),
+		},
+	}
+
+	for _, tt := range table {
+		var buf bytes.Buffer
+		tt.write(&buf)
+		require.Equal(t, tt.expected, buf.Bytes())
+	}
+}
+
+func TestDurationSeconds(t *testing.T) {
+	require.Equal(t, uint32(1800), durationSeconds(30*time.Minute))
+	require.Equal(t, uint32(0), durationSeconds(-time.Second))
+	require.Equal(t, uint32(math.MaxUint32), durationSeconds(200*365*24*time.Hour))
+}
+
+func BenchmarkWriteAnnounce(b *testing.B) {
+	peers := make([]bittorrent.Peer, 50)
+	for i := range peers {
+		peers[i] = bittorrent.Peer{IP: bittorrent.IP{IP: net.IPv4(10, 0, 0, byte(i)).To4(), AddressFamily: bittorrent.IPv4}, Port: uint16(i)}
+	}
+	resp := &bittorrent.AnnounceResponse{Interval: 30 * time.Minute, IPv4Peers: peers}
+	txID := []byte{1, 2, 3, 4}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		WriteAnnounce(ioutil.Discard, txID, resp, false, false)
+	}
+}
+
+func BenchmarkWriteScrape(b *testing.B) {
+	resp := &bittorrent.ScrapeResponse{Files: make([]bittorrent.Scrape, 50)}
+	txID := []byte{1, 2, 3, 4}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		WriteScrape(ioutil.Discard, txID, resp)
+	}
+}
@@ -0,0 +1,54 @@
+// Package chisquare implements Pearson's chi-square test, which is used to
+// assert that random selections are fair.
+package chisquare
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/stretchr/testify/require"
+)
+
+// z is the standard normal quantile of the significance level, 10^-6. Tests
+// of random selections fail spuriously with this probability.
+const z = 4.753424
+
+// Statistic returns the chi-square statistic of counts under the hypothesis
+// that all outcomes are equally likely.
+func Statistic(counts []int) float64 {
+	var total int
+	for _, c := range counts {
+		total += c
+	}
+	expected := float64(total) / float64(len(counts))
+
+	var stat float64
+	for _, c := range counts {
+		d := float64(c) - expected
+		stat += d * d / expected
+	}
+	return stat
+}
+
+// Critical returns the value that the chi-square statistic with df degrees
+// of freedom exceeds with a probability of 10^-6.
+//
+// It uses the approximation of Wilson and Hilferty, which is accurate enough
+// for df >= 3.
+func Critical(df int) float64 {
+	k := float64(df)
+	return k * math.Pow(1-2/(9*k)+z*math.Sqrt(2/(9*k)), 3)
+}
+
+// RequireUniform fails the test if counts are unlikely to be outcomes that
+// are all equally likely.
+//
+// Counts of peers included in samples drawn without replacement vary less
+// than independent outcomes, which only makes the test more lenient.
+func RequireUniform(t require.TestingT, counts []int, msgAndArgs ...interface{}) {
+	stat, critical := Statistic(counts), Critical(len(counts)-1)
+	if stat > critical {
+		msg := fmt.Sprintf("distribution is not uniform: chi-square %.1f exceeds %.1f for counts %v", stat, critical, counts)
+		require.Fail(t, msg, msgAndArgs...)
+	}
+}
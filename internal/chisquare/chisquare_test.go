@@ -0,0 +1,30 @@
+package chisquare
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCritical(t *testing.T) {
+	// Exact values for a significance of 10^-6.
+	for df, expected := range map[int]float64{9: 44.81, 39: 96.13, 999: 1226.05} {
+		require.InEpsilon(t, expected, Critical(df), 0.03)
+	}
+}
+
+func TestRequireUniform(t *testing.T) {
+	counts := make([]int, 20)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		counts[r.Intn(len(counts))]++
+	}
+	RequireUniform(t, counts)
+
+	// The first outcome is twice as likely.
+	for i := 0; i < 1000; i++ {
+		counts[0]++
+	}
+	require.True(t, Statistic(counts) > Critical(len(counts)-1))
+}
@@ -0,0 +1,95 @@
+// Package cpus determines how many CPUs the process can use, taking the CPU
+// limits of containers into account.
+//
+// Go versions up to 1.24 set GOMAXPROCS to the number of CPUs of the host,
+// even if the cgroup of the process is only allowed to use a fraction of
+// them. Goroutines sized for the host then compete for the quota, and the
+// process is throttled by the kernel.
+package cpus
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// cgroupRoot is where the cgroup file systems are mounted.
+//
+// The cgroup of the process is expected at the root, which is the case in
+// containers with their own cgroup namespace.
+var cgroupRoot = "/sys/fs/cgroup"
+
+// Limit returns the number of CPUs the cgroup of the process may use,
+// rounded up, and false if it is not limited or the limit can't be read.
+//
+// Both cgroup v2 (cpu.max) and cgroup v1 (cpu.cfs_quota_us and
+// cpu.cfs_period_us) are supported.
+func Limit() (int, bool) {
+	if b, err := ioutil.ReadFile(filepath.Join(cgroupRoot, "cpu.max")); err == nil {
+		fields := strings.Fields(string(b))
+		if len(fields) != 2 {
+			return 0, false
+		}
+		return quotaCPUs(fields[0], fields[1])
+	}
+
+	for _, dir := range []string{"cpu", "cpu,cpuacct"} {
+		quota, err := ioutil.ReadFile(filepath.Join(cgroupRoot, dir, "cpu.cfs_quota_us"))
+		if err != nil {
+			continue
+		}
+		period, err := ioutil.ReadFile(filepath.Join(cgroupRoot, dir, "cpu.cfs_period_us"))
+		if err != nil {
+			continue
+		}
+		return quotaCPUs(strings.TrimSpace(string(quota)), strings.TrimSpace(string(period)))
+	}
+	return 0, false
+}
+
+// quotaCPUs returns the number of CPUs needed to use up quota within every
+// period, rounded up. A quota of "max" or -1 is no limit.
+func quotaCPUs(quota, period string) (int, bool) {
+	if quota == "max" {
+		return 0, false
+	}
+	q, err := strconv.ParseFloat(quota, 64)
+	if err != nil || q <= 0 {
+		return 0, false
+	}
+	p, err := strconv.ParseFloat(period, 64)
+	if err != nil || p <= 0 {
+		return 0, false
+	}
+	return int(math.Ceil(q / p)), true
+}
+
+// Available returns the number of CPUs the process can use at once: the
+// smaller of GOMAXPROCS and the limit of its cgroup.
+func Available() int {
+	n := runtime.GOMAXPROCS(0)
+	if limit, ok := Limit(); ok && limit < n {
+		n = limit
+	}
+	return n
+}
+
+// AdjustGOMAXPROCS lowers GOMAXPROCS to the limit of the cgroup of the
+// process, unless it was set through the GOMAXPROCS environment variable. It
+// returns the previous and the new value.
+func AdjustGOMAXPROCS() (previous, current int) {
+	previous = runtime.GOMAXPROCS(0)
+	if _, ok := os.LookupEnv("GOMAXPROCS"); ok {
+		return previous, previous
+	}
+
+	if limit, ok := Limit(); ok && limit < previous {
+		runtime.GOMAXPROCS(limit)
+		return previous, limit
+	}
+	return previous, previous
+}
@@ -0,0 +1,63 @@
+package cpus
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuotaCPUs(t *testing.T) {
+	var table = []struct {
+		quota, period string
+		expected      int
+		limited       bool
+	}{
+		{"max", "100000", 0, false},
+		{"-1", "100000", 0, false},
+		{"200000", "100000", 2, true},
+		{"150000", "100000", 2, true},
+		{"50000", "100000", 1, true},
+		{"50000", "0", 0, false},
+		{"lots", "100000", 0, false},
+	}
+
+	for _, tt := range table {
+		n, ok := quotaCPUs(tt.quota, tt.period)
+		require.Equal(t, tt.limited, ok, "%s/%s", tt.quota, tt.period)
+		require.Equal(t, tt.expected, n, "%s/%s", tt.quota, tt.period)
+	}
+}
+
+func TestLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chihaya-cgroup")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	defer func(root string) { cgroupRoot = root }(cgroupRoot)
+	cgroupRoot = dir
+
+	_, ok := Limit()
+	require.False(t, ok)
+
+	// cgroup v1
+	require.Nil(t, os.Mkdir(filepath.Join(dir, "cpu,cpuacct"), 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "cpu,cpuacct", "cpu.cfs_quota_us"), []byte("300000\n"), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "cpu,cpuacct", "cpu.cfs_period_us"), []byte("100000\n"), 0644))
+	n, ok := Limit()
+	require.True(t, ok)
+	require.Equal(t, 3, n)
+
+	// cgroup v2 takes precedence.
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "cpu.max"), []byte("max 100000\n"), 0644))
+	_, ok = Limit()
+	require.False(t, ok)
+
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "cpu.max"), []byte("100000 100000\n"), 0644))
+	n, ok = Limit()
+	require.True(t, ok)
+	require.Equal(t, 1, n)
+	require.Equal(t, 1, Available())
+}
@@ -0,0 +1,350 @@
+// Package handoff implements passing the sockets of a running process to a
+// new process of a possibly upgraded binary, so that it can take over without
+// dropping requests.
+//
+// Sockets are registered with the address they were bound to as configured.
+// Upgrade starts a new process with the same arguments, which inherits all
+// registered sockets. The new process uses them instead of binding sockets
+// to the same addresses, and calls Ready once it serves requests, after
+// which the old process drains and exits.
+//
+// Sockets are inherited as file descriptors, so Upgrade is not supported on
+// Windows.
+package handoff
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The environment variables describing the sockets inherited by a new
+// process and the pipe it reports readiness on.
+const (
+	envSockets = "CHIHAYA_HANDOFF_SOCKETS"
+	envReadyFD = "CHIHAYA_HANDOFF_READY_FD"
+)
+
+// inheritedFDsStart is the first file descriptor inherited by a new process.
+const inheritedFDsStart = 3
+
+// Socket is a socket that can be passed to a new process, such as a
+// *net.TCPListener or a *net.UDPConn.
+type Socket interface {
+	File() (*os.File, error)
+}
+
+// addr is the network and the address a socket was bound to as configured,
+// which identifies it in the new process.
+type addr struct {
+	Network string `json:"network"`
+	Addr    string `json:"addr"`
+}
+
+type registered struct {
+	addr
+	socket Socket
+}
+
+type inheritedSocket struct {
+	addr
+	file *os.File
+}
+
+var (
+	mu sync.Mutex
+
+	// sockets holds the registered sockets in the order they were added.
+	sockets []registered
+
+	// inherited holds the sockets inherited from the previous process that
+	// were not taken yet.
+	inherited     []inheritedSocket
+	ready         *os.File
+	inheritedOnce sync.Once
+)
+
+// Add registers a socket bound to addr, so that it is passed to new processes
+// started by Upgrade. It must be removed with Remove before it is closed.
+func Add(network, address string, s Socket) {
+	mu.Lock()
+	defer mu.Unlock()
+	sockets = append(sockets, registered{addr{network, address}, s})
+}
+
+// Remove unregisters a socket added with Add.
+func Remove(s Socket) {
+	mu.Lock()
+	defer mu.Unlock()
+	for i, r := range sockets {
+		if r.socket == s {
+			sockets = append(sockets[:i], sockets[i+1:]...)
+			return
+		}
+	}
+}
+
+// parseInherited reads the sockets inherited from the previous process from
+// the environment, which is cleared afterwards so that it isn't passed on to
+// child processes.
+func parseInherited() {
+	inheritedOnce.Do(func() {
+		encoded, readyFD := os.Getenv(envSockets), os.Getenv(envReadyFD)
+		os.Unsetenv(envSockets)
+		os.Unsetenv(envReadyFD)
+
+		if fd, err := strconv.Atoi(readyFD); err == nil {
+			ready = os.NewFile(uintptr(fd), "handoff-ready")
+		}
+
+		var addrs []addr
+		if encoded == "" || json.Unmarshal([]byte(encoded), &addrs) != nil {
+			return
+		}
+		for i, a := range addrs {
+			f := os.NewFile(uintptr(inheritedFDsStart+i), "handoff-"+a.Network+"-"+a.Addr)
+			inherited = append(inherited, inheritedSocket{a, f})
+		}
+	})
+}
+
+// take returns the files of the sockets inherited for addr, which are no
+// longer available afterwards.
+func take(network, address string) []*os.File {
+	parseInherited()
+
+	mu.Lock()
+	defer mu.Unlock()
+	var files []*os.File
+	remaining := inherited[:0]
+	for _, s := range inherited {
+		if s.Network == network && s.Addr == address {
+			files = append(files, s.file)
+			continue
+		}
+		remaining = append(remaining, s)
+	}
+	inherited = remaining
+	return files
+}
+
+// Upgraded returns whether this process was started by Upgrade.
+func Upgraded() bool {
+	parseInherited()
+
+	mu.Lock()
+	defer mu.Unlock()
+	return ready != nil
+}
+
+// Listen returns a listener for the stream socket inherited for addr, or
+// calls listen to bind a new one if none was inherited.
+//
+// The listener is registered until it is closed, unless it can't be passed
+// to a new process.
+func Listen(network, address string, listen func() (net.Listener, error)) (net.Listener, error) {
+	var l net.Listener
+	if files := take(network, address); len(files) > 0 {
+		var err error
+		l, err = net.FileListener(files[0])
+		for _, f := range files {
+			f.Close()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("handoff: inherited socket for %s is not a stream socket: %s", address, err)
+		}
+	} else {
+		var err error
+		if l, err = listen(); err != nil {
+			return nil, err
+		}
+	}
+
+	s, ok := l.(Socket)
+	if !ok {
+		return l, nil
+	}
+	Add(network, address, s)
+	return &listener{Listener: l, socket: s}, nil
+}
+
+// listener is a registered listener, which is removed when it is closed.
+type listener struct {
+	net.Listener
+	socket Socket
+}
+
+func (l *listener) Close() error {
+	Remove(l.socket)
+	return l.Listener.Close()
+}
+
+// ListenPacket returns connections for the UDP sockets inherited for addr,
+// or calls listen to bind new ones if none were inherited.
+//
+// The connections are registered and must be removed with Remove before
+// they are closed.
+func ListenPacket(network, address string, listen func() ([]*net.UDPConn, error)) ([]*net.UDPConn, error) {
+	files := take(network, address)
+	if len(files) == 0 {
+		conns, err := listen()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range conns {
+			Add(network, address, c)
+		}
+		return conns, nil
+	}
+
+	var conns []*net.UDPConn
+	var err error
+	for _, f := range files {
+		if err != nil {
+			f.Close()
+			continue
+		}
+		var pc net.PacketConn
+		pc, err = net.FilePacketConn(f)
+		f.Close()
+		if err != nil {
+			err = fmt.Errorf("handoff: inherited socket for %s is not a datagram socket: %s", address, err)
+			continue
+		}
+		c, ok := pc.(*net.UDPConn)
+		if !ok {
+			pc.Close()
+			err = fmt.Errorf("handoff: inherited socket for %s is not a UDP socket", address)
+			continue
+		}
+		conns = append(conns, c)
+	}
+	if err != nil {
+		for _, c := range conns {
+			c.Close()
+		}
+		return nil, err
+	}
+
+	for _, c := range conns {
+		Add(network, address, c)
+	}
+	return conns, nil
+}
+
+// Ready reports to the process that started this one with Upgrade that it
+// serves requests, so that the previous process stops. Inherited sockets that
+// were not taken, because their addresses are no longer configured, are
+// closed.
+//
+// It does nothing if this process was not started by Upgrade.
+func Ready() error {
+	parseInherited()
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, s := range inherited {
+		s.file.Close()
+	}
+	inherited = nil
+
+	if ready == nil {
+		return nil
+	}
+	_, err := ready.Write([]byte{1})
+	ready.Close()
+	ready = nil
+	return err
+}
+
+// Upgrade starts a new process of the executable of this process with the
+// same arguments and environment, which inherits all registered sockets. It
+// returns once the new process called Ready.
+//
+// If the new process exits or doesn't call Ready within timeout, it is killed
+// and an error is returned, so that this process can keep serving requests.
+func Upgrade(timeout time.Duration) (*os.Process, error) {
+	if runtime.GOOS == "windows" {
+		return nil, errors.New("handoff: upgrades are not supported on Windows")
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	mu.Lock()
+	registeredSockets := append([]registered(nil), sockets...)
+	mu.Unlock()
+
+	addrs := make([]addr, 0, len(registeredSockets))
+	files := make([]*os.File, 0, len(registeredSockets)+1)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, r := range registeredSockets {
+		f, err := r.socket.File()
+		if err != nil {
+			return nil, fmt.Errorf("handoff: failed to pass socket for %s: %s", r.Addr, err)
+		}
+		files = append(files, f)
+		addrs = append(addrs, r.addr)
+	}
+	encoded, err := json.Marshal(addrs)
+	if err != nil {
+		return nil, err
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyR.Close()
+	files = append(files, readyW)
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(),
+		envSockets+"="+string(encoded),
+		envReadyFD+"="+strconv.Itoa(inheritedFDsStart+len(addrs)),
+	)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	// The pipe is only written to by the new process, so that reading it
+	// fails once that exits.
+	readyW.Close()
+	files = files[:len(files)-1]
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := readyR.Read(make([]byte, 1))
+		readErr <- err
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-readErr:
+		if err == nil {
+			return cmd.Process, nil
+		}
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, errors.New("handoff: the new process exited before it was ready")
+	case <-timer.C:
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, fmt.Errorf("handoff: the new process was not ready within %s", timeout)
+	}
+}
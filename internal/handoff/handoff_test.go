@@ -0,0 +1,105 @@
+// +build !windows
+
+package handoff
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func registeredCount() int {
+	mu.Lock()
+	defer mu.Unlock()
+	return len(sockets)
+}
+
+func TestListenRegisters(t *testing.T) {
+	l, err := Listen("tcp", "127.0.0.1:0", func() (net.Listener, error) {
+		return net.Listen("tcp", "127.0.0.1:0")
+	})
+	require.Nil(t, err)
+	require.Equal(t, 1, registeredCount())
+
+	require.Nil(t, l.Close())
+	require.Equal(t, 0, registeredCount())
+}
+
+func TestListenPacketRegisters(t *testing.T) {
+	conns, err := ListenPacket("udp", "127.0.0.1:0", func() ([]*net.UDPConn, error) {
+		c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		return []*net.UDPConn{c}, err
+	})
+	require.Nil(t, err)
+	require.Len(t, conns, 1)
+	require.Equal(t, 1, registeredCount())
+
+	Remove(conns[0])
+	require.Nil(t, conns[0].Close())
+	require.Equal(t, 0, registeredCount())
+}
+
+// upgradeTest runs the test named name in a new process started by Upgrade.
+func upgradeTest(t *testing.T, name string) (*os.Process, error) {
+	args := os.Args
+	os.Args = []string{args[0], "-test.run=^" + name + "$"}
+	defer func() { os.Args = args }()
+
+	return Upgrade(10 * time.Second)
+}
+
+func TestUpgrade(t *testing.T) {
+	listen := func() (net.Listener, error) {
+		return net.Listen("tcp", "127.0.0.1:0")
+	}
+
+	if Upgraded() {
+		// This is the new process, which serves one connection on the
+		// inherited socket.
+		l, err := Listen("tcp", "127.0.0.1:0", listen)
+		require.Nil(t, err)
+		defer l.Close()
+		require.Nil(t, Ready())
+
+		conn, err := l.Accept()
+		require.Nil(t, err)
+		conn.Write([]byte("upgraded"))
+		conn.Close()
+		return
+	}
+
+	l, err := Listen("tcp", "127.0.0.1:0", listen)
+	require.Nil(t, err)
+	addr := l.Addr().String()
+
+	proc, err := upgradeTest(t, "TestUpgrade")
+	require.Nil(t, err)
+
+	// The socket stays open in the new process.
+	require.Nil(t, l.Close())
+	conn, err := net.Dial("tcp", addr)
+	require.Nil(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	b, err := ioutil.ReadAll(conn)
+	require.Nil(t, err)
+	require.Equal(t, "upgraded", string(b))
+
+	state, err := proc.Wait()
+	require.Nil(t, err)
+	require.True(t, state.Success())
+}
+
+func TestUpgradeFailure(t *testing.T) {
+	if Upgraded() {
+		// This is the new process, which fails before it is ready.
+		os.Exit(2)
+	}
+
+	_, err := upgradeTest(t, "TestUpgradeFailure")
+	require.NotNil(t, err)
+}
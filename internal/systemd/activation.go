@@ -0,0 +1,186 @@
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+// AddrPrefix is the prefix of addresses naming a socket passed by systemd
+// instead of an address to bind to.
+const AddrPrefix = "fd://"
+
+var (
+	activated     []*os.File
+	activatedOnce sync.Once
+
+	// activatedNames holds the names of the sockets passed by systemd, as
+	// set with FileDescriptorName=, by their position.
+	activatedNames []string
+)
+
+// files returns the sockets passed by systemd, as described in
+// sd_listen_fds(3).
+//
+// The files are kept open, so that sockets can be used again after a
+// frontend was stopped, for example when reloading the configuration.
+func files() []*os.File {
+	activatedOnce.Do(func() {
+		defer func() {
+			os.Unsetenv("LISTEN_PID")
+			os.Unsetenv("LISTEN_FDS")
+			os.Unsetenv("LISTEN_FDNAMES")
+		}()
+
+		if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+			return
+		}
+		n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil || n <= 0 {
+			return
+		}
+
+		for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+			activated = append(activated, os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd)))
+		}
+		if names := os.Getenv("LISTEN_FDNAMES"); names != "" {
+			activatedNames = strings.Split(names, ":")
+		}
+	})
+
+	return activated
+}
+
+// Listeners returns listeners for all stream sockets passed by systemd that
+// are bound to the given TCP address.
+//
+// If no such socket was passed, no listeners are returned and the caller is
+// expected to bind a socket itself.
+func Listeners(network, address string) ([]net.Listener, error) {
+	addr, err := net.ResolveTCPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	var listeners []net.Listener
+	for _, f := range files() {
+		l, err := net.FileListener(f)
+		if err != nil {
+			// Not a stream socket.
+			continue
+		}
+
+		if la, ok := l.Addr().(*net.TCPAddr); ok && matches(la.IP, la.Port, addr.IP, addr.Port) {
+			listeners = append(listeners, l)
+			continue
+		}
+		l.Close()
+	}
+
+	return listeners, nil
+}
+
+// PacketConns returns connections for all datagram sockets passed by systemd
+// that are bound to the given UDP address.
+//
+// If no such socket was passed, no connections are returned and the caller is
+// expected to bind a socket itself.
+func PacketConns(network, address string) ([]net.PacketConn, error) {
+	addr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	var conns []net.PacketConn
+	for _, f := range files() {
+		pc, err := net.FilePacketConn(f)
+		if err != nil {
+			// Not a datagram socket.
+			continue
+		}
+
+		if la, ok := pc.LocalAddr().(*net.UDPAddr); ok && matches(la.IP, la.Port, addr.IP, addr.Port) {
+			conns = append(conns, pc)
+			continue
+		}
+		pc.Close()
+	}
+
+	return conns, nil
+}
+
+// matches returns whether a socket bound to the address ip:port is bound to
+// the address wantIP:wantPort.
+// If wantIP is nil, any socket bound to an unspecified address matches.
+func matches(ip net.IP, port int, wantIP net.IP, wantPort int) bool {
+	if port != wantPort {
+		return false
+	}
+	if wantIP == nil {
+		return ip == nil || ip.IsUnspecified()
+	}
+	return wantIP.Equal(ip) && (wantIP.To4() == nil) == (ip.To4() == nil)
+}
+
+// IsAddr returns whether addr names a socket passed by systemd, either by its
+// position among the sockets passed, as in fd://0 for the first one, or by
+// the name set with FileDescriptorName=, as in fd://udp.
+func IsAddr(addr string) bool {
+	return strings.HasPrefix(addr, AddrPrefix)
+}
+
+// file returns the socket passed by systemd that addr names.
+func file(addr string) (*os.File, error) {
+	fs := files()
+	ref := strings.TrimPrefix(addr, AddrPrefix)
+
+	if i, err := strconv.Atoi(ref); err == nil {
+		if i < 0 || i >= len(fs) {
+			return nil, fmt.Errorf("systemd: %s was not passed, %d sockets were passed", addr, len(fs))
+		}
+		return fs[i], nil
+	}
+
+	for i, name := range activatedNames {
+		if name == ref && i < len(fs) {
+			return fs[i], nil
+		}
+	}
+	return nil, fmt.Errorf("systemd: no socket named %q was passed", ref)
+}
+
+// Listener returns a listener for the stream socket passed by systemd that
+// addr names. See IsAddr for the addresses supported.
+func Listener(addr string) (net.Listener, error) {
+	f, err := file(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("systemd: %s is not a stream socket: %s", addr, err)
+	}
+	return l, nil
+}
+
+// PacketConn returns a connection for the datagram socket passed by systemd
+// that addr names. See IsAddr for the addresses supported.
+func PacketConn(addr string) (net.PacketConn, error) {
+	f, err := file(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, fmt.Errorf("systemd: %s is not a datagram socket: %s", addr, err)
+	}
+	return pc, nil
+}
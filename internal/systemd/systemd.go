@@ -0,0 +1,53 @@
+// Package systemd implements the parts of the service manager interfaces of
+// systemd used by Chihaya: readiness notifications, the watchdog and socket
+// activation.
+//
+// All functions are no-ops if the process was not started by systemd.
+package systemd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Notify sends a state change, such as "READY=1", to systemd.
+// See sd_notify(3) for the states available.
+//
+// It returns false if notifications are not supported, because the process
+// was not started by systemd.
+func Notify(state string) (bool, error) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return false, nil
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns the interval after which systemd considers the
+// process hung if it didn't send "WATCHDOG=1", or 0 if the watchdog is
+// disabled.
+// See sd_watchdog_enabled(3).
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
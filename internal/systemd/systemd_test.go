@@ -0,0 +1,129 @@
+package systemd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotify(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	ok, err := Notify("READY=1")
+	require.Nil(t, err)
+	require.False(t, ok)
+
+	dir, err := ioutil.TempDir("", "systemd")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	require.Nil(t, err)
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", path)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	ok, err = Notify("READY=1")
+	require.Nil(t, err)
+	require.True(t, ok)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	require.Nil(t, err)
+	require.Equal(t, "READY=1", string(buf[:n]))
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+
+	var table = []struct {
+		usec     string
+		pid      string
+		expected time.Duration
+	}{
+		{"", "", 0},
+		{"invalid", "", 0},
+		{"30000000", "", 30 * time.Second},
+		{"30000000", strconv.Itoa(os.Getpid()), 30 * time.Second},
+		{"30000000", "1", 0},
+	}
+
+	for _, tt := range table {
+		os.Setenv("WATCHDOG_USEC", tt.usec)
+		os.Setenv("WATCHDOG_PID", tt.pid)
+		require.Equal(t, tt.expected, WatchdogInterval())
+	}
+}
+
+func TestMatches(t *testing.T) {
+	var table = []struct {
+		bound    string
+		want     string
+		expected bool
+	}{
+		{"0.0.0.0:6969", "0.0.0.0:6969", true},
+		{"0.0.0.0:6969", ":6969", true},
+		{"[::]:6969", ":6969", true},
+		{"127.0.0.1:6969", ":6969", false},
+		{"0.0.0.0:6969", "0.0.0.0:6970", false},
+		{"0.0.0.0:6969", "[::]:6969", false},
+		{"[::1]:6969", "[::1]:6969", true},
+	}
+
+	for _, tt := range table {
+		bound, err := net.ResolveTCPAddr("tcp", tt.bound)
+		require.Nil(t, err)
+		want, err := net.ResolveTCPAddr("tcp", tt.want)
+		require.Nil(t, err)
+		require.Equal(t, tt.expected, matches(bound.IP, bound.Port, want.IP, want.Port), "%s, %s", tt.bound, tt.want)
+	}
+}
+
+func TestSocketAddrs(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer l.Close()
+	lf, err := l.(*net.TCPListener).File()
+	require.Nil(t, err)
+
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.Nil(t, err)
+	defer pc.Close()
+	pcf, err := pc.File()
+	require.Nil(t, err)
+
+	// Pretend systemd passed the sockets.
+	activatedOnce.Do(func() {})
+	activated = []*os.File{lf, pcf}
+	activatedNames = []string{"http", "udp"}
+	defer func() { activated, activatedNames = nil, nil }()
+
+	require.True(t, IsAddr("fd://0"))
+	require.False(t, IsAddr("127.0.0.1:6969"))
+
+	passedL, err := Listener("fd://0")
+	require.Nil(t, err)
+	require.Equal(t, l.Addr().String(), passedL.Addr().String())
+	passedL.Close()
+
+	passedPC, err := PacketConn("fd://udp")
+	require.Nil(t, err)
+	require.Equal(t, pc.LocalAddr().String(), passedPC.LocalAddr().String())
+	passedPC.Close()
+
+	_, err = Listener("fd://udp")
+	require.NotNil(t, err)
+	_, err = PacketConn("fd://2")
+	require.NotNil(t, err)
+	_, err = PacketConn("fd://dns")
+	require.NotNil(t, err)
+}
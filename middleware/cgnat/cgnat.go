@@ -0,0 +1,208 @@
+// Package cgnat implements a Hook that limits the number of peers sharing
+// one IP address, as is the case for clients behind carrier-grade NAT, that
+// are added to a swarm.
+package cgnat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/clock"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+// Name is the name by which this middleware is registered with Chihaya.
+const Name = "cgnat"
+
+func init() {
+	middleware.RegisterDriver(Name, driver{})
+}
+
+var _ middleware.Driver = driver{}
+
+type driver struct{}
+
+func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
+	var cfg Config
+	err := yaml.UnmarshalStrict(optionBytes, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid options for middleware %s: %s", Name, err)
+	}
+
+	return NewHook(cfg)
+}
+
+// ErrInvalidMaxPeersPerIP is returned for a config with an invalid
+// MaxPeersPerIP.
+var ErrInvalidMaxPeersPerIP = errors.New("invalid max_peers_per_ip")
+
+// ErrInvalidPeerLifetime is returned for a config with an invalid
+// PeerLifetime.
+var ErrInvalidPeerLifetime = errors.New("invalid peer_lifetime")
+
+// Config represents the configuration for the cgnat middleware.
+type Config struct {
+	// MaxPeersPerIP is the number of peers with distinct peer IDs that are
+	// added to a swarm from one IP address. Peers announcing from an IP
+	// address that already has this many peers in the swarm receive a
+	// response, but are not added to the swarm.
+	MaxPeersPerIP int `yaml:"max_peers_per_ip"`
+
+	// PeerLifetime is the amount of time after which a peer that did not
+	// announce again is no longer counted.
+	// This should be the same as the peer lifetime of the storage.
+	PeerLifetime time.Duration `yaml:"peer_lifetime"`
+
+	// Clock is used to timestamp peers and to schedule garbage collection.
+	// It defaults to clock.Cached and is replaced in tests.
+	Clock clock.Clock `yaml:"-"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"maxPeersPerIP": cfg.MaxPeersPerIP,
+		"peerLifetime":  cfg.PeerLifetime,
+	}
+}
+
+func checkConfig(cfg Config) error {
+	if cfg.MaxPeersPerIP <= 0 {
+		return ErrInvalidMaxPeersPerIP
+	}
+
+	if cfg.PeerLifetime <= 0 {
+		return ErrInvalidPeerLifetime
+	}
+
+	return nil
+}
+
+// swarmIP identifies the peers announcing from one IP address in a swarm.
+type swarmIP struct {
+	infoHash bittorrent.InfoHash
+	ip       string
+}
+
+type hook struct {
+	cfg Config
+
+	// peers holds the time of the last announce of every peer, grouped by
+	// swarm and IP address.
+	peers map[swarmIP]map[bittorrent.PeerID]int64
+	sync.Mutex
+
+	closing chan struct{}
+}
+
+// NewHook creates a middleware that limits the number of peers from one IP
+// address in a swarm.
+func NewHook(cfg Config) (middleware.Hook, error) {
+	err := checkConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = clock.Cached
+	}
+
+	h := &hook{
+		cfg:     cfg,
+		peers:   make(map[swarmIP]map[bittorrent.PeerID]int64),
+		closing: make(chan struct{}),
+	}
+
+	go func() {
+		for {
+			select {
+			case <-h.closing:
+				return
+			case <-cfg.Clock.After(cfg.PeerLifetime / 2):
+				h.collectGarbage(cfg.Clock.Now().Add(-cfg.PeerLifetime))
+			}
+		}
+	}()
+
+	return h, nil
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	key := swarmIP{req.InfoHash, string(req.IP.IP)}
+	now := h.cfg.Clock.Now().UnixNano()
+
+	h.Lock()
+	defer h.Unlock()
+
+	peers := h.peers[key]
+	if req.Event == bittorrent.Stopped {
+		delete(peers, req.ID)
+		if len(peers) == 0 {
+			delete(h.peers, key)
+		}
+		return ctx, nil
+	}
+
+	if _, ok := peers[req.ID]; !ok && len(peers) >= h.cfg.MaxPeersPerIP {
+		log.Debug("cgnat: not adding peer to swarm", log.Fields{
+			"infoHash": req.InfoHash,
+			"ip":       req.IP,
+			"peers":    len(peers),
+		})
+		bittorrent.RecordDecision(ctx, Name, "swarm interaction skipped")
+		return context.WithValue(ctx, middleware.SkipSwarmInteractionKey, struct{}{}), nil
+	}
+
+	if peers == nil {
+		peers = make(map[bittorrent.PeerID]int64)
+		h.peers[key] = peers
+	}
+	peers[req.ID] = now
+
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't add peers to swarms.
+	return ctx, nil
+}
+
+// collectGarbage removes all peers that did not announce since cutoff.
+func (h *hook) collectGarbage(cutoff time.Time) {
+	cutoffUnix := cutoff.UnixNano()
+
+	h.Lock()
+	defer h.Unlock()
+
+	for key, peers := range h.peers {
+		for id, mtime := range peers {
+			if mtime <= cutoffUnix {
+				delete(peers, id)
+			}
+		}
+		if len(peers) == 0 {
+			delete(h.peers, key)
+		}
+	}
+}
+
+func (h *hook) Stop() stop.Result {
+	select {
+	case <-h.closing:
+		return stop.AlreadyStopped
+	default:
+	}
+	c := make(stop.Channel)
+	go func() {
+		close(h.closing)
+		c.Done()
+	}()
+	return c.Result()
+}
@@ -0,0 +1,77 @@
+package cgnat
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/clock"
+)
+
+var configTests = []struct {
+	cfg      Config
+	expected error
+}{
+	{Config{MaxPeersPerIP: 2, PeerLifetime: time.Minute}, nil},
+	{Config{MaxPeersPerIP: 0, PeerLifetime: time.Minute}, ErrInvalidMaxPeersPerIP},
+	{Config{MaxPeersPerIP: 2, PeerLifetime: 0}, ErrInvalidPeerLifetime},
+}
+
+func TestCheckConfig(t *testing.T) {
+	for _, tt := range configTests {
+		t.Run(fmt.Sprintf("%#v", tt.cfg), func(t *testing.T) {
+			require.Equal(t, tt.expected, checkConfig(tt.cfg))
+		})
+	}
+}
+
+func announce(id byte, ip string, event bittorrent.Event) *bittorrent.AnnounceRequest {
+	return &bittorrent.AnnounceRequest{
+		Event: event,
+		Peer: bittorrent.Peer{
+			ID: bittorrent.PeerID{id},
+			IP: bittorrent.IP{IP: net.ParseIP(ip).To4(), AddressFamily: bittorrent.IPv4},
+		},
+	}
+}
+
+func skipped(t *testing.T, h middleware.Hook, req *bittorrent.AnnounceRequest) bool {
+	ctx, err := h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	return ctx.Value(middleware.SkipSwarmInteractionKey) != nil
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	c := clock.NewMock(time.Unix(1e9, 0))
+	h, err := NewHook(Config{MaxPeersPerIP: 2, PeerLifetime: time.Minute, Clock: c})
+	require.Nil(t, err)
+	defer h.(*hook).Stop()
+
+	require.False(t, skipped(t, h, announce(1, "10.0.0.1", bittorrent.Started)))
+	require.False(t, skipped(t, h, announce(2, "10.0.0.1", bittorrent.Started)))
+	require.True(t, skipped(t, h, announce(3, "10.0.0.1", bittorrent.Started)))
+
+	// Peers already in the swarm and peers from other IPs are not affected.
+	require.False(t, skipped(t, h, announce(1, "10.0.0.1", bittorrent.None)))
+	require.False(t, skipped(t, h, announce(3, "10.0.0.2", bittorrent.Started)))
+
+	// Stopped peers make room for others.
+	require.False(t, skipped(t, h, announce(2, "10.0.0.1", bittorrent.Stopped)))
+	require.False(t, skipped(t, h, announce(3, "10.0.0.1", bittorrent.Started)))
+
+	// Peers that did not announce for their lifetime make room for others.
+	c.BlockUntil(1)
+	c.Add(30 * time.Second)
+	c.BlockUntil(1)
+	require.True(t, skipped(t, h, announce(4, "10.0.0.1", bittorrent.Started)))
+
+	c.Add(30 * time.Second)
+	c.BlockUntil(1)
+	require.False(t, skipped(t, h, announce(4, "10.0.0.1", bittorrent.Started)))
+}
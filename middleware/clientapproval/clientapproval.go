@@ -1,8 +1,9 @@
 // Package clientapproval implements a Hook that fails an Announce based on a
-// whitelist or blacklist of BitTorrent client IDs.
+// whitelist or blacklist of BitTorrent client IDs or PeerID prefixes.
 package clientapproval
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -26,7 +27,7 @@ type driver struct{}
 
 func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
 	var cfg Config
-	err := yaml.Unmarshal(optionBytes, &cfg)
+	err := yaml.UnmarshalStrict(optionBytes, &cfg)
 	if err != nil {
 		return nil, fmt.Errorf("invalid options for middleware %s: %s", Name, err)
 	}
@@ -42,11 +43,19 @@ var ErrClientUnapproved = bittorrent.ClientError("unapproved client")
 type Config struct {
 	Whitelist []string `yaml:"whitelist"`
 	Blacklist []string `yaml:"blacklist"`
+
+	// WhitelistPrefixes and BlacklistPrefixes are matched against the first
+	// bytes of the PeerID, for example "-TR2" or "-qB4".
+	WhitelistPrefixes []string `yaml:"whitelist_prefixes"`
+	BlacklistPrefixes []string `yaml:"blacklist_prefixes"`
 }
 
 type hook struct {
 	approved   map[bittorrent.ClientID]struct{}
 	unapproved map[bittorrent.ClientID]struct{}
+
+	approvedPrefixes   [][]byte
+	unapprovedPrefixes [][]byte
 }
 
 // NewHook returns an instance of the client approval middleware.
@@ -56,7 +65,9 @@ func NewHook(cfg Config) (middleware.Hook, error) {
 		unapproved: make(map[bittorrent.ClientID]struct{}),
 	}
 
-	if len(cfg.Whitelist) > 0 && len(cfg.Blacklist) > 0 {
+	whitelisted := len(cfg.Whitelist) > 0 || len(cfg.WhitelistPrefixes) > 0
+	blacklisted := len(cfg.Blacklist) > 0 || len(cfg.BlacklistPrefixes) > 0
+	if whitelisted && blacklisted {
 		return nil, fmt.Errorf("using both whitelist and blacklist is invalid")
 	}
 
@@ -80,24 +91,61 @@ func NewHook(cfg Config) (middleware.Hook, error) {
 		h.unapproved[cid] = struct{}{}
 	}
 
+	var err error
+	h.approvedPrefixes, err = parsePrefixes(cfg.WhitelistPrefixes)
+	if err != nil {
+		return nil, err
+	}
+
+	h.unapprovedPrefixes, err = parsePrefixes(cfg.BlacklistPrefixes)
+	if err != nil {
+		return nil, err
+	}
+
 	return h, nil
 }
 
+func parsePrefixes(prefixes []string) ([][]byte, error) {
+	var parsed [][]byte
+	for _, prefix := range prefixes {
+		if len(prefix) == 0 || len(prefix) > len(bittorrent.PeerID{}) {
+			return nil, fmt.Errorf("PeerID prefix %q must be between 1 and %d bytes", prefix, len(bittorrent.PeerID{}))
+		}
+		parsed = append(parsed, []byte(prefix))
+	}
+
+	return parsed, nil
+}
+
+// hasPrefix returns whether a PeerID starts with any of the prefixes.
+func hasPrefix(pid bittorrent.PeerID, prefixes [][]byte) bool {
+	for _, prefix := range prefixes {
+		if bytes.HasPrefix(pid[:], prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
 	clientID := bittorrent.NewClientID(req.Peer.ID)
 
-	if len(h.approved) > 0 {
-		if _, found := h.approved[clientID]; !found {
+	if len(h.approved) > 0 || len(h.approvedPrefixes) > 0 {
+		if _, found := h.approved[clientID]; !found && !hasPrefix(req.Peer.ID, h.approvedPrefixes) {
+			bittorrent.RecordDecision(ctx, Name, "rejected")
 			return ctx, ErrClientUnapproved
 		}
 	}
 
-	if len(h.unapproved) > 0 {
-		if _, found := h.unapproved[clientID]; found {
+	if len(h.unapproved) > 0 || len(h.unapprovedPrefixes) > 0 {
+		if _, found := h.unapproved[clientID]; found || hasPrefix(req.Peer.ID, h.unapprovedPrefixes) {
+			bittorrent.RecordDecision(ctx, Name, "rejected")
 			return ctx, ErrClientUnapproved
 		}
 	}
 
+	bittorrent.RecordDecision(ctx, Name, "approved")
 	return ctx, nil
 }
 
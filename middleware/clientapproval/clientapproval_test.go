@@ -47,6 +47,50 @@ var cases = []struct {
 		"12345678900000000000",
 		false,
 	},
+	// PeerID prefix is whitelisted
+	{
+		Config{
+			WhitelistPrefixes: []string{"-TR2", "-qB4"},
+		},
+		"-qB4250-000000000000",
+		true,
+	},
+	// PeerID prefix is not whitelisted
+	{
+		Config{
+			WhitelistPrefixes: []string{"-TR2", "-qB4"},
+		},
+		"-TR3000-000000000000",
+		false,
+	},
+	// Client ID is whitelisted, but not the PeerID prefix
+	{
+		Config{
+			Whitelist:         []string{"TR3000"},
+			WhitelistPrefixes: []string{"-TR2"},
+		},
+		"-TR3000-000000000000",
+		true,
+	},
+	// PeerID prefix is blacklisted
+	{
+		Config{
+			BlacklistPrefixes: []string{"-XL0"},
+		},
+		"-XL0012-000000000000",
+		false,
+	},
+}
+
+func TestNewHook(t *testing.T) {
+	_, err := NewHook(Config{WhitelistPrefixes: []string{"-TR2"}, Blacklist: []string{"XL0012"}})
+	require.NotNil(t, err)
+
+	_, err = NewHook(Config{WhitelistPrefixes: []string{""}})
+	require.NotNil(t, err)
+
+	_, err = NewHook(Config{BlacklistPrefixes: []string{"-XL0012-0000000000000"}})
+	require.NotNil(t, err)
 }
 
 func TestHandleAnnounce(t *testing.T) {
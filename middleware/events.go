@@ -0,0 +1,224 @@
+package middleware
+
+import (
+	"container/list"
+	"context"
+	"sync"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// Policies for announces with events that don't follow from the previous
+// announces of the same peer, such as a completed event of a peer that never
+// announced before.
+//
+// Misbehaving clients send such events, which make the numbers of seeders,
+// leechers and snatches of the storage drift.
+const (
+	// EventValidationOff applies all events as they are.
+	EventValidationOff = "off"
+
+	// EventValidationCorrect applies invalid completed events as if the
+	// announce had no event, so that no snatch is counted. Invalid stopped
+	// events are applied anyway, since the storage may know the peer.
+	EventValidationCorrect = "correct"
+
+	// EventValidationReject rejects announces with invalid events.
+	EventValidationReject = "reject"
+)
+
+const (
+	defaultEventValidation = EventValidationOff
+
+	// defaultEventStateCacheSize is the default number of peers whose
+	// state is tracked to validate their events.
+	defaultEventStateCacheSize = 1 << 18
+)
+
+// ErrInvalidEvent is returned for announces with invalid events if they are
+// rejected.
+var ErrInvalidEvent = bittorrent.ClientError("invalid event")
+
+// Reasons for which events are invalid.
+const (
+	invalidCompletedUnknown = "completed by unknown peer"
+	invalidCompletedTwice   = "completed twice"
+	invalidStoppedUnknown   = "stopped by unknown peer"
+)
+
+// The byte counters of announces that are checked for regressions.
+const (
+	counterUploaded   = "uploaded"
+	counterDownloaded = "downloaded"
+)
+
+// newEventHook returns the Hook implementing the given policy, or nil if
+// events are not validated.
+func newEventHook(cfg ResponseConfig) Hook {
+	switch cfg.EventValidation {
+	case EventValidationOff:
+		return nil
+	case EventValidationCorrect, EventValidationReject:
+		size := cfg.EventStateCacheSize
+		if size <= 0 {
+			size = defaultEventStateCacheSize
+			log.Warn("falling back to default configuration", log.Fields{
+				"name":     "EventStateCacheSize",
+				"provided": cfg.EventStateCacheSize,
+				"default":  size,
+			})
+		}
+		return &eventHook{
+			reject: cfg.EventValidation == EventValidationReject,
+			peers:  newPeerStates(size),
+		}
+	}
+
+	log.Warn("falling back to default configuration", log.Fields{
+		"name":     "EventValidation",
+		"provided": cfg.EventValidation,
+		"default":  defaultEventValidation,
+	})
+	return nil
+}
+
+// eventHook validates the events of announces against the previous
+// announces of the same peer.
+type eventHook struct {
+	// reject is true if invalid events are rejected rather than corrected.
+	reject bool
+	peers  *peerStates
+}
+
+func (h *eventHook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	// Announces that don't change any swarm can't make it drift.
+	if ctx.Value(SkipSwarmInteractionKey) != nil || ctx.Value(bittorrent.UnverifiedKey) != nil {
+		return ctx, nil
+	}
+
+	reason, regressed := h.peers.announce(req)
+	for _, counter := range regressed {
+		// Counters are passed on as they are, since consumers such as
+		// the passkey middleware treat them like a restarted client.
+		recordCounterRegression(counter)
+		bittorrent.RecordDecision(ctx, counter, "regressed without started event")
+	}
+	if reason == "" {
+		return ctx, nil
+	}
+	recordInvalidEvent(req.Event, reason)
+
+	if h.reject {
+		bittorrent.RecordDecision(ctx, "event", reason+", rejected")
+		return ctx, ErrInvalidEvent
+	}
+
+	// Stopped peers are removed in any case, since they may be known to
+	// the storage, for example after the tracker restarted.
+	if req.Event == bittorrent.Stopped {
+		bittorrent.RecordDecision(ctx, "event", reason+", applied")
+		return ctx, nil
+	}
+
+	bittorrent.RecordDecision(ctx, "event", reason+", corrected")
+	req.Event = bittorrent.None
+	return ctx, nil
+}
+
+func (h *eventHook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes have no events.
+	return ctx, nil
+}
+
+// peerState is what the announces of a peer in a swarm revealed.
+type peerState struct {
+	key string
+
+	// complete is true once the peer completed the torrent or announced
+	// as a seeder.
+	complete bool
+
+	// uploaded and downloaded are the byte counters of the last announce.
+	uploaded   uint64
+	downloaded uint64
+}
+
+// peerStates tracks the states of the most recently seen peers.
+//
+// Peers evicted from the cache, or announcing after the tracker restarted,
+// are unknown again.
+type peerStates struct {
+	size int
+
+	mu    sync.Mutex
+	peers map[string]*list.Element
+	lru   *list.List
+}
+
+func newPeerStates(size int) *peerStates {
+	return &peerStates{
+		size:  size,
+		peers: make(map[string]*list.Element),
+		lru:   list.New(),
+	}
+}
+
+// announce updates the state of the peer of req and returns why its event
+// is invalid, or an empty string if it is valid, and the names of the byte
+// counters that are lower than in the previous announce of the peer although
+// it didn't start again.
+//
+// Announces with invalid events update the state as if they had no event.
+func (s *peerStates) announce(req *bittorrent.AnnounceRequest) (invalid string, regressed []string) {
+	key := req.InfoHash.RawString() + string(req.Peer.ID[:])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var st *peerState
+	if e, ok := s.peers[key]; ok {
+		st = e.Value.(*peerState)
+		if req.Event != bittorrent.Started {
+			if req.Uploaded < st.uploaded {
+				regressed = append(regressed, counterUploaded)
+			}
+			if req.Downloaded < st.downloaded {
+				regressed = append(regressed, counterDownloaded)
+			}
+		}
+		if req.Event == bittorrent.Stopped {
+			s.lru.Remove(e)
+			delete(s.peers, key)
+			return "", regressed
+		}
+		s.lru.MoveToFront(e)
+	} else {
+		if req.Event == bittorrent.Stopped {
+			return invalidStoppedUnknown, nil
+		}
+
+		if s.lru.Len() >= s.size {
+			oldest := s.lru.Back()
+			s.lru.Remove(oldest)
+			delete(s.peers, oldest.Value.(*peerState).key)
+		}
+		st = &peerState{key: key}
+		s.peers[key] = s.lru.PushFront(st)
+
+		if req.Event == bittorrent.Completed {
+			st.complete = req.Left == 0
+			st.uploaded, st.downloaded = req.Uploaded, req.Downloaded
+			return invalidCompletedUnknown, nil
+		}
+	}
+	st.uploaded, st.downloaded = req.Uploaded, req.Downloaded
+
+	if req.Event == bittorrent.Completed && st.complete {
+		return invalidCompletedTwice, regressed
+	}
+	if req.Left == 0 {
+		st.complete = true
+	}
+	return "", regressed
+}
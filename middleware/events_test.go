@@ -0,0 +1,150 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/storage/memory"
+)
+
+func TestPeerStates(t *testing.T) {
+	type announce struct {
+		peer     string
+		event    bittorrent.Event
+		left     uint64
+		expected string
+	}
+	var table = []struct {
+		name      string
+		announces []announce
+	}{
+		{"valid", []announce{
+			{"a", bittorrent.Started, 1, ""},
+			{"a", bittorrent.None, 1, ""},
+			{"a", bittorrent.Completed, 0, ""},
+			{"a", bittorrent.None, 0, ""},
+			{"a", bittorrent.Stopped, 0, ""},
+		}},
+		{"completed by unknown peer", []announce{
+			{"a", bittorrent.Completed, 0, invalidCompletedUnknown},
+			{"a", bittorrent.Completed, 0, invalidCompletedTwice},
+		}},
+		{"completed twice", []announce{
+			{"a", bittorrent.Started, 1, ""},
+			{"a", bittorrent.Completed, 0, ""},
+			{"a", bittorrent.Completed, 0, invalidCompletedTwice},
+		}},
+		{"completed by seeder", []announce{
+			{"a", bittorrent.Started, 0, ""},
+			{"a", bittorrent.Completed, 0, invalidCompletedTwice},
+		}},
+		{"stopped by unknown peer", []announce{
+			{"a", bittorrent.Started, 1, ""},
+			{"a", bittorrent.Stopped, 1, ""},
+			{"a", bittorrent.Stopped, 1, invalidStoppedUnknown},
+		}},
+		{"evicted", []announce{
+			{"a", bittorrent.Started, 1, ""},
+			{"b", bittorrent.Started, 1, ""},
+			{"c", bittorrent.Started, 1, ""},
+			{"a", bittorrent.Completed, 0, invalidCompletedUnknown},
+		}},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newPeerStates(2)
+			for i, a := range tt.announces {
+				req := &bittorrent.AnnounceRequest{Event: a.event, Left: a.left}
+				req.Peer.ID = bittorrent.PeerIDFromString(a.peer + "aaaaaaaaaaaaaaaaaaa")
+				invalid, _ := s.announce(req)
+				require.Equal(t, a.expected, invalid, "announce %d", i)
+			}
+		})
+	}
+}
+
+func TestCounterRegressions(t *testing.T) {
+	type announce struct {
+		event      bittorrent.Event
+		uploaded   uint64
+		downloaded uint64
+		expected   []string
+	}
+	var table = []struct {
+		name      string
+		announces []announce
+	}{
+		{"increasing", []announce{
+			{bittorrent.Started, 0, 0, nil},
+			{bittorrent.None, 10, 20, nil},
+			{bittorrent.Stopped, 10, 30, nil},
+		}},
+		{"regressed", []announce{
+			{bittorrent.Started, 0, 0, nil},
+			{bittorrent.None, 10, 20, nil},
+			{bittorrent.None, 5, 20, []string{counterUploaded}},
+			{bittorrent.Stopped, 0, 0, []string{counterUploaded, counterDownloaded}},
+		}},
+		{"restarted", []announce{
+			{bittorrent.None, 10, 20, nil},
+			{bittorrent.Started, 0, 0, nil},
+			{bittorrent.None, 1, 1, nil},
+		}},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newPeerStates(2)
+			for i, a := range tt.announces {
+				req := &bittorrent.AnnounceRequest{Event: a.event, Left: 1, Uploaded: a.uploaded, Downloaded: a.downloaded}
+				_, regressed := s.announce(req)
+				require.Equal(t, a.expected, regressed, "announce %d", i)
+			}
+		})
+	}
+}
+
+func TestEventValidation(t *testing.T) {
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	peer := bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("00000000000000000001"),
+		IP:   bittorrent.IP{IP: net.ParseIP("10.0.0.1").To4(), AddressFamily: bittorrent.IPv4},
+		Port: 1,
+	}
+	complete := func(lgc *Logic) error {
+		req := &bittorrent.AnnounceRequest{InfoHash: ih, Event: bittorrent.Completed, Peer: peer}
+		ctx, resp, err := lgc.HandleAnnounce(context.Background(), req)
+		if err == nil {
+			lgc.AfterAnnounce(ctx, req, resp)
+		}
+		return err
+	}
+
+	var table = []struct {
+		validation string
+		expected   error
+		snatches   uint32
+	}{
+		{EventValidationOff, nil, 1},
+		{EventValidationCorrect, nil, 0},
+		{EventValidationReject, ErrInvalidEvent, 0},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.validation, func(t *testing.T) {
+			ps, err := memory.New(memory.Config{})
+			require.Nil(t, err)
+			defer func() { ps.Stop().Wait() }()
+
+			lgc := NewLogic(ResponseConfig{EventValidation: tt.validation}, ps, nil, nil)
+			require.Equal(t, tt.expected, complete(lgc))
+			require.Equal(t, tt.expected, complete(lgc))
+			require.Equal(t, tt.snatches, ps.ScrapeSwarm(context.Background(), ih, bittorrent.IPv4).Snatches)
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package middleware
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// Announce histories record the last announces of individual peers, so that
+// operators can see what happened to the announces of a client that reports
+// problems, such as being dropped from swarms.
+//
+// Announces are only recorded for peers that are watched explicitly, by peer
+// ID or IP address.
+const (
+	// DefaultHistorySize is the number of announces recorded per watched
+	// peer if no size is given.
+	DefaultHistorySize = 50
+
+	// MaxHistorySize is the largest number of announces recorded per
+	// watched peer.
+	MaxHistorySize = 1000
+
+	// MaxWatches is the number of peers that can be watched at once.
+	MaxWatches = 64
+)
+
+// ErrTooManyWatches is returned if MaxWatches peers are watched already.
+var ErrTooManyWatches = fmt.Errorf("at most %d peers can be watched", MaxWatches)
+
+// AnnounceRecord is an announce recorded in an announce history, with its
+// outcome.
+type AnnounceRecord struct {
+	Time       time.Time `json:"time"`
+	InfoHash   string    `json:"info_hash"`
+	PeerID     string    `json:"peer_id"`
+	IP         string    `json:"ip"`
+	Port       uint16    `json:"port"`
+	Event      string    `json:"event"`
+	Uploaded   uint64    `json:"uploaded"`
+	Downloaded uint64    `json:"downloaded"`
+	Left       uint64    `json:"left"`
+	NumWant    uint32    `json:"numwant"`
+
+	// Error is the error or failure reason the announce was answered with,
+	// if any. The remaining fields are only set otherwise.
+	Error    string `json:"error,omitempty"`
+	Interval string `json:"interval,omitempty"`
+	Seeders  uint32 `json:"seeders"`
+	Leechers uint32 `json:"leechers"`
+	Peers    int    `json:"peers"`
+}
+
+// history is a ring of the last announces of a watched peer.
+type history struct {
+	records []AnnounceRecord
+	next    int
+	full    bool
+}
+
+func (h *history) add(r AnnounceRecord) {
+	h.records[h.next] = r
+	h.next++
+	if h.next == len(h.records) {
+		h.next, h.full = 0, true
+	}
+}
+
+// list returns the records from the oldest to the most recent.
+func (h *history) list() []AnnounceRecord {
+	if !h.full {
+		return append([]AnnounceRecord(nil), h.records[:h.next]...)
+	}
+	return append(append([]AnnounceRecord(nil), h.records[h.next:]...), h.records[:h.next]...)
+}
+
+// announceHistories holds the histories of all watched peers.
+type announceHistories struct {
+	// watched is the number of watched peers, so that announces can be
+	// skipped without locking if there are none.
+	watched int32
+
+	mu        sync.RWMutex
+	histories map[string]*history
+}
+
+var histories = &announceHistories{histories: make(map[string]*history)}
+
+// parseWatch parses a peer ID, hex-encoded like in the admin API, or an IP
+// address into the key of its history.
+func parseWatch(target string) (string, error) {
+	if b, err := hex.DecodeString(target); err == nil && len(b) == 20 {
+		return "peer_id:" + hex.EncodeToString(b), nil
+	}
+	if ip := net.ParseIP(target); ip != nil {
+		return "ip:" + ip.String(), nil
+	}
+	return "", fmt.Errorf("invalid peer %q: must be a hex-encoded peer ID or an IP address", target)
+}
+
+// WatchAnnounces starts recording the last size announces of a peer, given
+// by its hex-encoded peer ID or by IP address, and returns the key its
+// history is listed under. The history of a peer that is watched already is
+// kept, but resized.
+func WatchAnnounces(target string, size int) (string, error) {
+	if size <= 0 {
+		size = DefaultHistorySize
+	}
+	if size > MaxHistorySize {
+		return "", fmt.Errorf("at most %d announces can be recorded per peer", MaxHistorySize)
+	}
+	key, err := parseWatch(target)
+	if err != nil {
+		return "", err
+	}
+
+	histories.mu.Lock()
+	defer histories.mu.Unlock()
+
+	h := &history{records: make([]AnnounceRecord, size)}
+	if old, ok := histories.histories[key]; ok {
+		for _, r := range old.list() {
+			h.add(r)
+		}
+	} else if len(histories.histories) >= MaxWatches {
+		return "", ErrTooManyWatches
+	}
+	histories.histories[key] = h
+	atomic.StoreInt32(&histories.watched, int32(len(histories.histories)))
+	return key, nil
+}
+
+// UnwatchAnnounces stops recording the announces of a peer and discards its
+// history. It returns whether the peer was watched.
+func UnwatchAnnounces(target string) (bool, error) {
+	key, err := parseWatch(target)
+	if err != nil {
+		return false, err
+	}
+
+	histories.mu.Lock()
+	defer histories.mu.Unlock()
+	_, ok := histories.histories[key]
+	delete(histories.histories, key)
+	atomic.StoreInt32(&histories.watched, int32(len(histories.histories)))
+	return ok, nil
+}
+
+// WatchedAnnounces returns the keys of the histories of all watched peers.
+func WatchedAnnounces() []string {
+	histories.mu.RLock()
+	keys := make([]string, 0, len(histories.histories))
+	for key := range histories.histories {
+		keys = append(keys, key)
+	}
+	histories.mu.RUnlock()
+
+	sort.Strings(keys)
+	return keys
+}
+
+// ErrNotWatched is returned for the history of a peer that is not watched.
+var ErrNotWatched = errors.New("peer is not watched")
+
+// AnnounceHistory returns the recorded announces of a watched peer, from the
+// oldest to the most recent.
+func AnnounceHistory(target string) ([]AnnounceRecord, error) {
+	key, err := parseWatch(target)
+	if err != nil {
+		return nil, err
+	}
+
+	histories.mu.RLock()
+	defer histories.mu.RUnlock()
+	h, ok := histories.histories[key]
+	if !ok {
+		return nil, ErrNotWatched
+	}
+	return h.list(), nil
+}
+
+// recordAnnounce adds an announce and its outcome to the histories of the
+// peer, if it is watched.
+func recordAnnounce(req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse, err error) {
+	if atomic.LoadInt32(&histories.watched) == 0 {
+		return
+	}
+
+	keys := [2]string{"peer_id:" + hex.EncodeToString(req.Peer.ID[:]), "ip:" + req.Peer.IP.String()}
+
+	histories.mu.Lock()
+	defer histories.mu.Unlock()
+	for _, key := range keys {
+		h, ok := histories.histories[key]
+		if !ok {
+			continue
+		}
+
+		r := AnnounceRecord{
+			Time:       time.Now(),
+			InfoHash:   req.InfoHash.String(),
+			PeerID:     hex.EncodeToString(req.Peer.ID[:]),
+			IP:         req.Peer.IP.String(),
+			Port:       req.Peer.Port,
+			Event:      req.Event.String(),
+			Uploaded:   req.Uploaded,
+			Downloaded: req.Downloaded,
+			Left:       req.Left,
+			NumWant:    req.NumWant,
+		}
+		switch {
+		case err != nil:
+			r.Error = err.Error()
+		case resp.FailureReason != "":
+			r.Error = resp.FailureReason
+		default:
+			r.Interval = resp.Interval.String()
+			r.Seeders, r.Leechers = resp.Complete, resp.Incomplete
+			r.Peers = len(resp.IPv4Peers) + len(resp.IPv6Peers)
+		}
+		h.add(r)
+	}
+}
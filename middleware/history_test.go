@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"encoding/hex"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+func TestAnnounceHistory(t *testing.T) {
+	peerID := bittorrent.PeerIDFromString("-TR3000-000000000001")
+	req := &bittorrent.AnnounceRequest{
+		InfoHash: bittorrent.InfoHashFromString("00000000000000000001"),
+		Left:     100,
+		Peer:     bittorrent.Peer{ID: peerID, IP: bittorrent.IP{IP: net.ParseIP("10.0.0.1").To4(), AddressFamily: bittorrent.IPv4}, Port: 6881},
+	}
+
+	_, err := AnnounceHistory(hex.EncodeToString(peerID[:]))
+	require.Equal(t, ErrNotWatched, err)
+	_, err = WatchAnnounces("not a peer", 0)
+	require.Error(t, err)
+
+	key, err := WatchAnnounces(hex.EncodeToString(peerID[:]), 2)
+	require.NoError(t, err)
+	defer UnwatchAnnounces(key[len("peer_id:"):])
+	ipKey, err := WatchAnnounces("10.0.0.1", 0)
+	require.NoError(t, err)
+	defer UnwatchAnnounces("10.0.0.1")
+	require.Equal(t, []string{ipKey, key}, WatchedAnnounces())
+
+	for left := uint64(3); left > 0; left-- {
+		req.Left = left
+		recordAnnounce(req, &bittorrent.AnnounceResponse{Complete: 1}, nil)
+	}
+	recordAnnounce(req, nil, errors.New("rate limited"))
+
+	// Only the last two announces are kept for the peer ID.
+	history, err := AnnounceHistory(hex.EncodeToString(peerID[:]))
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	require.Equal(t, uint64(1), history[0].Left)
+	require.Equal(t, uint32(1), history[0].Seeders)
+	require.Equal(t, "rate limited", history[1].Error)
+
+	history, err = AnnounceHistory("10.0.0.1")
+	require.NoError(t, err)
+	require.Len(t, history, 4)
+	require.Equal(t, uint64(3), history[0].Left)
+
+	// Resizing keeps the most recent announces.
+	_, err = WatchAnnounces("10.0.0.1", 1)
+	require.NoError(t, err)
+	history, err = AnnounceHistory("10.0.0.1")
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	require.Equal(t, "rate limited", history[0].Error)
+
+	found, err := UnwatchAnnounces("10.0.0.1")
+	require.NoError(t, err)
+	require.True(t, found)
+	found, err = UnwatchAnnounces("10.0.0.1")
+	require.NoError(t, err)
+	require.False(t, found)
+}
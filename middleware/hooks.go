@@ -2,6 +2,10 @@ package middleware
 
 import (
 	"context"
+	"math"
+	"net"
+	"sort"
+	"strconv"
 
 	"github.com/chihaya/chihaya/bittorrent"
 	"github.com/chihaya/chihaya/storage"
@@ -30,37 +34,63 @@ type swarmInteractionHook struct {
 }
 
 func (h *swarmInteractionHook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (_ context.Context, err error) {
-	if ctx.Value(SkipSwarmInteractionKey) != nil {
+	if ctx.Value(SkipSwarmInteractionKey) != nil || ctx.Value(bittorrent.UnverifiedKey) != nil {
 		return ctx, nil
 	}
 
+	if req.AlternatePeer != nil {
+		return ctx, h.interactMultiHomed(ctx, req, req.Peer, *req.AlternatePeer)
+	}
+	return ctx, h.interact(ctx, req, req.Peer)
+}
+
+// interactMultiHomed updates the swarms of both address families according
+// to the announce of a multi-homed client, which is stored as one Peer with
+// the endpoints p and alternate.
+func (h *swarmInteractionHook) interactMultiHomed(ctx context.Context, req *bittorrent.AnnounceRequest, p, alternate bittorrent.Peer) error {
 	switch {
 	case req.Event == bittorrent.Stopped:
-		err = h.store.DeleteSeeder(req.InfoHash, req.Peer)
+		// Deleting one endpoint deletes both, unless the PeerStore stores
+		// them as independent Peers, so the other may be gone already.
+		if err := h.interact(ctx, req, p); err != nil {
+			return err
+		}
+		return h.interact(ctx, req, alternate)
+	case req.Event == bittorrent.Completed:
+		return storage.GraduateMultiHomedLeecher(ctx, h.store, req.InfoHash, p, alternate)
+	case req.Left == 0:
+		return storage.PutMultiHomedSeeder(ctx, h.store, req.InfoHash, p, alternate)
+	default:
+		return storage.PutMultiHomedLeecher(ctx, h.store, req.InfoHash, p, alternate)
+	}
+}
+
+// interact updates the swarm of the given Peer according to the announce.
+func (h *swarmInteractionHook) interact(ctx context.Context, req *bittorrent.AnnounceRequest, p bittorrent.Peer) (err error) {
+	switch {
+	case req.Event == bittorrent.Stopped:
+		err = h.store.DeleteSeeder(ctx, req.InfoHash, p)
 		if err != nil && err != storage.ErrResourceDoesNotExist {
-			return ctx, err
+			return err
 		}
 
-		err = h.store.DeleteLeecher(req.InfoHash, req.Peer)
+		err = h.store.DeleteLeecher(ctx, req.InfoHash, p)
 		if err != nil && err != storage.ErrResourceDoesNotExist {
-			return ctx, err
+			return err
 		}
 	case req.Event == bittorrent.Completed:
-		err = h.store.GraduateLeecher(req.InfoHash, req.Peer)
-		return ctx, err
+		return h.store.GraduateLeecher(ctx, req.InfoHash, p)
 	case req.Left == 0:
 		// Completed events will also have Left == 0, but by making this
 		// an extra case we can treat "old" seeders differently from
 		// graduating leechers. (Calling PutSeeder is probably faster
 		// than calling GraduateLeecher.)
-		err = h.store.PutSeeder(req.InfoHash, req.Peer)
-		return ctx, err
+		return h.store.PutSeeder(ctx, req.InfoHash, p)
 	default:
-		err = h.store.PutLeecher(req.InfoHash, req.Peer)
-		return ctx, err
+		return h.store.PutLeecher(ctx, req.InfoHash, p)
 	}
 
-	return ctx, nil
+	return nil
 }
 
 func (h *swarmInteractionHook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
@@ -85,8 +115,22 @@ type scrapeAddressType struct{}
 // it being set to false.
 var ScrapeIsIPv6Key = scrapeAddressType{}
 
+type hiddenSwarms struct{}
+
+// HiddenSwarmsKey is the key under which to store the infohashes of a Scrape
+// whose swarms must not be revealed.
+// The value is expected to be of type map[bittorrent.InfoHash]struct{}.
+// Hidden swarms are scraped as if they had no peers.
+var HiddenSwarmsKey = hiddenSwarms{}
+
 type responseHook struct {
-	store storage.PeerStore
+	store         storage.PeerStore
+	shuffler      shuffler
+	maxPeersPerIP int
+
+	// leecherSeedRatio is the fraction of the peers returned to leechers
+	// that are seeders, or 0 to leave the mix to the PeerStore.
+	leecherSeedRatio float64
 }
 
 func (h *responseHook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (_ context.Context, err error) {
@@ -95,24 +139,223 @@ func (h *responseHook) HandleAnnounce(ctx context.Context, req *bittorrent.Annou
 	}
 
 	// Add the Scrape data to the response.
-	s := h.store.ScrapeSwarm(req.InfoHash, req.IP.AddressFamily)
+	s := h.store.ScrapeSwarm(ctx, req.InfoHash, req.IP.AddressFamily)
 	resp.Incomplete = s.Incomplete
 	resp.Complete = s.Complete
 
-	err = h.appendPeers(req, resp)
+	if req.InfoHash.Reserved() {
+		bittorrent.RecordDecision(ctx, "swarm", "test")
+	}
+
+	// Clients that don't want any peers, typically because they are
+	// stopping, only register their announce and receive the counts.
+	if req.NumWant == 0 {
+		recordPeerlessAnnounce(req.IP.AddressFamily)
+		bittorrent.RecordDecision(ctx, "peer-selection", "none (numwant=0)")
+		return ctx, nil
+	}
+
+	selection := h.shuffler.strategy()
+	if h.maxPeersPerIP > 0 {
+		selection += ", max " + strconv.Itoa(h.maxPeersPerIP) + " per IP"
+	}
+	if h.leecherSeedRatio > 0 && req.Left > 0 {
+		selection += ", " + strconv.FormatFloat(h.leecherSeedRatio*100, 'f', -1, 64) + "% seeders"
+	}
+	if len(req.ExcludedPeers) > 0 {
+		selection += ", excluding " + strconv.Itoa(len(req.ExcludedPeers)) + " known peers"
+	}
+	if subnet, ok := ctx.Value(bittorrent.ClientSubnetKey).(*net.IPNet); ok {
+		selection += ", preferring peers in " + subnet.String()
+	}
+	bittorrent.RecordDecision(ctx, "peer-selection", selection)
+
+	err = h.appendPeers(ctx, req, resp)
+	if err != nil {
+		return ctx, err
+	}
+
+	// Multi-homed peers additionally receive peers of the other address
+	// family, as described in BEP 45.
+	if req.AlternatePeer != nil {
+		err = h.appendAlternatePeers(ctx, req, resp)
+	}
 	return ctx, err
 }
 
-func (h *responseHook) appendPeers(req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) error {
+// announcePeers returns the peers of the swarm of the given Peer for an
+// announce.
+func (h *responseHook) announcePeers(ctx context.Context, req *bittorrent.AnnounceRequest, p bittorrent.Peer) ([]bittorrent.Peer, error) {
 	seeding := req.Left == 0
-	peers, err := h.store.AnnouncePeers(req.InfoHash, seeding, int(req.NumWant), req.Peer)
+	excluded := excludedEndpoints(req.ExcludedPeers, p.IP.AddressFamily)
+
+	// Peers in the subnet of the client are preferred, if a trusted proxy
+	// asserted one of the family of the peers.
+	subnet, _ := ctx.Value(bittorrent.ClientSubnetKey).(*net.IPNet)
+	if subnet != nil && (subnet.IP.To4() != nil) != (p.IP.AddressFamily == bittorrent.IPv4) {
+		subnet = nil
+	}
+
+	// Ask for more peers to make up for the ones that are left out, and to
+	// choose the nearby ones from.
+	numWant := int(req.NumWant) + len(excluded)
+	if h.maxPeersPerIP > 0 || subnet != nil {
+		numWant *= 2
+	}
+
+	var peers []bittorrent.Peer
+	var err error
+	if h.leecherSeedRatio > 0 {
+		peers, err = h.balancedPeers(ctx, req.InfoHash, seeding, numWant, p)
+	} else {
+		peers, err = h.store.AnnouncePeers(ctx, req.InfoHash, seeding, numWant, p)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(excluded) > 0 {
+		peers = excludePeers(peers, excluded)
+	}
+	if h.maxPeersPerIP > 0 {
+		peers = limitPeersPerIP(peers, h.maxPeersPerIP)
+	}
+	if subnet != nil {
+		preferSubnet(peers, subnet)
+	}
+	if len(peers) > int(req.NumWant) {
+		peers = peers[:req.NumWant]
+	}
+
+	h.shuffler.shuffle(req, peers)
+	return peers, nil
+}
+
+// balancedPeers returns up to numWant peers of the swarm of the given Peer.
+// Seeders only receive leechers, leechers receive seeders and leechers in
+// the configured ratio. If there are not enough peers of one kind, more of
+// the other kind are returned.
+func (h *responseHook) balancedPeers(ctx context.Context, ih bittorrent.InfoHash, seeding bool, numWant int, p bittorrent.Peer) ([]bittorrent.Peer, error) {
+	if seeding {
+		return h.store.AnnounceLeechers(ctx, ih, numWant, p)
+	}
+
+	numSeeders := int(math.Round(h.leecherSeedRatio * float64(numWant)))
+	seeders, err := h.store.AnnounceSeeders(ctx, ih, numSeeders, p)
+	if err != nil {
+		return nil, err
+	}
+
+	leechers, err := h.store.AnnounceLeechers(ctx, ih, numWant-len(seeders), p)
+	if err != nil {
+		return nil, err
+	}
+
+	// Make up for missing leechers with more seeders.
+	if missing := numWant - len(seeders) - len(leechers); missing > 0 && len(seeders) == numSeeders {
+		seeders, err = h.store.AnnounceSeeders(ctx, ih, numSeeders+missing, p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return append(seeders, leechers...), nil
+}
+
+// limitPeersPerIP filters peers in place, so that at most max peers share an
+// IP address. This avoids returning many peers behind the same NAT, of which
+// most are likely not connectable.
+func limitPeersPerIP(peers []bittorrent.Peer, max int) []bittorrent.Peer {
+	counts := make(map[string]int, len(peers))
+	filtered := peers[:0]
+	for _, p := range peers {
+		ip := string(p.IP.IP)
+		if counts[ip] >= max {
+			continue
+		}
+		counts[ip]++
+		filtered = append(filtered, p)
+	}
+	return filtered
+}
+
+// preferSubnet reorders peers in place, so that the peers in subnet come
+// first and are kept when the peers are cut down to the number wanted. The
+// order is shuffled afterwards anyway.
+func preferSubnet(peers []bittorrent.Peer, subnet *net.IPNet) {
+	sort.SliceStable(peers, func(i, j int) bool {
+		return subnet.Contains(peers[i].IP.IP) && !subnet.Contains(peers[j].IP.IP)
+	})
+}
+
+// endpoint is the address of a peer, which identifies excluded peers.
+type endpoint struct {
+	ip   [net.IPv6len]byte
+	port uint16
+}
+
+func endpointOf(p bittorrent.Peer) (e endpoint) {
+	copy(e.ip[:], p.IP.To16())
+	e.port = p.Port
+	return
+}
+
+// excludedEndpoints returns the set of endpoints of the excluded peers of the
+// given address family.
+func excludedEndpoints(peers []bittorrent.Peer, af bittorrent.AddressFamily) map[endpoint]struct{} {
+	var excluded map[endpoint]struct{}
+	for _, p := range peers {
+		if p.IP.AddressFamily != af {
+			continue
+		}
+		if excluded == nil {
+			excluded = make(map[endpoint]struct{}, len(peers))
+		}
+		excluded[endpointOf(p)] = struct{}{}
+	}
+	return excluded
+}
+
+// excludePeers filters peers in place, leaving out the excluded endpoints.
+func excludePeers(peers []bittorrent.Peer, excluded map[endpoint]struct{}) []bittorrent.Peer {
+	filtered := peers[:0]
+	for _, p := range peers {
+		if _, ok := excluded[endpointOf(p)]; !ok {
+			filtered = append(filtered, p)
+		}
+	}
+	return filtered
+}
+
+func (h *responseHook) appendAlternatePeers(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) error {
+	peers, err := h.announcePeers(ctx, req, *req.AlternatePeer)
+	if err != nil && err != storage.ErrResourceDoesNotExist {
+		return err
+	}
+
+	switch req.AlternatePeer.IP.AddressFamily {
+	case bittorrent.IPv4:
+		resp.IPv4Peers = peers
+	case bittorrent.IPv6:
+		resp.IPv6Peers = peers
+	default:
+		panic("attempted to append peer that is neither IPv4 nor IPv6")
+	}
+
+	return nil
+}
+
+func (h *responseHook) appendPeers(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) error {
+	seeding := req.Left == 0
+	peers, err := h.announcePeers(ctx, req, req.Peer)
 	if err != nil && err != storage.ErrResourceDoesNotExist {
 		return err
 	}
 
 	// Some clients expect a minimum of their own peer representation returned to
-	// them if they are the only peer in a swarm.
-	if len(peers) == 0 {
+	// them if they are the only peer in a swarm. Clients that excluded peers
+	// are not alone.
+	if len(peers) == 0 && len(req.ExcludedPeers) == 0 {
 		if seeding {
 			resp.Complete++
 		} else {
@@ -138,8 +381,21 @@ func (h *responseHook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeR
 		return ctx, nil
 	}
 
+	hidden, _ := ctx.Value(HiddenSwarmsKey).(map[bittorrent.InfoHash]struct{})
+	withActivity := ctx.Value(bittorrent.ScrapeActivityKey) != nil
 	for _, infoHash := range req.InfoHashes {
-		resp.Files = append(resp.Files, h.store.ScrapeSwarm(infoHash, req.AddressFamily))
+		if _, ok := hidden[infoHash]; ok {
+			resp.Files = append(resp.Files, bittorrent.Scrape{InfoHash: infoHash})
+			continue
+		}
+
+		scrape := h.store.ScrapeSwarm(ctx, infoHash, req.AddressFamily)
+		if withActivity {
+			if activity, ok := storage.Activity(ctx, h.store, infoHash, req.AddressFamily); ok {
+				scrape.Created, scrape.LastAnnounce = activity.Created, activity.LastAnnounce
+			}
+		}
+		resp.Files = append(resp.Files, scrape)
 	}
 
 	return ctx, nil
@@ -0,0 +1,347 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/internal/chisquare"
+	"github.com/chihaya/chihaya/storage"
+	"github.com/chihaya/chihaya/storage/memory"
+)
+
+func TestLimitPeersPerIP(t *testing.T) {
+	peer := func(ip string, port uint16) bittorrent.Peer {
+		return bittorrent.Peer{
+			IP:   bittorrent.IP{IP: net.ParseIP(ip).To4(), AddressFamily: bittorrent.IPv4},
+			Port: port,
+		}
+	}
+
+	peers := []bittorrent.Peer{
+		peer("10.0.0.1", 1),
+		peer("10.0.0.1", 2),
+		peer("10.0.0.2", 1),
+		peer("10.0.0.1", 3),
+		peer("10.0.0.2", 2),
+	}
+	expected := []bittorrent.Peer{
+		peer("10.0.0.1", 1),
+		peer("10.0.0.1", 2),
+		peer("10.0.0.2", 1),
+		peer("10.0.0.2", 2),
+	}
+	require.Equal(t, expected, limitPeersPerIP(peers, 2))
+}
+
+func TestResponseHookNumWantZero(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { ps.Stop().Wait() }()
+
+	peer := func(port uint16) bittorrent.Peer {
+		return bittorrent.Peer{
+			IP:   bittorrent.IP{IP: net.ParseIP("10.0.0.1").To4(), AddressFamily: bittorrent.IPv4},
+			Port: port,
+		}
+	}
+	var ih bittorrent.InfoHash
+	require.Nil(t, ps.PutSeeder(context.Background(), ih, peer(1)))
+
+	h := &responseHook{store: ps, shuffler: noShuffler{}}
+	for _, numWant := range []uint32{0, 10} {
+		req := &bittorrent.AnnounceRequest{InfoHash: ih, NumWant: numWant, Left: 1, Peer: peer(2)}
+		resp := &bittorrent.AnnounceResponse{}
+		_, err := h.HandleAnnounce(context.Background(), req, resp)
+		require.Nil(t, err)
+		require.Equal(t, uint32(1), resp.Complete)
+		require.Len(t, resp.IPv4Peers, int(numWant/10))
+	}
+}
+
+func TestMultiHomedSwarmInteraction(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { ps.Stop().Wait() }()
+
+	h := &swarmInteractionHook{store: ps}
+	var ih bittorrent.InfoHash
+	v4 := bittorrent.Peer{IP: bittorrent.IP{IP: net.ParseIP("10.0.0.1").To4(), AddressFamily: bittorrent.IPv4}, Port: 1}
+	v6 := bittorrent.Peer{IP: bittorrent.IP{IP: net.ParseIP("fc00::1"), AddressFamily: bittorrent.IPv6}, Port: 1}
+	leechers := func(af bittorrent.AddressFamily) uint32 {
+		return ps.ScrapeSwarm(context.Background(), ih, af).Incomplete
+	}
+
+	req := &bittorrent.AnnounceRequest{InfoHash: ih, Left: 1, Peer: v4, AlternatePeer: &v6}
+	_, err = h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	require.Equal(t, uint32(1), leechers(bittorrent.IPv4))
+	require.Equal(t, uint32(1), leechers(bittorrent.IPv6))
+
+	// Stopping over one address family stops the whole peer.
+	req = &bittorrent.AnnounceRequest{InfoHash: ih, Event: bittorrent.Stopped, Left: 1, Peer: v6}
+	_, err = h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	require.Equal(t, uint32(0), leechers(bittorrent.IPv4))
+	require.Equal(t, uint32(0), leechers(bittorrent.IPv6))
+}
+
+func TestReservedInfoHashes(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { ps.Stop().Wait() }()
+
+	lgc := NewLogic(ResponseConfig{}, ps, nil, nil)
+	peer := func(port uint16) bittorrent.Peer {
+		return bittorrent.Peer{
+			IP:   bittorrent.IP{IP: net.ParseIP("10.0.0.1").To4(), AddressFamily: bittorrent.IPv4},
+			Port: port,
+		}
+	}
+	ih := bittorrent.ReservedInfoHash([]byte("e2e"))
+
+	for port := uint16(1); port <= 2; port++ {
+		req := &bittorrent.AnnounceRequest{InfoHash: ih, NumWant: 10, Left: 1, Peer: peer(port)}
+		ctx, resp, err := lgc.HandleAnnounce(context.Background(), req)
+		require.Nil(t, err)
+		lgc.AfterAnnounce(ctx, req, resp)
+
+		// The second peer receives the first one from the test swarm.
+		require.Equal(t, []bittorrent.Peer{peer(1)}, resp.IPv4Peers)
+	}
+
+	// The test swarm never reached the configured storage.
+	scrape := ps.ScrapeSwarm(context.Background(), ih, bittorrent.IPv4)
+	require.Equal(t, uint32(0), scrape.Incomplete)
+	_, err = ps.AnnouncePeers(context.Background(), ih, false, 10, peer(3))
+	require.Equal(t, storage.ErrResourceDoesNotExist, err)
+
+	_, resp, err := lgc.HandleScrape(context.Background(), &bittorrent.ScrapeRequest{AddressFamily: bittorrent.IPv4, InfoHashes: []bittorrent.InfoHash{ih}})
+	require.Nil(t, err)
+	require.Equal(t, uint32(2), resp.Files[0].Incomplete)
+}
+
+func TestLeecherSeedRatio(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { ps.Stop().Wait() }()
+
+	peer := func(port uint16) bittorrent.Peer {
+		return bittorrent.Peer{
+			IP:   bittorrent.IP{IP: net.ParseIP("10.0.0.1").To4(), AddressFamily: bittorrent.IPv4},
+			Port: port,
+		}
+	}
+	count := func(peers []bittorrent.Peer) (seeders, leechers int) {
+		for _, p := range peers {
+			if p.Port < 100 {
+				seeders++
+			} else {
+				leechers++
+			}
+		}
+		return
+	}
+
+	var ih bittorrent.InfoHash
+	for port := uint16(1); port <= 10; port++ {
+		require.Nil(t, ps.PutSeeder(context.Background(), ih, peer(port)))
+		require.Nil(t, ps.PutLeecher(context.Background(), ih, peer(100+port)))
+	}
+
+	h := &responseHook{store: ps, shuffler: noShuffler{}, leecherSeedRatio: 0.3}
+	announce := func(left uint64, p bittorrent.Peer) []bittorrent.Peer {
+		req := &bittorrent.AnnounceRequest{InfoHash: ih, NumWant: 10, Left: left, Peer: p}
+		resp := &bittorrent.AnnounceResponse{}
+		_, err := h.HandleAnnounce(context.Background(), req, resp)
+		require.Nil(t, err)
+		return resp.IPv4Peers
+	}
+
+	// Leechers receive seeders and leechers in the configured ratio.
+	seeders, leechers := count(announce(1, peer(101)))
+	require.Equal(t, 3, seeders)
+	require.Equal(t, 7, leechers)
+
+	// Seeders only receive leechers.
+	seeders, leechers = count(announce(0, peer(1)))
+	require.Equal(t, 0, seeders)
+	require.Equal(t, 10, leechers)
+
+	// Missing leechers are made up for with seeders.
+	for port := uint16(103); port <= 110; port++ {
+		require.Nil(t, ps.DeleteLeecher(context.Background(), ih, peer(port)))
+	}
+	seeders, leechers = count(announce(1, peer(101)))
+	require.Equal(t, 9, seeders)
+	require.Equal(t, 1, leechers)
+}
+
+func TestExcludedPeers(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { ps.Stop().Wait() }()
+
+	peer := func(port uint16) bittorrent.Peer {
+		return bittorrent.Peer{
+			ID:   bittorrent.PeerID{byte(port)},
+			IP:   bittorrent.IP{IP: net.ParseIP("10.0.0.1").To4(), AddressFamily: bittorrent.IPv4},
+			Port: port,
+		}
+	}
+
+	var ih bittorrent.InfoHash
+	for port := uint16(1); port <= 5; port++ {
+		require.Nil(t, ps.PutLeecher(context.Background(), ih, peer(port)))
+	}
+
+	h := &responseHook{store: ps, shuffler: noShuffler{}}
+	announce := func(numWant uint32, excluded ...bittorrent.Peer) []bittorrent.Peer {
+		req := &bittorrent.AnnounceRequest{InfoHash: ih, NumWant: numWant, Left: 1, Peer: peer(100), ExcludedPeers: excluded}
+		resp := &bittorrent.AnnounceResponse{}
+		_, err := h.HandleAnnounce(context.Background(), req, resp)
+		require.Nil(t, err)
+		return resp.IPv4Peers
+	}
+
+	// Excluded peers are matched by their endpoints, since their IDs are
+	// not known.
+	known := []bittorrent.Peer{peer(1), peer(2), peer(3)}
+	for i := range known {
+		known[i].ID = bittorrent.PeerID{}
+	}
+	peers := announce(2, known...)
+	require.Len(t, peers, 2)
+	for _, p := range peers {
+		require.True(t, p.Port > 3)
+	}
+
+	// Clients that know all peers receive none.
+	require.Empty(t, announce(5, append(known, peer(4), peer(5))...))
+
+	// Peers of the other address family are not excluded.
+	other := bittorrent.Peer{IP: bittorrent.IP{IP: net.ParseIP("::1"), AddressFamily: bittorrent.IPv6}, Port: 1}
+	require.Len(t, announce(5, other), 5)
+}
+
+// TestSelectionFairness tests that the peer selection of the response hook
+// keeps its bounds without favouring any peers over many announces.
+func TestSelectionFairness(t *testing.T) {
+	const trials = 2000
+	peer := func(ip byte, port uint16) bittorrent.Peer {
+		return bittorrent.Peer{
+			IP:   bittorrent.IP{IP: net.IPv4(10, 0, 0, ip).To4(), AddressFamily: bittorrent.IPv4},
+			Port: port,
+		}
+	}
+	announcer := peer(255, 1)
+
+	t.Run("leecher seed ratio", func(t *testing.T) {
+		ps, err := memory.New(memory.Config{})
+		require.Nil(t, err)
+
+		// Ports 0-29 are seeders, ports 30-59 are leechers.
+		var ih bittorrent.InfoHash
+		for port := uint16(0); port < 30; port++ {
+			require.Nil(t, ps.PutSeeder(context.Background(), ih, peer(1, port)))
+			require.Nil(t, ps.PutLeecher(context.Background(), ih, peer(1, 30+port)))
+		}
+
+		h := &responseHook{store: ps, shuffler: noShuffler{}, leecherSeedRatio: 0.3}
+		counts := make([]int, 60)
+		for i := 0; i < trials; i++ {
+			req := &bittorrent.AnnounceRequest{InfoHash: ih, NumWant: 10, Left: 1, Peer: announcer}
+			resp := &bittorrent.AnnounceResponse{}
+			_, err := h.HandleAnnounce(context.Background(), req, resp)
+			require.Nil(t, err)
+
+			var seeders int
+			for _, p := range resp.IPv4Peers {
+				counts[p.Port]++
+				if p.Port < 30 {
+					seeders++
+				}
+			}
+			require.Equal(t, 10, len(resp.IPv4Peers))
+			require.Equal(t, 3, seeders)
+		}
+		chisquare.RequireUniform(t, counts[:30], "seeders")
+		chisquare.RequireUniform(t, counts[30:], "leechers")
+
+		require.Nil(t, ps.Stop().Wait())
+	})
+
+	t.Run("max peers per IP", func(t *testing.T) {
+		ps, err := memory.New(memory.Config{})
+		require.Nil(t, err)
+
+		// 20 IPs with three seeders each.
+		var ih bittorrent.InfoHash
+		for port := uint16(0); port < 60; port++ {
+			require.Nil(t, ps.PutSeeder(context.Background(), ih, peer(byte(port/3), port)))
+		}
+
+		h := &responseHook{store: ps, shuffler: noShuffler{}, maxPeersPerIP: 1}
+		counts := make([]int, 60)
+		for i := 0; i < trials; i++ {
+			req := &bittorrent.AnnounceRequest{InfoHash: ih, NumWant: 10, Left: 1, Peer: announcer}
+			resp := &bittorrent.AnnounceResponse{}
+			_, err := h.HandleAnnounce(context.Background(), req, resp)
+			require.Nil(t, err)
+
+			ips := make(map[string]bool)
+			for _, p := range resp.IPv4Peers {
+				counts[p.Port]++
+				require.False(t, ips[p.IP.String()], "more than one peer of %s", p.IP)
+				ips[p.IP.String()] = true
+			}
+		}
+		chisquare.RequireUniform(t, counts)
+
+		require.Nil(t, ps.Stop().Wait())
+	})
+}
+
+func TestClientSubnetPreference(t *testing.T) {
+	ps, err := memory.New(memory.Config{})
+	require.Nil(t, err)
+	defer func() { ps.Stop().Wait() }()
+
+	peer := func(ip string, port uint16) bittorrent.Peer {
+		return bittorrent.Peer{
+			ID:   bittorrent.PeerID{byte(port)},
+			IP:   bittorrent.IP{IP: net.ParseIP(ip).To4(), AddressFamily: bittorrent.IPv4},
+			Port: port,
+		}
+	}
+
+	var ih bittorrent.InfoHash
+	for port := uint16(1); port <= 8; port++ {
+		require.Nil(t, ps.PutLeecher(context.Background(), ih, peer("198.51.100.1", port)))
+	}
+	for port := uint16(9); port <= 10; port++ {
+		require.Nil(t, ps.PutLeecher(context.Background(), ih, peer("203.0.113.1", port)))
+	}
+
+	_, subnet, _ := net.ParseCIDR("203.0.113.0/24")
+	ctx := context.WithValue(context.Background(), bittorrent.ClientSubnetKey, subnet)
+
+	h := &responseHook{store: ps, shuffler: noShuffler{}}
+	req := &bittorrent.AnnounceRequest{InfoHash: ih, NumWant: 5, Left: 1, Peer: peer("203.0.113.2", 100)}
+	resp := &bittorrent.AnnounceResponse{}
+	_, err = h.HandleAnnounce(ctx, req, resp)
+	require.Nil(t, err)
+	require.Len(t, resp.IPv4Peers, 5)
+
+	// Both peers in the subnet of the client are among the ones returned.
+	var nearby int
+	for _, p := range resp.IPv4Peers {
+		if subnet.Contains(p.IP.IP) {
+			nearby++
+		}
+	}
+	require.Equal(t, 2, nearby)
+}
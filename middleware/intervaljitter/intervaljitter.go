@@ -0,0 +1,124 @@
+// Package intervaljitter implements a Hook that randomizes the announce
+// interval within a window around the configured interval, so that clients
+// don't synchronize their announces, for example after a restart of the
+// tracker.
+package intervaljitter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/middleware/pkg/random"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// Name is the name by which this middleware is registered with Chihaya.
+const Name = "interval jitter"
+
+func init() {
+	middleware.RegisterDriver(Name, driver{})
+}
+
+var _ middleware.Driver = driver{}
+
+type driver struct{}
+
+func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
+	var cfg Config
+	err := yaml.UnmarshalStrict(optionBytes, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid options for middleware %s: %s", Name, err)
+	}
+
+	return NewHook(cfg)
+}
+
+// ErrInvalidJitter is returned for a config with an invalid Jitter.
+var ErrInvalidJitter = errors.New("invalid jitter")
+
+// Config represents the configuration for the intervaljitter middleware.
+type Config struct {
+	// Jitter is the fraction of the interval by which it is changed at most,
+	// in either direction. For example, 0.1 changes the interval by up to
+	// ±10%.
+	Jitter float64 `yaml:"jitter"`
+
+	// ModifyMinInterval specifies whether min_interval should be changed by
+	// the same fraction as well.
+	ModifyMinInterval bool `yaml:"modify_min_interval"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"jitter":            cfg.Jitter,
+		"modifyMinInterval": cfg.ModifyMinInterval,
+	}
+}
+
+func checkConfig(cfg Config) error {
+	if cfg.Jitter <= 0 || cfg.Jitter >= 1 {
+		return ErrInvalidJitter
+	}
+
+	return nil
+}
+
+type hook struct {
+	cfg Config
+}
+
+// NewHook creates a middleware to randomize the announce interval within
+// the window of the given config.
+func NewHook(cfg Config) (middleware.Hook, error) {
+	err := checkConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &hook{cfg: cfg}, nil
+}
+
+// HandleAnnounce changes the intervals of resp by a random fraction of
+// themselves.
+//
+// The fraction is derived from the request, so that the same peer of a swarm
+// keeps announcing at its own offset. Every response starts with the
+// configured intervals, so that changes never accumulate.
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	v, _, _ := random.GenerateAndAdvance(random.DeriveEntropyFromRequest(req))
+
+	// The fraction is in [-Jitter, Jitter). It is taken from the high bits,
+	// which depend on both the infohash and the PeerID.
+	fraction := (float64(v>>40)/(1<<23) - 1) * h.cfg.Jitter
+
+	resp.Interval = jitter(resp.Interval, fraction)
+	if h.cfg.ModifyMinInterval {
+		resp.MinInterval = jitter(resp.MinInterval, fraction)
+	}
+
+	// Clients must not be told to announce before they may.
+	if resp.Interval < resp.MinInterval {
+		resp.Interval = resp.MinInterval
+	}
+
+	bittorrent.RecordDecision(ctx, "interval", fmt.Sprintf("%s (%+.1f%%)", Name, fraction*100))
+	return ctx, nil
+}
+
+// jitter changes d by fraction of itself, rounded to whole seconds as
+// intervals are sent to clients.
+func jitter(d time.Duration, fraction float64) time.Duration {
+	return (d + time.Duration(float64(d)*fraction)).Round(time.Second)
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes are not altered.
+	return ctx, nil
+}
@@ -0,0 +1,88 @@
+package intervaljitter
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/storage/memory"
+)
+
+var configTests = []struct {
+	cfg      Config
+	expected error
+}{
+	{Config{Jitter: 0.1}, nil},
+	{Config{Jitter: 0}, ErrInvalidJitter},
+	{Config{Jitter: 1}, ErrInvalidJitter},
+	{Config{Jitter: -0.1}, ErrInvalidJitter},
+}
+
+func TestCheckConfig(t *testing.T) {
+	for _, tt := range configTests {
+		t.Run(fmt.Sprintf("%#v", tt.cfg), func(t *testing.T) {
+			require.Equal(t, tt.expected, checkConfig(tt.cfg))
+		})
+	}
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	h, err := NewHook(Config{Jitter: 0.1, ModifyMinInterval: true})
+	require.Nil(t, err)
+
+	ps, err := memory.New(memory.Config{ShardCount: 1})
+	require.Nil(t, err)
+	defer ps.Stop()
+
+	logic := middleware.NewLogic(middleware.ResponseConfig{
+		AnnounceInterval:    30 * time.Minute,
+		MinAnnounceInterval: 15 * time.Minute,
+	}, ps, []middleware.Hook{h}, nil)
+
+	announce := func(id byte) *bittorrent.AnnounceResponse {
+		req := &bittorrent.AnnounceRequest{
+			InfoHash: bittorrent.InfoHashFromString("00000000000000000001"),
+			Peer: bittorrent.Peer{
+				ID: bittorrent.PeerID{id},
+				IP: bittorrent.IP{IP: net.IPv4(10, 0, 0, id).To4(), AddressFamily: bittorrent.IPv4},
+			},
+		}
+		_, resp, err := logic.HandleAnnounce(context.Background(), req)
+		require.Nil(t, err)
+		return resp
+	}
+
+	intervals := make(map[time.Duration]bool)
+	for id := byte(0); id < 100; id++ {
+		resp := announce(id)
+		require.True(t, resp.Interval >= 27*time.Minute && resp.Interval <= 33*time.Minute, resp.Interval)
+		require.True(t, resp.MinInterval >= 810*time.Second && resp.MinInterval <= 990*time.Second, resp.MinInterval)
+		require.Equal(t, time.Duration(0), resp.Interval%time.Second)
+		intervals[resp.Interval] = true
+
+		// Every response starts with the configured intervals, so repeated
+		// announces of a peer don't accumulate changes.
+		require.Equal(t, resp.Interval, announce(id).Interval)
+	}
+	require.True(t, len(intervals) > 50, "intervals should be spread")
+}
+
+func TestMinInterval(t *testing.T) {
+	h, err := NewHook(Config{Jitter: 0.5})
+	require.Nil(t, err)
+
+	for id := byte(0); id < 100; id++ {
+		req := &bittorrent.AnnounceRequest{Peer: bittorrent.Peer{ID: bittorrent.PeerID{id}}}
+		resp := &bittorrent.AnnounceResponse{Interval: 20 * time.Minute, MinInterval: 15 * time.Minute}
+		_, err := h.HandleAnnounce(context.Background(), req, resp)
+		require.Nil(t, err)
+		require.True(t, resp.Interval >= resp.MinInterval)
+		require.Equal(t, 15*time.Minute, resp.MinInterval)
+	}
+}
@@ -0,0 +1,246 @@
+// Package ipblocklist implements a Hook that fails an Announce if the
+// client's IP address is in a blocked range.
+//
+// Ranges are configured as CIDRs or read from blocklists in the CIDR, P2P or
+// DAT formats, which are files or HTTP endpoints reloaded on an interval.
+package ipblocklist
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/middleware/pkg/listsource"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+// Name is the name by which this middleware is registered with Chihaya.
+const Name = "ip blocklist"
+
+func init() {
+	middleware.RegisterDriver(Name, driver{})
+}
+
+var _ middleware.Driver = driver{}
+
+type driver struct{}
+
+func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
+	var cfg Config
+	err := yaml.UnmarshalStrict(optionBytes, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid options for middleware %s: %s", Name, err)
+	}
+
+	return NewHook(cfg)
+}
+
+// ErrBlocked is the error returned for announces from a blocked IP address.
+var ErrBlocked = bittorrent.ClientError("IP address is blocked")
+
+// cidrsListName is the name of the list of ranges configured as CIDRs.
+const cidrsListName = "cidrs"
+
+// ListConfig is the configuration of a blocklist.
+type ListConfig struct {
+	// Name identifies the list in logs and metrics.
+	Name string `yaml:"name"`
+
+	// Source is the path to a file or the URL of an HTTP endpoint.
+	Source string `yaml:"source"`
+
+	// Format is one of FormatCIDR, FormatP2P or FormatDAT.
+	Format string `yaml:"format"`
+}
+
+// Config represents all the values required by this middleware to block IP
+// addresses.
+type Config struct {
+	CIDRs          []string      `yaml:"cidrs"`
+	Lists          []ListConfig  `yaml:"lists"`
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+}
+
+// LogFields implements log.Fielder for a Config.
+func (cfg Config) LogFields() log.Fields {
+	var lists []string
+	for _, l := range cfg.Lists {
+		lists = append(lists, l.Name)
+	}
+
+	return log.Fields{
+		"cidrsLen":       len(cfg.CIDRs),
+		"lists":          lists,
+		"reloadInterval": cfg.ReloadInterval,
+	}
+}
+
+// Default config constants.
+const defaultReloadInterval = 24 * time.Hour
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if len(cfg.Lists) > 0 && cfg.ReloadInterval <= 0 {
+		validcfg.ReloadInterval = defaultReloadInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".ReloadInterval",
+			"provided": cfg.ReloadInterval,
+			"default":  validcfg.ReloadInterval,
+		})
+	}
+
+	return validcfg
+}
+
+// list is a named list of blocked ranges.
+type list struct {
+	name   string
+	ranges ranges
+}
+
+type hook struct {
+	cfg Config
+
+	// lists holds the current []list, starting with the configured CIDRs
+	// followed by the configured blocklists.
+	lists   atomic.Value
+	closing chan struct{}
+}
+
+// NewHook returns an instance of the IP blocklist middleware.
+func NewHook(provided Config) (middleware.Hook, error) {
+	cfg := provided.Validate()
+	h := &hook{
+		cfg:     cfg,
+		closing: make(chan struct{}),
+	}
+
+	var cidrs []ipRange
+	for _, s := range cfg.CIDRs {
+		r, err := parseCIDR(s)
+		if err != nil {
+			return nil, errors.New("cidrs: " + err.Error())
+		}
+		cidrs = append(cidrs, r)
+	}
+
+	lists := []list{{name: cidrsListName, ranges: newRanges(cidrs)}}
+	names := map[string]bool{cidrsListName: true}
+	for _, l := range cfg.Lists {
+		if l.Name == "" || names[l.Name] {
+			return nil, fmt.Errorf("blocklist name %q is empty or not unique", l.Name)
+		}
+		names[l.Name] = true
+
+		switch l.Format {
+		case FormatCIDR, FormatP2P, FormatDAT:
+		default:
+			return nil, fmt.Errorf("blocklist %s: %s %q", l.Name, ErrUnknownFormat, l.Format)
+		}
+
+		rs, err := loadList(l)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load blocklist %s: %s", l.Name, err)
+		}
+		lists = append(lists, list{name: l.Name, ranges: rs})
+	}
+	h.lists.Store(lists)
+
+	if len(cfg.Lists) == 0 {
+		return h, nil
+	}
+
+	go func() {
+		for {
+			select {
+			case <-h.closing:
+				return
+			case <-time.After(cfg.ReloadInterval):
+				h.reload()
+			}
+		}
+	}()
+
+	return h, nil
+}
+
+func loadList(cfg ListConfig) (ranges, error) {
+	rc, err := listsource.Open(cfg.Source)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return parseBlocklist(rc, cfg.Format)
+}
+
+// reload replaces the ranges of every blocklist that can be loaded.
+// Blocklists that fail to load keep their previous ranges.
+func (h *hook) reload() {
+	current := h.lists.Load().([]list)
+	lists := make([]list, len(current))
+	copy(lists, current)
+
+	for i, l := range h.cfg.Lists {
+		rs, err := loadList(l)
+		if err != nil {
+			log.Error("failed to reload blocklist", log.Fields{
+				"name":   l.Name,
+				"source": l.Source,
+				"error":  err,
+			})
+			continue
+		}
+
+		lists[i+1].ranges = rs
+		log.Debug("reloaded blocklist", log.Fields{
+			"name":   l.Name,
+			"ranges": len(rs),
+		})
+	}
+
+	h.lists.Store(lists)
+}
+
+func (h *hook) Stop() stop.Result {
+	select {
+	case <-h.closing:
+		return stop.AlreadyStopped
+	default:
+	}
+	c := make(stop.Channel)
+	go func() {
+		close(h.closing)
+		c.Done()
+	}()
+	return c.Result()
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	for _, l := range h.lists.Load().([]list) {
+		if l.ranges.contains(req.IP.IP) {
+			recordBlocked(l.name)
+			bittorrent.RecordDecision(ctx, Name, "blocked by "+l.name)
+			return ctx, ErrBlocked
+		}
+	}
+
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't carry the IP address of a peer.
+	return ctx, nil
+}
@@ -0,0 +1,126 @@
+package ipblocklist
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+func TestParseBlocklist(t *testing.T) {
+	var table = []struct {
+		format   string
+		list     string
+		blocked  []string
+		allowed  []string
+		expected int
+	}{
+		{
+			FormatCIDR,
+			"# comment\n10.0.0.0/8\n10.1.0.0/16\n192.168.1.1\n2001:db8::/32\n",
+			[]string{"10.0.0.0", "10.255.255.255", "192.168.1.1", "2001:db8::1"},
+			[]string{"11.0.0.0", "192.168.1.2", "2001:db9::1", "::a00:1"},
+			3,
+		},
+		{
+			FormatP2P,
+			"Some organization:1.2.3.0-1.2.3.255\nOther: with colon:1.2.4.0-1.2.4.10\n",
+			[]string{"1.2.3.0", "1.2.3.255", "1.2.4.5"},
+			[]string{"1.2.4.11", "1.2.2.255"},
+			1,
+		},
+		{
+			FormatDAT,
+			"001.009.096.105 - 001.009.096.110 , 000 , Some organization\n002.000.000.000 - 002.255.255.255 , 200 , Allowed\n",
+			[]string{"1.9.96.105", "1.9.96.110"},
+			[]string{"1.9.96.111", "2.0.0.1"},
+			1,
+		},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.format, func(t *testing.T) {
+			rs, err := parseBlocklist(strings.NewReader(tt.list), tt.format)
+			require.Nil(t, err)
+			require.Len(t, rs, tt.expected)
+
+			for _, ip := range tt.blocked {
+				require.True(t, rs.contains(net.ParseIP(ip)), ip)
+			}
+			for _, ip := range tt.allowed {
+				require.False(t, rs.contains(net.ParseIP(ip)), ip)
+			}
+		})
+	}
+
+	_, err := parseBlocklist(strings.NewReader("1.2.3.4-1.2.3.0\n"), FormatP2P)
+	require.NotNil(t, err)
+}
+
+func TestGzipBlocklist(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte("test:1.2.3.0-1.2.3.255\n"))
+	zw.Close()
+
+	rs, err := parseBlocklist(&buf, FormatP2P)
+	require.Nil(t, err)
+	require.True(t, rs.contains(net.ParseIP("1.2.3.4")))
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipblocklist")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "level1.p2p")
+	require.Nil(t, ioutil.WriteFile(path, []byte("test:1.2.3.0-1.2.3.255\n"), 0644))
+
+	h, err := NewHook(Config{
+		CIDRs: []string{"10.0.0.0/8"},
+		Lists: []ListConfig{{Name: "level1", Source: path, Format: FormatP2P}},
+	})
+	require.Nil(t, err)
+	defer h.(*hook).Stop()
+
+	announce := func(ip string) error {
+		req := &bittorrent.AnnounceRequest{Peer: bittorrent.Peer{IP: bittorrent.IP{IP: net.ParseIP(ip)}}}
+		_, err := h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+		return err
+	}
+
+	require.Equal(t, ErrBlocked, announce("10.1.2.3"))
+	require.Equal(t, ErrBlocked, announce("1.2.3.4"))
+	require.Nil(t, announce("1.2.4.4"))
+
+	// Reloading replaces the ranges of the list, unless it fails to load.
+	require.Nil(t, ioutil.WriteFile(path, []byte("test:1.2.4.0-1.2.4.255\n"), 0644))
+	h.(*hook).reload()
+	require.Nil(t, announce("1.2.3.4"))
+	require.Equal(t, ErrBlocked, announce("1.2.4.4"))
+
+	require.Nil(t, os.Remove(path))
+	h.(*hook).reload()
+	require.Equal(t, ErrBlocked, announce("1.2.4.4"))
+	require.Equal(t, ErrBlocked, announce("10.1.2.3"))
+}
+
+func TestNewHook(t *testing.T) {
+	_, err := NewHook(Config{CIDRs: []string{"10.0.0.0/33"}})
+	require.NotNil(t, err)
+
+	_, err = NewHook(Config{Lists: []ListConfig{{Name: "test", Source: "/nonexistent", Format: "csv"}}})
+	require.NotNil(t, err)
+
+	_, err = NewHook(Config{Lists: []ListConfig{{Name: "test", Source: "/nonexistent", Format: FormatP2P}}})
+	require.NotNil(t, err)
+}
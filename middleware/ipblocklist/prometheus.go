@@ -0,0 +1,20 @@
+package ipblocklist
+
+import "github.com/prometheus/client_golang/prometheus"
+
+func init() {
+	prometheus.MustRegister(promBlockedTotal)
+}
+
+var promBlockedTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "chihaya_ip_blocklist_blocked_announces_total",
+		Help: "The number of announces rejected because the IP address of the client is blocked, by blocklist",
+	},
+	[]string{"list"},
+)
+
+// recordBlocked records an announce blocked by the given list.
+func recordBlocked(list string) {
+	promBlockedTotal.WithLabelValues(list).Inc()
+}
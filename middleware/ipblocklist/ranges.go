@@ -0,0 +1,232 @@
+package ipblocklist
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The formats of blocklists.
+const (
+	// FormatCIDR lists one IP address or CIDR range per line.
+	FormatCIDR = "cidr"
+
+	// FormatP2P lists one range per line as "description:first-last".
+	FormatP2P = "p2p"
+
+	// FormatDAT lists one range per line as "first - last , level , description",
+	// as used by eMule's ipfilter.dat. Ranges with a level of 128 or higher
+	// are not blocked.
+	FormatDAT = "dat"
+)
+
+// ErrUnknownFormat is returned for a blocklist with an unknown format.
+var ErrUnknownFormat = errors.New("unknown blocklist format")
+
+// ipRange is an inclusive range of IP addresses, both in their 16-byte form.
+type ipRange struct {
+	first, last net.IP
+}
+
+// ranges is a sorted list of disjoint ipRanges.
+type ranges []ipRange
+
+// newRanges sorts and merges rs.
+func newRanges(rs []ipRange) ranges {
+	sort.Slice(rs, func(i, j int) bool {
+		return bytes.Compare(rs[i].first, rs[j].first) < 0
+	})
+
+	var merged ranges
+	for _, r := range rs {
+		if n := len(merged); n > 0 && bytes.Compare(r.first, next(merged[n-1].last)) <= 0 {
+			if bytes.Compare(r.last, merged[n-1].last) > 0 {
+				merged[n-1].last = r.last
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+
+	return merged
+}
+
+// next returns the IP address following ip, or ip if it is the last one.
+func next(ip net.IP) net.IP {
+	n := make(net.IP, len(ip))
+	copy(n, ip)
+	for i := len(n) - 1; i >= 0; i-- {
+		n[i]++
+		if n[i] != 0 {
+			return n
+		}
+	}
+	return ip
+}
+
+// contains returns whether ip is in any of the ranges.
+func (rs ranges) contains(ip net.IP) bool {
+	ip = ip.To16()
+	if ip == nil {
+		return false
+	}
+
+	i := sort.Search(len(rs), func(i int) bool {
+		return bytes.Compare(rs[i].last, ip) >= 0
+	})
+	return i < len(rs) && bytes.Compare(rs[i].first, ip) <= 0
+}
+
+// parseCIDR parses an IP address or CIDR range into an ipRange.
+func parseCIDR(s string) (ipRange, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return ipRange{}, fmt.Errorf("invalid IP address %q", s)
+		}
+		return ipRange{ip.To16(), ip.To16()}, nil
+	}
+
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		return ipRange{}, err
+	}
+
+	first := ipNet.IP.To16()
+	last := make(net.IP, len(first))
+	mask := ipNet.Mask
+	if len(mask) == net.IPv4len {
+		mask = append(net.CIDRMask(96, 128)[:12:12], mask...)
+	}
+	for i := range first {
+		last[i] = first[i] | ^mask[i]
+	}
+
+	return ipRange{first, last}, nil
+}
+
+// parseIP parses an IP address, allowing leading zeros in the octets of
+// IPv4 addresses as they are common in blocklists.
+func parseIP(s string) (net.IP, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, ":") {
+		if ip := net.ParseIP(s); ip != nil {
+			return ip, nil
+		}
+		return nil, fmt.Errorf("invalid IP address %q", s)
+	}
+
+	octets := strings.Split(s, ".")
+	if len(octets) != 4 {
+		return nil, fmt.Errorf("invalid IP address %q", s)
+	}
+	ip := make(net.IP, net.IPv4len)
+	for i, octet := range octets {
+		n, err := strconv.ParseUint(octet, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP address %q", s)
+		}
+		ip[i] = byte(n)
+	}
+
+	return ip.To16(), nil
+}
+
+// parseRange parses a range of IP addresses given as "first-last".
+func parseRange(s string) (ipRange, error) {
+	i := strings.Index(s, "-")
+	if i < 0 {
+		return ipRange{}, fmt.Errorf("invalid range %q", s)
+	}
+
+	first, err := parseIP(s[:i])
+	if err != nil {
+		return ipRange{}, err
+	}
+	last, err := parseIP(s[i+1:])
+	if err != nil {
+		return ipRange{}, err
+	}
+	if bytes.Compare(first, last) > 0 {
+		return ipRange{}, fmt.Errorf("invalid range %q", s)
+	}
+
+	return ipRange{first, last}, nil
+}
+
+// parseLine parses a line of a blocklist of the given format.
+// It returns false if the line doesn't block any addresses.
+func parseLine(line, format string) (ipRange, bool, error) {
+	switch format {
+	case FormatCIDR:
+		r, err := parseCIDR(line)
+		return r, true, err
+	case FormatP2P:
+		i := strings.LastIndex(line, ":")
+		if i < 0 {
+			return ipRange{}, false, fmt.Errorf("invalid line %q", line)
+		}
+		r, err := parseRange(line[i+1:])
+		return r, true, err
+	case FormatDAT:
+		fields := strings.Split(line, ",")
+		if len(fields) > 1 {
+			level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+			if err != nil {
+				return ipRange{}, false, fmt.Errorf("invalid level in line %q", line)
+			}
+			if level >= 128 {
+				return ipRange{}, false, nil
+			}
+		}
+		r, err := parseRange(fields[0])
+		return r, true, err
+	default:
+		return ipRange{}, false, ErrUnknownFormat
+	}
+}
+
+// parseBlocklist parses a blocklist of the given format, which may be
+// compressed with gzip. Empty lines and lines starting with "#" are ignored.
+func parseBlocklist(r io.Reader, format string) (ranges, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	} else {
+		r = br
+	}
+
+	var rs []ipRange
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		ipr, blocked, err := parseLine(text, format)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		if blocked {
+			rs = append(rs, ipr)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return newRanges(rs), nil
+}
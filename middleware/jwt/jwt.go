@@ -3,6 +3,7 @@
 //
 // JWTs are validated against the standard claims in RFC7519 along with an
 // extra "infohash" claim that verifies the client has access to the Swarm.
+// Expired JWTs and JWTs that are not yet valid are rejected.
 // RS256 keys are asychronously rotated from a provided JWK Set HTTP endpoint.
 package jwt
 
@@ -15,11 +16,9 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	jc "github.com/SermoDigital/jose/crypto"
-	"github.com/SermoDigital/jose/jws"
-	"github.com/SermoDigital/jose/jwt"
 	"github.com/mendsley/gojwk"
 	yaml "gopkg.in/yaml.v2"
 
@@ -42,7 +41,7 @@ type driver struct{}
 
 func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
 	var cfg Config
-	err := yaml.Unmarshal(optionBytes, &cfg)
+	err := yaml.UnmarshalStrict(optionBytes, &cfg)
 	if err != nil {
 		return nil, fmt.Errorf("invalid options for middleware %s: %s", Name, err)
 	}
@@ -65,6 +64,8 @@ type Config struct {
 	Audience          string        `yaml:"audience"`
 	JWKSetURL         string        `yaml:"jwk_set_url"`
 	JWKUpdateInterval time.Duration `yaml:"jwk_set_update_interval"`
+	RequireExpiration bool          `yaml:"require_expiration"`
+	Leeway            time.Duration `yaml:"leeway"`
 }
 
 // LogFields implements log.Fielder for a Config.
@@ -74,23 +75,60 @@ func (cfg Config) LogFields() log.Fields {
 		"audience":          cfg.Audience,
 		"JWKSetURL":         cfg.JWKSetURL,
 		"JWKUpdateInterval": cfg.JWKUpdateInterval,
+		"requireExpiration": cfg.RequireExpiration,
+		"leeway":            cfg.Leeway,
 	}
 }
 
+// Default config constants.
+const defaultJWKUpdateInterval = 5 * time.Minute
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.JWKUpdateInterval <= 0 {
+		validcfg.JWKUpdateInterval = defaultJWKUpdateInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".JWKUpdateInterval",
+			"provided": cfg.JWKUpdateInterval,
+			"default":  validcfg.JWKUpdateInterval,
+		})
+	}
+
+	if cfg.Leeway < 0 {
+		validcfg.Leeway = 0
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".Leeway",
+			"provided": cfg.Leeway,
+			"default":  validcfg.Leeway,
+		})
+	}
+
+	return validcfg
+}
+
 type hook struct {
-	cfg        Config
-	publicKeys map[string]crypto.PublicKey
+	cfg Config
+
+	// publicKeys holds the map[string]crypto.PublicKey of the current JWK
+	// Set by key ID. It is replaced whenever the JWK Set is fetched.
+	publicKeys atomic.Value
 	closing    chan struct{}
 }
 
 // NewHook returns an instance of the JWT middleware.
-func NewHook(cfg Config) (middleware.Hook, error) {
+func NewHook(provided Config) (middleware.Hook, error) {
+	cfg := provided.Validate()
 	log.Debug("creating new JWT middleware", cfg)
 	h := &hook{
-		cfg:        cfg,
-		publicKeys: map[string]crypto.PublicKey{},
-		closing:    make(chan struct{}),
+		cfg:     cfg,
+		closing: make(chan struct{}),
 	}
+	h.publicKeys.Store(map[string]crypto.PublicKey{})
 
 	log.Debug("performing initial fetch of JWKs")
 	err := h.updateKeys()
@@ -113,12 +151,22 @@ func NewHook(cfg Config) (middleware.Hook, error) {
 	return h, nil
 }
 
+// jwkClient is used to fetch JWK Sets, so that an unresponsive endpoint can't
+// stall updates forever.
+var jwkClient = &http.Client{Timeout: 30 * time.Second}
+
 func (h *hook) updateKeys() error {
-	resp, err := http.Get(h.cfg.JWKSetURL)
+	resp, err := jwkClient.Get(h.cfg.JWKSetURL)
 	if err != nil {
 		log.Error("failed to fetch JWK Set", log.Err(err))
 		return err
 	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		err = fmt.Errorf("unexpected status %q", resp.Status)
+		log.Error("failed to fetch JWK Set", log.Err(err))
+		return err
+	}
 
 	var parsedJWKs gojwk.Key
 	err = json.NewDecoder(resp.Body).Decode(&parsedJWKs)
@@ -138,7 +186,7 @@ func (h *hook) updateKeys() error {
 		}
 		keys[parsedJWK.Kid] = publicKey
 	}
-	h.publicKeys = keys
+	h.publicKeys.Store(keys)
 
 	log.Debug("successfully fetched JWK Set")
 	return nil
@@ -169,10 +217,13 @@ func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceReque
 		return ctx, ErrMissingJWT
 	}
 
-	if err := validateJWT(req.InfoHash, []byte(jwtParam), h.cfg.Issuer, h.cfg.Audience, h.publicKeys); err != nil {
+	publicKeys := h.publicKeys.Load().(map[string]crypto.PublicKey)
+	if err := validateJWT(req.InfoHash, []byte(jwtParam), h.cfg, publicKeys, time.Now()); err != nil {
+		bittorrent.RecordDecision(ctx, Name, "invalid")
 		return ctx, ErrInvalidJWT
 	}
 
+	bittorrent.RecordDecision(ctx, Name, "valid")
 	return ctx, nil
 }
 
@@ -181,59 +232,64 @@ func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest,
 	return ctx, nil
 }
 
-func validateJWT(ih bittorrent.InfoHash, jwtBytes []byte, cfgIss, cfgAud string, publicKeys map[string]crypto.PublicKey) error {
-	parsedJWT, err := jws.ParseJWT(jwtBytes)
+func validateJWT(ih bittorrent.InfoHash, jwtBytes []byte, cfg Config, publicKeys map[string]crypto.PublicKey, now time.Time) error {
+	cfgIss, cfgAud := cfg.Issuer, cfg.Audience
+	parsedJWT, err := parseToken(jwtBytes)
 	if err != nil {
 		return err
 	}
 
-	claims := parsedJWT.Claims()
-	if iss, ok := claims.Issuer(); !ok || iss != cfgIss {
+	if _, ok := parsedJWT.time("exp"); !ok && cfg.RequireExpiration {
+		log.Debug("missing expiration when validating JWT")
+		return errMissingExpiry
+	}
+	if err := parsedJWT.validateTimes(now, cfg.Leeway); err != nil {
+		log.Debug("expired or not yet valid JWT", log.Err(err))
+		return err
+	}
+
+	if iss, ok := parsedJWT.string("iss"); !ok || iss != cfgIss {
 		log.Debug("unequal or missing issuer when validating JWT", log.Fields{
 			"exists": ok,
 			"claim":  iss,
 			"config": cfgIss,
 		})
-		return jwt.ErrInvalidISSClaim
+		return errInvalidIssuer
 	}
 
-	if auds, ok := claims.Audience(); !ok || !in(cfgAud, auds) {
+	if auds, ok := parsedJWT.audience(); !ok || !in(cfgAud, auds) {
 		log.Debug("unequal or missing audience when validating JWT", log.Fields{
 			"exists": ok,
 			"claim":  strings.Join(auds, ","),
 			"config": cfgAud,
 		})
-		return jwt.ErrInvalidAUDClaim
+		return errInvalidAudience
 	}
 
 	ihHex := hex.EncodeToString(ih[:])
-	if ihClaim, ok := claims.Get("infohash").(string); !ok || ihClaim != ihHex {
+	if ihClaim, ok := parsedJWT.string("infohash"); !ok || ihClaim != ihHex {
 		log.Debug("unequal or missing infohash when validating JWT", log.Fields{
 			"exists":  ok,
 			"claim":   ihClaim,
 			"request": ihHex,
 		})
-		return errors.New("claim \"infohash\" is invalid")
+		return errInvalidInfoHash
 	}
 
-	parsedJWS := parsedJWT.(jws.JWS)
-	kid, ok := parsedJWS.Protected().Get("kid").(string)
-	if !ok {
-		log.Debug("missing kid when validating JWT", log.Fields{
-			"exists": ok,
-			"claim":  kid,
-		})
-		return errors.New("invalid kid")
+	kid := parsedJWT.header.Kid
+	if kid == "" {
+		log.Debug("missing kid when validating JWT")
+		return errInvalidKeyID
 	}
 	publicKey, ok := publicKeys[kid]
 	if !ok {
 		log.Debug("missing public key forkid when validating JWT", log.Fields{
 			"kid": kid,
 		})
-		return errors.New("signed by unknown kid")
+		return errUnknownKeyID
 	}
 
-	err = parsedJWS.Verify(publicKey, jc.SigningMethodRS256)
+	err = parsedJWT.verify(publicKey)
 	if err != nil {
 		log.Debug("failed to verify signature of JWT", log.Err(err))
 		return err
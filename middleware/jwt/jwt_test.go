@@ -0,0 +1,122 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+var (
+	testNow      = time.Unix(1600000000, 0)
+	testInfoHash = bittorrent.InfoHashFromString("00000000000000000001")
+	testConfig   = Config{
+		Issuer:            "https://issuer.example.com",
+		Audience:          "https://tracker.example.com",
+		RequireExpiration: true,
+		Leeway:            time.Minute,
+	}
+)
+
+func signToken(t *testing.T, key *rsa.PrivateKey, header, claims map[string]interface{}) []byte {
+	encode := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		require.Nil(t, err)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	signed := encode(header) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	require.Nil(t, err)
+
+	return []byte(signed + "." + base64.RawURLEncoding.EncodeToString(sig))
+}
+
+func TestValidateJWT(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	publicKeys := map[string]crypto.PublicKey{"key": &key.PublicKey}
+
+	validClaims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":      testConfig.Issuer,
+			"aud":      testConfig.Audience,
+			"infohash": hex.EncodeToString(testInfoHash[:]),
+			"exp":      testNow.Add(time.Hour).Unix(),
+			"nbf":      testNow.Add(-time.Hour).Unix(),
+		}
+	}
+	header := map[string]interface{}{"alg": "RS256", "kid": "key"}
+
+	var table = []struct {
+		name     string
+		key      *rsa.PrivateKey
+		header   map[string]interface{}
+		modify   func(claims map[string]interface{})
+		expected error
+	}{
+		{"valid", key, header, func(map[string]interface{}) {}, nil},
+		{"valid audience list", key, header, func(c map[string]interface{}) {
+			c["aud"] = []string{"https://other.example.com", testConfig.Audience}
+		}, nil},
+		{"expired within leeway", key, header, func(c map[string]interface{}) {
+			c["exp"] = testNow.Add(-30 * time.Second).Unix()
+		}, nil},
+		{"expired", key, header, func(c map[string]interface{}) {
+			c["exp"] = testNow.Add(-2 * time.Minute).Unix()
+		}, errExpired},
+		{"not yet valid", key, header, func(c map[string]interface{}) {
+			c["nbf"] = testNow.Add(2 * time.Minute).Unix()
+		}, errNotYetValid},
+		{"missing expiration", key, header, func(c map[string]interface{}) {
+			delete(c, "exp")
+		}, errMissingExpiry},
+		{"wrong issuer", key, header, func(c map[string]interface{}) {
+			c["iss"] = "https://other.example.com"
+		}, errInvalidIssuer},
+		{"wrong audience", key, header, func(c map[string]interface{}) {
+			c["aud"] = "https://other.example.com"
+		}, errInvalidAudience},
+		{"wrong infohash", key, header, func(c map[string]interface{}) {
+			c["infohash"] = hex.EncodeToString([]byte("00000000000000000002"))
+		}, errInvalidInfoHash},
+		{"missing kid", key, map[string]interface{}{"alg": "RS256"}, func(map[string]interface{}) {}, errInvalidKeyID},
+		{"unknown kid", key, map[string]interface{}{"alg": "RS256", "kid": "other"}, func(map[string]interface{}) {}, errUnknownKeyID},
+		{"wrong algorithm", key, map[string]interface{}{"alg": "none", "kid": "key"}, func(map[string]interface{}) {}, errUnsupportedAlg},
+		{"bad signature", otherKey, header, func(map[string]interface{}) {}, errInvalidSignature},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := validClaims()
+			tt.modify(claims)
+			token := signToken(t, tt.key, tt.header, claims)
+			require.Equal(t, tt.expected, validateJWT(testInfoHash, token, testConfig, publicKeys, testNow))
+		})
+	}
+
+	t.Run("optional expiration", func(t *testing.T) {
+		cfg := testConfig
+		cfg.RequireExpiration = false
+		claims := validClaims()
+		delete(claims, "exp")
+		token := signToken(t, key, header, claims)
+		require.Nil(t, validateJWT(testInfoHash, token, cfg, publicKeys, testNow))
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		require.Equal(t, errMalformed, validateJWT(testInfoHash, []byte("a.b"), testConfig, publicKeys, testNow))
+	})
+}
@@ -0,0 +1,145 @@
+package jwt
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Errors returned when validating JWTs.
+var (
+	errMalformed        = errors.New("malformed jwt")
+	errUnsupportedAlg   = errors.New("unsupported signing algorithm")
+	errUnsupportedKey   = errors.New("unsupported public key")
+	errMissingExpiry    = errors.New("claim \"exp\" is missing")
+	errExpired          = errors.New("token is expired")
+	errNotYetValid      = errors.New("token is not yet valid")
+	errInvalidIssuer    = errors.New("claim \"iss\" is invalid")
+	errInvalidAudience  = errors.New("claim \"aud\" is invalid")
+	errInvalidInfoHash  = errors.New("claim \"infohash\" is invalid")
+	errInvalidKeyID     = errors.New("invalid kid")
+	errUnknownKeyID     = errors.New("signed by unknown kid")
+	errInvalidSignature = errors.New("invalid signature")
+)
+
+// token is a JWT in the compact serialization of a JWS.
+type token struct {
+	header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	claims map[string]interface{}
+
+	// signed is the encoded header and payload the signature is computed
+	// over.
+	signed    []byte
+	signature []byte
+}
+
+// parseToken parses a JWT without verifying it.
+func parseToken(b []byte) (*token, error) {
+	parts := bytes.Split(b, []byte("."))
+	if len(parts) != 3 {
+		return nil, errMalformed
+	}
+
+	t := &token{signed: b[:len(parts[0])+1+len(parts[1])]}
+	header, err := decodeSegment(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(header, &t.header); err != nil {
+		return nil, errMalformed
+	}
+	payload, err := decodeSegment(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(payload, &t.claims); err != nil || t.claims == nil {
+		return nil, errMalformed
+	}
+	if t.signature, err = decodeSegment(parts[2]); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// decodeSegment decodes a base64url encoded segment of a JWT. Padding is
+// tolerated, although it must be omitted.
+func decodeSegment(seg []byte) ([]byte, error) {
+	b, err := base64.RawURLEncoding.DecodeString(string(bytes.TrimRight(seg, "=")))
+	if err != nil {
+		return nil, errMalformed
+	}
+	return b, nil
+}
+
+// time returns the time of a NumericDate claim, such as "exp".
+func (t *token) time(key string) (time.Time, bool) {
+	v, ok := t.claims[key].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(v), 0), true
+}
+
+// string returns the value of a string claim.
+func (t *token) string(key string) (string, bool) {
+	v, ok := t.claims[key].(string)
+	return v, ok
+}
+
+// audience returns the "aud" claim, which is either a string or a list of
+// strings.
+func (t *token) audience() ([]string, bool) {
+	switch aud := t.claims["aud"].(type) {
+	case string:
+		return []string{aud}, true
+	case []interface{}:
+		auds := make([]string, len(aud))
+		for i, v := range aud {
+			s, ok := v.(string)
+			if !ok {
+				return nil, false
+			}
+			auds[i] = s
+		}
+		return auds, len(auds) > 0
+	}
+	return nil, false
+}
+
+// validateTimes checks the "exp" and "nbf" claims against now, allowing for
+// leeway in both directions.
+func (t *token) validateTimes(now time.Time, leeway time.Duration) error {
+	if exp, ok := t.time("exp"); ok && now.After(exp.Add(leeway)) {
+		return errExpired
+	}
+	if nbf, ok := t.time("nbf"); ok && !now.After(nbf.Add(-leeway)) {
+		return errNotYetValid
+	}
+	return nil
+}
+
+// verify checks the RS256 signature of the token.
+func (t *token) verify(publicKey crypto.PublicKey) error {
+	if t.header.Alg != "RS256" {
+		return errUnsupportedAlg
+	}
+	key, ok := publicKey.(*rsa.PublicKey)
+	if !ok {
+		return errUnsupportedKey
+	}
+
+	digest := sha256.Sum256(t.signed)
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], t.signature); err != nil {
+		return errInvalidSignature
+	}
+	return nil
+}
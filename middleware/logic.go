@@ -2,6 +2,9 @@ package middleware
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/chihaya/chihaya/bittorrent"
@@ -20,19 +23,163 @@ import (
 type ResponseConfig struct {
 	AnnounceInterval    time.Duration `yaml:"announce_interval"`
 	MinAnnounceInterval time.Duration `yaml:"min_announce_interval"`
+	PeerShuffling       string        `yaml:"peer_shuffling"`
+	MaxPeersPerIP       int           `yaml:"max_peers_per_ip"`
+	LeecherSeedRatio    float64       `yaml:"leecher_seed_ratio"`
+	AnnounceTimeout     time.Duration `yaml:"announce_timeout"`
+	ScrapeTimeout       time.Duration `yaml:"scrape_timeout"`
+
+	// UnknownSwarms is the policy for announces of infohashes without a
+	// swarm. SwarmCreationRate and SwarmCreationBurst limit the swarms
+	// every IP address can create per second and at once, if the policy is
+	// UnknownSwarmsRateLimit.
+	UnknownSwarms      string  `yaml:"unknown_swarms"`
+	SwarmCreationRate  float64 `yaml:"swarm_creation_rate"`
+	SwarmCreationBurst int     `yaml:"swarm_creation_burst"`
+
+	// EventValidation is the policy for announces whose events don't follow
+	// from the previous announces of the peer. EventStateCacheSize is the
+	// number of peers whose state is tracked for it.
+	EventValidation     string `yaml:"event_validation"`
+	EventStateCacheSize int    `yaml:"event_state_cache_size"`
 }
 
+var (
+	// ErrAnnounceTimeout is returned if generating the response to an
+	// announce took longer than the configured announce timeout.
+	ErrAnnounceTimeout = errors.New("announce timed out")
+
+	// ErrScrapeTimeout is returned if generating the response to a scrape
+	// took longer than the configured scrape timeout.
+	ErrScrapeTimeout = errors.New("scrape timed out")
+)
+
 var _ frontend.TrackerLogic = &Logic{}
 
+// Check returns all problems of a config that make no sense, such as
+// negative intervals or unknown strategies.
+//
+// Unset values are not problems, since NewLogic replaces them with defaults.
+func (cfg ResponseConfig) Check() (problems []error) {
+	negative := func(key string) {
+		problems = append(problems, fmt.Errorf("%s must not be negative", key))
+	}
+
+	if cfg.AnnounceInterval < 0 {
+		negative("announce_interval")
+	}
+	if cfg.MinAnnounceInterval < 0 {
+		negative("min_announce_interval")
+	}
+	if cfg.MinAnnounceInterval > cfg.AnnounceInterval {
+		problems = append(problems, errors.New("min_announce_interval must not exceed announce_interval"))
+	}
+	if cfg.MaxPeersPerIP < 0 {
+		negative("max_peers_per_ip")
+	}
+	if cfg.LeecherSeedRatio < 0 || cfg.LeecherSeedRatio > 1 {
+		problems = append(problems, errors.New("leecher_seed_ratio must be between 0 and 1"))
+	}
+	if cfg.AnnounceTimeout < 0 {
+		negative("announce_timeout")
+	}
+	if cfg.ScrapeTimeout < 0 {
+		negative("scrape_timeout")
+	}
+	if cfg.SwarmCreationRate < 0 {
+		negative("swarm_creation_rate")
+	}
+	if cfg.SwarmCreationBurst < 0 {
+		negative("swarm_creation_burst")
+	}
+	if cfg.EventStateCacheSize < 0 {
+		negative("event_state_cache_size")
+	}
+
+	switch cfg.PeerShuffling {
+	case "", ShuffleNone, ShuffleRandom, ShuffleRotate, ShufflePeerID:
+	default:
+		problems = append(problems, fmt.Errorf("invalid peer_shuffling %q", cfg.PeerShuffling))
+	}
+	switch cfg.UnknownSwarms {
+	case "", UnknownSwarmsCreate, UnknownSwarmsReject, UnknownSwarmsRateLimit:
+	default:
+		problems = append(problems, fmt.Errorf("invalid unknown_swarms %q", cfg.UnknownSwarms))
+	}
+	switch cfg.EventValidation {
+	case "", EventValidationOff, EventValidationCorrect, EventValidationReject:
+	default:
+		problems = append(problems, fmt.Errorf("invalid event_validation %q", cfg.EventValidation))
+	}
+	return
+}
+
+// logger is used for all messages logged while handling requests.
+var logger = log.Component("middleware")
+
 // NewLogic creates a new instance of a TrackerLogic that executes the provided
 // middleware hooks.
 func NewLogic(cfg ResponseConfig, peerStore storage.PeerStore, preHooks, postHooks []Hook) *Logic {
+	return NewLogicWithResponseHooks(cfg, peerStore, preHooks, nil, postHooks)
+}
+
+// NewLogicWithResponseHooks creates a new instance of a TrackerLogic like
+// NewLogic, which additionally executes responseHooks.
+//
+// PreHooks run before the response is populated from the PeerStore,
+// ResponseHooks afterwards, so that they can post-process the complete
+// response before it is written. PostHooks run after the response has been
+// written.
+func NewLogicWithResponseHooks(cfg ResponseConfig, peerStore storage.PeerStore, preHooks, responseHooks, postHooks []Hook) *Logic {
+	if cfg.PeerShuffling == "" {
+		cfg.PeerShuffling = defaultPeerShuffling
+	}
+	if cfg.LeecherSeedRatio < 0 || cfg.LeecherSeedRatio > 1 {
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "LeecherSeedRatio",
+			"provided": cfg.LeecherSeedRatio,
+			"default":  0,
+		})
+		cfg.LeecherSeedRatio = 0
+	}
+	if cfg.UnknownSwarms == "" {
+		cfg.UnknownSwarms = defaultUnknownSwarms
+	}
+	if cfg.EventValidation == "" {
+		cfg.EventValidation = defaultEventValidation
+	}
+
+	// Swarms of reserved infohashes never reach the configured storage.
+	store := newReservedStore(peerStore)
+
+	respHook := &responseHook{
+		store:            store,
+		shuffler:         newShuffler(cfg.PeerShuffling),
+		maxPeersPerIP:    cfg.MaxPeersPerIP,
+		leecherSeedRatio: cfg.LeecherSeedRatio,
+	}
+
+	// Unknown swarms are checked after the configured PreHooks, which may
+	// reject the announce on their own.
+	if h := newUnknownSwarmHook(cfg, store); h != nil {
+		preHooks = append(preHooks, h)
+	}
+
+	// Events are validated last, so that the state of peers is only updated
+	// for announces that aren't rejected otherwise.
+	if h := newEventHook(cfg); h != nil {
+		preHooks = append(preHooks, h)
+	}
+
 	return &Logic{
 		announceInterval:    cfg.AnnounceInterval,
 		minAnnounceInterval: cfg.MinAnnounceInterval,
+		announceTimeout:     cfg.AnnounceTimeout,
+		scrapeTimeout:       cfg.ScrapeTimeout,
 		peerStore:           peerStore,
-		preHooks:            append(preHooks, &responseHook{store: peerStore}),
-		postHooks:           append(postHooks, &swarmInteractionHook{store: peerStore}),
+		preHooks:            append(preHooks, respHook),
+		responseHooks:       responseHooks,
+		postHooks:           append(postHooks, &swarmInteractionHook{store: store}),
 	}
 }
 
@@ -41,83 +188,252 @@ func NewLogic(cfg ResponseConfig, peerStore storage.PeerStore, preHooks, postHoo
 type Logic struct {
 	announceInterval    time.Duration
 	minAnnounceInterval time.Duration
+	announceTimeout     time.Duration
+	scrapeTimeout       time.Duration
 	peerStore           storage.PeerStore
 	preHooks            []Hook
+	responseHooks       []Hook
 	postHooks           []Hook
 }
 
+// withTimeout returns a context that is canceled after timeout, if it is
+// greater than zero.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// timedOut reports whether ctx was canceled because its own timeout expired
+// rather than because parent was done.
+func timedOut(parent, ctx context.Context) bool {
+	return parent.Err() == nil && ctx.Err() == context.DeadlineExceeded
+}
+
 // HandleAnnounce generates a response for an Announce.
-func (l *Logic) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest) (_ context.Context, resp *bittorrent.AnnounceResponse, err error) {
+//
+// A hook may refuse an announce without an error by setting the
+// FailureReason of the response, for example to tell clients when to retry.
+// The remaining hooks are skipped then, like after an error, and the response
+// is returned.
+//
+// If an announce timeout is configured, ErrAnnounceTimeout is returned once it
+// expired, even if a hook is still running. Such a hook keeps running with a
+// canceled context, its result is discarded and the remaining hooks are
+// skipped. The returned context is canceled in that case, too.
+func (l *Logic) HandleAnnounce(parent context.Context, req *bittorrent.AnnounceRequest) (_ context.Context, resp *bittorrent.AnnounceResponse, err error) {
+	// Deferred first, so that the outcome is recorded after timeouts were
+	// reported.
+	defer func() { recordAnnounce(req, resp, err) }()
+
+	ctx, cancel := withTimeout(parent, l.announceTimeout)
+	defer cancel()
+	deadline := ctx
+	defer func() {
+		if err != nil && timedOut(parent, deadline) {
+			recordTimeout("announce")
+			err = ErrAnnounceTimeout
+		}
+	}()
+
 	resp = &bittorrent.AnnounceResponse{
 		Interval:    l.announceInterval,
 		MinInterval: l.minAnnounceInterval,
 		Compact:     req.Compact,
+		NoPeerID:    req.NoPeerID,
 	}
-	for _, h := range l.preHooks {
-		if ctx, err = h.HandleAnnounce(ctx, req, resp); err != nil {
-			return nil, nil, err
+	bittorrent.RecordDecision(ctx, "interval", "config")
+	if l.announceTimeout <= 0 {
+		return l.announceHooks(ctx, req, resp)
+	}
+
+	type result struct {
+		ctx  context.Context
+		resp *bittorrent.AnnounceResponse
+		err  error
+	}
+	done := make(chan result, 1)
+	go func(ctx context.Context, resp *bittorrent.AnnounceResponse) {
+		ctx, resp, err := l.announceHooks(ctx, req, resp)
+		done <- result{ctx, resp, err}
+	}(ctx, resp)
+	select {
+	case r := <-done:
+		return r.ctx, r.resp, r.err
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+}
+
+// announceHooks runs the PreHooks and ResponseHooks for an Announce, checking
+// ctx before every hook.
+func (l *Logic) announceHooks(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (_ context.Context, _ *bittorrent.AnnounceResponse, err error) {
+	for _, hooks := range [][]Hook{l.preHooks, l.responseHooks} {
+		for _, h := range hooks {
+			if err = ctx.Err(); err != nil {
+				return nil, nil, err
+			}
+			if ctx, err = h.HandleAnnounce(ctx, req, resp); err != nil {
+				recordRejection(h, err, clientName(req.Peer.ID))
+				return nil, nil, err
+			}
+			if resp.FailureReason != "" {
+				recordRejection(h, bittorrent.ClientError(resp.FailureReason), clientName(req.Peer.ID))
+				logger.Debug("generated announce failure", resp)
+				return ctx, resp, nil
+			}
 		}
 	}
 
-	log.Debug("generated announce response", resp)
+	logger.Debug("generated announce response", resp)
 	return ctx, resp, nil
 }
 
 // AfterAnnounce does something with the results of an Announce after it has
 // been completed.
+//
+// Failures are ignored, so that refused peers don't join the swarm.
 func (l *Logic) AfterAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) {
+	if resp.FailureReason != "" {
+		return
+	}
+
 	var err error
 	for _, h := range l.postHooks {
 		if ctx, err = h.HandleAnnounce(ctx, req, resp); err != nil {
-			log.Error("post-announce hooks failed", log.Err(err))
+			logger.Error("post-announce hooks failed", log.Err(err))
 			return
 		}
 	}
 }
 
+// scrapeResponsePool holds ScrapeResponses that can be reused, to avoid
+// allocating a response for every scrape.
+var scrapeResponsePool = sync.Pool{
+	New: func() interface{} { return new(bittorrent.ScrapeResponse) },
+}
+
 // HandleScrape generates a response for a Scrape.
-func (l *Logic) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest) (_ context.Context, resp *bittorrent.ScrapeResponse, err error) {
-	resp = &bittorrent.ScrapeResponse{
-		Files: make([]bittorrent.Scrape, 0, len(req.InfoHashes)),
+//
+// The response is taken from a pool and returned to it by AfterScrape.
+//
+// If a scrape timeout is configured, ErrScrapeTimeout is returned once it
+// expired, even if a hook is still running. Such a hook keeps running with a
+// canceled context, its result is discarded and the remaining hooks are
+// skipped. The returned context is canceled in that case, too.
+func (l *Logic) HandleScrape(parent context.Context, req *bittorrent.ScrapeRequest) (_ context.Context, resp *bittorrent.ScrapeResponse, err error) {
+	ctx, cancel := withTimeout(parent, l.scrapeTimeout)
+	defer cancel()
+	deadline := ctx
+	defer func() {
+		if err != nil && timedOut(parent, deadline) {
+			recordTimeout("scrape")
+			err = ErrScrapeTimeout
+		}
+	}()
+
+	resp = scrapeResponsePool.Get().(*bittorrent.ScrapeResponse)
+	if cap(resp.Files) < len(req.InfoHashes) {
+		resp.Files = make([]bittorrent.Scrape, 0, len(req.InfoHashes))
 	}
-	for _, h := range l.preHooks {
-		if ctx, err = h.HandleScrape(ctx, req, resp); err != nil {
-			return nil, nil, err
+	if l.scrapeTimeout <= 0 {
+		return l.scrapeHooks(ctx, req, resp)
+	}
+
+	type result struct {
+		ctx  context.Context
+		resp *bittorrent.ScrapeResponse
+		err  error
+	}
+	done := make(chan result, 1)
+	go func(ctx context.Context, resp *bittorrent.ScrapeResponse) {
+		ctx, resp, err := l.scrapeHooks(ctx, req, resp)
+		done <- result{ctx, resp, err}
+	}(ctx, resp)
+	select {
+	case r := <-done:
+		return r.ctx, r.resp, r.err
+	case <-ctx.Done():
+		// The response may still be written to by the running hook, so
+		// it isn't returned to the pool.
+		return nil, nil, ctx.Err()
+	}
+}
+
+// scrapeHooks runs the PreHooks and ResponseHooks for a Scrape, checking ctx
+// before every hook. The response is returned to the pool if a hook fails.
+func (l *Logic) scrapeHooks(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (_ context.Context, _ *bittorrent.ScrapeResponse, err error) {
+	for _, hooks := range [][]Hook{l.preHooks, l.responseHooks} {
+		for _, h := range hooks {
+			if err = ctx.Err(); err != nil {
+				ReturnScrapeResponse(resp)
+				return nil, nil, err
+			}
+			if ctx, err = h.HandleScrape(ctx, req, resp); err != nil {
+				recordRejection(h, err, UnknownClient)
+				ReturnScrapeResponse(resp)
+				return nil, nil, err
+			}
 		}
 	}
 
-	log.Debug("generated scrape response", resp)
+	logger.Debug("generated scrape response", resp)
 	return ctx, resp, nil
 }
 
 // AfterScrape does something with the results of a Scrape after it has been
 // completed.
+//
+// The response is returned to the pool of responses afterwards, so it must not
+// be used once AfterScrape was called.
 func (l *Logic) AfterScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) {
+	defer ReturnScrapeResponse(resp)
+
 	var err error
 	for _, h := range l.postHooks {
 		if ctx, err = h.HandleScrape(ctx, req, resp); err != nil {
-			log.Error("post-scrape hooks failed", log.Err(err))
+			logger.Error("post-scrape hooks failed", log.Err(err))
 			return
 		}
 	}
 }
 
+// ReturnScrapeResponse returns a ScrapeResponse generated by HandleScrape to
+// the pool of responses. The response must not be used afterwards.
+//
+// This is called by AfterScrape, it is only necessary to call it if a
+// response is not passed to AfterScrape.
+func ReturnScrapeResponse(resp *bittorrent.ScrapeResponse) {
+	resp.Files = resp.Files[:0]
+	resp.MinRequestInterval = 0
+	scrapeResponsePool.Put(resp)
+}
+
 // Stop stops the Logic.
 //
 // This stops any hooks that implement stop.Stopper.
 func (l *Logic) Stop() stop.Result {
-	stopGroup := stop.NewGroup()
-	for _, hook := range l.preHooks {
-		stoppable, ok := hook.(stop.Stopper)
-		if ok {
-			stopGroup.Add(stoppable)
-		}
-	}
+	return l.StopWithin(0)
+}
 
-	for _, hook := range l.postHooks {
-		stoppable, ok := hook.(stop.Stopper)
-		if ok {
-			stopGroup.Add(stoppable)
+// StopWithin stops the Logic like Stop, but gives up on every hook that did
+// not stop within timeout, so that a hung hook can't block a shutdown. Such a
+// hook is reported as a stop.TimeoutError.
+//
+// A timeout that is not positive waits for the hooks indefinitely.
+func (l *Logic) StopWithin(timeout time.Duration) stop.Result {
+	stopGroup := stop.NewGroup()
+	for _, hooks := range [][]Hook{l.preHooks, l.responseHooks, l.postHooks} {
+		for _, hook := range hooks {
+			stoppable, ok := hook.(stop.Stopper)
+			if !ok {
+				continue
+			}
+			name := hookName(hook)
+			stopGroup.AddFunc(func() stop.Result {
+				return stop.WithTimeout(stoppable.Stop(), name, timeout)
+			})
 		}
 	}
 
@@ -5,10 +5,12 @@ import (
 	"fmt"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
 	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/stop"
 )
 
 // nopHook is a Hook to measure the overhead of a no-operation Hook through
@@ -81,3 +83,222 @@ func BenchmarkHookOverhead(b *testing.B) {
 		})
 	}
 }
+
+// scrapeHook adds a Scrape for every InfoHash of a ScrapeRequest.
+type scrapeHook struct {
+	nopHook
+}
+
+func (h *scrapeHook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	for range req.InfoHashes {
+		resp.Files = append(resp.Files, bittorrent.Scrape{Complete: 1})
+	}
+	return ctx, nil
+}
+
+func TestHandleScrapeReusesResponses(t *testing.T) {
+	l := &Logic{preHooks: []Hook{&scrapeHook{}}}
+	for _, n := range []int{3, 1, 5, 0} {
+		req := &bittorrent.ScrapeRequest{InfoHashes: make([]bittorrent.InfoHash, n)}
+		ctx, resp, err := l.HandleScrape(context.Background(), req)
+		require.Nil(t, err)
+		require.Len(t, resp.Files, n)
+		l.AfterScrape(ctx, req, resp)
+	}
+}
+
+func BenchmarkHandleScrape(b *testing.B) {
+	l := &Logic{preHooks: []Hook{&scrapeHook{}}}
+	req := &bittorrent.ScrapeRequest{InfoHashes: make([]bittorrent.InfoHash, 10)}
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, resp, err := l.HandleScrape(ctx, req)
+		if err != nil {
+			b.Fatal(err)
+		}
+		l.AfterScrape(ctx, req, resp)
+	}
+}
+
+// doublingHook doubles the interval of announces and the number of complete
+// peers of scrapes.
+type doublingHook struct{}
+
+func (doublingHook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	resp.Interval *= 2
+	return ctx, nil
+}
+
+func (doublingHook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	for i := range resp.Files {
+		resp.Files[i].Complete *= 2
+	}
+	return ctx, nil
+}
+
+func TestResponseHooksRunAfterPreHooks(t *testing.T) {
+	l := &Logic{
+		announceInterval: time.Minute,
+		preHooks:         []Hook{&scrapeHook{}},
+		responseHooks:    []Hook{doublingHook{}},
+	}
+
+	_, announceResp, err := l.HandleAnnounce(context.Background(), &bittorrent.AnnounceRequest{})
+	require.Nil(t, err)
+	require.Equal(t, 2*time.Minute, announceResp.Interval)
+
+	req := &bittorrent.ScrapeRequest{InfoHashes: make([]bittorrent.InfoHash, 2)}
+	ctx, scrapeResp, err := l.HandleScrape(context.Background(), req)
+	require.Nil(t, err)
+	require.Equal(t, []bittorrent.Scrape{{Complete: 2}, {Complete: 2}}, scrapeResp.Files)
+	l.AfterScrape(ctx, req, scrapeResp)
+}
+
+// retryHook refuses announces by setting the FailureReason of the response.
+type retryHook struct {
+	nopHook
+}
+
+func (h *retryHook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	resp.FailureReason = "tracker is busy"
+	resp.RetryIn = 5 * time.Minute
+	return ctx, nil
+}
+
+// countingHook counts the announces it handled.
+type countingHook struct {
+	nopHook
+	announces int
+}
+
+func (h *countingHook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	h.announces++
+	return ctx, nil
+}
+
+func TestAnnounceFailureSkipsHooks(t *testing.T) {
+	post := &countingHook{}
+	l := &Logic{
+		announceInterval: time.Minute,
+		preHooks:         []Hook{&retryHook{}},
+		responseHooks:    []Hook{doublingHook{}},
+		postHooks:        []Hook{post},
+	}
+
+	req := &bittorrent.AnnounceRequest{}
+	ctx, resp, err := l.HandleAnnounce(context.Background(), req)
+	require.Nil(t, err)
+	require.Equal(t, "tracker is busy", resp.FailureReason)
+	require.Equal(t, 5*time.Minute, resp.RetryIn)
+	require.Equal(t, time.Minute, resp.Interval)
+
+	l.AfterAnnounce(ctx, req, resp)
+	require.Equal(t, 0, post.announces)
+}
+
+// slowHook blocks until the context of the request is done.
+type slowHook struct{}
+
+func (slowHook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	<-ctx.Done()
+	return ctx, nil
+}
+
+func (slowHook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	<-ctx.Done()
+	return ctx, nil
+}
+
+// blockingHook blocks until release is closed, ignoring the context of the
+// request.
+type blockingHook struct {
+	release chan struct{}
+}
+
+func (h blockingHook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	<-h.release
+	return ctx, nil
+}
+
+func (h blockingHook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	<-h.release
+	return ctx, nil
+}
+
+func TestRequestTimeouts(t *testing.T) {
+	l := &Logic{
+		announceTimeout: 10 * time.Millisecond,
+		scrapeTimeout:   10 * time.Millisecond,
+		preHooks:        []Hook{slowHook{}},
+		responseHooks:   []Hook{doublingHook{}},
+	}
+
+	_, _, err := l.HandleAnnounce(context.Background(), &bittorrent.AnnounceRequest{})
+	require.Equal(t, ErrAnnounceTimeout, err)
+
+	_, _, err = l.HandleScrape(context.Background(), &bittorrent.ScrapeRequest{})
+	require.Equal(t, ErrScrapeTimeout, err)
+
+	// Hooks ignoring the context don't delay the response past the timeout.
+	release := make(chan struct{})
+	defer close(release)
+	blocked := &Logic{
+		announceTimeout: 10 * time.Millisecond,
+		scrapeTimeout:   10 * time.Millisecond,
+		preHooks:        []Hook{blockingHook{release}},
+	}
+
+	start := time.Now()
+	_, _, err = blocked.HandleAnnounce(context.Background(), &bittorrent.AnnounceRequest{})
+	require.Equal(t, ErrAnnounceTimeout, err)
+	_, _, err = blocked.HandleScrape(context.Background(), &bittorrent.ScrapeRequest{})
+	require.Equal(t, ErrScrapeTimeout, err)
+	require.True(t, time.Since(start) < time.Second)
+
+	// Requests aborted by the frontend are not reported as timeouts.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err = l.HandleAnnounce(ctx, &bittorrent.AnnounceRequest{})
+	require.Equal(t, context.Canceled, err)
+}
+
+// hungHook never stops, like a hook stuck flushing to an unreachable
+// backend.
+type hungHook struct{ *nopHook }
+
+func (hungHook) Stop() stop.Result {
+	return make(stop.Channel).Result()
+}
+
+func TestStopWithin(t *testing.T) {
+	l := &Logic{
+		preHooks:  []Hook{namedHook{Hook: &nopHook{}, name: "nop"}},
+		postHooks: []Hook{namedHook{Hook: hungHook{&nopHook{}}, name: "hung"}},
+	}
+
+	errs := l.StopWithin(10 * time.Millisecond).Wait()
+	require.Equal(t, []error{stop.TimeoutError{Name: "hung", Timeout: 10 * time.Millisecond}}, errs)
+}
+
+func TestResponseConfigCheck(t *testing.T) {
+	require.Empty(t, ResponseConfig{}.Check())
+	require.Empty(t, ResponseConfig{
+		AnnounceInterval:    30 * time.Minute,
+		MinAnnounceInterval: 15 * time.Minute,
+		PeerShuffling:       ShuffleRandom,
+		LeecherSeedRatio:    0.5,
+		UnknownSwarms:       UnknownSwarmsReject,
+	}.Check())
+
+	problems := ResponseConfig{
+		AnnounceInterval:    time.Minute,
+		MinAnnounceInterval: time.Hour,
+		MaxPeersPerIP:       -1,
+		LeecherSeedRatio:    2,
+		PeerShuffling:       "sorted",
+		UnknownSwarms:       "ignore",
+	}.Check()
+	require.Len(t, problems, 5)
+}
@@ -4,9 +4,12 @@ package middleware
 
 import (
 	"errors"
+	"fmt"
 	"sync"
 
 	yaml "gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya/pkg/stop"
 )
 
 var (
@@ -87,8 +90,46 @@ func HooksFromHookConfigs(cfgs []HookConfig) (hooks []Hook, err error) {
 			return
 		}
 
-		hooks = append(hooks, h)
+		hooks = append(hooks, NamedHook(cfg.Name, h))
 	}
 
 	return
 }
+
+// namedHook is a Hook labeled with the name of its middleware, so that the
+// requests it rejects can be attributed to it.
+type namedHook struct {
+	Hook
+	name string
+}
+
+// NamedHook labels h with the name of its middleware, which the requests it
+// rejects are attributed to. Hooks created by HooksFromHookConfigs are
+// labeled with the name of their driver.
+func NamedHook(name string, h Hook) Hook {
+	return namedHook{Hook: h, name: name}
+}
+
+// Stop implements stop.Stopper by stopping the labeled Hook, if it can be
+// stopped.
+func (h namedHook) Stop() stop.Result {
+	if stopper, ok := h.Hook.(stop.Stopper); ok {
+		return stopper.Stop()
+	}
+	return stop.AlreadyStopped
+}
+
+// hookName returns the name of the middleware of h.
+func hookName(h Hook) string {
+	switch h := h.(type) {
+	case namedHook:
+		return h.name
+	case *unknownSwarmHook:
+		return "unknown swarms"
+	case *eventHook:
+		return "event validation"
+	case *responseHook:
+		return "response"
+	}
+	return fmt.Sprintf("%T", h)
+}
@@ -0,0 +1,390 @@
+// Package passkey implements a Hook for private trackers that only accepts
+// announces and scrapes carrying the passkey of a user, and records the data
+// users transferred.
+//
+// Passkeys are looked up in a UserStore. The UserStore of the middleware
+// reads them from a file or HTTP endpoint and writes the statistics of users
+// to a file or HTTP endpoint.
+package passkey
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/policy"
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+// Name is the name by which this middleware is registered with Chihaya.
+const Name = "passkey"
+
+func init() {
+	middleware.RegisterDriver(Name, driver{})
+}
+
+var _ middleware.Driver = driver{}
+
+type driver struct{}
+
+func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
+	var cfg Config
+	err := yaml.UnmarshalStrict(optionBytes, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid options for middleware %s: %s", Name, err)
+	}
+
+	return NewHook(cfg)
+}
+
+// MaxPasskeyLength is the maximum length of a passkey.
+const MaxPasskeyLength = 64
+
+// ErrPasskeyRequired is returned for requests without a passkey.
+var ErrPasskeyRequired = bittorrent.ClientError("passkey required")
+
+// ErrUnknownPasskey is returned for requests with a passkey that doesn't
+// belong to any user.
+var ErrUnknownPasskey = bittorrent.ClientError("unknown passkey")
+
+// ErrUserDisabled is returned for requests of disabled users.
+var ErrUserDisabled = bittorrent.ClientError("user disabled")
+
+// ErrDownloadsDisabled is returned for announces of incomplete torrents of
+// users whose downloads are disabled.
+var ErrDownloadsDisabled = bittorrent.ClientError("downloads disabled")
+
+type userKey struct{}
+
+// UserKey is the key of the user of a request in the context returned by the
+// middleware, as a string, so that middleware running afterwards can treat
+// users differently.
+var UserKey = userKey{}
+
+// Config represents the configuration for the passkey middleware.
+type Config struct {
+	// RouteParam is the named parameter of the HTTP routes that holds the
+	// passkey, such as "passkey" for "/:passkey/announce".
+	RouteParam string `yaml:"route_param"`
+
+	// Param is the query parameter that holds the passkey of requests
+	// whose route has none, such as UDP announces with BEP 41 URL data.
+	Param string `yaml:"param"`
+
+	// Store is the UserStore driver users are looked up in and statistics
+	// are recorded to. If it isn't set, passkeys are read from Source and
+	// statistics written to StatsDestination.
+	Store StoreConfig `yaml:"store"`
+
+	// Source is the path to a file or the URL of an HTTP endpoint listing
+	// passkeys. Stores that keep users in memory, such as this one, are
+	// reloaded every ReloadInterval.
+	Source         string        `yaml:"source"`
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+
+	// StatsDestination is the path to a file or the URL of an HTTP endpoint
+	// the data users transferred is written to. If empty, statistics are
+	// not recorded. Statistics are recorded to the store every
+	// StatsInterval.
+	StatsDestination string        `yaml:"stats_destination"`
+	StatsInterval    time.Duration `yaml:"stats_interval"`
+
+	// SessionTimeout is the time after which the session of a client that
+	// stopped announcing is forgotten.
+	SessionTimeout time.Duration `yaml:"session_timeout"`
+}
+
+// StoreConfig is the name and configuration of a UserStore driver.
+type StoreConfig struct {
+	Name   string      `yaml:"name"`
+	Config interface{} `yaml:"config"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"store":            cfg.Store.Name,
+		"routeParam":       cfg.RouteParam,
+		"param":            cfg.Param,
+		"source":           cfg.Source,
+		"reloadInterval":   cfg.ReloadInterval,
+		"statsDestination": cfg.StatsDestination,
+		"statsInterval":    cfg.StatsInterval,
+		"sessionTimeout":   cfg.SessionTimeout,
+	}
+}
+
+// Default config constants.
+const (
+	defaultParam          = "passkey"
+	defaultReloadInterval = time.Minute
+	defaultStatsInterval  = time.Minute
+	defaultSessionTimeout = 2 * time.Hour
+)
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.RouteParam == "" {
+		validcfg.RouteParam = defaultParam
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".RouteParam",
+			"provided": cfg.RouteParam,
+			"default":  validcfg.RouteParam,
+		})
+	}
+
+	if cfg.Param == "" {
+		validcfg.Param = defaultParam
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".Param",
+			"provided": cfg.Param,
+			"default":  validcfg.Param,
+		})
+	}
+
+	if cfg.ReloadInterval <= 0 {
+		validcfg.ReloadInterval = defaultReloadInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".ReloadInterval",
+			"provided": cfg.ReloadInterval,
+			"default":  validcfg.ReloadInterval,
+		})
+	}
+
+	if cfg.StatsInterval <= 0 {
+		validcfg.StatsInterval = defaultStatsInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".StatsInterval",
+			"provided": cfg.StatsInterval,
+			"default":  validcfg.StatsInterval,
+		})
+	}
+
+	if cfg.SessionTimeout <= 0 {
+		validcfg.SessionTimeout = defaultSessionTimeout
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".SessionTimeout",
+			"provided": cfg.SessionTimeout,
+			"default":  validcfg.SessionTimeout,
+		})
+	}
+
+	return validcfg
+}
+
+type hook struct {
+	cfg      Config
+	store    UserStore
+	sessions *sessions
+
+	closing chan struct{}
+	done    chan struct{}
+}
+
+// NewHook returns an instance of the passkey middleware that uses the
+// configured store or, if none is configured, reads passkeys from the
+// configured source.
+func NewHook(provided Config) (middleware.Hook, error) {
+	if provided.Store.Name == "" && provided.Source == "" {
+		return nil, errors.New("store or source must be set")
+	}
+	cfg := provided.Validate()
+
+	var store UserStore
+	var err error
+	if cfg.Store.Name != "" {
+		store, err = NewUserStore(cfg.Store.Name, cfg.Store.Config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create user store %s: %s", cfg.Store.Name, err)
+		}
+	} else {
+		store, err = newListStore(cfg.Source, cfg.StatsDestination)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return newHook(cfg, store), nil
+}
+
+// NewHookWithStore returns an instance of the passkey middleware that looks
+// up passkeys in and records statistics to store. The Store, Source and
+// StatsDestination of the config are ignored.
+//
+// The store is stopped with the middleware if it implements stop.Stopper.
+func NewHookWithStore(provided Config, store UserStore) middleware.Hook {
+	return newHook(provided.Validate(), store)
+}
+
+func newHook(cfg Config, store UserStore) *hook {
+	h := &hook{
+		cfg:      cfg,
+		store:    store,
+		sessions: newSessions(),
+		closing:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go h.run()
+	return h
+}
+
+// run reloads the store and flushes statistics until the hook is stopped.
+func (h *hook) run() {
+	defer close(h.done)
+
+	reload := time.NewTicker(h.cfg.ReloadInterval)
+	defer reload.Stop()
+	flush := time.NewTicker(h.cfg.StatsInterval)
+	defer flush.Stop()
+
+	for {
+		select {
+		case <-h.closing:
+			h.flush()
+			return
+		case <-reload.C:
+			h.reload()
+		case <-flush.C:
+			h.flush()
+		}
+	}
+}
+
+// reload reloads the store, if it keeps users in memory.
+func (h *hook) reload() {
+	r, ok := h.store.(Reloader)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.cfg.ReloadInterval)
+	defer cancel()
+	if err := r.Reload(ctx); err != nil {
+		// The previous passkeys stay in effect.
+		log.Error("failed to reload passkeys", log.Fields{
+			"store":  h.cfg.Store.Name,
+			"source": h.cfg.Source,
+			"error":  err,
+		})
+	}
+}
+
+// flush records the statistics summed up since the previous flush. They are
+// kept for the next flush if they can't be recorded.
+func (h *hook) flush() {
+	now := time.Now()
+	stats := h.sessions.flush(now.Add(-h.cfg.SessionTimeout))
+	if len(stats) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.cfg.StatsInterval)
+	defer cancel()
+	if err := h.store.RecordStats(ctx, stats); err != nil {
+		h.sessions.restore(stats)
+		log.Error("failed to record user statistics", log.Fields{
+			"users": len(stats),
+			"error": err,
+		})
+	}
+}
+
+func (h *hook) Stop() stop.Result {
+	select {
+	case <-h.closing:
+		return stop.AlreadyStopped
+	default:
+	}
+	c := make(stop.Channel)
+	go func() {
+		close(h.closing)
+		<-h.done
+
+		// The store is stopped after the final statistics were recorded.
+		if stopper, ok := h.store.(stop.Stopper); ok {
+			c.Done(stopper.Stop().Wait()...)
+			return
+		}
+		c.Done()
+	}()
+	return c.Result()
+}
+
+// passkey returns the passkey of a request, from its route or its
+// parameters.
+func (h *hook) passkey(ctx context.Context, params bittorrent.Params) string {
+	if rp, ok := ctx.Value(bittorrent.RouteParamsKey).(bittorrent.RouteParams); ok {
+		if passkey := rp.ByName(h.cfg.RouteParam); passkey != "" {
+			return passkey
+		}
+	}
+	if params == nil {
+		return ""
+	}
+	passkey, _ := params.String(h.cfg.Param)
+	return passkey
+}
+
+// user returns the user of the passkey of a request, if the user is not
+// disabled.
+func (h *hook) user(ctx context.Context, params bittorrent.Params) (User, error) {
+	passkey := h.passkey(ctx, params)
+	switch {
+	case passkey == "":
+		bittorrent.RecordDecision(ctx, Name, "missing")
+		return User{}, ErrPasskeyRequired
+	case len(passkey) > MaxPasskeyLength:
+		bittorrent.RecordDecision(ctx, Name, "unknown")
+		return User{}, ErrUnknownPasskey
+	}
+
+	user, ok, err := h.store.User(ctx, passkey)
+	switch {
+	case err != nil:
+		return User{}, err
+	case !ok:
+		bittorrent.RecordDecision(ctx, Name, "unknown")
+		return User{}, ErrUnknownPasskey
+	case user.Disabled:
+		bittorrent.RecordDecision(ctx, Name, "disabled")
+		return User{}, ErrUserDisabled
+	}
+
+	bittorrent.RecordDecision(ctx, Name, "authorized")
+	return user, nil
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	user, err := h.user(ctx, req.Params)
+	if err != nil {
+		return ctx, err
+	}
+
+	// Leechers may always leave the swarm.
+	if user.DownloadsDisabled && req.Left > 0 && req.Event != bittorrent.Stopped {
+		bittorrent.RecordDecision(ctx, Name, "downloads disabled")
+		return ctx, ErrDownloadsDisabled
+	}
+
+	p, _ := policy.FromContext(ctx)
+	h.sessions.announce(user.ID, req, p.Freeleech, time.Now())
+	return context.WithValue(ctx, UserKey, user.ID), nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	user, err := h.user(ctx, req.Params)
+	if err != nil {
+		return ctx, err
+	}
+	return context.WithValue(ctx, UserKey, user.ID), nil
+}
@@ -0,0 +1,140 @@
+package passkey
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// mapStore is a UserStore backed by a map, which keeps the recorded stats.
+type mapStore struct {
+	users    map[string]User
+	recorded []Stats
+	err      error
+}
+
+func (s *mapStore) User(ctx context.Context, passkey string) (User, bool, error) {
+	user, ok := s.users[passkey]
+	return user, ok, nil
+}
+
+func (s *mapStore) RecordStats(ctx context.Context, stats []Stats) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.recorded = append(s.recorded, stats...)
+	return nil
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	store := &mapStore{users: map[string]User{
+		"abc": {ID: "alice"},
+		"bcd": {ID: "bob", Disabled: true},
+		"cde": {ID: "carol", DownloadsDisabled: true},
+	}}
+	h := newHook(Config{}.Validate(), store)
+	defer func() { h.Stop().Wait() }()
+
+	routeCtx := func(passkey string) context.Context {
+		rp := bittorrent.RouteParams{{Key: "passkey", Value: passkey}}
+		return context.WithValue(context.Background(), bittorrent.RouteParamsKey, rp)
+	}
+	query := func(q string) bittorrent.Params {
+		params, err := bittorrent.ParseURLData("/announce?" + q)
+		require.Nil(t, err)
+		return params
+	}
+
+	var table = []struct {
+		ctx      context.Context
+		params   bittorrent.Params
+		expected error
+	}{
+		{routeCtx("abc"), nil, nil},
+		{routeCtx("bcd"), nil, ErrUserDisabled},
+		{routeCtx("abd"), nil, ErrUnknownPasskey},
+		{context.Background(), query("passkey=abc"), nil},
+		{context.Background(), query("passkey=abd"), ErrUnknownPasskey},
+		{context.Background(), query("key=abc"), ErrPasskeyRequired},
+		{context.Background(), nil, ErrPasskeyRequired},
+	}
+
+	for _, tt := range table {
+		req := &bittorrent.AnnounceRequest{Params: tt.params}
+		ctx, err := h.HandleAnnounce(tt.ctx, req, &bittorrent.AnnounceResponse{})
+		require.Equal(t, tt.expected, err)
+		if err == nil {
+			require.Equal(t, "alice", ctx.Value(UserKey))
+		}
+
+		_, err = h.HandleScrape(tt.ctx, &bittorrent.ScrapeRequest{Params: tt.params}, &bittorrent.ScrapeResponse{})
+		require.Equal(t, tt.expected, err)
+	}
+
+	// Users whose downloads are disabled may seed and leave swarms.
+	for _, req := range []*bittorrent.AnnounceRequest{
+		{Left: 1, Event: bittorrent.Started},
+		{Left: 0, Event: bittorrent.Started},
+		{Left: 1, Event: bittorrent.Stopped},
+	} {
+		_, err := h.HandleAnnounce(routeCtx("cde"), req, &bittorrent.AnnounceResponse{})
+		if req.Left > 0 && req.Event != bittorrent.Stopped {
+			require.Equal(t, ErrDownloadsDisabled, err)
+		} else {
+			require.Nil(t, err)
+		}
+	}
+}
+
+func TestSessions(t *testing.T) {
+	s := newSessions()
+	now := time.Now()
+	announce := func(peer string, event bittorrent.Event, uploaded, downloaded uint64) {
+		s.announce("alice", &bittorrent.AnnounceRequest{
+			Event:      event,
+			Uploaded:   uploaded,
+			Downloaded: downloaded,
+			Peer:       bittorrent.Peer{ID: bittorrent.PeerIDFromString(peer + "aaaaaaaaaaaaaaaaaaa")},
+		}, false, now)
+	}
+
+	// Started sessions are counted from zero, unknown sessions from their
+	// first announce.
+	announce("a", bittorrent.Started, 10, 20)
+	announce("b", bittorrent.None, 100, 100)
+	announce("a", bittorrent.None, 15, 20)
+	announce("b", bittorrent.Stopped, 150, 110)
+
+	// A client that restarted without a started event reset its totals.
+	announce("a", bittorrent.None, 1, 2)
+	require.Equal(t, []Stats{{User: "alice", Uploaded: 66, Downloaded: 32}}, s.flush(now.Add(-time.Hour)))
+	require.Nil(t, s.flush(now.Add(-time.Hour)))
+
+	// Stopped and expired sessions are forgotten.
+	require.Len(t, s.sessions, 1)
+	s.flush(now.Add(time.Second))
+	require.Len(t, s.sessions, 0)
+
+	// The downloaded data of freeleech torrents is not counted.
+	s.announce("alice", &bittorrent.AnnounceRequest{Event: bittorrent.Started, Uploaded: 5, Downloaded: 50}, true, now)
+	require.Equal(t, []Stats{{User: "alice", Uploaded: 5}}, s.flush(now.Add(-time.Hour)))
+}
+
+func TestFlushRestoresStats(t *testing.T) {
+	store := &mapStore{users: map[string]User{"abc": {ID: "alice"}}, err: errors.New("unreachable")}
+	h := newHook(Config{}.Validate(), store)
+	defer func() { h.Stop().Wait() }()
+
+	h.sessions.announce("alice", &bittorrent.AnnounceRequest{Event: bittorrent.Started, Uploaded: 1}, false, time.Now())
+	h.flush()
+	require.Len(t, store.recorded, 0)
+
+	store.err = nil
+	h.flush()
+	require.Equal(t, []Stats{{User: "alice", Uploaded: 1}}, store.recorded)
+}
@@ -0,0 +1,257 @@
+// Package postgres implements a passkey.UserStore backed by the user database
+// of a private tracker in PostgreSQL.
+//
+// Users are loaded into memory whenever the passkey middleware reloads the
+// store, so that requests don't wait for the database. Statistics are
+// written in one transaction every time the middleware flushes them.
+//
+// Chihaya doesn't link a PostgreSQL driver for database/sql. Binaries using
+// this store must import one, such as github.com/lib/pq, which registers the
+// driver "postgres".
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya/middleware/passkey"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+// Name is the name by which this user store is registered with the passkey
+// middleware.
+const Name = "postgres"
+
+func init() {
+	passkey.RegisterStoreDriver(Name, driver{})
+}
+
+type driver struct{}
+
+func (d driver) NewUserStore(icfg interface{}) (passkey.UserStore, error) {
+	// Marshal the config back into bytes.
+	bytes, err := yaml.Marshal(icfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unmarshal the bytes into the proper config type.
+	var cfg Config
+	err = yaml.UnmarshalStrict(bytes, &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(cfg)
+}
+
+// Config holds the configuration of a PostgreSQL user store.
+type Config struct {
+	// Driver is the name of the database/sql driver, DSN the data source
+	// name passed to it.
+	Driver string `yaml:"driver"`
+	DSN    string `yaml:"dsn"`
+
+	// UsersQuery selects the passkey, the ID and the flags disabled and
+	// downloads_disabled of all users, in this order.
+	UsersQuery string `yaml:"users_query"`
+
+	// StatsQuery is executed for the statistics of every user with the
+	// parameters ID, uploaded bytes and downloaded bytes.
+	StatsQuery string `yaml:"stats_query"`
+
+	// MaxOpenConns limits the connections to the database.
+	MaxOpenConns int `yaml:"max_open_conns"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"driver":       cfg.Driver,
+		"usersQuery":   cfg.UsersQuery,
+		"statsQuery":   cfg.StatsQuery,
+		"maxOpenConns": cfg.MaxOpenConns,
+	}
+}
+
+// Default config constants.
+const (
+	defaultDriver       = "postgres"
+	defaultUsersQuery   = "SELECT passkey, id, disabled, downloads_disabled FROM chihaya_users"
+	defaultStatsQuery   = "UPDATE chihaya_users SET uploaded = uploaded + $2, downloaded = downloaded + $3 WHERE id = $1"
+	defaultMaxOpenConns = 4
+)
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.Driver == "" {
+		validcfg.Driver = defaultDriver
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".Driver",
+			"provided": cfg.Driver,
+			"default":  validcfg.Driver,
+		})
+	}
+
+	if cfg.UsersQuery == "" {
+		validcfg.UsersQuery = defaultUsersQuery
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".UsersQuery",
+			"provided": cfg.UsersQuery,
+			"default":  validcfg.UsersQuery,
+		})
+	}
+
+	if cfg.StatsQuery == "" {
+		validcfg.StatsQuery = defaultStatsQuery
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".StatsQuery",
+			"provided": cfg.StatsQuery,
+			"default":  validcfg.StatsQuery,
+		})
+	}
+
+	if cfg.MaxOpenConns <= 0 {
+		validcfg.MaxOpenConns = defaultMaxOpenConns
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".MaxOpenConns",
+			"provided": cfg.MaxOpenConns,
+			"default":  validcfg.MaxOpenConns,
+		})
+	}
+
+	return validcfg
+}
+
+// Store is a passkey.UserStore backed by PostgreSQL.
+type Store struct {
+	cfg Config
+	db  *sql.DB
+
+	// users holds the current map[string]passkey.User from passkeys to
+	// users.
+	users atomic.Value
+}
+
+var (
+	_ passkey.UserStore = &Store{}
+	_ passkey.Reloader  = &Store{}
+	_ stop.Stopper      = &Store{}
+)
+
+// New connects to the database and loads the users.
+func New(provided Config) (*Store, error) {
+	if provided.DSN == "" {
+		return nil, errors.New("dsn must be set")
+	}
+	cfg := provided.Validate()
+
+	if !linked(cfg.Driver) {
+		return nil, fmt.Errorf("database driver %q is not linked into this binary", cfg.Driver)
+	}
+	db, err := sql.Open(cfg.Driver, cfg.DSN)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+
+	s := &Store{cfg: cfg, db: db}
+	if err := s.Reload(context.Background()); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to load users: %s", err)
+	}
+	return s, nil
+}
+
+// linked returns whether a database/sql driver is registered by name.
+func linked(name string) bool {
+	for _, driver := range sql.Drivers() {
+		if driver == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Reload implements passkey.Reloader by replacing the users with those
+// selected by the UsersQuery.
+func (s *Store) Reload(ctx context.Context) error {
+	rows, err := s.db.QueryContext(ctx, s.cfg.UsersQuery)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	users := make(map[string]passkey.User)
+	for rows.Next() {
+		var key string
+		var user passkey.User
+		if err := rows.Scan(&key, &user.ID, &user.Disabled, &user.DownloadsDisabled); err != nil {
+			return err
+		}
+		users[key] = user
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	s.users.Store(users)
+	log.Debug("loaded users", log.Fields{"store": Name, "users": len(users)})
+	return nil
+}
+
+// User implements passkey.UserStore.
+func (s *Store) User(ctx context.Context, key string) (passkey.User, bool, error) {
+	user, ok := s.users.Load().(map[string]passkey.User)[key]
+	return user, ok, nil
+}
+
+// RecordStats implements passkey.UserStore by executing the StatsQuery for
+// every user in one transaction, so that either all or none of the
+// statistics are recorded.
+func (s *Store) RecordStats(ctx context.Context, stats []passkey.Stats) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, s.cfg.StatsQuery)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, st := range stats {
+		if _, err := stmt.ExecContext(ctx, st.User, st.Uploaded, st.Downloaded); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Stop implements stop.Stopper by closing the connections to the database.
+func (s *Store) Stop() stop.Result {
+	c := make(stop.Channel)
+	go func() {
+		c.Done(s.db.Close())
+	}()
+	return c.Result()
+}
+
+// LogFields implements log.Fielder.
+func (s *Store) LogFields() log.Fields {
+	return s.cfg.LogFields()
+}
@@ -0,0 +1,141 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	sqldriver "database/sql/driver"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/middleware/passkey"
+)
+
+// fakeDB is a database/sql driver that answers every query with users and
+// records the arguments of committed statements.
+type fakeDB struct {
+	mu        sync.Mutex
+	users     [][]sqldriver.Value
+	committed [][]sqldriver.Value
+	pending   [][]sqldriver.Value
+	failExec  bool
+}
+
+func (db *fakeDB) Open(name string) (sqldriver.Conn, error) { return fakeConn{db}, nil }
+
+type fakeConn struct{ db *fakeDB }
+
+func (c fakeConn) Prepare(query string) (sqldriver.Stmt, error) { return fakeStmt(c), nil }
+func (c fakeConn) Close() error                                 { return nil }
+func (c fakeConn) Begin() (sqldriver.Tx, error)                 { return fakeTx(c), nil }
+
+type fakeTx struct{ db *fakeDB }
+
+func (tx fakeTx) Commit() error {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+	tx.db.committed = append(tx.db.committed, tx.db.pending...)
+	tx.db.pending = nil
+	return nil
+}
+
+func (tx fakeTx) Rollback() error {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+	tx.db.pending = nil
+	return nil
+}
+
+type fakeStmt struct{ db *fakeDB }
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+
+func (s fakeStmt) Exec(args []sqldriver.Value) (sqldriver.Result, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	if s.db.failExec && len(s.db.pending) > 0 {
+		return nil, errors.New("connection lost")
+	}
+	s.db.pending = append(s.db.pending, args)
+	return sqldriver.RowsAffected(1), nil
+}
+
+func (s fakeStmt) Query(args []sqldriver.Value) (sqldriver.Rows, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	return &fakeRows{rows: s.db.users}, nil
+}
+
+type fakeRows struct{ rows [][]sqldriver.Value }
+
+func (r *fakeRows) Columns() []string {
+	return []string{"passkey", "id", "disabled", "downloads_disabled"}
+}
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []sqldriver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+var db = &fakeDB{}
+
+func init() {
+	sql.Register("chihaya-fake", db)
+}
+
+func TestStore(t *testing.T) {
+	db.users = [][]sqldriver.Value{
+		{"abc", int64(1001), false, false},
+		{"def", int64(1002), true, false},
+	}
+
+	s, err := New(Config{Driver: "chihaya-fake", DSN: "test"})
+	require.Nil(t, err)
+	defer func() { s.Stop().Wait() }()
+
+	user, ok, err := s.User(context.Background(), "abc")
+	require.Nil(t, err)
+	require.True(t, ok)
+	require.Equal(t, passkey.User{ID: "1001"}, user)
+
+	user, ok, err = s.User(context.Background(), "def")
+	require.Nil(t, err)
+	require.True(t, ok)
+	require.True(t, user.Disabled)
+
+	_, ok, err = s.User(context.Background(), "ghi")
+	require.Nil(t, err)
+	require.False(t, ok)
+
+	// Reloading replaces the users.
+	db.users = [][]sqldriver.Value{{"ghi", "1003", false, true}}
+	require.Nil(t, s.Reload(context.Background()))
+	_, ok, _ = s.User(context.Background(), "abc")
+	require.False(t, ok)
+	user, ok, _ = s.User(context.Background(), "ghi")
+	require.True(t, ok)
+	require.Equal(t, passkey.User{ID: "1003", DownloadsDisabled: true}, user)
+
+	stats := []passkey.Stats{{User: "1001", Uploaded: 1, Downloaded: 2}, {User: "1002", Uploaded: 3}}
+	require.Nil(t, s.RecordStats(context.Background(), stats))
+	require.Equal(t, [][]sqldriver.Value{{"1001", int64(1), int64(2)}, {"1002", int64(3), int64(0)}}, db.committed)
+
+	// Statistics are recorded all or nothing.
+	db.committed, db.failExec = nil, true
+	require.NotNil(t, s.RecordStats(context.Background(), stats))
+	require.Nil(t, db.committed)
+}
+
+func TestUnlinkedDriver(t *testing.T) {
+	_, err := New(Config{Driver: "unlinked", DSN: "test"})
+	require.NotNil(t, err)
+}
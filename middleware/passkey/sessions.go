@@ -0,0 +1,131 @@
+package passkey
+
+import (
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// sessionKey identifies the session of a client of a user in a swarm.
+type sessionKey struct {
+	user     string
+	infoHash bittorrent.InfoHash
+	peerID   bittorrent.PeerID
+}
+
+// session holds the totals a client reported in its last announce.
+type session struct {
+	uploaded   uint64
+	downloaded uint64
+	seen       time.Time
+}
+
+// sessions turns the totals clients report into the data users transferred
+// between announces, and sums them up per user until they are flushed.
+type sessions struct {
+	mu       sync.Mutex
+	sessions map[sessionKey]session
+	stats    map[string]Stats
+}
+
+func newSessions() *sessions {
+	return &sessions{
+		sessions: make(map[sessionKey]session),
+		stats:    make(map[string]Stats),
+	}
+}
+
+// announce records an announce of a client of user.
+//
+// Clients report the data transferred since they started announcing, so the
+// difference to the previous announce is added to the stats of user. The
+// first announce of a session is only counted if it is a started event: the
+// totals of a client whose session is unknown, for example because the
+// tracker restarted, may have been counted already. The downloaded data of
+// freeleech torrents is not counted.
+func (s *sessions) announce(user string, req *bittorrent.AnnounceRequest, freeleech bool, now time.Time) {
+	key := sessionKey{user: user, infoHash: req.InfoHash, peerID: req.Peer.ID}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	last, known := s.sessions[key]
+	if req.Event == bittorrent.Stopped {
+		delete(s.sessions, key)
+	} else {
+		s.sessions[key] = session{uploaded: req.Uploaded, downloaded: req.Downloaded, seen: now}
+	}
+
+	var uploaded, downloaded uint64
+	switch {
+	case req.Event == bittorrent.Started:
+		uploaded, downloaded = req.Uploaded, req.Downloaded
+	case !known:
+		return
+	default:
+		uploaded = delta(last.uploaded, req.Uploaded)
+		downloaded = delta(last.downloaded, req.Downloaded)
+	}
+	if freeleech {
+		downloaded = 0
+	}
+	if uploaded == 0 && downloaded == 0 {
+		return
+	}
+
+	s.add(Stats{User: user, Uploaded: uploaded, Downloaded: downloaded})
+}
+
+// add adds st to the stats of its user. The caller must hold s.mu.
+func (s *sessions) add(st Stats) {
+	stats := s.stats[st.User]
+	stats.User = st.User
+	stats.Uploaded += st.Uploaded
+	stats.Downloaded += st.Downloaded
+	s.stats[st.User] = stats
+}
+
+// restore adds stats that could not be recorded back, so that they are
+// recorded with the next flush.
+func (s *sessions) restore(stats []Stats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, st := range stats {
+		s.add(st)
+	}
+}
+
+// delta returns the data transferred between two reported totals. Totals
+// that decreased were reset by a client that restarted without a started
+// event, so they are counted as a whole.
+func delta(last, current uint64) uint64 {
+	if current < last {
+		return current
+	}
+	return current - last
+}
+
+// flush returns the stats summed up since the previous flush and forgets
+// sessions that were not seen since expiry.
+func (s *sessions) flush(expiry time.Time) []Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, session := range s.sessions {
+		if session.seen.Before(expiry) {
+			delete(s.sessions, key)
+		}
+	}
+
+	if len(s.stats) == 0 {
+		return nil
+	}
+	stats := make([]Stats, 0, len(s.stats))
+	for _, st := range s.stats {
+		stats = append(stats, st)
+	}
+	s.stats = make(map[string]Stats)
+	return stats
+}
@@ -0,0 +1,261 @@
+package passkey
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chihaya/chihaya/middleware/pkg/listsource"
+)
+
+// User is a user of a private tracker.
+type User struct {
+	ID string
+
+	// Disabled users are rejected.
+	Disabled bool
+
+	// DownloadsDisabled rejects the announces of incomplete torrents of
+	// the user, who may still seed.
+	DownloadsDisabled bool
+}
+
+// Stats are the data a user transferred, as reported by the user's clients.
+type Stats struct {
+	User       string
+	Uploaded   uint64
+	Downloaded uint64
+}
+
+// UserStore is the source of the users of a private tracker and the
+// destination of their statistics.
+type UserStore interface {
+	// User returns the user a passkey belongs to. ok is false if the
+	// passkey is unknown.
+	//
+	// It is called for every request, so stores backed by remote databases
+	// should answer from memory.
+	User(ctx context.Context, passkey string) (user User, ok bool, err error)
+
+	// RecordStats records the data users transferred since the previous
+	// call, at most one Stats for every user.
+	RecordStats(ctx context.Context, stats []Stats) error
+}
+
+// Reloader is implemented by UserStores that keep users in memory, which
+// the middleware reloads every ReloadInterval.
+type Reloader interface {
+	Reload(ctx context.Context) error
+}
+
+// StoreDriver is the interface used to initialize a new UserStore with
+// provided configuration.
+type StoreDriver interface {
+	NewUserStore(cfg interface{}) (UserStore, error)
+}
+
+// ErrStoreDriverDoesNotExist is the error returned by NewUserStore when a
+// user store driver with that name does not exist.
+var ErrStoreDriverDoesNotExist = errors.New("user store driver with that name does not exist")
+
+var (
+	storeDriversM sync.RWMutex
+	storeDrivers  = make(map[string]StoreDriver)
+)
+
+// RegisterStoreDriver makes a StoreDriver available by the provided name.
+//
+// If called twice with the same name, the name is blank, or if the provided
+// StoreDriver is nil, this function panics.
+func RegisterStoreDriver(name string, d StoreDriver) {
+	if name == "" {
+		panic("passkey: could not register a StoreDriver with an empty name")
+	}
+	if d == nil {
+		panic("passkey: could not register a nil StoreDriver")
+	}
+
+	storeDriversM.Lock()
+	defer storeDriversM.Unlock()
+
+	if _, dup := storeDrivers[name]; dup {
+		panic("passkey: RegisterStoreDriver called twice for " + name)
+	}
+
+	storeDrivers[name] = d
+}
+
+// NewUserStore attempts to initialize a new UserStore instance from the list
+// of registered StoreDrivers.
+//
+// If a driver does not exist, returns ErrStoreDriverDoesNotExist.
+func NewUserStore(name string, cfg interface{}) (UserStore, error) {
+	storeDriversM.RLock()
+	defer storeDriversM.RUnlock()
+
+	d, ok := storeDrivers[name]
+	if !ok {
+		return nil, ErrStoreDriverDoesNotExist
+	}
+
+	return d.NewUserStore(cfg)
+}
+
+// listStore is a UserStore that reads passkeys from a file or HTTP endpoint
+// and writes statistics to a file or HTTP endpoint.
+type listStore struct {
+	source      string
+	destination string
+
+	// users holds the current map[string]User from passkeys to users.
+	users atomic.Value
+}
+
+var (
+	_ UserStore = &listStore{}
+	_ Reloader  = &listStore{}
+)
+
+// statsClient is used to post statistics to HTTP endpoints, so that an
+// unresponsive endpoint can't stall flushing forever.
+var statsClient = &http.Client{Timeout: 30 * time.Second}
+
+// newListStore returns a listStore that has loaded source.
+func newListStore(source, destination string) (*listStore, error) {
+	s := &listStore{source: source, destination: destination}
+	if err := s.Reload(context.Background()); err != nil {
+		return nil, fmt.Errorf("failed to load %s: %s", source, err)
+	}
+	return s, nil
+}
+
+// Reload replaces the current users with those of the source.
+func (s *listStore) Reload(ctx context.Context) error {
+	rc, err := listsource.Open(s.source)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	users, err := parseUsers(rc)
+	if err != nil {
+		return err
+	}
+	s.users.Store(users)
+	return nil
+}
+
+func (s *listStore) User(ctx context.Context, passkey string) (User, bool, error) {
+	user, ok := s.users.Load().(map[string]User)[passkey]
+	return user, ok, nil
+}
+
+func (s *listStore) RecordStats(ctx context.Context, stats []Stats) error {
+	if s.destination == "" {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	writeStats(&buf, time.Now(), stats)
+
+	if !listsource.IsURL(s.destination) {
+		f, err := os.OpenFile(s.destination, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		if _, err := buf.WriteTo(f); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.destination, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/tab-separated-values")
+	resp, err := statsClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %q", resp.Status)
+	}
+	return nil
+}
+
+// parseUsers parses a list of passkeys, one per line, each optionally
+// followed by whitespace and the user it belongs to and then by a
+// comma-separated list of the flags "disabled" and "downloads_disabled".
+// Passkeys without a user belong to a user named like the passkey.
+// Empty lines and lines starting with "#" are ignored.
+func parseUsers(r io.Reader) (map[string]User, error) {
+	users := make(map[string]User)
+
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		switch {
+		case len(fields) > 3:
+			return nil, fmt.Errorf("line %d: too many fields", line)
+		case len(fields[0]) > MaxPasskeyLength:
+			return nil, fmt.Errorf("line %d: passkey is longer than %d bytes", line, MaxPasskeyLength)
+		}
+
+		user := User{ID: fields[0]}
+		if len(fields) > 1 {
+			user.ID = fields[1]
+		}
+		if len(fields) > 2 {
+			for _, flag := range strings.Split(fields[2], ",") {
+				switch flag {
+				case "disabled":
+					user.Disabled = true
+				case "downloads_disabled":
+					user.DownloadsDisabled = true
+				default:
+					return nil, fmt.Errorf("line %d: unknown flag %q", line, flag)
+				}
+			}
+		}
+		users[fields[0]] = user
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// writeStats writes one line for every Stats: the Unix time of now, the
+// user, the uploaded and the downloaded bytes, separated by tabs.
+func writeStats(buf *bytes.Buffer, now time.Time, stats []Stats) {
+	unix := strconv.FormatInt(now.Unix(), 10)
+	for _, s := range stats {
+		buf.WriteString(unix)
+		buf.WriteByte('\t')
+		buf.WriteString(s.User)
+		buf.WriteByte('\t')
+		buf.WriteString(strconv.FormatUint(s.Uploaded, 10))
+		buf.WriteByte('\t')
+		buf.WriteString(strconv.FormatUint(s.Downloaded, 10))
+		buf.WriteByte('\n')
+	}
+}
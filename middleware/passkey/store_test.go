@@ -0,0 +1,64 @@
+package passkey
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseUsers(t *testing.T) {
+	users, err := parseUsers(strings.NewReader("# passkeys\nabc alice\n\n  def  \nghi bob disabled,downloads_disabled\n"))
+	require.Nil(t, err)
+	require.Equal(t, map[string]User{
+		"abc": {ID: "alice"},
+		"def": {ID: "def"},
+		"ghi": {ID: "bob", Disabled: true, DownloadsDisabled: true},
+	}, users)
+
+	_, err = parseUsers(strings.NewReader("abc alice bob\n"))
+	require.NotNil(t, err)
+
+	_, err = parseUsers(strings.NewReader("abc alice disabled extra\n"))
+	require.NotNil(t, err)
+
+	_, err = parseUsers(strings.NewReader(strings.Repeat("a", MaxPasskeyLength+1)))
+	require.NotNil(t, err)
+}
+
+func TestWriteStats(t *testing.T) {
+	var buf bytes.Buffer
+	writeStats(&buf, time.Unix(1500000000, 0), []Stats{{User: "alice", Uploaded: 1, Downloaded: 2}})
+	require.Equal(t, "1500000000\talice\t1\t2\n", buf.String())
+}
+
+func TestListStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "passkey")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "passkeys")
+	destination := filepath.Join(dir, "stats")
+	require.Nil(t, ioutil.WriteFile(source, []byte("abc alice\n"), 0644))
+
+	s, err := newListStore(source, destination)
+	require.Nil(t, err)
+	user, ok, err := s.User(context.Background(), "abc")
+	require.Nil(t, err)
+	require.True(t, ok)
+	require.Equal(t, User{ID: "alice"}, user)
+
+	// Statistics are appended.
+	for i := 0; i < 2; i++ {
+		require.Nil(t, s.RecordStats(context.Background(), []Stats{{User: "alice", Uploaded: 1}}))
+	}
+	written, err := ioutil.ReadFile(destination)
+	require.Nil(t, err)
+	require.Equal(t, 2, strings.Count(string(written), "\talice\t1\t0\n"))
+}
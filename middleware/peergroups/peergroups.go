@@ -0,0 +1,186 @@
+// Package peergroups implements a Hook that partitions swarms by a group
+// clients report when announcing, so that peers only receive peers of their
+// own group, for example in classrooms, labs or experiments that share a
+// torrent.
+//
+// The swarm of a group is stored under an infohash derived from the
+// infohash of the torrent and the group, so that it is kept apart from the
+// swarm of the torrent by the storage.
+package peergroups
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// Name is the name by which this middleware is registered with Chihaya.
+const Name = "peer groups"
+
+func init() {
+	middleware.RegisterDriver(Name, driver{})
+}
+
+var _ middleware.Driver = driver{}
+
+type driver struct{}
+
+func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
+	var cfg Config
+	err := yaml.UnmarshalStrict(optionBytes, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid options for middleware %s: %s", Name, err)
+	}
+
+	return NewHook(cfg)
+}
+
+// MaxGroupLength is the maximum length of a group.
+const MaxGroupLength = 64
+
+// ErrInvalidGroup is returned for announces with a group that is longer
+// than MaxGroupLength.
+var ErrInvalidGroup = bittorrent.ClientError("invalid group")
+
+// ErrUnknownGroup is returned for announces with a group that is not one of
+// the configured groups.
+var ErrUnknownGroup = bittorrent.ClientError("unknown group")
+
+// ErrGroupRequired is returned for announces without a group, if a group is
+// required.
+var ErrGroupRequired = bittorrent.ClientError("group required")
+
+// Config represents the configuration for the peergroups middleware.
+type Config struct {
+	// GroupParam is the announce parameter in which clients report their
+	// group.
+	GroupParam string `yaml:"group_param"`
+
+	// Groups are the groups clients may report. If empty, any group is
+	// accepted.
+	Groups []string `yaml:"groups"`
+
+	// Required rejects announces without a group, so that no peer joins
+	// the swarm of the torrent itself.
+	Required bool `yaml:"required"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"groupParam": cfg.GroupParam,
+		"groups":     cfg.Groups,
+		"required":   cfg.Required,
+	}
+}
+
+// Default config constants.
+const defaultGroupParam = "group"
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.GroupParam == "" {
+		validcfg.GroupParam = defaultGroupParam
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".GroupParam",
+			"provided": cfg.GroupParam,
+			"default":  validcfg.GroupParam,
+		})
+	}
+
+	return validcfg
+}
+
+func checkConfig(cfg Config) error {
+	for _, group := range cfg.Groups {
+		if group == "" || len(group) > MaxGroupLength {
+			return fmt.Errorf("invalid group %q", group)
+		}
+	}
+	return nil
+}
+
+type hook struct {
+	cfg Config
+
+	// groups holds the configured groups. It is nil if any group is
+	// accepted.
+	groups map[string]struct{}
+}
+
+// NewHook creates a middleware that partitions swarms by the group reported
+// by clients.
+func NewHook(cfg Config) (middleware.Hook, error) {
+	cfg = cfg.Validate()
+	if err := checkConfig(cfg); err != nil {
+		return nil, err
+	}
+
+	h := &hook{cfg: cfg}
+	if len(cfg.Groups) > 0 {
+		h.groups = make(map[string]struct{}, len(cfg.Groups))
+		for _, group := range cfg.Groups {
+			h.groups[group] = struct{}{}
+		}
+	}
+
+	return h, nil
+}
+
+// GroupInfoHash returns the infohash the swarm of the given group of the
+// torrent with the infohash ih is stored under.
+func GroupInfoHash(ih bittorrent.InfoHash, group string) bittorrent.InfoHash {
+	h := sha1.New()
+	h.Write(ih[:])
+	h.Write([]byte(group))
+	return bittorrent.InfoHashFromBytes(h.Sum(nil))
+}
+
+// HandleAnnounce replaces the infohash of req by the infohash of the swarm of
+// the group of the client, if it reported one.
+//
+// This must be configured as a PreHook, after any middleware that checks the
+// infohash, such as torrent approval, since the infohash is replaced for all
+// middleware that runs afterwards and for the storage.
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	var group string
+	if req.Params != nil {
+		group, _ = req.Params.String(h.cfg.GroupParam)
+	}
+
+	switch {
+	case group == "":
+		if h.cfg.Required {
+			return ctx, ErrGroupRequired
+		}
+		return ctx, nil
+	case len(group) > MaxGroupLength:
+		return ctx, ErrInvalidGroup
+	}
+	if h.groups != nil {
+		if _, ok := h.groups[group]; !ok {
+			return ctx, ErrUnknownGroup
+		}
+	}
+
+	req.InfoHash = GroupInfoHash(req.InfoHash, group)
+	bittorrent.RecordDecision(ctx, Name, "grouped")
+
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes report the swarm of the torrent itself.
+	return ctx, nil
+}
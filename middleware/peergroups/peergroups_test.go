@@ -0,0 +1,74 @@
+package peergroups
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+var ih = bittorrent.InfoHashFromString("aaaaaaaaaaaaaaaaaaaa")
+
+func announce(params string) *bittorrent.AnnounceRequest {
+	qp, err := bittorrent.ParseURLData("/announce?" + params)
+	if err != nil {
+		panic(err)
+	}
+	return &bittorrent.AnnounceRequest{InfoHash: ih, Params: qp}
+}
+
+func TestNewHook(t *testing.T) {
+	_, err := NewHook(Config{Groups: []string{"lab-1", ""}})
+	require.NotNil(t, err)
+	_, err = NewHook(Config{Groups: []string{strings.Repeat("a", MaxGroupLength+1)}})
+	require.NotNil(t, err)
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	h, err := NewHook(Config{})
+	require.Nil(t, err)
+
+	var table = []struct {
+		params   string
+		expected bittorrent.InfoHash
+	}{
+		{"", ih},
+		{"group=", ih},
+		{"group=lab-1", GroupInfoHash(ih, "lab-1")},
+		{"group=lab-2", GroupInfoHash(ih, "lab-2")},
+	}
+	for _, tt := range table {
+		t.Run(tt.params, func(t *testing.T) {
+			req := announce(tt.params)
+			_, err := h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+			require.Nil(t, err)
+			require.Equal(t, tt.expected, req.InfoHash)
+		})
+	}
+
+	// Groups of different torrents and different groups don't share swarms.
+	require.NotEqual(t, GroupInfoHash(ih, "lab-1"), GroupInfoHash(ih, "lab-2"))
+	require.NotEqual(t, GroupInfoHash(ih, "lab-1"), GroupInfoHash(bittorrent.InfoHashFromString("bbbbbbbbbbbbbbbbbbbb"), "lab-1"))
+
+	_, err = h.HandleAnnounce(context.Background(), announce("group="+strings.Repeat("a", MaxGroupLength+1)), &bittorrent.AnnounceResponse{})
+	require.Equal(t, ErrInvalidGroup, err)
+}
+
+func TestHandleAnnounceRestricted(t *testing.T) {
+	h, err := NewHook(Config{GroupParam: "team", Groups: []string{"red", "blue"}, Required: true})
+	require.Nil(t, err)
+
+	req := announce("team=red")
+	_, err = h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	require.Equal(t, GroupInfoHash(ih, "red"), req.InfoHash)
+
+	_, err = h.HandleAnnounce(context.Background(), announce("team=green"), &bittorrent.AnnounceResponse{})
+	require.Equal(t, ErrUnknownGroup, err)
+
+	_, err = h.HandleAnnounce(context.Background(), announce("group=red"), &bittorrent.AnnounceResponse{})
+	require.Equal(t, ErrGroupRequired, err)
+}
@@ -0,0 +1,332 @@
+// Package peermetadata implements a Hook that keeps track of whether peers
+// report to be connectable and how many upload slots they have, and returns
+// the peers most likely to accept connections first to new leechers.
+//
+// Clients behind NAT without a forwarded port can only connect to others,
+// so a new leecher that only receives such peers can't download anything
+// until a connectable peer connects to it.
+package peermetadata
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/clock"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+// Name is the name by which this middleware is registered with Chihaya.
+const Name = "peer metadata"
+
+func init() {
+	middleware.RegisterDriver(Name, driver{})
+}
+
+var _ middleware.Driver = driver{}
+
+type driver struct{}
+
+func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
+	var cfg Config
+	err := yaml.UnmarshalStrict(optionBytes, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid options for middleware %s: %s", Name, err)
+	}
+
+	return NewHook(cfg)
+}
+
+// ErrInvalidPeerLifetime is returned for a config with an invalid
+// PeerLifetime.
+var ErrInvalidPeerLifetime = errors.New("invalid peer_lifetime")
+
+// Config represents the configuration for the peermetadata middleware.
+type Config struct {
+	// ConnectableParam is the announce parameter in which clients report
+	// whether they accept incoming connections, as "1" or "0".
+	ConnectableParam string `yaml:"connectable_param"`
+
+	// UploadSlotsParam is the announce parameter in which clients report
+	// the number of their free upload slots.
+	UploadSlotsParam string `yaml:"upload_slots_param"`
+
+	// PeerLifetime is the amount of time after which the metadata of a peer
+	// that did not announce again is forgotten.
+	// This should be the same as the peer lifetime of the storage.
+	PeerLifetime time.Duration `yaml:"peer_lifetime"`
+
+	// Clock is used to timestamp peers and to schedule garbage collection.
+	// It defaults to clock.Cached and is replaced in tests.
+	Clock clock.Clock `yaml:"-"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"connectableParam": cfg.ConnectableParam,
+		"uploadSlotsParam": cfg.UploadSlotsParam,
+		"peerLifetime":     cfg.PeerLifetime,
+	}
+}
+
+// Default config constants.
+const (
+	defaultConnectableParam = "connectable"
+	defaultUploadSlotsParam = "upload_slots"
+)
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.ConnectableParam == "" {
+		validcfg.ConnectableParam = defaultConnectableParam
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".ConnectableParam",
+			"provided": cfg.ConnectableParam,
+			"default":  validcfg.ConnectableParam,
+		})
+	}
+
+	if cfg.UploadSlotsParam == "" {
+		validcfg.UploadSlotsParam = defaultUploadSlotsParam
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".UploadSlotsParam",
+			"provided": cfg.UploadSlotsParam,
+			"default":  validcfg.UploadSlotsParam,
+		})
+	}
+
+	if cfg.Clock == nil {
+		validcfg.Clock = clock.Cached
+	}
+
+	return validcfg
+}
+
+// Connectability as reported by a peer.
+const (
+	// behindNAT is reported by peers that don't accept incoming
+	// connections.
+	behindNAT = -1
+
+	// unknown is the connectability of peers that didn't report it.
+	unknown = 0
+
+	// connectable is reported by peers that accept incoming connections.
+	connectable = 1
+)
+
+// metadata is what a peer reported about itself.
+type metadata struct {
+	connectability int
+	uploadSlots    int
+	mtime          int64
+}
+
+// swarmPeer identifies the endpoint of a peer in a swarm.
+type swarmPeer struct {
+	infoHash bittorrent.InfoHash
+	endpoint string
+}
+
+func newSwarmPeer(ih bittorrent.InfoHash, p bittorrent.Peer) swarmPeer {
+	var port [2]byte
+	binary.BigEndian.PutUint16(port[:], p.Port)
+	return swarmPeer{ih, string(p.IP.IP) + string(port[:])}
+}
+
+type hook struct {
+	cfg Config
+
+	// peers holds the metadata of every peer that reported any.
+	peers map[swarmPeer]metadata
+	sync.RWMutex
+
+	closing chan struct{}
+}
+
+// NewHook creates a middleware that records the metadata reported by peers
+// and prefers connectable peers for new leechers.
+func NewHook(provided Config) (middleware.Hook, error) {
+	if provided.PeerLifetime <= 0 {
+		return nil, ErrInvalidPeerLifetime
+	}
+	cfg := provided.Validate()
+
+	h := &hook{
+		cfg:     cfg,
+		peers:   make(map[swarmPeer]metadata),
+		closing: make(chan struct{}),
+	}
+
+	go func() {
+		for {
+			select {
+			case <-h.closing:
+				return
+			case <-cfg.Clock.After(cfg.PeerLifetime / 2):
+				h.collectGarbage(cfg.Clock.Now().Add(-cfg.PeerLifetime))
+			}
+		}
+	}()
+
+	return h, nil
+}
+
+// parseMetadata returns the metadata reported in the parameters of req and
+// whether there was any. Invalid values are ignored.
+func (h *hook) parseMetadata(req *bittorrent.AnnounceRequest) (md metadata, ok bool) {
+	if req.Params == nil {
+		return md, false
+	}
+
+	if s, found := req.Params.String(h.cfg.ConnectableParam); found {
+		switch s {
+		case "1":
+			md.connectability, ok = connectable, true
+		case "0":
+			md.connectability, ok = behindNAT, true
+		}
+	}
+
+	if s, found := req.Params.String(h.cfg.UploadSlotsParam); found {
+		if slots, err := strconv.Atoi(s); err == nil && slots >= 0 {
+			md.uploadSlots, ok = slots, true
+		}
+	}
+
+	return md, ok
+}
+
+// HandleAnnounce records the metadata reported by the announcing peer.
+//
+// If it is a new leecher, the peers of resp are reordered so that peers
+// reporting to be connectable come first, followed by peers that didn't
+// report anything and peers behind NAT. Within these groups, peers with
+// more free upload slots come first. Otherwise, the order chosen by the peer
+// shuffling strategy is kept.
+//
+// This must be configured as a ResponseHook, so that resp contains the
+// peers to reorder.
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	if req.Event == bittorrent.Started && req.Left > 0 {
+		h.prefer(req.InfoHash, resp.IPv4Peers)
+		h.prefer(req.InfoHash, resp.IPv6Peers)
+		bittorrent.RecordDecision(ctx, Name, "connectable peers first")
+	}
+
+	key := newSwarmPeer(req.InfoHash, req.Peer)
+	md, ok := h.parseMetadata(req)
+
+	if req.Event == bittorrent.Stopped || !ok {
+		// Peers that stopped reporting metadata are no longer preferred.
+		// Most peers never report any, so the write lock is only taken for
+		// known peers.
+		h.RLock()
+		_, known := h.peers[key]
+		h.RUnlock()
+		if known {
+			h.Lock()
+			delete(h.peers, key)
+			h.Unlock()
+		}
+		return ctx, nil
+	}
+
+	md.mtime = h.cfg.Clock.Now().UnixNano()
+	h.Lock()
+	h.peers[key] = md
+	h.Unlock()
+
+	return ctx, nil
+}
+
+// prefer sorts peers of the swarm of ih by their reported metadata.
+func (h *hook) prefer(ih bittorrent.InfoHash, peers []bittorrent.Peer) {
+	if len(peers) < 2 {
+		return
+	}
+
+	byPref := byPreference{peers: peers, mds: make([]metadata, len(peers))}
+	var reported bool
+	h.RLock()
+	for i, p := range peers {
+		md, ok := h.peers[newSwarmPeer(ih, p)]
+		byPref.mds[i] = md
+		reported = reported || ok
+	}
+	h.RUnlock()
+
+	if reported {
+		sort.Stable(byPref)
+	}
+}
+
+// byPreference sorts peers by the metadata at the same index.
+type byPreference struct {
+	peers []bittorrent.Peer
+	mds   []metadata
+}
+
+func (s byPreference) Len() int { return len(s.peers) }
+
+func (s byPreference) Less(i, j int) bool {
+	if s.mds[i].connectability != s.mds[j].connectability {
+		return s.mds[i].connectability > s.mds[j].connectability
+	}
+	return s.mds[i].uploadSlots > s.mds[j].uploadSlots
+}
+
+func (s byPreference) Swap(i, j int) {
+	s.peers[i], s.peers[j] = s.peers[j], s.peers[i]
+	s.mds[i], s.mds[j] = s.mds[j], s.mds[i]
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't report metadata.
+	return ctx, nil
+}
+
+// collectGarbage removes the metadata of all peers that did not announce
+// since cutoff.
+func (h *hook) collectGarbage(cutoff time.Time) {
+	cutoffUnix := cutoff.UnixNano()
+
+	h.Lock()
+	defer h.Unlock()
+
+	for key, md := range h.peers {
+		if md.mtime <= cutoffUnix {
+			delete(h.peers, key)
+		}
+	}
+}
+
+func (h *hook) Stop() stop.Result {
+	select {
+	case <-h.closing:
+		return stop.AlreadyStopped
+	default:
+	}
+	c := make(stop.Channel)
+	go func() {
+		close(h.closing)
+		c.Done()
+	}()
+	return c.Result()
+}
@@ -0,0 +1,72 @@
+package peermetadata
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/clock"
+)
+
+func peer(port uint16) bittorrent.Peer {
+	return bittorrent.Peer{
+		ID:   bittorrent.PeerID{byte(port)},
+		IP:   bittorrent.IP{IP: net.ParseIP("10.0.0.1").To4(), AddressFamily: bittorrent.IPv4},
+		Port: port,
+	}
+}
+
+func announce(t *testing.T, h *hook, p bittorrent.Peer, event bittorrent.Event, query string, peers ...bittorrent.Peer) []bittorrent.Peer {
+	params, err := bittorrent.ParseURLData("/announce?" + query)
+	require.Nil(t, err)
+
+	req := &bittorrent.AnnounceRequest{Event: event, Left: 1, Peer: p, Params: params}
+	resp := &bittorrent.AnnounceResponse{IPv4Peers: peers}
+	_, err = h.HandleAnnounce(context.Background(), req, resp)
+	require.Nil(t, err)
+	return resp.IPv4Peers
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	c := clock.NewMock(time.Unix(1e9, 0))
+	hk, err := NewHook(Config{PeerLifetime: time.Minute, Clock: c})
+	require.Nil(t, err)
+	h := hk.(*hook)
+	defer h.Stop()
+
+	announce(t, h, peer(1), bittorrent.Started, "")
+	announce(t, h, peer(2), bittorrent.Started, "connectable=0")
+	announce(t, h, peer(3), bittorrent.Started, "connectable=1&upload_slots=2")
+	announce(t, h, peer(4), bittorrent.Started, "connectable=1&upload_slots=5")
+	announce(t, h, peer(5), bittorrent.Started, "connectable=yes")
+
+	// New leechers receive connectable peers with the most upload slots
+	// first, peers behind NAT last.
+	peers := announce(t, h, peer(6), bittorrent.Started, "", peer(1), peer(2), peer(3), peer(4), peer(5))
+	require.Equal(t, []bittorrent.Peer{peer(4), peer(3), peer(1), peer(5), peer(2)}, peers)
+
+	// Other announces keep the order.
+	peers = announce(t, h, peer(6), bittorrent.None, "", peer(1), peer(2), peer(3))
+	require.Equal(t, []bittorrent.Peer{peer(1), peer(2), peer(3)}, peers)
+
+	// Stopped peers and peers that no longer report metadata are forgotten.
+	announce(t, h, peer(4), bittorrent.Stopped, "connectable=1")
+	announce(t, h, peer(3), bittorrent.None, "")
+	peers = announce(t, h, peer(6), bittorrent.Started, "", peer(2), peer(3), peer(4))
+	require.Equal(t, []bittorrent.Peer{peer(3), peer(4), peer(2)}, peers)
+
+	// Peers that did not announce for their lifetime are forgotten.
+	announce(t, h, peer(4), bittorrent.None, "connectable=1")
+	c.BlockUntil(1)
+	c.Add(time.Minute)
+	c.BlockUntil(1)
+	c.Add(30 * time.Second)
+	c.BlockUntil(1)
+	peers = announce(t, h, peer(6), bittorrent.Started, "", peer(2), peer(4))
+	require.Equal(t, []bittorrent.Peer{peer(2), peer(4)}, peers)
+	require.Len(t, h.peers, 0)
+}
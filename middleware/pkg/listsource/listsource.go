@@ -0,0 +1,43 @@
+// Package listsource implements reading lists used by middleware, such as
+// whitelists and blocklists, from files or HTTP endpoints.
+package listsource
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// client is used to fetch lists from HTTP endpoints, so that an unresponsive
+// endpoint can't stall reloading forever.
+var client = &http.Client{Timeout: 30 * time.Second}
+
+// IsURL returns whether a source is an HTTP endpoint rather than a file.
+func IsURL(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// Open opens a source, which is either the path to a file or the URL of an
+// HTTP endpoint.
+//
+// The caller must close the returned ReadCloser.
+func Open(source string) (io.ReadCloser, error) {
+	if !IsURL(source) {
+		return os.Open(source)
+	}
+
+	resp, err := client.Get(source)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %q", resp.Status)
+	}
+
+	return resp.Body, nil
+}
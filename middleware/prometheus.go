@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+func init() {
+	prometheus.MustRegister(
+		promPeerlessAnnouncesTotal,
+		promTimeoutsTotal,
+		promRejectedSwarmCreationsTotal,
+		promInvalidEventsTotal,
+		promCounterRegressionsTotal,
+	)
+}
+
+var promPeerlessAnnouncesTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "chihaya_peerless_announces_total",
+		Help: "The number of announces asking for no peers, which are answered without selecting peers",
+	},
+	[]string{"address_family"},
+)
+
+// recordPeerlessAnnounce records an announce with a numwant of zero received
+// from a peer of the given address family.
+func recordPeerlessAnnounce(af bittorrent.AddressFamily) {
+	promPeerlessAnnouncesTotal.WithLabelValues(af.String()).Inc()
+}
+
+var promTimeoutsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "chihaya_request_timeouts_total",
+		Help: "The number of requests aborted because generating the response took longer than the configured timeout",
+	},
+	[]string{"action"},
+)
+
+// recordTimeout records a request of the given action that timed out.
+func recordTimeout(action string) {
+	promTimeoutsTotal.WithLabelValues(action).Inc()
+}
+
+var promRejectedSwarmCreationsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "chihaya_rejected_swarm_creations_total",
+		Help: "The number of announces rejected because they would have created a swarm",
+	},
+	[]string{"reason"},
+)
+
+// recordRejectedSwarmCreation records an announce of an unknown swarm that
+// was rejected for the given reason.
+func recordRejectedSwarmCreation(reason string) {
+	promRejectedSwarmCreationsTotal.WithLabelValues(reason).Inc()
+}
+
+var promInvalidEventsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "chihaya_invalid_events_total",
+		Help: "The number of announces whose event doesn't follow from the previous announces of the peer",
+	},
+	[]string{"event", "reason"},
+)
+
+// recordInvalidEvent records an announce with an event that was invalid for
+// the given reason.
+func recordInvalidEvent(event bittorrent.Event, reason string) {
+	promInvalidEventsTotal.WithLabelValues(event.String(), reason).Inc()
+}
+
+var promCounterRegressionsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "chihaya_counter_regressions_total",
+		Help: "The number of announces whose byte counter is lower than in the previous announce of the peer without a started event",
+	},
+	[]string{"counter"},
+)
+
+// recordCounterRegression records an announce whose given byte counter
+// regressed.
+func recordCounterRegression(counter string) {
+	promCounterRegressionsTotal.WithLabelValues(counter).Inc()
+}
@@ -0,0 +1,295 @@
+// Package ratioenforcement implements a Hook for private trackers that
+// restricts the announces of users whose share ratio fell below configured
+// thresholds.
+//
+// Users are identified by the passkey middleware, which must run before this
+// one. Their share ratios are read from a file or HTTP endpoint that is
+// reloaded on an interval, such as an export of the statistics the passkey
+// middleware recorded.
+package ratioenforcement
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/middleware/passkey"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/policy"
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+// Name is the name by which this middleware is registered with Chihaya.
+const Name = "ratio enforcement"
+
+func init() {
+	middleware.RegisterDriver(Name, driver{})
+}
+
+var _ middleware.Driver = driver{}
+
+type driver struct{}
+
+func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
+	var cfg Config
+	err := yaml.UnmarshalStrict(optionBytes, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid options for middleware %s: %s", Name, err)
+	}
+
+	return NewHook(cfg)
+}
+
+// ErrRatioTooLow is returned for announces of downloads that are denied
+// because the share ratio of the user is too low.
+var ErrRatioTooLow = bittorrent.ClientError("share ratio too low to download")
+
+// Threshold is a restriction of the users whose share ratio is below Ratio.
+type Threshold struct {
+	Ratio float64 `yaml:"ratio"`
+
+	// MaxNumWant caps the number of peers the users receive, if not zero.
+	MaxNumWant uint32 `yaml:"max_numwant"`
+
+	// DenyNewDownloads rejects announces that start downloading a torrent,
+	// DenyDownloads all announces of incomplete torrents. Seeding is
+	// always allowed, so that users can improve their ratio.
+	DenyNewDownloads bool `yaml:"deny_new_downloads"`
+	DenyDownloads    bool `yaml:"deny_downloads"`
+
+	// Warning is sent to the clients of the users, if not empty.
+	Warning string `yaml:"warning"`
+}
+
+// Config represents the configuration for the ratioenforcement middleware.
+type Config struct {
+	// Source is the path to a file or the URL of an HTTP endpoint listing
+	// the share ratios of users, which is reloaded every ReloadInterval.
+	Source         string        `yaml:"source"`
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+
+	// Users that joined less than GracePeriod ago or downloaded less than
+	// GraceDownloaded bytes are not restricted.
+	GracePeriod     time.Duration `yaml:"grace_period"`
+	GraceDownloaded uint64        `yaml:"grace_downloaded"`
+
+	// Thresholds are the restrictions of users with low ratios. All
+	// thresholds above the ratio of a user apply.
+	Thresholds []Threshold `yaml:"thresholds"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"source":          cfg.Source,
+		"reloadInterval":  cfg.ReloadInterval,
+		"gracePeriod":     cfg.GracePeriod,
+		"graceDownloaded": cfg.GraceDownloaded,
+		"thresholds":      len(cfg.Thresholds),
+	}
+}
+
+// Default config constants.
+const defaultReloadInterval = time.Minute
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.ReloadInterval <= 0 {
+		validcfg.ReloadInterval = defaultReloadInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".ReloadInterval",
+			"provided": cfg.ReloadInterval,
+			"default":  validcfg.ReloadInterval,
+		})
+	}
+
+	return validcfg
+}
+
+func checkConfig(cfg Config) error {
+	if cfg.Source == "" {
+		return errors.New("source must be set")
+	}
+	if cfg.GracePeriod < 0 {
+		return errors.New("grace_period must not be negative")
+	}
+	if len(cfg.Thresholds) == 0 {
+		return errors.New("at least one threshold must be set")
+	}
+	for i, t := range cfg.Thresholds {
+		if t.Ratio <= 0 {
+			return fmt.Errorf("threshold %d: ratio must be positive", i)
+		}
+	}
+	return nil
+}
+
+// restriction combines the thresholds that apply to a user.
+type restriction struct {
+	maxNumWant       uint32
+	denyNewDownloads bool
+	denyDownloads    bool
+	warning          string
+}
+
+type hook struct {
+	cfg Config
+
+	// restrictions holds the current map[string]restriction of the
+	// restricted users.
+	restrictions atomic.Value
+	closing      chan struct{}
+}
+
+// NewHook returns an instance of the ratio enforcement middleware.
+func NewHook(provided Config) (middleware.Hook, error) {
+	if err := checkConfig(provided); err != nil {
+		return nil, err
+	}
+	cfg := provided.Validate()
+
+	// The most severe threshold comes first.
+	cfg.Thresholds = append([]Threshold(nil), cfg.Thresholds...)
+	sort.Slice(cfg.Thresholds, func(i, j int) bool { return cfg.Thresholds[i].Ratio < cfg.Thresholds[j].Ratio })
+
+	h := &hook{
+		cfg:     cfg,
+		closing: make(chan struct{}),
+	}
+	if err := h.reload(time.Now()); err != nil {
+		return nil, fmt.Errorf("failed to load %s: %s", cfg.Source, err)
+	}
+
+	go func() {
+		for {
+			select {
+			case <-h.closing:
+				return
+			case <-time.After(cfg.ReloadInterval):
+				if err := h.reload(time.Now()); err != nil {
+					// The previous restrictions stay in effect.
+					log.Error("failed to reload share ratios", log.Fields{
+						"source": cfg.Source,
+						"error":  err,
+					})
+				}
+			}
+		}
+	}()
+
+	return h, nil
+}
+
+// reload replaces the current restrictions with those of the standings of
+// the source. Grace periods are evaluated at now.
+func (h *hook) reload(now time.Time) error {
+	standings, err := loadStandings(h.cfg.Source)
+	if err != nil {
+		return err
+	}
+
+	restrictions := make(map[string]restriction)
+	for user, st := range standings {
+		if r, ok := h.restrict(st, now); ok {
+			restrictions[user] = r
+		}
+	}
+	h.restrictions.Store(restrictions)
+
+	log.Debug("loaded share ratios", log.Fields{
+		"source":     h.cfg.Source,
+		"users":      len(standings),
+		"restricted": len(restrictions),
+	})
+	return nil
+}
+
+// restrict returns the restriction of a user with the standing st, if any.
+func (h *hook) restrict(st standing, now time.Time) (r restriction, restricted bool) {
+	if st.downloaded < h.cfg.GraceDownloaded || (!st.joined.IsZero() && now.Sub(st.joined) < h.cfg.GracePeriod) {
+		return r, false
+	}
+
+	ratio := st.ratio()
+	for _, t := range h.cfg.Thresholds {
+		if ratio >= t.Ratio {
+			continue
+		}
+		restricted = true
+
+		if t.MaxNumWant > 0 && (r.maxNumWant == 0 || t.MaxNumWant < r.maxNumWant) {
+			r.maxNumWant = t.MaxNumWant
+		}
+		r.denyNewDownloads = r.denyNewDownloads || t.DenyNewDownloads
+		r.denyDownloads = r.denyDownloads || t.DenyDownloads
+		if r.warning == "" {
+			r.warning = t.Warning
+		}
+	}
+	return r, restricted
+}
+
+func (h *hook) Stop() stop.Result {
+	select {
+	case <-h.closing:
+		return stop.AlreadyStopped
+	default:
+	}
+	c := make(stop.Channel)
+	go func() {
+		close(h.closing)
+		c.Done()
+	}()
+	return c.Result()
+}
+
+// HandleAnnounce applies the restriction of the user of the announce, as
+// identified by the passkey middleware. Users that are not listed by the
+// source are not restricted.
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	user, ok := ctx.Value(passkey.UserKey).(string)
+	if !ok {
+		return ctx, nil
+	}
+	r, restricted := h.restrictions.Load().(map[string]restriction)[user]
+	if !restricted {
+		bittorrent.RecordDecision(ctx, Name, "allowed")
+		return ctx, nil
+	}
+
+	// Leechers may always leave the swarm, and download freeleech torrents,
+	// which don't lower their ratio.
+	p, _ := policy.FromContext(ctx)
+	if req.Left > 0 && req.Event != bittorrent.Stopped && !p.Freeleech {
+		if r.denyDownloads || (r.denyNewDownloads && req.Event == bittorrent.Started) {
+			bittorrent.RecordDecision(ctx, Name, "denied")
+			return ctx, ErrRatioTooLow
+		}
+	}
+
+	if r.maxNumWant > 0 && req.NumWant > r.maxNumWant {
+		req.NumWant = r.maxNumWant
+	}
+	if r.warning != "" {
+		resp.WarningMessage = r.warning
+	}
+	bittorrent.RecordDecision(ctx, Name, "restricted")
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't transfer any data.
+	return ctx, nil
+}
@@ -0,0 +1,87 @@
+package ratioenforcement
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware/passkey"
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+func TestParseStandings(t *testing.T) {
+	standings, err := parseStandings(strings.NewReader("# user up down joined\nalice 10 20\nbob 1 2 1500000000\n"))
+	require.Nil(t, err)
+	require.Equal(t, map[string]standing{
+		"alice": {uploaded: 10, downloaded: 20},
+		"bob":   {uploaded: 1, downloaded: 2, joined: time.Unix(1500000000, 0)},
+	}, standings)
+
+	for _, invalid := range []string{"alice 10", "alice ten 20", "alice 10 20 yesterday"} {
+		_, err := parseStandings(strings.NewReader(invalid))
+		require.NotNil(t, err, invalid)
+	}
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	now := time.Now()
+	f, err := ioutil.TempFile("", "standings")
+	require.Nil(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(strings.Join([]string{
+		"good 100 100",
+		"poor 40 100",
+		"bad 10 100",
+		"fresh 0 100 " + strconv.FormatInt(now.Add(-time.Hour).Unix(), 10),
+		"light 0 5",
+	}, "\n"))
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+
+	h, err := NewHook(Config{
+		Source:          f.Name(),
+		GracePeriod:     24 * time.Hour,
+		GraceDownloaded: 10,
+		Thresholds: []Threshold{
+			{Ratio: 0.5, MaxNumWant: 10, Warning: "ratio below 0.5"},
+			{Ratio: 0.2, DenyNewDownloads: true, Warning: "ratio below 0.2"},
+		},
+	})
+	require.Nil(t, err)
+	defer func() { h.(stop.Stopper).Stop().Wait() }()
+
+	var table = []struct {
+		user    string
+		event   bittorrent.Event
+		left    uint64
+		err     error
+		numWant uint32
+		warning string
+	}{
+		{"good", bittorrent.Started, 1, nil, 50, ""},
+		{"poor", bittorrent.Started, 1, nil, 10, "ratio below 0.5"},
+		{"bad", bittorrent.None, 1, nil, 10, "ratio below 0.2"},
+		{"bad", bittorrent.Started, 1, ErrRatioTooLow, 50, ""},
+		{"bad", bittorrent.Started, 0, nil, 10, "ratio below 0.2"},
+		{"fresh", bittorrent.Started, 1, nil, 50, ""},
+		{"light", bittorrent.Started, 1, nil, 50, ""},
+		{"unlisted", bittorrent.Started, 1, nil, 50, ""},
+	}
+
+	for _, tt := range table {
+		ctx := context.WithValue(context.Background(), passkey.UserKey, tt.user)
+		req := &bittorrent.AnnounceRequest{Event: tt.event, Left: tt.left, NumWant: 50}
+		resp := &bittorrent.AnnounceResponse{}
+		_, err := h.HandleAnnounce(ctx, req, resp)
+		require.Equal(t, tt.err, err, tt.user)
+		require.Equal(t, tt.numWant, req.NumWant, tt.user)
+		require.Equal(t, tt.warning, resp.WarningMessage, tt.user)
+	}
+}
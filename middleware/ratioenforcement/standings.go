@@ -0,0 +1,85 @@
+package ratioenforcement
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chihaya/chihaya/middleware/pkg/listsource"
+)
+
+// standing is the share ratio of a user, as recorded by the site.
+type standing struct {
+	uploaded   uint64
+	downloaded uint64
+
+	// joined is when the user joined, or the zero Time if unknown.
+	joined time.Time
+}
+
+// ratio returns the share ratio of s. Users that downloaded nothing have an
+// infinite ratio.
+func (s standing) ratio() float64 {
+	if s.downloaded == 0 {
+		return math.Inf(1)
+	}
+	return float64(s.uploaded) / float64(s.downloaded)
+}
+
+// loadStandings reads the standings of a file or HTTP endpoint.
+func loadStandings(source string) (map[string]standing, error) {
+	rc, err := listsource.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return parseStandings(rc)
+}
+
+// parseStandings parses a list of the standings of users, one per line: the
+// user, the uploaded and the downloaded bytes and, optionally, the Unix time
+// the user joined, separated by whitespace.
+// Empty lines and lines starting with "#" are ignored.
+func parseStandings(r io.Reader) (map[string]standing, error) {
+	standings := make(map[string]standing)
+
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 3 && len(fields) != 4 {
+			return nil, fmt.Errorf("line %d: expected 3 or 4 fields, got %d", line, len(fields))
+		}
+
+		var st standing
+		var err error
+		if st.uploaded, err = strconv.ParseUint(fields[1], 10, 64); err != nil {
+			return nil, fmt.Errorf("line %d: invalid uploaded bytes %q", line, fields[1])
+		}
+		if st.downloaded, err = strconv.ParseUint(fields[2], 10, 64); err != nil {
+			return nil, fmt.Errorf("line %d: invalid downloaded bytes %q", line, fields[2])
+		}
+		if len(fields) == 4 {
+			joined, err := strconv.ParseInt(fields[3], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid join time %q", line, fields[3])
+			}
+			st.joined = time.Unix(joined, 0)
+		}
+		standings[fields[0]] = st
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return standings, nil
+}
@@ -0,0 +1,228 @@
+package middleware
+
+import (
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/clock"
+)
+
+// Rejections are counted in buckets of one minute for a day, so that
+// operators can see which middleware rejected which clients, and why.
+const (
+	rejectionBucketDuration = time.Minute
+	rejectionBuckets        = 24 * 60
+
+	// MaxRejectionWindow is the longest window rejections are aggregated
+	// over.
+	MaxRejectionWindow = rejectionBuckets * rejectionBucketDuration
+
+	// maxRejectionKeys is the number of distinct combinations of
+	// middleware, reason and client counted in a bucket. Rejections of
+	// further clients are counted as OtherClients, so that clients sending
+	// random peer IDs can't exhaust the memory.
+	maxRejectionKeys = 1024
+
+	// maxRejectionCounts is the number of entries of each list of a
+	// RejectionSummary.
+	maxRejectionCounts = 20
+)
+
+// Clients that rejections are attributed to instead of a client ID.
+const (
+	// UnknownClient is the client of scrapes, which have no peer ID.
+	UnknownClient = "unknown"
+
+	// OtherClients are the clients that were not counted individually.
+	OtherClients = "other"
+)
+
+// RejectionCount is the number of rejections attributed to a middleware, a
+// reason or a client, and their share of all rejections.
+type RejectionCount struct {
+	Name  string  `json:"name"`
+	Count uint64  `json:"count"`
+	Share float64 `json:"share"`
+}
+
+// Rejection is the number of requests of a client rejected by a middleware
+// for a reason, and their share of all rejections.
+type Rejection struct {
+	Middleware string  `json:"middleware"`
+	Reason     string  `json:"reason"`
+	Client     string  `json:"client"`
+	Count      uint64  `json:"count"`
+	Share      float64 `json:"share"`
+}
+
+// RejectionSummary aggregates the requests rejected by middleware within a
+// window.
+//
+// Each list is sorted by count and holds at most the 20 largest entries.
+type RejectionSummary struct {
+	Window       string           `json:"window"`
+	Total        uint64           `json:"total"`
+	ByMiddleware []RejectionCount `json:"by_middleware"`
+	ByReason     []RejectionCount `json:"by_reason"`
+	ByClient     []RejectionCount `json:"by_client"`
+	Top          []Rejection      `json:"top"`
+}
+
+type rejectionKey struct {
+	middleware string
+	reason     string
+	client     string
+}
+
+type rejectionBucket struct {
+	start  time.Time
+	counts map[rejectionKey]uint64
+}
+
+// rejectionCounter counts rejections in a ring of buckets.
+type rejectionCounter struct {
+	clock clock.Clock
+
+	mu      sync.Mutex
+	buckets [rejectionBuckets]rejectionBucket
+}
+
+// rejections counts the rejections of all Logic instances, so that the
+// counts survive reloading the middleware.
+var rejections = &rejectionCounter{clock: clock.Cached}
+
+// clientName returns the client ID of a peer ID in a printable form.
+func clientName(id bittorrent.PeerID) string {
+	cid := bittorrent.NewClientID(id)
+	for _, b := range cid {
+		if b < 0x20 || b > 0x7e {
+			return hex.EncodeToString(cid[:])
+		}
+	}
+	return string(cid[:])
+}
+
+func (c *rejectionCounter) record(middleware, reason, client string) {
+	start := c.clock.Now().Truncate(rejectionBucketDuration)
+	key := rejectionKey{middleware: middleware, reason: reason, client: client}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b := &c.buckets[start.Unix()/int64(rejectionBucketDuration/time.Second)%rejectionBuckets]
+	if !b.start.Equal(start) {
+		b.start = start
+		b.counts = make(map[rejectionKey]uint64)
+	}
+	if _, ok := b.counts[key]; !ok && len(b.counts) >= maxRejectionKeys {
+		key.client = OtherClients
+	}
+	b.counts[key]++
+}
+
+func (c *rejectionCounter) summary(window time.Duration) RejectionSummary {
+	if window < rejectionBucketDuration {
+		window = rejectionBucketDuration
+	}
+	if window > MaxRejectionWindow {
+		window = MaxRejectionWindow
+	}
+	window = window.Truncate(rejectionBucketDuration)
+
+	// The current bucket is included, so the oldest one is excluded.
+	oldest := c.clock.Now().Truncate(rejectionBucketDuration).Add(-window)
+
+	counts := make(map[rejectionKey]uint64)
+	c.mu.Lock()
+	for _, b := range c.buckets {
+		if !b.start.After(oldest) {
+			continue
+		}
+		for key, count := range b.counts {
+			counts[key] += count
+		}
+	}
+	c.mu.Unlock()
+
+	summary := RejectionSummary{Window: window.String(), Top: []Rejection{}}
+	byMiddleware := make(map[string]uint64)
+	byReason := make(map[string]uint64)
+	byClient := make(map[string]uint64)
+	for key, count := range counts {
+		summary.Total += count
+		byMiddleware[key.middleware] += count
+		byReason[key.reason] += count
+		byClient[key.client] += count
+		summary.Top = append(summary.Top, Rejection{
+			Middleware: key.middleware,
+			Reason:     key.reason,
+			Client:     key.client,
+			Count:      count,
+		})
+	}
+
+	share := func(count uint64) float64 { return float64(count) / float64(summary.Total) }
+	summary.ByMiddleware = topRejectionCounts(byMiddleware, share)
+	summary.ByReason = topRejectionCounts(byReason, share)
+	summary.ByClient = topRejectionCounts(byClient, share)
+
+	sort.Slice(summary.Top, func(i, j int) bool {
+		a, b := summary.Top[i], summary.Top[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if a.Middleware != b.Middleware {
+			return a.Middleware < b.Middleware
+		}
+		if a.Reason != b.Reason {
+			return a.Reason < b.Reason
+		}
+		return a.Client < b.Client
+	})
+	if len(summary.Top) > maxRejectionCounts {
+		summary.Top = summary.Top[:maxRejectionCounts]
+	}
+	for i := range summary.Top {
+		summary.Top[i].Share = share(summary.Top[i].Count)
+	}
+
+	return summary
+}
+
+// topRejectionCounts returns the largest counts, sorted by count and name.
+func topRejectionCounts(counts map[string]uint64, share func(uint64) float64) []RejectionCount {
+	top := make([]RejectionCount, 0, len(counts))
+	for name, count := range counts {
+		top = append(top, RejectionCount{Name: name, Count: count, Share: share(count)})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].Name < top[j].Name
+	})
+	if len(top) > maxRejectionCounts {
+		top = top[:maxRejectionCounts]
+	}
+	return top
+}
+
+// Rejections returns the requests rejected by middleware within the given
+// window, which is rounded down to whole minutes and capped at a day.
+func Rejections(window time.Duration) RejectionSummary {
+	return rejections.summary(window)
+}
+
+// recordRejection records that the hook h rejected a request of the given
+// client with err, if err is a bittorrent.ClientError.
+//
+// Other errors are failures of the tracker rather than rejections.
+func recordRejection(h Hook, err error, client string) {
+	if _, ok := err.(bittorrent.ClientError); !ok {
+		return
+	}
+	rejections.record(hookName(h), err.Error(), client)
+}
@@ -0,0 +1,111 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/clock"
+)
+
+func TestRejectionCounter(t *testing.T) {
+	clk := clock.NewMock(time.Unix(1600000000, 0))
+	c := &rejectionCounter{clock: clk}
+
+	for i := 0; i < 8; i++ {
+		c.record("torrent rate limit", "torrent is rate limited", "qB4250")
+	}
+	c.record("client approval", "unapproved client", "UT3550")
+	clk.Add(30 * time.Minute)
+	c.record("torrent rate limit", "torrent is rate limited", "TR3000")
+
+	summary := c.summary(time.Hour)
+	require.Equal(t, "1h0m0s", summary.Window)
+	require.Equal(t, uint64(10), summary.Total)
+	require.Equal(t, []RejectionCount{
+		{Name: "torrent rate limit", Count: 9, Share: 0.9},
+		{Name: "client approval", Count: 1, Share: 0.1},
+	}, summary.ByMiddleware)
+	require.Equal(t, RejectionCount{Name: "qB4250", Count: 8, Share: 0.8}, summary.ByClient[0])
+	require.Equal(t, Rejection{
+		Middleware: "torrent rate limit",
+		Reason:     "torrent is rate limited",
+		Client:     "qB4250",
+		Count:      8,
+		Share:      0.8,
+	}, summary.Top[0])
+
+	// Only the last rejection is within the last 10 minutes.
+	summary = c.summary(10 * time.Minute)
+	require.Equal(t, uint64(1), summary.Total)
+	require.Equal(t, "TR3000", summary.Top[0].Client)
+
+	// Rejections older than the longest window are forgotten.
+	clk.Add(MaxRejectionWindow - 10*time.Minute)
+	summary = c.summary(MaxRejectionWindow)
+	require.Equal(t, uint64(1), summary.Total)
+	clk.Add(30 * time.Minute)
+	summary = c.summary(MaxRejectionWindow)
+	require.Equal(t, uint64(0), summary.Total)
+	require.Empty(t, summary.Top)
+}
+
+func TestRejectionCounterBoundsClients(t *testing.T) {
+	c := &rejectionCounter{clock: clock.NewMock(time.Unix(1600000000, 0))}
+
+	for i := 0; i < 2*maxRejectionKeys; i++ {
+		c.record("jwt", "unapproved request: missing jwt", fmt.Sprintf("C%05d", i))
+	}
+
+	summary := c.summary(time.Hour)
+	require.Equal(t, uint64(2*maxRejectionKeys), summary.Total)
+	require.Equal(t, RejectionCount{Name: OtherClients, Count: maxRejectionKeys, Share: 0.5}, summary.ByClient[0])
+}
+
+func TestClientName(t *testing.T) {
+	require.Equal(t, "qB4250", clientName(bittorrent.PeerID{'-', 'q', 'B', '4', '2', '5', '0', '-'}))
+	require.Equal(t, "000102030405", clientName(bittorrent.PeerID{0, 1, 2, 3, 4, 5}))
+}
+
+type rejectingHook struct{ err error }
+
+func (h rejectingHook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	return ctx, h.err
+}
+
+func (h rejectingHook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	return ctx, h.err
+}
+
+func TestLogicRecordsRejections(t *testing.T) {
+	old := rejections
+	rejections = &rejectionCounter{clock: clock.NewMock(time.Unix(1600000000, 0))}
+	defer func() { rejections = old }()
+
+	rejected := bittorrent.ClientError("go away")
+	hooks := []Hook{NamedHook("bouncer", rejectingHook{rejected})}
+	lgc := NewLogic(ResponseConfig{}, nil, hooks, nil)
+
+	req := &bittorrent.AnnounceRequest{Peer: bittorrent.Peer{ID: bittorrent.PeerID{'-', 'q', 'B', '4', '2', '5', '0', '-'}}}
+	_, _, err := lgc.HandleAnnounce(context.Background(), req)
+	require.Equal(t, rejected, err)
+	_, _, err = lgc.HandleScrape(context.Background(), &bittorrent.ScrapeRequest{})
+	require.Equal(t, rejected, err)
+
+	// Errors other than ClientErrors are not rejections.
+	lgc = NewLogic(ResponseConfig{}, nil, []Hook{NamedHook("broken", rejectingHook{context.Canceled})}, nil)
+	_, _, err = lgc.HandleAnnounce(context.Background(), req)
+	require.Equal(t, context.Canceled, err)
+
+	summary := Rejections(time.Hour)
+	require.Equal(t, uint64(2), summary.Total)
+	require.Equal(t, []RejectionCount{{Name: "bouncer", Count: 2, Share: 1}}, summary.ByMiddleware)
+	require.Equal(t, []RejectionCount{
+		{Name: "qB4250", Count: 1, Share: 0.5},
+		{Name: UnknownClient, Count: 1, Share: 0.5},
+	}, summary.ByClient)
+}
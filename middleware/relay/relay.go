@@ -0,0 +1,197 @@
+// Package relay implements a Hook that returns peers through a relay to
+// clients that announce to support it, so that they don't learn the IP
+// addresses of other peers.
+//
+// The peers of the response are replaced by tokens of package pkg/relay,
+// IPv6 addresses in the prefix routed to the relay, which forwards the
+// connections made to them to the peers.
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/relay"
+)
+
+// Name is the name by which this middleware is registered with Chihaya.
+const Name = "relay"
+
+func init() {
+	middleware.RegisterDriver(Name, driver{})
+}
+
+var _ middleware.Driver = driver{}
+
+type driver struct{}
+
+func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
+	var cfg Config
+	err := yaml.UnmarshalStrict(optionBytes, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid options for middleware %s: %s", Name, err)
+	}
+
+	return NewHook(cfg)
+}
+
+// ErrInvalidPrefix is returned for a config with an invalid Prefix.
+var ErrInvalidPrefix = errors.New("invalid prefix")
+
+// ErrInvalidKey is returned for a config with a Key that is too short.
+var ErrInvalidKey = errors.New("invalid key")
+
+// ErrInvalidPort is returned for a config without a Port.
+var ErrInvalidPort = errors.New("invalid port")
+
+// ErrRelayRequired is returned for announces without the capability param,
+// if relaying is required.
+var ErrRelayRequired = bittorrent.ClientError("relay capability required")
+
+// Config represents the configuration for the relay middleware.
+type Config struct {
+	// Prefix is the IPv6 prefix of at most 64 bits routed to the relay,
+	// which the tokens are addresses in.
+	Prefix string `yaml:"prefix"`
+
+	// Port is the port the relay listens on, which is returned as the
+	// port of every relayed peer.
+	Port uint16 `yaml:"port"`
+
+	// Key is the secret shared with the relay that tokens are encrypted
+	// with. It must be at least 16 bytes long.
+	Key string `yaml:"key"`
+
+	// CapabilityParam is the announce parameter in which clients report
+	// that they want to receive relayed peers, as "1".
+	CapabilityParam string `yaml:"capability_param"`
+
+	// Required rejects announces of clients that don't report the
+	// capability, so that no client learns the IP addresses of others.
+	Required bool `yaml:"required"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+// The key is omitted.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"prefix":          cfg.Prefix,
+		"port":            cfg.Port,
+		"capabilityParam": cfg.CapabilityParam,
+		"required":        cfg.Required,
+	}
+}
+
+// Default config constants.
+const defaultCapabilityParam = "relay"
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.CapabilityParam == "" {
+		validcfg.CapabilityParam = defaultCapabilityParam
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".CapabilityParam",
+			"provided": cfg.CapabilityParam,
+			"default":  validcfg.CapabilityParam,
+		})
+	}
+
+	return validcfg
+}
+
+func checkConfig(cfg Config) error {
+	if cfg.Port == 0 {
+		return ErrInvalidPort
+	}
+
+	if len(cfg.Key) < relay.MinKeyLength {
+		return ErrInvalidKey
+	}
+
+	return nil
+}
+
+type hook struct {
+	cfg    Config
+	tokens *relay.Tokens
+}
+
+// NewHook creates a middleware that returns peers through a relay.
+func NewHook(cfg Config) (middleware.Hook, error) {
+	cfg = cfg.Validate()
+	if err := checkConfig(cfg); err != nil {
+		return nil, err
+	}
+
+	_, prefix, err := net.ParseCIDR(cfg.Prefix)
+	if err != nil {
+		return nil, ErrInvalidPrefix
+	}
+	tokens, err := relay.NewTokens([]byte(cfg.Key), prefix)
+	if err == relay.ErrInvalidPrefix {
+		return nil, ErrInvalidPrefix
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &hook{cfg: cfg, tokens: tokens}, nil
+}
+
+// capable reports whether the client of req announced that it wants to
+// receive relayed peers.
+func (h *hook) capable(req *bittorrent.AnnounceRequest) bool {
+	if req.Params == nil {
+		return false
+	}
+	s, _ := req.Params.String(h.cfg.CapabilityParam)
+	return s == "1"
+}
+
+// HandleAnnounce replaces the peers of resp by their tokens, if the client
+// reported the capability.
+//
+// The tokens are IPv6 addresses, so relayed responses only contain IPv6
+// peers and reach clients announcing over IPv6, or over HTTP. IPv6 peers
+// can't be relayed and are left out.
+//
+// This must be configured as a ResponseHook, so that resp contains the
+// peers to replace.
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	if !h.capable(req) {
+		if h.cfg.Required {
+			return ctx, ErrRelayRequired
+		}
+		return ctx, nil
+	}
+
+	relayed := make([]bittorrent.Peer, 0, len(resp.IPv4Peers))
+	for _, p := range resp.IPv4Peers {
+		relayed = append(relayed, bittorrent.Peer{
+			ID:   p.ID,
+			IP:   bittorrent.IP{IP: h.tokens.Seal(p.IP.IP, p.Port), AddressFamily: bittorrent.IPv6},
+			Port: h.cfg.Port,
+		})
+	}
+	resp.IPv4Peers = resp.IPv4Peers[:0]
+	resp.IPv6Peers = relayed
+	bittorrent.RecordDecision(ctx, Name, "peers relayed")
+
+	return ctx, nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't return peers.
+	return ctx, nil
+}
@@ -0,0 +1,90 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/relay"
+)
+
+var configTests = []struct {
+	cfg      Config
+	expected error
+}{
+	{Config{Prefix: "2001:db8:1::/64", Port: 6881, Key: "0123456789abcdef"}, nil},
+	{Config{Prefix: "2001:db8:1::/64", Port: 0, Key: "0123456789abcdef"}, ErrInvalidPort},
+	{Config{Prefix: "2001:db8:1::/64", Port: 6881, Key: "short"}, ErrInvalidKey},
+	{Config{Prefix: "2001:db8:1::/96", Port: 6881, Key: "0123456789abcdef"}, ErrInvalidPrefix},
+	{Config{Prefix: "bogus", Port: 6881, Key: "0123456789abcdef"}, ErrInvalidPrefix},
+}
+
+func TestNewHook(t *testing.T) {
+	for _, tt := range configTests {
+		t.Run(fmt.Sprintf("%#v", tt.cfg), func(t *testing.T) {
+			_, err := NewHook(tt.cfg)
+			require.Equal(t, tt.expected, err)
+		})
+	}
+}
+
+func announce(params string) *bittorrent.AnnounceRequest {
+	qp, err := bittorrent.ParseURLData("/announce?" + params)
+	if err != nil {
+		panic(err)
+	}
+	return &bittorrent.AnnounceRequest{Params: qp}
+}
+
+func response() *bittorrent.AnnounceResponse {
+	return &bittorrent.AnnounceResponse{
+		IPv4Peers: []bittorrent.Peer{
+			{ID: bittorrent.PeerID{1}, IP: bittorrent.IP{IP: net.IP{198, 51, 100, 1}, AddressFamily: bittorrent.IPv4}, Port: 1234},
+		},
+		IPv6Peers: []bittorrent.Peer{
+			{ID: bittorrent.PeerID{2}, IP: bittorrent.IP{IP: net.ParseIP("2001:db8::1"), AddressFamily: bittorrent.IPv6}, Port: 1234},
+		},
+	}
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	cfg := Config{Prefix: "2001:db8:1::/64", Port: 6881, Key: "0123456789abcdef"}
+	h, err := NewHook(cfg)
+	require.Nil(t, err)
+
+	// Clients without the capability receive the peers.
+	resp := response()
+	_, err = h.HandleAnnounce(context.Background(), announce(""), resp)
+	require.Nil(t, err)
+	require.Equal(t, response(), resp)
+
+	// Clients with the capability receive tokens for the IPv4 peers.
+	resp = response()
+	_, err = h.HandleAnnounce(context.Background(), announce("relay=1"), resp)
+	require.Nil(t, err)
+	require.Empty(t, resp.IPv4Peers)
+	require.Len(t, resp.IPv6Peers, 1)
+	require.Equal(t, bittorrent.PeerID{1}, resp.IPv6Peers[0].ID)
+	require.Equal(t, uint16(6881), resp.IPv6Peers[0].Port)
+
+	_, prefix, _ := net.ParseCIDR(cfg.Prefix)
+	tokens, err := relay.NewTokens([]byte(cfg.Key), prefix)
+	require.Nil(t, err)
+	ip, port, ok := tokens.Open(resp.IPv6Peers[0].IP.IP)
+	require.True(t, ok)
+	require.Equal(t, net.IP{198, 51, 100, 1}, ip)
+	require.Equal(t, uint16(1234), port)
+
+	// If relaying is required, clients without the capability are rejected.
+	cfg.Required = true
+	h, err = NewHook(cfg)
+	require.Nil(t, err)
+	_, err = h.HandleAnnounce(context.Background(), announce("relay=0"), response())
+	require.Equal(t, ErrRelayRequired, err)
+	_, err = h.HandleAnnounce(context.Background(), announce("relay=1"), response())
+	require.Nil(t, err)
+}
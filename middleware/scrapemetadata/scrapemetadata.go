@@ -0,0 +1,256 @@
+// Package scrapemetadata implements a Hook that adds the optional metadata
+// of torrents defined by BEP 48, their names and numbers of downloaders, to
+// scrape responses.
+//
+// The metadata is taken from a Source. The built-in Source reads it from a
+// file or an HTTP endpoint, which is reloaded on an interval, and other
+// Sources can be used by creating the Hook with New.
+package scrapemetadata
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/middleware/pkg/listsource"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+// Name is the name by which this middleware is registered with Chihaya.
+const Name = "scrape metadata"
+
+func init() {
+	middleware.RegisterDriver(Name, driver{})
+}
+
+var _ middleware.Driver = driver{}
+
+type driver struct{}
+
+func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
+	var cfg Config
+	err := yaml.UnmarshalStrict(optionBytes, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid options for middleware %s: %s", Name, err)
+	}
+
+	return NewHook(cfg)
+}
+
+// Metadata is the metadata of a torrent.
+type Metadata struct {
+	// Name is the name of the torrent, or empty if it is unknown.
+	Name string `yaml:"name"`
+
+	// Downloaders is the number of peers actively downloading the torrent,
+	// or nil if it is unknown.
+	Downloaders *uint32 `yaml:"downloaders"`
+}
+
+// Source provides the metadata of torrents.
+type Source interface {
+	// Metadata returns the metadata of the given torrents. Torrents without
+	// metadata are left out.
+	Metadata(ctx context.Context, infoHashes []bittorrent.InfoHash) (map[bittorrent.InfoHash]Metadata, error)
+}
+
+// Config represents all the values required by this middleware.
+type Config struct {
+	// Source is the path to a file or the URL of an HTTP endpoint holding
+	// the metadata of torrents as YAML or JSON, keyed by hex-encoded
+	// infohash. It is ignored by New.
+	Source         string        `yaml:"source"`
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+
+	// MinRequestInterval, if not zero, is sent to clients as the minimum
+	// time to wait between scrapes.
+	MinRequestInterval time.Duration `yaml:"min_request_interval"`
+}
+
+// LogFields implements log.Fielder for a Config.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"source":             cfg.Source,
+		"reloadInterval":     cfg.ReloadInterval,
+		"minRequestInterval": cfg.MinRequestInterval,
+	}
+}
+
+// Default config constants.
+const defaultReloadInterval = time.Minute
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.Source != "" && cfg.ReloadInterval <= 0 {
+		validcfg.ReloadInterval = defaultReloadInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".ReloadInterval",
+			"provided": cfg.ReloadInterval,
+			"default":  validcfg.ReloadInterval,
+		})
+	}
+
+	return validcfg
+}
+
+type hook struct {
+	cfg    Config
+	source Source
+}
+
+// NewHook returns an instance of the scrape metadata middleware taking the
+// metadata from the configured source.
+func NewHook(provided Config) (middleware.Hook, error) {
+	cfg := provided.Validate()
+	if cfg.Source == "" {
+		return nil, fmt.Errorf("invalid options for middleware %s: no source", Name)
+	}
+
+	s := &fileSource{source: cfg.Source, closing: make(chan struct{})}
+	if err := s.reload(); err != nil {
+		return nil, fmt.Errorf("failed to load %s: %s", cfg.Source, err)
+	}
+	go s.reloadEvery(cfg.ReloadInterval)
+
+	return New(s, cfg), nil
+}
+
+// New returns an instance of the scrape metadata middleware taking the
+// metadata from source. If source implements stop.Stopper, it is stopped
+// along with the middleware.
+func New(source Source, provided Config) middleware.Hook {
+	return &hook{cfg: provided.Validate(), source: source}
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	// Announces don't carry any of the metadata.
+	return ctx, nil
+}
+
+// HandleScrape adds the metadata of the scraped torrents to the response.
+// Torrents hidden from scrapes are left out, and the response is left
+// unchanged if the metadata can't be read.
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	if h.cfg.MinRequestInterval > resp.MinRequestInterval {
+		resp.MinRequestInterval = h.cfg.MinRequestInterval
+	}
+
+	hidden, _ := ctx.Value(middleware.HiddenSwarmsKey).(map[bittorrent.InfoHash]struct{})
+	metadata, err := h.source.Metadata(ctx, req.InfoHashes)
+	if err != nil {
+		log.Error("failed to read scrape metadata", log.Err(err))
+		return ctx, nil
+	}
+
+	for i := range resp.Files {
+		scrape := &resp.Files[i]
+		if _, ok := hidden[scrape.InfoHash]; ok {
+			continue
+		}
+		m, ok := metadata[scrape.InfoHash]
+		if !ok {
+			continue
+		}
+		scrape.Name = m.Name
+		if m.Downloaders != nil {
+			scrape.Downloaders, scrape.HasDownloaders = *m.Downloaders, true
+		}
+	}
+
+	return ctx, nil
+}
+
+func (h *hook) Stop() stop.Result {
+	if s, ok := h.source.(stop.Stopper); ok {
+		return s.Stop()
+	}
+	return stop.AlreadyStopped
+}
+
+// fileSource is a Source reading the metadata from a file or an HTTP
+// endpoint.
+type fileSource struct {
+	source string
+
+	// metadata holds the current map[bittorrent.InfoHash]Metadata.
+	metadata atomic.Value
+	closing  chan struct{}
+}
+
+func (s *fileSource) Metadata(ctx context.Context, infoHashes []bittorrent.InfoHash) (map[bittorrent.InfoHash]Metadata, error) {
+	return s.metadata.Load().(map[bittorrent.InfoHash]Metadata), nil
+}
+
+// reload replaces the current metadata with that of the source.
+func (s *fileSource) reload() error {
+	rc, err := listsource.Open(s.source)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	var raw map[string]Metadata
+	if err := yaml.NewDecoder(rc).Decode(&raw); err != nil && err != io.EOF {
+		return err
+	}
+
+	metadata := make(map[bittorrent.InfoHash]Metadata, len(raw))
+	for hexHash, m := range raw {
+		b, err := hex.DecodeString(hexHash)
+		if err != nil || len(b) != 20 {
+			return fmt.Errorf("invalid infohash %q", hexHash)
+		}
+		metadata[bittorrent.InfoHashFromBytes(b)] = m
+	}
+	s.metadata.Store(metadata)
+
+	log.Debug("loaded scrape metadata", log.Fields{
+		"source":   s.source,
+		"torrents": len(metadata),
+	})
+	return nil
+}
+
+func (s *fileSource) reloadEvery(interval time.Duration) {
+	for {
+		select {
+		case <-s.closing:
+			return
+		case <-time.After(interval):
+			if err := s.reload(); err != nil {
+				// The previous metadata stays in effect.
+				log.Error("failed to reload scrape metadata", log.Fields{
+					"source": s.source,
+					"error":  err,
+				})
+			}
+		}
+	}
+}
+
+func (s *fileSource) Stop() stop.Result {
+	select {
+	case <-s.closing:
+		return stop.AlreadyStopped
+	default:
+	}
+	c := make(stop.Channel)
+	go func() {
+		close(s.closing)
+		c.Done()
+	}()
+	return c.Result()
+}
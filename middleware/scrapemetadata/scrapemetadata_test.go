@@ -0,0 +1,73 @@
+package scrapemetadata
+
+import (
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+)
+
+func infoHash(t *testing.T, s string) bittorrent.InfoHash {
+	b, err := hex.DecodeString(s)
+	require.Nil(t, err)
+	return bittorrent.InfoHashFromBytes(b)
+}
+
+func TestHandleScrape(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scrapemetadata")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "metadata.yaml")
+	require.Nil(t, ioutil.WriteFile(path, []byte(`
+"3532cf2d327fad8448c075b4cb42c8136964a435": {name: "ubuntu.iso", downloaders: 2}
+"4532cf2d327fad8448c075b4cb42c8136964a435": {name: "debian.iso"}
+"5532cf2d327fad8448c075b4cb42c8136964a435": {name: "hidden.iso"}
+`), 0644))
+
+	h, err := NewHook(Config{Source: path, MinRequestInterval: 15 * time.Minute})
+	require.Nil(t, err)
+	defer func() { h.(*hook).Stop().Wait() }()
+
+	ubuntu := infoHash(t, "3532cf2d327fad8448c075b4cb42c8136964a435")
+	debian := infoHash(t, "4532cf2d327fad8448c075b4cb42c8136964a435")
+	hidden := infoHash(t, "5532cf2d327fad8448c075b4cb42c8136964a435")
+	unknown := infoHash(t, "6532cf2d327fad8448c075b4cb42c8136964a435")
+
+	req := &bittorrent.ScrapeRequest{InfoHashes: []bittorrent.InfoHash{ubuntu, debian, hidden, unknown}}
+	resp := &bittorrent.ScrapeResponse{}
+	for _, ih := range req.InfoHashes {
+		resp.Files = append(resp.Files, bittorrent.Scrape{InfoHash: ih, Complete: 1})
+	}
+	ctx := context.WithValue(context.Background(), middleware.HiddenSwarmsKey, map[bittorrent.InfoHash]struct{}{hidden: {}})
+
+	_, err = h.HandleScrape(ctx, req, resp)
+	require.Nil(t, err)
+	require.Equal(t, 15*time.Minute, resp.MinRequestInterval)
+	require.Equal(t, bittorrent.Scrape{InfoHash: ubuntu, Complete: 1, Name: "ubuntu.iso", Downloaders: 2, HasDownloaders: true}, resp.Files[0])
+	require.Equal(t, bittorrent.Scrape{InfoHash: debian, Complete: 1, Name: "debian.iso"}, resp.Files[1])
+	require.Equal(t, bittorrent.Scrape{InfoHash: hidden, Complete: 1}, resp.Files[2])
+	require.Equal(t, bittorrent.Scrape{InfoHash: unknown, Complete: 1}, resp.Files[3])
+}
+
+func TestNewHook(t *testing.T) {
+	_, err := NewHook(Config{})
+	require.NotNil(t, err)
+
+	dir, err := ioutil.TempDir("", "scrapemetadata")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "metadata.yaml")
+	require.Nil(t, ioutil.WriteFile(path, []byte(`"not an infohash": {name: "x"}`), 0644))
+	_, err = NewHook(Config{Source: path})
+	require.NotNil(t, err)
+}
@@ -0,0 +1,153 @@
+package middleware
+
+import (
+	"bytes"
+	"math/rand"
+	"sort"
+	"sync/atomic"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// Peer shuffling strategies.
+//
+// The order of the peers returned to a client affects how quickly new peers
+// interconnect, because clients usually connect to the first peers in the
+// response first.
+const (
+	// ShuffleNone returns peers in the order they were returned by the
+	// storage.
+	ShuffleNone = "none"
+
+	// ShuffleRandom returns peers in a random order.
+	ShuffleRandom = "random"
+
+	// ShuffleRotate returns peers in a stable order, but starts at a
+	// different peer for each announce.
+	ShuffleRotate = "rotate"
+
+	// ShufflePeerID returns peers in an order that is random, but the same
+	// for every announce of a peer as long as the returned peers don't
+	// change.
+	ShufflePeerID = "peer_id"
+)
+
+const defaultPeerShuffling = ShuffleNone
+
+// shuffler reorders the peers returned for an announce.
+type shuffler interface {
+	shuffle(req *bittorrent.AnnounceRequest, peers []bittorrent.Peer)
+
+	// strategy returns the name of the implemented strategy.
+	strategy() string
+}
+
+// newShuffler returns the shuffler implementing the given strategy.
+func newShuffler(strategy string) shuffler {
+	switch strategy {
+	case ShuffleNone:
+		return noShuffler{}
+	case ShuffleRandom:
+		return randomShuffler{}
+	case ShuffleRotate:
+		return &rotatingShuffler{}
+	case ShufflePeerID:
+		return peerIDShuffler{}
+	}
+
+	log.Warn("falling back to default configuration", log.Fields{
+		"name":     "PeerShuffling",
+		"provided": strategy,
+		"default":  defaultPeerShuffling,
+	})
+	return newShuffler(defaultPeerShuffling)
+}
+
+type noShuffler struct{}
+
+func (noShuffler) shuffle(*bittorrent.AnnounceRequest, []bittorrent.Peer) {}
+
+func (noShuffler) strategy() string { return ShuffleNone }
+
+type randomShuffler struct{}
+
+func (randomShuffler) shuffle(_ *bittorrent.AnnounceRequest, peers []bittorrent.Peer) {
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+}
+
+func (randomShuffler) strategy() string { return ShuffleRandom }
+
+type rotatingShuffler struct {
+	offset uint64
+}
+
+func (s *rotatingShuffler) shuffle(_ *bittorrent.AnnounceRequest, peers []bittorrent.Peer) {
+	if len(peers) < 2 {
+		return
+	}
+
+	sortPeers(peers)
+
+	offset := int(atomic.AddUint64(&s.offset, 1) % uint64(len(peers)))
+	rotated := append(peers[offset:len(peers):len(peers)], peers[:offset]...)
+	copy(peers, rotated)
+}
+
+func (*rotatingShuffler) strategy() string { return ShuffleRotate }
+
+type peerIDShuffler struct{}
+
+func (peerIDShuffler) strategy() string { return ShufflePeerID }
+
+func (peerIDShuffler) shuffle(req *bittorrent.AnnounceRequest, peers []bittorrent.Peer) {
+	if len(peers) < 2 {
+		return
+	}
+
+	// The order returned by the storage is not necessarily stable.
+	sortPeers(peers)
+
+	// The seed covers the whole peer ID, since its first bytes are usually
+	// the same for all peers of a client version, e.g. "-qB4650-".
+	state := fnv64a(req.Peer.ID[:])
+	for i := len(peers) - 1; i > 0; i-- {
+		j := int(splitMix64(&state) % uint64(i+1))
+		peers[i], peers[j] = peers[j], peers[i]
+	}
+}
+
+// fnv64a returns the 64-bit FNV-1a hash of b.
+func fnv64a(b []byte) uint64 {
+	h := uint64(14695981039346656037)
+	for _, c := range b {
+		h ^= uint64(c)
+		h *= 1099511628211
+	}
+	return h
+}
+
+// splitMix64 returns the next number of the SplitMix64 generator with the
+// given state. It is cheap to seed, unlike the sources of math/rand, and its
+// slight bias when reduced modulo small numbers doesn't matter for
+// shuffling peers.
+func splitMix64(state *uint64) uint64 {
+	*state += 0x9e3779b97f4a7c15
+	z := *state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// sortPeers sorts peers by their ID, IP and port.
+func sortPeers(peers []bittorrent.Peer) {
+	sort.Slice(peers, func(i, j int) bool {
+		if c := bytes.Compare(peers[i].ID[:], peers[j].ID[:]); c != 0 {
+			return c < 0
+		}
+		if c := bytes.Compare(peers[i].IP.IP, peers[j].IP.IP); c != 0 {
+			return c < 0
+		}
+		return peers[i].Port < peers[j].Port
+	})
+}
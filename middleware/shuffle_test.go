@@ -0,0 +1,134 @@
+package middleware
+
+import (
+	"math/rand"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/internal/chisquare"
+)
+
+func testPeers(n int) []bittorrent.Peer {
+	peers := make([]bittorrent.Peer, n)
+	for i := range peers {
+		peers[i] = bittorrent.Peer{
+			ID:   bittorrent.PeerID{byte(i)},
+			IP:   bittorrent.IP{IP: net.IPv4(10, 0, 0, byte(i)).To4(), AddressFamily: bittorrent.IPv4},
+			Port: uint16(i),
+		}
+	}
+	return peers
+}
+
+func TestShufflers(t *testing.T) {
+	req := &bittorrent.AnnounceRequest{Peer: bittorrent.Peer{ID: bittorrent.PeerID{1, 2, 3}}}
+
+	for _, strategy := range []string{ShuffleNone, ShuffleRandom, ShuffleRotate, ShufflePeerID} {
+		t.Run(strategy, func(t *testing.T) {
+			peers := testPeers(20)
+			newShuffler(strategy).shuffle(req, peers)
+			require.ElementsMatch(t, testPeers(20), peers)
+		})
+	}
+}
+
+func TestRotatingShuffler(t *testing.T) {
+	req := &bittorrent.AnnounceRequest{}
+	s := newShuffler(ShuffleRotate)
+
+	first := testPeers(5)
+	s.shuffle(req, first)
+	second := testPeers(5)
+	s.shuffle(req, second)
+
+	require.Equal(t, first[1], second[0])
+	require.Equal(t, first[0], second[4])
+}
+
+func TestPeerIDShuffler(t *testing.T) {
+	req := &bittorrent.AnnounceRequest{Peer: bittorrent.Peer{ID: bittorrent.PeerID{1, 2, 3}}}
+	s := newShuffler(ShufflePeerID)
+
+	first := testPeers(20)
+	s.shuffle(req, first)
+
+	// The order must not depend on the order returned by the storage.
+	second := testPeers(20)
+	second[0], second[19] = second[19], second[0]
+	s.shuffle(req, second)
+
+	require.Equal(t, first, second)
+}
+
+// TestShufflerFairness tests that every peer is equally likely to be returned
+// first, since clients usually connect to the first peers first.
+func TestShufflerFairness(t *testing.T) {
+	const n, trials = 20, 4000
+
+	t.Run(ShuffleRandom, func(t *testing.T) {
+		s := newShuffler(ShuffleRandom)
+		counts := make([]int, n)
+		for i := 0; i < trials; i++ {
+			peers := testPeers(n)
+			s.shuffle(&bittorrent.AnnounceRequest{}, peers)
+			counts[peers[0].Port]++
+		}
+		chisquare.RequireUniform(t, counts)
+	})
+
+	t.Run(ShufflePeerID, func(t *testing.T) {
+		s := newShuffler(ShufflePeerID)
+		counts := make([]int, n)
+		for i := 0; i < trials; i++ {
+			var id bittorrent.PeerID
+			rand.Read(id[:])
+			peers := testPeers(n)
+			s.shuffle(&bittorrent.AnnounceRequest{Peer: bittorrent.Peer{ID: id}}, peers)
+			counts[peers[0].Port]++
+		}
+		chisquare.RequireUniform(t, counts)
+	})
+
+	// Peers of the same client version share the prefix of their peer IDs,
+	// but must not get the same order.
+	t.Run(ShufflePeerID+" same client", func(t *testing.T) {
+		s := newShuffler(ShufflePeerID)
+		counts := make([]int, n)
+		for i := 0; i < trials; i++ {
+			var id bittorrent.PeerID
+			copy(id[:], "-qB4650-")
+			rand.Read(id[8:])
+			peers := testPeers(n)
+			s.shuffle(&bittorrent.AnnounceRequest{Peer: bittorrent.Peer{ID: id}}, peers)
+			counts[peers[0].Port]++
+		}
+		chisquare.RequireUniform(t, counts)
+	})
+
+	t.Run(ShuffleRotate, func(t *testing.T) {
+		s := newShuffler(ShuffleRotate)
+		counts := make([]int, n)
+		for i := 0; i < trials; i++ {
+			peers := testPeers(n)
+			s.shuffle(&bittorrent.AnnounceRequest{}, peers)
+			counts[peers[0].Port]++
+		}
+		for _, count := range counts {
+			require.Equal(t, trials/n, count)
+		}
+	})
+}
+
+func BenchmarkPeerIDShuffler(b *testing.B) {
+	req := &bittorrent.AnnounceRequest{Peer: bittorrent.Peer{ID: bittorrent.PeerID{1, 2, 3}}}
+	s := newShuffler(ShufflePeerID)
+	peers := testPeers(50)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		s.shuffle(req, peers)
+	}
+}
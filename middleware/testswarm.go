@@ -0,0 +1,292 @@
+package middleware
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/storage"
+)
+
+const (
+	// testPeerLifetime is the duration after which peers of a test swarm
+	// that did not announce again are removed.
+	testPeerLifetime = 10 * time.Minute
+
+	// maxTestSwarms limits the memory used by test swarms, which anybody can
+	// create by announcing a reserved infohash.
+	maxTestSwarms = 1024
+)
+
+// ErrTooManyTestSwarms is returned if an announce would create a test swarm
+// while the maximum number of test swarms is active.
+var ErrTooManyTestSwarms = bittorrent.ClientError("too many test swarms")
+
+// reservedStore is a storage.PeerStore that routes the swarms of infohashes in
+// the reserved namespace to a loopback test swarm instead of the underlying
+// PeerStore, so that they are never stored in or returned from it.
+type reservedStore struct {
+	storage.PeerStore
+	test *testSwarms
+}
+
+func newReservedStore(ps storage.PeerStore) reservedStore {
+	return reservedStore{
+		PeerStore: ps,
+		test:      &testSwarms{swarms: make(map[bittorrent.InfoHash]testSwarm)},
+	}
+}
+
+func (s reservedStore) PutSeeder(ctx context.Context, infoHash bittorrent.InfoHash, p bittorrent.Peer) error {
+	if infoHash.Reserved() {
+		return s.test.put(infoHash, p, true)
+	}
+	return s.PeerStore.PutSeeder(ctx, infoHash, p)
+}
+
+func (s reservedStore) DeleteSeeder(ctx context.Context, infoHash bittorrent.InfoHash, p bittorrent.Peer) error {
+	if infoHash.Reserved() {
+		return s.test.delete(infoHash, p, true)
+	}
+	return s.PeerStore.DeleteSeeder(ctx, infoHash, p)
+}
+
+func (s reservedStore) PutLeecher(ctx context.Context, infoHash bittorrent.InfoHash, p bittorrent.Peer) error {
+	if infoHash.Reserved() {
+		return s.test.put(infoHash, p, false)
+	}
+	return s.PeerStore.PutLeecher(ctx, infoHash, p)
+}
+
+func (s reservedStore) DeleteLeecher(ctx context.Context, infoHash bittorrent.InfoHash, p bittorrent.Peer) error {
+	if infoHash.Reserved() {
+		return s.test.delete(infoHash, p, false)
+	}
+	return s.PeerStore.DeleteLeecher(ctx, infoHash, p)
+}
+
+func (s reservedStore) GraduateLeecher(ctx context.Context, infoHash bittorrent.InfoHash, p bittorrent.Peer) error {
+	if infoHash.Reserved() {
+		return s.test.put(infoHash, p, true)
+	}
+	return s.PeerStore.GraduateLeecher(ctx, infoHash, p)
+}
+
+// PutMultiHomedSeeder implements storage.MultiHomedPeerStore. The endpoints
+// of multi-homed peers are independent peers of test swarms.
+func (s reservedStore) PutMultiHomedSeeder(ctx context.Context, infoHash bittorrent.InfoHash, p, alternate bittorrent.Peer) error {
+	if infoHash.Reserved() {
+		if err := s.test.put(infoHash, p, true); err != nil {
+			return err
+		}
+		return s.test.put(infoHash, alternate, true)
+	}
+	return storage.PutMultiHomedSeeder(ctx, s.PeerStore, infoHash, p, alternate)
+}
+
+// PutMultiHomedLeecher implements storage.MultiHomedPeerStore.
+func (s reservedStore) PutMultiHomedLeecher(ctx context.Context, infoHash bittorrent.InfoHash, p, alternate bittorrent.Peer) error {
+	if infoHash.Reserved() {
+		if err := s.test.put(infoHash, p, false); err != nil {
+			return err
+		}
+		return s.test.put(infoHash, alternate, false)
+	}
+	return storage.PutMultiHomedLeecher(ctx, s.PeerStore, infoHash, p, alternate)
+}
+
+// GraduateMultiHomedLeecher implements storage.MultiHomedPeerStore.
+func (s reservedStore) GraduateMultiHomedLeecher(ctx context.Context, infoHash bittorrent.InfoHash, p, alternate bittorrent.Peer) error {
+	if infoHash.Reserved() {
+		if err := s.test.put(infoHash, p, true); err != nil {
+			return err
+		}
+		return s.test.put(infoHash, alternate, true)
+	}
+	return storage.GraduateMultiHomedLeecher(ctx, s.PeerStore, infoHash, p, alternate)
+}
+
+func (s reservedStore) AnnouncePeers(ctx context.Context, infoHash bittorrent.InfoHash, seeder bool, numWant int, p bittorrent.Peer) ([]bittorrent.Peer, error) {
+	if infoHash.Reserved() {
+		return s.test.announcePeers(infoHash, seeder, numWant, p)
+	}
+	return s.PeerStore.AnnouncePeers(ctx, infoHash, seeder, numWant, p)
+}
+
+func (s reservedStore) AnnounceSeeders(ctx context.Context, infoHash bittorrent.InfoHash, numWant int, p bittorrent.Peer) ([]bittorrent.Peer, error) {
+	if infoHash.Reserved() {
+		return s.test.announcePeersOf(infoHash, true, numWant, p)
+	}
+	return s.PeerStore.AnnounceSeeders(ctx, infoHash, numWant, p)
+}
+
+func (s reservedStore) AnnounceLeechers(ctx context.Context, infoHash bittorrent.InfoHash, numWant int, p bittorrent.Peer) ([]bittorrent.Peer, error) {
+	if infoHash.Reserved() {
+		return s.test.announcePeersOf(infoHash, false, numWant, p)
+	}
+	return s.PeerStore.AnnounceLeechers(ctx, infoHash, numWant, p)
+}
+
+func (s reservedStore) ScrapeSwarm(ctx context.Context, infoHash bittorrent.InfoHash, addressFamily bittorrent.AddressFamily) bittorrent.Scrape {
+	if infoHash.Reserved() {
+		return s.test.scrape(infoHash, addressFamily)
+	}
+	return s.PeerStore.ScrapeSwarm(ctx, infoHash, addressFamily)
+}
+
+// SwarmActivity implements storage.ActivityReporter. The activity of test
+// swarms is unknown.
+func (s reservedStore) SwarmActivity(ctx context.Context, infoHash bittorrent.InfoHash, addressFamily bittorrent.AddressFamily) (storage.SwarmActivity, bool) {
+	if infoHash.Reserved() {
+		return storage.SwarmActivity{}, false
+	}
+	return storage.Activity(ctx, s.PeerStore, infoHash, addressFamily)
+}
+
+// testPeer is a member of a test swarm.
+type testPeer struct {
+	peer    bittorrent.Peer
+	seeder  bool
+	expires time.Time
+}
+
+// testSwarm maps the string representation of peers to the peers.
+type testSwarm map[string]testPeer
+
+// testSwarms is a minimal in-memory store for the swarms of reserved
+// infohashes.
+//
+// Expired peers are removed lazily whenever their swarm is accessed.
+type testSwarms struct {
+	sync.Mutex
+	swarms map[bittorrent.InfoHash]testSwarm
+}
+
+// swarm returns the swarm of the given infohash after removing its expired
+// peers, or nil if it has no peers left.
+//
+// The caller must hold the lock.
+func (ts *testSwarms) swarm(infoHash bittorrent.InfoHash, now time.Time) testSwarm {
+	swarm, ok := ts.swarms[infoHash]
+	if !ok {
+		return nil
+	}
+
+	for k, tp := range swarm {
+		if now.After(tp.expires) {
+			delete(swarm, k)
+		}
+	}
+	if len(swarm) == 0 {
+		delete(ts.swarms, infoHash)
+		return nil
+	}
+	return swarm
+}
+
+func (ts *testSwarms) put(infoHash bittorrent.InfoHash, p bittorrent.Peer, seeder bool) error {
+	ts.Lock()
+	defer ts.Unlock()
+
+	now := time.Now()
+	swarm := ts.swarm(infoHash, now)
+	if swarm == nil {
+		if len(ts.swarms) >= maxTestSwarms {
+			for ih := range ts.swarms {
+				ts.swarm(ih, now)
+			}
+			if len(ts.swarms) >= maxTestSwarms {
+				return ErrTooManyTestSwarms
+			}
+		}
+		swarm = make(testSwarm)
+		ts.swarms[infoHash] = swarm
+	}
+
+	swarm[p.String()] = testPeer{peer: p, seeder: seeder, expires: now.Add(testPeerLifetime)}
+	return nil
+}
+
+func (ts *testSwarms) delete(infoHash bittorrent.InfoHash, p bittorrent.Peer, seeder bool) error {
+	ts.Lock()
+	defer ts.Unlock()
+
+	swarm := ts.swarm(infoHash, time.Now())
+	k := p.String()
+	if tp, ok := swarm[k]; !ok || tp.seeder != seeder {
+		return storage.ErrResourceDoesNotExist
+	}
+
+	delete(swarm, k)
+	if len(swarm) == 0 {
+		delete(ts.swarms, infoHash)
+	}
+	return nil
+}
+
+func (ts *testSwarms) announcePeers(infoHash bittorrent.InfoHash, seeder bool, numWant int, p bittorrent.Peer) ([]bittorrent.Peer, error) {
+	ts.Lock()
+	defer ts.Unlock()
+
+	swarm := ts.swarm(infoHash, time.Now())
+	if swarm == nil {
+		return nil, storage.ErrResourceDoesNotExist
+	}
+
+	var peers []bittorrent.Peer
+	for _, tp := range swarm {
+		if len(peers) >= numWant {
+			break
+		}
+		// Like the production stores, seeders only receive leechers and
+		// peers only receive peers of their own address family.
+		if (seeder && tp.seeder) || tp.peer.IP.AddressFamily != p.IP.AddressFamily || tp.peer.Equal(p) {
+			continue
+		}
+		peers = append(peers, tp.peer)
+	}
+	return peers, nil
+}
+
+// announcePeersOf returns up to numWant seeders or leechers of the test swarm
+// of the given infohash, excluding p.
+func (ts *testSwarms) announcePeersOf(infoHash bittorrent.InfoHash, seeders bool, numWant int, p bittorrent.Peer) ([]bittorrent.Peer, error) {
+	ts.Lock()
+	defer ts.Unlock()
+
+	swarm := ts.swarm(infoHash, time.Now())
+	if swarm == nil {
+		return nil, storage.ErrResourceDoesNotExist
+	}
+
+	var peers []bittorrent.Peer
+	for _, tp := range swarm {
+		if len(peers) >= numWant {
+			break
+		}
+		if tp.seeder != seeders || tp.peer.IP.AddressFamily != p.IP.AddressFamily || tp.peer.Equal(p) {
+			continue
+		}
+		peers = append(peers, tp.peer)
+	}
+	return peers, nil
+}
+
+func (ts *testSwarms) scrape(infoHash bittorrent.InfoHash, addressFamily bittorrent.AddressFamily) (scrape bittorrent.Scrape) {
+	ts.Lock()
+	defer ts.Unlock()
+
+	scrape.InfoHash = infoHash
+	for _, tp := range ts.swarm(infoHash, time.Now()) {
+		if tp.peer.IP.AddressFamily != addressFamily {
+			continue
+		}
+		if tp.seeder {
+			scrape.Complete++
+		} else {
+			scrape.Incomplete++
+		}
+	}
+	return scrape
+}
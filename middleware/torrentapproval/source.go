@@ -0,0 +1,61 @@
+package torrentapproval
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware/pkg/listsource"
+)
+
+// loadSource reads the infohashes of a file or HTTP endpoint.
+func loadSource(source string) (map[bittorrent.InfoHash]struct{}, error) {
+	rc, err := listsource.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return parseList(rc)
+}
+
+// parseList parses a list of hex-encoded infohashes, one per line.
+// Empty lines and lines starting with "#" are ignored.
+func parseList(r io.Reader) (map[bittorrent.InfoHash]struct{}, error) {
+	hashes := make(map[bittorrent.InfoHash]struct{})
+
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		ih, err := parseInfoHash(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		hashes[ih] = struct{}{}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return hashes, nil
+}
+
+func parseInfoHash(s string) (bittorrent.InfoHash, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return bittorrent.InfoHash{}, fmt.Errorf("invalid hash %s", s)
+	}
+	if len(b) != 20 {
+		return bittorrent.InfoHash{}, errors.New("hash " + s + " is not 20 byes")
+	}
+
+	return bittorrent.InfoHashFromBytes(b), nil
+}
@@ -1,16 +1,24 @@
 // Package torrentapproval implements a Hook that fails an Announce based on a
 // whitelist or blacklist of torrent hash.
+//
+// The list can be read from a file or an HTTP endpoint, which is reloaded on
+// an interval.
 package torrentapproval
 
 import (
 	"context"
-	"encoding/hex"
+	"errors"
 	"fmt"
+	"sync/atomic"
+	"time"
 
 	yaml "gopkg.in/yaml.v2"
 
 	"github.com/chihaya/chihaya/bittorrent"
 	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/policy"
+	"github.com/chihaya/chihaya/pkg/stop"
 )
 
 // Name is the name by which this middleware is registered with Chihaya.
@@ -26,7 +34,7 @@ type driver struct{}
 
 func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
 	var cfg Config
-	err := yaml.Unmarshal(optionBytes, &cfg)
+	err := yaml.UnmarshalStrict(optionBytes, &cfg)
 	if err != nil {
 		return nil, fmt.Errorf("invalid options for middleware %s: %s", Name, err)
 	}
@@ -42,68 +50,209 @@ var ErrTorrentUnapproved = bittorrent.ClientError("unapproved torrent")
 type Config struct {
 	Whitelist []string `yaml:"whitelist"`
 	Blacklist []string `yaml:"blacklist"`
+
+	// WhitelistSource and BlacklistSource are the path to a file or the URL
+	// of an HTTP endpoint listing hashes, one per line. The listed hashes are
+	// added to Whitelist or Blacklist respectively.
+	WhitelistSource string        `yaml:"whitelist_source"`
+	BlacklistSource string        `yaml:"blacklist_source"`
+	ReloadInterval  time.Duration `yaml:"reload_interval"`
+
+	// ApproveScrapes fails scrapes that include an unapproved hash.
+	ApproveScrapes bool `yaml:"approve_scrapes"`
+}
+
+// LogFields implements log.Fielder for a Config.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"whitelistLen":    len(cfg.Whitelist),
+		"blacklistLen":    len(cfg.Blacklist),
+		"whitelistSource": cfg.WhitelistSource,
+		"blacklistSource": cfg.BlacklistSource,
+		"reloadInterval":  cfg.ReloadInterval,
+		"approveScrapes":  cfg.ApproveScrapes,
+	}
+}
+
+// Default config constants.
+const defaultReloadInterval = time.Minute
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.source() != "" && cfg.ReloadInterval <= 0 {
+		validcfg.ReloadInterval = defaultReloadInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".ReloadInterval",
+			"provided": cfg.ReloadInterval,
+			"default":  validcfg.ReloadInterval,
+		})
+	}
+
+	return validcfg
+}
+
+// source returns the configured source, if any.
+func (cfg Config) source() string {
+	if cfg.WhitelistSource != "" {
+		return cfg.WhitelistSource
+	}
+	return cfg.BlacklistSource
 }
 
 type hook struct {
-	approved   map[bittorrent.InfoHash]struct{}
-	unapproved map[bittorrent.InfoHash]struct{}
+	cfg Config
+
+	// whitelist is true if hashes lists the approved hashes, false if it
+	// lists the unapproved hashes.
+	whitelist bool
+
+	// static holds the hashes of the configuration, which are merged with
+	// the hashes of the source whenever it is reloaded.
+	static map[bittorrent.InfoHash]struct{}
+
+	// hashes holds the current map[bittorrent.InfoHash]struct{}.
+	hashes  atomic.Value
+	closing chan struct{}
 }
 
 // NewHook returns an instance of the torrent approval middleware.
-func NewHook(cfg Config) (middleware.Hook, error) {
+func NewHook(provided Config) (middleware.Hook, error) {
+	cfg := provided.Validate()
 	h := &hook{
-		approved:   make(map[bittorrent.InfoHash]struct{}),
-		unapproved: make(map[bittorrent.InfoHash]struct{}),
+		cfg:       cfg,
+		whitelist: len(cfg.Whitelist) > 0 || cfg.WhitelistSource != "",
+		static:    make(map[bittorrent.InfoHash]struct{}),
+		closing:   make(chan struct{}),
 	}
 
-	if len(cfg.Whitelist) > 0 && len(cfg.Blacklist) > 0 {
+	if (len(cfg.Whitelist) > 0 || cfg.WhitelistSource != "") && (len(cfg.Blacklist) > 0 || cfg.BlacklistSource != "") {
 		return nil, fmt.Errorf("using both whitelist and blacklist is invalid")
 	}
 
 	for _, hashString := range cfg.Whitelist {
-		hashinfo, err := hex.DecodeString(hashString)
+		ih, err := parseInfoHash(hashString)
 		if err != nil {
-			return nil, fmt.Errorf("whitelist : invalid hash %s", hashString)
-		}
-		if len(hashinfo) != 20 {
-			return nil, fmt.Errorf("whitelist : hash %s is not 20 byes", hashString)
+			return nil, errors.New("whitelist : " + err.Error())
 		}
-		h.approved[bittorrent.InfoHashFromBytes(hashinfo)] = struct{}{}
+		h.static[ih] = struct{}{}
 	}
 
 	for _, hashString := range cfg.Blacklist {
-		hashinfo, err := hex.DecodeString(hashString)
+		ih, err := parseInfoHash(hashString)
 		if err != nil {
-			return nil, fmt.Errorf("blacklist : invalid hash %s", hashString)
-		}
-		if len(hashinfo) != 20 {
-			return nil, fmt.Errorf("blacklist : hash %s is not 20 byes", hashString)
+			return nil, errors.New("blacklist : " + err.Error())
 		}
-		h.unapproved[bittorrent.InfoHashFromBytes(hashinfo)] = struct{}{}
+		h.static[ih] = struct{}{}
 	}
+	h.hashes.Store(h.static)
+
+	if cfg.source() == "" {
+		return h, nil
+	}
+
+	if err := h.reload(); err != nil {
+		return nil, fmt.Errorf("failed to load %s: %s", cfg.source(), err)
+	}
+
+	go func() {
+		for {
+			select {
+			case <-h.closing:
+				return
+			case <-time.After(cfg.ReloadInterval):
+				if err := h.reload(); err != nil {
+					// The previous list stays in effect.
+					log.Error("failed to reload torrent approval list", log.Fields{
+						"source": cfg.source(),
+						"error":  err,
+					})
+				}
+			}
+		}
+	}()
 
 	return h, nil
 }
 
-func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
-	infohash := req.InfoHash
+// reload replaces the current hashes with those of the source and the
+// configuration.
+func (h *hook) reload() error {
+	loaded, err := loadSource(h.cfg.source())
+	if err != nil {
+		return err
+	}
 
-	if len(h.approved) > 0 {
-		if _, found := h.approved[infohash]; !found {
-			return ctx, ErrTorrentUnapproved
-		}
+	for ih := range h.static {
+		loaded[ih] = struct{}{}
 	}
+	h.hashes.Store(loaded)
 
-	if len(h.unapproved) > 0 {
-		if _, found := h.unapproved[infohash]; found {
-			return ctx, ErrTorrentUnapproved
-		}
+	log.Debug("loaded torrent approval list", log.Fields{
+		"source": h.cfg.source(),
+		"hashes": len(loaded),
+	})
+	return nil
+}
+
+func (h *hook) Stop() stop.Result {
+	select {
+	case <-h.closing:
+		return stop.AlreadyStopped
+	default:
+	}
+	c := make(stop.Channel)
+	go func() {
+		close(h.closing)
+		c.Done()
+	}()
+	return c.Result()
+}
+
+// approved returns whether a torrent is approved by the current list.
+func (h *hook) approved(ih bittorrent.InfoHash) bool {
+	hashes := h.hashes.Load().(map[bittorrent.InfoHash]struct{})
+	_, found := hashes[ih]
+	if h.whitelist {
+		return found
+	}
+	return !found
+}
+
+// HandleAnnounce rejects unapproved torrents. Torrents approved by their
+// policy are approved regardless of the list.
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	if p, ok := policy.FromContext(ctx); ok && p.Approval == policy.Approved {
+		bittorrent.RecordDecision(ctx, Name, "approved")
+		return ctx, nil
+	}
+
+	if !h.approved(req.InfoHash) {
+		bittorrent.RecordDecision(ctx, Name, "rejected")
+		return ctx, ErrTorrentUnapproved
 	}
 
+	bittorrent.RecordDecision(ctx, Name, "approved")
 	return ctx, nil
 }
 
 func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
-	// Scrapes don't require any protection.
+	if !h.cfg.ApproveScrapes {
+		// Scrapes don't require any protection.
+		return ctx, nil
+	}
+
+	for _, ih := range req.InfoHashes {
+		if !h.approved(ih) {
+			bittorrent.RecordDecision(ctx, Name, "rejected")
+			return ctx, ErrTorrentUnapproved
+		}
+	}
+
+	bittorrent.RecordDecision(ctx, Name, "approved")
 	return ctx, nil
 }
@@ -4,11 +4,20 @@ import (
 	"context"
 	"encoding/hex"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
 	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/policy"
 )
 
 var cases = []struct {
@@ -77,3 +86,83 @@ func TestHandleAnnounce(t *testing.T) {
 		})
 	}
 }
+
+func TestPolicyApproval(t *testing.T) {
+	h, err := NewHook(Config{Whitelist: []string{"3532cf2d327fad8448c075b4cb42c8136964a435"}})
+	require.Nil(t, err)
+	req := &bittorrent.AnnounceRequest{InfoHash: bittorrent.InfoHashFromString("00000000000000000001")}
+
+	// Torrents approved by their policy need not be whitelisted.
+	_, err = h.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+	require.Equal(t, ErrTorrentUnapproved, err)
+	ctx := policy.NewContext(context.Background(), policy.Policy{Approval: policy.Approved})
+	_, err = h.HandleAnnounce(ctx, req, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+}
+
+func TestHandleScrape(t *testing.T) {
+	ih := bittorrent.InfoHashFromString("\x35\x32\xcf\x2d\x32\x7f\xad\x84\x48\xc0\x75\xb4\xcb\x42\xc8\x13\x69\x64\xa4\x35")
+	other := bittorrent.InfoHashFromString("\x45\x32\xcf\x2d\x32\x7f\xad\x84\x48\xc0\x75\xb4\xcb\x42\xc8\x13\x69\x64\xa4\x35")
+	req := &bittorrent.ScrapeRequest{InfoHashes: []bittorrent.InfoHash{ih, other}}
+
+	h, err := NewHook(Config{Whitelist: []string{"3532cf2d327fad8448c075b4cb42c8136964a435"}})
+	require.Nil(t, err)
+	_, err = h.HandleScrape(context.Background(), req, &bittorrent.ScrapeResponse{})
+	require.Nil(t, err)
+
+	h, err = NewHook(Config{Whitelist: []string{"3532cf2d327fad8448c075b4cb42c8136964a435"}, ApproveScrapes: true})
+	require.Nil(t, err)
+	_, err = h.HandleScrape(context.Background(), req, &bittorrent.ScrapeResponse{})
+	require.Equal(t, ErrTorrentUnapproved, err)
+
+	req.InfoHashes = req.InfoHashes[:1]
+	_, err = h.HandleScrape(context.Background(), req, &bittorrent.ScrapeResponse{})
+	require.Nil(t, err)
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torrentapproval")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "blacklist")
+	list := "# unapproved torrents\n3532cf2d327fad8448c075b4cb42c8136964a435\n\n"
+	require.Nil(t, ioutil.WriteFile(path, []byte(list), 0644))
+
+	var served atomic.Value
+	served.Store(list)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, served.Load().(string))
+	}))
+	defer srv.Close()
+
+	blacklisted := bittorrent.InfoHashFromString("\x35\x32\xcf\x2d\x32\x7f\xad\x84\x48\xc0\x75\xb4\xcb\x42\xc8\x13\x69\x64\xa4\x35")
+	added := bittorrent.InfoHashFromString("\x45\x32\xcf\x2d\x32\x7f\xad\x84\x48\xc0\x75\xb4\xcb\x42\xc8\x13\x69\x64\xa4\x35")
+
+	for _, source := range []string{path, srv.URL} {
+		t.Run(source, func(t *testing.T) {
+			h, err := NewHook(Config{BlacklistSource: source, ReloadInterval: time.Hour})
+			require.Nil(t, err)
+			defer h.(*hook).Stop()
+
+			require.False(t, h.(*hook).approved(blacklisted))
+			require.True(t, h.(*hook).approved(added))
+
+			updated := list + "4532cf2d327fad8448c075b4cb42c8136964a435\n"
+			require.Nil(t, ioutil.WriteFile(path, []byte(updated), 0644))
+			served.Store(updated)
+			require.Nil(t, h.(*hook).reload())
+			require.False(t, h.(*hook).approved(blacklisted))
+			require.False(t, h.(*hook).approved(added))
+
+			// A broken list doesn't replace the current one.
+			require.Nil(t, ioutil.WriteFile(path, []byte("broken\n"), 0644))
+			served.Store("broken\n")
+			require.NotNil(t, h.(*hook).reload())
+			require.False(t, h.(*hook).approved(added))
+
+			require.Nil(t, ioutil.WriteFile(path, []byte(list), 0644))
+			served.Store(list)
+		})
+	}
+}
@@ -0,0 +1,20 @@
+package torrentratelimit
+
+import "github.com/prometheus/client_golang/prometheus"
+
+func init() {
+	prometheus.MustRegister(promShedTotal)
+}
+
+var promShedTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "chihaya_torrent_rate_limit_shed_total",
+		Help: "The number of requests shed because their torrent exceeded its rate limit",
+	},
+	[]string{"action"},
+)
+
+// recordShed records a request of the given action that was shed.
+func recordShed(action string) {
+	promShedTotal.WithLabelValues(action).Inc()
+}
@@ -0,0 +1,196 @@
+// Package torrentratelimit implements a Hook that limits the rate of
+// announces and scrapes for every torrent across all clients.
+//
+// Announces exceeding the limit are shed: they receive a response without
+// peers and are not added to the swarm, so that the storage isn't consulted.
+// Scrapes exceeding the limit fail.
+package torrentratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/internal/timecache"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/ratelimit"
+)
+
+// Name is the name by which this middleware is registered with Chihaya.
+const Name = "torrent rate limit"
+
+func init() {
+	middleware.RegisterDriver(Name, driver{})
+}
+
+var _ middleware.Driver = driver{}
+
+type driver struct{}
+
+func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
+	var cfg Config
+	err := yaml.UnmarshalStrict(optionBytes, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid options for middleware %s: %s", Name, err)
+	}
+
+	return NewHook(cfg)
+}
+
+// ErrRateLimited is returned for scrapes of a torrent that exceeded its
+// rate limit.
+var ErrRateLimited = bittorrent.ClientError("torrent is rate limited, try again later")
+
+// ErrNoRateLimit is returned for a config that neither limits announces nor
+// scrapes.
+var ErrNoRateLimit = errors.New("neither announce_rate nor scrape_rate is set")
+
+// Config represents the configuration for the torrent rate limit middleware.
+type Config struct {
+	// AnnounceRate is the number of announces per second allowed for a
+	// torrent, and AnnounceBurst the number of announces allowed at once.
+	// Set AnnounceRate to 0 to not limit announces.
+	AnnounceRate  float64 `yaml:"announce_rate"`
+	AnnounceBurst int     `yaml:"announce_burst"`
+
+	// ScrapeRate is the number of scrapes per second allowed for a torrent,
+	// and ScrapeBurst the number of scrapes allowed at once.
+	// Set ScrapeRate to 0 to not limit scrapes.
+	ScrapeRate  float64 `yaml:"scrape_rate"`
+	ScrapeBurst int     `yaml:"scrape_burst"`
+
+	// ShedInterval is the interval returned to clients whose announce was
+	// shed. If 0, the configured announce interval is used.
+	ShedInterval time.Duration `yaml:"shed_interval"`
+
+	// CacheSize is the number of torrents whose rate is tracked. If a torrent
+	// is evicted, its next request starts with a full burst.
+	CacheSize int `yaml:"cache_size"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"announceRate":  cfg.AnnounceRate,
+		"announceBurst": cfg.AnnounceBurst,
+		"scrapeRate":    cfg.ScrapeRate,
+		"scrapeBurst":   cfg.ScrapeBurst,
+		"shedInterval":  cfg.ShedInterval,
+		"cacheSize":     cfg.CacheSize,
+	}
+}
+
+// Default config constants.
+const defaultCacheSize = 65536
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.AnnounceRate > 0 && cfg.AnnounceBurst <= 0 {
+		validcfg.AnnounceBurst = int(math.Ceil(cfg.AnnounceRate))
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".AnnounceBurst",
+			"provided": cfg.AnnounceBurst,
+			"default":  validcfg.AnnounceBurst,
+		})
+	}
+
+	if cfg.ScrapeRate > 0 && cfg.ScrapeBurst <= 0 {
+		validcfg.ScrapeBurst = int(math.Ceil(cfg.ScrapeRate))
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".ScrapeBurst",
+			"provided": cfg.ScrapeBurst,
+			"default":  validcfg.ScrapeBurst,
+		})
+	}
+
+	if cfg.ShedInterval < 0 {
+		validcfg.ShedInterval = 0
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".ShedInterval",
+			"provided": cfg.ShedInterval,
+			"default":  validcfg.ShedInterval,
+		})
+	}
+
+	if cfg.CacheSize <= 0 {
+		validcfg.CacheSize = defaultCacheSize
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".CacheSize",
+			"provided": cfg.CacheSize,
+			"default":  validcfg.CacheSize,
+		})
+	}
+
+	return validcfg
+}
+
+type hook struct {
+	cfg Config
+
+	// announces and scrapes are nil if the respective rate isn't limited.
+	announces *ratelimit.Limiter
+	scrapes   *ratelimit.Limiter
+}
+
+// NewHook creates a middleware that limits the rate of announces and scrapes
+// of every torrent.
+func NewHook(provided Config) (middleware.Hook, error) {
+	if provided.AnnounceRate <= 0 && provided.ScrapeRate <= 0 {
+		return nil, ErrNoRateLimit
+	}
+	cfg := provided.Validate()
+
+	h := &hook{cfg: cfg}
+	if cfg.AnnounceRate > 0 {
+		h.announces = ratelimit.New(cfg.AnnounceRate, cfg.AnnounceBurst, cfg.CacheSize)
+	}
+	if cfg.ScrapeRate > 0 {
+		h.scrapes = ratelimit.New(cfg.ScrapeRate, cfg.ScrapeBurst, cfg.CacheSize)
+	}
+
+	return h, nil
+}
+
+func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	if h.announces == nil || h.announces.Allow(string(req.InfoHash[:]), timecache.Now()) {
+		return ctx, nil
+	}
+
+	recordShed("announce")
+	bittorrent.RecordDecision(ctx, Name, "shed")
+	if h.cfg.ShedInterval > 0 {
+		resp.Interval = h.cfg.ShedInterval
+		resp.MinInterval = h.cfg.ShedInterval
+	}
+
+	ctx = context.WithValue(ctx, middleware.SkipResponseHookKey, struct{}{})
+	return context.WithValue(ctx, middleware.SkipSwarmInteractionKey, struct{}{}), nil
+}
+
+func (h *hook) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	if h.scrapes == nil {
+		return ctx, nil
+	}
+
+	now := timecache.Now()
+	for _, ih := range req.InfoHashes {
+		if !h.scrapes.Allow(string(ih[:]), now) {
+			recordShed("scrape")
+			bittorrent.RecordDecision(ctx, Name, "shed")
+			return ctx, ErrRateLimited
+		}
+	}
+
+	return ctx, nil
+}
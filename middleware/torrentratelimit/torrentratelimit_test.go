@@ -0,0 +1,72 @@
+package torrentratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+)
+
+var (
+	ih1 = bittorrent.InfoHashFromString("11111111111111111111")
+	ih2 = bittorrent.InfoHashFromString("22222222222222222222")
+)
+
+func shed(ctx context.Context) bool {
+	return ctx.Value(middleware.SkipResponseHookKey) != nil && ctx.Value(middleware.SkipSwarmInteractionKey) != nil
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	h, err := NewHook(Config{AnnounceRate: 0.001, AnnounceBurst: 2, ShedInterval: time.Hour})
+	require.Nil(t, err)
+
+	announce := func(ih bittorrent.InfoHash) (context.Context, *bittorrent.AnnounceResponse) {
+		resp := &bittorrent.AnnounceResponse{Interval: time.Minute, MinInterval: time.Minute}
+		ctx, err := h.HandleAnnounce(context.Background(), &bittorrent.AnnounceRequest{InfoHash: ih}, resp)
+		require.Nil(t, err)
+		return ctx, resp
+	}
+
+	for i := 0; i < 2; i++ {
+		ctx, resp := announce(ih1)
+		require.False(t, shed(ctx))
+		require.Equal(t, time.Minute, resp.Interval)
+	}
+
+	ctx, resp := announce(ih1)
+	require.True(t, shed(ctx))
+	require.Equal(t, time.Hour, resp.Interval)
+	require.Equal(t, time.Hour, resp.MinInterval)
+
+	// Torrents are limited separately.
+	ctx, _ = announce(ih2)
+	require.False(t, shed(ctx))
+
+	// Scrapes are not limited.
+	_, err = h.HandleScrape(context.Background(), &bittorrent.ScrapeRequest{InfoHashes: []bittorrent.InfoHash{ih1}}, &bittorrent.ScrapeResponse{})
+	require.Nil(t, err)
+}
+
+func TestHandleScrape(t *testing.T) {
+	h, err := NewHook(Config{ScrapeRate: 0.001, ScrapeBurst: 1})
+	require.Nil(t, err)
+
+	scrape := func(ihs ...bittorrent.InfoHash) error {
+		_, err := h.HandleScrape(context.Background(), &bittorrent.ScrapeRequest{InfoHashes: ihs}, &bittorrent.ScrapeResponse{})
+		return err
+	}
+
+	require.Nil(t, scrape(ih1))
+	require.Equal(t, ErrRateLimited, scrape(ih1))
+	require.Equal(t, ErrRateLimited, scrape(ih2, ih1))
+	require.Equal(t, ErrRateLimited, scrape(ih2))
+}
+
+func TestNewHook(t *testing.T) {
+	_, err := NewHook(Config{})
+	require.Equal(t, ErrNoRateLimit, err)
+}
@@ -0,0 +1,144 @@
+package middleware
+
+import (
+	"context"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/internal/timecache"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/ratelimit"
+	"github.com/chihaya/chihaya/storage"
+)
+
+// Policies for announces of infohashes without a swarm.
+//
+// An open tracker creates a swarm for every infohash announced to it, which
+// allows anybody to fill the storage with swarms.
+const (
+	// UnknownSwarmsCreate creates a swarm for every announced infohash.
+	UnknownSwarmsCreate = "create"
+
+	// UnknownSwarmsReject rejects announces of infohashes without a swarm,
+	// so that only swarms created by other means, such as another tracker
+	// sharing the storage, are tracked.
+	UnknownSwarmsReject = "reject"
+
+	// UnknownSwarmsRateLimit creates swarms, but limits the rate at which
+	// every IP address can create them.
+	UnknownSwarmsRateLimit = "rate_limit"
+)
+
+const defaultUnknownSwarms = UnknownSwarmsCreate
+
+// swarmCreationCacheSize is the number of IP addresses whose rate of
+// creating swarms is tracked.
+const swarmCreationCacheSize = 65536
+
+var (
+	// ErrUnknownSwarm is returned for announces of infohashes without a
+	// swarm if unknown swarms are rejected.
+	ErrUnknownSwarm = bittorrent.ClientError("unregistered torrent")
+
+	// ErrSwarmCreationRateLimited is returned for announces that would
+	// create a swarm after the IP address exceeded its rate of creating
+	// swarms.
+	ErrSwarmCreationRateLimited = bittorrent.ClientError("too many new torrents, try again later")
+)
+
+// newUnknownSwarmHook returns the Hook implementing the given policy, or nil
+// if every swarm is created.
+func newUnknownSwarmHook(cfg ResponseConfig, store storage.PeerStore) Hook {
+	switch cfg.UnknownSwarms {
+	case UnknownSwarmsCreate:
+		return nil
+	case UnknownSwarmsReject:
+		return &unknownSwarmHook{store: store}
+	case UnknownSwarmsRateLimit:
+		rate, burst := cfg.SwarmCreationRate, cfg.SwarmCreationBurst
+		if rate <= 0 {
+			log.Warn("rate limiting swarm creation without a rate, rejecting unknown swarms", log.Fields{
+				"name":     "SwarmCreationRate",
+				"provided": rate,
+			})
+			return &unknownSwarmHook{store: store}
+		}
+		if burst <= 0 {
+			burst = 1
+		}
+		return &unknownSwarmHook{
+			store:   store,
+			limiter: ratelimit.New(rate, burst, swarmCreationCacheSize),
+		}
+	}
+
+	log.Warn("falling back to default configuration", log.Fields{
+		"name":     "UnknownSwarms",
+		"provided": cfg.UnknownSwarms,
+		"default":  defaultUnknownSwarms,
+	})
+	cfg.UnknownSwarms = defaultUnknownSwarms
+	return newUnknownSwarmHook(cfg, store)
+}
+
+// unknownSwarmHook rejects announces that would create a swarm, unless the
+// IP address of the announcing peer is allowed to create another one.
+type unknownSwarmHook struct {
+	store storage.PeerStore
+
+	// limiter is nil if unknown swarms are always rejected.
+	limiter *ratelimit.Limiter
+}
+
+func (h *unknownSwarmHook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	// Announces that don't add the peer to a swarm can't create one, and
+	// test swarms are limited on their own.
+	if ctx.Value(SkipSwarmInteractionKey) != nil || req.Event == bittorrent.Stopped || req.InfoHash.Reserved() {
+		return ctx, nil
+	}
+
+	if h.swarmExists(ctx, req) {
+		return ctx, nil
+	}
+
+	if h.limiter == nil {
+		recordRejectedSwarmCreation("unknown")
+		bittorrent.RecordDecision(ctx, "swarm", "unknown, rejected")
+		return ctx, ErrUnknownSwarm
+	}
+
+	if !h.limiter.Allow(string(req.IP.IP), timecache.Now()) {
+		recordRejectedSwarmCreation("rate_limit")
+		bittorrent.RecordDecision(ctx, "swarm", "unknown, creation rate limited")
+		return ctx, ErrSwarmCreationRateLimited
+	}
+
+	bittorrent.RecordDecision(ctx, "swarm", "created")
+	return ctx, nil
+}
+
+// swarmExists returns whether the infohash of req has peers of any address
+// family.
+//
+// Two announces of the same new infohash can both pass this check, so a
+// swarm may be counted against the rate of more than one IP address.
+func (h *unknownSwarmHook) swarmExists(ctx context.Context, req *bittorrent.AnnounceRequest) bool {
+	for _, af := range []bittorrent.AddressFamily{req.IP.AddressFamily, otherAddressFamily(req.IP.AddressFamily)} {
+		s := h.store.ScrapeSwarm(ctx, req.InfoHash, af)
+		if s.Complete > 0 || s.Incomplete > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func otherAddressFamily(af bittorrent.AddressFamily) bittorrent.AddressFamily {
+	if af == bittorrent.IPv4 {
+		return bittorrent.IPv6
+	}
+	return bittorrent.IPv4
+}
+
+func (h *unknownSwarmHook) HandleScrape(ctx context.Context, _ *bittorrent.ScrapeRequest, _ *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes never create swarms.
+	return ctx, nil
+}
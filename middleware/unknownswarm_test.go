@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/storage/memory"
+)
+
+func TestUnknownSwarms(t *testing.T) {
+	peer := func(ip string, port uint16) bittorrent.Peer {
+		return bittorrent.Peer{
+			IP:   bittorrent.IP{IP: net.ParseIP(ip).To4(), AddressFamily: bittorrent.IPv4},
+			Port: port,
+		}
+	}
+	announce := func(lgc *Logic, ih bittorrent.InfoHash, p bittorrent.Peer) error {
+		req := &bittorrent.AnnounceRequest{InfoHash: ih, NumWant: 10, Left: 1, Peer: p}
+		ctx, resp, err := lgc.HandleAnnounce(context.Background(), req)
+		if err == nil {
+			lgc.AfterAnnounce(ctx, req, resp)
+		}
+		return err
+	}
+
+	var table = []struct {
+		name     string
+		cfg      ResponseConfig
+		expected []error
+	}{
+		{
+			name:     "create",
+			cfg:      ResponseConfig{},
+			expected: []error{nil, nil, nil},
+		},
+		{
+			name:     "reject",
+			cfg:      ResponseConfig{UnknownSwarms: UnknownSwarmsReject},
+			expected: []error{ErrUnknownSwarm, ErrUnknownSwarm, ErrUnknownSwarm},
+		},
+		{
+			name:     "rate limit",
+			cfg:      ResponseConfig{UnknownSwarms: UnknownSwarmsRateLimit, SwarmCreationRate: 0.001, SwarmCreationBurst: 2},
+			expected: []error{nil, nil, ErrSwarmCreationRateLimited},
+		},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.name, func(t *testing.T) {
+			ps, err := memory.New(memory.Config{})
+			require.Nil(t, err)
+			defer func() { ps.Stop().Wait() }()
+
+			// An existing swarm can always be joined.
+			existing := bittorrent.InfoHashFromString("00000000000000000000")
+			require.Nil(t, ps.PutSeeder(context.Background(), existing, peer("10.0.0.2", 1)))
+
+			lgc := NewLogic(tt.cfg, ps, nil, nil)
+			for i, expected := range tt.expected {
+				ih := bittorrent.InfoHashFromString("0000000000000000000" + string(rune('1'+i)))
+				require.Equal(t, expected, announce(lgc, ih, peer("10.0.0.1", 1)))
+				require.Nil(t, announce(lgc, existing, peer("10.0.0.1", 1)))
+			}
+
+			// Announces of swarms that were created don't count again.
+			first := bittorrent.InfoHashFromString("00000000000000000001")
+			require.Equal(t, tt.expected[0], announce(lgc, first, peer("10.0.0.1", 2)))
+		})
+	}
+}
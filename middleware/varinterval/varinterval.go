@@ -27,7 +27,7 @@ type driver struct{}
 
 func (d driver) NewHook(optionBytes []byte) (middleware.Hook, error) {
 	var cfg Config
-	err := yaml.Unmarshal(optionBytes, &cfg)
+	err := yaml.UnmarshalStrict(optionBytes, &cfg)
 	if err != nil {
 		return nil, fmt.Errorf("invalid options for middleware %s: %s", Name, err)
 	}
@@ -104,6 +104,8 @@ func (h *hook) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceReque
 			resp.MinInterval += addSeconds
 		}
 
+		bittorrent.RecordDecision(ctx, "interval", Name+" (+"+addSeconds.String()+")")
+
 		return ctx, nil
 	}
 
@@ -0,0 +1,221 @@
+// Package accesslog implements access logs in the Common and Combined Log
+// Formats, so that they can be processed by existing log analysis tools.
+//
+// Access logs can be rotated by moving the files and calling ReopenAll
+// afterwards.
+package accesslog
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// Supported formats.
+const (
+	// FormatCommon is the Common Log Format:
+	//   host ident authuser [date] "request" status bytes
+	FormatCommon = "common"
+
+	// FormatCombined is the Combined Log Format, which additionally contains
+	// the referer, the user agent and, as an extension, the duration of the
+	// request in microseconds:
+	//   host ident authuser [date] "request" status bytes "referer" "agent" duration
+	FormatCombined = "combined"
+)
+
+// ErrUnknownFormat is returned when opening a Log of an unsupported format.
+var ErrUnknownFormat = errors.New("accesslog: unknown format")
+
+var (
+	openM sync.Mutex
+	open  = make(map[*Log]struct{})
+)
+
+// ReopenAll reopens the files of all open Logs, e.g. after they were moved by
+// a log rotation tool.
+func ReopenAll() error {
+	openM.Lock()
+	defer openM.Unlock()
+
+	var firstErr error
+	for l := range open {
+		if err := l.reopen(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Entry is a handled request.
+type Entry struct {
+	Remote    string
+	Time      time.Time
+	Request   string
+	Status    int
+	Bytes     int // Negative if unknown.
+	Referer   string
+	UserAgent string
+	Duration  time.Duration
+}
+
+// LogFields renders the Entry as Fields, so that it can be logged by the
+// regular logger when no access log file is configured.
+func (e Entry) LogFields() log.Fields {
+	fields := log.Fields{
+		"remote":   e.Remote,
+		"request":  e.Request,
+		"status":   e.Status,
+		"duration": e.Duration,
+	}
+	if e.Bytes >= 0 {
+		fields["bytes"] = e.Bytes
+	}
+	if e.Referer != "" {
+		fields["referer"] = e.Referer
+	}
+	if e.UserAgent != "" {
+		fields["userAgent"] = e.UserAgent
+	}
+	return fields
+}
+
+// Log is an access log file that is safe for concurrent use.
+type Log struct {
+	path     string
+	combined bool
+
+	mu  sync.Mutex
+	f   *os.File
+	buf []byte
+}
+
+// Open opens the access log at path in the given format, appending to it if
+// it exists.
+func Open(path, format string) (*Log, error) {
+	l := &Log{path: path}
+	switch format {
+	case FormatCommon, "":
+	case FormatCombined:
+		l.combined = true
+	default:
+		return nil, ErrUnknownFormat
+	}
+
+	if err := l.reopen(); err != nil {
+		return nil, err
+	}
+
+	openM.Lock()
+	open[l] = struct{}{}
+	openM.Unlock()
+	return l, nil
+}
+
+func (l *Log) reopen() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil {
+		l.f.Close()
+	}
+	l.f = f
+	return nil
+}
+
+// Log writes an Entry to the Log.
+//
+// Entries of requests that are still handled after the Log was closed are
+// discarded.
+func (l *Log) Log(e Entry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return nil
+	}
+
+	l.buf = e.appendTo(l.buf[:0], l.combined)
+	_, err := l.f.Write(l.buf)
+	return err
+}
+
+// Close closes the Log.
+func (l *Log) Close() error {
+	openM.Lock()
+	delete(open, l)
+	openM.Unlock()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+// appendTo appends the Entry as a line in the Common or Combined Log Format.
+func (e Entry) appendTo(b []byte, combined bool) []byte {
+	b = appendField(b, e.Remote)
+	b = append(b, " - - ["...)
+	b = e.Time.AppendFormat(b, "02/Jan/2006:15:04:05 -0700")
+	b = append(b, "] "...)
+	b = appendQuoted(b, e.Request)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, int64(e.Status), 10)
+	b = append(b, ' ')
+	if e.Bytes < 0 {
+		b = append(b, '-')
+	} else {
+		b = strconv.AppendInt(b, int64(e.Bytes), 10)
+	}
+
+	if combined {
+		b = append(b, ' ')
+		b = appendQuoted(b, e.Referer)
+		b = append(b, ' ')
+		b = appendQuoted(b, e.UserAgent)
+		b = append(b, ' ')
+		b = strconv.AppendInt(b, int64(e.Duration/time.Microsecond), 10)
+	}
+
+	return append(b, '\n')
+}
+
+// appendField appends s, or "-" if it is empty.
+func appendField(b []byte, s string) []byte {
+	if s == "" {
+		return append(b, '-')
+	}
+	return append(b, s...)
+}
+
+// appendQuoted appends s, or "-" if it is empty, in quotes, escaping quotes,
+// backslashes and control characters so that every entry is a single line.
+func appendQuoted(b []byte, s string) []byte {
+	if s == "" {
+		return append(b, `"-"`...)
+	}
+
+	const hex = "0123456789abcdef"
+	b = append(b, '"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b = append(b, '\\', c)
+		case c < 0x20 || c == 0x7f:
+			b = append(b, '\\', 'x', hex[c>>4], hex[c&0xf])
+		default:
+			b = append(b, c)
+		}
+	}
+	return append(b, '"')
+}
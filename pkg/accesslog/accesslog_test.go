@@ -0,0 +1,86 @@
+package accesslog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+func TestEntryFormats(t *testing.T) {
+	e := Entry{
+		Remote:    "10.0.0.1",
+		Time:      time.Date(2019, 3, 14, 15, 9, 26, 0, time.FixedZone("", -7*3600)),
+		Request:   `GET /announce?info_hash="x" HTTP/1.1`,
+		Status:    200,
+		Bytes:     42,
+		UserAgent: "client\n1.0",
+		Duration:  1500 * time.Microsecond,
+	}
+
+	require.Equal(t,
+		`10.0.0.1 - - [14/Mar/2019:15:09:26 -0700] "GET /announce?info_hash=\"x\" HTTP/1.1" 200 42`+"\n",
+		string(e.appendTo(nil, false)))
+	require.Equal(t,
+		`10.0.0.1 - - [14/Mar/2019:15:09:26 -0700] "GET /announce?info_hash=\"x\" HTTP/1.1" 200 42 "-" "client\x0a1.0" 1500`+"\n",
+		string(e.appendTo(nil, true)))
+
+	e.Bytes = -1
+	require.Equal(t,
+		`10.0.0.1 - - [14/Mar/2019:15:09:26 -0700] "GET /announce?info_hash=\"x\" HTTP/1.1" 200 -`+"\n",
+		string(e.appendTo(nil, false)))
+}
+
+func TestEntryLogFields(t *testing.T) {
+	e := Entry{
+		Remote:   "10.0.0.1",
+		Request:  "announce IPv4 UDP",
+		Status:   200,
+		Bytes:    -1,
+		Duration: time.Millisecond,
+	}
+	require.Equal(t, log.Fields{
+		"remote":   "10.0.0.1",
+		"request":  "announce IPv4 UDP",
+		"status":   200,
+		"duration": time.Millisecond,
+	}, e.LogFields())
+
+	e.Bytes, e.UserAgent = 42, "client/1.0"
+	fields := e.LogFields()
+	require.Equal(t, 42, fields["bytes"])
+	require.Equal(t, "client/1.0", fields["userAgent"])
+}
+
+func TestReopenAll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "accesslog")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "access.log")
+	l, err := Open(path, FormatCommon)
+	require.Nil(t, err)
+	defer l.Close()
+
+	e := Entry{Remote: "10.0.0.1", Request: "announce", Status: 200, Bytes: -1}
+	require.Nil(t, l.Log(e))
+
+	// Rotate the log.
+	require.Nil(t, os.Rename(path, path+".1"))
+	require.Nil(t, ReopenAll())
+	require.Nil(t, l.Log(e))
+
+	for _, p := range []string{path, path + ".1"} {
+		contents, err := ioutil.ReadFile(p)
+		require.Nil(t, err)
+		require.Equal(t, string(e.appendTo(nil, false)), string(contents))
+	}
+
+	_, err = Open(path, "json")
+	require.Equal(t, ErrUnknownFormat, err)
+}
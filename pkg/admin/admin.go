@@ -0,0 +1,941 @@
+// Package admin implements an API for inspecting and modifying the state of a
+// running tracker, served over HTTP, gRPC, or both.
+//
+// Each API is served on a dedicated address and requires a static bearer
+// token, TLS client certificates signed by a configured CA, or both.
+//
+// The gRPC service is defined in adminpb/admin.proto. The HTTP API serves:
+//
+//	GET    /stats                 numbers of torrents, seeders and leechers
+//	GET    /stats/rejections      requests rejected by middleware, by reason
+//	                              and client
+//	GET    /torrents              all torrents with their numbers of peers
+//	GET    /torrents?idle=<dur>   all torrents not announced to within the
+//	                              duration, with or without peers
+//	GET    /torrents/<infohash>   the peers of a torrent
+//	DELETE /torrents/<infohash>   removes all peers of a torrent
+//	GET    /bans                  banned IP addresses and ranges
+//	PUT    /bans/<ip or cidr>     bans an IP address or range
+//	DELETE /bans/<ip or cidr>     lifts a ban
+//	GET    /policies              the policies of all torrents with one
+//	GET    /policies/<infohash>   the policy of a torrent
+//	PUT    /policies/<infohash>   replaces the policy of a torrent with the
+//	                              policy in the request body
+//	DELETE /policies/<infohash>   removes the policy of a torrent
+//	GET    /history               the peers whose announces are recorded
+//	PUT    /history/<peer>        records the announces of a peer, given by
+//	                              peer ID or IP address
+//	GET    /history/<peer>        the recorded announces of a peer
+//	DELETE /history/<peer>        stops recording the announces of a peer
+//	GET    /merges                classes of equivalent infohashes whose
+//	                              swarms are merged
+//	GET    /reload                the report of the last reload
+//	POST   /reload                reloads the configuration
+//
+// Infohashes and peer IDs are hex-encoded.
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/chihaya/chihaya/internal/handoff"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/admin/adminpb"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/policy"
+	"github.com/chihaya/chihaya/pkg/stop"
+	"github.com/chihaya/chihaya/storage"
+)
+
+// Name is the name used in logs and configuration errors.
+const Name = "admin"
+
+// maxPeers is the maximum number of peers of each kind and address family
+// read from a swarm.
+const maxPeers = 1 << 20
+
+// Default config constants.
+const defaultRequestTimeout = 30 * time.Second
+
+var (
+	// ErrNoAddr is returned if no address to listen on is configured.
+	ErrNoAddr = errors.New("admin: addr or grpc_addr must be set")
+
+	// ErrNoAuthentication is returned if neither a token nor a client CA is
+	// configured, which would leave the API unprotected.
+	ErrNoAuthentication = errors.New("admin: token or client_ca_path must be set")
+
+	// ErrIncompleteTLS is returned if only some of the TLS paths are set.
+	ErrIncompleteTLS = errors.New("admin: tls_cert_path and tls_key_path must be set together, and are required by client_ca_path")
+
+	errNoLister    = errors.New("the storage does not support listing torrents")
+	errNoActivity  = errors.New("the storage does not track the activity of torrents")
+	errInvalidHash = errors.New("invalid infohash")
+	errInvalidIdle = errors.New("invalid idle duration")
+)
+
+// Config represents the configuration of the admin API.
+//
+// The HTTP API is served on Addr and the gRPC service on GRPCAddr. Either
+// may be empty to not serve it.
+type Config struct {
+	Addr           string        `yaml:"addr"`
+	GRPCAddr       string        `yaml:"grpc_addr"`
+	Token          string        `yaml:"token"`
+	TLSCertPath    string        `yaml:"tls_cert_path"`
+	TLSKeyPath     string        `yaml:"tls_key_path"`
+	ClientCAPath   string        `yaml:"client_ca_path"`
+	RequestTimeout time.Duration `yaml:"request_timeout"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"addr":           cfg.Addr,
+		"grpcAddr":       cfg.GRPCAddr,
+		"token":          cfg.Token != "",
+		"tlsCertPath":    cfg.TLSCertPath,
+		"tlsKeyPath":     cfg.TLSKeyPath,
+		"clientCAPath":   cfg.ClientCAPath,
+		"requestTimeout": cfg.RequestTimeout,
+	}
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.RequestTimeout <= 0 {
+		validcfg.RequestTimeout = defaultRequestTimeout
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".RequestTimeout",
+			"provided": cfg.RequestTimeout,
+			"default":  validcfg.RequestTimeout,
+		})
+	}
+
+	return validcfg
+}
+
+func checkConfig(cfg Config) error {
+	switch {
+	case cfg.Addr == "" && cfg.GRPCAddr == "":
+		return ErrNoAddr
+	case cfg.Token == "" && cfg.ClientCAPath == "":
+		return ErrNoAuthentication
+	case (cfg.TLSCertPath == "") != (cfg.TLSKeyPath == ""):
+		return ErrIncompleteTLS
+	case cfg.ClientCAPath != "" && cfg.TLSCertPath == "":
+		return ErrIncompleteTLS
+	}
+	return nil
+}
+
+// Server serves the admin API.
+type Server struct {
+	cfg Config
+
+	// srv and l are nil if the HTTP API is not served, grpc and gl if the
+	// gRPC service is not.
+	srv  *http.Server
+	l    net.Listener
+	grpc *grpc.Server
+	gl   net.Listener
+
+	// store is modified by the API. lister is used to list the swarms and
+	// is nil if the PeerStore can't enumerate them.
+	store    storage.PeerStore
+	lister   storage.SwarmLister
+	bans     *Bans
+	policies *policy.Store
+
+	// reloader is nil if reloading is not supported.
+	reloader Reloader
+}
+
+// ReloadReport describes what a reload of the configuration applied.
+type ReloadReport struct {
+	Time time.Time `json:"time"`
+
+	// Applied are the sections of the configuration that changed and were
+	// applied.
+	Applied []string `json:"applied"`
+
+	// Restarted are the components that were restarted or rebuilt to apply
+	// the changes.
+	Restarted []string `json:"restarted"`
+
+	// RequiresRestart are the sections of the configuration that changed,
+	// but can only be applied by restarting the process.
+	RequiresRestart []string `json:"requires_restart"`
+
+	// Error is set if the reload failed before anything was applied.
+	Error string `json:"error,omitempty"`
+}
+
+// LogFields renders the report as a set of Logrus fields.
+func (r ReloadReport) LogFields() log.Fields {
+	return log.Fields{
+		"applied":         r.Applied,
+		"restarted":       r.Restarted,
+		"requiresRestart": r.RequiresRestart,
+		"error":           r.Error,
+	}
+}
+
+// Reloader reloads the configuration of a tracker.
+type Reloader interface {
+	// RequestReload requests reloading the configuration. It must not wait
+	// for the reload, since reloading may restart the Server.
+	RequestReload()
+
+	// LastReload returns the report of the last reload, or nil if the
+	// configuration has not been reloaded.
+	LastReload() *ReloadReport
+}
+
+// NewServer starts serving the admin API for store, bans and policies.
+//
+// Swarms are listed using lister, which may be nil if they can't be listed.
+// It is separate from store, so that store may wrap the PeerStore that can
+// list its swarms.
+//
+// reloader may be nil if reloading is not supported.
+func NewServer(provided Config, store storage.PeerStore, lister storage.SwarmLister, bans *Bans, policies *policy.Store, reloader Reloader) (*Server, error) {
+	if err := checkConfig(provided); err != nil {
+		return nil, err
+	}
+	cfg := provided.Validate()
+
+	s := &Server{
+		cfg:      cfg,
+		store:    store,
+		lister:   lister,
+		bans:     bans,
+		policies: policies,
+		reloader: reloader,
+	}
+
+	tlsCfg, err := loadTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// The sockets are bound before returning, so that privileges can be
+	// dropped afterwards. On upgrades, they are taken over from the
+	// previous process.
+	if cfg.Addr != "" {
+		s.l, err = handoff.Listen("tcp", cfg.Addr, func() (net.Listener, error) {
+			return net.Listen("tcp", cfg.Addr)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.GRPCAddr != "" {
+		s.gl, err = handoff.Listen("tcp", cfg.GRPCAddr, func() (net.Listener, error) {
+			return net.Listen("tcp", cfg.GRPCAddr)
+		})
+		if err != nil {
+			if s.l != nil {
+				s.l.Close()
+			}
+			return nil, err
+		}
+	}
+
+	if s.l != nil {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/stats", s.serveStats)
+		mux.HandleFunc("/stats/rejections", s.serveRejections)
+		mux.HandleFunc("/torrents", s.serveTorrents)
+		mux.HandleFunc("/torrents/", s.serveTorrent)
+		mux.HandleFunc("/bans", s.serveBans)
+		mux.HandleFunc("/bans/", s.serveBan)
+		mux.HandleFunc("/policies", s.servePolicies)
+		mux.HandleFunc("/policies/", s.servePolicy)
+		mux.HandleFunc("/history", s.serveWatches)
+		mux.HandleFunc("/history/", s.serveHistory)
+		mux.HandleFunc("/merges", s.serveMerges)
+		mux.HandleFunc("/reload", s.serveReload)
+		s.srv = &http.Server{
+			Handler:      s.authenticate(mux),
+			ReadTimeout:  cfg.RequestTimeout,
+			WriteTimeout: cfg.RequestTimeout,
+			TLSConfig:    tlsCfg,
+		}
+
+		go func() {
+			var err error
+			if s.srv.TLSConfig != nil {
+				err = s.srv.ServeTLS(s.l, "", "")
+			} else {
+				err = s.srv.Serve(s.l)
+			}
+			if err != http.ErrServerClosed {
+				log.Fatal("failed while serving admin API", log.Err(err))
+			}
+		}()
+	}
+
+	if s.gl != nil {
+		opts := []grpc.ServerOption{grpc.UnaryInterceptor(s.interceptGRPC)}
+		if tlsCfg != nil {
+			opts = append(opts, grpc.Creds(credentials.NewTLS(tlsCfg)))
+		}
+		s.grpc = grpc.NewServer(opts...)
+		adminpb.RegisterAdminServer(s.grpc, grpcServer{s})
+
+		go func() {
+			if err := s.grpc.Serve(s.gl); err != nil {
+				log.Fatal("failed while serving admin gRPC service", log.Err(err))
+			}
+		}()
+	}
+
+	return s, nil
+}
+
+// loadTLSConfig returns the TLS configuration shared by the HTTP API and the
+// gRPC service, or nil if TLS is not enabled.
+func loadTLSConfig(cfg Config) (*tls.Config, error) {
+	if cfg.TLSCertPath == "" {
+		return nil, nil
+	}
+
+	tlsCfg := &tls.Config{Certificates: make([]tls.Certificate, 1)}
+	var err error
+	tlsCfg.Certificates[0], err = tls.LoadX509KeyPair(cfg.TLSCertPath, cfg.TLSKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.ClientCAPath != "" {
+		pem, err := ioutil.ReadFile(cfg.ClientCAPath)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.ClientCAs = x509.NewCertPool()
+		if !tlsCfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("admin: no certificates found in " + cfg.ClientCAPath)
+		}
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsCfg, nil
+}
+
+// Addr returns the address the HTTP API is served on, or nil if it is not
+// served.
+func (s *Server) Addr() net.Addr {
+	if s.l == nil {
+		return nil
+	}
+	return s.l.Addr()
+}
+
+// GRPCAddr returns the address the gRPC service is served on, or nil if it
+// is not served.
+func (s *Server) GRPCAddr() net.Addr {
+	if s.gl == nil {
+		return nil
+	}
+	return s.gl.Addr()
+}
+
+// Stop shuts down the server.
+func (s *Server) Stop() stop.Result {
+	c := make(stop.Channel)
+	go func() {
+		if s.grpc != nil {
+			s.grpc.GracefulStop()
+		}
+		if s.srv == nil {
+			c.Done()
+			return
+		}
+		c.Done(s.srv.Shutdown(context.Background()))
+	}()
+
+	return c.Result()
+}
+
+// authorized returns whether the value of the Authorization header of a
+// request or the authorization metadata of a call carries the configured
+// token.
+//
+// Client certificates are verified by the TLS handshake.
+func (s *Server) authorized(authorization string) bool {
+	if s.cfg.Token == "" {
+		return true
+	}
+	token := strings.TrimPrefix(authorization, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.Token)) == 1
+}
+
+// authenticate requires the configured token for all requests.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.authorized(r.Header.Get("Authorization")) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Debug("failed to write admin API response", log.Err(err))
+	}
+}
+
+// methodNotAllowed responds that the request method is not supported.
+func methodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+}
+
+// Torrent is the state of a torrent over both address families.
+//
+// Created and LastAnnounce are only set if the storage tracks the activity
+// of swarms.
+type Torrent struct {
+	InfoHash     string     `json:"info_hash"`
+	Seeders      uint32     `json:"seeders"`
+	Leechers     uint32     `json:"leechers"`
+	Snatches     uint32     `json:"snatches"`
+	Created      *time.Time `json:"created,omitempty"`
+	LastAnnounce *time.Time `json:"last_announce,omitempty"`
+}
+
+// Merge is a class of equivalent infohashes, whose swarms are merged into the
+// swarm of Canonical.
+type Merge struct {
+	Canonical  string   `json:"canonical"`
+	InfoHashes []string `json:"info_hashes"`
+}
+
+// Merger is implemented by PeerStores that merge the swarms of equivalent
+// infohashes.
+type Merger interface {
+	// Classes returns the classes of equivalent infohashes. The first
+	// infohash of a class is the one its swarm is stored under.
+	Classes() [][]bittorrent.InfoHash
+}
+
+// Peer is a peer of a torrent.
+type Peer struct {
+	ID   string `json:"id"`
+	IP   string `json:"ip"`
+	Port uint16 `json:"port"`
+}
+
+// Swarm is the state of a torrent including its peers.
+type Swarm struct {
+	Torrent
+	SeederPeers  []Peer `json:"seeder_peers"`
+	LeecherPeers []Peer `json:"leecher_peers"`
+}
+
+// Stats are the numbers of torrents and peers.
+type Stats struct {
+	Torrents int    `json:"torrents"`
+	Seeders  uint64 `json:"seeders"`
+	Leechers uint64 `json:"leechers"`
+}
+
+// torrent returns the state of the torrent ih over both address families.
+func (s *Server) torrent(ctx context.Context, ih bittorrent.InfoHash) Torrent {
+	t := Torrent{InfoHash: ih.String()}
+	for _, af := range []bittorrent.AddressFamily{bittorrent.IPv4, bittorrent.IPv6} {
+		scrape := s.store.ScrapeSwarm(ctx, ih, af)
+		t.Seeders += scrape.Complete
+		t.Leechers += scrape.Incomplete
+		t.Snatches += scrape.Snatches
+
+		activity, ok := storage.Activity(ctx, s.store, ih, af)
+		if !ok {
+			continue
+		}
+		if t.Created == nil || activity.Created.Before(*t.Created) {
+			created := activity.Created.UTC()
+			t.Created = &created
+		}
+		if t.LastAnnounce == nil || activity.LastAnnounce.After(*t.LastAnnounce) {
+			lastAnnounce := activity.LastAnnounce.UTC()
+			t.LastAnnounce = &lastAnnounce
+		}
+	}
+	return t
+}
+
+// listTorrents returns all torrents, or an error if the swarms can't be
+// listed.
+func (s *Server) listTorrents(ctx context.Context) ([]Torrent, error) {
+	if s.lister == nil {
+		return nil, errNoLister
+	}
+
+	infoHashes, err := s.lister.ListSwarms(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	torrents := make([]Torrent, 0, len(infoHashes))
+	for _, ih := range infoHashes {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		torrents = append(torrents, s.torrent(ctx, ih))
+	}
+	return torrents, nil
+}
+
+// torrents returns all torrents with peers or, if idle is positive, all
+// torrents not announced to within idle.
+func (s *Server) torrents(ctx context.Context, idle time.Duration) ([]Torrent, error) {
+	if idle > 0 {
+		if _, ok := s.store.(storage.ActivityReporter); !ok {
+			return nil, errNoActivity
+		}
+	}
+
+	torrents, err := s.listTorrents(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if idle > 0 {
+		// Abandoned swarms may have peers that stopped announcing and
+		// were not garbage collected yet, so they are listed either way.
+		cutoff := time.Now().Add(-idle)
+		abandoned := torrents[:0]
+		for _, t := range torrents {
+			if t.LastAnnounce != nil && t.LastAnnounce.Before(cutoff) {
+				abandoned = append(abandoned, t)
+			}
+		}
+		return abandoned, nil
+	}
+
+	// Swarms without peers may be listed until they are garbage collected.
+	active := torrents[:0]
+	for _, t := range torrents {
+		if t.Seeders+t.Leechers > 0 {
+			active = append(active, t)
+		}
+	}
+	return active, nil
+}
+
+// stats sums up the torrents with peers.
+func (s *Server) stats(ctx context.Context) (Stats, error) {
+	torrents, err := s.torrents(ctx, 0)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	var stats Stats
+	for _, t := range torrents {
+		stats.Torrents++
+		stats.Seeders += uint64(t.Seeders)
+		stats.Leechers += uint64(t.Leechers)
+	}
+	return stats, nil
+}
+
+// unsupportedStatus returns the HTTP status of an error returned while
+// listing torrents.
+func unsupportedStatus(err error) int {
+	if err == errNoLister || err == errNoActivity {
+		return http.StatusNotImplemented
+	}
+	return http.StatusInternalServerError
+}
+
+func (s *Server) serveStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	stats, err := s.stats(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), unsupportedStatus(err))
+		return
+	}
+	writeJSON(w, stats)
+}
+
+// defaultRejectionWindow is the window rejections are aggregated over if none
+// is requested.
+const defaultRejectionWindow = time.Hour
+
+func (s *Server) serveRejections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	window := defaultRejectionWindow
+	if param := r.URL.Query().Get("window"); param != "" {
+		var err error
+		window, err = time.ParseDuration(param)
+		if err != nil || window <= 0 {
+			http.Error(w, "invalid window", http.StatusBadRequest)
+			return
+		}
+	}
+	writeJSON(w, middleware.Rejections(window))
+}
+
+func (s *Server) serveTorrents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	var idle time.Duration
+	if param := r.URL.Query().Get("idle"); param != "" {
+		var err error
+		idle, err = time.ParseDuration(param)
+		if err != nil || idle <= 0 {
+			http.Error(w, errInvalidIdle.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	torrents, err := s.torrents(r.Context(), idle)
+	if err != nil {
+		http.Error(w, err.Error(), unsupportedStatus(err))
+		return
+	}
+	writeJSON(w, torrents)
+}
+
+// swarmPeers returns the seeders and leechers of ih of both address families.
+func (s *Server) swarmPeers(ctx context.Context, ih bittorrent.InfoHash) (seeders, leechers []bittorrent.Peer, err error) {
+	// The announcer is excluded from the peers returned, so a peer that
+	// can't be stored is used.
+	for _, announcer := range []bittorrent.Peer{
+		{IP: bittorrent.IP{IP: net.IPv4zero.To4(), AddressFamily: bittorrent.IPv4}},
+		{IP: bittorrent.IP{IP: net.IPv6zero, AddressFamily: bittorrent.IPv6}},
+	} {
+		ps, err := s.store.AnnounceSeeders(ctx, ih, maxPeers, announcer)
+		if err != nil && err != storage.ErrResourceDoesNotExist {
+			return nil, nil, err
+		}
+		seeders = append(seeders, ps...)
+
+		ps, err = s.store.AnnounceLeechers(ctx, ih, maxPeers, announcer)
+		if err != nil && err != storage.ErrResourceDoesNotExist {
+			return nil, nil, err
+		}
+		leechers = append(leechers, ps...)
+	}
+	return seeders, leechers, nil
+}
+
+func encodePeers(peers []bittorrent.Peer) []Peer {
+	encoded := make([]Peer, 0, len(peers))
+	for _, p := range peers {
+		encoded = append(encoded, Peer{ID: hex.EncodeToString(p.ID[:]), IP: p.IP.String(), Port: p.Port})
+	}
+	return encoded
+}
+
+// parseInfoHash parses a hex-encoded infohash.
+func parseInfoHash(s string) (bittorrent.InfoHash, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 20 {
+		return bittorrent.InfoHash{}, errInvalidHash
+	}
+	return bittorrent.InfoHashFromBytes(b), nil
+}
+
+// dropTorrent removes all peers of ih and returns how many were removed.
+func (s *Server) dropTorrent(ctx context.Context, ih bittorrent.InfoHash) (int, error) {
+	seeders, leechers, err := s.swarmPeers(ctx, ih)
+	if err != nil {
+		return 0, err
+	}
+
+	// Peers announcing again are added back, unless the torrent is also
+	// blocked by a middleware.
+	deleted := 0
+	for _, p := range seeders {
+		if err := s.store.DeleteSeeder(ctx, ih, p); err == nil {
+			deleted++
+		}
+	}
+	for _, p := range leechers {
+		if err := s.store.DeleteLeecher(ctx, ih, p); err == nil {
+			deleted++
+		}
+	}
+	log.Info("admin: dropped torrent", log.Fields{"infoHash": ih, "peers": deleted})
+	return deleted, nil
+}
+
+func (s *Server) serveTorrent(w http.ResponseWriter, r *http.Request) {
+	ih, err := parseInfoHash(strings.TrimPrefix(r.URL.Path, "/torrents/"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		seeders, leechers, err := s.swarmPeers(r.Context(), ih)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, Swarm{
+			Torrent:      s.torrent(r.Context(), ih),
+			SeederPeers:  encodePeers(seeders),
+			LeecherPeers: encodePeers(leechers),
+		})
+
+	case http.MethodDelete:
+		deleted, err := s.dropTorrent(r.Context(), ih)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, map[string]int{"deleted_peers": deleted})
+
+	default:
+		methodNotAllowed(w, http.MethodGet+", "+http.MethodDelete)
+	}
+}
+
+func (s *Server) serveBans(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	writeJSON(w, s.bans.List())
+}
+
+// serveMerges lists the classes of equivalent infohashes, which is empty
+// unless the store merges swarms.
+func (s *Server) serveMerges(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	merges := []Merge{}
+	if m, ok := s.store.(Merger); ok {
+		for _, class := range m.Classes() {
+			merge := Merge{Canonical: class[0].String(), InfoHashes: make([]string, len(class))}
+			for i, ih := range class {
+				merge.InfoHashes[i] = ih.String()
+			}
+			merges = append(merges, merge)
+		}
+	}
+	writeJSON(w, merges)
+}
+
+func (s *Server) serveBan(w http.ResponseWriter, r *http.Request) {
+	ban := strings.TrimPrefix(r.URL.Path, "/bans/")
+
+	var err error
+	switch r.Method {
+	case http.MethodPut:
+		ban, err = s.bans.Add(ban)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Info("admin: banned IP addresses", log.Fields{"range": ban})
+		writeJSON(w, ban)
+
+	case http.MethodDelete:
+		found, err := s.bans.Remove(ban)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !found {
+			http.Error(w, "not banned", http.StatusNotFound)
+			return
+		}
+		log.Info("admin: lifted ban", log.Fields{"range": ban})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		methodNotAllowed(w, http.MethodPut+", "+http.MethodDelete)
+	}
+}
+
+func (s *Server) serveWatches(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	writeJSON(w, middleware.WatchedAnnounces())
+}
+
+// serveHistory serves the announce history of a peer. The number of
+// announces recorded can be given as the size parameter when watching it.
+func (s *Server) serveHistory(w http.ResponseWriter, r *http.Request) {
+	peer := strings.TrimPrefix(r.URL.Path, "/history/")
+
+	switch r.Method {
+	case http.MethodGet:
+		history, err := middleware.AnnounceHistory(peer)
+		if err == middleware.ErrNotWatched {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, history)
+
+	case http.MethodPut:
+		var size int
+		if param := r.URL.Query().Get("size"); param != "" {
+			var err error
+			if size, err = strconv.Atoi(param); err != nil || size <= 0 {
+				http.Error(w, "invalid size", http.StatusBadRequest)
+				return
+			}
+		}
+		key, err := middleware.WatchAnnounces(peer, size)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Info("admin: recording the announces of a peer", log.Fields{"peer": key})
+		writeJSON(w, key)
+
+	case http.MethodDelete:
+		found, err := middleware.UnwatchAnnounces(peer)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !found {
+			http.Error(w, middleware.ErrNotWatched.Error(), http.StatusNotFound)
+			return
+		}
+		log.Info("admin: stopped recording the announces of a peer", log.Fields{"peer": peer})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		methodNotAllowed(w, http.MethodGet+", "+http.MethodPut+", "+http.MethodDelete)
+	}
+}
+
+// maxPolicySize is the maximum size of a policy in a request body.
+const maxPolicySize = 1 << 16
+
+func (s *Server) servePolicies(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	writeJSON(w, s.policies.List())
+}
+
+func (s *Server) servePolicy(w http.ResponseWriter, r *http.Request) {
+	ih, err := policy.ParseInfoHash(strings.TrimPrefix(r.URL.Path, "/policies/"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		p, ok := s.policies.Get(ih)
+		if !ok {
+			http.Error(w, "no policy", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, p)
+
+	case http.MethodPut:
+		var p policy.Policy
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxPolicySize)).Decode(&p); err != nil {
+			http.Error(w, "invalid policy: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := p.Validate(); err != nil {
+			http.Error(w, "invalid policy: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.policies.Set(ih, p); err != nil {
+			// The policy applies, but is lost when reloading.
+			http.Error(w, "failed to save policy: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Info("admin: set torrent policy", log.Fields{"infoHash": ih, "policy": p})
+		writeJSON(w, p)
+
+	case http.MethodDelete:
+		found, err := s.policies.Delete(ih)
+		if err != nil {
+			http.Error(w, "failed to save policies: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "no policy", http.StatusNotFound)
+			return
+		}
+		log.Info("admin: removed torrent policy", log.Fields{"infoHash": ih})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		methodNotAllowed(w, http.MethodGet+", "+http.MethodPut+", "+http.MethodDelete)
+	}
+}
+
+func (s *Server) serveReload(w http.ResponseWriter, r *http.Request) {
+	if s.reloader == nil {
+		http.Error(w, "reloading is not supported", http.StatusNotImplemented)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		report := s.reloader.LastReload()
+		if report == nil {
+			http.Error(w, "not reloaded yet", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, report)
+
+	case http.MethodPost:
+		log.Info("admin: requested reload")
+		s.reloader.RequestReload()
+		w.WriteHeader(http.StatusAccepted)
+
+	default:
+		methodNotAllowed(w, http.MethodGet+", "+http.MethodPost)
+	}
+}
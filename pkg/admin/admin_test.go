@@ -0,0 +1,357 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/admin/adminpb"
+	"github.com/chihaya/chihaya/pkg/policy"
+	"github.com/chihaya/chihaya/storage"
+	"github.com/chihaya/chihaya/storage/memory"
+	"github.com/chihaya/chihaya/storage/merge"
+)
+
+func TestCheckConfig(t *testing.T) {
+	var table = []struct {
+		cfg      Config
+		expected error
+	}{
+		{Config{Token: "t"}, ErrNoAddr},
+		{Config{Addr: ":0"}, ErrNoAuthentication},
+		{Config{Addr: ":0", Token: "t", TLSCertPath: "cert"}, ErrIncompleteTLS},
+		{Config{Addr: ":0", ClientCAPath: "ca"}, ErrIncompleteTLS},
+		{Config{Addr: ":0", Token: "t"}, nil},
+		{Config{GRPCAddr: ":0", Token: "t"}, nil},
+		{Config{Addr: ":0", TLSCertPath: "cert", TLSKeyPath: "key", ClientCAPath: "ca"}, nil},
+	}
+
+	for _, tt := range table {
+		require.Equal(t, tt.expected, checkConfig(tt.cfg))
+	}
+}
+
+func TestBans(t *testing.T) {
+	b := NewBans()
+
+	ban, err := b.Add("10.0.0.1")
+	require.Nil(t, err)
+	require.Equal(t, "10.0.0.1/32", ban)
+	ban, err = b.Add("2001:db8::/32")
+	require.Nil(t, err)
+	require.Equal(t, "2001:db8::/32", ban)
+	_, err = b.Add("not an ip")
+	require.NotNil(t, err)
+
+	require.Equal(t, []string{"10.0.0.1/32", "2001:db8::/32"}, b.List())
+	require.True(t, b.Banned(net.ParseIP("10.0.0.1")))
+	require.False(t, b.Banned(net.ParseIP("10.0.0.2")))
+	require.True(t, b.Banned(net.ParseIP("2001:db8::1")))
+
+	req := &bittorrent.AnnounceRequest{Peer: bittorrent.Peer{IP: bittorrent.IP{IP: net.ParseIP("10.0.0.1").To4(), AddressFamily: bittorrent.IPv4}}}
+	_, err = b.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+	require.Equal(t, ErrBanned, err)
+
+	found, err := b.Remove("10.0.0.1/32")
+	require.Nil(t, err)
+	require.True(t, found)
+	found, err = b.Remove("10.0.0.1")
+	require.Nil(t, err)
+	require.False(t, found)
+
+	_, err = b.HandleAnnounce(context.Background(), req, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+}
+
+func TestServer(t *testing.T) {
+	ps, err := memory.New(memory.Config{ShardCount: 1, GarbageCollectionInterval: time.Hour, PeerLifetime: time.Hour})
+	require.Nil(t, err)
+	defer func() { ps.Stop().Wait() }()
+
+	bans := NewBans()
+	reloader := &fakeReloader{}
+	s, err := NewServer(Config{Addr: "127.0.0.1:0", Token: "secret"}, ps, ps.(storage.SwarmLister), bans, policy.NewStore(), reloader)
+	require.Nil(t, err)
+	defer func() { s.Stop().Wait() }()
+
+	ctx := context.Background()
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	peer := func(port uint16) bittorrent.Peer {
+		return bittorrent.Peer{
+			ID:   bittorrent.PeerID{byte(port)},
+			IP:   bittorrent.IP{IP: net.ParseIP("10.0.0.1").To4(), AddressFamily: bittorrent.IPv4},
+			Port: port,
+		}
+	}
+	require.Nil(t, ps.PutSeeder(ctx, ih, peer(1)))
+	require.Nil(t, ps.PutLeecher(ctx, ih, peer(2)))
+	require.Nil(t, ps.PutLeecher(ctx, ih, peer(3)))
+
+	do := func(method, path, token string, v interface{}) int {
+		req, err := http.NewRequest(method, "http://"+s.Addr().String()+path, nil)
+		require.Nil(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		defer resp.Body.Close()
+		if v != nil && resp.StatusCode == http.StatusOK {
+			require.Nil(t, json.NewDecoder(resp.Body).Decode(v))
+		}
+		return resp.StatusCode
+	}
+
+	require.Equal(t, http.StatusUnauthorized, do("GET", "/stats", "wrong", nil))
+
+	var stats Stats
+	require.Equal(t, http.StatusOK, do("GET", "/stats", "secret", &stats))
+	require.Equal(t, Stats{Torrents: 1, Seeders: 1, Leechers: 2}, stats)
+
+	var torrents []Torrent
+	require.Equal(t, http.StatusOK, do("GET", "/torrents", "secret", &torrents))
+	require.Len(t, torrents, 1)
+	require.NotNil(t, torrents[0].Created)
+	require.NotNil(t, torrents[0].LastAnnounce)
+	require.False(t, torrents[0].LastAnnounce.Before(*torrents[0].Created))
+	torrents[0].Created, torrents[0].LastAnnounce = nil, nil
+	require.Equal(t, []Torrent{{InfoHash: ih.String(), Seeders: 1, Leechers: 2}}, torrents)
+
+	require.Equal(t, http.StatusOK, do("GET", "/torrents?idle=1h", "secret", &torrents))
+	require.Empty(t, torrents)
+	require.Equal(t, http.StatusBadRequest, do("GET", "/torrents?idle=never", "secret", nil))
+
+	var swarm Swarm
+	require.Equal(t, http.StatusOK, do("GET", "/torrents/"+ih.String(), "secret", &swarm))
+	require.Len(t, swarm.SeederPeers, 1)
+	require.Len(t, swarm.LeecherPeers, 2)
+	require.Equal(t, Peer{ID: "0100000000000000000000000000000000000000", IP: "10.0.0.1", Port: 1}, swarm.SeederPeers[0])
+	require.Equal(t, http.StatusBadRequest, do("GET", "/torrents/00", "secret", nil))
+
+	var deleted map[string]int
+	require.Equal(t, http.StatusOK, do("DELETE", "/torrents/"+ih.String(), "secret", &deleted))
+	require.Equal(t, 3, deleted["deleted_peers"])
+	require.Equal(t, bittorrent.Scrape{InfoHash: ih}, ps.ScrapeSwarm(ctx, ih, bittorrent.IPv4))
+
+	require.Equal(t, http.StatusOK, do("PUT", "/bans/10.0.0.0/8", "secret", nil))
+	require.True(t, bans.Banned(net.ParseIP("10.1.2.3")))
+	var list []string
+	require.Equal(t, http.StatusOK, do("GET", "/bans", "secret", &list))
+	require.Equal(t, []string{"10.0.0.0/8"}, list)
+	require.Equal(t, http.StatusNoContent, do("DELETE", "/bans/10.0.0.0%2F8", "secret", nil))
+	require.Equal(t, http.StatusNotFound, do("DELETE", "/bans/10.0.0.0/8", "secret", nil))
+	require.Equal(t, http.StatusBadRequest, do("PUT", "/bans/nonsense", "secret", nil))
+
+	require.Equal(t, http.StatusNotFound, do("GET", "/reload", "secret", nil))
+	require.Equal(t, http.StatusAccepted, do("POST", "/reload", "secret", nil))
+	require.Equal(t, 1, reloader.requests)
+	reloader.report = &ReloadReport{Applied: []string{"middleware"}, Restarted: []string{"middleware"}, RequiresRestart: []string{"storage"}}
+	var report ReloadReport
+	require.Equal(t, http.StatusOK, do("GET", "/reload", "secret", &report))
+	require.Equal(t, *reloader.report, report)
+	require.Equal(t, http.StatusMethodNotAllowed, do("PUT", "/reload", "secret", nil))
+
+	var rejections middleware.RejectionSummary
+	require.Equal(t, http.StatusOK, do("GET", "/stats/rejections?window=24h", "secret", &rejections))
+	require.Equal(t, "24h0m0s", rejections.Window)
+	require.Equal(t, http.StatusBadRequest, do("GET", "/stats/rejections?window=-1h", "secret", nil))
+}
+
+func TestGRPCServer(t *testing.T) {
+	ps, err := memory.New(memory.Config{ShardCount: 1, GarbageCollectionInterval: time.Hour, PeerLifetime: time.Hour})
+	require.Nil(t, err)
+	defer func() { ps.Stop().Wait() }()
+
+	bans := NewBans()
+	s, err := NewServer(Config{GRPCAddr: "127.0.0.1:0", Token: "secret"}, ps, ps.(storage.SwarmLister), bans, policy.NewStore(), nil)
+	require.Nil(t, err)
+	defer func() { s.Stop().Wait() }()
+	require.Nil(t, s.Addr())
+
+	ctx := context.Background()
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	peer := func(port uint16) bittorrent.Peer {
+		return bittorrent.Peer{
+			ID:   bittorrent.PeerID{byte(port)},
+			IP:   bittorrent.IP{IP: net.ParseIP("10.0.0.1").To4(), AddressFamily: bittorrent.IPv4},
+			Port: port,
+		}
+	}
+	require.Nil(t, ps.PutSeeder(ctx, ih, peer(1)))
+	require.Nil(t, ps.PutLeecher(ctx, ih, peer(2)))
+
+	dial := func(token string) *grpc.ClientConn {
+		cc, err := grpc.Dial(s.GRPCAddr().String(),
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpc.WithPerRPCCredentials(TokenCredentials{Token: token, Insecure: true}))
+		require.Nil(t, err)
+		return cc
+	}
+
+	wrong := dial("wrong")
+	defer wrong.Close()
+	_, err = adminpb.NewAdminClient(wrong).Stats(ctx, &adminpb.StatsRequest{})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	cc := dial("secret")
+	defer cc.Close()
+	c := adminpb.NewAdminClient(cc)
+	stats, err := c.Stats(ctx, &adminpb.StatsRequest{})
+	require.Nil(t, err)
+	require.Equal(t, uint64(1), stats.Torrents)
+	require.Equal(t, uint64(1), stats.Seeders)
+	require.Equal(t, uint64(1), stats.Leechers)
+
+	torrents, err := c.ListTorrents(ctx, &adminpb.ListTorrentsRequest{})
+	require.Nil(t, err)
+	require.Len(t, torrents.Torrents, 1)
+	require.Equal(t, ih.String(), torrents.Torrents[0].InfoHash)
+	require.NotNil(t, torrents.Torrents[0].LastAnnounce)
+
+	torrents, err = c.ListTorrents(ctx, &adminpb.ListTorrentsRequest{Idle: durationpb.New(time.Hour)})
+	require.Nil(t, err)
+	require.Empty(t, torrents.Torrents)
+	_, err = c.ListTorrents(ctx, &adminpb.ListTorrentsRequest{Idle: durationpb.New(-time.Hour)})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	swarm, err := c.GetSwarm(ctx, &adminpb.GetSwarmRequest{InfoHash: ih.String()})
+	require.Nil(t, err)
+	require.Equal(t, uint32(1), swarm.Torrent.Seeders)
+	require.Len(t, swarm.Seeders, 1)
+	require.Len(t, swarm.Leechers, 1)
+	require.Equal(t, "0100000000000000000000000000000000000000", swarm.Seeders[0].Id)
+	require.Equal(t, "10.0.0.1", swarm.Seeders[0].Ip)
+	require.Equal(t, uint32(1), swarm.Seeders[0].Port)
+	_, err = c.GetSwarm(ctx, &adminpb.GetSwarmRequest{InfoHash: "00"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	dropped, err := c.DropTorrent(ctx, &adminpb.DropTorrentRequest{InfoHash: ih.String()})
+	require.Nil(t, err)
+	require.Equal(t, uint32(2), dropped.DeletedPeers)
+	require.Equal(t, bittorrent.Scrape{InfoHash: ih}, ps.ScrapeSwarm(ctx, ih, bittorrent.IPv4))
+
+	banned, err := c.BanIP(ctx, &adminpb.BanIPRequest{Ban: "10.0.0.0/8"})
+	require.Nil(t, err)
+	require.Equal(t, "10.0.0.0/8", banned.Ban)
+	require.True(t, bans.Banned(net.ParseIP("10.1.2.3")))
+	list, err := c.ListBans(ctx, &adminpb.ListBansRequest{})
+	require.Nil(t, err)
+	require.Equal(t, []string{"10.0.0.0/8"}, list.Bans)
+	_, err = c.UnbanIP(ctx, &adminpb.UnbanIPRequest{Ban: "10.0.0.0/8"})
+	require.Nil(t, err)
+	_, err = c.UnbanIP(ctx, &adminpb.UnbanIPRequest{Ban: "10.0.0.0/8"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = c.BanIP(ctx, &adminpb.BanIPRequest{Ban: "nonsense"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+type fakeReloader struct {
+	requests int
+	report   *ReloadReport
+}
+
+func (r *fakeReloader) RequestReload()            { r.requests++ }
+func (r *fakeReloader) LastReload() *ReloadReport { return r.report }
+
+func TestClient(t *testing.T) {
+	ps, err := memory.New(memory.Config{ShardCount: 1, GarbageCollectionInterval: time.Hour, PeerLifetime: time.Hour})
+	require.Nil(t, err)
+	defer func() { ps.Stop().Wait() }()
+
+	s, err := NewServer(Config{Addr: "127.0.0.1:0", Token: "secret"}, ps, ps.(storage.SwarmLister), NewBans(), policy.NewStore(), nil)
+	require.Nil(t, err)
+	defer func() { s.Stop().Wait() }()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	peer := bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("00000000000000000001"),
+		IP:   bittorrent.IP{IP: net.ParseIP("10.0.0.1").To4(), AddressFamily: bittorrent.IPv4},
+		Port: 1,
+	}
+	require.Nil(t, ps.PutSeeder(context.Background(), ih, peer))
+
+	_, err = NewClient("http://"+s.Addr().String(), "wrong", nil).Stats()
+	require.NotNil(t, err)
+
+	c := NewClient("http://"+s.Addr().String()+"/", "secret", nil)
+	stats, err := c.Stats()
+	require.Nil(t, err)
+	require.Equal(t, Stats{Torrents: 1, Seeders: 1}, stats)
+
+	torrents, err := c.Torrents()
+	require.Nil(t, err)
+	require.Len(t, torrents, 1)
+	torrents[0].Created, torrents[0].LastAnnounce = nil, nil
+	require.Equal(t, []Torrent{{InfoHash: ih.String(), Seeders: 1}}, torrents)
+
+	torrents, err = c.IdleTorrents(time.Hour)
+	require.Nil(t, err)
+	require.Empty(t, torrents)
+
+	swarm, err := c.Swarm(ih)
+	require.Nil(t, err)
+	require.Len(t, swarm.SeederPeers, 1)
+
+	banned, err := c.Ban("10.0.0.0/8")
+	require.Nil(t, err)
+	require.Equal(t, "10.0.0.0/8", banned)
+	bans, err := c.Bans()
+	require.Nil(t, err)
+	require.Equal(t, []string{"10.0.0.0/8"}, bans)
+	require.Nil(t, c.Unban("10.0.0.0/8"))
+	require.NotNil(t, c.Unban("10.0.0.0/8"))
+
+	require.Nil(t, c.SetPolicy(ih, policy.Policy{Interval: time.Hour, Freeleech: true}))
+	require.NotNil(t, c.SetPolicy(ih, policy.Policy{Approval: "maybe"}))
+	p, err := c.Policy(ih)
+	require.Nil(t, err)
+	require.Equal(t, policy.Policy{Interval: time.Hour, Freeleech: true}, p)
+	policies, err := c.Policies()
+	require.Nil(t, err)
+	require.Equal(t, map[string]policy.Policy{ih.String(): p}, policies)
+	require.Nil(t, c.DeletePolicy(ih))
+	require.NotNil(t, c.DeletePolicy(ih))
+	_, err = c.Policy(ih)
+	require.NotNil(t, err)
+
+	deleted, err := c.DropSwarm(ih)
+	require.Nil(t, err)
+	require.Equal(t, 1, deleted)
+
+	// The swarms of this Server are not merged.
+	merges, err := c.Merges()
+	require.Nil(t, err)
+	require.Empty(t, merges)
+
+	// Reloading is not supported by this Server.
+	require.NotNil(t, c.Reload())
+}
+
+func TestMerges(t *testing.T) {
+	ps, err := memory.New(memory.Config{ShardCount: 1, GarbageCollectionInterval: time.Hour, PeerLifetime: time.Hour})
+	require.Nil(t, err)
+	defer func() { ps.Stop().Wait() }()
+
+	v1, v2 := strings.Repeat("a", 40), strings.Repeat("b", 64)
+	store, err := merge.New(ps, merge.Config{Classes: [][]string{{v1, v2}}})
+	require.Nil(t, err)
+
+	s, err := NewServer(Config{Addr: "127.0.0.1:0", Token: "secret"}, store, ps.(storage.SwarmLister), NewBans(), policy.NewStore(), nil)
+	require.Nil(t, err)
+	defer func() { s.Stop().Wait() }()
+
+	merges, err := NewClient("http://"+s.Addr().String(), "secret", nil).Merges()
+	require.Nil(t, err)
+	require.Equal(t, []Merge{{Canonical: v1, InfoHashes: []string{v1, v2[:40]}}}, merges)
+}
@@ -0,0 +1,171 @@
+// Package adminpb implements the messages and the gRPC service defined in
+// admin.proto, which is the admin API of chihaya served over gRPC.
+//
+// The types are written by hand instead of being generated by protoc, so that
+// building chihaya doesn't require the protobuf compiler. They follow the
+// naming of protoc-gen-go, and must be kept in sync with admin.proto.
+package adminpb
+
+import (
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// StatsRequest is the request of Admin.Stats.
+type StatsRequest struct{}
+
+func (m *StatsRequest) Reset()         { *m = StatsRequest{} }
+func (m *StatsRequest) String() string { return proto.CompactTextString(m) }
+func (*StatsRequest) ProtoMessage()    {}
+
+// StatsResponse are the numbers of torrents with peers, and their seeders and
+// leechers.
+type StatsResponse struct {
+	Torrents uint64 `protobuf:"varint,1,opt,name=torrents,proto3" json:"torrents,omitempty"`
+	Seeders  uint64 `protobuf:"varint,2,opt,name=seeders,proto3" json:"seeders,omitempty"`
+	Leechers uint64 `protobuf:"varint,3,opt,name=leechers,proto3" json:"leechers,omitempty"`
+}
+
+func (m *StatsResponse) Reset()         { *m = StatsResponse{} }
+func (m *StatsResponse) String() string { return proto.CompactTextString(m) }
+func (*StatsResponse) ProtoMessage()    {}
+
+// Torrent is the state of a torrent over both address families.
+//
+// Created and LastAnnounce are only set if the storage tracks the activity
+// of swarms.
+type Torrent struct {
+	InfoHash     string                 `protobuf:"bytes,1,opt,name=info_hash,json=infoHash,proto3" json:"info_hash,omitempty"`
+	Seeders      uint32                 `protobuf:"varint,2,opt,name=seeders,proto3" json:"seeders,omitempty"`
+	Leechers     uint32                 `protobuf:"varint,3,opt,name=leechers,proto3" json:"leechers,omitempty"`
+	Snatches     uint32                 `protobuf:"varint,4,opt,name=snatches,proto3" json:"snatches,omitempty"`
+	Created      *timestamppb.Timestamp `protobuf:"bytes,5,opt,name=created,proto3" json:"created,omitempty"`
+	LastAnnounce *timestamppb.Timestamp `protobuf:"bytes,6,opt,name=last_announce,json=lastAnnounce,proto3" json:"last_announce,omitempty"`
+}
+
+func (m *Torrent) Reset()         { *m = Torrent{} }
+func (m *Torrent) String() string { return proto.CompactTextString(m) }
+func (*Torrent) ProtoMessage()    {}
+
+// ListTorrentsRequest is the request of Admin.ListTorrents.
+//
+// If Idle is set, only torrents not announced to within it are listed.
+type ListTorrentsRequest struct {
+	Idle *durationpb.Duration `protobuf:"bytes,1,opt,name=idle,proto3" json:"idle,omitempty"`
+}
+
+func (m *ListTorrentsRequest) Reset()         { *m = ListTorrentsRequest{} }
+func (m *ListTorrentsRequest) String() string { return proto.CompactTextString(m) }
+func (*ListTorrentsRequest) ProtoMessage()    {}
+
+// ListTorrentsResponse is the response of Admin.ListTorrents.
+type ListTorrentsResponse struct {
+	Torrents []*Torrent `protobuf:"bytes,1,rep,name=torrents,proto3" json:"torrents,omitempty"`
+}
+
+func (m *ListTorrentsResponse) Reset()         { *m = ListTorrentsResponse{} }
+func (m *ListTorrentsResponse) String() string { return proto.CompactTextString(m) }
+func (*ListTorrentsResponse) ProtoMessage()    {}
+
+// Peer is a peer of a torrent.
+type Peer struct {
+	Id   string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Ip   string `protobuf:"bytes,2,opt,name=ip,proto3" json:"ip,omitempty"`
+	Port uint32 `protobuf:"varint,3,opt,name=port,proto3" json:"port,omitempty"`
+}
+
+func (m *Peer) Reset()         { *m = Peer{} }
+func (m *Peer) String() string { return proto.CompactTextString(m) }
+func (*Peer) ProtoMessage()    {}
+
+// GetSwarmRequest is the request of Admin.GetSwarm.
+type GetSwarmRequest struct {
+	InfoHash string `protobuf:"bytes,1,opt,name=info_hash,json=infoHash,proto3" json:"info_hash,omitempty"`
+}
+
+func (m *GetSwarmRequest) Reset()         { *m = GetSwarmRequest{} }
+func (m *GetSwarmRequest) String() string { return proto.CompactTextString(m) }
+func (*GetSwarmRequest) ProtoMessage()    {}
+
+// Swarm is the state of a torrent including its peers.
+type Swarm struct {
+	Torrent  *Torrent `protobuf:"bytes,1,opt,name=torrent,proto3" json:"torrent,omitempty"`
+	Seeders  []*Peer  `protobuf:"bytes,2,rep,name=seeders,proto3" json:"seeders,omitempty"`
+	Leechers []*Peer  `protobuf:"bytes,3,rep,name=leechers,proto3" json:"leechers,omitempty"`
+}
+
+func (m *Swarm) Reset()         { *m = Swarm{} }
+func (m *Swarm) String() string { return proto.CompactTextString(m) }
+func (*Swarm) ProtoMessage()    {}
+
+// DropTorrentRequest is the request of Admin.DropTorrent.
+type DropTorrentRequest struct {
+	InfoHash string `protobuf:"bytes,1,opt,name=info_hash,json=infoHash,proto3" json:"info_hash,omitempty"`
+}
+
+func (m *DropTorrentRequest) Reset()         { *m = DropTorrentRequest{} }
+func (m *DropTorrentRequest) String() string { return proto.CompactTextString(m) }
+func (*DropTorrentRequest) ProtoMessage()    {}
+
+// DropTorrentResponse is the response of Admin.DropTorrent.
+type DropTorrentResponse struct {
+	DeletedPeers uint32 `protobuf:"varint,1,opt,name=deleted_peers,json=deletedPeers,proto3" json:"deleted_peers,omitempty"`
+}
+
+func (m *DropTorrentResponse) Reset()         { *m = DropTorrentResponse{} }
+func (m *DropTorrentResponse) String() string { return proto.CompactTextString(m) }
+func (*DropTorrentResponse) ProtoMessage()    {}
+
+// ListBansRequest is the request of Admin.ListBans.
+type ListBansRequest struct{}
+
+func (m *ListBansRequest) Reset()         { *m = ListBansRequest{} }
+func (m *ListBansRequest) String() string { return proto.CompactTextString(m) }
+func (*ListBansRequest) ProtoMessage()    {}
+
+// ListBansResponse is the response of Admin.ListBans.
+type ListBansResponse struct {
+	Bans []string `protobuf:"bytes,1,rep,name=bans,proto3" json:"bans,omitempty"`
+}
+
+func (m *ListBansResponse) Reset()         { *m = ListBansResponse{} }
+func (m *ListBansResponse) String() string { return proto.CompactTextString(m) }
+func (*ListBansResponse) ProtoMessage()    {}
+
+// BanIPRequest is the request of Admin.BanIP. Ban is an IP address or a
+// range in CIDR notation.
+type BanIPRequest struct {
+	Ban string `protobuf:"bytes,1,opt,name=ban,proto3" json:"ban,omitempty"`
+}
+
+func (m *BanIPRequest) Reset()         { *m = BanIPRequest{} }
+func (m *BanIPRequest) String() string { return proto.CompactTextString(m) }
+func (*BanIPRequest) ProtoMessage()    {}
+
+// BanIPResponse is the response of Admin.BanIP. Ban is the banned range in
+// CIDR notation.
+type BanIPResponse struct {
+	Ban string `protobuf:"bytes,1,opt,name=ban,proto3" json:"ban,omitempty"`
+}
+
+func (m *BanIPResponse) Reset()         { *m = BanIPResponse{} }
+func (m *BanIPResponse) String() string { return proto.CompactTextString(m) }
+func (*BanIPResponse) ProtoMessage()    {}
+
+// UnbanIPRequest is the request of Admin.UnbanIP. Ban is an IP address or a
+// range in CIDR notation.
+type UnbanIPRequest struct {
+	Ban string `protobuf:"bytes,1,opt,name=ban,proto3" json:"ban,omitempty"`
+}
+
+func (m *UnbanIPRequest) Reset()         { *m = UnbanIPRequest{} }
+func (m *UnbanIPRequest) String() string { return proto.CompactTextString(m) }
+func (*UnbanIPRequest) ProtoMessage()    {}
+
+// UnbanIPResponse is the response of Admin.UnbanIP.
+type UnbanIPResponse struct{}
+
+func (m *UnbanIPResponse) Reset()         { *m = UnbanIPResponse{} }
+func (m *UnbanIPResponse) String() string { return proto.CompactTextString(m) }
+func (*UnbanIPResponse) ProtoMessage()    {}
@@ -0,0 +1,251 @@
+package adminpb
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ServiceName is the fully qualified name of the Admin service.
+const ServiceName = "chihaya.admin.v1.Admin"
+
+// AdminServer is the server API of the Admin service.
+type AdminServer interface {
+	Stats(context.Context, *StatsRequest) (*StatsResponse, error)
+	ListTorrents(context.Context, *ListTorrentsRequest) (*ListTorrentsResponse, error)
+	GetSwarm(context.Context, *GetSwarmRequest) (*Swarm, error)
+	DropTorrent(context.Context, *DropTorrentRequest) (*DropTorrentResponse, error)
+	ListBans(context.Context, *ListBansRequest) (*ListBansResponse, error)
+	BanIP(context.Context, *BanIPRequest) (*BanIPResponse, error)
+	UnbanIP(context.Context, *UnbanIPRequest) (*UnbanIPResponse, error)
+}
+
+// UnimplementedAdminServer can be embedded by implementations of AdminServer
+// to have methods added to the service fail with codes.Unimplemented.
+type UnimplementedAdminServer struct{}
+
+func (UnimplementedAdminServer) Stats(context.Context, *StatsRequest) (*StatsResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method Stats not implemented")
+}
+
+func (UnimplementedAdminServer) ListTorrents(context.Context, *ListTorrentsRequest) (*ListTorrentsResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method ListTorrents not implemented")
+}
+
+func (UnimplementedAdminServer) GetSwarm(context.Context, *GetSwarmRequest) (*Swarm, error) {
+	return nil, status.Error(codes.Unimplemented, "method GetSwarm not implemented")
+}
+
+func (UnimplementedAdminServer) DropTorrent(context.Context, *DropTorrentRequest) (*DropTorrentResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method DropTorrent not implemented")
+}
+
+func (UnimplementedAdminServer) ListBans(context.Context, *ListBansRequest) (*ListBansResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method ListBans not implemented")
+}
+
+func (UnimplementedAdminServer) BanIP(context.Context, *BanIPRequest) (*BanIPResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method BanIP not implemented")
+}
+
+func (UnimplementedAdminServer) UnbanIP(context.Context, *UnbanIPRequest) (*UnbanIPResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method UnbanIP not implemented")
+}
+
+// RegisterAdminServer registers srv as the Admin service of s.
+func RegisterAdminServer(s grpc.ServiceRegistrar, srv AdminServer) {
+	s.RegisterService(&ServiceDesc, srv)
+}
+
+func statsHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).Stats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + ServiceName + "/Stats"}
+	return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).Stats(ctx, req.(*StatsRequest))
+	})
+}
+
+func listTorrentsHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListTorrentsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).ListTorrents(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + ServiceName + "/ListTorrents"}
+	return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).ListTorrents(ctx, req.(*ListTorrentsRequest))
+	})
+}
+
+func getSwarmHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetSwarmRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).GetSwarm(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + ServiceName + "/GetSwarm"}
+	return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).GetSwarm(ctx, req.(*GetSwarmRequest))
+	})
+}
+
+func dropTorrentHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DropTorrentRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).DropTorrent(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + ServiceName + "/DropTorrent"}
+	return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).DropTorrent(ctx, req.(*DropTorrentRequest))
+	})
+}
+
+func listBansHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListBansRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).ListBans(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + ServiceName + "/ListBans"}
+	return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).ListBans(ctx, req.(*ListBansRequest))
+	})
+}
+
+func banIPHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BanIPRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).BanIP(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + ServiceName + "/BanIP"}
+	return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).BanIP(ctx, req.(*BanIPRequest))
+	})
+}
+
+func unbanIPHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UnbanIPRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).UnbanIP(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + ServiceName + "/UnbanIP"}
+	return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).UnbanIP(ctx, req.(*UnbanIPRequest))
+	})
+}
+
+// ServiceDesc describes the Admin service for grpc.Server.RegisterService.
+var ServiceDesc = grpc.ServiceDesc{
+	ServiceName: ServiceName,
+	HandlerType: (*AdminServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Stats", Handler: statsHandler},
+		{MethodName: "ListTorrents", Handler: listTorrentsHandler},
+		{MethodName: "GetSwarm", Handler: getSwarmHandler},
+		{MethodName: "DropTorrent", Handler: dropTorrentHandler},
+		{MethodName: "ListBans", Handler: listBansHandler},
+		{MethodName: "BanIP", Handler: banIPHandler},
+		{MethodName: "UnbanIP", Handler: unbanIPHandler},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "pkg/admin/adminpb/admin.proto",
+}
+
+// AdminClient is the client API of the Admin service.
+type AdminClient interface {
+	Stats(ctx context.Context, in *StatsRequest, opts ...grpc.CallOption) (*StatsResponse, error)
+	ListTorrents(ctx context.Context, in *ListTorrentsRequest, opts ...grpc.CallOption) (*ListTorrentsResponse, error)
+	GetSwarm(ctx context.Context, in *GetSwarmRequest, opts ...grpc.CallOption) (*Swarm, error)
+	DropTorrent(ctx context.Context, in *DropTorrentRequest, opts ...grpc.CallOption) (*DropTorrentResponse, error)
+	ListBans(ctx context.Context, in *ListBansRequest, opts ...grpc.CallOption) (*ListBansResponse, error)
+	BanIP(ctx context.Context, in *BanIPRequest, opts ...grpc.CallOption) (*BanIPResponse, error)
+	UnbanIP(ctx context.Context, in *UnbanIPRequest, opts ...grpc.CallOption) (*UnbanIPResponse, error)
+}
+
+type adminClient struct {
+	cc grpc.ClientConnInterface
+}
+
+// NewAdminClient returns a client of the Admin service served on cc.
+func NewAdminClient(cc grpc.ClientConnInterface) AdminClient {
+	return &adminClient{cc}
+}
+
+func (c *adminClient) Stats(ctx context.Context, in *StatsRequest, opts ...grpc.CallOption) (*StatsResponse, error) {
+	out := new(StatsResponse)
+	if err := c.cc.Invoke(ctx, "/"+ServiceName+"/Stats", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) ListTorrents(ctx context.Context, in *ListTorrentsRequest, opts ...grpc.CallOption) (*ListTorrentsResponse, error) {
+	out := new(ListTorrentsResponse)
+	if err := c.cc.Invoke(ctx, "/"+ServiceName+"/ListTorrents", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) GetSwarm(ctx context.Context, in *GetSwarmRequest, opts ...grpc.CallOption) (*Swarm, error) {
+	out := new(Swarm)
+	if err := c.cc.Invoke(ctx, "/"+ServiceName+"/GetSwarm", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) DropTorrent(ctx context.Context, in *DropTorrentRequest, opts ...grpc.CallOption) (*DropTorrentResponse, error) {
+	out := new(DropTorrentResponse)
+	if err := c.cc.Invoke(ctx, "/"+ServiceName+"/DropTorrent", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) ListBans(ctx context.Context, in *ListBansRequest, opts ...grpc.CallOption) (*ListBansResponse, error) {
+	out := new(ListBansResponse)
+	if err := c.cc.Invoke(ctx, "/"+ServiceName+"/ListBans", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) BanIP(ctx context.Context, in *BanIPRequest, opts ...grpc.CallOption) (*BanIPResponse, error) {
+	out := new(BanIPResponse)
+	if err := c.cc.Invoke(ctx, "/"+ServiceName+"/BanIP", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) UnbanIP(ctx context.Context, in *UnbanIPRequest, opts ...grpc.CallOption) (*UnbanIPResponse, error) {
+	out := new(UnbanIPResponse)
+	if err := c.cc.Invoke(ctx, "/"+ServiceName+"/UnbanIP", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,123 @@
+package admin
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+)
+
+// ErrBanned is the error returned for announces from a banned IP address.
+var ErrBanned = bittorrent.ClientError("IP address is banned")
+
+// Bans is a set of IP addresses and ranges banned at runtime.
+//
+// It is a middleware.Hook that fails announces from banned addresses. Bans
+// are kept in memory only, but a Bans can be kept across reloads.
+type Bans struct {
+	mu  sync.RWMutex
+	ips map[string]*net.IPNet
+}
+
+var _ middleware.Hook = &Bans{}
+
+// NewBans returns an empty Bans.
+func NewBans() *Bans {
+	return &Bans{ips: make(map[string]*net.IPNet)}
+}
+
+// parseBan parses an IP address or a range in CIDR notation into a range and
+// its canonical notation.
+func parseBan(s string) (string, *net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return "", nil, &net.ParseError{Type: "IP address", Text: s}
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		s = ip.String() + "/" + strconv.Itoa(bits)
+	}
+
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		return "", nil, err
+	}
+	return ipNet.String(), ipNet, nil
+}
+
+// Add bans an IP address or a range in CIDR notation and returns it in
+// canonical notation.
+func (b *Bans) Add(s string) (string, error) {
+	key, ipNet, err := parseBan(s)
+	if err != nil {
+		return "", err
+	}
+
+	b.mu.Lock()
+	b.ips[key] = ipNet
+	b.mu.Unlock()
+	return key, nil
+}
+
+// Remove lifts the ban of an IP address or range and returns whether it was
+// banned.
+func (b *Bans) Remove(s string) (bool, error) {
+	key, _, err := parseBan(s)
+	if err != nil {
+		return false, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.ips[key]
+	delete(b.ips, key)
+	return ok, nil
+}
+
+// List returns the banned addresses and ranges in CIDR notation.
+func (b *Bans) List() []string {
+	b.mu.RLock()
+	list := make([]string, 0, len(b.ips))
+	for key := range b.ips {
+		list = append(list, key)
+	}
+	b.mu.RUnlock()
+
+	sort.Strings(list)
+	return list
+}
+
+// Banned returns whether ip is banned.
+func (b *Bans) Banned(ip net.IP) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, ipNet := range b.ips {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleAnnounce fails announces from banned addresses.
+func (b *Bans) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	if b.Banned(req.IP.IP) {
+		return ctx, ErrBanned
+	}
+	return ctx, nil
+}
+
+// HandleScrape is a no-op.
+func (b *Bans) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	// Scrapes don't modify any swarms.
+	return ctx, nil
+}
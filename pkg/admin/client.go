@@ -0,0 +1,238 @@
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/policy"
+)
+
+// Client is a client of the admin API.
+type Client struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+// NewClient returns a Client for the admin API served at baseURL, such as
+// "https://127.0.0.1:6882".
+//
+// token is sent with every request, if not empty. Client certificates are
+// configured in the TLS configuration of the transport of client, which
+// defaults to http.DefaultClient if nil.
+func NewClient(baseURL, token string, client *http.Client) *Client {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		client:  client,
+	}
+}
+
+// do performs a request and decodes its JSON response into v, unless v is
+// nil.
+//
+// Responses with a status other than 2xx are returned as errors.
+func (c *Client) do(method, path string, v interface{}) error {
+	return c.doBody(method, path, nil, v)
+}
+
+// doBody performs a request like do, with body encoded as JSON as the
+// request body.
+func (c *Client) doBody(method, path string, body, v interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, c.baseURL+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Stats returns the numbers of torrents, seeders and leechers.
+func (c *Client) Stats() (stats Stats, err error) {
+	err = c.do(http.MethodGet, "/stats", &stats)
+	return
+}
+
+// Rejections returns the requests rejected by middleware within window, which
+// is rounded down to whole minutes and capped at a day.
+func (c *Client) Rejections(window time.Duration) (summary middleware.RejectionSummary, err error) {
+	err = c.do(http.MethodGet, "/stats/rejections?window="+url.QueryEscape(window.String()), &summary)
+	return
+}
+
+// Torrents returns all torrents with peers.
+func (c *Client) Torrents() (torrents []Torrent, err error) {
+	err = c.do(http.MethodGet, "/torrents", &torrents)
+	return
+}
+
+// IdleTorrents returns all torrents that were not announced to within idle,
+// whether they have peers or not.
+func (c *Client) IdleTorrents(idle time.Duration) (torrents []Torrent, err error) {
+	err = c.do(http.MethodGet, "/torrents?idle="+url.QueryEscape(idle.String()), &torrents)
+	return
+}
+
+// Swarm returns the torrent ih, including its peers.
+func (c *Client) Swarm(ih bittorrent.InfoHash) (swarm Swarm, err error) {
+	err = c.do(http.MethodGet, "/torrents/"+ih.String(), &swarm)
+	return
+}
+
+// DropSwarm removes all peers of the torrent ih and returns how many were
+// removed.
+func (c *Client) DropSwarm(ih bittorrent.InfoHash) (int, error) {
+	var deleted map[string]int
+	if err := c.do(http.MethodDelete, "/torrents/"+ih.String(), &deleted); err != nil {
+		return 0, err
+	}
+	return deleted["deleted_peers"], nil
+}
+
+// Bans returns the banned IP addresses and ranges.
+func (c *Client) Bans() (bans []string, err error) {
+	err = c.do(http.MethodGet, "/bans", &bans)
+	return
+}
+
+// Ban bans an IP address or a range in CIDR notation and returns the range
+// banned.
+func (c *Client) Ban(ban string) (banned string, err error) {
+	if ban == "" {
+		return "", errors.New("no IP address or range given")
+	}
+	err = c.do(http.MethodPut, "/bans/"+url.PathEscape(ban), &banned)
+	return
+}
+
+// Unban lifts a ban of an IP address or range.
+func (c *Client) Unban(ban string) error {
+	if ban == "" {
+		return errors.New("no IP address or range given")
+	}
+	return c.do(http.MethodDelete, "/bans/"+url.PathEscape(ban), nil)
+}
+
+// Watches returns the peers whose announces are recorded.
+func (c *Client) Watches() (watches []string, err error) {
+	err = c.do(http.MethodGet, "/history", &watches)
+	return
+}
+
+// Watch starts recording the last size announces of a peer, given by its
+// hex-encoded peer ID or IP address, and returns the peer as it is listed by
+// Watches. If size is 0, the default size is used.
+func (c *Client) Watch(peer string, size int) (watch string, err error) {
+	if peer == "" {
+		return "", errors.New("no peer given")
+	}
+	path := "/history/" + url.PathEscape(peer)
+	if size > 0 {
+		path += "?size=" + strconv.Itoa(size)
+	}
+	err = c.do(http.MethodPut, path, &watch)
+	return
+}
+
+// Unwatch stops recording the announces of a peer.
+func (c *Client) Unwatch(peer string) error {
+	if peer == "" {
+		return errors.New("no peer given")
+	}
+	return c.do(http.MethodDelete, "/history/"+url.PathEscape(peer), nil)
+}
+
+// History returns the recorded announces of a peer, from the oldest to the
+// most recent.
+func (c *Client) History(peer string) (history []middleware.AnnounceRecord, err error) {
+	if peer == "" {
+		return nil, errors.New("no peer given")
+	}
+	err = c.do(http.MethodGet, "/history/"+url.PathEscape(peer), &history)
+	return
+}
+
+// Policies returns the policies of all torrents with one by hex-encoded
+// infohash.
+func (c *Client) Policies() (policies map[string]policy.Policy, err error) {
+	err = c.do(http.MethodGet, "/policies", &policies)
+	return
+}
+
+// Policy returns the policy of the torrent ih.
+func (c *Client) Policy(ih bittorrent.InfoHash) (p policy.Policy, err error) {
+	err = c.do(http.MethodGet, "/policies/"+ih.String(), &p)
+	return
+}
+
+// SetPolicy replaces the policy of the torrent ih.
+func (c *Client) SetPolicy(ih bittorrent.InfoHash, p policy.Policy) error {
+	return c.doBody(http.MethodPut, "/policies/"+ih.String(), p, nil)
+}
+
+// DeletePolicy removes the policy of the torrent ih.
+func (c *Client) DeletePolicy(ih bittorrent.InfoHash) error {
+	return c.do(http.MethodDelete, "/policies/"+ih.String(), nil)
+}
+
+// Merges returns the classes of equivalent infohashes whose swarms are
+// merged.
+func (c *Client) Merges() (merges []Merge, err error) {
+	err = c.do(http.MethodGet, "/merges", &merges)
+	return
+}
+
+// Reload requests reloading the configuration of the tracker. It returns
+// before the reload finished.
+func (c *Client) Reload() error {
+	return c.do(http.MethodPost, "/reload", nil)
+}
+
+// LastReload returns the report of the last reload.
+func (c *Client) LastReload() (report ReloadReport, err error) {
+	err = c.do(http.MethodGet, "/reload", &report)
+	return
+}
@@ -0,0 +1,187 @@
+package admin
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/admin/adminpb"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// TokenCredentials authenticates the calls of a gRPC client with the token of
+// the admin API:
+//
+//	grpc.Dial(addr, grpc.WithTransportCredentials(creds),
+//		grpc.WithPerRPCCredentials(admin.TokenCredentials{Token: token}))
+//
+// The token is only sent over TLS, unless Insecure is set.
+type TokenCredentials struct {
+	Token    string
+	Insecure bool
+}
+
+// GetRequestMetadata implements the credentials.PerRPCCredentials interface.
+func (c TokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + c.Token}, nil
+}
+
+// RequireTransportSecurity implements the credentials.PerRPCCredentials
+// interface.
+func (c TokenCredentials) RequireTransportSecurity() bool {
+	return !c.Insecure
+}
+
+// interceptGRPC requires the configured token for all calls and limits them
+// to the request timeout.
+func (s *Server) interceptGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	var authorization string
+	if values := metadata.ValueFromIncomingContext(ctx, "authorization"); len(values) > 0 {
+		authorization = values[0]
+	}
+	if !s.authorized(authorization) {
+		return nil, status.Error(codes.Unauthenticated, "unauthorized")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.RequestTimeout)
+	defer cancel()
+	return handler(ctx, req)
+}
+
+// grpcError returns err as the error of a gRPC call.
+func grpcError(err error) error {
+	switch err {
+	case errNoLister, errNoActivity:
+		return status.Error(codes.Unimplemented, err.Error())
+	case errInvalidHash, errInvalidIdle:
+		return status.Error(codes.InvalidArgument, err.Error())
+	case context.Canceled, context.DeadlineExceeded:
+		return status.FromContextError(err).Err()
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// grpcServer serves the admin API over gRPC.
+type grpcServer struct {
+	s *Server
+}
+
+var _ adminpb.AdminServer = grpcServer{}
+
+func encodeTorrent(t Torrent) *adminpb.Torrent {
+	encoded := &adminpb.Torrent{
+		InfoHash: t.InfoHash,
+		Seeders:  t.Seeders,
+		Leechers: t.Leechers,
+		Snatches: t.Snatches,
+	}
+	if t.Created != nil {
+		encoded.Created = timestamppb.New(*t.Created)
+	}
+	if t.LastAnnounce != nil {
+		encoded.LastAnnounce = timestamppb.New(*t.LastAnnounce)
+	}
+	return encoded
+}
+
+func encodeGRPCPeers(peers []bittorrent.Peer) []*adminpb.Peer {
+	encoded := make([]*adminpb.Peer, 0, len(peers))
+	for _, p := range encodePeers(peers) {
+		encoded = append(encoded, &adminpb.Peer{Id: p.ID, Ip: p.IP, Port: uint32(p.Port)})
+	}
+	return encoded
+}
+
+func (g grpcServer) Stats(ctx context.Context, req *adminpb.StatsRequest) (*adminpb.StatsResponse, error) {
+	stats, err := g.s.stats(ctx)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &adminpb.StatsResponse{
+		Torrents: uint64(stats.Torrents),
+		Seeders:  stats.Seeders,
+		Leechers: stats.Leechers,
+	}, nil
+}
+
+func (g grpcServer) ListTorrents(ctx context.Context, req *adminpb.ListTorrentsRequest) (*adminpb.ListTorrentsResponse, error) {
+	var idle time.Duration
+	if req.Idle != nil {
+		if err := req.Idle.CheckValid(); err != nil || req.Idle.AsDuration() <= 0 {
+			return nil, grpcError(errInvalidIdle)
+		}
+		idle = req.Idle.AsDuration()
+	}
+
+	torrents, err := g.s.torrents(ctx, idle)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	resp := &adminpb.ListTorrentsResponse{Torrents: make([]*adminpb.Torrent, 0, len(torrents))}
+	for _, t := range torrents {
+		resp.Torrents = append(resp.Torrents, encodeTorrent(t))
+	}
+	return resp, nil
+}
+
+func (g grpcServer) GetSwarm(ctx context.Context, req *adminpb.GetSwarmRequest) (*adminpb.Swarm, error) {
+	ih, err := parseInfoHash(req.InfoHash)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	seeders, leechers, err := g.s.swarmPeers(ctx, ih)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &adminpb.Swarm{
+		Torrent:  encodeTorrent(g.s.torrent(ctx, ih)),
+		Seeders:  encodeGRPCPeers(seeders),
+		Leechers: encodeGRPCPeers(leechers),
+	}, nil
+}
+
+func (g grpcServer) DropTorrent(ctx context.Context, req *adminpb.DropTorrentRequest) (*adminpb.DropTorrentResponse, error) {
+	ih, err := parseInfoHash(req.InfoHash)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	deleted, err := g.s.dropTorrent(ctx, ih)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &adminpb.DropTorrentResponse{DeletedPeers: uint32(deleted)}, nil
+}
+
+func (g grpcServer) ListBans(ctx context.Context, req *adminpb.ListBansRequest) (*adminpb.ListBansResponse, error) {
+	return &adminpb.ListBansResponse{Bans: g.s.bans.List()}, nil
+}
+
+func (g grpcServer) BanIP(ctx context.Context, req *adminpb.BanIPRequest) (*adminpb.BanIPResponse, error) {
+	ban, err := g.s.bans.Add(req.Ban)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	log.Info("admin: banned IP addresses", log.Fields{"range": ban})
+	return &adminpb.BanIPResponse{Ban: ban}, nil
+}
+
+func (g grpcServer) UnbanIP(ctx context.Context, req *adminpb.UnbanIPRequest) (*adminpb.UnbanIPResponse, error) {
+	found, err := g.s.bans.Remove(req.Ban)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if !found {
+		return nil, status.Error(codes.NotFound, "not banned")
+	}
+	log.Info("admin: lifted ban", log.Fields{"range": req.Ban})
+	return &adminpb.UnbanIPResponse{}, nil
+}
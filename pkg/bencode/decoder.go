@@ -53,20 +53,20 @@ func unmarshal(r *bufio.Reader) (interface{}, error) {
 		}
 
 		length, err := readTerminatedInt(r, ':')
-		if err != nil {
+		if err != nil || length < 0 {
 			return nil, errors.New("bencode: unknown input sequence")
 		}
 
-		buf := make([]byte, length)
-		n, err := r.Read(buf)
-
-		if err != nil {
-			return nil, err
-		} else if int64(n) != length {
+		// The length is not trusted to allocate the string at once.
+		var buf bytes.Buffer
+		n, err := io.CopyN(&buf, r, length)
+		if err == io.EOF || (err == nil && n != length) {
 			return nil, errors.New("bencode: short read")
+		} else if err != nil {
+			return nil, err
 		}
 
-		return string(buf), nil
+		return buf.String(), nil
 	}
 }
 
@@ -32,6 +32,18 @@ func TestUnmarshal(t *testing.T) {
 	}
 }
 
+func TestUnmarshalTolerant(t *testing.T) {
+	// Unsorted keys and leading zeros are accepted.
+	got, err := Unmarshal([]byte("d3:twoi02e3:onei1ee"))
+	require.Nil(t, err)
+	require.Equal(t, Dict{"one": int64(1), "two": int64(2)}, got)
+
+	for _, input := range []string{"5:abc", "-1:a", "99999999999:a", "i42", "l3:one"} {
+		_, err := Unmarshal([]byte(input))
+		require.NotNil(t, err, input)
+	}
+}
+
 type bufferLoop struct {
 	val string
 }
@@ -0,0 +1,217 @@
+package bencode
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// ErrUnsortedKeys is returned by a Writer for dictionary keys that are not
+// written in strictly increasing order, as required by BEP 3.
+var ErrUnsortedKeys = errors.New("bencode: dictionary keys are not sorted")
+
+// ErrInvalidNesting is returned by a Writer for values written where they
+// are not allowed, such as a dictionary value without a key or an End without
+// a dictionary or list.
+var ErrInvalidNesting = errors.New("bencode: invalid nesting")
+
+// writers holds flushed Writers, so that their buffers are reused.
+var writers = sync.Pool{
+	New: func() interface{} { return &Writer{buf: make([]byte, 0, 512)} },
+}
+
+// maxPooledBuffer is the capacity up to which the buffers of Writers are
+// reused.
+const maxPooledBuffer = 64 << 10
+
+// frame is a dictionary or list a Writer is writing.
+type frame struct {
+	dict bool
+
+	// lastKey is the last key written to the dictionary and wantValue is
+	// true if its value was not written yet.
+	lastKey   string
+	hasKey    bool
+	wantValue bool
+}
+
+// A Writer writes a bencoded value piece by piece, without building the
+// maps and lists Encoder encodes, into a pooled buffer that is written to
+// the underlying io.Writer by Flush.
+//
+// The keys of dictionaries must be written in sorted order. Errors are
+// sticky: once a method failed, all further calls do nothing and Flush
+// returns the first error.
+type Writer struct {
+	w      io.Writer
+	buf    []byte
+	frames []frame
+	err    error
+}
+
+// NewWriter returns a Writer that writes to w once it is flushed.
+func NewWriter(w io.Writer) *Writer {
+	bw := writers.Get().(*Writer)
+	bw.w = w
+	return bw
+}
+
+// Flush writes the value to the underlying io.Writer and returns the Writer
+// to the pool. The Writer must not be used afterwards.
+func (w *Writer) Flush() error {
+	err := w.err
+	if err == nil && len(w.frames) != 0 {
+		err = ErrInvalidNesting
+	}
+	if err == nil {
+		_, err = w.w.Write(w.buf)
+	}
+
+	// Writers that grew large, for example for a huge scrape, are not kept.
+	if cap(w.buf) <= maxPooledBuffer {
+		w.w, w.buf, w.frames, w.err = nil, w.buf[:0], w.frames[:0], nil
+		writers.Put(w)
+	}
+	return err
+}
+
+// value prepares writing a value and reports whether it may be written.
+func (w *Writer) value() bool {
+	if w.err != nil {
+		return false
+	}
+	if len(w.frames) == 0 {
+		return true
+	}
+
+	f := &w.frames[len(w.frames)-1]
+	if f.dict {
+		if !f.wantValue {
+			w.err = ErrInvalidNesting
+			return false
+		}
+		f.wantValue = false
+	}
+	return true
+}
+
+// Dict starts a dictionary, which is closed by End.
+func (w *Writer) Dict() {
+	if !w.value() {
+		return
+	}
+	w.buf = append(w.buf, 'd')
+	w.frames = append(w.frames, frame{dict: true})
+}
+
+// List starts a list, which is closed by End.
+func (w *Writer) List() {
+	if !w.value() {
+		return
+	}
+	w.buf = append(w.buf, 'l')
+	w.frames = append(w.frames, frame{})
+}
+
+// End closes the innermost dictionary or list.
+func (w *Writer) End() {
+	if w.err != nil {
+		return
+	}
+	if len(w.frames) == 0 || w.frames[len(w.frames)-1].wantValue {
+		w.err = ErrInvalidNesting
+		return
+	}
+	w.frames = w.frames[:len(w.frames)-1]
+	w.buf = append(w.buf, 'e')
+}
+
+// Key writes the key of the next value of the innermost dictionary.
+func (w *Writer) Key(key string) {
+	if w.err != nil {
+		return
+	}
+	if len(w.frames) == 0 {
+		w.err = ErrInvalidNesting
+		return
+	}
+
+	f := &w.frames[len(w.frames)-1]
+	switch {
+	case !f.dict || f.wantValue:
+		w.err = ErrInvalidNesting
+		return
+	case f.hasKey && key <= f.lastKey:
+		w.err = ErrUnsortedKeys
+		return
+	}
+	f.lastKey, f.hasKey, f.wantValue = key, true, true
+	w.appendString(key)
+}
+
+// Int writes an integer.
+func (w *Writer) Int(v int64) {
+	if !w.value() {
+		return
+	}
+	w.buf = append(w.buf, 'i')
+	w.buf = strconv.AppendInt(w.buf, v, 10)
+	w.buf = append(w.buf, 'e')
+}
+
+// Uint writes an unsigned integer.
+func (w *Writer) Uint(v uint64) {
+	if !w.value() {
+		return
+	}
+	w.buf = append(w.buf, 'i')
+	w.buf = strconv.AppendUint(w.buf, v, 10)
+	w.buf = append(w.buf, 'e')
+}
+
+// String writes a string.
+func (w *Writer) String(v string) {
+	if !w.value() {
+		return
+	}
+	w.appendString(v)
+}
+
+// Bytes writes a byte string.
+func (w *Writer) Bytes(v []byte) {
+	if !w.value() {
+		return
+	}
+	w.buf = strconv.AppendInt(w.buf, int64(len(v)), 10)
+	w.buf = append(w.buf, ':')
+	w.buf = append(w.buf, v...)
+}
+
+// ByteString writes a byte string of length n and returns its bytes, which
+// the caller fills in before the next call to the Writer. This avoids
+// building strings, such as compact peer lists, before writing them.
+//
+// It returns nil if the Writer failed.
+func (w *Writer) ByteString(n int) []byte {
+	if !w.value() {
+		return nil
+	}
+	w.buf = strconv.AppendInt(w.buf, int64(n), 10)
+	w.buf = append(w.buf, ':')
+
+	start := len(w.buf)
+	if cap(w.buf)-start < n {
+		grown := make([]byte, start, 2*cap(w.buf)+n)
+		copy(grown, w.buf)
+		w.buf = grown
+	}
+	w.buf = w.buf[:start+n]
+	return w.buf[start:]
+}
+
+func (w *Writer) appendString(v string) {
+	w.buf = strconv.AppendInt(w.buf, int64(len(v)), 10)
+	w.buf = append(w.buf, ':')
+	w.buf = append(w.buf, v...)
+}
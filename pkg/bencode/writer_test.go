@@ -0,0 +1,107 @@
+package bencode
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Dict()
+	w.Key("a")
+	w.Int(-42)
+	w.Key("b")
+	w.List()
+	w.String("one")
+	w.Bytes([]byte("two"))
+	w.Uint(3)
+	w.End()
+	w.Key("c")
+	copy(w.ByteString(4), "peer")
+	w.End()
+	require.Nil(t, w.Flush())
+
+	require.Equal(t, "d1:ai-42e1:bl3:one3:twoi3ee1:c4:peere", buf.String())
+
+	// The output is decoded to the same value.
+	v, err := Unmarshal(buf.Bytes())
+	require.Nil(t, err)
+	require.Equal(t, Dict{"a": int64(-42), "b": List{"one", "two", int64(3)}, "c": "peer"}, v)
+}
+
+func TestWriterGrows(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	b := w.ByteString(2 * maxPooledBuffer)
+	for i := range b {
+		b[i] = 'x'
+	}
+	require.Nil(t, w.Flush())
+	require.Equal(t, len("131072:")+2*maxPooledBuffer, buf.Len())
+}
+
+func TestWriterErrors(t *testing.T) {
+	var table = []struct {
+		name     string
+		write    func(w *Writer)
+		expected error
+	}{
+		{"unsorted keys", func(w *Writer) {
+			w.Dict()
+			w.Key("b")
+			w.Int(1)
+			w.Key("a")
+			w.Int(2)
+			w.End()
+		}, ErrUnsortedKeys},
+		{"duplicate keys", func(w *Writer) {
+			w.Dict()
+			w.Key("a")
+			w.Int(1)
+			w.Key("a")
+			w.Int(2)
+			w.End()
+		}, ErrUnsortedKeys},
+		{"value without key", func(w *Writer) { w.Dict(); w.Int(1); w.End() }, ErrInvalidNesting},
+		{"key without value", func(w *Writer) { w.Dict(); w.Key("a"); w.End() }, ErrInvalidNesting},
+		{"key in list", func(w *Writer) { w.List(); w.Key("a"); w.End() }, ErrInvalidNesting},
+		{"unclosed list", func(w *Writer) { w.List() }, ErrInvalidNesting},
+		{"end without list", func(w *Writer) { w.End() }, ErrInvalidNesting},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := NewWriter(&buf)
+			tt.write(w)
+			require.Equal(t, tt.expected, w.Flush())
+			require.Zero(t, buf.Len(), "nothing should be written on errors")
+		})
+	}
+}
+
+func BenchmarkWriter(b *testing.B) {
+	var buf bytes.Buffer
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		w := NewWriter(&buf)
+		w.Dict()
+		w.Key("k1")
+		w.List()
+		w.String("a")
+		w.String("b")
+		w.String("c")
+		w.End()
+		w.Key("k2")
+		w.Int(42)
+		w.Key("k3")
+		w.String("val")
+		w.Key("k4")
+		w.Uint(42)
+		w.End()
+		w.Flush()
+	}
+}
@@ -0,0 +1,34 @@
+// Package clock provides an abstraction of the passage of time, so that code
+// depending on it can be tested by advancing a virtual clock instead of
+// sleeping.
+package clock
+
+import (
+	"time"
+
+	"github.com/chihaya/chihaya/internal/timecache"
+)
+
+// Clock tells the time and waits for durations to elapse.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// After waits for the duration to elapse and then sends the current time
+	// on the returned channel.
+	After(d time.Duration) <-chan time.Time
+}
+
+// Cached is the Clock backed by the global time cache, which is updated once
+// every second.
+var Cached Clock = cachedClock{}
+
+type cachedClock struct{}
+
+func (cachedClock) Now() time.Time {
+	return timecache.Now()
+}
+
+func (cachedClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
@@ -0,0 +1,95 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Mock is a Clock whose time only changes when it is set or advanced.
+//
+// Channels returned by After receive the time once the Mock has been
+// advanced past their deadline.
+type Mock struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	waiters []waiter
+}
+
+type waiter struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+var _ Clock = &Mock{}
+
+// NewMock returns a Mock set to the given time.
+func NewMock(now time.Time) *Mock {
+	m := &Mock{now: now}
+	m.cond = sync.NewCond(&m.mu)
+	return m
+}
+
+// Now returns the time of the Mock.
+func (m *Mock) Now() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.now
+}
+
+// After returns a channel that receives the time once the Mock has been
+// advanced by d.
+func (m *Mock) After(d time.Duration) <-chan time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c := make(chan time.Time, 1)
+	if d <= 0 {
+		c <- m.now
+		return c
+	}
+
+	m.waiters = append(m.waiters, waiter{deadline: m.now.Add(d), c: c})
+	m.cond.Broadcast()
+	return c
+}
+
+// Add advances the Mock by d and fires all channels whose deadline passed.
+func (m *Mock) Add(d time.Duration) {
+	m.mu.Lock()
+	now := m.now.Add(d)
+	m.mu.Unlock()
+
+	m.Set(now)
+}
+
+// Set sets the time of the Mock and fires all channels whose deadline passed.
+func (m *Mock) Set(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.now = now
+	waiters := m.waiters[:0]
+	for _, w := range m.waiters {
+		if now.Before(w.deadline) {
+			waiters = append(waiters, w)
+			continue
+		}
+		w.c <- now
+	}
+	m.waiters = waiters
+	m.cond.Broadcast()
+}
+
+// BlockUntil blocks until n callers are waiting on channels returned by After.
+//
+// This allows waiting for a goroutine to handle a fired channel and wait for
+// the next one before advancing the Mock again.
+func (m *Mock) BlockUntil(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for len(m.waiters) != n {
+		m.cond.Wait()
+	}
+}
@@ -0,0 +1,52 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	m := NewMock(start)
+	require.Equal(t, start, m.Now())
+
+	short, long := m.After(time.Second), m.After(time.Minute)
+	select {
+	case <-m.After(0):
+	default:
+		t.Fatal("After(0) did not fire")
+	}
+
+	m.Add(time.Second)
+	require.Equal(t, start.Add(time.Second), <-short)
+	select {
+	case <-long:
+		t.Fatal("fired before its deadline")
+	default:
+	}
+
+	m.Set(start.Add(time.Hour))
+	require.Equal(t, start.Add(time.Hour), <-long)
+	m.BlockUntil(0)
+}
+
+func TestBlockUntil(t *testing.T) {
+	m := NewMock(time.Unix(0, 0))
+	fired := make(chan struct{})
+
+	go func() {
+		for i := 0; i < 3; i++ {
+			<-m.After(time.Minute)
+			fired <- struct{}{}
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		m.BlockUntil(1)
+		m.Add(time.Minute)
+		<-fired
+	}
+	m.BlockUntil(0)
+}
@@ -0,0 +1,251 @@
+// Package etcd implements reading and watching single keys of etcd through
+// the JSON gateway of its v3 API, which is enough to load configuration
+// from etcd without depending on its client library.
+//
+// Keys are addressed by URLs of the form etcd://host:port/key, or
+// etcds://host:port/key to connect with TLS. Credentials given in the URL
+// are used to authenticate.
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// The schemes of URLs of etcd keys.
+const (
+	Scheme    = "etcd"
+	SchemeTLS = "etcds"
+)
+
+// ErrKeyNotFound is returned by Get if the key does not exist.
+var ErrKeyNotFound = errors.New("etcd: key not found")
+
+// IsURL returns whether s is the URL of an etcd key.
+func IsURL(s string) bool {
+	return strings.HasPrefix(s, Scheme+"://") || strings.HasPrefix(s, SchemeTLS+"://")
+}
+
+// Key is a key of an etcd cluster.
+type Key struct {
+	url      string
+	endpoint string
+	key      string
+	username string
+	password string
+	client   *http.Client
+}
+
+// ParseURL parses the URL of an etcd key. The key is used with the HTTP
+// client c, which must not have a timeout for Watch to work.
+func ParseURL(rawurl string, c *http.Client) (*Key, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &Key{key: u.Path, client: c}
+	switch u.Scheme {
+	case Scheme:
+		k.endpoint = "http://" + u.Host
+	case SchemeTLS:
+		k.endpoint = "https://" + u.Host
+	default:
+		return nil, fmt.Errorf("etcd: invalid scheme %q", u.Scheme)
+	}
+	if u.Host == "" || k.key == "" || k.key == "/" {
+		return nil, fmt.Errorf("etcd: %q must name a host and a key", rawurl)
+	}
+	if u.User != nil {
+		k.username = u.User.Username()
+		k.password, _ = u.User.Password()
+		u.User = nil
+	}
+	k.url = u.String()
+	return k, nil
+}
+
+// String returns the URL of the key without credentials.
+func (k *Key) String() string {
+	return k.url
+}
+
+// Get returns the value of the key and the revision of the cluster it was
+// read at.
+func (k *Key) Get(ctx context.Context) (value []byte, revision int64, err error) {
+	var resp struct {
+		Header header `json:"header"`
+		KVs    []kv   `json:"kvs"`
+	}
+	body := map[string]string{"key": encode(k.key)}
+	if err := k.post(ctx, "/v3/kv/range", body, &resp); err != nil {
+		return nil, 0, err
+	}
+
+	revision, err = strconv.ParseInt(resp.Header.Revision, 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("etcd: invalid revision %q", resp.Header.Revision)
+	}
+	if len(resp.KVs) == 0 {
+		return nil, revision, ErrKeyNotFound
+	}
+	value, err = base64.StdEncoding.DecodeString(resp.KVs[0].Value)
+	return value, revision, err
+}
+
+// Watch calls changed for every change of the key after the given revision,
+// with the revision of the change, until ctx is done or the watch fails.
+//
+// It always returns an error, which is ctx.Err() if ctx is done.
+func (k *Key) Watch(ctx context.Context, revision int64, changed func(revision int64)) error {
+	body := map[string]interface{}{
+		"create_request": map[string]string{
+			"key":            encode(k.key),
+			"start_revision": strconv.FormatInt(revision+1, 10),
+		},
+	}
+	resp, err := k.do(ctx, "/v3/watch", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// The gateway streams one JSON object per message.
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Result struct {
+				Canceled     bool   `json:"canceled"`
+				CancelReason string `json:"cancel_reason"`
+				Events       []struct {
+					KV kv `json:"kv"`
+				} `json:"events"`
+			} `json:"result"`
+			Error *gatewayError `json:"error"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if msg.Error != nil {
+			return msg.Error
+		}
+		if msg.Result.Canceled {
+			return fmt.Errorf("etcd: watch canceled: %s", msg.Result.CancelReason)
+		}
+
+		for _, e := range msg.Result.Events {
+			rev, err := strconv.ParseInt(e.KV.ModRevision, 10, 64)
+			if err != nil {
+				return fmt.Errorf("etcd: invalid revision %q", e.KV.ModRevision)
+			}
+			changed(rev)
+		}
+	}
+}
+
+type header struct {
+	Revision string `json:"revision"`
+}
+
+type kv struct {
+	Value       string `json:"value"`
+	ModRevision string `json:"mod_revision"`
+}
+
+// gatewayError is an error returned by the gateway.
+type gatewayError struct {
+	Message string `json:"message"`
+	Code    int    `json:"code"`
+}
+
+func (e *gatewayError) Error() string {
+	return "etcd: " + e.Message
+}
+
+func encode(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// post posts body to path and decodes the response into v.
+func (k *Key) post(ctx context.Context, path string, body, v interface{}) error {
+	resp, err := k.do(ctx, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// do posts body to path, after authenticating if the key has credentials.
+func (k *Key) do(ctx context.Context, path string, body interface{}) (*http.Response, error) {
+	var token string
+	if k.username != "" {
+		var err error
+		if token, err = k.authenticate(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return k.send(ctx, path, token, body)
+}
+
+// authenticate returns a token authenticating requests as the user of the
+// key.
+func (k *Key) authenticate(ctx context.Context) (string, error) {
+	creds := map[string]string{"name": k.username, "password": k.password}
+	resp, err := k.send(ctx, "/v3/auth/authenticate", "", creds)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var auth struct {
+		Token string `json:"token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&auth)
+	return auth.Token, err
+}
+
+// send posts body to path with the given token, if any. Responses with a
+// status other than 200 OK are returned as errors.
+func (k *Key) send(ctx context.Context, path, token string, body interface{}) (*http.Response, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, k.endpoint+path, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var gwErr gatewayError
+		msg, _ := ioutil.ReadAll(resp.Body)
+		if json.Unmarshal(msg, &gwErr) == nil && gwErr.Message != "" {
+			return nil, &gwErr
+		}
+		return nil, fmt.Errorf("etcd: unexpected status %s", resp.Status)
+	}
+	return resp, nil
+}
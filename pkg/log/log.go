@@ -129,3 +129,61 @@ func Fatal(v interface{}, fielders ...Fielder) {
 		l.Fatal(v)
 	}
 }
+
+// A Logger logs messages with a fixed set of Fields, such as the component of
+// Chihaya that is logging.
+type Logger struct {
+	fields Fields
+}
+
+// With returns a Logger adding the given Fields to every message.
+func With(fields Fields) *Logger {
+	return &Logger{fields: fields}
+}
+
+// Component returns a Logger adding the name of a component, such as a
+// frontend, to every message.
+func Component(name string) *Logger {
+	return With(Fields{"component": name})
+}
+
+// merge merges the Fields of the Logger with those of the fielders.
+func (lg *Logger) merge(fielders []Fielder) logrus.Fields {
+	fields := make(logrus.Fields, len(lg.fields))
+	if len(fielders) != 0 {
+		for k, v := range mergeFielders(fielders...) {
+			fields[k] = v
+		}
+	}
+	for k, v := range lg.fields {
+		fields[k] = v
+	}
+	return fields
+}
+
+// Debug logs at the debug level if debug logging is enabled.
+func (lg *Logger) Debug(v interface{}, fielders ...Fielder) {
+	if debug {
+		l.WithFields(lg.merge(fielders)).Debug(v)
+	}
+}
+
+// Info logs at the info level.
+func (lg *Logger) Info(v interface{}, fielders ...Fielder) {
+	l.WithFields(lg.merge(fielders)).Info(v)
+}
+
+// Warn logs at the warning level.
+func (lg *Logger) Warn(v interface{}, fielders ...Fielder) {
+	l.WithFields(lg.merge(fielders)).Warn(v)
+}
+
+// Error logs at the error level.
+func (lg *Logger) Error(v interface{}, fielders ...Fielder) {
+	l.WithFields(lg.merge(fielders)).Error(v)
+}
+
+// Fatal logs at the fatal level and exits with a status code != 0.
+func (lg *Logger) Fatal(v interface{}, fielders ...Fielder) {
+	l.WithFields(lg.merge(fielders)).Fatal(v)
+}
@@ -0,0 +1,77 @@
+// Package netutil implements helpers to parse and classify IP addresses, so
+// that all frontends agree on the address family of a client.
+//
+// IPv4 addresses are handled in their 4-byte form. IPv4 addresses mapped to
+// IPv6 (::ffff:a.b.c.d), as returned by net.ParseIP or sent by dual-stack
+// sockets, are IPv4 addresses.
+package netutil
+
+import "net"
+
+// Family is the address family of an IP address.
+type Family uint8
+
+// Family constants.
+const (
+	// Invalid is the family of IPs that are neither IPv4 nor IPv6, such as
+	// nil or slices of a wrong length.
+	Invalid Family = iota
+	IPv4
+	IPv6
+)
+
+func (f Family) String() string {
+	switch f {
+	case IPv4:
+		return "IPv4"
+	case IPv6:
+		return "IPv6"
+	default:
+		return "invalid"
+	}
+}
+
+// FamilyOf returns the address family of ip.
+func FamilyOf(ip net.IP) Family {
+	if ip.To4() != nil {
+		return IPv4
+	} else if len(ip) == net.IPv6len { // implies ip.To4() == nil
+		return IPv6
+	}
+	return Invalid
+}
+
+// Unmap returns ip in its canonical form: 4 bytes for IPv4 addresses,
+// including the ones mapped to IPv6, and 16 bytes for IPv6 addresses.
+// It returns nil if ip is neither.
+//
+// The result may share its bytes with ip.
+func Unmap(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	} else if len(ip) == net.IPv6len {
+		return ip
+	}
+	return nil
+}
+
+// ByteIP returns a copy of the IP address encoded in b, in its canonical
+// form.
+// b must hold exactly 4 or 16 bytes, as the IP fields of binary protocols do.
+func ByteIP(b []byte) (net.IP, bool) {
+	if len(b) != net.IPv4len && len(b) != net.IPv6len {
+		return nil, false
+	}
+
+	// Make sure the bytes are copied to a new slice, so that the IP doesn't
+	// keep a buffer alive or change when it is reused.
+	ip := make(net.IP, len(b))
+	copy(ip, b)
+	return Unmap(ip), true
+}
+
+// ParseIP parses s as an IPv4 or IPv6 address and returns it in its
+// canonical form. It returns nil if s is not a valid address.
+func ParseIP(s string) net.IP {
+	return Unmap(net.ParseIP(s))
+}
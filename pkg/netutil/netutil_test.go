@@ -0,0 +1,59 @@
+package netutil
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFamilyOf(t *testing.T) {
+	var table = []struct {
+		ip       net.IP
+		expected Family
+	}{
+		{net.ParseIP("192.0.2.1"), IPv4},
+		{net.ParseIP("192.0.2.1").To4(), IPv4},
+		{net.ParseIP("::ffff:192.0.2.1"), IPv4},
+		{net.ParseIP("2001:db8::1"), IPv6},
+		{net.ParseIP("::"), IPv6},
+		{nil, Invalid},
+		{net.IP{192, 0, 2}, Invalid},
+	}
+
+	for _, tt := range table {
+		require.Equal(t, tt.expected, FamilyOf(tt.ip), "%#v", tt.ip)
+	}
+}
+
+func TestUnmap(t *testing.T) {
+	require.Equal(t, net.IP{192, 0, 2, 1}, Unmap(net.ParseIP("::ffff:192.0.2.1")))
+	require.Equal(t, net.IP{192, 0, 2, 1}, Unmap(net.IP{192, 0, 2, 1}))
+	require.Equal(t, net.ParseIP("2001:db8::1"), Unmap(net.ParseIP("2001:db8::1")))
+	require.Nil(t, Unmap(net.IP{192, 0, 2}))
+	require.Nil(t, ParseIP("bogus"))
+	require.Equal(t, net.IP{192, 0, 2, 1}, ParseIP("192.0.2.1"))
+}
+
+func TestByteIP(t *testing.T) {
+	b := []byte{192, 0, 2, 1}
+	ip, ok := ByteIP(b)
+	require.True(t, ok)
+	require.Equal(t, net.IP{192, 0, 2, 1}, ip)
+
+	// The IP doesn't change with the buffer it was read from.
+	b[0] = 198
+	require.Equal(t, net.IP{192, 0, 2, 1}, ip)
+
+	ip, ok = ByteIP(net.ParseIP("::ffff:192.0.2.1"))
+	require.True(t, ok)
+	require.Equal(t, net.IP{192, 0, 2, 1}, ip)
+
+	ip, ok = ByteIP(net.ParseIP("2001:db8::1"))
+	require.True(t, ok)
+	require.Equal(t, net.ParseIP("2001:db8::1"), ip)
+
+	// The bytes of an IP are never parsed as text.
+	_, ok = ByteIP([]byte("192.0.2.1"))
+	require.False(t, ok)
+}
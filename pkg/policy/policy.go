@@ -0,0 +1,358 @@
+// Package policy implements per-torrent policies: one record per torrent
+// holding everything middleware treat differently for it, such as its
+// announce interval, whether it is freeleech or approved, its category and
+// whether it is visible to scrapes.
+//
+// Policies are kept in a Store shared by the middleware and the admin API,
+// which can persist them to a file, so that the settings of a torrent don't
+// have to be repeated in the lists of several middleware.
+package policy
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// Name is the name used in logs and for the decisions of the Store.
+const Name = "torrent policies"
+
+// ErrTorrentUnapproved is the error returned for announces of torrents whose
+// policy is Unapproved.
+var ErrTorrentUnapproved = bittorrent.ClientError("unapproved torrent")
+
+// Approval is the approval state of a torrent.
+type Approval string
+
+const (
+	// Unset leaves the approval of a torrent to the torrent approval
+	// middleware, if any.
+	Unset Approval = ""
+
+	// Approved torrents are approved, even if the torrent approval
+	// middleware does not list them.
+	Approved Approval = "approved"
+
+	// Unapproved torrents are rejected.
+	Unapproved Approval = "unapproved"
+)
+
+// Policy is the policy of a torrent. Its zero value is the policy of
+// torrents without a policy.
+type Policy struct {
+	// Interval overrides the announce interval, if not zero.
+	Interval time.Duration `yaml:"interval,omitempty"`
+
+	// Freeleech torrents don't count towards the downloaded bytes of users.
+	Freeleech bool `yaml:"freeleech,omitempty"`
+
+	Approval Approval `yaml:"approval,omitempty"`
+
+	// Category is not interpreted by Chihaya, but made available to
+	// middleware.
+	Category string `yaml:"category,omitempty"`
+
+	// HideFromScrapes scrapes the swarm of the torrent as empty, and leaves
+	// it out of full scrapes.
+	HideFromScrapes bool `yaml:"hide_from_scrapes,omitempty"`
+}
+
+// jsonPolicy is the JSON representation of a Policy, which has the Interval
+// in the notation of time.Duration.
+type jsonPolicy struct {
+	Interval        string   `json:"interval,omitempty"`
+	Freeleech       bool     `json:"freeleech"`
+	Approval        Approval `json:"approval,omitempty"`
+	Category        string   `json:"category,omitempty"`
+	HideFromScrapes bool     `json:"hide_from_scrapes"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (p Policy) MarshalJSON() ([]byte, error) {
+	jp := jsonPolicy{
+		Freeleech:       p.Freeleech,
+		Approval:        p.Approval,
+		Category:        p.Category,
+		HideFromScrapes: p.HideFromScrapes,
+	}
+	if p.Interval != 0 {
+		jp.Interval = p.Interval.String()
+	}
+	return json.Marshal(jp)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (p *Policy) UnmarshalJSON(b []byte) error {
+	var jp jsonPolicy
+	if err := json.Unmarshal(b, &jp); err != nil {
+		return err
+	}
+
+	*p = Policy{
+		Freeleech:       jp.Freeleech,
+		Approval:        jp.Approval,
+		Category:        jp.Category,
+		HideFromScrapes: jp.HideFromScrapes,
+	}
+	if jp.Interval != "" {
+		var err error
+		if p.Interval, err = time.ParseDuration(jp.Interval); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate returns an error if p can't be applied.
+func (p Policy) Validate() error {
+	switch {
+	case p.Interval < 0:
+		return fmt.Errorf("interval must not be negative")
+	case p.Approval != Unset && p.Approval != Approved && p.Approval != Unapproved:
+		return fmt.Errorf("unknown approval %q", p.Approval)
+	}
+	return nil
+}
+
+// Config represents the configuration of the torrent policies.
+type Config struct {
+	// Path is the YAML file the policies are read from, a map from
+	// hex-encoded infohashes to policies. Policies changed through the admin
+	// API are written back to it.
+	Path string `yaml:"path"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{"path": cfg.Path}
+}
+
+type policyKey struct{}
+
+// FromContext returns the policy the Store stored in the context of an
+// announce, if the torrent has one.
+func FromContext(ctx context.Context) (Policy, bool) {
+	p, ok := ctx.Value(policyKey{}).(Policy)
+	return p, ok
+}
+
+// NewContext returns a context holding the policy p, as returned by
+// FromContext.
+func NewContext(ctx context.Context, p Policy) context.Context {
+	return context.WithValue(ctx, policyKey{}, p)
+}
+
+// Store holds the policies of torrents.
+//
+// It is a middleware.Hook applying the policies and storing them in the
+// context of announces, so that they are available to the middleware that
+// run after it. A Store can be kept across reloads.
+type Store struct {
+	mu       sync.RWMutex
+	policies map[bittorrent.InfoHash]Policy
+
+	// path is the file changes are written to, if not empty.
+	path string
+}
+
+var _ middleware.Hook = &Store{}
+
+// NewStore returns an empty Store.
+func NewStore() *Store {
+	return &Store{policies: make(map[bittorrent.InfoHash]Policy)}
+}
+
+// ParseInfoHash parses a hex-encoded infohash.
+func ParseInfoHash(s string) (bittorrent.InfoHash, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 20 {
+		return bittorrent.InfoHash{}, fmt.Errorf("invalid infohash %q: must be 40 hexadecimal characters", s)
+	}
+	return bittorrent.InfoHashFromBytes(b), nil
+}
+
+// Open replaces the policies with those of the file path and writes later
+// changes to it. A file that does not exist yet holds no policies.
+//
+// If path is empty, the policies are kept, but changes are no longer
+// written to a file.
+func (s *Store) Open(path string) error {
+	if path == "" {
+		s.mu.Lock()
+		s.path = ""
+		s.mu.Unlock()
+		return nil
+	}
+
+	policies := make(map[bittorrent.InfoHash]Policy)
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var file map[string]Policy
+	if err := yaml.UnmarshalStrict(b, &file); err != nil {
+		return err
+	}
+	for key, p := range file {
+		ih, err := ParseInfoHash(key)
+		if err != nil {
+			return err
+		}
+		if err := p.Validate(); err != nil {
+			return fmt.Errorf("policy of %s: %s", key, err)
+		}
+		policies[ih] = p
+	}
+
+	s.mu.Lock()
+	s.policies, s.path = policies, path
+	s.mu.Unlock()
+
+	log.Debug("loaded torrent policies", log.Fields{"path": path, "policies": len(policies)})
+	return nil
+}
+
+// save writes the policies to the file of s, if any. The caller must hold
+// s.mu.
+//
+// The file is replaced atomically, so that it is never read half-written.
+func (s *Store) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	file := make(map[string]Policy, len(s.policies))
+	for ih, p := range s.policies {
+		file[ih.String()] = p
+	}
+	b, err := yaml.Marshal(file)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), s.path)
+}
+
+// Get returns the policy of ih, if it has one.
+func (s *Store) Get(ih bittorrent.InfoHash) (Policy, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.policies[ih]
+	return p, ok
+}
+
+// Set replaces the policy of ih.
+//
+// The policy is applied even if it can't be written to the file, in which
+// case the error is returned.
+func (s *Store) Set(ih bittorrent.InfoHash, p Policy) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policies[ih] = p
+	return s.save()
+}
+
+// Delete removes the policy of ih and returns whether it had one.
+//
+// The policy is removed even if the file can't be written, in which case the
+// error is returned.
+func (s *Store) Delete(ih bittorrent.InfoHash) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.policies[ih]; !ok {
+		return false, nil
+	}
+	delete(s.policies, ih)
+	return true, s.save()
+}
+
+// List returns all policies by hex-encoded infohash.
+func (s *Store) List() map[string]Policy {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make(map[string]Policy, len(s.policies))
+	for ih, p := range s.policies {
+		list[ih.String()] = p
+	}
+	return list
+}
+
+// Hidden returns whether the swarm of ih is hidden from scrapes.
+func (s *Store) Hidden(ih bittorrent.InfoHash) bool {
+	p, _ := s.Get(ih)
+	return p.HideFromScrapes
+}
+
+// HandleAnnounce rejects unapproved torrents, overrides the announce
+// interval and stores the policy of the torrent in the context.
+func (s *Store) HandleAnnounce(ctx context.Context, req *bittorrent.AnnounceRequest, resp *bittorrent.AnnounceResponse) (context.Context, error) {
+	p, ok := s.Get(req.InfoHash)
+	if !ok {
+		return ctx, nil
+	}
+
+	if p.Approval == Unapproved {
+		bittorrent.RecordDecision(ctx, Name, "unapproved")
+		return ctx, ErrTorrentUnapproved
+	}
+
+	if p.Interval > 0 {
+		resp.Interval = p.Interval
+		if resp.MinInterval > p.Interval {
+			resp.MinInterval = p.Interval
+		}
+	}
+
+	bittorrent.RecordDecision(ctx, Name, "applied")
+	return NewContext(ctx, p), nil
+}
+
+// HandleScrape hides the swarms of torrents hidden from scrapes.
+func (s *Store) HandleScrape(ctx context.Context, req *bittorrent.ScrapeRequest, resp *bittorrent.ScrapeResponse) (context.Context, error) {
+	var hidden map[bittorrent.InfoHash]struct{}
+	for _, ih := range req.InfoHashes {
+		if !s.Hidden(ih) {
+			continue
+		}
+		if hidden == nil {
+			hidden = make(map[bittorrent.InfoHash]struct{})
+		}
+		hidden[ih] = struct{}{}
+	}
+
+	if hidden == nil {
+		return ctx, nil
+	}
+	return context.WithValue(ctx, middleware.HiddenSwarmsKey, hidden), nil
+}
@@ -0,0 +1,103 @@
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/middleware"
+)
+
+var (
+	ih1 = bittorrent.InfoHashFromString("00000000000000000001")
+	ih2 = bittorrent.InfoHashFromString("00000000000000000002")
+)
+
+func TestJSON(t *testing.T) {
+	p := Policy{Interval: 30 * time.Minute, Freeleech: true, Approval: Approved, Category: "linux"}
+	b, err := json.Marshal(p)
+	require.Nil(t, err)
+	require.JSONEq(t, `{"interval":"30m0s","freeleech":true,"approval":"approved","category":"linux","hide_from_scrapes":false}`, string(b))
+
+	var decoded Policy
+	require.Nil(t, json.Unmarshal(b, &decoded))
+	require.Equal(t, p, decoded)
+
+	require.NotNil(t, json.Unmarshal([]byte(`{"interval":"soon"}`), &decoded))
+}
+
+func TestOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chihaya-policies")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "policies.yaml")
+
+	// A file that does not exist yet holds no policies.
+	s := NewStore()
+	require.Nil(t, s.Open(path))
+	require.Empty(t, s.List())
+
+	require.Nil(t, s.Set(ih1, Policy{Interval: time.Hour, HideFromScrapes: true}))
+	require.NotNil(t, s.Set(ih2, Policy{Approval: "maybe"}))
+	require.Nil(t, s.Set(ih2, Policy{Approval: Unapproved}))
+	found, err := s.Delete(ih2)
+	require.Nil(t, err)
+	require.True(t, found)
+
+	// Changes are written to the file.
+	reopened := NewStore()
+	require.Nil(t, reopened.Open(path))
+	require.Equal(t, map[string]Policy{ih1.String(): {Interval: time.Hour, HideFromScrapes: true}}, reopened.List())
+
+	// Policies are kept if they are no longer read from a file.
+	require.Nil(t, reopened.Open(""))
+	require.True(t, reopened.Hidden(ih1))
+
+	require.Nil(t, ioutil.WriteFile(path, []byte(ih1.String()+":\n  approval: maybe\n"), 0644))
+	require.NotNil(t, NewStore().Open(path))
+	require.Nil(t, ioutil.WriteFile(path, []byte("abc:\n  freeleech: true\n"), 0644))
+	require.NotNil(t, NewStore().Open(path))
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	s := NewStore()
+	require.Nil(t, s.Set(ih1, Policy{Interval: time.Minute, Freeleech: true}))
+	require.Nil(t, s.Set(ih2, Policy{Approval: Unapproved}))
+
+	resp := &bittorrent.AnnounceResponse{Interval: time.Hour, MinInterval: 30 * time.Minute}
+	ctx, err := s.HandleAnnounce(context.Background(), &bittorrent.AnnounceRequest{InfoHash: ih1}, resp)
+	require.Nil(t, err)
+	require.Equal(t, time.Minute, resp.Interval)
+	require.Equal(t, time.Minute, resp.MinInterval)
+	p, ok := FromContext(ctx)
+	require.True(t, ok)
+	require.True(t, p.Freeleech)
+
+	_, err = s.HandleAnnounce(context.Background(), &bittorrent.AnnounceRequest{InfoHash: ih2}, &bittorrent.AnnounceResponse{})
+	require.Equal(t, ErrTorrentUnapproved, err)
+
+	ctx, err = s.HandleAnnounce(context.Background(), &bittorrent.AnnounceRequest{}, &bittorrent.AnnounceResponse{})
+	require.Nil(t, err)
+	_, ok = FromContext(ctx)
+	require.False(t, ok)
+}
+
+func TestHandleScrape(t *testing.T) {
+	s := NewStore()
+	require.Nil(t, s.Set(ih1, Policy{HideFromScrapes: true}))
+
+	ctx, err := s.HandleScrape(context.Background(), &bittorrent.ScrapeRequest{InfoHashes: []bittorrent.InfoHash{ih1, ih2}}, &bittorrent.ScrapeResponse{})
+	require.Nil(t, err)
+	require.Equal(t, map[bittorrent.InfoHash]struct{}{ih1: {}}, ctx.Value(middleware.HiddenSwarmsKey))
+
+	ctx, err = s.HandleScrape(context.Background(), &bittorrent.ScrapeRequest{InfoHashes: []bittorrent.InfoHash{ih2}}, &bittorrent.ScrapeResponse{})
+	require.Nil(t, err)
+	require.Nil(t, ctx.Value(middleware.HiddenSwarmsKey))
+}
@@ -0,0 +1,68 @@
+package push
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"time"
+)
+
+func init() {
+	RegisterBackend("graphite", newGraphite)
+}
+
+// graphiteTimeout limits the time spent connecting to and writing to Graphite.
+const graphiteTimeout = 10 * time.Second
+
+// graphite is a Sink that pushes to Graphite using the plaintext protocol.
+//
+// Graphite derives rates from the cumulative values of counters itself, so
+// all values are sent as they are.
+type graphite struct {
+	addr string
+	conn net.Conn
+}
+
+func newGraphite(addr string) (Sink, error) {
+	return &graphite{addr: addr}, nil
+}
+
+func (g *graphite) Push(samples []Sample, now time.Time) error {
+	// The connection is established lazily and again after failures, so that
+	// Graphite being unavailable for a while doesn't require a restart.
+	if g.conn == nil {
+		conn, err := net.DialTimeout("tcp", g.addr, graphiteTimeout)
+		if err != nil {
+			return err
+		}
+		g.conn = conn
+	}
+
+	g.conn.SetWriteDeadline(time.Now().Add(graphiteTimeout))
+	w := bufio.NewWriter(g.conn)
+	ts := strconv.FormatInt(now.Unix(), 10)
+	var line []byte
+	for _, sample := range samples {
+		line = append(line[:0], sample.Name...)
+		line = append(line, ' ')
+		line = strconv.AppendFloat(line, sample.Value, 'f', -1, 64)
+		line = append(line, ' ')
+		line = append(line, ts...)
+		line = append(line, '\n')
+		w.Write(line)
+	}
+
+	if err := w.Flush(); err != nil {
+		g.conn.Close()
+		g.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (g *graphite) Close() error {
+	if g.conn == nil {
+		return nil
+	}
+	return g.conn.Close()
+}
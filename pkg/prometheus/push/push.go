@@ -0,0 +1,270 @@
+// Package push implements a reporter that periodically pushes the values of
+// the registered Prometheus metrics to push-based monitoring systems such as
+// StatsD or Graphite.
+//
+// Backends are pluggable: every backend registers a constructor for its Sink
+// with RegisterBackend.
+package push
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+var (
+	backendsM sync.RWMutex
+	backends  = make(map[string]NewSinkFunc)
+)
+
+// NewSinkFunc creates a Sink that pushes to the given address.
+type NewSinkFunc func(addr string) (Sink, error)
+
+// RegisterBackend makes a backend available by the provided name.
+//
+// If called twice with the same name, the name is blank, or if the provided
+// function is nil, this function panics.
+func RegisterBackend(name string, newSink NewSinkFunc) {
+	if name == "" {
+		panic("push: could not register a backend with an empty name")
+	}
+	if newSink == nil {
+		panic("push: could not register a nil backend")
+	}
+
+	backendsM.Lock()
+	defer backendsM.Unlock()
+
+	if _, dup := backends[name]; dup {
+		panic("push: RegisterBackend called twice for " + name)
+	}
+
+	backends[name] = newSink
+}
+
+// ErrUnknownBackend is returned when creating a Reporter for a backend that
+// has not been registered.
+var ErrUnknownBackend = errors.New("push: unknown backend")
+
+// Type is the type of a Sample.
+type Type int
+
+const (
+	// Counter is a value that only ever increases.
+	Counter Type = iota
+
+	// Gauge is a value that can increase and decrease.
+	Gauge
+)
+
+// Sample is the value of a single metric.
+type Sample struct {
+	// Name is the name of the metric, followed by the names and values of
+	// its labels, separated by dots.
+	Name  string
+	Type  Type
+	Value float64
+}
+
+// Sink is a push-based monitoring system that Samples are pushed to.
+type Sink interface {
+	// Push pushes the Samples gathered at the given time.
+	Push(samples []Sample, now time.Time) error
+
+	// Close closes the connection to the monitoring system.
+	Close() error
+}
+
+// Config holds the configuration of a Reporter.
+type Config struct {
+	Backend  string        `yaml:"backend"`
+	Addr     string        `yaml:"addr"`
+	Prefix   string        `yaml:"prefix"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"backend":  cfg.Backend,
+		"addr":     cfg.Addr,
+		"prefix":   cfg.Prefix,
+		"interval": cfg.Interval,
+	}
+}
+
+// Default config constants.
+const defaultInterval = 10 * time.Second
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.Interval <= 0 {
+		validcfg.Interval = defaultInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "push.Interval",
+			"provided": cfg.Interval,
+			"default":  validcfg.Interval,
+		})
+	}
+
+	return validcfg
+}
+
+// Reporter pushes the values of the metrics of a prometheus.Gatherer to a
+// Sink on an interval.
+type Reporter struct {
+	cfg      Config
+	gatherer prometheus.Gatherer
+	sink     Sink
+	closing  chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewReporter creates a Reporter that pushes the metrics registered with the
+// default Prometheus registry.
+func NewReporter(provided Config) (*Reporter, error) {
+	cfg := provided.Validate()
+
+	backendsM.RLock()
+	newSink, ok := backends[cfg.Backend]
+	backendsM.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%s: %q", ErrUnknownBackend, cfg.Backend)
+	}
+
+	sink, err := newSink(cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Reporter{
+		cfg:      cfg,
+		gatherer: prometheus.DefaultGatherer,
+		sink:     sink,
+		closing:  make(chan struct{}),
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		t := time.NewTicker(cfg.Interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-r.closing:
+				return
+			case now := <-t.C:
+				if err := r.push(now); err != nil {
+					log.Error("failed to push metrics", log.Fields{"backend": cfg.Backend}, log.Err(err))
+				}
+			}
+		}
+	}()
+
+	return r, nil
+}
+
+// push gathers the metrics and pushes them to the Sink.
+func (r *Reporter) push(now time.Time) error {
+	families, err := r.gatherer.Gather()
+	if err != nil {
+		return err
+	}
+	return r.sink.Push(Samples(families, r.cfg.Prefix), now)
+}
+
+// Stop stops the Reporter after pushing the metrics a final time.
+func (r *Reporter) Stop() stop.Result {
+	c := make(stop.Channel)
+	go func() {
+		close(r.closing)
+		r.wg.Wait()
+
+		err := r.push(time.Now())
+		if closeErr := r.sink.Close(); err == nil {
+			err = closeErr
+		}
+		c.Done(err)
+	}()
+	return c.Result()
+}
+
+// Samples converts gathered metric families into Samples.
+//
+// Histograms and summaries are reported as the counters of their count and
+// sum. The names of all Samples are prefixed with prefix, if set.
+func Samples(families []*dto.MetricFamily, prefix string) []Sample {
+	var samples []Sample
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			name := sampleName(prefix, family.GetName(), m.GetLabel())
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				samples = append(samples, Sample{name, Counter, m.GetCounter().GetValue()})
+			case dto.MetricType_GAUGE:
+				samples = append(samples, Sample{name, Gauge, m.GetGauge().GetValue()})
+			case dto.MetricType_UNTYPED:
+				samples = append(samples, Sample{name, Gauge, m.GetUntyped().GetValue()})
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				samples = append(samples,
+					Sample{name + ".count", Counter, float64(h.GetSampleCount())},
+					Sample{name + ".sum", Counter, h.GetSampleSum()},
+				)
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				samples = append(samples,
+					Sample{name + ".count", Counter, float64(s.GetSampleCount())},
+					Sample{name + ".sum", Counter, s.GetSampleSum()},
+				)
+			}
+		}
+	}
+	return samples
+}
+
+// sampleName joins the prefix, the name of a metric and its labels, sorted by
+// name, with dots.
+func sampleName(prefix, name string, labels []*dto.LabelPair) string {
+	parts := make([]string, 0, 2+2*len(labels))
+	if prefix != "" {
+		parts = append(parts, prefix)
+	}
+	parts = append(parts, name)
+
+	sorted := append([]*dto.LabelPair(nil), labels...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].GetName() < sorted[j].GetName() })
+	for _, l := range sorted {
+		parts = append(parts, sanitize(l.GetName()), sanitize(l.GetValue()))
+	}
+	return strings.Join(parts, ".")
+}
+
+// sanitize replaces the characters that have a special meaning in StatsD or
+// Graphite metric names.
+func sanitize(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+			return r
+		}
+		return '_'
+	}, s)
+}
@@ -0,0 +1,81 @@
+package push
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSamples(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "requests_total", Help: "help"}, []string{"action", "error"})
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "queue_depth", Help: "help"})
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "duration_milliseconds", Help: "help"})
+	reg.MustRegister(counter, gauge, histogram)
+
+	counter.WithLabelValues("announce", "bad request").Add(3)
+	gauge.Set(7)
+	histogram.Observe(1.5)
+	histogram.Observe(2.5)
+
+	families, err := reg.Gather()
+	require.Nil(t, err)
+	require.Equal(t, []Sample{
+		{"chihaya.duration_milliseconds.count", Counter, 2},
+		{"chihaya.duration_milliseconds.sum", Counter, 4},
+		{"chihaya.queue_depth", Gauge, 7},
+		{"chihaya.requests_total.action.announce.error.bad_request", Counter, 3},
+	}, Samples(families, "chihaya"))
+}
+
+func TestStatsD(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer pc.Close()
+
+	sink, err := newStatsD(pc.LocalAddr().String())
+	require.Nil(t, err)
+	defer sink.Close()
+
+	read := func() string {
+		buf := make([]byte, maxStatsDPacketSize)
+		pc.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := pc.ReadFrom(buf)
+		require.Nil(t, err)
+		return string(buf[:n])
+	}
+
+	require.Nil(t, sink.Push([]Sample{{"a", Counter, 5}, {"b", Gauge, 1.5}}, time.Now()))
+	require.Equal(t, "a:5|c\nb:1.5|g", read())
+
+	// Counters are pushed as increments, unchanged ones not at all.
+	require.Nil(t, sink.Push([]Sample{{"a", Counter, 8}, {"c", Counter, 0}}, time.Now()))
+	require.Equal(t, "a:3|c", read())
+}
+
+func TestGraphite(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer l.Close()
+
+	sink, err := newGraphite(l.Addr().String())
+	require.Nil(t, err)
+	defer sink.Close()
+
+	now := time.Unix(1500000000, 0)
+	require.Nil(t, sink.Push([]Sample{{"a", Counter, 5}, {"b", Gauge, 1.5}}, now))
+
+	conn, err := l.Accept()
+	require.Nil(t, err)
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for _, expected := range []string{"a 5 1500000000\n", "b 1.5 1500000000\n"} {
+		line, err := r.ReadString('\n')
+		require.Nil(t, err)
+		require.Equal(t, expected, line)
+	}
+}
@@ -0,0 +1,84 @@
+package push
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"time"
+)
+
+func init() {
+	RegisterBackend("statsd", newStatsD)
+}
+
+// maxStatsDPacketSize is the largest payload sent in a single packet, which
+// fits into an Ethernet frame.
+const maxStatsDPacketSize = 1432
+
+// statsD is a Sink that pushes to StatsD over UDP.
+//
+// StatsD expects counters as increments, so the differences to the values
+// pushed before are sent.
+type statsD struct {
+	conn net.Conn
+	last map[string]float64
+}
+
+func newStatsD(addr string) (Sink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &statsD{conn: conn, last: make(map[string]float64)}, nil
+}
+
+func (s *statsD) Push(samples []Sample, now time.Time) error {
+	var buf bytes.Buffer
+	for _, sample := range samples {
+		var line []byte
+		switch sample.Type {
+		case Counter:
+			delta := sample.Value - s.last[sample.Name]
+			if delta < 0 {
+				// The counter was reset, e.g. by a restart.
+				delta = sample.Value
+			}
+			s.last[sample.Name] = sample.Value
+			if delta == 0 {
+				continue
+			}
+			line = appendStatsD(nil, sample.Name, delta, "c")
+		case Gauge:
+			line = appendStatsD(nil, sample.Name, sample.Value, "g")
+		}
+
+		if buf.Len() > 0 && buf.Len()+1+len(line) > maxStatsDPacketSize {
+			if _, err := s.conn.Write(buf.Bytes()); err != nil {
+				return err
+			}
+			buf.Reset()
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.Write(line)
+	}
+
+	if buf.Len() > 0 {
+		_, err := s.conn.Write(buf.Bytes())
+		return err
+	}
+	return nil
+}
+
+func appendStatsD(b []byte, name string, value float64, typ string) []byte {
+	b = append(b, name...)
+	b = append(b, ':')
+	b = strconv.AppendFloat(b, value, 'f', -1, 64)
+	b = append(b, '|')
+	return append(b, typ...)
+}
+
+func (s *statsD) Close() error {
+	return s.conn.Close()
+}
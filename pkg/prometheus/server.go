@@ -1,21 +1,53 @@
 // Package prometheus implements a standalone HTTP server for serving a
-// Prometheus metrics endpoint.
+// Prometheus metrics endpoint and health checks.
 package prometheus
 
 import (
 	"context"
+	"net"
 	"net/http"
+	"sync/atomic"
 
 	"github.com/prometheus/client_golang/prometheus"
 
+	"github.com/chihaya/chihaya/internal/handoff"
 	"github.com/chihaya/chihaya/pkg/log"
 	"github.com/chihaya/chihaya/pkg/stop"
 )
 
 // Server represents a standalone HTTP server for serving a Prometheus metrics
 // endpoint.
+//
+// Besides /metrics, it serves /healthz, which succeeds as long as the server
+// is running, and /readyz, which succeeds only while the Server is marked as
+// ready. Metrics are also served on any other path, as they always were.
 type Server struct {
 	srv *http.Server
+
+	// ready is 1 while the Server is marked as ready.
+	ready int32
+}
+
+// SetReady marks whether the process is ready to serve requests, which is
+// reported by /readyz.
+func (s *Server) SetReady(ready bool) {
+	var v int32
+	if ready {
+		v = 1
+	}
+	atomic.StoreInt32(&s.ready, v)
+}
+
+func (s *Server) serveHealth(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+func (s *Server) serveReadiness(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&s.ready) != 1 {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
 }
 
 // Stop shuts down the server.
@@ -31,15 +63,32 @@ func (s *Server) Stop() stop.Result {
 // NewServer creates a new instance of a Prometheus server that asynchronously
 // serves requests.
 func NewServer(addr string) *Server {
-	s := &Server{
-		srv: &http.Server{
-			Addr:    addr,
-			Handler: prometheus.Handler(),
-		},
+	s := &Server{}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", prometheus.Handler())
+	mux.HandleFunc("/healthz", s.serveHealth)
+	mux.HandleFunc("/readyz", s.serveReadiness)
+	s.srv = &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+
+	// The socket is bound before returning, so that privileges can be
+	// dropped afterwards. On upgrades, it is taken over from the previous
+	// process.
+	if addr == "" {
+		addr = ":http"
+	}
+	l, err := handoff.Listen("tcp", addr, func() (net.Listener, error) {
+		return net.Listen("tcp", addr)
+	})
+	if err != nil {
+		log.Fatal("failed while serving prometheus", log.Err(err))
 	}
 
 	go func() {
-		if err := s.srv.ListenAndServe(); err != http.ErrServerClosed {
+		if err := s.srv.Serve(l); err != http.ErrServerClosed {
 			log.Fatal("failed while serving prometheus", log.Err(err))
 		}
 	}()
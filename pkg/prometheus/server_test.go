@@ -0,0 +1,28 @@
+package prometheus
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthChecks(t *testing.T) {
+	s := &Server{}
+
+	get := func(handler http.HandlerFunc) int {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", "/", nil))
+		return rec.Code
+	}
+
+	require.Equal(t, http.StatusOK, get(s.serveHealth))
+	require.Equal(t, http.StatusServiceUnavailable, get(s.serveReadiness))
+
+	s.SetReady(true)
+	require.Equal(t, http.StatusOK, get(s.serveReadiness))
+
+	s.SetReady(false)
+	require.Equal(t, http.StatusServiceUnavailable, get(s.serveReadiness))
+}
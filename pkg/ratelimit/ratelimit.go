@@ -0,0 +1,76 @@
+// Package ratelimit implements token buckets for a bounded number of keys,
+// such as IP addresses or infohashes.
+package ratelimit
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Limiter limits the rate of events per key using token buckets.
+//
+// Only the buckets of the most recently seen keys are kept. If a key is
+// evicted from the cache, its next event starts with a full bucket.
+type Limiter struct {
+	rate  float64
+	burst float64
+	size  int
+
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+	lru     *list.List
+}
+
+// bucket is the token bucket of a key.
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// New creates a Limiter allowing rate events per second and bursts of burst
+// events for each of up to size keys.
+func New(rate float64, burst, size int) *Limiter {
+	return &Limiter{
+		rate:    rate,
+		burst:   float64(burst),
+		size:    size,
+		buckets: make(map[string]*list.Element, size),
+		lru:     list.New(),
+	}
+}
+
+// Allow takes a token from the bucket of key and returns whether there was
+// one.
+func (l *Limiter) Allow(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var b *bucket
+	if e, ok := l.buckets[key]; ok {
+		l.lru.MoveToFront(e)
+		b = e.Value.(*bucket)
+
+		b.tokens += now.Sub(b.last).Seconds() * l.rate
+		if b.tokens > l.burst {
+			b.tokens = l.burst
+		}
+		b.last = now
+	} else {
+		if l.lru.Len() >= l.size {
+			oldest := l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*bucket).key)
+		}
+
+		b = &bucket{key: key, tokens: l.burst, last: now}
+		l.buckets[key] = l.lru.PushFront(b)
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
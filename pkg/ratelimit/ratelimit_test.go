@@ -0,0 +1,29 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiter(t *testing.T) {
+	l := New(1, 2, 2)
+	now := time.Unix(0, 0)
+	a, b, c := "a", "b", "c"
+
+	// The burst is allowed, then events are limited to the rate.
+	require.True(t, l.Allow(a, now))
+	require.True(t, l.Allow(a, now))
+	require.False(t, l.Allow(a, now))
+	require.True(t, l.Allow(a, now.Add(time.Second)))
+	require.False(t, l.Allow(a, now.Add(time.Second)))
+
+	// Keys are limited separately.
+	require.True(t, l.Allow(b, now))
+
+	// The least recently seen key is evicted and starts with a full bucket.
+	require.True(t, l.Allow(c, now))
+	require.True(t, l.Allow(a, now.Add(time.Second)))
+	require.True(t, l.Allow(a, now.Add(time.Second)))
+}
@@ -0,0 +1,175 @@
+package relay
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+// Server relays TCP connections made to tokens to the peers they encrypt.
+//
+// The prefix of the tokens must be routed to the host of the Server, so that
+// it accepts connections to any address in it. On Linux this is done with a
+// local route, such as:
+//
+//	ip -6 route add local 2001:db8:1::/64 dev lo
+type Server struct {
+	tokens      *Tokens
+	dialTimeout time.Duration
+	l           net.Listener
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// NewServer creates a Server that relays the connections accepted from l.
+// A connection is closed if the peer can't be reached within dialTimeout.
+func NewServer(l net.Listener, tokens *Tokens, dialTimeout time.Duration) *Server {
+	s := &Server{
+		tokens:      tokens,
+		dialTimeout: dialTimeout,
+		l:           l,
+		conns:       make(map[net.Conn]struct{}),
+	}
+
+	s.wg.Add(1)
+	go s.serve()
+
+	return s
+}
+
+// Addr returns the address the Server listens on.
+func (s *Server) Addr() net.Addr {
+	return s.l.Addr()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Debug("relay: temporary error accepting connection", log.Err(err))
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			log.Error("relay: failed to accept connection", log.Err(err))
+			return
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.relay(conn)
+		}()
+	}
+}
+
+// track adds conn to the connections closed when the Server stops. It
+// returns false if the Server is already stopped.
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+// relay forwards conn to the peer encrypted in the address it was made to.
+func (s *Server) relay(conn net.Conn) {
+	defer conn.Close()
+
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return
+	}
+	ip, port, ok := s.tokens.Open(local.IP)
+	if !ok {
+		log.Debug("relay: connection to an invalid token", log.Fields{"token": local.IP})
+		return
+	}
+
+	if !s.track(conn) {
+		return
+	}
+	defer s.untrack(conn)
+
+	peer, err := net.DialTimeout("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), s.dialTimeout)
+	if err != nil {
+		log.Debug("relay: failed to reach peer", log.Err(err))
+		return
+	}
+	if !s.track(peer) {
+		peer.Close()
+		return
+	}
+	defer s.untrack(peer)
+	defer peer.Close()
+
+	// Each direction is closed when the other side stops sending, so that
+	// both copies finish.
+	done := make(chan struct{})
+	go func() {
+		io.Copy(peer, conn)
+		closeWrite(peer)
+		close(done)
+	}()
+	io.Copy(conn, peer)
+	closeWrite(conn)
+	<-done
+}
+
+// closeWrite shuts down the writing side of conn, or closes it, if that is
+// not supported.
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+		return
+	}
+	conn.Close()
+}
+
+// Stop stops accepting connections and closes the relayed ones.
+func (s *Server) Stop() stop.Result {
+	c := make(stop.Channel)
+	go func() {
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			c.Done()
+			return
+		}
+		s.closed = true
+		err := s.l.Close()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+
+		s.wg.Wait()
+		c.Done(err)
+	}()
+
+	return c.Result()
+}
@@ -0,0 +1,87 @@
+package relay
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// tokenListener accepts connections as if they were made to token.
+type tokenListener struct {
+	net.Listener
+	token net.IP
+}
+
+type tokenConn struct {
+	*net.TCPConn
+	local net.Addr
+}
+
+func (c tokenConn) LocalAddr() net.Addr { return c.local }
+
+func (l tokenListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return tokenConn{conn.(*net.TCPConn), &net.TCPAddr{IP: l.token, Port: 6881}}, nil
+}
+
+func TestServer(t *testing.T) {
+	peer, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer peer.Close()
+	go func() {
+		conn, err := peer.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		b, _ := ioutil.ReadAll(conn)
+		conn.Write(append([]byte("echo "), b...))
+	}()
+
+	tokens, err := NewTokens(testKey, mustParseCIDR("2001:db8:1::/64"))
+	require.Nil(t, err)
+	token := tokens.Seal(net.IPv4(127, 0, 0, 1), uint16(peer.Addr().(*net.TCPAddr).Port))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	s := NewServer(tokenListener{l, token}, tokens, time.Second)
+	defer func() { s.Stop().Wait() }()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	require.Nil(t, err)
+	require.Nil(t, conn.(*net.TCPConn).CloseWrite())
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	b, err := ioutil.ReadAll(conn)
+	require.Nil(t, err)
+	require.Equal(t, "echo hello", string(b))
+}
+
+func TestServerRejectsInvalidTokens(t *testing.T) {
+	tokens, err := NewTokens(testKey, mustParseCIDR("2001:db8:1::/64"))
+	require.Nil(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	s := NewServer(tokenListener{l, net.ParseIP("2001:db8:1::1")}, tokens, time.Second)
+	defer func() { s.Stop().Wait() }()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+
+	// The connection is closed without being relayed.
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	b, err := ioutil.ReadAll(conn)
+	require.Nil(t, err)
+	require.Empty(t, b)
+}
@@ -0,0 +1,120 @@
+// Package relay implements relaying connections between peers, so that peers
+// don't learn each other's IP addresses from the tracker.
+//
+// Instead of the address of a peer, the tracker returns a token: an address
+// in an IPv6 prefix routed to the relay, which encrypts the address and port
+// of the peer. Clients connect to the token as if it were a peer, and the
+// relay decrypts the address the connection was made to and forwards the
+// connection to the peer.
+//
+// Tokens are stateless, so the relay and the tracker only share a key.
+// Only IPv4 peers can be relayed, as the 64 bits of an address below a /64
+// prefix can't hold the address of an IPv6 peer.
+package relay
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// MinKeyLength is the minimum length of the key tokens are encrypted with.
+const MinKeyLength = 16
+
+// ErrInvalidPrefix is returned for a prefix that is not an IPv6 prefix of at
+// most 64 bits.
+var ErrInvalidPrefix = errors.New("relay: the prefix must be an IPv6 prefix of at most 64 bits")
+
+// ErrInvalidKey is returned for a key shorter than MinKeyLength.
+var ErrInvalidKey = errors.New("relay: the key must be at least 16 bytes long")
+
+// feistelRounds is the number of rounds of the Feistel network that encrypts
+// tokens. Four rounds make it a strong pseudorandom permutation.
+const feistelRounds = 4
+
+// Tokens encrypts the endpoints of peers into tokens and decrypts them.
+//
+// A token is the 64-bit block of an endpoint encrypted with a Feistel
+// network below the prefix. The block holds the IPv4 address, the port and
+// two zero bytes, so that all but one in 65536 forged tokens are rejected.
+type Tokens struct {
+	key    []byte
+	prefix net.IP
+}
+
+// NewTokens creates Tokens for the given key and prefix.
+func NewTokens(key []byte, prefix *net.IPNet) (*Tokens, error) {
+	if len(key) < MinKeyLength {
+		return nil, ErrInvalidKey
+	}
+	if prefix == nil || len(prefix.IP) != net.IPv6len || prefix.IP.To4() != nil {
+		return nil, ErrInvalidPrefix
+	}
+	if ones, bits := prefix.Mask.Size(); bits != 128 || ones > 64 {
+		return nil, ErrInvalidPrefix
+	}
+
+	return &Tokens{
+		key:    append([]byte(nil), key...),
+		prefix: prefix.IP.Mask(prefix.Mask)[:8],
+	}, nil
+}
+
+// Seal returns the token of the IPv4 endpoint ip:port.
+// It returns nil if ip is not an IPv4 address.
+func (t *Tokens) Seal(ip net.IP, port uint16) net.IP {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil
+	}
+
+	var block [8]byte
+	copy(block[:4], ip4)
+	binary.BigEndian.PutUint16(block[4:6], port)
+
+	l, r := binary.BigEndian.Uint32(block[:4]), binary.BigEndian.Uint32(block[4:])
+	for i := 0; i < feistelRounds; i++ {
+		l, r = r, l^t.round(i, r)
+	}
+
+	token := make(net.IP, net.IPv6len)
+	copy(token, t.prefix)
+	binary.BigEndian.PutUint32(token[8:12], l)
+	binary.BigEndian.PutUint32(token[12:], r)
+	return token
+}
+
+// Open returns the endpoint encrypted in token. It returns false if token is
+// not below the prefix or was not sealed with the key.
+func (t *Tokens) Open(token net.IP) (net.IP, uint16, bool) {
+	if len(token) != net.IPv6len || !net.IP(token[:8]).Equal(t.prefix) {
+		return nil, 0, false
+	}
+
+	l, r := binary.BigEndian.Uint32(token[8:12]), binary.BigEndian.Uint32(token[12:])
+	for i := feistelRounds - 1; i >= 0; i-- {
+		l, r = r^t.round(i, l), l
+	}
+
+	var block [8]byte
+	binary.BigEndian.PutUint32(block[:4], l)
+	binary.BigEndian.PutUint32(block[4:], r)
+	if block[6] != 0 || block[7] != 0 {
+		return nil, 0, false
+	}
+
+	return net.IP(block[:4]), binary.BigEndian.Uint16(block[4:6]), true
+}
+
+// round is the round function of the Feistel network.
+func (t *Tokens) round(i int, half uint32) uint32 {
+	var b [5]byte
+	b[0] = byte(i)
+	binary.BigEndian.PutUint32(b[1:], half)
+
+	mac := hmac.New(sha256.New, t.key)
+	mac.Write(b[:])
+	return binary.BigEndian.Uint32(mac.Sum(nil))
+}
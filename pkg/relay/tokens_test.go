@@ -0,0 +1,74 @@
+package relay
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testKey = []byte("0123456789abcdef")
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func TestNewTokens(t *testing.T) {
+	var table = []struct {
+		key      []byte
+		prefix   string
+		expected error
+	}{
+		{testKey, "2001:db8:1::/64", nil},
+		{testKey, "2001:db8::/48", nil},
+		{testKey[:15], "2001:db8:1::/64", ErrInvalidKey},
+		{testKey, "2001:db8:1::/96", ErrInvalidPrefix},
+		{testKey, "192.0.2.0/24", ErrInvalidPrefix},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.prefix, func(t *testing.T) {
+			_, err := NewTokens(tt.key, mustParseCIDR(tt.prefix))
+			require.Equal(t, tt.expected, err)
+		})
+	}
+}
+
+func TestTokens(t *testing.T) {
+	tokens, err := NewTokens(testKey, mustParseCIDR("2001:db8:1::/64"))
+	require.Nil(t, err)
+
+	token := tokens.Seal(net.ParseIP("198.51.100.1"), 6881)
+	require.True(t, mustParseCIDR("2001:db8:1::/64").Contains(token))
+
+	ip, port, ok := tokens.Open(token)
+	require.True(t, ok)
+	require.Equal(t, net.IP{198, 51, 100, 1}, ip)
+	require.Equal(t, uint16(6881), port)
+
+	// Tokens don't reveal the endpoint and differ for every endpoint.
+	require.NotContains(t, string(token), string([]byte{198, 51, 100, 1}))
+	require.NotEqual(t, token, tokens.Seal(net.ParseIP("198.51.100.1"), 6882))
+	require.NotEqual(t, token, tokens.Seal(net.ParseIP("198.51.100.2"), 6881))
+
+	// IPv6 peers can't be relayed.
+	require.Nil(t, tokens.Seal(net.ParseIP("2001:db8::1"), 6881))
+
+	// Tokens of other keys or prefixes are rejected.
+	other, err := NewTokens([]byte("fedcba9876543210"), mustParseCIDR("2001:db8:1::/64"))
+	require.Nil(t, err)
+	_, _, ok = other.Open(token)
+	require.False(t, ok)
+
+	other, err = NewTokens(testKey, mustParseCIDR("2001:db8:2::/64"))
+	require.Nil(t, err)
+	_, _, ok = other.Open(token)
+	require.False(t, ok)
+
+	_, _, ok = tokens.Open(net.ParseIP("198.51.100.1"))
+	require.False(t, ok)
+}
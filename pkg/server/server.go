@@ -0,0 +1,169 @@
+// Package server implements a Pool managing the lifecycle of the servers of a
+// tracker, like its frontends.
+//
+// Servers are booted one after another and stopped in the reverse order. A
+// Pool watches the servers that can fail while serving, so that the first
+// failure can be handled in one place instead of exiting the process from
+// the goroutine serving requests.
+package server
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+// Server is a server managed by a Pool. It serves requests from the time it
+// is booted until it is stopped.
+type Server interface {
+	stop.Stopper
+}
+
+// Failer is implemented by Servers that can fail while serving.
+type Failer interface {
+	// Failed returns a channel that receives the error the Server failed
+	// with, if it stops serving before it is stopped.
+	Failed() <-chan error
+}
+
+// BootFunc boots a Server. It returns once the Server is ready to serve
+// requests, for example once its sockets are bound.
+type BootFunc func() (Server, error)
+
+// Pool is a set of Servers that are stopped together.
+type Pool struct {
+	mu      sync.Mutex
+	members []*member
+
+	// failed receives the first failure of any member.
+	failed chan error
+}
+
+// member is a Server of a Pool.
+type member struct {
+	name   string
+	server Server
+
+	// stopping is closed once the Server is being stopped, after which its
+	// failures are no longer reported.
+	stopping chan struct{}
+}
+
+// NewPool creates an empty Pool.
+func NewPool() *Pool {
+	return &Pool{failed: make(chan error, 1)}
+}
+
+// Boot boots a Server with boot and adds it to the Pool under name.
+//
+// Servers are booted in the order Boot is called. If boot fails, its error is
+// returned and the Pool is left unchanged.
+func (p *Pool) Boot(name string, boot BootFunc) error {
+	srv, err := boot()
+	if err != nil {
+		return fmt.Errorf("failed to boot %s: %s", name, err)
+	}
+
+	m := &member{name: name, server: srv, stopping: make(chan struct{})}
+	p.mu.Lock()
+	p.members = append(p.members, m)
+	p.mu.Unlock()
+
+	if f, ok := srv.(Failer); ok {
+		go p.watch(m, f.Failed())
+	}
+	log.Debug("booted server", log.Fields{"name": name})
+	return nil
+}
+
+// watch reports the failure of a member, unless it is stopped first.
+func (p *Pool) watch(m *member, failed <-chan error) {
+	select {
+	case err := <-failed:
+		select {
+		case <-m.stopping:
+			// Servers may fail while they are being stopped.
+			return
+		default:
+		}
+
+		select {
+		case p.failed <- fmt.Errorf("%s failed: %s", m.name, err):
+		default:
+			// Another member failed first.
+		}
+	case <-m.stopping:
+	}
+}
+
+// Failed returns a channel that receives the first error any Server of the
+// Pool failed with while serving.
+//
+// The Pool keeps running after a failure. It is up to the receiver to stop
+// it.
+func (p *Pool) Failed() <-chan error {
+	return p.failed
+}
+
+// Names returns the names of the Servers of the Pool in the order they were
+// booted.
+func (p *Pool) Names() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	names := make([]string, len(p.members))
+	for i, m := range p.members {
+		names[i] = m.name
+	}
+	return names
+}
+
+// StopServer stops the Server with the given name and removes it from the
+// Pool. If there is no such Server, stop.AlreadyStopped is returned.
+func (p *Pool) StopServer(name string) stop.Result {
+	p.mu.Lock()
+	var m *member
+	for i := range p.members {
+		if p.members[i].name == name {
+			m = p.members[i]
+			p.members = append(p.members[:i], p.members[i+1:]...)
+			break
+		}
+	}
+	p.mu.Unlock()
+
+	if m == nil {
+		return stop.AlreadyStopped
+	}
+	return m.stop()
+}
+
+// Stop stops all Servers of the Pool and removes them from it.
+//
+// The Servers are stopped in the reverse order they were booted, each once
+// the one booted after it finished stopping. The errors of all Servers are
+// returned.
+func (p *Pool) Stop() stop.Result {
+	p.mu.Lock()
+	members := p.members
+	p.members = nil
+	p.mu.Unlock()
+
+	c := make(stop.Channel)
+	go func() {
+		var errs []error
+		for i := len(members) - 1; i >= 0; i-- {
+			errs = append(errs, members[i].stop().Wait()...)
+		}
+		c.Done(errs...)
+	}()
+	return c.Result()
+}
+
+func (m *member) stop() stop.Result {
+	log.Debug("stopping server", log.Fields{"name": m.name})
+	close(m.stopping)
+	return m.server.Stop()
+}
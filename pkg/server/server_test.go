@@ -0,0 +1,97 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+// fakeServer records the order servers are stopped in.
+type fakeServer struct {
+	name    string
+	stopped *[]string
+	mu      *sync.Mutex
+	failed  chan error
+	err     error
+}
+
+func (s *fakeServer) Stop() stop.Result {
+	c := make(stop.Channel)
+	go func() {
+		s.mu.Lock()
+		*s.stopped = append(*s.stopped, s.name)
+		s.mu.Unlock()
+		c.Done(s.err)
+	}()
+	return c.Result()
+}
+
+func (s *fakeServer) Failed() <-chan error { return s.failed }
+
+type fakeServers struct {
+	mu      sync.Mutex
+	stopped []string
+}
+
+func (fs *fakeServers) boot(name string, err error) BootFunc {
+	return func() (Server, error) {
+		return &fakeServer{name: name, stopped: &fs.stopped, mu: &fs.mu, failed: make(chan error, 1), err: err}, nil
+	}
+}
+
+func TestPoolStopsInReverseOrder(t *testing.T) {
+	var fs fakeServers
+	p := NewPool()
+	require.Nil(t, p.Boot("a", fs.boot("a", nil)))
+	require.Nil(t, p.Boot("b", fs.boot("b", errors.New("b failed to stop"))))
+	require.Nil(t, p.Boot("c", fs.boot("c", nil)))
+	require.Equal(t, []string{"a", "b", "c"}, p.Names())
+
+	errs := p.Stop().Wait()
+	require.Equal(t, []string{"c", "b", "a"}, fs.stopped)
+	require.Len(t, errs, 1)
+	require.Empty(t, p.Names())
+}
+
+func TestPoolBootFailure(t *testing.T) {
+	p := NewPool()
+	err := p.Boot("a", func() (Server, error) { return nil, errors.New("address in use") })
+	require.EqualError(t, err, "failed to boot a: address in use")
+	require.Empty(t, p.Names())
+}
+
+func TestPoolStopServer(t *testing.T) {
+	var fs fakeServers
+	p := NewPool()
+	require.Nil(t, p.Boot("a", fs.boot("a", nil)))
+	require.Nil(t, p.Boot("b", fs.boot("b", nil)))
+
+	require.Empty(t, p.StopServer("b").Wait())
+	require.Equal(t, []string{"b"}, fs.stopped)
+	require.Equal(t, []string{"a"}, p.Names())
+	require.Equal(t, stop.AlreadyStopped, p.StopServer("b"))
+}
+
+func TestPoolFailed(t *testing.T) {
+	p := NewPool()
+	a := &fakeServer{name: "a", stopped: new([]string), mu: new(sync.Mutex), failed: make(chan error, 1)}
+	b := &fakeServer{name: "b", stopped: new([]string), mu: new(sync.Mutex), failed: make(chan error, 1)}
+	require.Nil(t, p.Boot("a", func() (Server, error) { return a, nil }))
+	require.Nil(t, p.Boot("b", func() (Server, error) { return b, nil }))
+
+	b.failed <- errors.New("socket closed")
+	require.EqualError(t, <-p.Failed(), "b failed: socket closed")
+
+	// Servers that are stopped no longer report failures.
+	p.Stop().Wait()
+	a.failed <- errors.New("socket closed")
+	select {
+	case err := <-p.Failed():
+		t.Fatalf("unexpected failure: %s", err)
+	default:
+	}
+}
@@ -2,7 +2,9 @@
 package stop
 
 import (
+	"fmt"
 	"sync"
+	"time"
 )
 
 // Channel is used to return zero or more errors asynchronously. Call Done()
@@ -46,6 +48,44 @@ func init() {
 	AlreadyStopped = closeMe.Result()
 }
 
+// TimeoutError is returned by a Result created by WithTimeout if stopping did
+// not finish in time.
+type TimeoutError struct {
+	// Name is the name of what was being stopped.
+	Name    string
+	Timeout time.Duration
+}
+
+func (e TimeoutError) Error() string {
+	return fmt.Sprintf("%s did not stop within %s", e.Name, e.Timeout)
+}
+
+// WithTimeout returns a Result that returns the errors of r, or a
+// TimeoutError if r is not done within timeout.
+//
+// Whatever is stopping is abandoned after the timeout, so that a component
+// that hangs can't keep the process from exiting. It keeps stopping in the
+// background. If timeout is not positive, r is returned.
+func WithTimeout(r Result, name string, timeout time.Duration) Result {
+	if timeout <= 0 {
+		return r
+	}
+
+	c := make(Channel)
+	go func() {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+
+		select {
+		case errs := <-r:
+			c.Done(errs...)
+		case <-t.C:
+			c.Done(TimeoutError{Name: name, Timeout: timeout})
+		}
+	}()
+	return c.Result()
+}
+
 // Stopper is an interface that allows a clean shutdown.
 type Stopper interface {
 	// Stop returns a channel that indicates whether the stop was
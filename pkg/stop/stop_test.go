@@ -0,0 +1,44 @@
+package stop
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// hung never finishes stopping.
+func hung() Result {
+	return make(Channel).Result()
+}
+
+// stopped finishes stopping with errs right away.
+func stopped(errs ...error) Result {
+	c := make(Channel)
+	go c.Done(errs...)
+	return c.Result()
+}
+
+func TestWithTimeout(t *testing.T) {
+	errFailed := errors.New("failed")
+
+	require.Empty(t, WithTimeout(stopped(), "clean", time.Second).Wait())
+	require.Equal(t, []error{errFailed}, WithTimeout(stopped(errFailed), "failing", time.Second).Wait())
+
+	start := time.Now()
+	errs := WithTimeout(hung(), "hung", 10*time.Millisecond).Wait()
+	require.Equal(t, []error{TimeoutError{Name: "hung", Timeout: 10 * time.Millisecond}}, errs)
+	require.Equal(t, "hung did not stop within 10ms", errs[0].Error())
+	require.True(t, time.Since(start) < time.Second)
+}
+
+func TestGroupWithTimeout(t *testing.T) {
+	g := NewGroup()
+	g.AddFunc(func() Result { return stopped() })
+	g.AddFunc(func() Result { return WithTimeout(hung(), "hung", 10*time.Millisecond) })
+
+	errs := g.Stop().Wait()
+	require.Len(t, errs, 1)
+	require.IsType(t, TimeoutError{}, errs[0])
+}
@@ -0,0 +1,135 @@
+package memory
+
+import (
+	"sync/atomic"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// The policies applied to new peers exceeding a peer limit.
+const (
+	// PeerLimitEvict makes room for new peers by removing the peer that
+	// announced least recently.
+	PeerLimitEvict = "evict"
+
+	// PeerLimitReject rejects new peers.
+	PeerLimitReject = "reject"
+)
+
+const defaultPeerLimitPolicy = PeerLimitEvict
+
+var (
+	// ErrSwarmFull is returned for new peers of swarms that hold
+	// max_swarm_peers peers, if they are rejected.
+	ErrSwarmFull = bittorrent.ClientError("swarm is full")
+
+	// ErrStoreFull is returned for new peers once the storage holds
+	// max_peers peers, if they are rejected or no peer can be evicted.
+	ErrStoreFull = bittorrent.ClientError("tracker is full")
+)
+
+// The limits and actions peer limit metrics are labeled with.
+const (
+	peerLimitSwarm = "swarm"
+	peerLimitTotal = "total"
+
+	peerLimitEvicted  = "evicted"
+	peerLimitRejected = "rejected"
+)
+
+// admit makes room for a new peer in the swarm sw of ih, or returns an error
+// if the peer is rejected.
+//
+// The shard must be locked for writing.
+func (ps *peerStore) admit(shard *peerShard, ih bittorrent.InfoHash, sw swarm) error {
+	if max := ps.cfg.MaxSwarmPeers; max > 0 && len(sw.seeders)+len(sw.leechers) >= max {
+		if ps.cfg.PeerLimitPolicy == PeerLimitReject {
+			recordPeerLimit(peerLimitSwarm, peerLimitRejected)
+			return ErrSwarmFull
+		}
+		shard.evictStalest(ih, sw)
+		atomic.AddInt64(&ps.numPeers, -1)
+		recordPeerLimit(peerLimitSwarm, peerLimitEvicted)
+	}
+
+	// Shards are locked independently, so concurrent announces to other
+	// shards may exceed max_peers by a few peers.
+	if max := ps.cfg.MaxPeers; max > 0 && atomic.LoadInt64(&ps.numPeers) >= int64(max) {
+		if ps.cfg.PeerLimitPolicy == PeerLimitReject || !shard.evictStalestOfShard(ih) {
+			recordPeerLimit(peerLimitTotal, peerLimitRejected)
+			return ErrStoreFull
+		}
+		atomic.AddInt64(&ps.numPeers, -1)
+		recordPeerLimit(peerLimitTotal, peerLimitEvicted)
+	}
+
+	return nil
+}
+
+// stalest returns the peer of sw that announced least recently, and whether
+// it is a seeder.
+func (sw swarm) stalest() (pk serializedPeer, mtime int64, seeder bool) {
+	found := false
+	for k, t := range sw.seeders {
+		if !found || t < mtime {
+			pk, mtime, seeder, found = k, t, true, true
+		}
+	}
+	for k, t := range sw.leechers {
+		if !found || t < mtime {
+			pk, mtime, seeder, found = k, t, false, true
+		}
+	}
+	return
+}
+
+// evictStalest removes the peer of sw, the swarm of ih, that announced least
+// recently. sw must not be empty.
+//
+// If the peer is an endpoint of a multi-homed peer, its other endpoint stays
+// until it is reaped, since it is at least as stale.
+//
+// The shard must be locked for writing.
+func (s *peerShard) evictStalest(ih bittorrent.InfoHash, sw swarm) {
+	pk, _, seeder := sw.stalest()
+	s.unlink(ih, pk)
+	if seeder {
+		delete(sw.seeders, pk)
+		s.numSeeders--
+	} else {
+		delete(sw.leechers, pk)
+		s.numLeechers--
+	}
+}
+
+// evictStalestOfShard removes the peer of the shard that announced least
+// recently and returns whether the shard had any peer. Swarms left empty are
+// deleted, except for the swarm of ih, which a peer is added to.
+//
+// This visits every peer of the shard, which is acceptable because it only
+// happens while the storage is full.
+//
+// The shard must be locked for writing.
+func (s *peerShard) evictStalestOfShard(ih bittorrent.InfoHash) bool {
+	var stalestIH bittorrent.InfoHash
+	var stalestMtime int64
+	found := false
+	for swarmIH, sw := range s.swarms {
+		if len(sw.seeders)+len(sw.leechers) == 0 {
+			continue
+		}
+		if _, mtime, _ := sw.stalest(); !found || mtime < stalestMtime {
+			stalestIH, stalestMtime, found = swarmIH, mtime, true
+		}
+	}
+	if !found {
+		return false
+	}
+
+	sw := s.swarms[stalestIH]
+	s.evictStalest(stalestIH, sw)
+	if stalestIH != ih && len(sw.seeders)+len(sw.leechers) == 0 {
+		delete(s.swarms, stalestIH)
+	}
+	return true
+}
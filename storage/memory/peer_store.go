@@ -3,18 +3,22 @@
 package memory
 
 import (
+	"context"
 	"encoding/binary"
+	"hash/fnv"
+	"math/rand"
 	"net"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	yaml "gopkg.in/yaml.v2"
 
 	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/clock"
 	"github.com/chihaya/chihaya/pkg/log"
 	"github.com/chihaya/chihaya/pkg/stop"
-	"github.com/chihaya/chihaya/pkg/timecache"
 	"github.com/chihaya/chihaya/storage"
 )
 
@@ -27,6 +31,23 @@ const (
 	defaultPrometheusReportingInterval = time.Second * 1
 	defaultGarbageCollectionInterval   = time.Minute * 3
 	defaultPeerLifetime                = time.Minute * 30
+	defaultCompactionInterval          = time.Minute * 10
+	defaultCompactionThreshold         = 0.5
+	defaultShardHash                   = ShardHashPrefix
+	defaultGCConcurrency               = 1
+	defaultSnapshotInterval            = time.Minute * 5
+	defaultSnatchLifetime              = time.Hour * 24 * 30
+)
+
+// The functions used to map infohashes to shards.
+const (
+	// ShardHashPrefix uses the first four bytes of an infohash.
+	// Infohashes are SHA-1 hashes, so these are uniformly distributed unless
+	// clients announce crafted infohashes.
+	ShardHashPrefix = "prefix"
+
+	// ShardHashFNV uses the FNV-1a hash of the whole infohash.
+	ShardHashFNV = "fnv"
 )
 
 func init() {
@@ -45,7 +66,7 @@ func (d driver) NewPeerStore(icfg interface{}) (storage.PeerStore, error) {
 
 	// Unmarshal the bytes into the proper config type.
 	var cfg Config
-	err = yaml.Unmarshal(bytes, &cfg)
+	err = yaml.UnmarshalStrict(bytes, &cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -59,16 +80,42 @@ type Config struct {
 	PrometheusReportingInterval time.Duration `yaml:"prometheus_reporting_interval"`
 	PeerLifetime                time.Duration `yaml:"peer_lifetime"`
 	ShardCount                  int           `yaml:"shard_count"`
+	CompactionInterval          time.Duration `yaml:"compaction_interval"`
+	CompactionThreshold         float64       `yaml:"compaction_threshold"`
+	ShardHash                   string        `yaml:"shard_hash"`
+	GCConcurrency               int           `yaml:"gc_concurrency"`
+	ShardMetrics                bool          `yaml:"shard_metrics"`
+	SnapshotPath                string        `yaml:"snapshot_path"`
+	SnapshotInterval            time.Duration `yaml:"snapshot_interval"`
+	MaxSwarmPeers               int           `yaml:"max_swarm_peers"`
+	MaxPeers                    int           `yaml:"max_peers"`
+	PeerLimitPolicy             string        `yaml:"peer_limit_policy"`
+	SnatchLifetime              time.Duration `yaml:"snatch_lifetime"`
+
+	// Clock is used to timestamp peers and to schedule garbage collection.
+	// It defaults to clock.Cached and is replaced in tests.
+	Clock clock.Clock `yaml:"-"`
 }
 
 // LogFields renders the current config as a set of Logrus fields.
 func (cfg Config) LogFields() log.Fields {
 	return log.Fields{
-		"name":               Name,
-		"gcInterval":         cfg.GarbageCollectionInterval,
-		"promReportInterval": cfg.PrometheusReportingInterval,
-		"peerLifetime":       cfg.PeerLifetime,
-		"shardCount":         cfg.ShardCount,
+		"name":                Name,
+		"gcInterval":          cfg.GarbageCollectionInterval,
+		"promReportInterval":  cfg.PrometheusReportingInterval,
+		"peerLifetime":        cfg.PeerLifetime,
+		"shardCount":          cfg.ShardCount,
+		"compactionInterval":  cfg.CompactionInterval,
+		"compactionThreshold": cfg.CompactionThreshold,
+		"shardHash":           cfg.ShardHash,
+		"gcConcurrency":       cfg.GCConcurrency,
+		"shardMetrics":        cfg.ShardMetrics,
+		"snapshotPath":        cfg.SnapshotPath,
+		"snapshotInterval":    cfg.SnapshotInterval,
+		"maxSwarmPeers":       cfg.MaxSwarmPeers,
+		"maxPeers":            cfg.MaxPeers,
+		"peerLimitPolicy":     cfg.PeerLimitPolicy,
+		"snatchLifetime":      cfg.SnatchLifetime,
 	}
 }
 
@@ -115,6 +162,75 @@ func (cfg Config) Validate() Config {
 		})
 	}
 
+	if cfg.CompactionInterval <= 0 {
+		validcfg.CompactionInterval = defaultCompactionInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".CompactionInterval",
+			"provided": cfg.CompactionInterval,
+			"default":  validcfg.CompactionInterval,
+		})
+	}
+
+	if cfg.CompactionThreshold <= 0 || cfg.CompactionThreshold > 1 {
+		validcfg.CompactionThreshold = defaultCompactionThreshold
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".CompactionThreshold",
+			"provided": cfg.CompactionThreshold,
+			"default":  validcfg.CompactionThreshold,
+		})
+	}
+
+	if cfg.ShardHash != ShardHashPrefix && cfg.ShardHash != ShardHashFNV {
+		validcfg.ShardHash = defaultShardHash
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".ShardHash",
+			"provided": cfg.ShardHash,
+			"default":  validcfg.ShardHash,
+		})
+	}
+
+	if cfg.GCConcurrency <= 0 {
+		validcfg.GCConcurrency = defaultGCConcurrency
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".GCConcurrency",
+			"provided": cfg.GCConcurrency,
+			"default":  validcfg.GCConcurrency,
+		})
+	}
+
+	if cfg.SnapshotPath != "" && cfg.SnapshotInterval <= 0 {
+		validcfg.SnapshotInterval = defaultSnapshotInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".SnapshotInterval",
+			"provided": cfg.SnapshotInterval,
+			"default":  validcfg.SnapshotInterval,
+		})
+	}
+
+	if cfg.PeerLimitPolicy != PeerLimitEvict && cfg.PeerLimitPolicy != PeerLimitReject {
+		validcfg.PeerLimitPolicy = defaultPeerLimitPolicy
+		if cfg.PeerLimitPolicy != "" {
+			log.Warn("falling back to default configuration", log.Fields{
+				"name":     Name + ".PeerLimitPolicy",
+				"provided": cfg.PeerLimitPolicy,
+				"default":  validcfg.PeerLimitPolicy,
+			})
+		}
+	}
+
+	if cfg.SnatchLifetime <= 0 {
+		validcfg.SnatchLifetime = defaultSnatchLifetime
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".SnatchLifetime",
+			"provided": cfg.SnatchLifetime,
+			"default":  validcfg.SnatchLifetime,
+		})
+	}
+
+	if cfg.Clock == nil {
+		validcfg.Clock = clock.Cached
+	}
+
 	return validcfg
 }
 
@@ -124,11 +240,42 @@ func New(provided Config) (storage.PeerStore, error) {
 	ps := &peerStore{
 		cfg:    cfg,
 		shards: make([]*peerShard, cfg.ShardCount*2),
+		hash:   prefixHash,
 		closed: make(chan struct{}),
 	}
+	if cfg.ShardHash == ShardHashFNV {
+		ps.hash = fnvHash
+	}
 
 	for i := 0; i < cfg.ShardCount*2; i++ {
-		ps.shards[i] = &peerShard{swarms: make(map[bittorrent.InfoHash]swarm)}
+		ps.shards[i] = newPeerShard()
+	}
+
+	if cfg.SnapshotPath != "" {
+		if err := ps.loadSnapshot(); err != nil {
+			return nil, err
+		}
+		for _, s := range ps.shards {
+			ps.numPeers += int64(s.numSeeders + s.numLeechers)
+		}
+
+		// Start a goroutine for saving snapshots.
+		ps.wg.Add(1)
+		go func() {
+			defer ps.wg.Done()
+			t := time.NewTicker(cfg.SnapshotInterval)
+			for {
+				select {
+				case <-ps.closed:
+					t.Stop()
+					return
+				case <-t.C:
+					if err := ps.saveSnapshot(); err != nil {
+						log.Error("storage: failed to save snapshot", log.Err(err))
+					}
+				}
+			}
+		}()
 	}
 
 	// Start a goroutine for garbage collection.
@@ -139,10 +286,27 @@ func New(provided Config) (storage.PeerStore, error) {
 			select {
 			case <-ps.closed:
 				return
-			case <-time.After(cfg.GarbageCollectionInterval):
-				before := time.Now().Add(-cfg.PeerLifetime)
+			case <-cfg.Clock.After(cfg.GarbageCollectionInterval):
+				now := cfg.Clock.Now()
+				before := now.Add(-cfg.PeerLifetime)
 				log.Debug("storage: purging peers with no announces since", log.Fields{"before": before})
-				ps.collectGarbage(before)
+				ps.collectGarbage(before, now.Add(-cfg.SnatchLifetime))
+			}
+		}
+	}()
+
+	// Start a goroutine for compacting shards.
+	ps.wg.Add(1)
+	go func() {
+		defer ps.wg.Done()
+		t := time.NewTicker(cfg.CompactionInterval)
+		for {
+			select {
+			case <-ps.closed:
+				t.Stop()
+				return
+			case <-t.C:
+				ps.compact(cfg.CompactionThreshold)
 			}
 		}
 	}()
@@ -201,41 +365,202 @@ type peerShard struct {
 	swarms      map[bittorrent.InfoHash]swarm
 	numSeeders  uint64
 	numLeechers uint64
+
+	// snatches holds the snatches of every infohash. They are kept apart
+	// from the swarms, so that they outlive swarms that become empty, until
+	// nobody completed downloading for the snatch lifetime.
+	snatches map[bittorrent.InfoHash]snatches
+
+	// partners links the endpoints of multi-homed peers in the shard to
+	// their endpoints of the other address family, which are in a shard of
+	// the other half.
+	partners map[peerRef]serializedPeer
+
+	// peakSwarms and peakPeers are the highest number of swarms and peers
+	// in the shard since it was last compacted.
+	// Maps don't shrink when entries are deleted, so these are used to
+	// estimate how much memory is held by deleted entries.
+	peakSwarms int
+	peakPeers  uint64
+
 	sync.RWMutex
 }
 
+func newPeerShard() *peerShard {
+	return &peerShard{
+		swarms:   make(map[bittorrent.InfoHash]swarm),
+		snatches: make(map[bittorrent.InfoHash]snatches),
+		partners: make(map[peerRef]serializedPeer),
+	}
+}
+
+// peerRef identifies a peer of the swarm of an infohash.
+type peerRef struct {
+	ih bittorrent.InfoHash
+	pk serializedPeer
+}
+
+// unlink removes the link of the peer pk of the swarm of ih to the other
+// endpoint of a multi-homed peer, and returns that endpoint.
+//
+// The shard must be locked for writing.
+func (s *peerShard) unlink(ih bittorrent.InfoHash, pk serializedPeer) (partner serializedPeer, linked bool) {
+	if len(s.partners) == 0 {
+		return "", false
+	}
+	ref := peerRef{ih, pk}
+	partner, linked = s.partners[ref]
+	delete(s.partners, ref)
+	return
+}
+
+// removePartner removes the peer pk from the swarm of ih, if it is the
+// endpoint of a multi-homed peer linked to partner, and returns whether it
+// was removed.
+//
+// The shard must be locked for writing.
+func (s *peerShard) removePartner(ih bittorrent.InfoHash, pk, partner serializedPeer) bool {
+	ref := peerRef{ih, pk}
+	if linked, ok := s.partners[ref]; !ok || linked != partner {
+		return false
+	}
+	delete(s.partners, ref)
+
+	sw, ok := s.swarms[ih]
+	if !ok {
+		return false
+	}
+	if _, ok := sw.seeders[pk]; ok {
+		delete(sw.seeders, pk)
+		s.numSeeders--
+	} else if _, ok := sw.leechers[pk]; ok {
+		delete(sw.leechers, pk)
+		s.numLeechers--
+	} else {
+		return false
+	}
+	s.deleteIfEmpty(ih)
+	return true
+}
+
+// touchSwarm returns the swarm of ih and records that a peer was put into it
+// at now. The swarm is created if it does not exist.
+//
+// The shard must be locked for writing.
+func (s *peerShard) touchSwarm(ih bittorrent.InfoHash, now int64) swarm {
+	sw, ok := s.swarms[ih]
+	if !ok {
+		sw = swarm{
+			seeders:  make(map[serializedPeer]int64),
+			leechers: make(map[serializedPeer]int64),
+			created:  now,
+		}
+	}
+	sw.lastAnnounce = now
+	s.swarms[ih] = sw
+	return sw
+}
+
+// deleteIfEmpty deletes the swarm of ih if it has no peers.
+//
+// The shard must be locked for writing.
+func (s *peerShard) deleteIfEmpty(ih bittorrent.InfoHash) {
+	if sw, ok := s.swarms[ih]; ok && len(sw.seeders)|len(sw.leechers) == 0 {
+		delete(s.swarms, ih)
+	}
+}
+
+// updatePeaks updates the peak numbers of swarms and peers of the shard.
+//
+// The shard must be locked for writing.
+func (s *peerShard) updatePeaks() {
+	if n := len(s.swarms); n > s.peakSwarms {
+		s.peakSwarms = n
+	}
+	if n := s.numSeeders + s.numLeechers; n > s.peakPeers {
+		s.peakPeers = n
+	}
+}
+
+// usage returns the number of swarms and peers in the shard and the peak
+// number of them since the shard was last compacted.
+//
+// The shard must be locked for reading.
+func (s *peerShard) usage() (live, peak uint64) {
+	live = uint64(len(s.swarms)) + s.numSeeders + s.numLeechers
+	peak = uint64(s.peakSwarms) + s.peakPeers
+	return
+}
+
 type swarm struct {
 	// map serialized peer to mtime
 	seeders  map[serializedPeer]int64
 	leechers map[serializedPeer]int64
+
+	// created and lastAnnounce are the clock readings when the swarm was
+	// created and when a peer was last put into it. No peer of the swarm
+	// is newer than lastAnnounce.
+	created      int64
+	lastAnnounce int64
+}
+
+// snatches is the number of peers of an infohash that completed downloading
+// and the clock reading when the last of them did.
+type snatches struct {
+	n    uint32
+	last int64
 }
 
 type peerStore struct {
+	// numPeers is the number of peers of all shards, which is checked
+	// against max_peers. It is accessed atomically, and comes first so that
+	// it is 64-bit aligned.
+	numPeers int64
+
 	cfg    Config
 	shards []*peerShard
+	hash   func(bittorrent.InfoHash) uint32
 
 	closed chan struct{}
 	wg     sync.WaitGroup
 }
 
-var _ storage.PeerStore = &peerStore{}
+var (
+	_ storage.PeerStore           = &peerStore{}
+	_ storage.SwarmLister         = &peerStore{}
+	_ storage.ActivityReporter    = &peerStore{}
+	_ storage.MultiHomedPeerStore = &peerStore{}
+)
 
 // populateProm aggregates metrics over all shards and then posts them to
 // prometheus.
 func (ps *peerStore) populateProm() {
-	var numInfohashes, numSeeders, numLeechers uint64
+	var numInfohashes, numSeeders, numLeechers, numMultiHomed, live, peak uint64
 
-	for _, s := range ps.shards {
+	for idx, s := range ps.shards {
 		s.RLock()
 		numInfohashes += uint64(len(s.swarms))
 		numSeeders += s.numSeeders
 		numLeechers += s.numLeechers
+		// Every multi-homed peer has one endpoint in an IPv4 shard.
+		if idx < len(ps.shards)/2 {
+			numMultiHomed += uint64(len(s.partners))
+		}
+		l, p := s.usage()
+		live += l
+		peak += p
 		s.RUnlock()
 	}
 
+	if ps.cfg.ShardMetrics {
+		ps.populateShardProm()
+	}
+
 	storage.PromInfohashesCount.Set(float64(numInfohashes))
 	storage.PromSeedersCount.Set(float64(numSeeders))
 	storage.PromLeechersCount.Set(float64(numLeechers))
+	storage.PromMultiHomedPeersCount.Set(float64(numMultiHomed))
+	recordFragmentation(live, peak)
 }
 
 // recordGCDuration records the duration of a GC sweep.
@@ -244,52 +569,64 @@ func recordGCDuration(duration time.Duration) {
 }
 
 func (ps *peerStore) getClock() int64 {
-	return timecache.NowUnixNano()
+	return ps.cfg.Clock.Now().UnixNano()
+}
+
+// prefixHash implements ShardHashPrefix.
+func prefixHash(infoHash bittorrent.InfoHash) uint32 {
+	return binary.BigEndian.Uint32(infoHash[:4])
+}
+
+// fnvHash implements ShardHashFNV.
+func fnvHash(infoHash bittorrent.InfoHash) uint32 {
+	h := fnv.New32a()
+	h.Write(infoHash[:])
+	return h.Sum32()
 }
 
 func (ps *peerStore) shardIndex(infoHash bittorrent.InfoHash, af bittorrent.AddressFamily) uint32 {
 	// There are twice the amount of shards specified by the user, the first
 	// half is dedicated to IPv4 swarms and the second half is dedicated to
 	// IPv6 swarms.
-	idx := binary.BigEndian.Uint32(infoHash[:4]) % (uint32(len(ps.shards)) / 2)
+	idx := ps.hash(infoHash) % (uint32(len(ps.shards)) / 2)
 	if af == bittorrent.IPv6 {
 		idx += uint32(len(ps.shards) / 2)
 	}
 	return idx
 }
 
-func (ps *peerStore) PutSeeder(ih bittorrent.InfoHash, p bittorrent.Peer) error {
-	select {
-	case <-ps.closed:
-		panic("attempted to interact with stopped memory store")
-	default:
-	}
-
-	pk := newPeerKey(p)
+// putFunc puts the peer pk into the swarm of ih in shard at now.
+//
+// The shard must be locked for writing.
+type putFunc func(shard *peerShard, ih bittorrent.InfoHash, pk serializedPeer, now int64) error
 
-	shard := ps.shards[ps.shardIndex(ih, p.IP.AddressFamily)]
-	shard.Lock()
+func (ps *peerStore) PutSeeder(_ context.Context, ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	return ps.put(ih, p, ps.putSeeder)
+}
 
-	if _, ok := shard.swarms[ih]; !ok {
-		shard.swarms[ih] = swarm{
-			seeders:  make(map[serializedPeer]int64),
-			leechers: make(map[serializedPeer]int64),
-		}
-	}
+// putSeeder adds pk to the seeders of the swarm of ih.
+//
+// The shard must be locked for writing.
+func (ps *peerStore) putSeeder(shard *peerShard, ih bittorrent.InfoHash, pk serializedPeer, now int64) error {
+	sw := shard.touchSwarm(ih, now)
 
 	// If this peer isn't already a seeder, update the stats for the swarm.
-	if _, ok := shard.swarms[ih].seeders[pk]; !ok {
+	if _, ok := sw.seeders[pk]; !ok {
+		if err := ps.admit(shard, ih, sw); err != nil {
+			shard.deleteIfEmpty(ih)
+			return err
+		}
 		shard.numSeeders++
+		atomic.AddInt64(&ps.numPeers, 1)
 	}
 
 	// Update the peer in the swarm.
-	shard.swarms[ih].seeders[pk] = ps.getClock()
-
-	shard.Unlock()
+	sw.seeders[pk] = now
+	shard.updatePeaks()
 	return nil
 }
 
-func (ps *peerStore) DeleteSeeder(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+func (ps *peerStore) DeleteSeeder(_ context.Context, ih bittorrent.InfoHash, p bittorrent.Peer) error {
 	select {
 	case <-ps.closed:
 		panic("attempted to interact with stopped memory store")
@@ -312,48 +649,49 @@ func (ps *peerStore) DeleteSeeder(ih bittorrent.InfoHash, p bittorrent.Peer) err
 	}
 
 	shard.numSeeders--
+	atomic.AddInt64(&ps.numPeers, -1)
 	delete(shard.swarms[ih].seeders, pk)
 
 	if len(shard.swarms[ih].seeders)|len(shard.swarms[ih].leechers) == 0 {
 		delete(shard.swarms, ih)
 	}
 
+	partner, linked := shard.unlink(ih, pk)
 	shard.Unlock()
-	return nil
-}
 
-func (ps *peerStore) PutLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error {
-	select {
-	case <-ps.closed:
-		panic("attempted to interact with stopped memory store")
-	default:
+	if linked {
+		ps.removePartner(ih, p.IP.AddressFamily, pk, partner)
 	}
+	return nil
+}
 
-	pk := newPeerKey(p)
-
-	shard := ps.shards[ps.shardIndex(ih, p.IP.AddressFamily)]
-	shard.Lock()
+func (ps *peerStore) PutLeecher(_ context.Context, ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	return ps.put(ih, p, ps.putLeecher)
+}
 
-	if _, ok := shard.swarms[ih]; !ok {
-		shard.swarms[ih] = swarm{
-			seeders:  make(map[serializedPeer]int64),
-			leechers: make(map[serializedPeer]int64),
-		}
-	}
+// putLeecher adds pk to the leechers of the swarm of ih.
+//
+// The shard must be locked for writing.
+func (ps *peerStore) putLeecher(shard *peerShard, ih bittorrent.InfoHash, pk serializedPeer, now int64) error {
+	sw := shard.touchSwarm(ih, now)
 
 	// If this peer isn't already a leecher, update the stats for the swarm.
-	if _, ok := shard.swarms[ih].leechers[pk]; !ok {
+	if _, ok := sw.leechers[pk]; !ok {
+		if err := ps.admit(shard, ih, sw); err != nil {
+			shard.deleteIfEmpty(ih)
+			return err
+		}
 		shard.numLeechers++
+		atomic.AddInt64(&ps.numPeers, 1)
 	}
 
 	// Update the peer in the swarm.
-	shard.swarms[ih].leechers[pk] = ps.getClock()
-
-	shard.Unlock()
+	sw.leechers[pk] = now
+	shard.updatePeaks()
 	return nil
 }
 
-func (ps *peerStore) DeleteLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+func (ps *peerStore) DeleteLeecher(_ context.Context, ih bittorrent.InfoHash, p bittorrent.Peer) error {
 	select {
 	case <-ps.closed:
 		panic("attempted to interact with stopped memory store")
@@ -376,17 +714,66 @@ func (ps *peerStore) DeleteLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) er
 	}
 
 	shard.numLeechers--
+	atomic.AddInt64(&ps.numPeers, -1)
 	delete(shard.swarms[ih].leechers, pk)
 
 	if len(shard.swarms[ih].seeders)|len(shard.swarms[ih].leechers) == 0 {
 		delete(shard.swarms, ih)
 	}
 
+	partner, linked := shard.unlink(ih, pk)
 	shard.Unlock()
+
+	if linked {
+		ps.removePartner(ih, p.IP.AddressFamily, pk, partner)
+	}
 	return nil
 }
 
-func (ps *peerStore) GraduateLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+func (ps *peerStore) GraduateLeecher(_ context.Context, ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	return ps.put(ih, p, ps.graduateLeecher)
+}
+
+// graduateLeecher moves pk from the leechers to the seeders of the swarm of
+// ih, counting a snatch if it wasn't a seeder already.
+//
+// The shard must be locked for writing.
+func (ps *peerStore) graduateLeecher(shard *peerShard, ih bittorrent.InfoHash, pk serializedPeer, now int64) error {
+	sw := shard.touchSwarm(ih, now)
+
+	// If this peer is a leecher, update the stats for the swarm and remove them.
+	if _, ok := sw.leechers[pk]; ok {
+		shard.numLeechers--
+		atomic.AddInt64(&ps.numPeers, -1)
+		delete(sw.leechers, pk)
+	}
+
+	// If this peer isn't already a seeder, update the stats for the swarm.
+	// Only peers becoming seeders are counted as snatches, so that repeated
+	// completed events of a peer are counted once.
+	if _, ok := sw.seeders[pk]; !ok {
+		if err := ps.admit(shard, ih, sw); err != nil {
+			shard.deleteIfEmpty(ih)
+			return err
+		}
+		shard.numSeeders++
+		atomic.AddInt64(&ps.numPeers, 1)
+		sn := shard.snatches[ih]
+		sn.n++
+		sn.last = now
+		shard.snatches[ih] = sn
+	}
+
+	// Update the peer in the swarm.
+	sw.seeders[pk] = now
+	shard.updatePeaks()
+	return nil
+}
+
+// put puts p into the swarm of ih with put. If p was the endpoint of a
+// multi-homed peer, its other endpoint is removed, since the peer no longer
+// announces it.
+func (ps *peerStore) put(ih bittorrent.InfoHash, p bittorrent.Peer, put putFunc) error {
 	select {
 	case <-ps.closed:
 		panic("attempted to interact with stopped memory store")
@@ -397,33 +784,109 @@ func (ps *peerStore) GraduateLeecher(ih bittorrent.InfoHash, p bittorrent.Peer)
 
 	shard := ps.shards[ps.shardIndex(ih, p.IP.AddressFamily)]
 	shard.Lock()
+	err := put(shard, ih, pk, ps.getClock())
+	partner, linked := shard.unlink(ih, pk)
+	shard.Unlock()
 
-	if _, ok := shard.swarms[ih]; !ok {
-		shard.swarms[ih] = swarm{
-			seeders:  make(map[serializedPeer]int64),
-			leechers: make(map[serializedPeer]int64),
+	if linked {
+		ps.removePartner(ih, p.IP.AddressFamily, pk, partner)
+	}
+	return err
+}
+
+// removePartner removes the endpoint partner of the multi-homed peer whose
+// endpoint pk of the address family af was deleted or put on its own.
+//
+// The partner is removed after the shard of pk was unlocked, so that shards
+// are only ever locked in the order putMultiHomed locks them in.
+func (ps *peerStore) removePartner(ih bittorrent.InfoHash, af bittorrent.AddressFamily, pk, partner serializedPeer) {
+	partnerAF := bittorrent.IPv6
+	if af == bittorrent.IPv6 {
+		partnerAF = bittorrent.IPv4
+	}
+
+	shard := ps.shards[ps.shardIndex(ih, partnerAF)]
+	shard.Lock()
+	removed := shard.removePartner(ih, partner, pk)
+	shard.Unlock()
+
+	if removed {
+		atomic.AddInt64(&ps.numPeers, -1)
+	}
+}
+
+// PutMultiHomedSeeder implements storage.MultiHomedPeerStore.
+func (ps *peerStore) PutMultiHomedSeeder(_ context.Context, ih bittorrent.InfoHash, p, alternate bittorrent.Peer) error {
+	return ps.putMultiHomed(ih, p, alternate, ps.putSeeder)
+}
+
+// PutMultiHomedLeecher implements storage.MultiHomedPeerStore.
+func (ps *peerStore) PutMultiHomedLeecher(_ context.Context, ih bittorrent.InfoHash, p, alternate bittorrent.Peer) error {
+	return ps.putMultiHomed(ih, p, alternate, ps.putLeecher)
+}
+
+// GraduateMultiHomedLeecher implements storage.MultiHomedPeerStore.
+func (ps *peerStore) GraduateMultiHomedLeecher(_ context.Context, ih bittorrent.InfoHash, p, alternate bittorrent.Peer) error {
+	return ps.putMultiHomed(ih, p, alternate, ps.graduateLeecher)
+}
+
+// putMultiHomed puts both endpoints of a multi-homed peer into the swarms of
+// ih with put, at the same time, and links them. Endpoints that were linked
+// to other endpoints before are unlinked from them, and those are removed.
+func (ps *peerStore) putMultiHomed(ih bittorrent.InfoHash, p, alternate bittorrent.Peer, put putFunc) error {
+	if p.IP.AddressFamily == alternate.IP.AddressFamily {
+		// Both endpoints would be in the same shard. Sanitized requests
+		// never have such alternate peers.
+		if err := ps.put(ih, p, put); err != nil {
+			return err
 		}
+		return ps.put(ih, alternate, put)
 	}
 
-	// If this peer is a leecher, update the stats for the swarm and remove them.
-	if _, ok := shard.swarms[ih].leechers[pk]; ok {
-		shard.numLeechers--
-		delete(shard.swarms[ih].leechers, pk)
+	select {
+	case <-ps.closed:
+		panic("attempted to interact with stopped memory store")
+	default:
 	}
 
-	// If this peer isn't already a seeder, update the stats for the swarm.
-	if _, ok := shard.swarms[ih].seeders[pk]; !ok {
-		shard.numSeeders++
+	endpoints := [2]serializedPeer{newPeerKey(p), newPeerKey(alternate)}
+	shards := [2]*peerShard{
+		ps.shards[ps.shardIndex(ih, p.IP.AddressFamily)],
+		ps.shards[ps.shardIndex(ih, alternate.IP.AddressFamily)],
 	}
 
-	// Update the peer in the swarm.
-	shard.swarms[ih].seeders[pk] = ps.getClock()
+	// The shard of the IPv4 endpoint is locked first, so that concurrent
+	// announces of multi-homed peers can't deadlock.
+	first, second := shards[0], shards[1]
+	if p.IP.AddressFamily == bittorrent.IPv6 {
+		first, second = second, first
+	}
+	first.Lock()
+	defer first.Unlock()
+	second.Lock()
+	defer second.Unlock()
+
+	for i := range endpoints {
+		other := 1 - i
+		partner, linked := shards[i].unlink(ih, endpoints[i])
+		if linked && partner != endpoints[other] && shards[other].removePartner(ih, partner, endpoints[i]) {
+			atomic.AddInt64(&ps.numPeers, -1)
+		}
+	}
 
-	shard.Unlock()
+	now := ps.getClock()
+	for i := range endpoints {
+		if err := put(shards[i], ih, endpoints[i], now); err != nil {
+			return err
+		}
+	}
+
+	shards[0].partners[peerRef{ih, endpoints[0]}] = endpoints[1]
+	shards[1].partners[peerRef{ih, endpoints[1]}] = endpoints[0]
 	return nil
 }
 
-func (ps *peerStore) AnnouncePeers(ih bittorrent.InfoHash, seeder bool, numWant int, announcer bittorrent.Peer) (peers []bittorrent.Peer, err error) {
+func (ps *peerStore) AnnouncePeers(_ context.Context, ih bittorrent.InfoHash, seeder bool, numWant int, announcer bittorrent.Peer) (peers []bittorrent.Peer, err error) {
 	select {
 	case <-ps.closed:
 		panic("attempted to interact with stopped memory store")
@@ -440,51 +903,97 @@ func (ps *peerStore) AnnouncePeers(ih bittorrent.InfoHash, seeder bool, numWant
 
 	if seeder {
 		// Append leechers as possible.
-		leechers := shard.swarms[ih].leechers
-		for pk := range leechers {
-			if numWant == 0 {
-				break
-			}
-
-			peers = append(peers, decodePeerKey(pk))
-			numWant--
-		}
+		peers = appendSample(peers, shard.swarms[ih].leechers, numWant, "")
 	} else {
 		// Append as many seeders as possible.
-		seeders := shard.swarms[ih].seeders
-		for pk := range seeders {
-			if numWant == 0 {
-				break
-			}
+		peers = appendSample(peers, shard.swarms[ih].seeders, numWant, "")
 
-			peers = append(peers, decodePeerKey(pk))
-			numWant--
+		// Append leechers until we reach numWant.
+		if numWant > len(peers) {
+			peers = appendSample(peers, shard.swarms[ih].leechers, numWant-len(peers), newPeerKey(announcer))
 		}
+	}
 
-		// Append leechers until we reach numWant.
-		if numWant > 0 {
-			leechers := shard.swarms[ih].leechers
-			announcerPK := newPeerKey(announcer)
-			for pk := range leechers {
-				if pk == announcerPK {
-					continue
-				}
+	shard.RUnlock()
+	return
+}
 
-				if numWant == 0 {
-					break
-				}
+func (ps *peerStore) AnnounceSeeders(_ context.Context, ih bittorrent.InfoHash, numWant int, announcer bittorrent.Peer) ([]bittorrent.Peer, error) {
+	return ps.announcePeersOf(ih, true, numWant, announcer)
+}
 
-				peers = append(peers, decodePeerKey(pk))
-				numWant--
-			}
+func (ps *peerStore) AnnounceLeechers(_ context.Context, ih bittorrent.InfoHash, numWant int, announcer bittorrent.Peer) ([]bittorrent.Peer, error) {
+	return ps.announcePeersOf(ih, false, numWant, announcer)
+}
+
+// announcePeersOf returns up to numWant seeders or leechers of the swarm of
+// the announcer, excluding the announcer.
+func (ps *peerStore) announcePeersOf(ih bittorrent.InfoHash, seeders bool, numWant int, announcer bittorrent.Peer) (peers []bittorrent.Peer, err error) {
+	select {
+	case <-ps.closed:
+		panic("attempted to interact with stopped memory store")
+	default:
+	}
+
+	shard := ps.shards[ps.shardIndex(ih, announcer.IP.AddressFamily)]
+	shard.RLock()
+	defer shard.RUnlock()
+
+	swarm, ok := shard.swarms[ih]
+	if !ok {
+		return nil, storage.ErrResourceDoesNotExist
+	}
+
+	members := swarm.leechers
+	if seeders {
+		members = swarm.seeders
+	}
+
+	return appendSample(nil, members, numWant, newPeerKey(announcer)), nil
+}
+
+// maxSampledSwarmSize is the number of seeders or leechers of a swarm up to
+// which peers are sampled uniformly at random. Sampling visits all of them.
+const maxSampledSwarmSize = 4096
+
+// appendSample appends up to numWant members other than skip to peers, in
+// random order.
+//
+// Members are sampled uniformly at random using selection sampling, unless
+// there are more than maxSampledSwarmSize of them. Then the first members in
+// the order of the map are taken, which is random, but not uniform.
+func appendSample(peers []bittorrent.Peer, members map[serializedPeer]int64, numWant int, skip serializedPeer) []bittorrent.Peer {
+	start := len(peers)
+	remaining := len(members)
+	if _, ok := members[skip]; ok {
+		remaining--
+	}
+	uniform := remaining <= maxSampledSwarmSize
+
+	for pk := range members {
+		if numWant <= 0 {
+			break
+		}
+		if pk == skip {
+			continue
+		}
+
+		// Each remaining member is chosen with the probability of the
+		// remaining peers wanted among the remaining members.
+		if !uniform || numWant >= remaining || rand.Intn(remaining) < numWant {
+			peers = append(peers, decodePeerKey(pk))
+			numWant--
 		}
+		remaining--
 	}
 
-	shard.RUnlock()
-	return
+	// Selection sampling keeps the order of the map, which is not uniform.
+	sample := peers[start:]
+	rand.Shuffle(len(sample), func(i, j int) { sample[i], sample[j] = sample[j], sample[i] })
+	return peers
 }
 
-func (ps *peerStore) ScrapeSwarm(ih bittorrent.InfoHash, addressFamily bittorrent.AddressFamily) (resp bittorrent.Scrape) {
+func (ps *peerStore) ScrapeSwarm(_ context.Context, ih bittorrent.InfoHash, addressFamily bittorrent.AddressFamily) (resp bittorrent.Scrape) {
 	select {
 	case <-ps.closed:
 		panic("attempted to interact with stopped memory store")
@@ -495,80 +1004,256 @@ func (ps *peerStore) ScrapeSwarm(ih bittorrent.InfoHash, addressFamily bittorren
 	shard := ps.shards[ps.shardIndex(ih, addressFamily)]
 	shard.RLock()
 
+	// Snatches are reported even if the swarm became empty.
+	resp.Snatches = shard.snatches[ih].n
+	if swarm, ok := shard.swarms[ih]; ok {
+		resp.Incomplete = uint32(len(swarm.leechers))
+		resp.Complete = uint32(len(swarm.seeders))
+	}
+	shard.RUnlock()
+
+	return
+}
+
+// SwarmActivity implements storage.ActivityReporter.
+func (ps *peerStore) SwarmActivity(_ context.Context, ih bittorrent.InfoHash, addressFamily bittorrent.AddressFamily) (storage.SwarmActivity, bool) {
+	select {
+	case <-ps.closed:
+		panic("attempted to interact with stopped memory store")
+	default:
+	}
+
+	shard := ps.shards[ps.shardIndex(ih, addressFamily)]
+	shard.RLock()
 	swarm, ok := shard.swarms[ih]
+	shard.RUnlock()
 	if !ok {
-		shard.RUnlock()
-		return
+		return storage.SwarmActivity{}, false
 	}
 
-	resp.Incomplete = uint32(len(swarm.leechers))
-	resp.Complete = uint32(len(swarm.seeders))
-	shard.RUnlock()
+	return storage.SwarmActivity{
+		Created:      time.Unix(0, swarm.created),
+		LastAnnounce: time.Unix(0, swarm.lastAnnounce),
+	}, true
+}
 
-	return
+// ListSwarms implements storage.SwarmLister.
+func (ps *peerStore) ListSwarms(_ context.Context) ([]bittorrent.InfoHash, error) {
+	select {
+	case <-ps.closed:
+		panic("attempted to interact with stopped memory store")
+	default:
+	}
+
+	// The swarms of both address families of an infohash may be in
+	// different shards.
+	seen := make(map[bittorrent.InfoHash]struct{})
+	var infoHashes []bittorrent.InfoHash
+	for _, shard := range ps.shards {
+		shard.RLock()
+		for ih := range shard.swarms {
+			if _, ok := seen[ih]; ok {
+				continue
+			}
+			seen[ih] = struct{}{}
+			infoHashes = append(infoHashes, ih)
+		}
+		shard.RUnlock()
+	}
+
+	return infoHashes, nil
 }
 
 // collectGarbage deletes all Peers from the PeerStore which are older than the
-// cutoff time.
+// cutoff time, and the snatches of infohashes without swarms that were last
+// counted before snatchCutoff.
 //
 // This function must be able to execute while other methods on this interface
 // are being executed in parallel.
-func (ps *peerStore) collectGarbage(cutoff time.Time) error {
+func (ps *peerStore) collectGarbage(cutoff, snatchCutoff time.Time) error {
 	select {
 	case <-ps.closed:
 		return nil
 	default:
 	}
 
-	cutoffUnix := cutoff.UnixNano()
+	cutoffUnix, snatchCutoffUnix := cutoff.UnixNano(), snatchCutoff.UnixNano()
 	start := time.Now()
 
-	for _, shard := range ps.shards {
-		shard.RLock()
-		var infohashes []bittorrent.InfoHash
-		for ih := range shard.swarms {
-			infohashes = append(infohashes, ih)
-		}
-		shard.RUnlock()
-		runtime.Gosched()
+	// Shards are independent, so they are distributed among the configured
+	// number of workers.
+	indices := make(chan int)
+	var reaped uint64
+	var wg sync.WaitGroup
+	for i := 0; i < ps.cfg.GCConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range indices {
+				shardStart := time.Now()
+				n := ps.shards[idx].collectGarbage(cutoffUnix, snatchCutoffUnix)
+				atomic.AddUint64(&reaped, n)
+				atomic.AddInt64(&ps.numPeers, -int64(n))
+				if ps.cfg.ShardMetrics {
+					ps.recordShardGCDuration(idx, time.Since(shardStart))
+				}
+			}
+		}()
+	}
+	for idx := range ps.shards {
+		indices <- idx
+	}
+	close(indices)
+	wg.Wait()
 
-		for _, ih := range infohashes {
-			shard.Lock()
+	storage.PromGCReapedPeersTotal.Add(float64(reaped))
+	recordGCDuration(time.Since(start))
 
-			if _, stillExists := shard.swarms[ih]; !stillExists {
-				shard.Unlock()
-				runtime.Gosched()
-				continue
-			}
+	return nil
+}
+
+// collectGarbage deletes all Peers from the shard which were last updated at
+// or before cutoffUnix and returns the number of deleted Peers.
+//
+// Snatches of infohashes without a swarm that were last counted at or before
+// snatchCutoffUnix are deleted as well.
+func (s *peerShard) collectGarbage(cutoffUnix, snatchCutoffUnix int64) (reaped uint64) {
+	s.RLock()
+	var infohashes []bittorrent.InfoHash
+	for ih := range s.swarms {
+		infohashes = append(infohashes, ih)
+	}
+	s.RUnlock()
+	runtime.Gosched()
+
+	for _, ih := range infohashes {
+		s.Lock()
 
-			for pk, mtime := range shard.swarms[ih].leechers {
-				if mtime <= cutoffUnix {
-					shard.numLeechers--
-					delete(shard.swarms[ih].leechers, pk)
+		sw, stillExists := s.swarms[ih]
+		if !stillExists {
+			s.Unlock()
+			runtime.Gosched()
+			continue
+		}
+
+		// All peers of a swarm that was not announced to since the cutoff
+		// are stale, so they don't need to be checked one by one.
+		if sw.lastAnnounce <= cutoffUnix {
+			if len(s.partners) > 0 {
+				for _, peers := range []map[serializedPeer]int64{sw.seeders, sw.leechers} {
+					for pk := range peers {
+						s.unlink(ih, pk)
+					}
 				}
 			}
+			s.numLeechers -= uint64(len(sw.leechers))
+			s.numSeeders -= uint64(len(sw.seeders))
+			reaped += uint64(len(sw.leechers) + len(sw.seeders))
+			delete(s.swarms, ih)
+			s.Unlock()
+			runtime.Gosched()
+			continue
+		}
 
-			for pk, mtime := range shard.swarms[ih].seeders {
-				if mtime <= cutoffUnix {
-					shard.numSeeders--
-					delete(shard.swarms[ih].seeders, pk)
-				}
+		for pk, mtime := range s.swarms[ih].leechers {
+			if mtime <= cutoffUnix {
+				s.numLeechers--
+				reaped++
+				delete(s.swarms[ih].leechers, pk)
+				s.unlink(ih, pk)
 			}
+		}
 
-			if len(shard.swarms[ih].seeders)|len(shard.swarms[ih].leechers) == 0 {
-				delete(shard.swarms, ih)
+		for pk, mtime := range s.swarms[ih].seeders {
+			if mtime <= cutoffUnix {
+				s.numSeeders--
+				reaped++
+				delete(s.swarms[ih].seeders, pk)
+				s.unlink(ih, pk)
 			}
+		}
+
+		if len(s.swarms[ih].seeders)|len(s.swarms[ih].leechers) == 0 {
+			delete(s.swarms, ih)
+		}
 
+		s.Unlock()
+		runtime.Gosched()
+	}
+
+	s.Lock()
+	for ih, sn := range s.snatches {
+		if _, ok := s.swarms[ih]; !ok && sn.last <= snatchCutoffUnix {
+			delete(s.snatches, ih)
+		}
+	}
+	s.Unlock()
+
+	return reaped
+}
+
+// compact rebuilds the maps of all shards in which the estimated share of
+// memory held by deleted entries is at least threshold, so that the memory
+// can be released.
+//
+// This function must be able to execute while other methods on this interface
+// are being executed in parallel.
+func (ps *peerStore) compact(threshold float64) {
+	select {
+	case <-ps.closed:
+		return
+	default:
+	}
+
+	start := time.Now()
+	var compacted int
+
+	for _, shard := range ps.shards {
+		shard.Lock()
+
+		live, peak := shard.usage()
+		if peak == 0 || 1-float64(live)/float64(peak) < threshold {
 			shard.Unlock()
 			runtime.Gosched()
+			continue
+		}
+
+		swarms := make(map[bittorrent.InfoHash]swarm, len(shard.swarms))
+		for ih, sw := range shard.swarms {
+			rebuilt := swarm{
+				seeders:      make(map[serializedPeer]int64, len(sw.seeders)),
+				leechers:     make(map[serializedPeer]int64, len(sw.leechers)),
+				created:      sw.created,
+				lastAnnounce: sw.lastAnnounce,
+			}
+			for pk, mtime := range sw.seeders {
+				rebuilt.seeders[pk] = mtime
+			}
+			for pk, mtime := range sw.leechers {
+				rebuilt.leechers[pk] = mtime
+			}
+			swarms[ih] = rebuilt
+		}
+		shard.swarms = swarms
+		rebuiltSnatches := make(map[bittorrent.InfoHash]snatches, len(shard.snatches))
+		for ih, sn := range shard.snatches {
+			rebuiltSnatches[ih] = sn
 		}
+		shard.snatches = rebuiltSnatches
+		rebuiltPartners := make(map[peerRef]serializedPeer, len(shard.partners))
+		for ref, partner := range shard.partners {
+			rebuiltPartners[ref] = partner
+		}
+		shard.partners = rebuiltPartners
+		shard.peakSwarms = len(swarms)
+		shard.peakPeers = shard.numSeeders + shard.numLeechers
+		compacted++
 
+		shard.Unlock()
 		runtime.Gosched()
 	}
 
-	recordGCDuration(time.Since(start))
-
-	return nil
+	recordCompaction(compacted, time.Since(start))
 }
 
 func (ps *peerStore) Stop() stop.Result {
@@ -577,13 +1262,23 @@ func (ps *peerStore) Stop() stop.Result {
 		close(ps.closed)
 		ps.wg.Wait()
 
+		// Save a final snapshot to restart from.
+		var err error
+		if ps.cfg.SnapshotPath != "" {
+			err = ps.saveSnapshot()
+		}
+
 		// Explicitly deallocate our storage.
 		shards := make([]*peerShard, len(ps.shards))
 		for i := 0; i < len(ps.shards); i++ {
-			shards[i] = &peerShard{swarms: make(map[bittorrent.InfoHash]swarm)}
+			shards[i] = newPeerShard()
 		}
 		ps.shards = shards
 
+		if err != nil {
+			c.Done(err)
+			return
+		}
 		c.Done()
 	}()
 
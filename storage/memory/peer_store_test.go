@@ -1,9 +1,19 @@
 package memory
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/clock"
 	s "github.com/chihaya/chihaya/storage"
 )
 
@@ -22,6 +32,8 @@ func createNew() s.PeerStore {
 
 func TestPeerStore(t *testing.T) { s.TestPeerStore(t, createNew()) }
 
+func TestPeerSelection(t *testing.T) { s.TestPeerSelection(t, createNew()) }
+
 func BenchmarkNop(b *testing.B)                        { s.Nop(b, createNew()) }
 func BenchmarkPut(b *testing.B)                        { s.Put(b, createNew()) }
 func BenchmarkPut1k(b *testing.B)                      { s.Put1k(b, createNew()) }
@@ -49,3 +61,397 @@ func BenchmarkAnnounceSeeder(b *testing.B)             { s.AnnounceSeeder(b, cre
 func BenchmarkAnnounceSeeder1kInfohash(b *testing.B)   { s.AnnounceSeeder1kInfohash(b, createNew()) }
 func BenchmarkScrapeSwarm(b *testing.B)                { s.ScrapeSwarm(b, createNew()) }
 func BenchmarkScrapeSwarm1kInfohash(b *testing.B)      { s.ScrapeSwarm1kInfohash(b, createNew()) }
+
+func TestCompact(t *testing.T) {
+	ps := createNew().(*peerStore)
+	defer ps.Stop()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	peers := make([]bittorrent.Peer, 100)
+	for i := range peers {
+		peers[i] = bittorrent.Peer{
+			ID:   bittorrent.PeerID{byte(i)},
+			IP:   bittorrent.IP{IP: net.IPv4(10, 0, 0, 1).To4(), AddressFamily: bittorrent.IPv4},
+			Port: uint16(i),
+		}
+		require.Nil(t, ps.PutLeecher(context.Background(), ih, peers[i]))
+	}
+	for _, p := range peers[10:] {
+		require.Nil(t, ps.DeleteLeecher(context.Background(), ih, p))
+	}
+
+	shard := ps.shards[ps.shardIndex(ih, bittorrent.IPv4)]
+	live, peak := shard.usage()
+	require.Equal(t, uint64(11), live)
+	require.Equal(t, uint64(101), peak)
+
+	ps.compact(0.5)
+
+	live, peak = shard.usage()
+	require.Equal(t, uint64(11), live)
+	require.Equal(t, uint64(11), peak)
+	require.Equal(t, uint32(10), ps.ScrapeSwarm(context.Background(), ih, bittorrent.IPv4).Incomplete)
+}
+
+func TestShardHash(t *testing.T) {
+	for _, tt := range []struct {
+		hash   string
+		shards int
+	}{
+		{ShardHashPrefix, 1},
+		{ShardHashFNV, 4},
+	} {
+		t.Run(tt.hash, func(t *testing.T) {
+			ps, err := New(Config{ShardCount: 4, ShardHash: tt.hash, GCConcurrency: 2})
+			require.Nil(t, err)
+			defer ps.Stop()
+
+			// Infohashes sharing their first bytes end up in the same shard
+			// unless the whole infohash is hashed.
+			p := bittorrent.Peer{IP: bittorrent.IP{IP: net.IPv4(10, 0, 0, 1).To4(), AddressFamily: bittorrent.IPv4}}
+			for i := 0; i < 64; i++ {
+				ih := bittorrent.InfoHashFromString(fmt.Sprintf("0000%016d", i))
+				require.Nil(t, ps.PutLeecher(context.Background(), ih, p))
+			}
+
+			used := 0
+			for _, s := range ps.(*peerStore).shards {
+				if s.numLeechers > 0 {
+					used++
+				}
+			}
+			require.Equal(t, tt.shards, used)
+
+			require.Nil(t, ps.(*peerStore).collectGarbage(time.Now().Add(time.Minute), time.Now().Add(time.Minute)))
+			for _, s := range ps.(*peerStore).shards {
+				require.Equal(t, uint64(0), s.numLeechers)
+				require.Len(t, s.swarms, 0)
+			}
+		})
+	}
+}
+
+func TestCollectGarbageReapedPeers(t *testing.T) {
+	ps := createNew().(*peerStore)
+	defer ps.Stop()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	for i := 0; i < 3; i++ {
+		p := bittorrent.Peer{
+			ID:   bittorrent.PeerID{byte(i)},
+			IP:   bittorrent.IP{IP: net.IPv4(10, 0, 0, 1).To4(), AddressFamily: bittorrent.IPv4},
+			Port: uint16(i),
+		}
+		if i == 0 {
+			require.Nil(t, ps.PutSeeder(context.Background(), ih, p))
+		} else {
+			require.Nil(t, ps.PutLeecher(context.Background(), ih, p))
+		}
+	}
+
+	shard := ps.shards[ps.shardIndex(ih, bittorrent.IPv4)]
+	require.Equal(t, uint64(0), shard.collectGarbage(time.Now().Add(-time.Minute).UnixNano(), 0))
+	require.Equal(t, uint64(3), shard.collectGarbage(time.Now().Add(time.Minute).UnixNano(), 0))
+	require.Len(t, shard.swarms, 0)
+}
+
+func TestPeerExpiry(t *testing.T) {
+	c := clock.NewMock(time.Unix(1e9, 0))
+	ps, err := New(Config{
+		ShardCount:                1,
+		GarbageCollectionInterval: 10 * time.Minute,
+		PeerLifetime:              30 * time.Minute,
+		Clock:                     c,
+	})
+	require.Nil(t, err)
+	defer ps.Stop()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	peer := func(port uint16) bittorrent.Peer {
+		return bittorrent.Peer{IP: bittorrent.IP{IP: net.IPv4(10, 0, 0, 1).To4(), AddressFamily: bittorrent.IPv4}, Port: port}
+	}
+	leechers := func() uint32 {
+		return ps.ScrapeSwarm(context.Background(), ih, bittorrent.IPv4).Incomplete
+	}
+
+	// The garbage collection goroutine waits for its next run.
+	c.BlockUntil(1)
+	require.Nil(t, ps.PutLeecher(context.Background(), ih, peer(1)))
+
+	for i := 0; i < 2; i++ {
+		c.Add(10 * time.Minute)
+		c.BlockUntil(1)
+	}
+	require.Nil(t, ps.PutLeecher(context.Background(), ih, peer(2)))
+	require.Equal(t, uint32(2), leechers())
+
+	// Peers are removed once they didn't announce for their lifetime.
+	c.Add(10 * time.Minute)
+	c.BlockUntil(1)
+	require.Equal(t, uint32(1), leechers())
+
+	c.Add(10 * time.Minute)
+	c.BlockUntil(1)
+	require.Equal(t, uint32(1), leechers())
+
+	c.Add(10 * time.Minute)
+	c.BlockUntil(1)
+	require.Equal(t, uint32(0), leechers())
+}
+
+func TestSwarmActivity(t *testing.T) {
+	c := clock.NewMock(time.Unix(1e9, 0))
+	ps, err := New(Config{
+		ShardCount:                1,
+		GarbageCollectionInterval: time.Hour,
+		PeerLifetime:              time.Hour,
+		Clock:                     c,
+	})
+	require.Nil(t, err)
+	defer ps.Stop()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	peer := bittorrent.Peer{IP: bittorrent.IP{IP: net.IPv4(10, 0, 0, 1).To4(), AddressFamily: bittorrent.IPv4}, Port: 1}
+	reporter := ps.(s.ActivityReporter)
+
+	_, ok := reporter.SwarmActivity(context.Background(), ih, bittorrent.IPv4)
+	require.False(t, ok)
+
+	created := c.Now()
+	require.Nil(t, ps.PutLeecher(context.Background(), ih, peer))
+	c.Add(10 * time.Minute)
+	require.Nil(t, ps.GraduateLeecher(context.Background(), ih, peer))
+
+	activity, ok := reporter.SwarmActivity(context.Background(), ih, bittorrent.IPv4)
+	require.True(t, ok)
+	require.True(t, created.Equal(activity.Created))
+	require.True(t, c.Now().Equal(activity.LastAnnounce))
+
+	// Swarms not announced to since the cutoff are reaped as a whole.
+	shard := ps.(*peerStore).shards[0]
+	require.Equal(t, uint64(0), shard.collectGarbage(created.UnixNano(), 0))
+	require.Equal(t, uint64(1), shard.collectGarbage(c.Now().UnixNano(), 0))
+	_, ok = reporter.SwarmActivity(context.Background(), ih, bittorrent.IPv4)
+	require.False(t, ok)
+}
+
+func TestMultiHomedPeers(t *testing.T) {
+	ps := createNew().(*peerStore)
+	defer ps.Stop()
+
+	ctx := context.Background()
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	id := bittorrent.PeerIDFromString("00000000000000000001")
+	v4 := bittorrent.Peer{ID: id, IP: bittorrent.IP{IP: net.IPv4(10, 0, 0, 1).To4(), AddressFamily: bittorrent.IPv4}, Port: 1}
+	v6 := bittorrent.Peer{ID: id, IP: bittorrent.IP{IP: net.ParseIP("fc00::1"), AddressFamily: bittorrent.IPv6}, Port: 1}
+	otherV6 := bittorrent.Peer{ID: id, IP: bittorrent.IP{IP: net.ParseIP("fc00::2"), AddressFamily: bittorrent.IPv6}, Port: 1}
+
+	counts := func(af bittorrent.AddressFamily) [3]uint32 {
+		scrape := ps.ScrapeSwarm(ctx, ih, af)
+		return [3]uint32{scrape.Complete, scrape.Incomplete, scrape.Snatches}
+	}
+	multiHomed := func() int {
+		return len(ps.shards[ps.shardIndex(ih, bittorrent.IPv4)].partners)
+	}
+
+	// Both endpoints are put and graduated together.
+	require.Nil(t, ps.PutMultiHomedLeecher(ctx, ih, v4, v6))
+	require.Equal(t, [3]uint32{0, 1, 0}, counts(bittorrent.IPv4))
+	require.Equal(t, [3]uint32{0, 1, 0}, counts(bittorrent.IPv6))
+	require.Equal(t, 1, multiHomed())
+	require.Nil(t, ps.GraduateMultiHomedLeecher(ctx, ih, v6, v4))
+	require.Equal(t, [3]uint32{1, 0, 1}, counts(bittorrent.IPv4))
+	require.Equal(t, [3]uint32{1, 0, 1}, counts(bittorrent.IPv6))
+	require.Equal(t, int64(2), ps.numPeers)
+
+	// An endpoint put on its own drops the other.
+	require.Nil(t, ps.PutSeeder(ctx, ih, v4))
+	require.Equal(t, [3]uint32{1, 0, 1}, counts(bittorrent.IPv4))
+	require.Equal(t, [3]uint32{0, 0, 1}, counts(bittorrent.IPv6))
+	require.Equal(t, 0, multiHomed())
+
+	// Deleting either endpoint deletes both.
+	require.Nil(t, ps.PutMultiHomedSeeder(ctx, ih, v4, v6))
+	require.Nil(t, ps.DeleteSeeder(ctx, ih, v6))
+	require.Equal(t, [3]uint32{0, 0, 1}, counts(bittorrent.IPv4))
+	require.Equal(t, int64(0), ps.numPeers)
+	require.Equal(t, 0, multiHomed())
+
+	// A new endpoint replaces the previous one.
+	require.Nil(t, ps.PutMultiHomedLeecher(ctx, ih, v4, v6))
+	require.Nil(t, ps.PutMultiHomedLeecher(ctx, ih, v4, otherV6))
+	require.Equal(t, [3]uint32{0, 1, 1}, counts(bittorrent.IPv6))
+	peers, err := ps.AnnouncePeers(ctx, ih, true, 10, bittorrent.Peer{IP: otherV6.IP})
+	require.Nil(t, err)
+	require.Equal(t, []bittorrent.Peer{otherV6}, peers)
+	require.Equal(t, int64(2), ps.numPeers)
+
+	// Endpoints are reaped together, along with their links.
+	ps.collectGarbage(time.Now().Add(time.Minute), time.Unix(0, 0))
+	require.Equal(t, [3]uint32{0, 0, 1}, counts(bittorrent.IPv4))
+	require.Equal(t, [3]uint32{0, 0, 1}, counts(bittorrent.IPv6))
+	require.Equal(t, 0, multiHomed())
+	require.Empty(t, ps.shards[ps.shardIndex(ih, bittorrent.IPv6)].partners)
+}
+
+func TestSnatchesOutliveSwarms(t *testing.T) {
+	c := clock.NewMock(time.Unix(1e9, 0))
+	ps, err := New(Config{
+		ShardCount:                1,
+		GarbageCollectionInterval: time.Hour,
+		PeerLifetime:              time.Hour,
+		SnatchLifetime:            24 * time.Hour,
+		Clock:                     c,
+	})
+	require.Nil(t, err)
+	defer ps.Stop()
+
+	ctx := context.Background()
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	peer := func(port uint16) bittorrent.Peer {
+		return bittorrent.Peer{IP: bittorrent.IP{IP: net.IPv4(10, 0, 0, 1).To4(), AddressFamily: bittorrent.IPv4}, Port: port}
+	}
+	scrape := func() bittorrent.Scrape {
+		return ps.ScrapeSwarm(ctx, ih, bittorrent.IPv4)
+	}
+
+	require.Nil(t, ps.PutLeecher(ctx, ih, peer(1)))
+	require.Nil(t, ps.GraduateLeecher(ctx, ih, peer(1)))
+	require.Nil(t, ps.GraduateLeecher(ctx, ih, peer(2)))
+	require.Equal(t, uint32(2), scrape().Snatches)
+
+	// Emptying the swarm deletes it, but not its snatches.
+	require.Nil(t, ps.DeleteSeeder(ctx, ih, peer(1)))
+	require.Nil(t, ps.DeleteSeeder(ctx, ih, peer(2)))
+	_, err = ps.AnnouncePeers(ctx, ih, false, 10, peer(3))
+	require.Equal(t, s.ErrResourceDoesNotExist, err)
+	require.Equal(t, bittorrent.Scrape{InfoHash: ih, Snatches: 2}, scrape())
+
+	// Announcing again recreates the swarm, which keeps counting.
+	require.Nil(t, ps.PutLeecher(ctx, ih, peer(3)))
+	require.Nil(t, ps.GraduateLeecher(ctx, ih, peer(3)))
+	require.Equal(t, bittorrent.Scrape{InfoHash: ih, Complete: 1, Snatches: 3}, scrape())
+
+	// Snatches of empty swarms expire once nobody completed downloading for
+	// the snatch lifetime.
+	shard := ps.(*peerStore).shards[0]
+	c.Add(2 * time.Hour)
+	require.Equal(t, uint64(1), shard.collectGarbage(c.Now().Add(-time.Hour).UnixNano(), c.Now().Add(-24*time.Hour).UnixNano()))
+	require.Equal(t, uint32(3), scrape().Snatches)
+
+	c.Add(24 * time.Hour)
+	require.Equal(t, uint64(0), shard.collectGarbage(c.Now().Add(-time.Hour).UnixNano(), c.Now().Add(-24*time.Hour).UnixNano()))
+	require.Equal(t, bittorrent.Scrape{InfoHash: ih}, scrape())
+}
+
+func TestPeerLimits(t *testing.T) {
+	ctx := context.Background()
+	ih1 := bittorrent.InfoHashFromString("00000000000000000001")
+	ih2 := bittorrent.InfoHashFromString("00000000000000000002")
+	peer := func(port uint16) bittorrent.Peer {
+		return bittorrent.Peer{IP: bittorrent.IP{IP: net.IPv4(10, 0, 0, 1).To4(), AddressFamily: bittorrent.IPv4}, Port: port}
+	}
+	newStore := func(cfg Config) (s.PeerStore, *clock.Mock) {
+		c := clock.NewMock(time.Unix(1e9, 0))
+		cfg.ShardCount, cfg.GarbageCollectionInterval, cfg.PeerLifetime, cfg.Clock = 1, time.Hour, time.Hour, c
+		ps, err := New(cfg)
+		require.Nil(t, err)
+		return ps, c
+	}
+
+	// The stalest peer of a full swarm is evicted.
+	ps, c := newStore(Config{MaxSwarmPeers: 2})
+	require.Nil(t, ps.PutLeecher(ctx, ih1, peer(1)))
+	c.Add(time.Second)
+	require.Nil(t, ps.PutSeeder(ctx, ih1, peer(2)))
+	c.Add(time.Second)
+	require.Nil(t, ps.PutLeecher(ctx, ih1, peer(1)))
+	require.Nil(t, ps.PutLeecher(ctx, ih1, peer(3)))
+	require.Equal(t, bittorrent.Scrape{InfoHash: ih1, Incomplete: 2}, ps.ScrapeSwarm(ctx, ih1, bittorrent.IPv4))
+	ps.Stop()
+
+	ps, _ = newStore(Config{MaxSwarmPeers: 1, PeerLimitPolicy: PeerLimitReject})
+	require.Nil(t, ps.PutLeecher(ctx, ih1, peer(1)))
+	require.Equal(t, ErrSwarmFull, ps.PutSeeder(ctx, ih1, peer(2)))
+	require.Nil(t, ps.PutLeecher(ctx, ih2, peer(2)))
+	ps.Stop()
+
+	// The stalest peer of all swarms of the shard is evicted, and swarms
+	// left empty are deleted.
+	ps, c = newStore(Config{MaxPeers: 2})
+	require.Nil(t, ps.PutLeecher(ctx, ih1, peer(1)))
+	c.Add(time.Second)
+	require.Nil(t, ps.PutLeecher(ctx, ih2, peer(2)))
+	c.Add(time.Second)
+	require.Nil(t, ps.GraduateLeecher(ctx, ih2, peer(3)))
+	require.Equal(t, bittorrent.Scrape{InfoHash: ih2, Complete: 1, Incomplete: 1, Snatches: 1}, ps.ScrapeSwarm(ctx, ih2, bittorrent.IPv4))
+	swarms, err := ps.(s.SwarmLister).ListSwarms(ctx)
+	require.Nil(t, err)
+	require.Equal(t, []bittorrent.InfoHash{ih2}, swarms)
+	ps.Stop()
+
+	ps, _ = newStore(Config{MaxPeers: 1, PeerLimitPolicy: PeerLimitReject})
+	require.Nil(t, ps.PutLeecher(ctx, ih1, peer(1)))
+	require.Equal(t, ErrStoreFull, ps.PutLeecher(ctx, ih2, peer(2)))
+	require.Nil(t, ps.DeleteLeecher(ctx, ih1, peer(1)))
+	require.Nil(t, ps.PutLeecher(ctx, ih2, peer(2)))
+	swarms, err = ps.(s.SwarmLister).ListSwarms(ctx)
+	require.Nil(t, err)
+	require.Equal(t, []bittorrent.InfoHash{ih2}, swarms)
+	ps.Stop()
+}
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chihaya")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snapshot")
+	cfg := Config{ShardCount: 4, SnapshotPath: path, SnapshotInterval: time.Hour}
+
+	ps, err := New(cfg)
+	require.Nil(t, err)
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	v4 := bittorrent.Peer{ID: bittorrent.PeerID{1}, IP: bittorrent.IP{IP: net.IPv4(10, 0, 0, 1).To4(), AddressFamily: bittorrent.IPv4}, Port: 1}
+	v6 := bittorrent.Peer{ID: bittorrent.PeerID{2}, IP: bittorrent.IP{IP: net.ParseIP("2001:db8::1"), AddressFamily: bittorrent.IPv6}, Port: 2}
+	require.Nil(t, ps.GraduateLeecher(context.Background(), ih, v4))
+	require.Nil(t, ps.PutLeecher(context.Background(), ih, v6))
+	empty := bittorrent.InfoHashFromString("00000000000000000002")
+	require.Nil(t, ps.GraduateLeecher(context.Background(), empty, v4))
+	require.Nil(t, ps.DeleteSeeder(context.Background(), empty, v4))
+	require.Len(t, ps.Stop().Wait(), 0)
+
+	// Restarting from the snapshot restores the swarms.
+	cfg.ShardHash = ShardHashFNV
+	ps, err = New(cfg)
+	require.Nil(t, err)
+	require.Equal(t, uint32(1), ps.ScrapeSwarm(context.Background(), ih, bittorrent.IPv4).Complete)
+	require.Equal(t, uint32(1), ps.ScrapeSwarm(context.Background(), ih, bittorrent.IPv4).Snatches)
+	require.Equal(t, uint32(1), ps.ScrapeSwarm(context.Background(), ih, bittorrent.IPv6).Incomplete)
+	require.Equal(t, uint32(1), ps.ScrapeSwarm(context.Background(), empty, bittorrent.IPv4).Snatches)
+	activity, ok := ps.(s.ActivityReporter).SwarmActivity(context.Background(), ih, bittorrent.IPv4)
+	require.True(t, ok)
+	require.False(t, activity.Created.IsZero())
+	require.False(t, activity.LastAnnounce.Before(activity.Created))
+	peers, err := ps.AnnouncePeers(context.Background(), ih, false, 10, v6)
+	require.Nil(t, err)
+	require.Len(t, peers, 0)
+	peers, err = ps.AnnouncePeers(context.Background(), ih, false, 10, v4)
+	require.Nil(t, err)
+	require.Equal(t, []bittorrent.Peer{v4}, peers)
+	require.Len(t, ps.Stop().Wait(), 0)
+
+	// Truncated snapshots are rejected.
+	contents, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(path, contents[:len(contents)-1], 0600))
+	_, err = New(cfg)
+	require.Equal(t, ErrInvalidSnapshot, err)
+
+	// So are snapshots of other versions.
+	contents[len(snapshotMagic)+1] = snapshotVersion + 1
+	require.Nil(t, ioutil.WriteFile(path, contents, 0600))
+	_, err = New(cfg)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "unsupported version")
+}
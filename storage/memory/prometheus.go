@@ -0,0 +1,114 @@
+package memory
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+func init() {
+	prometheus.MustRegister(
+		promFragmentationRatio,
+		promCompactedShardsTotal,
+		promCompactionDurationMilliseconds,
+		promShardPeersCount,
+		promShardGCDurationMilliseconds,
+		promSnapshotDurationMilliseconds,
+		promPeerLimitTotal,
+	)
+}
+
+var promFragmentationRatio = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "chihaya_storage_memory_fragmentation_ratio",
+	Help: "The estimated share of the memory of the memory storage's maps held by deleted entries",
+})
+
+var promCompactedShardsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "chihaya_storage_memory_compacted_shards_total",
+	Help: "The number of shards of the memory storage that were compacted",
+})
+
+var promCompactionDurationMilliseconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Name:    "chihaya_storage_memory_compaction_duration_milliseconds",
+	Help:    "The time it takes to check and compact the shards of the memory storage",
+	Buckets: prometheus.ExponentialBuckets(9.375, 2, 10),
+})
+
+// recordFragmentation records the estimated fragmentation given the number of
+// live entries and the peak number of entries since the last compaction.
+func recordFragmentation(live, peak uint64) {
+	var ratio float64
+	if peak > 0 {
+		ratio = 1 - float64(live)/float64(peak)
+	}
+	promFragmentationRatio.Set(ratio)
+}
+
+// recordCompaction records a compaction run.
+func recordCompaction(shards int, duration time.Duration) {
+	promCompactedShardsTotal.Add(float64(shards))
+	promCompactionDurationMilliseconds.Observe(float64(duration.Nanoseconds()) / float64(time.Millisecond))
+}
+
+var promSnapshotDurationMilliseconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Name:    "chihaya_storage_memory_snapshot_duration_milliseconds",
+	Help:    "The time it takes to save a snapshot of the memory storage",
+	Buckets: prometheus.ExponentialBuckets(9.375, 2, 10),
+})
+
+// recordSnapshot records the duration of saving a snapshot.
+func recordSnapshot(duration time.Duration) {
+	promSnapshotDurationMilliseconds.Observe(float64(duration.Nanoseconds()) / float64(time.Millisecond))
+}
+
+var promPeerLimitTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "chihaya_storage_memory_peer_limit_total",
+	Help: "The number of new peers exceeding a peer limit of the memory storage, by limit and whether a peer was evicted or the new peer rejected",
+}, []string{"limit", "action"})
+
+// recordPeerLimit records a new peer exceeding a peer limit.
+func recordPeerLimit(limit, action string) {
+	promPeerLimitTotal.WithLabelValues(limit, action).Inc()
+}
+
+var promShardPeersCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "chihaya_storage_memory_shard_peers_count",
+	Help: "The number of peers in each shard of the memory storage",
+}, []string{"shard", "address_family"})
+
+var promShardGCDurationMilliseconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "chihaya_storage_memory_shard_gc_duration_milliseconds",
+	Help: "The time the last garbage collection took for each shard of the memory storage",
+}, []string{"shard", "address_family"})
+
+// shardLabels returns the labels of the shard with the given index.
+//
+// The first half of the shards holds IPv4 swarms and the second half IPv6
+// swarms, so shards are numbered per address family.
+func (ps *peerStore) shardLabels(idx int) prometheus.Labels {
+	af := bittorrent.IPv4
+	if n := len(ps.shards) / 2; idx >= n {
+		af = bittorrent.IPv6
+		idx -= n
+	}
+	return prometheus.Labels{"shard": strconv.Itoa(idx), "address_family": af.String()}
+}
+
+// populateShardProm posts the number of peers of every shard to prometheus.
+func (ps *peerStore) populateShardProm() {
+	for idx, s := range ps.shards {
+		s.RLock()
+		peers := s.numSeeders + s.numLeechers
+		s.RUnlock()
+		promShardPeersCount.With(ps.shardLabels(idx)).Set(float64(peers))
+	}
+}
+
+// recordShardGCDuration records the duration of the garbage collection of the
+// shard with the given index.
+func (ps *peerStore) recordShardGCDuration(idx int, duration time.Duration) {
+	promShardGCDurationMilliseconds.With(ps.shardLabels(idx)).Set(float64(duration.Nanoseconds()) / float64(time.Millisecond))
+}
@@ -0,0 +1,193 @@
+package memory
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+	"github.com/chihaya/chihaya/storage"
+)
+
+func init() {
+	storage.RegisterIPStoreDriver(Name, driver{})
+	storage.RegisterStringStoreDriver(Name, driver{})
+}
+
+// NewIPStore creates a new memory IPStore. It takes no configuration.
+func (d driver) NewIPStore(cfg interface{}) (storage.IPStore, error) {
+	return NewIPStore(), nil
+}
+
+// NewStringStore creates a new memory StringStore. It takes no
+// configuration.
+func (d driver) NewStringStore(cfg interface{}) (storage.StringStore, error) {
+	return NewStringStore(), nil
+}
+
+// ipStore is an IPStore keeping single addresses and ranges in maps keyed by
+// their canonical notation.
+type ipStore struct {
+	mu       sync.RWMutex
+	ips      map[string]struct{}
+	networks map[string]*net.IPNet
+}
+
+var _ storage.IPStore = &ipStore{}
+
+// NewIPStore creates a new, empty memory IPStore.
+func NewIPStore() storage.IPStore {
+	return &ipStore{
+		ips:      make(map[string]struct{}),
+		networks: make(map[string]*net.IPNet),
+	}
+}
+
+// ipKey returns the canonical notation of ip, which is the same for the
+// 4-byte and 16-byte forms of IPv4 addresses.
+func ipKey(ip net.IP) (string, error) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String(), nil
+	}
+	if len(ip) != net.IPv6len {
+		return "", &net.ParseError{Type: "IP address", Text: ip.String()}
+	}
+	return ip.String(), nil
+}
+
+// parseNetwork parses a range in CIDR notation into the range and its
+// canonical notation.
+func parseNetwork(network string) (string, *net.IPNet, error) {
+	_, ipNet, err := net.ParseCIDR(network)
+	if err != nil {
+		return "", nil, err
+	}
+	return ipNet.String(), ipNet, nil
+}
+
+func (s *ipStore) AddIP(ctx context.Context, ip net.IP) error {
+	key, err := ipKey(ip)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.ips[key] = struct{}{}
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *ipStore) AddNetwork(ctx context.Context, network string) error {
+	key, ipNet, err := parseNetwork(network)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.networks[key] = ipNet
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *ipStore) HasIP(ctx context.Context, ip net.IP) (bool, error) {
+	key, err := ipKey(ip)
+	if err != nil {
+		return false, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.ips[key]; ok {
+		return true, nil
+	}
+	for _, ipNet := range s.networks {
+		if ipNet.Contains(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *ipStore) RemoveIP(ctx context.Context, ip net.IP) error {
+	key, err := ipKey(ip)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.ips[key]; !ok {
+		return storage.ErrResourceDoesNotExist
+	}
+	delete(s.ips, key)
+	return nil
+}
+
+func (s *ipStore) RemoveNetwork(ctx context.Context, network string) error {
+	key, _, err := parseNetwork(network)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.networks[key]; !ok {
+		return storage.ErrResourceDoesNotExist
+	}
+	delete(s.networks, key)
+	return nil
+}
+
+func (s *ipStore) Stop() stop.Result {
+	return stop.AlreadyStopped
+}
+
+func (s *ipStore) LogFields() log.Fields {
+	return log.Fields{"name": Name}
+}
+
+// stringStore is a StringStore keeping its strings in a map.
+type stringStore struct {
+	mu      sync.RWMutex
+	strings map[string]struct{}
+}
+
+var _ storage.StringStore = &stringStore{}
+
+// NewStringStore creates a new, empty memory StringStore.
+func NewStringStore() storage.StringStore {
+	return &stringStore{strings: make(map[string]struct{})}
+}
+
+func (s *stringStore) PutString(ctx context.Context, str string) error {
+	s.mu.Lock()
+	s.strings[str] = struct{}{}
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *stringStore) HasString(ctx context.Context, str string) (bool, error) {
+	s.mu.RLock()
+	_, ok := s.strings[str]
+	s.mu.RUnlock()
+	return ok, nil
+}
+
+func (s *stringStore) RemoveString(ctx context.Context, str string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.strings[str]; !ok {
+		return storage.ErrResourceDoesNotExist
+	}
+	delete(s.strings, str)
+	return nil
+}
+
+func (s *stringStore) Stop() stop.Result {
+	return stop.AlreadyStopped
+}
+
+func (s *stringStore) LogFields() log.Fields {
+	return log.Fields{"name": Name}
+}
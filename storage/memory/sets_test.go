@@ -0,0 +1,26 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	s "github.com/chihaya/chihaya/storage"
+)
+
+func TestIPStore(t *testing.T) { s.TestIPStore(t, NewIPStore()) }
+
+func TestStringStore(t *testing.T) { s.TestStringStore(t, NewStringStore()) }
+
+func TestSetDrivers(t *testing.T) {
+	ips, err := s.NewIPStore(Name, nil)
+	require.Nil(t, err)
+	s.TestIPStore(t, ips)
+
+	strs, err := s.NewStringStore(Name, nil)
+	require.Nil(t, err)
+	s.TestStringStore(t, strs)
+
+	_, err = s.NewIPStore("nonexistent", nil)
+	require.Equal(t, s.ErrIPStoreDriverDoesNotExist, err)
+}
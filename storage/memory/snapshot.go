@@ -0,0 +1,361 @@
+package memory
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// Snapshots are streams of swarms, so that neither writing nor reading them
+// requires a second copy of the whole PeerStore in memory.
+//
+// A snapshot starts with snapshotMagic and a big-endian uint16 version,
+// followed by any number of records. Every record starts with a type byte.
+//
+// A recordSwarm consists of the 20 byte infohash, the address family byte,
+// the big-endian uint32 numbers of seeders and leechers and the big-endian
+// int64 time the swarm was created in nanoseconds, followed by every peer as a
+// length-prefixed serialized peer and its big-endian int64 mtime in
+// nanoseconds.
+//
+// Snatches are stored apart from the swarms, since they outlive them. A
+// recordSnatches consists of the 20 byte infohash, the address family byte,
+// the big-endian uint32 number of snatches and the big-endian int64 time of
+// the last snatch in nanoseconds.
+//
+// A recordEnd marks the end of the snapshot, so that truncated snapshots are
+// detected.
+//
+// The links between the endpoints of multi-homed peers are not saved. Their
+// endpoints are restored as independent peers, until they announce again.
+const (
+	snapshotMagic   = "chihaya\x00"
+	snapshotVersion = 1
+
+	recordEnd      = 0
+	recordSwarm    = 1
+	recordSnatches = 2
+)
+
+// ErrInvalidSnapshot is returned when loading a snapshot that is not a
+// snapshot of a memory PeerStore, is of an unknown version or is truncated.
+var ErrInvalidSnapshot = errors.New("invalid snapshot")
+
+// saveSnapshot writes a snapshot of the PeerStore to the configured path.
+//
+// The snapshot is written to a temporary file first, so that the previous
+// snapshot stays intact if writing fails.
+func (ps *peerStore) saveSnapshot() error {
+	start := time.Now()
+	path := ps.cfg.SnapshotPath
+
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	w := bufio.NewWriter(f)
+	if err = ps.writeSnapshot(w); err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+
+	recordSnapshot(time.Since(start))
+	return nil
+}
+
+// writeSnapshot streams a snapshot of the PeerStore to w.
+//
+// Only one shard is copied at a time, so that shards aren't locked while
+// writing to w.
+func (ps *peerStore) writeSnapshot(w io.Writer) error {
+	if _, err := io.WriteString(w, snapshotMagic); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint16(snapshotVersion)); err != nil {
+		return err
+	}
+
+	half := len(ps.shards) / 2
+	for idx, shard := range ps.shards {
+		af := byte(bittorrent.IPv4)
+		if idx >= half {
+			af = byte(bittorrent.IPv6)
+		}
+
+		shard.RLock()
+		swarms := make(map[bittorrent.InfoHash]swarm, len(shard.swarms))
+		for ih, sw := range shard.swarms {
+			copied := swarm{
+				seeders:  make(map[serializedPeer]int64, len(sw.seeders)),
+				leechers: make(map[serializedPeer]int64, len(sw.leechers)),
+				created:  sw.created,
+			}
+			for pk, mtime := range sw.seeders {
+				copied.seeders[pk] = mtime
+			}
+			for pk, mtime := range sw.leechers {
+				copied.leechers[pk] = mtime
+			}
+			swarms[ih] = copied
+		}
+		snatches := make(map[bittorrent.InfoHash]snatches, len(shard.snatches))
+		for ih, sn := range shard.snatches {
+			snatches[ih] = sn
+		}
+		shard.RUnlock()
+
+		for ih, sw := range swarms {
+			if err := writeSwarm(w, ih, af, sw); err != nil {
+				return err
+			}
+		}
+		for ih, sn := range snatches {
+			if err := writeSnatches(w, ih, af, sn); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := w.Write([]byte{recordEnd})
+	return err
+}
+
+func writeSwarm(w io.Writer, ih bittorrent.InfoHash, af byte, sw swarm) error {
+	header := make([]byte, 1+20+1+4+4+8)
+	header[0] = recordSwarm
+	copy(header[1:21], ih[:])
+	header[21] = af
+	binary.BigEndian.PutUint32(header[22:26], uint32(len(sw.seeders)))
+	binary.BigEndian.PutUint32(header[26:30], uint32(len(sw.leechers)))
+	binary.BigEndian.PutUint64(header[30:38], uint64(sw.created))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	for _, peers := range []map[serializedPeer]int64{sw.seeders, sw.leechers} {
+		for pk, mtime := range peers {
+			buf := make([]byte, 1+len(pk)+8)
+			buf[0] = byte(len(pk))
+			copy(buf[1:], pk)
+			binary.BigEndian.PutUint64(buf[1+len(pk):], uint64(mtime))
+			if _, err := w.Write(buf); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func writeSnatches(w io.Writer, ih bittorrent.InfoHash, af byte, sn snatches) error {
+	buf := make([]byte, 1+20+1+4+8)
+	buf[0] = recordSnatches
+	copy(buf[1:21], ih[:])
+	buf[21] = af
+	binary.BigEndian.PutUint32(buf[22:26], sn.n)
+	binary.BigEndian.PutUint64(buf[26:34], uint64(sn.last))
+	_, err := w.Write(buf)
+	return err
+}
+
+// loadSnapshot loads the snapshot at the configured path, if it exists.
+func (ps *peerStore) loadSnapshot() error {
+	f, err := os.Open(ps.cfg.SnapshotPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Peers that expired while the tracker was down are skipped.
+	cutoff := ps.cfg.Clock.Now().Add(-ps.cfg.PeerLifetime).UnixNano()
+	return ps.readSnapshot(bufio.NewReader(f), cutoff)
+}
+
+// readSnapshot adds the peers of the snapshot read from r that were updated
+// after cutoff to the PeerStore.
+func (ps *peerStore) readSnapshot(r io.Reader, cutoff int64) error {
+	header := make([]byte, len(snapshotMagic)+2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return ErrInvalidSnapshot
+	}
+	if string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return ErrInvalidSnapshot
+	}
+	version := binary.BigEndian.Uint16(header[len(snapshotMagic):])
+	if version != snapshotVersion {
+		return fmt.Errorf("%s: unsupported version %d", ErrInvalidSnapshot, version)
+	}
+
+	var swarms, peers int
+	buf := make([]byte, 1+20+1+4+4+8)
+	for {
+		if _, err := io.ReadFull(r, buf[:1]); err != nil {
+			return ErrInvalidSnapshot
+		}
+		switch buf[0] {
+		case recordEnd:
+			log.Info("storage: loaded snapshot", log.Fields{
+				"path":   ps.cfg.SnapshotPath,
+				"swarms": swarms,
+				"peers":  peers,
+			})
+			return nil
+		case recordSnatches:
+			if _, err := io.ReadFull(r, buf[1:1+20+1+4+8]); err != nil {
+				return ErrInvalidSnapshot
+			}
+			ih, af, err := readInfoHash(buf)
+			if err != nil {
+				return err
+			}
+			sn := snatches{
+				n:    binary.BigEndian.Uint32(buf[22:26]),
+				last: int64(binary.BigEndian.Uint64(buf[26:34])),
+			}
+			ps.shards[ps.shardIndex(ih, af)].restoreSnatches(ih, sn)
+			continue
+		case recordSwarm:
+		default:
+			return ErrInvalidSnapshot
+		}
+
+		if _, err := io.ReadFull(r, buf[1:]); err != nil {
+			return ErrInvalidSnapshot
+		}
+		ih, af, err := readInfoHash(buf)
+		if err != nil {
+			return err
+		}
+		numSeeders := binary.BigEndian.Uint32(buf[22:26])
+		numLeechers := binary.BigEndian.Uint32(buf[26:30])
+		created := int64(binary.BigEndian.Uint64(buf[30:38]))
+
+		shard := ps.shards[ps.shardIndex(ih, af)]
+		for i := uint64(0); i < uint64(numSeeders)+uint64(numLeechers); i++ {
+			pk, mtime, err := readPeer(r)
+			if err != nil {
+				return err
+			}
+			if mtime <= cutoff {
+				continue
+			}
+			shard.putPeer(ih, pk, mtime, i < uint64(numSeeders))
+			peers++
+		}
+		shard.restoreSwarm(ih, created)
+		swarms++
+	}
+}
+
+// readInfoHash reads the infohash and the address family of a record.
+func readInfoHash(buf []byte) (bittorrent.InfoHash, bittorrent.AddressFamily, error) {
+	ih := bittorrent.InfoHashFromBytes(buf[1:21])
+	af := bittorrent.AddressFamily(buf[21])
+	if af != bittorrent.IPv4 && af != bittorrent.IPv6 {
+		return ih, af, ErrInvalidSnapshot
+	}
+	return ih, af, nil
+}
+
+func readPeer(r io.Reader) (serializedPeer, int64, error) {
+	var length [1]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return "", 0, ErrInvalidSnapshot
+	}
+	if n := int(length[0]); n != 20+2+net.IPv4len && n != 20+2+net.IPv6len {
+		return "", 0, ErrInvalidSnapshot
+	}
+
+	buf := make([]byte, int(length[0])+8)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", 0, ErrInvalidSnapshot
+	}
+	pk := serializedPeer(buf[:length[0]])
+	mtime := int64(binary.BigEndian.Uint64(buf[length[0]:]))
+	return pk, mtime, nil
+}
+
+// putPeer adds a peer to the swarm of the given infohash. The swarm was last
+// announced to no earlier than the peer.
+func (s *peerShard) putPeer(ih bittorrent.InfoHash, pk serializedPeer, mtime int64, seeder bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	sw, ok := s.swarms[ih]
+	if !ok {
+		sw = swarm{
+			seeders:  make(map[serializedPeer]int64),
+			leechers: make(map[serializedPeer]int64),
+			created:  mtime,
+		}
+	}
+	if mtime > sw.lastAnnounce {
+		sw.lastAnnounce = mtime
+	}
+	s.swarms[ih] = sw
+
+	peers := sw.leechers
+	if seeder {
+		peers = sw.seeders
+	}
+	if _, ok := peers[pk]; !ok {
+		if seeder {
+			s.numSeeders++
+		} else {
+			s.numLeechers++
+		}
+	}
+	peers[pk] = mtime
+	s.updatePeaks()
+}
+
+// restoreSwarm sets when the swarm of the given infohash was created, if it
+// has any peers.
+func (s *peerShard) restoreSwarm(ih bittorrent.InfoHash, created int64) {
+	s.Lock()
+	defer s.Unlock()
+
+	if sw, ok := s.swarms[ih]; ok && created < sw.created {
+		sw.created = created
+		s.swarms[ih] = sw
+	}
+}
+
+// restoreSnatches adds the snatches of the given infohash.
+func (s *peerShard) restoreSnatches(ih bittorrent.InfoHash, sn snatches) {
+	s.Lock()
+	defer s.Unlock()
+
+	restored := s.snatches[ih]
+	restored.n += sn.n
+	if sn.last > restored.last {
+		restored.last = sn.last
+	}
+	s.snatches[ih] = restored
+}
@@ -0,0 +1,188 @@
+// Package merge implements a storage.PeerStore that merges the swarms of
+// infohashes an operator declared equivalent, such as the v1 and v2
+// infohashes of a hybrid torrent or re-uploads of the same content.
+//
+// Announces and scrapes of any infohash of a class of equivalent infohashes
+// use one swarm, stored under the first infohash of the class, so that peers
+// find each other regardless of the infohash they announce.
+package merge
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/storage"
+)
+
+// Config holds the configuration of a merging Store.
+type Config struct {
+	// Classes are the classes of equivalent infohashes, hex-encoded. The
+	// swarm of a class is stored under its first infohash.
+	//
+	// v2 infohashes may be given in full and are truncated to 20 bytes, as
+	// they are in announces.
+	Classes [][]string `yaml:"classes"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"classes": len(cfg.Classes),
+	}
+}
+
+// ParseInfoHash parses a hex-encoded v1 infohash or a v2 infohash, which is
+// truncated to 20 bytes.
+func ParseInfoHash(s string) (bittorrent.InfoHash, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || (len(b) != 20 && len(b) != 32) {
+		return bittorrent.InfoHash{}, fmt.Errorf("invalid infohash %q", s)
+	}
+	return bittorrent.InfoHashFromBytes(b[:20]), nil
+}
+
+// Store is a storage.PeerStore that stores the swarms of equivalent
+// infohashes as one swarm in the wrapped PeerStore.
+type Store struct {
+	storage.PeerStore
+
+	// canonical maps every infohash of a class but the first to the first.
+	canonical map[bittorrent.InfoHash]bittorrent.InfoHash
+	classes   [][]bittorrent.InfoHash
+}
+
+var _ storage.PeerStore = &Store{}
+
+// New returns a Store wrapping ps.
+//
+// An infohash must not be part of more than one class, and classes must
+// have at least two infohashes.
+func New(ps storage.PeerStore, cfg Config) (*Store, error) {
+	s := &Store{
+		PeerStore: ps,
+		canonical: make(map[bittorrent.InfoHash]bittorrent.InfoHash),
+		classes:   make([][]bittorrent.InfoHash, 0, len(cfg.Classes)),
+	}
+
+	seen := make(map[bittorrent.InfoHash]struct{})
+	for i, strs := range cfg.Classes {
+		if len(strs) < 2 {
+			return nil, fmt.Errorf("class %d must have at least two infohashes", i)
+		}
+
+		class := make([]bittorrent.InfoHash, 0, len(strs))
+		for _, str := range strs {
+			ih, err := ParseInfoHash(str)
+			if err != nil {
+				return nil, fmt.Errorf("class %d: %s", i, err)
+			}
+			if _, ok := seen[ih]; ok {
+				return nil, fmt.Errorf("class %d: infohash %s is part of more than one class", i, ih)
+			}
+			seen[ih] = struct{}{}
+
+			if len(class) > 0 {
+				s.canonical[ih] = class[0]
+			}
+			class = append(class, ih)
+		}
+		s.classes = append(s.classes, class)
+	}
+
+	return s, nil
+}
+
+// Canonical returns the infohash the swarm of ih is stored under.
+func (s *Store) Canonical(ih bittorrent.InfoHash) bittorrent.InfoHash {
+	if canonical, ok := s.canonical[ih]; ok {
+		return canonical
+	}
+	return ih
+}
+
+// Classes returns the classes of equivalent infohashes. The first infohash of
+// a class is the one its swarm is stored under.
+func (s *Store) Classes() [][]bittorrent.InfoHash {
+	return s.classes
+}
+
+// PutSeeder implements storage.PeerStore.
+func (s *Store) PutSeeder(ctx context.Context, ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	return s.PeerStore.PutSeeder(ctx, s.Canonical(ih), p)
+}
+
+// DeleteSeeder implements storage.PeerStore.
+func (s *Store) DeleteSeeder(ctx context.Context, ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	return s.PeerStore.DeleteSeeder(ctx, s.Canonical(ih), p)
+}
+
+// PutLeecher implements storage.PeerStore.
+func (s *Store) PutLeecher(ctx context.Context, ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	return s.PeerStore.PutLeecher(ctx, s.Canonical(ih), p)
+}
+
+// DeleteLeecher implements storage.PeerStore.
+func (s *Store) DeleteLeecher(ctx context.Context, ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	return s.PeerStore.DeleteLeecher(ctx, s.Canonical(ih), p)
+}
+
+// GraduateLeecher implements storage.PeerStore.
+func (s *Store) GraduateLeecher(ctx context.Context, ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	return s.PeerStore.GraduateLeecher(ctx, s.Canonical(ih), p)
+}
+
+// PutMultiHomedSeeder implements storage.MultiHomedPeerStore.
+func (s *Store) PutMultiHomedSeeder(ctx context.Context, ih bittorrent.InfoHash, p, alternate bittorrent.Peer) error {
+	return storage.PutMultiHomedSeeder(ctx, s.PeerStore, s.Canonical(ih), p, alternate)
+}
+
+// PutMultiHomedLeecher implements storage.MultiHomedPeerStore.
+func (s *Store) PutMultiHomedLeecher(ctx context.Context, ih bittorrent.InfoHash, p, alternate bittorrent.Peer) error {
+	return storage.PutMultiHomedLeecher(ctx, s.PeerStore, s.Canonical(ih), p, alternate)
+}
+
+// GraduateMultiHomedLeecher implements storage.MultiHomedPeerStore.
+func (s *Store) GraduateMultiHomedLeecher(ctx context.Context, ih bittorrent.InfoHash, p, alternate bittorrent.Peer) error {
+	return storage.GraduateMultiHomedLeecher(ctx, s.PeerStore, s.Canonical(ih), p, alternate)
+}
+
+// AnnouncePeers implements storage.PeerStore.
+func (s *Store) AnnouncePeers(ctx context.Context, ih bittorrent.InfoHash, seeder bool, numWant int, p bittorrent.Peer) ([]bittorrent.Peer, error) {
+	return s.PeerStore.AnnouncePeers(ctx, s.Canonical(ih), seeder, numWant, p)
+}
+
+// AnnounceSeeders implements storage.PeerStore.
+func (s *Store) AnnounceSeeders(ctx context.Context, ih bittorrent.InfoHash, numWant int, p bittorrent.Peer) ([]bittorrent.Peer, error) {
+	return s.PeerStore.AnnounceSeeders(ctx, s.Canonical(ih), numWant, p)
+}
+
+// AnnounceLeechers implements storage.PeerStore.
+func (s *Store) AnnounceLeechers(ctx context.Context, ih bittorrent.InfoHash, numWant int, p bittorrent.Peer) ([]bittorrent.Peer, error) {
+	return s.PeerStore.AnnounceLeechers(ctx, s.Canonical(ih), numWant, p)
+}
+
+// ScrapeSwarm implements storage.PeerStore.
+//
+// The Scrape returned has the original infohash, since it is part of
+// responses.
+func (s *Store) ScrapeSwarm(ctx context.Context, ih bittorrent.InfoHash, af bittorrent.AddressFamily) bittorrent.Scrape {
+	scrape := s.PeerStore.ScrapeSwarm(ctx, s.Canonical(ih), af)
+	scrape.InfoHash = ih
+	return scrape
+}
+
+// SwarmActivity implements storage.ActivityReporter.
+func (s *Store) SwarmActivity(ctx context.Context, ih bittorrent.InfoHash, af bittorrent.AddressFamily) (storage.SwarmActivity, bool) {
+	return storage.Activity(ctx, s.PeerStore, s.Canonical(ih), af)
+}
+
+// LogFields implements log.Fielder.
+func (s *Store) LogFields() log.Fields {
+	return log.Fields{
+		"mergedClasses": len(s.classes),
+		"storage":       s.PeerStore.LogFields(),
+	}
+}
@@ -0,0 +1,98 @@
+package merge
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/storage"
+	"github.com/chihaya/chihaya/storage/memory"
+)
+
+const (
+	v1   = "0000000000000000000000000000000000000001"
+	v2   = "0000000000000000000000000000000000000002000000000000000000000000"
+	dupe = "0000000000000000000000000000000000000003"
+)
+
+func newMemory(t *testing.T) storage.PeerStore {
+	ps, err := memory.New(memory.Config{ShardCount: 1, GarbageCollectionInterval: time.Hour, PeerLifetime: time.Hour})
+	require.Nil(t, err)
+	return ps
+}
+
+func TestPeerStore(t *testing.T) {
+	s, err := New(newMemory(t), Config{Classes: [][]string{{v1, v2, dupe}}})
+	require.Nil(t, err)
+	storage.TestPeerStore(t, s)
+}
+
+func TestNew(t *testing.T) {
+	var table = []struct {
+		classes  [][]string
+		expected string
+	}{
+		{[][]string{{v1, v2}, {dupe, strings.Repeat("f", 40)}}, ""},
+		{[][]string{{v1}}, "at least two"},
+		{[][]string{{v1, "bogus"}}, "invalid infohash"},
+		{[][]string{{v1, v2}, {v1, dupe}}, "more than one class"},
+		// The v2 infohash is the same as a v1 infohash after truncation.
+		{[][]string{{v1, v2, v2[:40]}}, "more than one class"},
+	}
+
+	for _, tt := range table {
+		_, err := New(nil, Config{Classes: tt.classes})
+		if tt.expected == "" {
+			require.Nil(t, err)
+		} else {
+			require.NotNil(t, err)
+			require.Contains(t, err.Error(), tt.expected)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	ps := newMemory(t)
+	defer func() { ps.Stop().Wait() }()
+
+	s, err := New(ps, Config{Classes: [][]string{{v1, v2, dupe}}})
+	require.Nil(t, err)
+
+	ih1, err := ParseInfoHash(v1)
+	require.Nil(t, err)
+	ih2, err := ParseInfoHash(v2)
+	require.Nil(t, err)
+	other := bittorrent.InfoHashFromString("00000000000000000004")
+	require.Equal(t, ih1, s.Canonical(ih2))
+	require.Equal(t, ih1, s.Canonical(ih1))
+	require.Equal(t, other, s.Canonical(other))
+
+	ctx := context.Background()
+	seeder := bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("00000000000000000001"),
+		IP:   bittorrent.IP{IP: net.ParseIP("10.0.0.1").To4(), AddressFamily: bittorrent.IPv4},
+		Port: 1,
+	}
+	leecher := bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("00000000000000000002"),
+		IP:   bittorrent.IP{IP: net.ParseIP("10.0.0.2").To4(), AddressFamily: bittorrent.IPv4},
+		Port: 2,
+	}
+	require.Nil(t, s.PutSeeder(ctx, ih1, seeder))
+	require.Nil(t, s.PutLeecher(ctx, ih2, leecher))
+
+	// Peers of either infohash find each other.
+	peers, err := s.AnnouncePeers(ctx, ih2, false, 10, leecher)
+	require.Nil(t, err)
+	require.Equal(t, []bittorrent.Peer{seeder}, peers)
+
+	// Scrapes report the merged swarm under the infohash asked for.
+	require.Equal(t, bittorrent.Scrape{InfoHash: ih2, Complete: 1, Incomplete: 1}, s.ScrapeSwarm(ctx, ih2, bittorrent.IPv4))
+	require.Equal(t, bittorrent.Scrape{InfoHash: ih1, Complete: 1, Incomplete: 1}, ps.ScrapeSwarm(ctx, ih1, bittorrent.IPv4))
+	require.Equal(t, bittorrent.Scrape{InfoHash: ih2}, ps.ScrapeSwarm(ctx, ih2, bittorrent.IPv4))
+}
@@ -0,0 +1,157 @@
+// Package privacy implements a storage.PeerStore that stores swarms under a
+// keyed hash of their infohashes instead of the infohashes themselves.
+//
+// Announces and scrapes of the same infohash are transformed identically,
+// so they still match the same swarm, but the contents of the storage, its
+// replicas and the logs of the storage don't reveal which torrents were
+// tracked without the key.
+package privacy
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/storage"
+)
+
+// minKeyLength is the minimum length of a key, in bytes.
+const minKeyLength = 16
+
+// ErrKeyTooShort is returned if the configured key is shorter than
+// minKeyLength.
+var ErrKeyTooShort = errors.New("infohash privacy key must be at least 16 bytes long")
+
+// Config holds the configuration of a privacy Store.
+type Config struct {
+	// Key is the secret key of the hash. Changing it orphans all swarms,
+	// which are recreated as peers announce again.
+	Key string `yaml:"key"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+//
+// The key is never logged.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"keyLength": len(cfg.Key),
+	}
+}
+
+// Store is a storage.PeerStore that stores swarms in the wrapped PeerStore
+// under a keyed hash of their infohashes.
+//
+// Infohashes in the reserved namespace are not transformed, so that they
+// keep being recognized as reserved.
+type Store struct {
+	storage.PeerStore
+	key []byte
+}
+
+var _ storage.PeerStore = &Store{}
+
+// New returns a Store wrapping ps.
+func New(ps storage.PeerStore, cfg Config) (*Store, error) {
+	if len(cfg.Key) < minKeyLength {
+		return nil, ErrKeyTooShort
+	}
+	return &Store{PeerStore: ps, key: []byte(cfg.Key)}, nil
+}
+
+// Transform returns the infohash a swarm is stored under.
+func (s *Store) Transform(ih bittorrent.InfoHash) bittorrent.InfoHash {
+	if ih.Reserved() {
+		return ih
+	}
+
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(ih[:])
+	transformed := bittorrent.InfoHashFromBytes(mac.Sum(nil)[:20])
+
+	// Transformed infohashes must not collide with the reserved namespace.
+	if transformed.Reserved() {
+		transformed[0] ^= 0xff
+	}
+	return transformed
+}
+
+// PutSeeder implements storage.PeerStore.
+func (s *Store) PutSeeder(ctx context.Context, ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	return s.PeerStore.PutSeeder(ctx, s.Transform(ih), p)
+}
+
+// DeleteSeeder implements storage.PeerStore.
+func (s *Store) DeleteSeeder(ctx context.Context, ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	return s.PeerStore.DeleteSeeder(ctx, s.Transform(ih), p)
+}
+
+// PutLeecher implements storage.PeerStore.
+func (s *Store) PutLeecher(ctx context.Context, ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	return s.PeerStore.PutLeecher(ctx, s.Transform(ih), p)
+}
+
+// DeleteLeecher implements storage.PeerStore.
+func (s *Store) DeleteLeecher(ctx context.Context, ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	return s.PeerStore.DeleteLeecher(ctx, s.Transform(ih), p)
+}
+
+// GraduateLeecher implements storage.PeerStore.
+func (s *Store) GraduateLeecher(ctx context.Context, ih bittorrent.InfoHash, p bittorrent.Peer) error {
+	return s.PeerStore.GraduateLeecher(ctx, s.Transform(ih), p)
+}
+
+// PutMultiHomedSeeder implements storage.MultiHomedPeerStore.
+func (s *Store) PutMultiHomedSeeder(ctx context.Context, ih bittorrent.InfoHash, p, alternate bittorrent.Peer) error {
+	return storage.PutMultiHomedSeeder(ctx, s.PeerStore, s.Transform(ih), p, alternate)
+}
+
+// PutMultiHomedLeecher implements storage.MultiHomedPeerStore.
+func (s *Store) PutMultiHomedLeecher(ctx context.Context, ih bittorrent.InfoHash, p, alternate bittorrent.Peer) error {
+	return storage.PutMultiHomedLeecher(ctx, s.PeerStore, s.Transform(ih), p, alternate)
+}
+
+// GraduateMultiHomedLeecher implements storage.MultiHomedPeerStore.
+func (s *Store) GraduateMultiHomedLeecher(ctx context.Context, ih bittorrent.InfoHash, p, alternate bittorrent.Peer) error {
+	return storage.GraduateMultiHomedLeecher(ctx, s.PeerStore, s.Transform(ih), p, alternate)
+}
+
+// AnnouncePeers implements storage.PeerStore.
+func (s *Store) AnnouncePeers(ctx context.Context, ih bittorrent.InfoHash, seeder bool, numWant int, p bittorrent.Peer) ([]bittorrent.Peer, error) {
+	return s.PeerStore.AnnouncePeers(ctx, s.Transform(ih), seeder, numWant, p)
+}
+
+// AnnounceSeeders implements storage.PeerStore.
+func (s *Store) AnnounceSeeders(ctx context.Context, ih bittorrent.InfoHash, numWant int, p bittorrent.Peer) ([]bittorrent.Peer, error) {
+	return s.PeerStore.AnnounceSeeders(ctx, s.Transform(ih), numWant, p)
+}
+
+// AnnounceLeechers implements storage.PeerStore.
+func (s *Store) AnnounceLeechers(ctx context.Context, ih bittorrent.InfoHash, numWant int, p bittorrent.Peer) ([]bittorrent.Peer, error) {
+	return s.PeerStore.AnnounceLeechers(ctx, s.Transform(ih), numWant, p)
+}
+
+// ScrapeSwarm implements storage.PeerStore.
+//
+// The Scrape returned has the original infohash, since it is part of
+// responses.
+func (s *Store) ScrapeSwarm(ctx context.Context, ih bittorrent.InfoHash, af bittorrent.AddressFamily) bittorrent.Scrape {
+	scrape := s.PeerStore.ScrapeSwarm(ctx, s.Transform(ih), af)
+	scrape.InfoHash = ih
+	return scrape
+}
+
+// SwarmActivity implements storage.ActivityReporter.
+func (s *Store) SwarmActivity(ctx context.Context, ih bittorrent.InfoHash, af bittorrent.AddressFamily) (storage.SwarmActivity, bool) {
+	return storage.Activity(ctx, s.PeerStore, s.Transform(ih), af)
+}
+
+// LogFields implements log.Fielder.
+func (s *Store) LogFields() log.Fields {
+	return log.Fields{
+		"infoHashPrivacy": true,
+		"storage":         s.PeerStore.LogFields(),
+	}
+}
@@ -0,0 +1,64 @@
+package privacy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/storage"
+	"github.com/chihaya/chihaya/storage/memory"
+)
+
+func newMemory(t *testing.T) storage.PeerStore {
+	ps, err := memory.New(memory.Config{ShardCount: 1, GarbageCollectionInterval: time.Hour, PeerLifetime: time.Hour})
+	require.Nil(t, err)
+	return ps
+}
+
+func TestPeerStore(t *testing.T) {
+	s, err := New(newMemory(t), Config{Key: "0123456789abcdef"})
+	require.Nil(t, err)
+	storage.TestPeerStore(t, s)
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(nil, Config{Key: "short"})
+	require.Equal(t, ErrKeyTooShort, err)
+}
+
+func TestTransform(t *testing.T) {
+	ps := newMemory(t)
+	defer func() { ps.Stop().Wait() }()
+
+	s, err := New(ps, Config{Key: "0123456789abcdef"})
+	require.Nil(t, err)
+	other, err := New(ps, Config{Key: "fedcba9876543210"})
+	require.Nil(t, err)
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	require.Equal(t, s.Transform(ih), s.Transform(ih))
+	require.NotEqual(t, ih, s.Transform(ih))
+	require.NotEqual(t, s.Transform(ih), other.Transform(ih))
+	require.False(t, s.Transform(ih).Reserved())
+
+	reserved := bittorrent.ReservedInfoHash([]byte("test"))
+	require.Equal(t, reserved, s.Transform(reserved))
+
+	ctx := context.Background()
+	peer := bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("00000000000000000001"),
+		IP:   bittorrent.IP{IP: net.ParseIP("10.0.0.1").To4(), AddressFamily: bittorrent.IPv4},
+		Port: 1,
+	}
+	require.Nil(t, s.PutSeeder(ctx, ih, peer))
+
+	// The swarm is only stored under the transformed infohash.
+	require.Equal(t, bittorrent.Scrape{InfoHash: ih, Complete: 1}, s.ScrapeSwarm(ctx, ih, bittorrent.IPv4))
+	require.Equal(t, uint32(0), ps.ScrapeSwarm(ctx, ih, bittorrent.IPv4).Complete)
+	require.Equal(t, uint32(1), ps.ScrapeSwarm(ctx, s.Transform(ih), bittorrent.IPv4).Complete)
+	require.Equal(t, uint32(0), other.ScrapeSwarm(ctx, ih, bittorrent.IPv4).Complete)
+}
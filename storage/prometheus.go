@@ -6,9 +6,11 @@ func init() {
 	// Register the metrics.
 	prometheus.MustRegister(
 		PromGCDurationMilliseconds,
+		PromGCReapedPeersTotal,
 		PromInfohashesCount,
 		PromSeedersCount,
 		PromLeechersCount,
+		PromMultiHomedPeersCount,
 	)
 }
 
@@ -21,6 +23,13 @@ var (
 		Buckets: prometheus.ExponentialBuckets(9.375, 2, 10),
 	})
 
+	// PromGCReapedPeersTotal is a counter used by storage to record the
+	// number of expired peers removed by garbage collection.
+	PromGCReapedPeersTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "chihaya_storage_gc_reaped_peers_total",
+		Help: "The number of expired peers removed by storage garbage collection",
+	})
+
 	// PromInfohashesCount is a gauge used to hold the current total amount of
 	// unique swarms being tracked by a storage.
 	PromInfohashesCount = prometheus.NewGauge(prometheus.GaugeOpts{
@@ -41,4 +50,12 @@ var (
 		Name: "chihaya_storage_leechers_count",
 		Help: "The number of leechers tracked",
 	})
+
+	// PromMultiHomedPeersCount is a gauge used to hold the current total
+	// amount of multi-homed peers, which are counted as seeders or leechers
+	// once per address family.
+	PromMultiHomedPeersCount = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "chihaya_storage_multihomed_peers_count",
+		Help: "The number of multi-homed peers tracked with endpoints of both address families",
+	})
 )
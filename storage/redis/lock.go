@@ -0,0 +1,169 @@
+package redis
+
+import (
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// Default lock config constants.
+const (
+	defaultLockKey = "chihaya_restart_lock"
+	defaultLockTTL = time.Minute * 2
+)
+
+// LockConfig holds the configuration of a Lock.
+type LockConfig struct {
+	RedisBroker         string        `yaml:"redis_broker"`
+	RedisReadTimeout    time.Duration `yaml:"redis_read_timeout"`
+	RedisWriteTimeout   time.Duration `yaml:"redis_write_timeout"`
+	RedisConnectTimeout time.Duration `yaml:"redis_connect_timeout"`
+	Key                 string        `yaml:"key"`
+	TTL                 time.Duration `yaml:"ttl"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg LockConfig) LogFields() log.Fields {
+	return log.Fields{
+		"redisBroker":         cfg.RedisBroker,
+		"redisReadTimeout":    cfg.RedisReadTimeout,
+		"redisWriteTimeout":   cfg.RedisWriteTimeout,
+		"redisConnectTimeout": cfg.RedisConnectTimeout,
+		"key":                 cfg.Key,
+		"ttl":                 cfg.TTL,
+	}
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg LockConfig) Validate() LockConfig {
+	validcfg := cfg
+
+	if cfg.RedisReadTimeout <= 0 {
+		validcfg.RedisReadTimeout = defaultRedisReadTimeout
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "lock.RedisReadTimeout",
+			"provided": cfg.RedisReadTimeout,
+			"default":  validcfg.RedisReadTimeout,
+		})
+	}
+
+	if cfg.RedisWriteTimeout <= 0 {
+		validcfg.RedisWriteTimeout = defaultRedisWriteTimeout
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "lock.RedisWriteTimeout",
+			"provided": cfg.RedisWriteTimeout,
+			"default":  validcfg.RedisWriteTimeout,
+		})
+	}
+
+	if cfg.RedisConnectTimeout <= 0 {
+		validcfg.RedisConnectTimeout = defaultRedisConnectTimeout
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "lock.RedisConnectTimeout",
+			"provided": cfg.RedisConnectTimeout,
+			"default":  validcfg.RedisConnectTimeout,
+		})
+	}
+
+	if cfg.Key == "" {
+		validcfg.Key = defaultLockKey
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "lock.Key",
+			"provided": cfg.Key,
+			"default":  validcfg.Key,
+		})
+	}
+
+	if cfg.TTL <= 0 {
+		validcfg.TTL = defaultLockTTL
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "lock.TTL",
+			"provided": cfg.TTL,
+			"default":  validcfg.TTL,
+		})
+	}
+
+	return validcfg
+}
+
+// acquireScript sets the lock to the owner if it is free or already held by
+// the owner, refreshing its TTL.
+var acquireScript = redis.NewScript(1, `
+local owner = redis.call("GET", KEYS[1])
+if owner == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+elseif owner then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+return 1
+`)
+
+// releaseScript deletes the lock if it is held by the owner.
+var releaseScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// Lock is a lock shared via redis that expires after a TTL, so that it is
+// released even if its owner never comes back.
+//
+// Owners are identified by name rather than by process, so that a restarted
+// process can release a lock acquired before it was restarted.
+type Lock struct {
+	cfg   LockConfig
+	rb    *redisBackend
+	owner string
+}
+
+// NewLock creates a new Lock for the given owner.
+func NewLock(provided LockConfig, owner string) (*Lock, error) {
+	cfg := provided.Validate()
+
+	u, err := parseRedisURL(cfg.RedisBroker)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Lock{
+		cfg: cfg,
+		rb: newRedisBackend(&Config{
+			RedisReadTimeout:    cfg.RedisReadTimeout,
+			RedisWriteTimeout:   cfg.RedisWriteTimeout,
+			RedisConnectTimeout: cfg.RedisConnectTimeout,
+		}, u, ""),
+		owner: owner,
+	}, nil
+}
+
+// TryAcquire attempts to acquire the Lock once and reports whether it is
+// held by the owner afterwards.
+func (l *Lock) TryAcquire() (bool, error) {
+	conn := l.rb.open()
+	defer conn.Close()
+
+	ttl := int64(l.cfg.TTL / time.Millisecond)
+	acquired, err := redis.Int(acquireScript.Do(conn, l.cfg.Key, l.owner, ttl))
+	return acquired == 1, err
+}
+
+// Release releases the Lock if it is held by the owner.
+func (l *Lock) Release() error {
+	conn := l.rb.open()
+	defer conn.Close()
+
+	_, err := releaseScript.Do(conn, l.cfg.Key, l.owner)
+	return err
+}
+
+// TTL returns the duration after which the Lock expires.
+func (l *Lock) TTL() time.Duration {
+	return l.cfg.TTL
+}
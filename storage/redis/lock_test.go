@@ -0,0 +1,48 @@
+package redis
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLock(t *testing.T) {
+	rs, err := miniredis.Run()
+	require.Nil(t, err)
+	defer rs.Close()
+
+	cfg := LockConfig{RedisBroker: fmt.Sprintf("redis://@%s/0", rs.Addr()), TTL: time.Minute}
+	a, err := NewLock(cfg, "a")
+	require.Nil(t, err)
+	b, err := NewLock(cfg, "b")
+	require.Nil(t, err)
+
+	acquired, err := a.TryAcquire()
+	require.Nil(t, err)
+	require.True(t, acquired)
+
+	// The owner can acquire the lock again, others can't.
+	acquired, err = a.TryAcquire()
+	require.Nil(t, err)
+	require.True(t, acquired)
+	acquired, err = b.TryAcquire()
+	require.Nil(t, err)
+	require.False(t, acquired)
+
+	// Only the owner can release the lock.
+	require.Nil(t, b.Release())
+	require.True(t, rs.Exists(defaultLockKey))
+	require.Nil(t, a.Release())
+	acquired, err = b.TryAcquire()
+	require.Nil(t, err)
+	require.True(t, acquired)
+
+	// The lock expires if its owner never releases it.
+	rs.FastForward(2 * time.Minute)
+	acquired, err = a.TryAcquire()
+	require.Nil(t, err)
+	require.True(t, acquired)
+}
@@ -24,7 +24,11 @@
 package redis
 
 import (
+	"context"
 	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"math/rand"
 	"net"
 	"strconv"
 	"sync"
@@ -34,9 +38,9 @@ import (
 	yaml "gopkg.in/yaml.v2"
 
 	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/clock"
 	"github.com/chihaya/chihaya/pkg/log"
 	"github.com/chihaya/chihaya/pkg/stop"
-	"github.com/chihaya/chihaya/pkg/timecache"
 	"github.com/chihaya/chihaya/storage"
 )
 
@@ -52,6 +56,7 @@ const (
 	defaultRedisReadTimeout            = time.Second * 15
 	defaultRedisWriteTimeout           = time.Second * 15
 	defaultRedisConnectTimeout         = time.Second * 15
+	defaultMaxReplicaLag               = time.Second * 10
 )
 
 func init() {
@@ -70,7 +75,7 @@ func (d driver) NewPeerStore(icfg interface{}) (storage.PeerStore, error) {
 
 	// Unmarshal the bytes into the proper config type.
 	var cfg Config
-	err = yaml.Unmarshal(bytes, &cfg)
+	err = yaml.UnmarshalStrict(bytes, &cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -87,6 +92,16 @@ type Config struct {
 	RedisReadTimeout            time.Duration `yaml:"redis_read_timeout"`
 	RedisWriteTimeout           time.Duration `yaml:"redis_write_timeout"`
 	RedisConnectTimeout         time.Duration `yaml:"redis_connect_timeout"`
+
+	// RedisReadReplicas are the addresses of replicas of redis_broker that
+	// peers and scrapes are read from, as long as they lag behind by at most
+	// MaxReplicaLag. All writes go to redis_broker.
+	RedisReadReplicas []string      `yaml:"redis_read_replicas"`
+	MaxReplicaLag     time.Duration `yaml:"max_replica_lag"`
+
+	// Clock is used to timestamp peers and to schedule garbage collection.
+	// It defaults to clock.Cached and is replaced in tests.
+	Clock clock.Clock `yaml:"-"`
 }
 
 // LogFields renders the current config as a set of Logrus fields.
@@ -100,6 +115,8 @@ func (cfg Config) LogFields() log.Fields {
 		"redisReadTimeout":    cfg.RedisReadTimeout,
 		"redisWriteTimeout":   cfg.RedisWriteTimeout,
 		"redisConnectTimeout": cfg.RedisConnectTimeout,
+		"redisReadReplicas":   cfg.RedisReadReplicas,
+		"maxReplicaLag":       cfg.MaxReplicaLag,
 	}
 }
 
@@ -173,6 +190,19 @@ func (cfg Config) Validate() Config {
 		})
 	}
 
+	if len(cfg.RedisReadReplicas) > 0 && cfg.MaxReplicaLag <= 0 {
+		validcfg.MaxReplicaLag = defaultMaxReplicaLag
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     Name + ".MaxReplicaLag",
+			"provided": cfg.MaxReplicaLag,
+			"default":  validcfg.MaxReplicaLag,
+		})
+	}
+
+	if cfg.Clock == nil {
+		validcfg.Clock = clock.Cached
+	}
+
 	return validcfg
 }
 
@@ -191,6 +221,32 @@ func New(provided Config) (storage.PeerStore, error) {
 		closed: make(chan struct{}),
 	}
 
+	for _, addr := range cfg.RedisReadReplicas {
+		u, err := parseRedisURL(addr)
+		if err != nil {
+			return nil, err
+		}
+		ps.replicas = append(ps.replicas, &replica{addr: u.Host, rb: newRedisBackend(&cfg, u, "")})
+	}
+
+	if len(ps.replicas) > 0 {
+		ps.checkReplicas()
+
+		// Start a goroutine for checking the lag of read replicas.
+		ps.wg.Add(1)
+		go func() {
+			defer ps.wg.Done()
+			for {
+				select {
+				case <-ps.closed:
+					return
+				case <-cfg.Clock.After(ps.replicaCheckInterval()):
+					ps.checkReplicas()
+				}
+			}
+		}()
+	}
+
 	// Start a goroutine for garbage collection.
 	ps.wg.Add(1)
 	go func() {
@@ -199,8 +255,8 @@ func New(provided Config) (storage.PeerStore, error) {
 			select {
 			case <-ps.closed:
 				return
-			case <-time.After(cfg.GarbageCollectionInterval):
-				before := time.Now().Add(-cfg.PeerLifetime)
+			case <-cfg.Clock.After(cfg.GarbageCollectionInterval):
+				before := cfg.Clock.Now().Add(-cfg.PeerLifetime)
 				log.Debug("storage: purging peers with no announces since", log.Fields{"before": before})
 				if err = ps.collectGarbage(before); err != nil {
 					log.Error("storage: collectGarbage error", log.Fields{"before": before, "error": err})
@@ -263,6 +319,9 @@ type peerStore struct {
 	cfg Config
 	rb  *redisBackend
 
+	replicas    []*replica
+	nextReplica uint32
+
 	closed chan struct{}
 	wg     sync.WaitGroup
 }
@@ -279,6 +338,12 @@ func (ps *peerStore) seederInfohashKey(af, ih string) string {
 	return af + "_S_" + ih
 }
 
+// snatchesKey is the key of the number of peers that completed downloading
+// since the swarm was created.
+func (ps *peerStore) snatchesKey(af, ih string) string {
+	return af + "_D_" + ih
+}
+
 func (ps *peerStore) infohashCountKey(af string) string {
 	return af + "_infohash_count"
 }
@@ -332,10 +397,10 @@ func (ps *peerStore) populateProm() {
 }
 
 func (ps *peerStore) getClock() int64 {
-	return timecache.NowUnixNano()
+	return ps.cfg.Clock.Now().UnixNano()
 }
 
-func (ps *peerStore) PutSeeder(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+func (ps *peerStore) PutSeeder(ctx context.Context, ih bittorrent.InfoHash, p bittorrent.Peer) error {
 	addressFamily := p.IP.AddressFamily.String()
 	log.Debug("storage: PutSeeder", log.Fields{
 		"InfoHash": ih.String(),
@@ -353,7 +418,7 @@ func (ps *peerStore) PutSeeder(ih bittorrent.InfoHash, p bittorrent.Peer) error
 	encodedSeederInfoHash := ps.seederInfohashKey(addressFamily, ih.String())
 	ct := ps.getClock()
 
-	conn := ps.rb.open()
+	conn := ps.rb.openContext(ctx)
 	defer conn.Close()
 
 	conn.Send("MULTI")
@@ -382,7 +447,7 @@ func (ps *peerStore) PutSeeder(ih bittorrent.InfoHash, p bittorrent.Peer) error
 	return nil
 }
 
-func (ps *peerStore) DeleteSeeder(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+func (ps *peerStore) DeleteSeeder(ctx context.Context, ih bittorrent.InfoHash, p bittorrent.Peer) error {
 	addressFamily := p.IP.AddressFamily.String()
 	log.Debug("storage: DeleteSeeder", log.Fields{
 		"InfoHash": ih.String(),
@@ -397,7 +462,7 @@ func (ps *peerStore) DeleteSeeder(ih bittorrent.InfoHash, p bittorrent.Peer) err
 
 	pk := newPeerKey(p)
 
-	conn := ps.rb.open()
+	conn := ps.rb.openContext(ctx)
 	defer conn.Close()
 
 	encodedSeederInfoHash := ps.seederInfohashKey(addressFamily, ih.String())
@@ -416,7 +481,7 @@ func (ps *peerStore) DeleteSeeder(ih bittorrent.InfoHash, p bittorrent.Peer) err
 	return nil
 }
 
-func (ps *peerStore) PutLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+func (ps *peerStore) PutLeecher(ctx context.Context, ih bittorrent.InfoHash, p bittorrent.Peer) error {
 	addressFamily := p.IP.AddressFamily.String()
 	log.Debug("storage: PutLeecher", log.Fields{
 		"InfoHash": ih.String(),
@@ -434,7 +499,7 @@ func (ps *peerStore) PutLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error
 	pk := newPeerKey(p)
 	ct := ps.getClock()
 
-	conn := ps.rb.open()
+	conn := ps.rb.openContext(ctx)
 	defer conn.Close()
 
 	conn.Send("MULTI")
@@ -454,7 +519,7 @@ func (ps *peerStore) PutLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error
 	return nil
 }
 
-func (ps *peerStore) DeleteLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+func (ps *peerStore) DeleteLeecher(ctx context.Context, ih bittorrent.InfoHash, p bittorrent.Peer) error {
 	addressFamily := p.IP.AddressFamily.String()
 	log.Debug("storage: DeleteLeecher", log.Fields{
 		"InfoHash": ih.String(),
@@ -467,7 +532,7 @@ func (ps *peerStore) DeleteLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) er
 	default:
 	}
 
-	conn := ps.rb.open()
+	conn := ps.rb.openContext(ctx)
 	defer conn.Close()
 
 	pk := newPeerKey(p)
@@ -487,7 +552,7 @@ func (ps *peerStore) DeleteLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) er
 	return nil
 }
 
-func (ps *peerStore) GraduateLeecher(ih bittorrent.InfoHash, p bittorrent.Peer) error {
+func (ps *peerStore) GraduateLeecher(ctx context.Context, ih bittorrent.InfoHash, p bittorrent.Peer) error {
 	addressFamily := p.IP.AddressFamily.String()
 	log.Debug("storage: GraduateLeecher", log.Fields{
 		"InfoHash": ih.String(),
@@ -506,7 +571,7 @@ func (ps *peerStore) GraduateLeecher(ih bittorrent.InfoHash, p bittorrent.Peer)
 	pk := newPeerKey(p)
 	ct := ps.getClock()
 
-	conn := ps.rb.open()
+	conn := ps.rb.openContext(ctx)
 	defer conn.Close()
 
 	conn.Send("MULTI")
@@ -528,6 +593,13 @@ func (ps *peerStore) GraduateLeecher(ih bittorrent.InfoHash, p bittorrent.Peer)
 		if err != nil {
 			return err
 		}
+
+		// Only peers becoming seeders are counted as snatches, so that
+		// repeated completed events of a peer are counted once.
+		_, err = conn.Do("INCR", ps.snatchesKey(addressFamily, encodedInfoHash))
+		if err != nil {
+			return err
+		}
 	}
 	if reply[2] == 1 {
 		_, err = conn.Do("INCR", ps.infohashCountKey(addressFamily))
@@ -539,7 +611,7 @@ func (ps *peerStore) GraduateLeecher(ih bittorrent.InfoHash, p bittorrent.Peer)
 	return nil
 }
 
-func (ps *peerStore) AnnouncePeers(ih bittorrent.InfoHash, seeder bool, numWant int, announcer bittorrent.Peer) (peers []bittorrent.Peer, err error) {
+func (ps *peerStore) AnnouncePeers(ctx context.Context, ih bittorrent.InfoHash, seeder bool, numWant int, announcer bittorrent.Peer) (peers []bittorrent.Peer, err error) {
 	addressFamily := announcer.IP.AddressFamily.String()
 	log.Debug("storage: AnnouncePeers", log.Fields{
 		"InfoHash": ih.String(),
@@ -558,7 +630,7 @@ func (ps *peerStore) AnnouncePeers(ih bittorrent.InfoHash, seeder bool, numWant
 	encodedLeecherInfoHash := ps.leecherInfohashKey(addressFamily, encodedInfoHash)
 	encodedSeederInfoHash := ps.seederInfohashKey(addressFamily, encodedInfoHash)
 
-	conn := ps.rb.open()
+	conn := ps.openRead(ctx)
 	defer conn.Close()
 
 	leechers, err := conn.Do("HKEYS", encodedLeecherInfoHash)
@@ -579,47 +651,97 @@ func (ps *peerStore) AnnouncePeers(ih bittorrent.InfoHash, seeder bool, numWant
 
 	if seeder {
 		// Append leechers as possible.
-		for _, pk := range conLeechers {
-			if numWant == 0 {
-				break
-			}
-
-			peers = append(peers, decodePeerKey(serializedPeer(pk.([]byte))))
-			numWant--
-		}
+		peers = appendSample(peers, conLeechers, numWant, "")
 	} else {
 		// Append as many seeders as possible.
-		for _, pk := range conSeeders {
-			if numWant == 0 {
-				break
-			}
+		peers = appendSample(peers, conSeeders, numWant, "")
 
-			peers = append(peers, decodePeerKey(serializedPeer(pk.([]byte))))
-			numWant--
+		// Append leechers until we reach numWant.
+		if numWant > len(peers) {
+			peers = appendSample(peers, conLeechers, numWant-len(peers), newPeerKey(announcer))
 		}
+	}
 
-		// Append leechers until we reach numWant.
-		if numWant > 0 {
-			announcerPK := newPeerKey(announcer)
-			for _, pk := range conLeechers {
-				if pk == announcerPK {
-					continue
-				}
+	return
+}
 
-				if numWant == 0 {
-					break
-				}
+// appendSample appends up to numWant of the peer keys returned by HKEYS
+// other than skip to peers, chosen uniformly at random.
+//
+// HKEYS returns the keys in the same order every time, so that taking the
+// first keys would hand out the same peers over and over. keys is shuffled in
+// place.
+func appendSample(peers []bittorrent.Peer, keys []interface{}, numWant int, skip serializedPeer) []bittorrent.Peer {
+	for i := 0; i < len(keys) && numWant > 0; i++ {
+		j := i + rand.Intn(len(keys)-i)
+		keys[i], keys[j] = keys[j], keys[i]
+
+		pk := serializedPeer(keys[i].([]byte))
+		if pk == skip {
+			continue
+		}
+		peers = append(peers, decodePeerKey(pk))
+		numWant--
+	}
+	return peers
+}
 
-				peers = append(peers, decodePeerKey(serializedPeer(pk.([]byte))))
-				numWant--
-			}
+func (ps *peerStore) AnnounceSeeders(ctx context.Context, ih bittorrent.InfoHash, numWant int, announcer bittorrent.Peer) ([]bittorrent.Peer, error) {
+	return ps.announcePeersOf(ctx, ih, true, numWant, announcer)
+}
+
+func (ps *peerStore) AnnounceLeechers(ctx context.Context, ih bittorrent.InfoHash, numWant int, announcer bittorrent.Peer) ([]bittorrent.Peer, error) {
+	return ps.announcePeersOf(ctx, ih, false, numWant, announcer)
+}
+
+// announcePeersOf returns up to numWant seeders or leechers of the swarm of
+// the announcer, excluding the announcer.
+func (ps *peerStore) announcePeersOf(ctx context.Context, ih bittorrent.InfoHash, seeders bool, numWant int, announcer bittorrent.Peer) (peers []bittorrent.Peer, err error) {
+	addressFamily := announcer.IP.AddressFamily.String()
+	log.Debug("storage: announcePeersOf", log.Fields{
+		"InfoHash": ih.String(),
+		"seeders":  seeders,
+		"numWant":  numWant,
+		"Peer":     announcer,
+	})
+
+	select {
+	case <-ps.closed:
+		panic("attempted to interact with stopped redis store")
+	default:
+	}
+
+	encodedInfoHash := ih.String()
+	membersKey := ps.leecherInfohashKey(addressFamily, encodedInfoHash)
+	othersKey := ps.seederInfohashKey(addressFamily, encodedInfoHash)
+	if seeders {
+		membersKey, othersKey = othersKey, membersKey
+	}
+
+	conn := ps.openRead(ctx)
+	defer conn.Close()
+
+	members, err := redis.Values(conn.Do("HKEYS", membersKey))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(members) == 0 {
+		// The swarm exists as long as it has peers of the other kind.
+		others, err := redis.Int(conn.Do("HLEN", othersKey))
+		if err != nil {
+			return nil, err
 		}
+		if others == 0 {
+			return nil, storage.ErrResourceDoesNotExist
+		}
+		return nil, nil
 	}
 
-	return
+	return appendSample(nil, members, numWant, newPeerKey(announcer)), nil
 }
 
-func (ps *peerStore) ScrapeSwarm(ih bittorrent.InfoHash, af bittorrent.AddressFamily) (resp bittorrent.Scrape) {
+func (ps *peerStore) ScrapeSwarm(ctx context.Context, ih bittorrent.InfoHash, af bittorrent.AddressFamily) (resp bittorrent.Scrape) {
 	select {
 	case <-ps.closed:
 		panic("attempted to interact with stopped redis store")
@@ -632,7 +754,7 @@ func (ps *peerStore) ScrapeSwarm(ih bittorrent.InfoHash, af bittorrent.AddressFa
 	encodedLeecherInfoHash := ps.leecherInfohashKey(addressFamily, encodedInfoHash)
 	encodedSeederInfoHash := ps.seederInfohashKey(addressFamily, encodedInfoHash)
 
-	conn := ps.rb.open()
+	conn := ps.openRead(ctx)
 	defer conn.Close()
 
 	leechersLen, err := redis.Int64(conn.Do("HLEN", encodedLeecherInfoHash))
@@ -653,12 +775,65 @@ func (ps *peerStore) ScrapeSwarm(ih bittorrent.InfoHash, af bittorrent.AddressFa
 		return
 	}
 
-	resp.Incomplete = uint32(leechersLen)
-	resp.Complete = uint32(seedersLen)
+	snatches, err := redis.Int64(conn.Do("GET", ps.snatchesKey(addressFamily, encodedInfoHash)))
+	if err != nil && err != redis.ErrNil {
+		log.Error("storage: Redis GET failure", log.Fields{
+			"key":   ps.snatchesKey(addressFamily, encodedInfoHash),
+			"error": err,
+		})
+		return
+	}
+
+	resp.Incomplete = clampUint32("incomplete", leechersLen)
+	resp.Complete = clampUint32("complete", seedersLen)
+	resp.Snatches = clampUint32("snatches", snatches)
 
 	return
 }
 
+// ListSwarms implements storage.SwarmLister.
+//
+// The swarms are read from the address family hashes, whose fields are the
+// keys of the seeder and leecher hashes of every swarm.
+func (ps *peerStore) ListSwarms(ctx context.Context) ([]bittorrent.InfoHash, error) {
+	select {
+	case <-ps.closed:
+		panic("attempted to interact with stopped redis store")
+	default:
+	}
+
+	conn := ps.openRead(ctx)
+	defer conn.Close()
+
+	seen := make(map[bittorrent.InfoHash]struct{})
+	var infoHashes []bittorrent.InfoHash
+	for _, group := range ps.groups() {
+		keys, err := redis.Strings(conn.Do("HKEYS", group))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range keys {
+			// Keys are of the form <address family>_{S,L}_<hex infohash>.
+			if len(key) <= len(group)+3 {
+				continue
+			}
+			b, err := hex.DecodeString(key[len(group)+3:])
+			if err != nil || len(b) != 20 {
+				continue
+			}
+			ih := bittorrent.InfoHashFromBytes(b)
+			if _, ok := seen[ih]; ok {
+				continue
+			}
+			seen[ih] = struct{}{}
+			infoHashes = append(infoHashes, ih)
+		}
+	}
+
+	return infoHashes, nil
+}
+
 // collectGarbage deletes all Peers from the PeerStore which are older than the
 // cutoff time.
 //
@@ -765,6 +940,7 @@ func (ps *peerStore) collectGarbage(cutoff time.Time) error {
 				if _, err := conn.Do("DECRBY", decrCounter, removedPeerCount); err != nil {
 					return err
 				}
+				storage.PromGCReapedPeersTotal.Add(float64(removedPeerCount))
 			}
 
 			// use WATCH to avoid race condition
@@ -795,6 +971,19 @@ func (ps *peerStore) collectGarbage(cutoff time.Time) error {
 						"error":    err,
 					})
 				}
+
+				// The snatches are forgotten with the swarm, once it
+				// has neither seeders nor leechers.
+				encodedInfoHash := ihStr[len(group)+3:]
+				n, err := redis.Int64(conn.Do("EXISTS", ps.seederInfohashKey(group, encodedInfoHash), ps.leecherInfohashKey(group, encodedInfoHash)))
+				if err != nil {
+					return err
+				}
+				if n == 0 {
+					if _, err = conn.Do("DEL", ps.snatchesKey(group, encodedInfoHash)); err != nil {
+						return err
+					}
+				}
 			} else {
 				if _, err = conn.Do("UNWATCH"); err != nil && err != redis.ErrNil {
 					log.Error("storage: Redis UNWATCH failure", log.Fields{"error": err})
@@ -825,3 +1014,18 @@ func (ps *peerStore) Stop() stop.Result {
 func (ps *peerStore) LogFields() log.Fields {
 	return ps.cfg.LogFields()
 }
+
+// clampUint32 converts a count of the given field to the uint32 used in
+// responses, clamping it to the range of a uint32. Clamped counts are
+// recorded.
+func clampUint32(field string, n int64) uint32 {
+	switch {
+	case n < 0:
+		recordClampedValue(field)
+		return 0
+	case n > math.MaxUint32:
+		recordClampedValue(field)
+		return math.MaxUint32
+	}
+	return uint32(n)
+}
@@ -1,12 +1,17 @@
 package redis
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"testing"
 	"time"
 
 	"github.com/alicebob/miniredis"
+	"github.com/stretchr/testify/require"
 
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/clock"
 	s "github.com/chihaya/chihaya/storage"
 )
 
@@ -32,6 +37,8 @@ func createNew() s.PeerStore {
 
 func TestPeerStore(t *testing.T) { s.TestPeerStore(t, createNew()) }
 
+func TestPeerSelection(t *testing.T) { s.TestPeerSelection(t, createNew()) }
+
 func BenchmarkNop(b *testing.B)                        { s.Nop(b, createNew()) }
 func BenchmarkPut(b *testing.B)                        { s.Put(b, createNew()) }
 func BenchmarkPut1k(b *testing.B)                      { s.Put1k(b, createNew()) }
@@ -59,3 +66,71 @@ func BenchmarkAnnounceSeeder(b *testing.B)             { s.AnnounceSeeder(b, cre
 func BenchmarkAnnounceSeeder1kInfohash(b *testing.B)   { s.AnnounceSeeder1kInfohash(b, createNew()) }
 func BenchmarkScrapeSwarm(b *testing.B)                { s.ScrapeSwarm(b, createNew()) }
 func BenchmarkScrapeSwarm1kInfohash(b *testing.B)      { s.ScrapeSwarm1kInfohash(b, createNew()) }
+
+func TestContextCanceled(t *testing.T) {
+	ps := createNew()
+	defer func() { <-ps.Stop() }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	p := bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("00000000000000000001"),
+		Port: 1,
+		IP:   bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4},
+	}
+	require.Equal(t, context.Canceled, ps.PutSeeder(ctx, ih, p))
+
+	require.Nil(t, ps.PutSeeder(context.Background(), ih, p))
+	_, err := ps.AnnouncePeers(ctx, ih, false, 10, p)
+	require.Equal(t, context.Canceled, err)
+}
+
+func TestReadReplicas(t *testing.T) {
+	primary, err := miniredis.Run()
+	require.Nil(t, err)
+	defer primary.Close()
+	replica, err := miniredis.Run()
+	require.Nil(t, err)
+	defer replica.Close()
+
+	mock := clock.NewMock(time.Unix(1000, 0))
+	ps, err := New(Config{
+		GarbageCollectionInterval:   10 * time.Minute,
+		PrometheusReportingInterval: 10 * time.Minute,
+		PeerLifetime:                30 * time.Minute,
+		RedisBroker:                 fmt.Sprintf("redis://@%s/0", primary.Addr()),
+		RedisReadReplicas:           []string{fmt.Sprintf("redis://@%s/0", replica.Addr())},
+		MaxReplicaLag:               4 * time.Second,
+		Clock:                       mock,
+	})
+	require.Nil(t, err)
+	defer func() { <-ps.Stop() }()
+
+	ctx := context.Background()
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	p := bittorrent.Peer{
+		ID:   bittorrent.PeerIDFromString("00000000000000000001"),
+		Port: 1,
+		IP:   bittorrent.IP{IP: net.ParseIP("1.1.1.1").To4(), AddressFamily: bittorrent.IPv4},
+	}
+	require.Nil(t, ps.PutSeeder(ctx, ih, p))
+
+	// The replica has not seen a heartbeat, so the primary is read from.
+	require.Equal(t, uint32(1), ps.ScrapeSwarm(ctx, ih, bittorrent.IPv4).Complete)
+
+	// The replica has seen the heartbeat but not the seeder.
+	heartbeat, err := primary.Get(heartbeatKey)
+	require.Nil(t, err)
+	require.Nil(t, replica.Set(heartbeatKey, heartbeat))
+	ps.(*peerStore).checkReplicas()
+	require.Equal(t, uint32(0), ps.ScrapeSwarm(ctx, ih, bittorrent.IPv4).Complete)
+	_, err = ps.AnnouncePeers(ctx, ih, false, 10, p)
+	require.Equal(t, s.ErrResourceDoesNotExist, err)
+
+	// The replica falls behind too far.
+	mock.Add(4 * time.Second)
+	ps.(*peerStore).checkReplicas()
+	require.Equal(t, uint32(1), ps.ScrapeSwarm(ctx, ih, bittorrent.IPv4).Complete)
+}
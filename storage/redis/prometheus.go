@@ -0,0 +1,21 @@
+package redis
+
+import "github.com/prometheus/client_golang/prometheus"
+
+func init() {
+	prometheus.MustRegister(promClampedValuesTotal)
+}
+
+var promClampedValuesTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "chihaya_storage_redis_clamped_values_total",
+		Help: "The number of counts read from redis that were clamped to fit into the fields of a scrape",
+	},
+	[]string{"field"},
+)
+
+// recordClampedValue records a count of the given field of a scrape that was
+// clamped to fit into the field.
+func recordClampedValue(field string) {
+	promClampedValuesTotal.WithLabelValues(field).Inc()
+}
@@ -1,6 +1,7 @@
 package redis
 
 import (
+	"context"
 	"errors"
 	"net/url"
 	"strconv"
@@ -13,8 +14,9 @@ import (
 
 // redisBackend represents a redis handler.
 type redisBackend struct {
-	pool    *redis.Pool
-	redsync *redsync.Redsync
+	pool        *redis.Pool
+	redsync     *redsync.Redsync
+	readTimeout time.Duration
 }
 
 // newRedisBackend creates a redisBackend instance.
@@ -29,8 +31,9 @@ func newRedisBackend(cfg *Config, u *redisURL, socketPath string) *redisBackend
 	pool := rc.NewPool()
 	redsync := redsync.New([]redsync.Pool{pool})
 	return &redisBackend{
-		pool:    pool,
-		redsync: redsync,
+		pool:        pool,
+		redsync:     redsync,
+		readTimeout: cfg.RedisReadTimeout,
 	}
 }
 
@@ -39,6 +42,42 @@ func (rb *redisBackend) open() redis.Conn {
 	return rb.pool.Get()
 }
 
+// openContext returns or creates instance of Redis connection for handling a
+// request with the given context.
+//
+// If no connection can be obtained before the context is done, the returned
+// connection fails every command.
+func (rb *redisBackend) openContext(ctx context.Context) redis.Conn {
+	conn, _ := rb.pool.GetContext(ctx)
+	return contextConn{Conn: conn, ctx: ctx, readTimeout: rb.readTimeout}
+}
+
+// contextConn is a redis.Conn that fails commands issued after its context is
+// done and limits the time waited for replies to the deadline of its context.
+type contextConn struct {
+	redis.Conn
+	ctx         context.Context
+	readTimeout time.Duration
+}
+
+// Do implements redis.Conn.
+func (c contextConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	if err := c.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	deadline, ok := c.ctx.Deadline()
+	if !ok {
+		return c.Conn.Do(commandName, args...)
+	}
+
+	timeout := time.Until(deadline)
+	if c.readTimeout > 0 && c.readTimeout < timeout {
+		timeout = c.readTimeout
+	}
+	return redis.DoWithTimeout(c.Conn, timeout, commandName, args...)
+}
+
 type redisConnector struct {
 	URL            *redisURL
 	SocketPath     string
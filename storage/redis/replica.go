@@ -0,0 +1,104 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// heartbeatKey is the key of the time, in nanoseconds since the epoch, that
+// is written to the primary regularly and read from read replicas to measure
+// how far behind they are.
+const heartbeatKey = "chihaya_heartbeat"
+
+// errNoHeartbeat is returned for read replicas that haven't seen a heartbeat.
+var errNoHeartbeat = errors.New("replica has not seen a heartbeat")
+
+// replica is a read replica of the redis primary.
+type replica struct {
+	addr string
+	rb   *redisBackend
+
+	// usable is 1 while the replica is known to lag behind the primary by
+	// less than the configured maximum.
+	usable int32
+}
+
+// replicaCheckInterval returns the interval at which the heartbeat is
+// written and the lag of read replicas is checked.
+//
+// A replica is read from until the next check, so it is considered usable
+// only if it lags behind by at most half the tolerated staleness.
+func (ps *peerStore) replicaCheckInterval() time.Duration {
+	return ps.cfg.MaxReplicaLag / 4
+}
+
+// checkReplicas writes a heartbeat to the primary and marks the read
+// replicas that have seen a recent enough heartbeat as usable.
+func (ps *peerStore) checkReplicas() {
+	now := ps.cfg.Clock.Now()
+
+	conn := ps.rb.open()
+	_, err := conn.Do("SET", heartbeatKey, now.UnixNano())
+	conn.Close()
+	if err != nil {
+		log.Error("storage: failed to write heartbeat", log.Fields{"error": err})
+	}
+
+	for _, r := range ps.replicas {
+		lag, err := r.lag(now)
+		usable := err == nil && lag <= ps.cfg.MaxReplicaLag-ps.replicaCheckInterval()
+
+		var v int32
+		if usable {
+			v = 1
+		}
+		if atomic.SwapInt32(&r.usable, v) == v {
+			continue
+		}
+
+		if usable {
+			log.Info("storage: reading from replica", log.Fields{"addr": r.addr, "lag": lag})
+		} else {
+			log.Warn("storage: not reading from replica", log.Fields{"addr": r.addr, "lag": lag, "error": err})
+		}
+	}
+}
+
+// lag returns the age of the heartbeat seen by the replica.
+func (r *replica) lag(now time.Time) (time.Duration, error) {
+	conn := r.rb.open()
+	defer conn.Close()
+
+	heartbeat, err := redis.Int64(conn.Do("GET", heartbeatKey))
+	if err == redis.ErrNil {
+		return 0, errNoHeartbeat
+	}
+	if err != nil {
+		return 0, err
+	}
+	return now.Sub(time.Unix(0, heartbeat)), nil
+}
+
+// openRead returns a connection for reading peers, which is a connection to
+// a usable read replica if there is any and to the primary otherwise.
+//
+// Replicas are used in turns to spread the load.
+func (ps *peerStore) openRead(ctx context.Context) redis.Conn {
+	n := len(ps.replicas)
+	if n > 0 {
+		start := int(atomic.AddUint32(&ps.nextReplica, 1))
+		for i := 0; i < n; i++ {
+			r := ps.replicas[(start+i)%n]
+			if atomic.LoadInt32(&r.usable) == 1 {
+				return r.rb.openContext(ctx)
+			}
+		}
+	}
+	return ps.rb.openContext(ctx)
+}
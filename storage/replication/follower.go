@@ -0,0 +1,187 @@
+package replication
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+	"github.com/chihaya/chihaya/storage"
+)
+
+// dialTimeout is the time a follower waits for the connection to the
+// primary to be established.
+const dialTimeout = 10 * time.Second
+
+// Follower applies the changes streamed by a primary to a PeerStore.
+type Follower struct {
+	ps  storage.PeerStore
+	cfg Config
+
+	// tlsCfg is used to connect to the primary, if it serves TLS.
+	tlsCfg *tls.Config
+
+	// conn is the current connection to the primary, which is closed to
+	// interrupt reading when stopping.
+	mu   sync.Mutex
+	conn net.Conn
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewFollower starts following the primary of the given config, applying
+// its changes to ps.
+func NewFollower(ps storage.PeerStore, provided Config) (*Follower, error) {
+	if err := checkConfig(provided); err != nil {
+		return nil, err
+	}
+	cfg := provided.Validate()
+
+	f := &Follower{
+		ps:      ps,
+		cfg:     cfg,
+		closing: make(chan struct{}),
+	}
+
+	if cfg.TLSCAPath != "" {
+		pem, err := ioutil.ReadFile(cfg.TLSCAPath)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, errors.New("replication: no certificates found in " + cfg.TLSCAPath)
+		}
+		host, _, err := net.SplitHostPort(cfg.Addr)
+		if err != nil {
+			return nil, err
+		}
+		f.tlsCfg = &tls.Config{RootCAs: roots, ServerName: host}
+	}
+
+	f.wg.Add(1)
+	go f.run()
+
+	return f, nil
+}
+
+// run follows the primary, reconnecting whenever the connection fails.
+func (f *Follower) run() {
+	defer f.wg.Done()
+
+	for {
+		err := f.follow()
+		select {
+		case <-f.closing:
+			return
+		default:
+		}
+		log.Warn("replication: lost connection to primary", log.Fields{"addr": f.cfg.Addr, "error": err})
+
+		select {
+		case <-f.closing:
+			return
+		case <-time.After(f.cfg.ReconnectInterval):
+		}
+	}
+}
+
+// follow connects to the primary and applies its events until the
+// connection fails.
+func (f *Follower) follow() error {
+	var conn net.Conn
+	var err error
+	if f.tlsCfg != nil {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: dialTimeout}, "tcp", f.cfg.Addr, f.tlsCfg)
+	} else {
+		conn, err = net.DialTimeout("tcp", f.cfg.Addr, dialTimeout)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	f.mu.Lock()
+	select {
+	case <-f.closing:
+		f.mu.Unlock()
+		return nil
+	default:
+	}
+	f.conn = conn
+	f.mu.Unlock()
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := writeHandshake(conn, f.cfg.Secret); err != nil {
+		return err
+	}
+	var ok [1]byte
+	if _, err := io.ReadFull(conn, ok[:]); err != nil || ok[0] != handshakeOK {
+		return errHandshake
+	}
+	log.Info("replication: following primary", log.Fields{"addr": f.cfg.Addr})
+
+	r := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
+		e, err := readEvent(r)
+		if err != nil {
+			return err
+		}
+		if e.op == opPing {
+			continue
+		}
+
+		if err := f.apply(e); err != nil && err != storage.ErrResourceDoesNotExist {
+			log.Warn("replication: failed to apply event", log.Fields{"infoHash": e.infoHash, "peer": e.peer, "error": err})
+		}
+		promEventsTotal.WithLabelValues("applied").Inc()
+	}
+}
+
+// apply makes the change of e to the PeerStore.
+func (f *Follower) apply(e event) error {
+	ctx := context.Background()
+	switch e.op {
+	case opPutSeeder:
+		return f.ps.PutSeeder(ctx, e.infoHash, e.peer)
+	case opDeleteSeeder:
+		return f.ps.DeleteSeeder(ctx, e.infoHash, e.peer)
+	case opPutLeecher:
+		return f.ps.PutLeecher(ctx, e.infoHash, e.peer)
+	case opDeleteLeecher:
+		return f.ps.DeleteLeecher(ctx, e.infoHash, e.peer)
+	case opGraduateLeecher:
+		return f.ps.GraduateLeecher(ctx, e.infoHash, e.peer)
+	}
+	return errInvalidEvent
+}
+
+// Stop stops following the primary.
+//
+// The PeerStore is not stopped, so that it can be kept when reloading, for
+// example to promote the follower.
+func (f *Follower) Stop() stop.Result {
+	c := make(stop.Channel)
+	go func() {
+		f.mu.Lock()
+		close(f.closing)
+		if f.conn != nil {
+			f.conn.Close()
+		}
+		f.mu.Unlock()
+
+		f.wg.Wait()
+		c.Done()
+	}()
+	return c.Result()
+}
@@ -0,0 +1,306 @@
+package replication
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/internal/handoff"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+	"github.com/chihaya/chihaya/storage"
+)
+
+// handshakeTimeout is the time a connecting follower has to complete the
+// handshake.
+const handshakeTimeout = 10 * time.Second
+
+// Primary is a storage.PeerStore that streams the changes made to the
+// wrapped PeerStore to all connected followers.
+//
+// Changes are queued for every follower, so that slow followers never delay
+// announces.
+type Primary struct {
+	storage.PeerStore
+	cfg Config
+
+	listener net.Listener
+
+	mu        sync.Mutex
+	followers map[*followerConn]struct{}
+
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// followerConn is the connection to a follower.
+type followerConn struct {
+	conn  net.Conn
+	queue chan event
+
+	// lagging is closed if the queue overflowed.
+	lagging chan struct{}
+	once    sync.Once
+}
+
+var _ storage.PeerStore = &Primary{}
+
+// NewPrimary starts listening for followers and returns a PeerStore that
+// streams the changes made to ps to them.
+func NewPrimary(ps storage.PeerStore, provided Config) (*Primary, error) {
+	if err := checkConfig(provided); err != nil {
+		return nil, err
+	}
+	cfg := provided.Validate()
+
+	var tlsCfg *tls.Config
+	if cfg.TLSCertPath != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertPath, cfg.TLSKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	// On upgrades, the socket is taken over from the previous process.
+	l, err := handoff.Listen("tcp", cfg.Addr, func() (net.Listener, error) {
+		return net.Listen("tcp", cfg.Addr)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if tlsCfg != nil {
+		l = tls.NewListener(l, tlsCfg)
+	}
+
+	p := &Primary{
+		PeerStore: ps,
+		cfg:       cfg,
+		listener:  l,
+		followers: make(map[*followerConn]struct{}),
+		closing:   make(chan struct{}),
+	}
+
+	p.wg.Add(1)
+	go p.accept()
+
+	return p, nil
+}
+
+// Addr returns the address the Primary listens on for followers.
+func (p *Primary) Addr() net.Addr {
+	return p.listener.Addr()
+}
+
+func (p *Primary) accept() {
+	defer p.wg.Done()
+
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			select {
+			case <-p.closing:
+				return
+			default:
+			}
+			log.Warn("replication: failed to accept follower", log.Err(err))
+			continue
+		}
+
+		p.wg.Add(1)
+		go p.serve(conn)
+	}
+}
+
+// serve streams events to a follower until the connection fails, the
+// follower falls behind or the Primary is stopped.
+func (p *Primary) serve(conn net.Conn) {
+	defer p.wg.Done()
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := readHandshake(conn, p.cfg.Secret); err != nil {
+		log.Warn("replication: rejected follower", log.Fields{"addr": conn.RemoteAddr(), "error": err})
+		return
+	}
+	if _, err := conn.Write([]byte{handshakeOK}); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	f := &followerConn{
+		conn:    conn,
+		queue:   make(chan event, p.cfg.QueueSize),
+		lagging: make(chan struct{}),
+	}
+	p.mu.Lock()
+	p.followers[f] = struct{}{}
+	p.mu.Unlock()
+	promFollowers.Inc()
+	log.Info("replication: follower connected", log.Fields{"addr": conn.RemoteAddr()})
+
+	defer func() {
+		p.mu.Lock()
+		delete(p.followers, f)
+		p.mu.Unlock()
+		promFollowers.Dec()
+	}()
+
+	ping := time.NewTicker(pingInterval)
+	defer ping.Stop()
+
+	w := bufio.NewWriter(conn)
+	var b []byte
+	for {
+		var e event
+		select {
+		case <-p.closing:
+			return
+		case <-f.lagging:
+			log.Warn("replication: disconnecting follower that fell behind", log.Fields{"addr": conn.RemoteAddr()})
+			promLaggingFollowersTotal.Inc()
+			return
+		case <-ping.C:
+			e = event{op: opPing}
+		case e = <-f.queue:
+		}
+
+		b = appendEvent(b[:0], e)
+		w.Write(b)
+
+		// Write events in batches, but don't hold them back if the queue
+		// is drained.
+		if len(f.queue) == 0 {
+			conn.SetWriteDeadline(time.Now().Add(readTimeout))
+			if err := w.Flush(); err != nil {
+				log.Warn("replication: follower disconnected", log.Fields{"addr": conn.RemoteAddr(), "error": err})
+				return
+			}
+		}
+		if e.op != opPing {
+			promEventsTotal.WithLabelValues("sent").Inc()
+		}
+	}
+}
+
+// publish queues e for all followers.
+func (p *Primary) publish(op byte, ih bittorrent.InfoHash, peer bittorrent.Peer) {
+	e := event{op: op, infoHash: ih, peer: peer}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for f := range p.followers {
+		select {
+		case f.queue <- e:
+		default:
+			f.once.Do(func() { close(f.lagging) })
+		}
+	}
+}
+
+// PutSeeder adds a Seeder to the wrapped PeerStore and publishes the change.
+func (p *Primary) PutSeeder(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	err := p.PeerStore.PutSeeder(ctx, ih, peer)
+	if err == nil {
+		p.publish(opPutSeeder, ih, peer)
+	}
+	return err
+}
+
+// DeleteSeeder removes a Seeder from the wrapped PeerStore and publishes the
+// change.
+func (p *Primary) DeleteSeeder(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	err := p.PeerStore.DeleteSeeder(ctx, ih, peer)
+	if err == nil {
+		p.publish(opDeleteSeeder, ih, peer)
+	}
+	return err
+}
+
+// PutLeecher adds a Leecher to the wrapped PeerStore and publishes the
+// change.
+func (p *Primary) PutLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	err := p.PeerStore.PutLeecher(ctx, ih, peer)
+	if err == nil {
+		p.publish(opPutLeecher, ih, peer)
+	}
+	return err
+}
+
+// DeleteLeecher removes a Leecher from the wrapped PeerStore and publishes
+// the change.
+func (p *Primary) DeleteLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	err := p.PeerStore.DeleteLeecher(ctx, ih, peer)
+	if err == nil {
+		p.publish(opDeleteLeecher, ih, peer)
+	}
+	return err
+}
+
+// GraduateLeecher promotes a Leecher to a Seeder in the wrapped PeerStore
+// and publishes the change.
+func (p *Primary) GraduateLeecher(ctx context.Context, ih bittorrent.InfoHash, peer bittorrent.Peer) error {
+	err := p.PeerStore.GraduateLeecher(ctx, ih, peer)
+	if err == nil {
+		p.publish(opGraduateLeecher, ih, peer)
+	}
+	return err
+}
+
+// PutMultiHomedSeeder adds a multi-homed Seeder to the wrapped PeerStore and
+// publishes the change. Followers store its endpoints as independent Peers.
+func (p *Primary) PutMultiHomedSeeder(ctx context.Context, ih bittorrent.InfoHash, peer, alternate bittorrent.Peer) error {
+	err := storage.PutMultiHomedSeeder(ctx, p.PeerStore, ih, peer, alternate)
+	if err == nil {
+		p.publish(opPutSeeder, ih, peer)
+		p.publish(opPutSeeder, ih, alternate)
+	}
+	return err
+}
+
+// PutMultiHomedLeecher adds a multi-homed Leecher to the wrapped PeerStore
+// and publishes the change.
+func (p *Primary) PutMultiHomedLeecher(ctx context.Context, ih bittorrent.InfoHash, peer, alternate bittorrent.Peer) error {
+	err := storage.PutMultiHomedLeecher(ctx, p.PeerStore, ih, peer, alternate)
+	if err == nil {
+		p.publish(opPutLeecher, ih, peer)
+		p.publish(opPutLeecher, ih, alternate)
+	}
+	return err
+}
+
+// GraduateMultiHomedLeecher promotes a multi-homed Leecher to a Seeder in
+// the wrapped PeerStore and publishes the change.
+func (p *Primary) GraduateMultiHomedLeecher(ctx context.Context, ih bittorrent.InfoHash, peer, alternate bittorrent.Peer) error {
+	err := storage.GraduateMultiHomedLeecher(ctx, p.PeerStore, ih, peer, alternate)
+	if err == nil {
+		p.publish(opGraduateLeecher, ih, peer)
+		p.publish(opGraduateLeecher, ih, alternate)
+	}
+	return err
+}
+
+// SwarmActivity implements storage.ActivityReporter.
+func (p *Primary) SwarmActivity(ctx context.Context, ih bittorrent.InfoHash, af bittorrent.AddressFamily) (storage.SwarmActivity, bool) {
+	return storage.Activity(ctx, p.PeerStore, ih, af)
+}
+
+// Stop stops listening for followers and disconnects them.
+//
+// The wrapped PeerStore is not stopped, so that it can be kept when
+// reloading.
+func (p *Primary) Stop() stop.Result {
+	c := make(stop.Channel)
+	go func() {
+		close(p.closing)
+		p.listener.Close()
+		p.wg.Wait()
+		c.Done()
+	}()
+	return c.Result()
+}
@@ -0,0 +1,31 @@
+package replication
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	prometheus.MustRegister(
+		promFollowers,
+		promEventsTotal,
+		promLaggingFollowersTotal,
+	)
+}
+
+var promFollowers = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "chihaya_replication_followers",
+	Help: "The number of followers connected to this primary",
+})
+
+var promEventsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "chihaya_replication_events_total",
+		Help: "The number of changes sent to followers by a primary or applied by a follower",
+	},
+	[]string{"action"},
+)
+
+var promLaggingFollowersTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "chihaya_replication_lagging_followers_total",
+	Help: "The number of followers disconnected because they fell behind",
+})
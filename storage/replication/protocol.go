@@ -0,0 +1,142 @@
+package replication
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/chihaya/chihaya/bittorrent"
+)
+
+// The replication protocol is a stream of events sent by the primary over
+// TCP.
+//
+// A follower starts by sending protocolMagic and the secret, prefixed with
+// its length as a big-endian uint16. The primary answers with handshakeOK
+// and starts streaming events if the secret matches, and closes the
+// connection otherwise.
+//
+// Every event consists of the operation byte, the 20 byte infohash and the
+// peer as its length byte followed by the peer ID, the big-endian port and
+// the IP address. Ping events consist of the operation byte only and are
+// sent every pingInterval, so that followers detect a vanished primary.
+const (
+	protocolMagic = "chihaya\x01"
+	handshakeOK   = 1
+
+	pingInterval = 10 * time.Second
+	readTimeout  = 3 * pingInterval
+)
+
+// Operations streamed to followers.
+const (
+	opPing byte = iota
+	opPutSeeder
+	opDeleteSeeder
+	opPutLeecher
+	opDeleteLeecher
+	opGraduateLeecher
+)
+
+var (
+	errHandshake    = errors.New("replication handshake failed")
+	errInvalidEvent = errors.New("invalid replication event")
+)
+
+// event is a change made to the PeerStore of the primary.
+type event struct {
+	op       byte
+	infoHash bittorrent.InfoHash
+	peer     bittorrent.Peer
+}
+
+// appendEvent appends the encoding of e to b.
+func appendEvent(b []byte, e event) []byte {
+	b = append(b, e.op)
+	if e.op == opPing {
+		return b
+	}
+
+	ip := e.peer.IP.IP
+	if ip4 := ip.To4(); ip4 != nil && e.peer.IP.AddressFamily == bittorrent.IPv4 {
+		ip = ip4
+	}
+
+	b = append(b, e.infoHash[:]...)
+	b = append(b, byte(20+2+len(ip)))
+	b = append(b, e.peer.ID[:]...)
+	b = append(b, byte(e.peer.Port>>8), byte(e.peer.Port))
+	return append(b, ip...)
+}
+
+// readEvent reads the next event from r.
+func readEvent(r *bufio.Reader) (e event, err error) {
+	if e.op, err = r.ReadByte(); err != nil {
+		return e, err
+	}
+	switch e.op {
+	case opPing:
+		return e, nil
+	case opPutSeeder, opDeleteSeeder, opPutLeecher, opDeleteLeecher, opGraduateLeecher:
+	default:
+		return e, errInvalidEvent
+	}
+
+	var buf [20 + 1 + 20 + 2 + net.IPv6len]byte
+	if _, err = io.ReadFull(r, buf[:21]); err != nil {
+		return e, err
+	}
+	e.infoHash = bittorrent.InfoHashFromBytes(buf[:20])
+
+	n := int(buf[20])
+	if n != 20+2+net.IPv4len && n != 20+2+net.IPv6len {
+		return e, errInvalidEvent
+	}
+	peer := buf[21 : 21+n]
+	if _, err = io.ReadFull(r, peer); err != nil {
+		return e, err
+	}
+
+	e.peer.ID = bittorrent.PeerIDFromBytes(peer[:20])
+	e.peer.Port = binary.BigEndian.Uint16(peer[20:22])
+	e.peer.IP.IP = append(net.IP(nil), peer[22:]...)
+	e.peer.IP.AddressFamily = bittorrent.IPv4
+	if len(e.peer.IP.IP) == net.IPv6len {
+		e.peer.IP.AddressFamily = bittorrent.IPv6
+	}
+	return e, nil
+}
+
+// writeHandshake sends the handshake of a follower.
+func writeHandshake(w io.Writer, secret string) error {
+	b := make([]byte, 0, len(protocolMagic)+2+len(secret))
+	b = append(b, protocolMagic...)
+	b = append(b, byte(len(secret)>>8), byte(len(secret)))
+	b = append(b, secret...)
+	_, err := w.Write(b)
+	return err
+}
+
+// readHandshake reads the handshake of a follower and checks its secret.
+func readHandshake(r io.Reader, secret string) error {
+	header := make([]byte, len(protocolMagic)+2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	if string(header[:len(protocolMagic)]) != protocolMagic {
+		return errHandshake
+	}
+
+	provided := make([]byte, binary.BigEndian.Uint16(header[len(protocolMagic):]))
+	if _, err := io.ReadFull(r, provided); err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(provided, []byte(secret)) != 1 {
+		return errHandshake
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+// Package replication implements streaming the changes made to a PeerStore
+// by announces from a primary node to follower nodes, so that a follower
+// keeps warm swarm state and can take over from the primary without starting
+// with empty swarms.
+//
+// Followers only receive changes made while they are connected. Because
+// peers announce at least once per announce interval, a follower has the
+// complete state of the primary once it has been connected for an announce
+// interval. Both nodes collect garbage on their own.
+//
+// A follower is promoted by changing its role to primary and reloading it,
+// which keeps its PeerStore.
+package replication
+
+import (
+	"errors"
+	"time"
+
+	"github.com/chihaya/chihaya/pkg/log"
+)
+
+// Roles of a node.
+const (
+	// RolePrimary streams the changes of its PeerStore to followers.
+	RolePrimary = "primary"
+
+	// RoleFollower applies the changes streamed by a primary to its
+	// PeerStore.
+	RoleFollower = "follower"
+)
+
+var (
+	// ErrInvalidRole is returned for a config with an unknown Role.
+	ErrInvalidRole = errors.New("replication role must be primary or follower")
+
+	// ErrNoAddr is returned for a config without an Addr.
+	ErrNoAddr = errors.New("replication addr must be set")
+
+	// ErrNoSecret is returned for a config without a Secret, which would
+	// stream all swarms to anyone reaching the primary.
+	ErrNoSecret = errors.New("replication secret must be set")
+
+	// ErrIncompleteTLS is returned for a primary with only one of
+	// TLSCertPath and TLSKeyPath.
+	ErrIncompleteTLS = errors.New("replication tls_cert_path and tls_key_path must be set together")
+)
+
+// Config holds the configuration of replication.
+type Config struct {
+	// Role is the role of this node, RolePrimary or RoleFollower.
+	Role string `yaml:"role"`
+
+	// Addr is the address a primary listens on for followers, or the
+	// address of the primary a follower connects to.
+	Addr string `yaml:"addr"`
+
+	// Secret authenticates followers to the primary and is required. It
+	// is sent in plain text unless TLS is used.
+	Secret string `yaml:"secret"`
+
+	// TLSCertPath and TLSKeyPath are the certificate and key a primary
+	// serves TLS with. TLSCAPath is the CA a follower verifies the
+	// certificate of the primary with, which makes it connect with TLS.
+	TLSCertPath string `yaml:"tls_cert_path"`
+	TLSKeyPath  string `yaml:"tls_key_path"`
+	TLSCAPath   string `yaml:"tls_ca_path"`
+
+	// QueueSize is the number of changes buffered for every follower.
+	// Followers falling further behind are disconnected and reconnect.
+	QueueSize int `yaml:"queue_size"`
+
+	// ReconnectInterval is the time a follower waits before reconnecting
+	// to the primary after the connection failed.
+	ReconnectInterval time.Duration `yaml:"reconnect_interval"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"role":              cfg.Role,
+		"addr":              cfg.Addr,
+		"secret":            cfg.Secret != "",
+		"tlsCertPath":       cfg.TLSCertPath,
+		"tlsKeyPath":        cfg.TLSKeyPath,
+		"tlsCAPath":         cfg.TLSCAPath,
+		"queueSize":         cfg.QueueSize,
+		"reconnectInterval": cfg.ReconnectInterval,
+	}
+}
+
+// Default config constants.
+const (
+	defaultQueueSize         = 65536
+	defaultReconnectInterval = 5 * time.Second
+)
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.QueueSize <= 0 {
+		validcfg.QueueSize = defaultQueueSize
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "replication.QueueSize",
+			"provided": cfg.QueueSize,
+			"default":  validcfg.QueueSize,
+		})
+	}
+
+	if cfg.ReconnectInterval <= 0 {
+		validcfg.ReconnectInterval = defaultReconnectInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "replication.ReconnectInterval",
+			"provided": cfg.ReconnectInterval,
+			"default":  validcfg.ReconnectInterval,
+		})
+	}
+
+	return validcfg
+}
+
+func checkConfig(cfg Config) error {
+	if cfg.Role != RolePrimary && cfg.Role != RoleFollower {
+		return ErrInvalidRole
+	}
+
+	if cfg.Addr == "" {
+		return ErrNoAddr
+	}
+
+	if cfg.Secret == "" {
+		return ErrNoSecret
+	}
+
+	if cfg.Role == RolePrimary && (cfg.TLSCertPath == "") != (cfg.TLSKeyPath == "") {
+		return ErrIncompleteTLS
+	}
+
+	return nil
+}
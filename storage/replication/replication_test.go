@@ -0,0 +1,223 @@
+package replication
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/storage"
+	"github.com/chihaya/chihaya/storage/memory"
+)
+
+func TestEventEncoding(t *testing.T) {
+	events := []event{
+		{op: opPing},
+		{
+			op:       opPutSeeder,
+			infoHash: bittorrent.InfoHashFromString("00000000000000000001"),
+			peer: bittorrent.Peer{
+				ID:   bittorrent.PeerIDFromString("00000000000000000002"),
+				IP:   bittorrent.IP{IP: net.ParseIP("10.0.0.1").To4(), AddressFamily: bittorrent.IPv4},
+				Port: 1234,
+			},
+		},
+		{
+			op:       opGraduateLeecher,
+			infoHash: bittorrent.InfoHashFromString("00000000000000000003"),
+			peer: bittorrent.Peer{
+				ID:   bittorrent.PeerIDFromString("00000000000000000004"),
+				IP:   bittorrent.IP{IP: net.ParseIP("2001:db8::1"), AddressFamily: bittorrent.IPv6},
+				Port: 5678,
+			},
+		},
+	}
+
+	var b []byte
+	for _, e := range events {
+		b = appendEvent(b, e)
+	}
+
+	r := bufio.NewReader(bytes.NewReader(b))
+	for _, expected := range events {
+		e, err := readEvent(r)
+		require.Nil(t, err)
+		require.Equal(t, expected, e)
+	}
+
+	_, err := readEvent(bufio.NewReader(bytes.NewReader([]byte{42})))
+	require.Equal(t, errInvalidEvent, err)
+}
+
+// waitFor polls cond until it is true or a second passed.
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func newStore(t *testing.T) storage.PeerStore {
+	ps, err := memory.New(memory.Config{ShardCount: 1, GarbageCollectionInterval: time.Hour, PeerLifetime: time.Hour})
+	require.Nil(t, err)
+	return ps
+}
+
+func TestReplication(t *testing.T) {
+	primaryStore, followerStore := newStore(t), newStore(t)
+	defer func() { primaryStore.Stop().Wait() }()
+	defer func() { followerStore.Stop().Wait() }()
+
+	primary, err := NewPrimary(primaryStore, Config{Role: RolePrimary, Addr: "127.0.0.1:0", Secret: "secret"})
+	require.Nil(t, err)
+	defer func() { primary.Stop().Wait() }()
+
+	cfg := Config{Role: RoleFollower, Addr: primary.Addr().String(), Secret: "secret"}
+	follower, err := NewFollower(followerStore, cfg)
+	require.Nil(t, err)
+	defer func() { follower.Stop().Wait() }()
+
+	// A follower with the wrong secret is rejected.
+	cfg.Secret = "wrong"
+	rejectedStore := newStore(t)
+	defer func() { rejectedStore.Stop().Wait() }()
+	rejected, err := NewFollower(rejectedStore, cfg)
+	require.Nil(t, err)
+	defer func() { rejected.Stop().Wait() }()
+
+	waitFor(t, func() bool {
+		primary.mu.Lock()
+		defer primary.mu.Unlock()
+		return len(primary.followers) == 1
+	})
+
+	ctx := context.Background()
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	peer := func(port uint16) bittorrent.Peer {
+		return bittorrent.Peer{
+			ID:   bittorrent.PeerID{byte(port)},
+			IP:   bittorrent.IP{IP: net.ParseIP("10.0.0.1").To4(), AddressFamily: bittorrent.IPv4},
+			Port: port,
+		}
+	}
+	require.Nil(t, primary.PutLeecher(ctx, ih, peer(1)))
+	require.Nil(t, primary.PutLeecher(ctx, ih, peer(2)))
+	require.Nil(t, primary.PutSeeder(ctx, ih, peer(3)))
+	require.Nil(t, primary.GraduateLeecher(ctx, ih, peer(1)))
+	require.Nil(t, primary.DeleteLeecher(ctx, ih, peer(2)))
+
+	expected := primaryStore.ScrapeSwarm(ctx, ih, bittorrent.IPv4)
+	require.Equal(t, bittorrent.Scrape{InfoHash: ih, Complete: 2, Snatches: 1}, expected)
+	waitFor(t, func() bool {
+		return followerStore.ScrapeSwarm(ctx, ih, bittorrent.IPv4) == expected
+	})
+
+	peers, err := followerStore.AnnounceSeeders(ctx, ih, 10, peer(4))
+	require.Nil(t, err)
+	require.ElementsMatch(t, []bittorrent.Peer{peer(1), peer(3)}, peers)
+}
+
+func TestCheckConfig(t *testing.T) {
+	var table = []struct {
+		cfg      Config
+		expected error
+	}{
+		{Config{Role: RolePrimary, Addr: ":6881", Secret: "secret"}, nil},
+		{Config{Role: RoleFollower, Addr: "10.0.0.1:6881", Secret: "secret", TLSCAPath: "ca.pem"}, nil},
+		{Config{Role: "leader", Addr: ":6881", Secret: "secret"}, ErrInvalidRole},
+		{Config{Role: RolePrimary, Secret: "secret"}, ErrNoAddr},
+		{Config{Role: RolePrimary, Addr: ":6881"}, ErrNoSecret},
+		{Config{Role: RoleFollower, Addr: "10.0.0.1:6881"}, ErrNoSecret},
+		{Config{Role: RolePrimary, Addr: ":6881", Secret: "secret", TLSCertPath: "cert.pem"}, ErrIncompleteTLS},
+	}
+
+	for _, tt := range table {
+		require.Equal(t, tt.expected, checkConfig(tt.cfg))
+	}
+}
+
+// writeCertificate writes a self-signed certificate for 127.0.0.1 and its key
+// to dir and returns their paths.
+func writeCertificate(t *testing.T, dir string) (certPath, keyPath string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+
+	certPath, keyPath = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.Nil(t, ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.Nil(t, ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certPath, keyPath
+}
+
+func TestReplicationTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replication")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	certPath, keyPath := writeCertificate(t, dir)
+
+	primaryStore, followerStore := newStore(t), newStore(t)
+	defer func() { primaryStore.Stop().Wait() }()
+	defer func() { followerStore.Stop().Wait() }()
+
+	primary, err := NewPrimary(primaryStore, Config{Role: RolePrimary, Addr: "127.0.0.1:0", Secret: "secret", TLSCertPath: certPath, TLSKeyPath: keyPath})
+	require.Nil(t, err)
+	defer func() { primary.Stop().Wait() }()
+
+	follower, err := NewFollower(followerStore, Config{Role: RoleFollower, Addr: primary.Addr().String(), Secret: "secret", TLSCAPath: certPath})
+	require.Nil(t, err)
+	defer func() { follower.Stop().Wait() }()
+
+	// A follower connecting without TLS is rejected.
+	plainStore := newStore(t)
+	defer func() { plainStore.Stop().Wait() }()
+	plain, err := NewFollower(plainStore, Config{Role: RoleFollower, Addr: primary.Addr().String(), Secret: "secret"})
+	require.Nil(t, err)
+	defer func() { plain.Stop().Wait() }()
+
+	waitFor(t, func() bool {
+		primary.mu.Lock()
+		defer primary.mu.Unlock()
+		return len(primary.followers) == 1
+	})
+
+	ctx := context.Background()
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	p := bittorrent.Peer{IP: bittorrent.IP{IP: net.ParseIP("10.0.0.1").To4(), AddressFamily: bittorrent.IPv4}, Port: 1}
+	require.Nil(t, primary.PutSeeder(ctx, ih, p))
+
+	waitFor(t, func() bool {
+		return followerStore.ScrapeSwarm(ctx, ih, bittorrent.IPv4).Complete == 1
+	})
+	require.Equal(t, uint32(0), plainStore.ScrapeSwarm(ctx, ih, bittorrent.IPv4).Complete)
+}
@@ -0,0 +1,23 @@
+package scrapecache
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	prometheus.MustRegister(promLookupsTotal)
+}
+
+var promLookupsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "chihaya_storage_scrape_cache_lookups_total",
+		Help: "The number of lookups in the scrape cache by result",
+	},
+	[]string{"result"},
+)
+
+// recordLookup records a lookup in the scrape cache, whose result is hit,
+// miss or error.
+func recordLookup(result string) {
+	promLookupsTotal.WithLabelValues(result).Inc()
+}
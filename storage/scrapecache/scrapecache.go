@@ -0,0 +1,331 @@
+// Package scrapecache implements a storage.PeerStore that caches the counts
+// of swarms returned by ScrapeSwarm, so that floods of scrapes for the same
+// torrents don't reach the wrapped PeerStore on every request.
+//
+// The cache is kept in memory or shared by several trackers through
+// memcached. Cached counts are refreshed from the wrapped PeerStore once they
+// are older than the refresh interval.
+package scrapecache
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/clock"
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+	"github.com/chihaya/chihaya/storage"
+)
+
+// The backends a cache can be kept in.
+const (
+	// BackendMemory keeps the cache in the memory of this process.
+	BackendMemory = "memory"
+
+	// BackendMemcached shares the cache between trackers through memcached.
+	BackendMemcached = "memcached"
+)
+
+// Default config constants.
+const (
+	defaultBackend         = BackendMemory
+	defaultRefreshInterval = 10 * time.Second
+	defaultTimeout         = 100 * time.Millisecond
+	defaultKeyPrefix       = "chihaya:scrape:"
+)
+
+// ErrNoServers is returned if the memcached backend is configured without
+// any servers.
+var ErrNoServers = errors.New("the memcached scrape cache requires at least one server")
+
+// Config holds the configuration of a scrape cache.
+type Config struct {
+	// Backend is the backend the cache is kept in, BackendMemory or
+	// BackendMemcached.
+	Backend string `yaml:"backend"`
+
+	// RefreshInterval is how long counts are served from the cache before
+	// they are read from the wrapped PeerStore again.
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+
+	// Servers are the addresses of the memcached servers.
+	Servers []string `yaml:"servers"`
+
+	// Timeout bounds every request to memcached.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// KeyPrefix is prepended to the keys of cached counts in memcached, so
+	// that trackers with different storages can share the servers.
+	KeyPrefix string `yaml:"key_prefix"`
+}
+
+// LogFields renders the current config as a set of Logrus fields.
+func (cfg Config) LogFields() log.Fields {
+	return log.Fields{
+		"backend":         cfg.Backend,
+		"refreshInterval": cfg.RefreshInterval,
+		"servers":         cfg.Servers,
+		"timeout":         cfg.Timeout,
+		"keyPrefix":       cfg.KeyPrefix,
+	}
+}
+
+// Validate sanity checks values set in a config and returns a new config with
+// default values replacing anything that is invalid.
+//
+// This function warns to the logger when a value is changed.
+func (cfg Config) Validate() Config {
+	validcfg := cfg
+
+	if cfg.Backend == "" {
+		validcfg.Backend = defaultBackend
+	}
+
+	if cfg.RefreshInterval <= 0 {
+		validcfg.RefreshInterval = defaultRefreshInterval
+		log.Warn("falling back to default configuration", log.Fields{
+			"name":     "scrapecache.RefreshInterval",
+			"provided": cfg.RefreshInterval,
+			"default":  validcfg.RefreshInterval,
+		})
+	}
+
+	if cfg.Timeout <= 0 {
+		validcfg.Timeout = defaultTimeout
+	}
+
+	if cfg.KeyPrefix == "" {
+		validcfg.KeyPrefix = defaultKeyPrefix
+	}
+
+	return validcfg
+}
+
+// counts are the cached fields of a Scrape.
+type counts struct {
+	snatches, complete, incomplete uint32
+}
+
+// cache is a backend of a Store.
+type cache interface {
+	// get returns the counts cached under key, if any.
+	get(key string) (counts, bool, error)
+
+	// set caches the counts under key.
+	set(key string, c counts) error
+
+	stop.Stopper
+}
+
+// Store is a storage.PeerStore that answers ScrapeSwarm from a cache and
+// passes everything else to the wrapped PeerStore.
+type Store struct {
+	storage.PeerStore
+	cfg   Config
+	cache cache
+}
+
+var _ storage.PeerStore = &Store{}
+
+// New returns a Store wrapping ps.
+func New(ps storage.PeerStore, provided Config) (*Store, error) {
+	cfg := provided.Validate()
+
+	var c cache
+	switch cfg.Backend {
+	case BackendMemory:
+		c = newMemoryCache(cfg.RefreshInterval, clock.Cached)
+	case BackendMemcached:
+		if len(cfg.Servers) == 0 {
+			return nil, ErrNoServers
+		}
+		client := memcache.New(cfg.Servers...)
+		client.Timeout = cfg.Timeout
+		c = &memcachedCache{client: client, expiration: cfg.RefreshInterval}
+	default:
+		return nil, fmt.Errorf("unknown scrape cache backend %q", cfg.Backend)
+	}
+
+	return &Store{PeerStore: ps, cfg: cfg, cache: c}, nil
+}
+
+// key returns the key the counts of a swarm are cached under.
+func (s *Store) key(ih bittorrent.InfoHash, af bittorrent.AddressFamily) string {
+	return s.cfg.KeyPrefix + af.String() + ":" + ih.String()
+}
+
+// ScrapeSwarm implements storage.PeerStore.
+//
+// Counts missing from the cache are read from the wrapped PeerStore and
+// cached. If the cache fails, the wrapped PeerStore is used.
+func (s *Store) ScrapeSwarm(ctx context.Context, ih bittorrent.InfoHash, af bittorrent.AddressFamily) bittorrent.Scrape {
+	key := s.key(ih, af)
+	c, ok, err := s.cache.get(key)
+	if err != nil {
+		recordLookup("error")
+		log.Debug("failed to read the scrape cache", log.Err(err))
+	} else if ok {
+		recordLookup("hit")
+		return bittorrent.Scrape{
+			InfoHash:   ih,
+			Snatches:   c.snatches,
+			Complete:   c.complete,
+			Incomplete: c.incomplete,
+		}
+	} else {
+		recordLookup("miss")
+	}
+
+	scrape := s.PeerStore.ScrapeSwarm(ctx, ih, af)
+	if err == nil {
+		c = counts{snatches: scrape.Snatches, complete: scrape.Complete, incomplete: scrape.Incomplete}
+		if err := s.cache.set(key, c); err != nil {
+			log.Debug("failed to write the scrape cache", log.Err(err))
+		}
+	}
+	return scrape
+}
+
+// PutMultiHomedSeeder implements storage.MultiHomedPeerStore.
+func (s *Store) PutMultiHomedSeeder(ctx context.Context, ih bittorrent.InfoHash, p, alternate bittorrent.Peer) error {
+	return storage.PutMultiHomedSeeder(ctx, s.PeerStore, ih, p, alternate)
+}
+
+// PutMultiHomedLeecher implements storage.MultiHomedPeerStore.
+func (s *Store) PutMultiHomedLeecher(ctx context.Context, ih bittorrent.InfoHash, p, alternate bittorrent.Peer) error {
+	return storage.PutMultiHomedLeecher(ctx, s.PeerStore, ih, p, alternate)
+}
+
+// GraduateMultiHomedLeecher implements storage.MultiHomedPeerStore.
+func (s *Store) GraduateMultiHomedLeecher(ctx context.Context, ih bittorrent.InfoHash, p, alternate bittorrent.Peer) error {
+	return storage.GraduateMultiHomedLeecher(ctx, s.PeerStore, ih, p, alternate)
+}
+
+// SwarmActivity implements storage.ActivityReporter.
+func (s *Store) SwarmActivity(ctx context.Context, ih bittorrent.InfoHash, af bittorrent.AddressFamily) (storage.SwarmActivity, bool) {
+	return storage.Activity(ctx, s.PeerStore, ih, af)
+}
+
+// StopCache stops the cache. The wrapped PeerStore is not stopped.
+func (s *Store) StopCache() stop.Result {
+	return s.cache.Stop()
+}
+
+// LogFields implements log.Fielder.
+func (s *Store) LogFields() log.Fields {
+	return log.Fields{
+		"scrapeCache": s.cfg,
+		"storage":     s.PeerStore.LogFields(),
+	}
+}
+
+// memoryCache is a cache in memory. All counts are dropped at once every
+// refresh interval, so that counts are cached for at most one interval.
+type memoryCache struct {
+	mu     sync.RWMutex
+	counts map[string]counts
+
+	closed chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newMemoryCache(interval time.Duration, clk clock.Clock) *memoryCache {
+	c := &memoryCache{
+		counts: make(map[string]counts),
+		closed: make(chan struct{}),
+	}
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		for {
+			select {
+			case <-c.closed:
+				return
+			case <-clk.After(interval):
+				c.mu.Lock()
+				c.counts = make(map[string]counts)
+				c.mu.Unlock()
+			}
+		}
+	}()
+
+	return c
+}
+
+func (c *memoryCache) get(key string) (counts, bool, error) {
+	c.mu.RLock()
+	cached, ok := c.counts[key]
+	c.mu.RUnlock()
+	return cached, ok, nil
+}
+
+func (c *memoryCache) set(key string, cached counts) error {
+	c.mu.Lock()
+	c.counts[key] = cached
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *memoryCache) Stop() stop.Result {
+	ch := make(stop.Channel)
+	go func() {
+		close(c.closed)
+		c.wg.Wait()
+		ch.Done()
+	}()
+	return ch.Result()
+}
+
+// memcachedCache is a cache in memcached. Counts expire after the refresh
+// interval.
+type memcachedCache struct {
+	client     *memcache.Client
+	expiration time.Duration
+}
+
+// countsSize is the size of encoded counts.
+const countsSize = 12
+
+func (c *memcachedCache) get(key string) (counts, bool, error) {
+	item, err := c.client.Get(key)
+	if err == memcache.ErrCacheMiss {
+		return counts{}, false, nil
+	} else if err != nil {
+		return counts{}, false, err
+	}
+	if len(item.Value) != countsSize {
+		return counts{}, false, fmt.Errorf("invalid cached counts of %d bytes", len(item.Value))
+	}
+
+	return counts{
+		snatches:   binary.BigEndian.Uint32(item.Value[0:4]),
+		complete:   binary.BigEndian.Uint32(item.Value[4:8]),
+		incomplete: binary.BigEndian.Uint32(item.Value[8:12]),
+	}, true, nil
+}
+
+func (c *memcachedCache) set(key string, cached counts) error {
+	value := make([]byte, countsSize)
+	binary.BigEndian.PutUint32(value[0:4], cached.snatches)
+	binary.BigEndian.PutUint32(value[4:8], cached.complete)
+	binary.BigEndian.PutUint32(value[8:12], cached.incomplete)
+
+	// Expirations are in whole seconds, and 0 would never expire.
+	expiration := int32(c.expiration / time.Second)
+	if expiration < 1 {
+		expiration = 1
+	}
+	return c.client.Set(&memcache.Item{Key: key, Value: value, Expiration: expiration})
+}
+
+func (c *memcachedCache) Stop() stop.Result {
+	return stop.AlreadyStopped
+}
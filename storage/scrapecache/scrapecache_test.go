@@ -0,0 +1,70 @@
+package scrapecache
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/pkg/clock"
+	"github.com/chihaya/chihaya/storage"
+	"github.com/chihaya/chihaya/storage/memory"
+)
+
+func newMemory(t *testing.T) storage.PeerStore {
+	ps, err := memory.New(memory.Config{ShardCount: 1, GarbageCollectionInterval: time.Hour, PeerLifetime: time.Hour})
+	require.Nil(t, err)
+	return ps
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(nil, Config{Backend: BackendMemcached})
+	require.Equal(t, ErrNoServers, err)
+	_, err = New(nil, Config{Backend: "groupcache"})
+	require.NotNil(t, err)
+}
+
+func TestScrapeSwarm(t *testing.T) {
+	ps := newMemory(t)
+	defer func() { ps.Stop().Wait() }()
+
+	clk := clock.NewMock(time.Unix(1600000000, 0))
+	s := &Store{
+		PeerStore: ps,
+		cfg:       Config{}.Validate(),
+		cache:     newMemoryCache(time.Minute, clk),
+	}
+	defer func() { s.StopCache().Wait() }()
+
+	ctx := context.Background()
+	ih := bittorrent.InfoHashFromString("00000000000000000001")
+	peer := func(i byte) bittorrent.Peer {
+		return bittorrent.Peer{
+			ID:   bittorrent.PeerIDFromString("0000000000000000000" + string('0'+i)),
+			IP:   bittorrent.IP{IP: net.IPv4(10, 0, 0, i).To4(), AddressFamily: bittorrent.IPv4},
+			Port: 6881,
+		}
+	}
+
+	require.Nil(t, ps.PutSeeder(ctx, ih, peer(1)))
+	scrape := s.ScrapeSwarm(ctx, ih, bittorrent.IPv4)
+	require.Equal(t, ih, scrape.InfoHash)
+	require.Equal(t, uint32(1), scrape.Complete)
+
+	// Changes are not visible until the cache is refreshed.
+	require.Nil(t, ps.PutLeecher(ctx, ih, peer(2)))
+	scrape = s.ScrapeSwarm(ctx, ih, bittorrent.IPv4)
+	require.Equal(t, ih, scrape.InfoHash)
+	require.Equal(t, uint32(0), scrape.Incomplete)
+	require.Equal(t, uint32(0), s.ScrapeSwarm(ctx, ih, bittorrent.IPv6).Complete)
+
+	clk.BlockUntil(1)
+	clk.Add(time.Minute)
+	clk.BlockUntil(1)
+	scrape = s.ScrapeSwarm(ctx, ih, bittorrent.IPv4)
+	require.Equal(t, uint32(1), scrape.Complete)
+	require.Equal(t, uint32(1), scrape.Incomplete)
+}
@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/chihaya/chihaya/pkg/log"
+	"github.com/chihaya/chihaya/pkg/stop"
+)
+
+// IPStore is an interface that abstracts storing a set of IP addresses and
+// ranges, such as banned or approved clients, such that it can be
+// implemented for various data stores.
+//
+// IPv4 addresses must be matched regardless of whether they are given in
+// their 4-byte or 16-byte form.
+type IPStore interface {
+	// AddIP adds a single IP address to the IPStore.
+	AddIP(ctx context.Context, ip net.IP) error
+
+	// AddNetwork adds a range of IP addresses, given in CIDR notation, to
+	// the IPStore.
+	AddNetwork(ctx context.Context, network string) error
+
+	// HasIP returns whether the IP address was added or is within a range
+	// that was added.
+	HasIP(ctx context.Context, ip net.IP) (bool, error)
+
+	// RemoveIP removes a single IP address from the IPStore. Ranges
+	// containing it are not affected.
+	//
+	// If the IP address was not added, this function returns
+	// ErrResourceDoesNotExist.
+	RemoveIP(ctx context.Context, ip net.IP) error
+
+	// RemoveNetwork removes a range of IP addresses, given in CIDR notation,
+	// from the IPStore.
+	//
+	// If the range was not added, this function returns
+	// ErrResourceDoesNotExist.
+	RemoveNetwork(ctx context.Context, network string) error
+
+	// stop.Stopper is an interface that expects a Stop method to stop the
+	// IPStore.
+	// For more details see the documentation in the stop package.
+	stop.Stopper
+
+	// log.Fielder returns a loggable version of the data used to configure and
+	// operate a particular IPStore.
+	log.Fielder
+}
+
+// StringStore is an interface that abstracts storing a set of strings, such
+// as approved client IDs or infohashes, such that it can be implemented for
+// various data stores.
+type StringStore interface {
+	// PutString adds a string to the StringStore.
+	PutString(ctx context.Context, s string) error
+
+	// HasString returns whether the string was added.
+	HasString(ctx context.Context, s string) (bool, error)
+
+	// RemoveString removes a string from the StringStore.
+	//
+	// If the string was not added, this function returns
+	// ErrResourceDoesNotExist.
+	RemoveString(ctx context.Context, s string) error
+
+	// stop.Stopper is an interface that expects a Stop method to stop the
+	// StringStore.
+	// For more details see the documentation in the stop package.
+	stop.Stopper
+
+	// log.Fielder returns a loggable version of the data used to configure and
+	// operate a particular StringStore.
+	log.Fielder
+}
+
+// IPStoreDriver is the interface used to initialize a new type of IPStore.
+type IPStoreDriver interface {
+	NewIPStore(cfg interface{}) (IPStore, error)
+}
+
+// StringStoreDriver is the interface used to initialize a new type of
+// StringStore.
+type StringStoreDriver interface {
+	NewStringStore(cfg interface{}) (StringStore, error)
+}
+
+var (
+	// ErrIPStoreDriverDoesNotExist is the error returned by NewIPStore when
+	// an IP store driver with that name does not exist.
+	ErrIPStoreDriverDoesNotExist = errors.New("IP store driver with that name does not exist")
+
+	// ErrStringStoreDriverDoesNotExist is the error returned by
+	// NewStringStore when a string store driver with that name does not
+	// exist.
+	ErrStringStoreDriverDoesNotExist = errors.New("string store driver with that name does not exist")
+)
+
+var (
+	ipStoreDriversM sync.RWMutex
+	ipStoreDrivers  = make(map[string]IPStoreDriver)
+
+	stringStoreDriversM sync.RWMutex
+	stringStoreDrivers  = make(map[string]StringStoreDriver)
+)
+
+// RegisterIPStoreDriver makes an IPStoreDriver available by the provided
+// name.
+//
+// If called twice with the same name, the name is blank, or if the provided
+// IPStoreDriver is nil, this function panics.
+func RegisterIPStoreDriver(name string, d IPStoreDriver) {
+	if name == "" {
+		panic("storage: could not register an IPStoreDriver with an empty name")
+	}
+	if d == nil {
+		panic("storage: could not register a nil IPStoreDriver")
+	}
+
+	ipStoreDriversM.Lock()
+	defer ipStoreDriversM.Unlock()
+
+	if _, dup := ipStoreDrivers[name]; dup {
+		panic("storage: RegisterIPStoreDriver called twice for " + name)
+	}
+
+	ipStoreDrivers[name] = d
+}
+
+// NewIPStore attempts to initialize a new IPStore instance from the list of
+// registered IPStoreDrivers.
+//
+// If a driver does not exist, returns ErrIPStoreDriverDoesNotExist.
+func NewIPStore(name string, cfg interface{}) (IPStore, error) {
+	ipStoreDriversM.RLock()
+	defer ipStoreDriversM.RUnlock()
+
+	d, ok := ipStoreDrivers[name]
+	if !ok {
+		return nil, ErrIPStoreDriverDoesNotExist
+	}
+
+	return d.NewIPStore(cfg)
+}
+
+// RegisterStringStoreDriver makes a StringStoreDriver available by the
+// provided name.
+//
+// If called twice with the same name, the name is blank, or if the provided
+// StringStoreDriver is nil, this function panics.
+func RegisterStringStoreDriver(name string, d StringStoreDriver) {
+	if name == "" {
+		panic("storage: could not register a StringStoreDriver with an empty name")
+	}
+	if d == nil {
+		panic("storage: could not register a nil StringStoreDriver")
+	}
+
+	stringStoreDriversM.Lock()
+	defer stringStoreDriversM.Unlock()
+
+	if _, dup := stringStoreDrivers[name]; dup {
+		panic("storage: RegisterStringStoreDriver called twice for " + name)
+	}
+
+	stringStoreDrivers[name] = d
+}
+
+// NewStringStore attempts to initialize a new StringStore instance from the
+// list of registered StringStoreDrivers.
+//
+// If a driver does not exist, returns ErrStringStoreDriverDoesNotExist.
+func NewStringStore(name string, cfg interface{}) (StringStore, error) {
+	stringStoreDriversM.RLock()
+	defer stringStoreDriversM.RUnlock()
+
+	d, ok := stringStoreDrivers[name]
+	if !ok {
+		return nil, ErrStringStoreDriverDoesNotExist
+	}
+
+	return d.NewStringStore(cfg)
+}
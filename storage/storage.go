@@ -1,8 +1,10 @@
 package storage
 
 import (
+	"context"
 	"errors"
 	"sync"
+	"time"
 
 	"github.com/chihaya/chihaya/bittorrent"
 	"github.com/chihaya/chihaya/pkg/log"
@@ -46,36 +48,41 @@ var ErrDriverDoesNotExist = errors.New("peer store driver with that name does no
 //
 // Implementations can be tested against this interface using the tests in
 // storage_tests.go and the benchmarks in storage_bench.go.
+//
+// The context of the request being handled is passed to every method, so
+// that PeerStores backed by remote services can honor its deadline and
+// cancellation.
 type PeerStore interface {
 	// PutSeeder adds a Seeder to the Swarm identified by the provided
 	// InfoHash.
-	PutSeeder(infoHash bittorrent.InfoHash, p bittorrent.Peer) error
+	PutSeeder(ctx context.Context, infoHash bittorrent.InfoHash, p bittorrent.Peer) error
 
 	// DeleteSeeder removes a Seeder from the Swarm identified by the
 	// provided InfoHash.
 	//
 	// If the Swarm or Peer does not exist, this function returns
 	// ErrResourceDoesNotExist.
-	DeleteSeeder(infoHash bittorrent.InfoHash, p bittorrent.Peer) error
+	DeleteSeeder(ctx context.Context, infoHash bittorrent.InfoHash, p bittorrent.Peer) error
 
 	// PutLeecher adds a Leecher to the Swarm identified by the provided
 	// InfoHash.
 	// If the Swarm does not exist already, it is created.
-	PutLeecher(infoHash bittorrent.InfoHash, p bittorrent.Peer) error
+	PutLeecher(ctx context.Context, infoHash bittorrent.InfoHash, p bittorrent.Peer) error
 
 	// DeleteLeecher removes a Leecher from the Swarm identified by the
 	// provided InfoHash.
 	//
 	// If the Swarm or Peer does not exist, this function returns
 	// ErrResourceDoesNotExist.
-	DeleteLeecher(infoHash bittorrent.InfoHash, p bittorrent.Peer) error
+	DeleteLeecher(ctx context.Context, infoHash bittorrent.InfoHash, p bittorrent.Peer) error
 
 	// GraduateLeecher promotes a Leecher to a Seeder in the Swarm
 	// identified by the provided InfoHash.
+	// If the Peer is not a Seeder already, it is counted as a snatch.
 	//
 	// If the given Peer is not present as a Leecher or the swarm does not exist
 	// already, the Peer is added as a Seeder and no error is returned.
-	GraduateLeecher(infoHash bittorrent.InfoHash, p bittorrent.Peer) error
+	GraduateLeecher(ctx context.Context, infoHash bittorrent.InfoHash, p bittorrent.Peer) error
 
 	// AnnouncePeers is a best effort attempt to return Peers from the Swarm
 	// identified by the provided InfoHash.
@@ -92,17 +99,32 @@ type PeerStore interface {
 	//   leechers
 	//
 	// Returns ErrResourceDoesNotExist if the provided InfoHash is not tracked.
-	AnnouncePeers(infoHash bittorrent.InfoHash, seeder bool, numWant int, p bittorrent.Peer) (peers []bittorrent.Peer, err error)
+	AnnouncePeers(ctx context.Context, infoHash bittorrent.InfoHash, seeder bool, numWant int, p bittorrent.Peer) (peers []bittorrent.Peer, err error)
+
+	// AnnounceSeeders returns up to numWant Seeders from the Swarm
+	// identified by the provided InfoHash, of the address family of the
+	// announcing Peer p.
+	//
+	// Returns ErrResourceDoesNotExist if the provided InfoHash is not tracked.
+	AnnounceSeeders(ctx context.Context, infoHash bittorrent.InfoHash, numWant int, p bittorrent.Peer) (peers []bittorrent.Peer, err error)
+
+	// AnnounceLeechers returns up to numWant Leechers from the Swarm
+	// identified by the provided InfoHash, of the address family of the
+	// announcing Peer p and excluding p itself.
+	//
+	// Returns ErrResourceDoesNotExist if the provided InfoHash is not tracked.
+	AnnounceLeechers(ctx context.Context, infoHash bittorrent.InfoHash, numWant int, p bittorrent.Peer) (peers []bittorrent.Peer, err error)
 
 	// ScrapeSwarm returns information required to answer a Scrape request
 	// about a Swarm identified by the given InfoHash.
 	// The AddressFamily indicates whether or not the IPv6 swarm should be
 	// scraped.
-	// The Complete and Incomplete fields of the Scrape must be filled,
-	// filling the Snatches field is optional.
+	// The Complete and Incomplete fields of the Scrape must be filled.
+	// The Snatches field is the number of Peers that became Seeders through
+	// GraduateLeecher since the Swarm was created.
 	//
 	// If the Swarm does not exist, an empty Scrape and no error is returned.
-	ScrapeSwarm(infoHash bittorrent.InfoHash, addressFamily bittorrent.AddressFamily) bittorrent.Scrape
+	ScrapeSwarm(ctx context.Context, infoHash bittorrent.InfoHash, addressFamily bittorrent.AddressFamily) bittorrent.Scrape
 
 	// stop.Stopper is an interface that expects a Stop method to stop the
 	// PeerStore.
@@ -114,6 +136,103 @@ type PeerStore interface {
 	log.Fielder
 }
 
+// SwarmLister is implemented by PeerStores that can enumerate their Swarms,
+// which is used to inspect a running tracker.
+type SwarmLister interface {
+	// ListSwarms returns the InfoHashes of all Swarms of any address family.
+	//
+	// Swarms created or deleted while listing may or may not be returned.
+	ListSwarms(ctx context.Context) ([]bittorrent.InfoHash, error)
+}
+
+// SwarmActivity is when a Swarm was created and when a Peer last announced
+// to it.
+type SwarmActivity struct {
+	Created      time.Time
+	LastAnnounce time.Time
+}
+
+// ActivityReporter is implemented by PeerStores that track the activity of
+// their Swarms, which is used to find abandoned torrents.
+type ActivityReporter interface {
+	// SwarmActivity returns the activity of the Swarm identified by the
+	// provided InfoHash and AddressFamily.
+	//
+	// ok is false if the Swarm does not exist or its activity is unknown.
+	SwarmActivity(ctx context.Context, infoHash bittorrent.InfoHash, addressFamily bittorrent.AddressFamily) (activity SwarmActivity, ok bool)
+}
+
+// Activity returns the activity of a Swarm of ps, if ps is an
+// ActivityReporter. It is used by PeerStores wrapping other PeerStores.
+func Activity(ctx context.Context, ps PeerStore, infoHash bittorrent.InfoHash, addressFamily bittorrent.AddressFamily) (SwarmActivity, bool) {
+	if r, ok := ps.(ActivityReporter); ok {
+		return r.SwarmActivity(ctx, infoHash, addressFamily)
+	}
+	return SwarmActivity{}, false
+}
+
+// MultiHomedPeerStore is implemented by PeerStores that store the endpoints
+// of a multi-homed client, one of each address family, as one logical Peer
+// with two addresses, as described in BEP 45.
+//
+// Both endpoints of such a Peer are put, graduated and refreshed together,
+// and are members of the Swarms of their address families like any other
+// Peer. Deleting either endpoint, or putting or graduating it without the
+// other, removes the other endpoint as well, since the client no longer
+// announces it.
+type MultiHomedPeerStore interface {
+	// PutMultiHomedSeeder adds the Peer with the endpoints p and alternate
+	// as a Seeder to the Swarms identified by the provided InfoHash.
+	PutMultiHomedSeeder(ctx context.Context, infoHash bittorrent.InfoHash, p, alternate bittorrent.Peer) error
+
+	// PutMultiHomedLeecher adds the Peer with the endpoints p and alternate
+	// as a Leecher to the Swarms identified by the provided InfoHash.
+	PutMultiHomedLeecher(ctx context.Context, infoHash bittorrent.InfoHash, p, alternate bittorrent.Peer) error
+
+	// GraduateMultiHomedLeecher promotes the Peer with the endpoints p and
+	// alternate to a Seeder like GraduateLeecher.
+	GraduateMultiHomedLeecher(ctx context.Context, infoHash bittorrent.InfoHash, p, alternate bittorrent.Peer) error
+}
+
+// PutMultiHomedSeeder adds the Peer with the endpoints p and alternate as a
+// Seeder to ps. If ps is not a MultiHomedPeerStore, the endpoints are added as
+// independent Peers.
+func PutMultiHomedSeeder(ctx context.Context, ps PeerStore, infoHash bittorrent.InfoHash, p, alternate bittorrent.Peer) error {
+	if m, ok := ps.(MultiHomedPeerStore); ok {
+		return m.PutMultiHomedSeeder(ctx, infoHash, p, alternate)
+	}
+	if err := ps.PutSeeder(ctx, infoHash, p); err != nil {
+		return err
+	}
+	return ps.PutSeeder(ctx, infoHash, alternate)
+}
+
+// PutMultiHomedLeecher adds the Peer with the endpoints p and alternate as a
+// Leecher to ps. If ps is not a MultiHomedPeerStore, the endpoints are added
+// as independent Peers.
+func PutMultiHomedLeecher(ctx context.Context, ps PeerStore, infoHash bittorrent.InfoHash, p, alternate bittorrent.Peer) error {
+	if m, ok := ps.(MultiHomedPeerStore); ok {
+		return m.PutMultiHomedLeecher(ctx, infoHash, p, alternate)
+	}
+	if err := ps.PutLeecher(ctx, infoHash, p); err != nil {
+		return err
+	}
+	return ps.PutLeecher(ctx, infoHash, alternate)
+}
+
+// GraduateMultiHomedLeecher promotes the Peer with the endpoints p and
+// alternate to a Seeder of ps. If ps is not a MultiHomedPeerStore, the
+// endpoints are graduated as independent Peers.
+func GraduateMultiHomedLeecher(ctx context.Context, ps PeerStore, infoHash bittorrent.InfoHash, p, alternate bittorrent.Peer) error {
+	if m, ok := ps.(MultiHomedPeerStore); ok {
+		return m.GraduateMultiHomedLeecher(ctx, infoHash, p, alternate)
+	}
+	if err := ps.GraduateLeecher(ctx, infoHash, p); err != nil {
+		return err
+	}
+	return ps.GraduateLeecher(ctx, infoHash, alternate)
+}
+
 // RegisterDriver makes a Driver available by the provided name.
 //
 // If called twice with the same name, the name is blank, or if the provided
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"context"
 	"math/rand"
 	"net"
 	"runtime"
@@ -114,7 +115,7 @@ func Nop(b *testing.B, ps PeerStore) {
 // Put can run in parallel.
 func Put(b *testing.B, ps PeerStore) {
 	runBenchmark(b, ps, true, nil, func(i int, ps PeerStore, bd *benchData) error {
-		return ps.PutSeeder(bd.infohashes[0], bd.peers[0])
+		return ps.PutSeeder(context.Background(), bd.infohashes[0], bd.peers[0])
 	})
 }
 
@@ -124,7 +125,7 @@ func Put(b *testing.B, ps PeerStore) {
 // Put1k can run in parallel.
 func Put1k(b *testing.B, ps PeerStore) {
 	runBenchmark(b, ps, true, nil, func(i int, ps PeerStore, bd *benchData) error {
-		return ps.PutSeeder(bd.infohashes[0], bd.peers[i%1000])
+		return ps.PutSeeder(context.Background(), bd.infohashes[0], bd.peers[i%1000])
 	})
 }
 
@@ -134,7 +135,7 @@ func Put1k(b *testing.B, ps PeerStore) {
 // Put1kInfohash can run in parallel.
 func Put1kInfohash(b *testing.B, ps PeerStore) {
 	runBenchmark(b, ps, true, nil, func(i int, ps PeerStore, bd *benchData) error {
-		return ps.PutSeeder(bd.infohashes[i%1000], bd.peers[0])
+		return ps.PutSeeder(context.Background(), bd.infohashes[i%1000], bd.peers[0])
 	})
 }
 
@@ -144,7 +145,7 @@ func Put1kInfohash(b *testing.B, ps PeerStore) {
 // Put1kInfohash1k can run in parallel.
 func Put1kInfohash1k(b *testing.B, ps PeerStore) {
 	runBenchmark(b, ps, true, nil, func(i int, ps PeerStore, bd *benchData) error {
-		err := ps.PutSeeder(bd.infohashes[i%1000], bd.peers[(i*3)%1000])
+		err := ps.PutSeeder(context.Background(), bd.infohashes[i%1000], bd.peers[(i*3)%1000])
 		return err
 	})
 }
@@ -155,11 +156,11 @@ func Put1kInfohash1k(b *testing.B, ps PeerStore) {
 // PutDelete can not run in parallel.
 func PutDelete(b *testing.B, ps PeerStore) {
 	runBenchmark(b, ps, false, nil, func(i int, ps PeerStore, bd *benchData) error {
-		err := ps.PutSeeder(bd.infohashes[0], bd.peers[0])
+		err := ps.PutSeeder(context.Background(), bd.infohashes[0], bd.peers[0])
 		if err != nil {
 			return err
 		}
-		return ps.DeleteSeeder(bd.infohashes[0], bd.peers[0])
+		return ps.DeleteSeeder(context.Background(), bd.infohashes[0], bd.peers[0])
 	})
 }
 
@@ -169,11 +170,11 @@ func PutDelete(b *testing.B, ps PeerStore) {
 // PutDelete1k can not run in parallel.
 func PutDelete1k(b *testing.B, ps PeerStore) {
 	runBenchmark(b, ps, false, nil, func(i int, ps PeerStore, bd *benchData) error {
-		err := ps.PutSeeder(bd.infohashes[0], bd.peers[i%1000])
+		err := ps.PutSeeder(context.Background(), bd.infohashes[0], bd.peers[i%1000])
 		if err != nil {
 			return err
 		}
-		return ps.DeleteSeeder(bd.infohashes[0], bd.peers[i%1000])
+		return ps.DeleteSeeder(context.Background(), bd.infohashes[0], bd.peers[i%1000])
 	})
 }
 
@@ -183,10 +184,10 @@ func PutDelete1k(b *testing.B, ps PeerStore) {
 // PutDelete1kInfohash can not run in parallel.
 func PutDelete1kInfohash(b *testing.B, ps PeerStore) {
 	runBenchmark(b, ps, false, nil, func(i int, ps PeerStore, bd *benchData) error {
-		err := ps.PutSeeder(bd.infohashes[i%1000], bd.peers[0])
+		err := ps.PutSeeder(context.Background(), bd.infohashes[i%1000], bd.peers[0])
 		if err != nil {
 		}
-		return ps.DeleteSeeder(bd.infohashes[i%1000], bd.peers[0])
+		return ps.DeleteSeeder(context.Background(), bd.infohashes[i%1000], bd.peers[0])
 	})
 }
 
@@ -196,11 +197,11 @@ func PutDelete1kInfohash(b *testing.B, ps PeerStore) {
 // PutDelete1kInfohash1k can not run in parallel.
 func PutDelete1kInfohash1k(b *testing.B, ps PeerStore) {
 	runBenchmark(b, ps, false, nil, func(i int, ps PeerStore, bd *benchData) error {
-		err := ps.PutSeeder(bd.infohashes[i%1000], bd.peers[(i*3)%1000])
+		err := ps.PutSeeder(context.Background(), bd.infohashes[i%1000], bd.peers[(i*3)%1000])
 		if err != nil {
 			return err
 		}
-		err = ps.DeleteSeeder(bd.infohashes[i%1000], bd.peers[(i*3)%1000])
+		err = ps.DeleteSeeder(context.Background(), bd.infohashes[i%1000], bd.peers[(i*3)%1000])
 		return err
 	})
 }
@@ -211,7 +212,7 @@ func PutDelete1kInfohash1k(b *testing.B, ps PeerStore) {
 // DeleteNonexist can run in parallel.
 func DeleteNonexist(b *testing.B, ps PeerStore) {
 	runBenchmark(b, ps, true, nil, func(i int, ps PeerStore, bd *benchData) error {
-		ps.DeleteSeeder(bd.infohashes[0], bd.peers[0])
+		ps.DeleteSeeder(context.Background(), bd.infohashes[0], bd.peers[0])
 		return nil
 	})
 }
@@ -222,7 +223,7 @@ func DeleteNonexist(b *testing.B, ps PeerStore) {
 // DeleteNonexist can run in parallel.
 func DeleteNonexist1k(b *testing.B, ps PeerStore) {
 	runBenchmark(b, ps, true, nil, func(i int, ps PeerStore, bd *benchData) error {
-		ps.DeleteSeeder(bd.infohashes[0], bd.peers[i%1000])
+		ps.DeleteSeeder(context.Background(), bd.infohashes[0], bd.peers[i%1000])
 		return nil
 	})
 }
@@ -233,7 +234,7 @@ func DeleteNonexist1k(b *testing.B, ps PeerStore) {
 // DeleteNonexist1kInfohash can run in parallel.
 func DeleteNonexist1kInfohash(b *testing.B, ps PeerStore) {
 	runBenchmark(b, ps, true, nil, func(i int, ps PeerStore, bd *benchData) error {
-		ps.DeleteSeeder(bd.infohashes[i%1000], bd.peers[0])
+		ps.DeleteSeeder(context.Background(), bd.infohashes[i%1000], bd.peers[0])
 		return nil
 	})
 }
@@ -244,7 +245,7 @@ func DeleteNonexist1kInfohash(b *testing.B, ps PeerStore) {
 // DeleteNonexist1kInfohash1k can run in parallel.
 func DeleteNonexist1kInfohash1k(b *testing.B, ps PeerStore) {
 	runBenchmark(b, ps, true, nil, func(i int, ps PeerStore, bd *benchData) error {
-		ps.DeleteSeeder(bd.infohashes[i%1000], bd.peers[(i*3)%1000])
+		ps.DeleteSeeder(context.Background(), bd.infohashes[i%1000], bd.peers[(i*3)%1000])
 		return nil
 	})
 }
@@ -255,7 +256,7 @@ func DeleteNonexist1kInfohash1k(b *testing.B, ps PeerStore) {
 // GradNonexist can run in parallel.
 func GradNonexist(b *testing.B, ps PeerStore) {
 	runBenchmark(b, ps, true, nil, func(i int, ps PeerStore, bd *benchData) error {
-		ps.GraduateLeecher(bd.infohashes[0], bd.peers[0])
+		ps.GraduateLeecher(context.Background(), bd.infohashes[0], bd.peers[0])
 		return nil
 	})
 }
@@ -266,7 +267,7 @@ func GradNonexist(b *testing.B, ps PeerStore) {
 // GradNonexist1k can run in parallel.
 func GradNonexist1k(b *testing.B, ps PeerStore) {
 	runBenchmark(b, ps, true, nil, func(i int, ps PeerStore, bd *benchData) error {
-		ps.GraduateLeecher(bd.infohashes[0], bd.peers[i%1000])
+		ps.GraduateLeecher(context.Background(), bd.infohashes[0], bd.peers[i%1000])
 		return nil
 	})
 }
@@ -277,7 +278,7 @@ func GradNonexist1k(b *testing.B, ps PeerStore) {
 // GradNonexist1kInfohash can run in parallel.
 func GradNonexist1kInfohash(b *testing.B, ps PeerStore) {
 	runBenchmark(b, ps, true, nil, func(i int, ps PeerStore, bd *benchData) error {
-		ps.GraduateLeecher(bd.infohashes[i%1000], bd.peers[0])
+		ps.GraduateLeecher(context.Background(), bd.infohashes[i%1000], bd.peers[0])
 		return nil
 	})
 }
@@ -289,7 +290,7 @@ func GradNonexist1kInfohash(b *testing.B, ps PeerStore) {
 // GradNonexist1kInfohash1k can run in parallel.
 func GradNonexist1kInfohash1k(b *testing.B, ps PeerStore) {
 	runBenchmark(b, ps, true, nil, func(i int, ps PeerStore, bd *benchData) error {
-		ps.GraduateLeecher(bd.infohashes[i%1000], bd.peers[(i*3)%1000])
+		ps.GraduateLeecher(context.Background(), bd.infohashes[i%1000], bd.peers[(i*3)%1000])
 		return nil
 	})
 }
@@ -301,15 +302,15 @@ func GradNonexist1kInfohash1k(b *testing.B, ps PeerStore) {
 // PutGradDelete can not run in parallel.
 func PutGradDelete(b *testing.B, ps PeerStore) {
 	runBenchmark(b, ps, false, nil, func(i int, ps PeerStore, bd *benchData) error {
-		err := ps.PutLeecher(bd.infohashes[0], bd.peers[0])
+		err := ps.PutLeecher(context.Background(), bd.infohashes[0], bd.peers[0])
 		if err != nil {
 			return err
 		}
-		err = ps.GraduateLeecher(bd.infohashes[0], bd.peers[0])
+		err = ps.GraduateLeecher(context.Background(), bd.infohashes[0], bd.peers[0])
 		if err != nil {
 			return err
 		}
-		return ps.DeleteSeeder(bd.infohashes[0], bd.peers[0])
+		return ps.DeleteSeeder(context.Background(), bd.infohashes[0], bd.peers[0])
 	})
 }
 
@@ -318,15 +319,15 @@ func PutGradDelete(b *testing.B, ps PeerStore) {
 // PutGradDelete1k can not run in parallel.
 func PutGradDelete1k(b *testing.B, ps PeerStore) {
 	runBenchmark(b, ps, false, nil, func(i int, ps PeerStore, bd *benchData) error {
-		err := ps.PutLeecher(bd.infohashes[0], bd.peers[i%1000])
+		err := ps.PutLeecher(context.Background(), bd.infohashes[0], bd.peers[i%1000])
 		if err != nil {
 			return err
 		}
-		err = ps.GraduateLeecher(bd.infohashes[0], bd.peers[i%1000])
+		err = ps.GraduateLeecher(context.Background(), bd.infohashes[0], bd.peers[i%1000])
 		if err != nil {
 			return err
 		}
-		return ps.DeleteSeeder(bd.infohashes[0], bd.peers[i%1000])
+		return ps.DeleteSeeder(context.Background(), bd.infohashes[0], bd.peers[i%1000])
 	})
 }
 
@@ -336,15 +337,15 @@ func PutGradDelete1k(b *testing.B, ps PeerStore) {
 // PutGradDelete1kInfohash can not run in parallel.
 func PutGradDelete1kInfohash(b *testing.B, ps PeerStore) {
 	runBenchmark(b, ps, false, nil, func(i int, ps PeerStore, bd *benchData) error {
-		err := ps.PutLeecher(bd.infohashes[i%1000], bd.peers[0])
+		err := ps.PutLeecher(context.Background(), bd.infohashes[i%1000], bd.peers[0])
 		if err != nil {
 			return err
 		}
-		err = ps.GraduateLeecher(bd.infohashes[i%1000], bd.peers[0])
+		err = ps.GraduateLeecher(context.Background(), bd.infohashes[i%1000], bd.peers[0])
 		if err != nil {
 			return err
 		}
-		return ps.DeleteSeeder(bd.infohashes[i%1000], bd.peers[0])
+		return ps.DeleteSeeder(context.Background(), bd.infohashes[i%1000], bd.peers[0])
 	})
 }
 
@@ -354,15 +355,15 @@ func PutGradDelete1kInfohash(b *testing.B, ps PeerStore) {
 // PutGradDelete1kInfohash can not run in parallel.
 func PutGradDelete1kInfohash1k(b *testing.B, ps PeerStore) {
 	runBenchmark(b, ps, false, nil, func(i int, ps PeerStore, bd *benchData) error {
-		err := ps.PutLeecher(bd.infohashes[i%1000], bd.peers[(i*3)%1000])
+		err := ps.PutLeecher(context.Background(), bd.infohashes[i%1000], bd.peers[(i*3)%1000])
 		if err != nil {
 			return err
 		}
-		err = ps.GraduateLeecher(bd.infohashes[i%1000], bd.peers[(i*3)%1000])
+		err = ps.GraduateLeecher(context.Background(), bd.infohashes[i%1000], bd.peers[(i*3)%1000])
 		if err != nil {
 			return err
 		}
-		err = ps.DeleteSeeder(bd.infohashes[i%1000], bd.peers[(i*3)%1000])
+		err = ps.DeleteSeeder(context.Background(), bd.infohashes[i%1000], bd.peers[(i*3)%1000])
 		return err
 	})
 }
@@ -372,9 +373,9 @@ func putPeers(ps PeerStore, bd *benchData) error {
 		for j := 0; j < 1000; j++ {
 			var err error
 			if j < 1000/2 {
-				err = ps.PutLeecher(bd.infohashes[i], bd.peers[j])
+				err = ps.PutLeecher(context.Background(), bd.infohashes[i], bd.peers[j])
 			} else {
-				err = ps.PutSeeder(bd.infohashes[i], bd.peers[j])
+				err = ps.PutSeeder(context.Background(), bd.infohashes[i], bd.peers[j])
 			}
 			if err != nil {
 				return err
@@ -391,7 +392,7 @@ func putPeers(ps PeerStore, bd *benchData) error {
 // AnnounceLeecher can run in parallel.
 func AnnounceLeecher(b *testing.B, ps PeerStore) {
 	runBenchmark(b, ps, true, putPeers, func(i int, ps PeerStore, bd *benchData) error {
-		_, err := ps.AnnouncePeers(bd.infohashes[0], false, 50, bd.peers[0])
+		_, err := ps.AnnouncePeers(context.Background(), bd.infohashes[0], false, 50, bd.peers[0])
 		return err
 	})
 }
@@ -402,7 +403,7 @@ func AnnounceLeecher(b *testing.B, ps PeerStore) {
 // AnnounceLeecher1kInfohash can run in parallel.
 func AnnounceLeecher1kInfohash(b *testing.B, ps PeerStore) {
 	runBenchmark(b, ps, true, putPeers, func(i int, ps PeerStore, bd *benchData) error {
-		_, err := ps.AnnouncePeers(bd.infohashes[i%1000], false, 50, bd.peers[0])
+		_, err := ps.AnnouncePeers(context.Background(), bd.infohashes[i%1000], false, 50, bd.peers[0])
 		return err
 	})
 }
@@ -413,7 +414,7 @@ func AnnounceLeecher1kInfohash(b *testing.B, ps PeerStore) {
 // AnnounceSeeder can run in parallel.
 func AnnounceSeeder(b *testing.B, ps PeerStore) {
 	runBenchmark(b, ps, true, putPeers, func(i int, ps PeerStore, bd *benchData) error {
-		_, err := ps.AnnouncePeers(bd.infohashes[0], true, 50, bd.peers[0])
+		_, err := ps.AnnouncePeers(context.Background(), bd.infohashes[0], true, 50, bd.peers[0])
 		return err
 	})
 }
@@ -424,7 +425,7 @@ func AnnounceSeeder(b *testing.B, ps PeerStore) {
 // AnnounceSeeder1kInfohash can run in parallel.
 func AnnounceSeeder1kInfohash(b *testing.B, ps PeerStore) {
 	runBenchmark(b, ps, true, putPeers, func(i int, ps PeerStore, bd *benchData) error {
-		_, err := ps.AnnouncePeers(bd.infohashes[i%1000], true, 50, bd.peers[0])
+		_, err := ps.AnnouncePeers(context.Background(), bd.infohashes[i%1000], true, 50, bd.peers[0])
 		return err
 	})
 }
@@ -435,7 +436,7 @@ func AnnounceSeeder1kInfohash(b *testing.B, ps PeerStore) {
 // ScrapeSwarm can run in parallel.
 func ScrapeSwarm(b *testing.B, ps PeerStore) {
 	runBenchmark(b, ps, true, putPeers, func(i int, ps PeerStore, bd *benchData) error {
-		ps.ScrapeSwarm(bd.infohashes[0], bittorrent.IPv4)
+		ps.ScrapeSwarm(context.Background(), bd.infohashes[0], bittorrent.IPv4)
 		return nil
 	})
 }
@@ -445,7 +446,7 @@ func ScrapeSwarm(b *testing.B, ps PeerStore) {
 // ScrapeSwarm1kInfohash can run in parallel.
 func ScrapeSwarm1kInfohash(b *testing.B, ps PeerStore) {
 	runBenchmark(b, ps, true, putPeers, func(i int, ps PeerStore, bd *benchData) error {
-		ps.ScrapeSwarm(bd.infohashes[i%1000], bittorrent.IPv4)
+		ps.ScrapeSwarm(context.Background(), bd.infohashes[i%1000], bittorrent.IPv4)
 		return nil
 	})
 }
@@ -1,12 +1,14 @@
 package storage
 
 import (
+	"context"
 	"net"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 
 	"github.com/chihaya/chihaya/bittorrent"
+	"github.com/chihaya/chihaya/internal/chisquare"
 )
 
 // PeerEqualityFunc is the boolean function to use to check two Peers for
@@ -41,111 +43,151 @@ func TestPeerStore(t *testing.T, p PeerStore) {
 		}
 
 		// Test ErrDNE for non-existent swarms.
-		err := p.DeleteLeecher(c.ih, c.peer)
+		err := p.DeleteLeecher(context.Background(), c.ih, c.peer)
 		require.Equal(t, ErrResourceDoesNotExist, err)
 
-		err = p.DeleteSeeder(c.ih, c.peer)
+		err = p.DeleteSeeder(context.Background(), c.ih, c.peer)
 		require.Equal(t, ErrResourceDoesNotExist, err)
 
-		_, err = p.AnnouncePeers(c.ih, false, 50, peer)
+		_, err = p.AnnouncePeers(context.Background(), c.ih, false, 50, peer)
+		require.Equal(t, ErrResourceDoesNotExist, err)
+
+		_, err = p.AnnounceSeeders(context.Background(), c.ih, 50, peer)
+		require.Equal(t, ErrResourceDoesNotExist, err)
+
+		_, err = p.AnnounceLeechers(context.Background(), c.ih, 50, peer)
 		require.Equal(t, ErrResourceDoesNotExist, err)
 
 		// Test empty scrape response for non-existent swarms.
-		scrape := p.ScrapeSwarm(c.ih, c.peer.IP.AddressFamily)
+		scrape := p.ScrapeSwarm(context.Background(), c.ih, c.peer.IP.AddressFamily)
 		require.Equal(t, uint32(0), scrape.Complete)
 		require.Equal(t, uint32(0), scrape.Incomplete)
 		require.Equal(t, uint32(0), scrape.Snatches)
 
 		// Insert dummy Peer to keep swarm active
 		// Has the same address family as c.peer
-		err = p.PutLeecher(c.ih, peer)
+		err = p.PutLeecher(context.Background(), c.ih, peer)
 		require.Nil(t, err)
 
+		if lister, ok := p.(SwarmLister); ok {
+			infoHashes, err := lister.ListSwarms(context.Background())
+			require.Nil(t, err)
+			require.Contains(t, infoHashes, c.ih)
+		}
+
 		// Test ErrDNE for non-existent seeder.
-		err = p.DeleteSeeder(c.ih, peer)
+		err = p.DeleteSeeder(context.Background(), c.ih, peer)
 		require.Equal(t, ErrResourceDoesNotExist, err)
 
 		// Test PutLeecher -> Announce -> DeleteLeecher -> Announce
 
-		err = p.PutLeecher(c.ih, c.peer)
+		err = p.PutLeecher(context.Background(), c.ih, c.peer)
 		require.Nil(t, err)
 
-		peers, err := p.AnnouncePeers(c.ih, true, 50, peer)
+		peers, err := p.AnnouncePeers(context.Background(), c.ih, true, 50, peer)
 		require.Nil(t, err)
 		require.True(t, containsPeer(peers, c.peer))
 
 		// non-seeder announce should still return the leecher
-		peers, err = p.AnnouncePeers(c.ih, false, 50, peer)
+		peers, err = p.AnnouncePeers(context.Background(), c.ih, false, 50, peer)
 		require.Nil(t, err)
 		require.True(t, containsPeer(peers, c.peer))
 
-		scrape = p.ScrapeSwarm(c.ih, c.peer.IP.AddressFamily)
+		scrape = p.ScrapeSwarm(context.Background(), c.ih, c.peer.IP.AddressFamily)
 		require.Equal(t, uint32(2), scrape.Incomplete)
 		require.Equal(t, uint32(0), scrape.Complete)
 
-		err = p.DeleteLeecher(c.ih, c.peer)
+		err = p.DeleteLeecher(context.Background(), c.ih, c.peer)
 		require.Nil(t, err)
 
-		peers, err = p.AnnouncePeers(c.ih, true, 50, peer)
+		peers, err = p.AnnouncePeers(context.Background(), c.ih, true, 50, peer)
 		require.Nil(t, err)
 		require.False(t, containsPeer(peers, c.peer))
 
 		// Test PutSeeder -> Announce -> DeleteSeeder -> Announce
 
-		err = p.PutSeeder(c.ih, c.peer)
+		err = p.PutSeeder(context.Background(), c.ih, c.peer)
 		require.Nil(t, err)
 
 		// Should be leecher to see the seeder
-		peers, err = p.AnnouncePeers(c.ih, false, 50, peer)
+		peers, err = p.AnnouncePeers(context.Background(), c.ih, false, 50, peer)
 		require.Nil(t, err)
 		require.True(t, containsPeer(peers, c.peer))
 
-		scrape = p.ScrapeSwarm(c.ih, c.peer.IP.AddressFamily)
+		scrape = p.ScrapeSwarm(context.Background(), c.ih, c.peer.IP.AddressFamily)
 		require.Equal(t, uint32(1), scrape.Incomplete)
 		require.Equal(t, uint32(1), scrape.Complete)
 
-		err = p.DeleteSeeder(c.ih, c.peer)
+		// Typed retrieval only returns peers of the requested kind.
+		peers, err = p.AnnounceSeeders(context.Background(), c.ih, 50, peer)
 		require.Nil(t, err)
+		require.True(t, containsPeer(peers, c.peer))
 
-		peers, err = p.AnnouncePeers(c.ih, false, 50, peer)
+		peers, err = p.AnnounceLeechers(context.Background(), c.ih, 50, peer)
+		require.Nil(t, err)
+		require.False(t, containsPeer(peers, c.peer))
+		require.False(t, containsPeer(peers, peer))
+
+		peers, err = p.AnnounceLeechers(context.Background(), c.ih, 50, c.peer)
+		require.Nil(t, err)
+		require.True(t, containsPeer(peers, peer))
+
+		peers, err = p.AnnounceSeeders(context.Background(), c.ih, 0, peer)
+		require.Nil(t, err)
+		require.Len(t, peers, 0)
+
+		err = p.DeleteSeeder(context.Background(), c.ih, c.peer)
+		require.Nil(t, err)
+
+		peers, err = p.AnnouncePeers(context.Background(), c.ih, false, 50, peer)
 		require.Nil(t, err)
 		require.False(t, containsPeer(peers, c.peer))
 
 		// Test PutLeecher -> Graduate -> Announce -> DeleteLeecher -> Announce
 
-		err = p.PutLeecher(c.ih, c.peer)
+		err = p.PutLeecher(context.Background(), c.ih, c.peer)
 		require.Nil(t, err)
 
-		err = p.GraduateLeecher(c.ih, c.peer)
+		err = p.GraduateLeecher(context.Background(), c.ih, c.peer)
 		require.Nil(t, err)
 
+		scrape = p.ScrapeSwarm(context.Background(), c.ih, c.peer.IP.AddressFamily)
+		require.Equal(t, uint32(1), scrape.Snatches)
+
+		// Graduating a Seeder again isn't another snatch.
+		err = p.GraduateLeecher(context.Background(), c.ih, c.peer)
+		require.Nil(t, err)
+
+		scrape = p.ScrapeSwarm(context.Background(), c.ih, c.peer.IP.AddressFamily)
+		require.Equal(t, uint32(1), scrape.Snatches)
+
 		// Has to be leecher to see the graduated seeder
-		peers, err = p.AnnouncePeers(c.ih, false, 50, peer)
+		peers, err = p.AnnouncePeers(context.Background(), c.ih, false, 50, peer)
 		require.Nil(t, err)
 		require.True(t, containsPeer(peers, c.peer))
 
 		// Deleting the Peer as a Leecher should have no effect
-		err = p.DeleteLeecher(c.ih, c.peer)
+		err = p.DeleteLeecher(context.Background(), c.ih, c.peer)
 		require.Equal(t, ErrResourceDoesNotExist, err)
 
 		// Verify it's still there
-		peers, err = p.AnnouncePeers(c.ih, false, 50, peer)
+		peers, err = p.AnnouncePeers(context.Background(), c.ih, false, 50, peer)
 		require.Nil(t, err)
 		require.True(t, containsPeer(peers, c.peer))
 
 		// Clean up
 
-		err = p.DeleteLeecher(c.ih, peer)
+		err = p.DeleteLeecher(context.Background(), c.ih, peer)
 		require.Nil(t, err)
 
 		// Test ErrDNE for missing leecher
-		err = p.DeleteLeecher(c.ih, peer)
+		err = p.DeleteLeecher(context.Background(), c.ih, peer)
 		require.Equal(t, ErrResourceDoesNotExist, err)
 
-		err = p.DeleteSeeder(c.ih, c.peer)
+		err = p.DeleteSeeder(context.Background(), c.ih, c.peer)
 		require.Nil(t, err)
 
-		err = p.DeleteSeeder(c.ih, c.peer)
+		err = p.DeleteSeeder(context.Background(), c.ih, c.peer)
 		require.Equal(t, ErrResourceDoesNotExist, err)
 	}
 
@@ -153,6 +195,78 @@ func TestPeerStore(t *testing.T, p PeerStore) {
 	require.Nil(t, <-e)
 }
 
+// TestPeerSelection tests that a PeerStore returns peers uniformly at random
+// if a swarm has more peers than requested, so that no peer is starved.
+//
+// The PeerStore is stopped afterwards.
+func TestPeerSelection(t *testing.T, p PeerStore) {
+	const (
+		swarmSize = 40
+		numWant   = 10
+		trials    = 2000
+	)
+
+	ctx := context.Background()
+	ih := bittorrent.InfoHashFromString("00000000000000000003")
+	peer := func(i int) bittorrent.Peer {
+		return bittorrent.Peer{
+			ID:   bittorrent.PeerID{byte(i)},
+			IP:   bittorrent.IP{IP: net.IPv4(10, 0, 0, byte(i)).To4(), AddressFamily: bittorrent.IPv4},
+			Port: uint16(i),
+		}
+	}
+	for i := 0; i < swarmSize; i++ {
+		require.Nil(t, p.PutSeeder(ctx, ih, peer(i)))
+		require.Nil(t, p.PutLeecher(ctx, ih, peer(swarmSize+i)))
+	}
+	announcer := peer(2 * swarmSize)
+
+	// Seeders are identified by ports below swarmSize, leechers by ports
+	// above.
+	for _, tt := range []struct {
+		name     string
+		seeders  bool
+		announce func() ([]bittorrent.Peer, error)
+	}{
+		{"AnnouncePeers as leecher", true, func() ([]bittorrent.Peer, error) {
+			return p.AnnouncePeers(ctx, ih, false, numWant, announcer)
+		}},
+		{"AnnouncePeers as seeder", false, func() ([]bittorrent.Peer, error) {
+			return p.AnnouncePeers(ctx, ih, true, numWant, announcer)
+		}},
+		{"AnnounceSeeders", true, func() ([]bittorrent.Peer, error) {
+			return p.AnnounceSeeders(ctx, ih, numWant, announcer)
+		}},
+		{"AnnounceLeechers", false, func() ([]bittorrent.Peer, error) {
+			return p.AnnounceLeechers(ctx, ih, numWant, announcer)
+		}},
+	} {
+		counts := make([]int, swarmSize)
+		for i := 0; i < trials; i++ {
+			peers, err := tt.announce()
+			require.Nil(t, err, tt.name)
+			require.Len(t, peers, numWant, tt.name)
+			for _, returned := range peers {
+				i := int(returned.Port)
+				if !tt.seeders {
+					i -= swarmSize
+				}
+				require.True(t, i >= 0 && i < swarmSize, "%s returned an unexpected peer %s", tt.name, returned)
+				counts[i]++
+			}
+		}
+		chisquare.RequireUniform(t, counts, tt.name)
+	}
+
+	for i := 0; i < swarmSize; i++ {
+		require.Nil(t, p.DeleteSeeder(ctx, ih, peer(i)))
+		require.Nil(t, p.DeleteLeecher(ctx, ih, peer(swarmSize+i)))
+	}
+
+	e := p.Stop()
+	require.Nil(t, <-e)
+}
+
 func containsPeer(peers []bittorrent.Peer, p bittorrent.Peer) bool {
 	for _, peer := range peers {
 		if PeerEqualityFunc(peer, p) {
@@ -161,3 +275,86 @@ func containsPeer(peers []bittorrent.Peer, p bittorrent.Peer) bool {
 	}
 	return false
 }
+
+// TestIPStore tests an IPStore implementation against the interface.
+//
+// The IPStore is stopped afterwards.
+func TestIPStore(t *testing.T, s IPStore) {
+	ctx := context.Background()
+	v4 := net.ParseIP("1.2.3.4")
+	v6 := net.ParseIP("abab::0001")
+
+	for _, ip := range []net.IP{v4, v4.To4(), v6} {
+		has, err := s.HasIP(ctx, ip)
+		require.Nil(t, err)
+		require.False(t, has)
+	}
+	require.Equal(t, ErrResourceDoesNotExist, s.RemoveIP(ctx, v4))
+	require.Equal(t, ErrResourceDoesNotExist, s.RemoveNetwork(ctx, "1.2.3.0/24"))
+
+	// IPv4 addresses match in both forms.
+	require.Nil(t, s.AddIP(ctx, v4.To4()))
+	require.Nil(t, s.AddIP(ctx, v6))
+	for _, ip := range []net.IP{v4, v4.To4(), v6} {
+		has, err := s.HasIP(ctx, ip)
+		require.Nil(t, err)
+		require.True(t, has)
+	}
+	require.Nil(t, s.RemoveIP(ctx, v4))
+	require.Nil(t, s.RemoveIP(ctx, v6))
+	has, err := s.HasIP(ctx, v4)
+	require.Nil(t, err)
+	require.False(t, has)
+
+	require.Nil(t, s.AddNetwork(ctx, "1.2.3.0/24"))
+	require.Nil(t, s.AddNetwork(ctx, "abab::/16"))
+	for _, ip := range []net.IP{v4, v4.To4(), v6} {
+		has, err := s.HasIP(ctx, ip)
+		require.Nil(t, err)
+		require.True(t, has)
+	}
+	has, err = s.HasIP(ctx, net.ParseIP("1.2.4.1"))
+	require.Nil(t, err)
+	require.False(t, has)
+	require.NotNil(t, s.AddNetwork(ctx, "1.2.3.4"))
+
+	// Removing a single address leaves the ranges containing it.
+	require.Equal(t, ErrResourceDoesNotExist, s.RemoveIP(ctx, v4))
+	require.Nil(t, s.RemoveNetwork(ctx, "1.2.3.0/24"))
+	require.Nil(t, s.RemoveNetwork(ctx, "abab::/16"))
+	has, err = s.HasIP(ctx, v6)
+	require.Nil(t, err)
+	require.False(t, has)
+
+	e := s.Stop()
+	require.Nil(t, <-e)
+}
+
+// TestStringStore tests a StringStore implementation against the interface.
+//
+// The StringStore is stopped afterwards.
+func TestStringStore(t *testing.T, s StringStore) {
+	ctx := context.Background()
+
+	has, err := s.HasString(ctx, "qB4250")
+	require.Nil(t, err)
+	require.False(t, has)
+	require.Equal(t, ErrResourceDoesNotExist, s.RemoveString(ctx, "qB4250"))
+
+	require.Nil(t, s.PutString(ctx, "qB4250"))
+	require.Nil(t, s.PutString(ctx, "qB4250"))
+	has, err = s.HasString(ctx, "qB4250")
+	require.Nil(t, err)
+	require.True(t, has)
+	has, err = s.HasString(ctx, "qB425")
+	require.Nil(t, err)
+	require.False(t, has)
+
+	require.Nil(t, s.RemoveString(ctx, "qB4250"))
+	has, err = s.HasString(ctx, "qB4250")
+	require.Nil(t, err)
+	require.False(t, has)
+
+	e := s.Stop()
+	require.Nil(t, <-e)
+}